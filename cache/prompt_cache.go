@@ -1,12 +1,15 @@
 package cache
 
 import (
+	"container/list"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"sync"
 	"time"
 
+	"kiro/lifecycle"
 	"kiro/types"
 	"kiro/utils"
 )
@@ -16,6 +19,9 @@ type CacheEntry struct {
 	Tokens  int       // 该内容的 token 数
 	ExpTime time.Time // 过期时间
 	TTL     string    // "5m" 或 "1h"，用于刷新
+
+	key  string        // 条目的 hash
+	elem *list.Element // 在 LRU 链表中的位置
 }
 
 // CacheResult 表示缓存处理结果
@@ -25,74 +31,151 @@ type CacheResult struct {
 	CacheReadTokens     int // 命中缓存的 token 数
 }
 
+// Limits 缓存容量上限，0 表示不限制
+type Limits struct {
+	MaxEntries int // 最大条目数
+	MaxTokens  int // 所有条目估算 token 数之和的上限
+}
+
+// Stats 缓存的当前规模和累计计数（命中/未命中按断点查询计数）
+type Stats struct {
+	Entries    int   `json:"entries"`
+	Tokens     int   `json:"tokens"`
+	MaxEntries int   `json:"max_entries"`
+	MaxTokens  int   `json:"max_tokens"`
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+	Evictions  int64 `json:"evictions"` // 因超出容量被淘汰的条目数（不含过期清理）
+}
+
 // PromptCache 提示缓存管理器
+// 超出 Limits 时按最近最少使用（LRU）淘汰条目，不必等到定期清理
 type PromptCache struct {
 	mu      sync.RWMutex
 	entries map[string]*CacheEntry
+	lru     *list.List // 最近使用的在前
+	tokens  int        // 所有条目的 token 数之和
+	limits  Limits
+	cleaner *lifecycle.Task
+
+	hits      int64
+	misses    int64
+	evictions int64
 }
 
-// globalCache 全局缓存实例
-var globalCache *PromptCache
+// defaultCleanInterval 未配置清理间隔时的默认值
+const defaultCleanInterval = 5 * time.Minute
 
-// InitGlobalCache 初始化全局缓存并启动清理协程
-func InitGlobalCache(cleanInterval time.Duration) {
-	globalCache = NewPromptCache()
-	globalCache.StartCleaner(cleanInterval)
+// StartPromptCache 创建缓存实例并启动清理协程，cleanInterval 非正数时使用默认的 5 分钟
+func StartPromptCache(cleanInterval time.Duration, limits Limits) *PromptCache {
+	if cleanInterval <= 0 {
+		cleanInterval = defaultCleanInterval
+	}
+	pc := NewPromptCache()
+	pc.limits = limits
+	pc.StartCleaner(cleanInterval)
 	utils.Log("Prompt Cache 已初始化",
-		utils.LogString("clean_interval", cleanInterval.String()))
+		utils.LogString("clean_interval", cleanInterval.String()),
+		utils.LogString("ttl", "5m/1h"),
+		utils.LogInt("max_entries", limits.MaxEntries),
+		utils.LogInt("max_tokens", limits.MaxTokens))
+	return pc
 }
 
-// GetGlobalCache 获取全局缓存实例
-func GetGlobalCache() *PromptCache {
-	return globalCache
-}
-
-// NewPromptCache 创建新的缓存实例
+// NewPromptCache 创建新的缓存实例（不限制容量）
 func NewPromptCache() *PromptCache {
 	return &PromptCache{
 		entries: make(map[string]*CacheEntry),
+		lru:     list.New(),
 	}
 }
 
-// Get 获取缓存条目并刷新 TTL
+// Get 获取缓存条目，命中时刷新 TTL 并标记为最近使用
 func (c *PromptCache) Get(hash string) (*CacheEntry, bool) {
-	c.mu.RLock()
-	entry, exists := c.entries[hash]
-	c.mu.RUnlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
+	entry, exists := c.touchLocked(hash)
 	if !exists {
+		c.misses++
 		return nil, false
 	}
+	c.hits++
+	return entry, true
+}
 
-	// 使用单次 time.Now() 调用
-	now := time.Now()
+// touchLocked 查找未过期的条目并刷新 TTL，不计入命中统计（调用方持有锁）
+func (c *PromptCache) touchLocked(hash string) (*CacheEntry, bool) {
+	entry, exists := c.entries[hash]
+	if !exists {
+		return nil, false
+	}
 
-	// 检查是否过期
+	now := time.Now()
 	if now.After(entry.ExpTime) {
 		// 已过期，删除条目
-		c.mu.Lock()
-		delete(c.entries, hash)
-		c.mu.Unlock()
+		c.removeLocked(entry)
 		return nil, false
 	}
 
-	// 刷新 TTL（使用已获取的 now）
-	c.mu.Lock()
 	entry.ExpTime = calculateExpTimeFrom(now, entry.TTL)
-	c.mu.Unlock()
-
+	c.lru.MoveToFront(entry.elem)
 	return entry, true
 }
 
-// Set 创建缓存条目
+// Set 创建或覆盖缓存条目，超出容量时淘汰最久未使用的条目
 func (c *PromptCache) Set(hash string, tokens int, ttl string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.entries[hash] = &CacheEntry{
+	if old, exists := c.entries[hash]; exists {
+		c.removeLocked(old)
+	}
+	entry := &CacheEntry{
 		Tokens:  tokens,
 		ExpTime: calculateExpTime(ttl),
 		TTL:     ttl,
+		key:     hash,
+	}
+	entry.elem = c.lru.PushFront(entry)
+	c.entries[hash] = entry
+	c.tokens += tokens
+
+	for c.overLimitLocked() {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			break
+		}
+		c.removeLocked(oldest.Value.(*CacheEntry))
+		c.evictions++
+	}
+}
+
+// overLimitLocked 是否超出容量上限（调用方持有锁）
+func (c *PromptCache) overLimitLocked() bool {
+	return (c.limits.MaxEntries > 0 && len(c.entries) > c.limits.MaxEntries) ||
+		(c.limits.MaxTokens > 0 && c.tokens > c.limits.MaxTokens)
+}
+
+// removeLocked 删除条目（调用方持有锁）
+func (c *PromptCache) removeLocked(entry *CacheEntry) {
+	delete(c.entries, entry.key)
+	c.lru.Remove(entry.elem)
+	c.tokens -= entry.Tokens
+}
+
+// Stats 返回缓存的当前规模和累计计数
+func (c *PromptCache) Stats() Stats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return Stats{
+		Entries:    len(c.entries),
+		Tokens:     c.tokens,
+		MaxEntries: c.limits.MaxEntries,
+		MaxTokens:  c.limits.MaxTokens,
+		Hits:       c.hits,
+		Misses:     c.misses,
+		Evictions:  c.evictions,
 	}
 }
 
@@ -103,9 +186,9 @@ func (c *PromptCache) CleanExpired() {
 
 	now := time.Now()
 	cleaned := 0
-	for hash, entry := range c.entries {
+	for _, entry := range c.entries {
 		if now.After(entry.ExpTime) {
-			delete(c.entries, hash)
+			c.removeLocked(entry)
 			cleaned++
 		}
 	}
@@ -119,12 +202,36 @@ func (c *PromptCache) CleanExpired() {
 
 // StartCleaner 启动定期清理协程
 func (c *PromptCache) StartCleaner(interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	go func() {
-		for range ticker.C {
-			c.CleanExpired()
+	c.cleaner.Stop()
+	c.cleaner = lifecycle.Go("prompt-cache-cleaner", func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.CleanExpired()
+			}
 		}
-	}()
+	})
+}
+
+// StopCleaner 停止定期清理协程
+func (c *PromptCache) StopCleaner() {
+	c.cleaner.Stop()
+}
+
+// Flush 清空所有缓存条目，返回清除的条目数
+func (c *PromptCache) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	flushed := len(c.entries)
+	c.entries = make(map[string]*CacheEntry)
+	c.lru.Init()
+	c.tokens = 0
+	return flushed
 }
 
 // Size 返回当前缓存条目数（用于调试）
@@ -134,69 +241,136 @@ func (c *PromptCache) Size() int {
 	return len(c.entries)
 }
 
+// cacheLookbackBlocks 每个断点向前查找已缓存前缀的最大块数（与官方一致）
+const cacheLookbackBlocks = 20
+
+// cacheItem 参与前缀累计的单个内容块
+type cacheItem struct {
+	hash   string // 这个块自身内容的 hash
+	tokens int    // 这个块的 token 数
+	hasCc  bool   // 是否有 cache_control 断点
+	ttl    string // ephemeral TTL
+}
+
 // ProcessRequest 处理请求的缓存逻辑（官方前缀累计方式）
-// 官方逻辑：cache_control 是断点标记，缓存的是从头到断点的所有内容的累计前缀。
-// 断点处用前缀 hash 做 key，命中时 cache_read = 累计 token 数。
-// 只有最后一个命中的断点生效（最长前缀匹配）。
-func ProcessRequest(req types.AnthropicRequest, inputTokens int) *CacheResult {
-	pc := GetGlobalCache()
-	if pc == nil {
+// 官方逻辑：cache_control 是断点标记，缓存的是从头到断点的所有内容的累计前缀，
+// 前缀按 tools → system → messages 的顺序排列（与官方渲染提示词的顺序一致）。
+// 每个块的前缀 hash 由上一个块的前缀 hash 和该块自身的 hash 链式计算，只有连续相同的前缀才会命中。
+// 每个断点在自身及之前最多 20 个块中查找已缓存的最长前缀：
+//   - cache_read = 命中的最长前缀的累计 token 数
+//   - cache_creation = 最后一个断点的累计 token 数 - cache_read（命中位置之后的断点都会写入缓存）
+//
+// 前缀 key 包含模型和全部工具定义的 hash：官方缓存按模型隔离，工具定义位于前缀最前面，
+// 相同文本换了模型或工具集不会命中。
+// 不同命名空间（如不同租户）之间的缓存条目互不可见；nil 缓存（未启用）按无缓存统计。
+func (c *PromptCache) ProcessRequest(req types.AnthropicRequest, inputTokens int, namespace string) *CacheResult {
+	if c == nil {
 		return &CacheResult{TotalTokens: inputTokens}
 	}
 
-	estimator := utils.NewTokenEstimator()
 	result := &CacheResult{TotalTokens: inputTokens}
-	minTokens := GetMinCacheTokens(req.Model)
+	items := collectCacheItems(utils.NewTokenEstimator(), req)
+
+	// prefixHashes[i] / cumulative[i]：前 i+1 个块构成的前缀的 hash 和累计 token 数
+	prefixHashes := make([]string, len(items))
+	cumulative := make([]int, len(items))
+	prefix := computeHash(cacheKeyScope(req, namespace))
+	total := 0
+	for i, item := range items {
+		prefix = computeHash(prefix + "|" + item.hash)
+		total += item.tokens
+		prefixHashes[i] = prefix
+		cumulative[i] = total
+	}
 
-	// 收集所有内容块，按顺序构建前缀
-	type contentItem struct {
-		hash   string // 这个块自身内容的 hash
-		tokens int    // 这个块的 token 数
-		hasCc  bool   // 是否有 cache_control 断点
-		ttl    string // ephemeral TTL
+	// 查找已缓存的最长前缀
+	readEnd, lastBreakpoint := -1, -1
+	for i, item := range items {
+		if !item.hasCc {
+			continue
+		}
+		lastBreakpoint = i
+		if end := c.longestCachedPrefix(prefixHashes, i, readEnd); end > readEnd {
+			readEnd = end
+		}
+	}
+	if lastBreakpoint < 0 {
+		return result
+	}
+	if readEnd >= 0 {
+		result.CacheReadTokens = cumulative[readEnd]
 	}
-	var items []contentItem
 
-	// 处理 system 消息
-	for _, sysMsg := range req.System {
-		if sysMsg.Text == "" {
+	// 命中位置之后的断点写入缓存，未达到模型最小可缓存 token 数的前缀不缓存
+	minTokens := GetMinCacheTokens(req.Model)
+	for i := readEnd + 1; i <= lastBreakpoint; i++ {
+		if !items[i].hasCc || cumulative[i] < minTokens {
 			continue
 		}
-		hash := computeHash(sysMsg.Text)
-		tokens := estimator.EstimateTextTokens(sysMsg.Text) + 2
-		hasCc := sysMsg.CacheControl != nil && sysMsg.CacheControl.Type == "ephemeral"
-		ttl := ""
-		if hasCc && sysMsg.CacheControl.TTL != "" {
-			ttl = sysMsg.CacheControl.TTL
+		ttl := items[i].ttl
+		if ttl == "" {
+			ttl = "5m"
+		}
+		c.Set(prefixHashes[i], cumulative[i], ttl)
+		result.CacheCreationTokens = cumulative[i] - result.CacheReadTokens
+	}
+
+	return result
+}
+
+// longestCachedPrefix 从断点 breakpoint 向前查找已缓存的前缀（不早于 after），返回前缀结束位置，未命中返回 -1
+// 每个断点计一次命中或未命中
+func (c *PromptCache) longestCachedPrefix(prefixHashes []string, breakpoint, after int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := breakpoint; i > after && i > breakpoint-cacheLookbackBlocks; i-- {
+		if _, ok := c.touchLocked(prefixHashes[i]); ok {
+			c.hits++
+			return i
 		}
-		items = append(items, contentItem{hash: hash, tokens: tokens, hasCc: hasCc, ttl: ttl})
 	}
+	c.misses++
+	return -1
+}
+
+// collectCacheItems 按 tools → system → messages 的顺序收集参与前缀累计的内容块
+func collectCacheItems(estimator *utils.TokenEstimator, req types.AnthropicRequest) []cacheItem {
+	var items []cacheItem
 
-	// 处理 tools（在 system 之后、messages 之前，参与前缀累计）
 	for _, tool := range req.Tools {
 		if tool.Name == "" {
 			continue
 		}
-		data, err := json.Marshal(tool)
-		if err != nil {
+		hash, ok := toolDefinitionHash(tool)
+		if !ok {
 			continue
 		}
-		hash := computeHashBytes(data)
-		tokens := estimator.EstimateToolUseTokens(tool.Name, tool.InputSchema)
-		hasCc := tool.CacheControl != nil && tool.CacheControl.Type == "ephemeral"
-		ttl := ""
-		if hasCc && tool.CacheControl.TTL != "" {
-			ttl = tool.CacheControl.TTL
+		items = append(items, cacheItem{
+			hash:   hash,
+			tokens: estimator.EstimateToolUseTokens(tool.Name, tool.InputSchema),
+			hasCc:  tool.CacheControl != nil && tool.CacheControl.Type == "ephemeral",
+			ttl:    cacheControlTTL(tool.CacheControl),
+		})
+	}
+
+	for _, sysMsg := range req.System {
+		if sysMsg.Text == "" {
+			continue
 		}
-		items = append(items, contentItem{hash: hash, tokens: tokens, hasCc: hasCc, ttl: ttl})
+		items = append(items, cacheItem{
+			hash:   computeHash(sysMsg.Text),
+			tokens: estimator.EstimateTextTokens(sysMsg.Text) + 2,
+			hasCc:  sysMsg.CacheControl != nil && sysMsg.CacheControl.Type == "ephemeral",
+			ttl:    cacheControlTTL(sysMsg.CacheControl),
+		})
 	}
 
-	// 处理 messages（按顺序遍历所有内容块）
 	for _, msg := range req.Messages {
 		switch content := msg.Content.(type) {
 		case string:
 			if content != "" {
-				items = append(items, contentItem{
+				items = append(items, cacheItem{
 					hash: computeHash(content), tokens: estimator.EstimateTextTokens(content),
 				})
 			}
@@ -206,84 +380,32 @@ func ProcessRequest(req types.AnthropicRequest, inputTokens int) *CacheResult {
 				if !ok {
 					continue
 				}
-				item := extractContentItem(estimator, blockMap)
-				if item != nil {
+				if item := extractContentItem(estimator, blockMap); item != nil {
 					items = append(items, *item)
 				}
 			}
 		case []types.ContentBlock:
 			for _, block := range content {
-				item := extractTypedContentItem(estimator, block)
-				if item != nil {
+				if item := extractTypedContentItem(estimator, block); item != nil {
 					items = append(items, *item)
 				}
 			}
 		}
 	}
 
-	// 构建前缀 hash 并在断点处检查缓存
-	// 前缀 hash = hash(block1.hash + block2.hash + ... + blockN.hash)
-	var prefixParts []string
-	var cumulativeTokens int
-
-	// 记录最后一个命中的断点
-	var lastReadTokens int
-	var lastCreateTokens int
-	var lastCreateTTL string
-	var hasRead bool
-	var hasCreate bool
-
-	for _, item := range items {
-		prefixParts = append(prefixParts, item.hash)
-		cumulativeTokens += item.tokens
-
-		if !item.hasCc {
-			continue
-		}
-
-		// 到达断点，用前缀 hash 检查缓存
-		prefixHash := computeHash(joinHashes(prefixParts))
-
-		entry, exists := pc.Get(prefixHash)
-		if exists {
-			// 命中：记录这个断点的累计 token（后面的断点可能覆盖）
-			lastReadTokens = entry.Tokens
-			hasRead = true
-			// 清除之前可能标记的 create（更长前缀命中了）
-			hasCreate = false
-		} else if cumulativeTokens >= minTokens {
-			// 未命中且达到最小 token 要求：标记为待创建
-			lastCreateTokens = cumulativeTokens
-			lastCreateTTL = item.ttl
-			if lastCreateTTL == "" {
-				lastCreateTTL = "5m"
-			}
-			hasCreate = true
-			// 不立即写入，等确定最终状态
-
-			// 写入缓存
-			pc.Set(prefixHash, cumulativeTokens, lastCreateTTL)
-		}
-	}
+	return items
+}
 
-	// 应用最终结果：只报最后一个有效断点
-	if hasRead {
-		result.CacheReadTokens = lastReadTokens
+// cacheControlTTL 返回 ephemeral 断点的 TTL，未设置时为空
+func cacheControlTTL(cc *types.CacheControl) string {
+	if cc == nil || cc.Type != "ephemeral" {
+		return ""
 	}
-	if hasCreate {
-		result.CacheCreationTokens = lastCreateTokens
-	}
-
-	return result
+	return cc.TTL
 }
 
 // extractContentItem 从 map 格式内容块提取缓存信息
-func extractContentItem(estimator *utils.TokenEstimator, blockMap map[string]any) *struct {
-	hash   string
-	tokens int
-	hasCc  bool
-	ttl    string
-} {
+func extractContentItem(estimator *utils.TokenEstimator, blockMap map[string]any) *cacheItem {
 	blockType, _ := blockMap["type"].(string)
 
 	var hash string
@@ -362,21 +484,11 @@ func extractContentItem(estimator *utils.TokenEstimator, blockMap map[string]any
 		}
 	}
 
-	return &struct {
-		hash   string
-		tokens int
-		hasCc  bool
-		ttl    string
-	}{hash: hash, tokens: tokens, hasCc: hasCc, ttl: ttl}
+	return &cacheItem{hash: hash, tokens: tokens, hasCc: hasCc, ttl: ttl}
 }
 
 // extractTypedContentItem 从结构化内容块提取缓存信息
-func extractTypedContentItem(estimator *utils.TokenEstimator, block types.ContentBlock) *struct {
-	hash   string
-	tokens int
-	hasCc  bool
-	ttl    string
-} {
+func extractTypedContentItem(estimator *utils.TokenEstimator, block types.ContentBlock) *cacheItem {
 	var hash string
 	var tokens int
 
@@ -424,12 +536,32 @@ func extractTypedContentItem(estimator *utils.TokenEstimator, block types.Conten
 		ttl = block.CacheControl.TTL
 	}
 
-	return &struct {
-		hash   string
-		tokens int
-		hasCc  bool
-		ttl    string
-	}{hash: hash, tokens: tokens, hasCc: hasCc, ttl: ttl}
+	return &cacheItem{hash: hash, tokens: tokens, hasCc: hasCc, ttl: ttl}
+}
+
+// cacheKeyScope 返回前缀 key 的作用域：命名空间 + 模型 + 全部工具定义的 hash
+func cacheKeyScope(req types.AnthropicRequest, namespace string) string {
+	var toolHashes []string
+	for _, tool := range req.Tools {
+		if hash, ok := toolDefinitionHash(tool); ok {
+			toolHashes = append(toolHashes, hash)
+		}
+	}
+	scope := req.Model + "#" + computeHash(joinHashes(toolHashes)) + "#"
+	if namespace != "" {
+		scope = namespace + "#" + scope
+	}
+	return scope
+}
+
+// toolDefinitionHash 计算工具定义的 hash，不含 cache_control（移动断点不改变工具定义）
+func toolDefinitionHash(tool types.AnthropicTool) (string, bool) {
+	tool.CacheControl = nil
+	data, err := json.Marshal(tool)
+	if err != nil {
+		return "", false
+	}
+	return computeHashBytes(data), true
 }
 
 // joinHashes 拼接 hash 列表用于前缀 hash
@@ -0,0 +1,170 @@
+// mock-upstream 端到端测试用的上游替身
+// 模拟 Kiro token 刷新端点、用量查询端点和 CodeWhisperer GenerateAssistantResponse（AWS event-stream 响应），
+// 配合 docker/e2e/docker-compose.yml 在不访问真实上游的情况下验证代理的完整请求链路
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"kiro/internal/eventstreamtest"
+)
+
+/**
+ * 用户消息中的控制指令（便于测试脚本触发不同的上游行为）：
+ *   [mock:429]    返回 429 限流（额度未耗尽）
+ *   [mock:quota]  返回 429 并将额度标记为耗尽（之后用量查询端点报告额度已用完，不可恢复，需放在测试最后）
+ *   [mock:403]    返回 403（账号封禁）
+ *   [mock:drop]   发送部分事件后断开连接
+ *   [mock:stall]  发送部分事件后停止发送数据（不断开）
+ * 其他消息回显为 "echo: <消息内容>"
+ */
+
+// accessToken 刷新端点签发的 access token，生成请求必须携带
+const accessToken = "mock-access-token"
+
+// quotaExhausted 是否已通过 [mock:quota] 耗尽额度
+var quotaExhausted atomic.Bool
+
+func main() {
+	addr := os.Getenv("MOCK_ADDR")
+	if addr == "" {
+		addr = ":9000"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /refreshToken", handleRefresh)
+	mux.HandleFunc("POST /token", handleRefresh)
+	mux.HandleFunc("GET /getUsageLimits", handleUsageLimits)
+	mux.HandleFunc("POST /", handleGenerate)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	log.Printf("mock upstream listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// handleRefresh Kiro / OIDC 刷新端点，任意非空 refresh token 均可刷新
+func handleRefresh(w http.ResponseWriter, r *http.Request) {
+	var req map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+		return
+	}
+	if rt, _ := req["refreshToken"].(string); rt == "" || rt == "invalid" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	writeJSON(w, map[string]any{
+		"accessToken": accessToken,
+		"expiresIn":   3600,
+		"profileArn":  "arn:aws:codewhisperer:us-east-1:000000000000:profile/MOCKPROFILE",
+	})
+}
+
+// handleUsageLimits 用量查询端点，额度耗尽前返回未使用的额度
+func handleUsageLimits(w http.ResponseWriter, r *http.Request) {
+	used := 0
+	if quotaExhausted.Load() {
+		used = 1000
+	}
+	writeJSON(w, map[string]any{
+		"usageBreakdownList": []any{map[string]any{
+			"resourceType":              "AGENTIC_REQUEST",
+			"currentUsage":              used,
+			"currentUsageWithPrecision": used,
+			"usageLimit":                1000,
+			"usageLimitWithPrecision":   1000,
+			"nextDateReset":             time.Now().Add(24 * time.Hour).Unix(),
+		}},
+	})
+}
+
+// handleGenerate GenerateAssistantResponse，按控制指令返回对应的响应
+func handleGenerate(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+accessToken {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"message":"invalid access token"}`))
+		return
+	}
+
+	var req struct {
+		ConversationState struct {
+			CurrentMessage struct {
+				UserInputMessage struct {
+					Content string `json:"content"`
+				} `json:"userInputMessage"`
+			} `json:"currentMessage"`
+		} `json:"conversationState"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message":"malformed request"}`))
+		return
+	}
+	content := req.ConversationState.CurrentMessage.UserInputMessage.Content
+
+	switch {
+	case strings.Contains(content, "[mock:quota]"):
+		quotaExhausted.Store(true)
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"message":"Monthly request limit reached","reason":"MONTHLY_REQUEST_COUNT"}`))
+		return
+	case strings.Contains(content, "[mock:429]"):
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"message":"Too many requests","reason":"THROTTLING"}`))
+		return
+	case strings.Contains(content, "[mock:403]"):
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"message":"Account suspended"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	chunks := []string{"echo: ", lastLine(content)}
+	for _, chunk := range chunks {
+		w.Write(eventstreamtest.Frame("assistantResponseEvent", map[string]any{"content": chunk}))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	switch {
+	case strings.Contains(content, "[mock:drop]"):
+		// 中途断开：劫持连接直接关闭，客户端读取时得到 unexpected EOF
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+			}
+		}
+	case strings.Contains(content, "[mock:stall]"):
+		// 停止发送数据直到客户端断开
+		<-r.Context().Done()
+	}
+}
+
+// lastLine 返回消息的最后一个非空行（代理会在用户消息前注入提示词）
+func lastLine(content string) string {
+	lines := strings.Split(strings.TrimSpace(content), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
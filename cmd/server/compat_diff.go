@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+ * compat-diff 子命令：把同一组请求分别发给代理和官方 Anthropic API，比较响应结构
+ * 只比较结构（字段路径、JSON 类型、type 取值、流式事件序列），不比较模型生成的文本，
+ * 用于在用户遇到之前发现兼容性回归
+ */
+
+// compatCase 一个对比用例，每个用例分别以非流式和流式各发送一次
+type compatCase struct {
+	Name    string
+	Request map[string]any
+}
+
+// compatCases 内置用例：纯文本、强制工具调用、思维链
+// 非思维链用例显式关闭 thinking，避免代理默认注入的思维链掩盖其他差异
+var compatCases = []compatCase{
+	{"text", map[string]any{
+		"max_tokens": 64,
+		"thinking":   map[string]any{"type": "disabled"},
+		"messages":   []any{map[string]any{"role": "user", "content": "Reply with the single word: pong"}},
+	}},
+	{"tool_use", map[string]any{
+		"max_tokens": 256,
+		"thinking":   map[string]any{"type": "disabled"},
+		"messages":   []any{map[string]any{"role": "user", "content": "What is the weather in Paris?"}},
+		"tools": []any{map[string]any{
+			"name":        "get_weather",
+			"description": "Get the current weather for a city",
+			"input_schema": map[string]any{
+				"type":       "object",
+				"properties": map[string]any{"city": map[string]any{"type": "string"}},
+				"required":   []any{"city"},
+			},
+		}},
+		"tool_choice": map[string]any{"type": "tool", "name": "get_weather"},
+	}},
+	{"thinking", map[string]any{
+		"max_tokens": 2048,
+		"thinking":   map[string]any{"type": "enabled", "budget_tokens": 1024},
+		"messages":   []any{map[string]any{"role": "user", "content": "What is 17 * 23? Answer with the number only."}},
+	}},
+}
+
+// compatOpaqueFields 内容由模型决定的字段，不展开比较其内部结构
+var compatOpaqueFields = map[string]bool{"input": true}
+
+// compatDifference 一处结构差异，缺失的一侧为 "(missing)"
+type compatDifference struct {
+	Path      string `json:"path"`
+	Proxy     string `json:"proxy"`
+	Anthropic string `json:"anthropic"`
+}
+
+// compatResult 单个用例（含流式/非流式）的对比结果
+type compatResult struct {
+	Case        string             `json:"case"`
+	Stream      bool               `json:"stream"`
+	Identical   bool               `json:"identical"`
+	Error       string             `json:"error,omitempty"`
+	Differences []compatDifference `json:"differences,omitempty"`
+}
+
+// compatReport compat-diff 的输出
+type compatReport struct {
+	Identical bool           `json:"identical"`
+	Results   []compatResult `json:"results"`
+}
+
+// compatEndpoint 一个被对比的 API 端点
+type compatEndpoint struct {
+	baseURL string
+	apiKey  string
+}
+
+// compatDiffCommand 执行 compat-diff 子命令，以 JSON 输出对比报告
+// 存在差异时退出码为 1，参数错误时为 2
+func compatDiffCommand(args []string) int {
+	fs := flag.NewFlagSet("compat-diff", flag.ExitOnError)
+	proxyURL := fs.String("proxy", "http://localhost:1188", "代理地址")
+	proxyKey := fs.String("proxy-key", "", "访问代理使用的 API Key（refresh token 或租户 key）")
+	anthropicURL := fs.String("anthropic-url", "https://api.anthropic.com", "官方 API 地址")
+	anthropicKey := fs.String("anthropic-key", os.Getenv("ANTHROPIC_API_KEY"), "官方 API Key，默认读取 ANTHROPIC_API_KEY")
+	model := fs.String("model", "claude-sonnet-4-5", "两侧使用的模型")
+	requestFile := fs.String("request", "", "自定义请求体（JSON 文件），指定时只对比该请求，按其 stream 字段发送")
+	fs.Parse(args)
+
+	if *proxyKey == "" || *anthropicKey == "" {
+		fmt.Println("需要同时提供 --proxy-key 和 --anthropic-key（或 ANTHROPIC_API_KEY）")
+		return 2
+	}
+
+	cases := compatCases
+	streams := []bool{false, true}
+	if *requestFile != "" {
+		data, err := os.ReadFile(*requestFile)
+		if err != nil {
+			fmt.Printf("读取请求文件失败: %v\n", err)
+			return 2
+		}
+		var req map[string]any
+		if err := json.Unmarshal(data, &req); err != nil {
+			fmt.Printf("解析请求文件失败: %v\n", err)
+			return 2
+		}
+		stream, _ := req["stream"].(bool)
+		cases = []compatCase{{Name: *requestFile, Request: req}}
+		streams = []bool{stream}
+	}
+
+	proxy := compatEndpoint{baseURL: *proxyURL, apiKey: *proxyKey}
+	official := compatEndpoint{baseURL: *anthropicURL, apiKey: *anthropicKey}
+	report := compatReport{Identical: true, Results: []compatResult{}}
+	for _, tc := range cases {
+		for _, stream := range streams {
+			req := make(map[string]any, len(tc.Request)+2)
+			for k, v := range tc.Request {
+				req[k] = v
+			}
+			if _, ok := req["model"]; !ok {
+				req["model"] = *model
+			}
+			req["stream"] = stream
+
+			result := runCompatCase(proxy, official, req)
+			result.Case = tc.Name
+			result.Stream = stream
+			report.Identical = report.Identical && result.Identical
+			report.Results = append(report.Results, result)
+		}
+	}
+
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+	if !report.Identical {
+		return 1
+	}
+	return 0
+}
+
+// runCompatCase 向两侧发送同一请求并比较响应结构
+func runCompatCase(proxy, official compatEndpoint, req map[string]any) compatResult {
+	body, _ := json.Marshal(req)
+	stream, _ := req["stream"].(bool)
+
+	proxyShape, err := fetchCompatShape(proxy, body, stream)
+	if err != nil {
+		return compatResult{Error: fmt.Sprintf("请求代理失败: %v", err)}
+	}
+	officialShape, err := fetchCompatShape(official, body, stream)
+	if err != nil {
+		return compatResult{Error: fmt.Sprintf("请求官方 API 失败: %v", err)}
+	}
+
+	diffs := diffCompatShapes(proxyShape, officialShape)
+	return compatResult{Identical: len(diffs) == 0, Differences: diffs}
+}
+
+// fetchCompatShape 发送请求并提取响应结构：状态码、Content-Type、事件序列和字段路径
+func fetchCompatShape(endpoint compatEndpoint, body []byte, stream bool) (map[string]string, error) {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(endpoint.baseURL, "/")+"/v1/messages", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", endpoint.apiKey)
+	req.Header.Set("anthropic-version", "2023-06-01")
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	shape := map[string]string{"status": fmt.Sprint(resp.StatusCode)}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	shape["header.content-type"] = mediaType
+
+	if !stream || resp.StatusCode != http.StatusOK {
+		var v any
+		if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+			return nil, fmt.Errorf("解析响应失败: %v", err)
+		}
+		collectCompatShape("body", v, shape)
+		return shape, nil
+	}
+
+	events, err := readCompatEvents(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var sequence []string
+	for _, ev := range events {
+		label := compatEventLabel(ev.name, ev.data)
+		if len(sequence) == 0 || sequence[len(sequence)-1] != label {
+			sequence = append(sequence, label)
+		}
+		if name, _ := ev.data["type"].(string); name != ev.name {
+			shape["event["+label+"].name"] = fmt.Sprintf("event: %s, data.type: %s", ev.name, name)
+		}
+		collectCompatShape("event["+label+"]", ev.data, shape)
+	}
+	// 连续相同的事件合并为一个，序列只反映事件的先后结构，不受文本长度影响
+	shape["events"] = strings.Join(sequence, " → ")
+	return shape, nil
+}
+
+// compatEvent 一个 SSE 事件
+type compatEvent struct {
+	name string
+	data map[string]any
+}
+
+// readCompatEvents 读取 SSE 响应中的全部事件
+func readCompatEvents(r io.Reader) ([]compatEvent, error) {
+	var events []compatEvent
+	var current compatEvent
+	var data strings.Builder
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data.Len() > 0 {
+				if err := json.Unmarshal([]byte(data.String()), &current.data); err != nil {
+					return nil, fmt.Errorf("解析事件 %s 失败: %v", current.name, err)
+				}
+				events = append(events, current)
+			}
+			current = compatEvent{}
+			data.Reset()
+		case strings.HasPrefix(line, "event:"):
+			current.name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+		}
+	}
+	return events, scanner.Err()
+}
+
+// compatEventLabel 事件在序列中的标签，内容块和增量事件附带块/增量类型
+func compatEventLabel(name string, data map[string]any) string {
+	var sub map[string]any
+	switch name {
+	case "content_block_start":
+		sub, _ = data["content_block"].(map[string]any)
+	case "content_block_delta":
+		sub, _ = data["delta"].(map[string]any)
+	}
+	if t, ok := sub["type"].(string); ok {
+		return name + "(" + t + ")"
+	}
+	return name
+}
+
+// collectCompatShape 记录 JSON 值中每个字段路径的类型
+// 数组中带 type 字段的对象按 type 分组（如 content[type=text]），type 字段本身记录取值
+func collectCompatShape(path string, v any, shape map[string]string) {
+	switch val := v.(type) {
+	case map[string]any:
+		shape[path] = "object"
+		for key, child := range val {
+			childPath := path + "." + key
+			if compatOpaqueFields[key] {
+				shape[childPath] = compatJSONType(child)
+				continue
+			}
+			if s, ok := child.(string); ok && key == "type" {
+				shape[childPath] = "string(" + s + ")"
+				continue
+			}
+			collectCompatShape(childPath, child, shape)
+		}
+	case []any:
+		shape[path] = "array"
+		for _, item := range val {
+			itemPath := path + "[]"
+			if obj, ok := item.(map[string]any); ok {
+				if t, ok := obj["type"].(string); ok {
+					itemPath = path + "[type=" + t + "]"
+				}
+			}
+			collectCompatShape(itemPath, item, shape)
+		}
+	default:
+		shape[path] = compatJSONType(v)
+	}
+}
+
+// compatJSONType JSON 值的类型名
+func compatJSONType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// diffCompatShapes 比较两侧的结构，按路径排序输出差异
+func diffCompatShapes(proxy, official map[string]string) []compatDifference {
+	paths := make([]string, 0, len(proxy)+len(official))
+	for path := range proxy {
+		paths = append(paths, path)
+	}
+	for path := range official {
+		if _, ok := proxy[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	var diffs []compatDifference
+	for _, path := range paths {
+		p, inProxy := proxy[path]
+		o, inOfficial := official[path]
+		if inProxy && inOfficial && p == o {
+			continue
+		}
+		if !inProxy {
+			p = "(missing)"
+		}
+		if !inOfficial {
+			o = "(missing)"
+		}
+		diffs = append(diffs, compatDifference{Path: path, Proxy: p, Anthropic: o})
+	}
+	return diffs
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+)
+
+// hashKeyCommand 执行 hash-key 子命令：生成（或读取）本地 API Key 并输出其 SHA256
+// 明文 key 交给客户端，哈希值写入 data/tenants.json 的 api_keys（"sha256:" 前缀）或 keys[].key_hash
+func hashKeyCommand(args []string) int {
+	fs := flag.NewFlagSet("hash-key", flag.ExitOnError)
+	fs.Parse(args)
+
+	key := fs.Arg(0)
+	if key == "" {
+		buf := make([]byte, 24)
+		if _, err := rand.Read(buf); err != nil {
+			fmt.Printf("生成随机 key 失败: %v\n", err)
+			return 1
+		}
+		key = "sk-kiro-" + hex.EncodeToString(buf)
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	fmt.Printf("key:      %s\n", key)
+	fmt.Printf("key_hash: sha256:%s\n", hex.EncodeToString(sum[:]))
+	return 0
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"kiro/config"
 	"kiro/server"
 
 	"github.com/joho/godotenv"
@@ -12,13 +16,28 @@ import (
 func main() {
 	godotenv.Load()
 
-	server.StartTokenRefresher()
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "1188"
+	if len(os.Args) > 1 && os.Args[1] == "validate-config" {
+		os.Exit(validateConfig(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "hash-key" {
+		os.Exit(hashKeyCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "compat-diff" {
+		os.Exit(compatDiffCommand(os.Args[2:]))
 	}
 
-	fmt.Printf("Kiro2API Proxy Server starting on port %s\n", port)
-	server.StartServer(port)
+	// 加载配置文件（可选），之后的配置读取均使用合并后的快照
+	config.Init()
+
+	srv := server.New()
+	srv.StartTokenRefresher()
+	fmt.Printf("Kiro2API Proxy Server starting on port %s\n", srv.Port())
+
+	// 收到 SIGINT/SIGTERM 时优雅退出
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := srv.ListenAndServe(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
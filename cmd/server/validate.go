@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	"kiro/server"
+)
+
+// validateConfig 执行 validate-config 子命令，以 JSON 输出校验报告
+// 存在错误时退出码为 1；指定 --strict 时警告也视为失败
+func validateConfig(args []string) int {
+	fs := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	strict := fs.Bool("strict", false, "将警告视为失败")
+	fs.Parse(args)
+
+	report := server.ValidateConfig()
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+
+	if !report.Valid || (*strict && report.Warnings > 0) {
+		return 1
+	}
+	return 0
+}
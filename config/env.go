@@ -0,0 +1,215 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+/**
+ * 环境变量配置项
+ * 只能通过环境变量设置的运行配置与配置文件项一样保存在 Settings 快照中，读取方统一通过 Current() 获取。
+ * 下面的表同时用于构建默认配置（defaultSettings）和 validate-config 的校验（ValidateEnv），
+ * 新增环境变量只需在表中登记一次。凭证（API Key、AWS / Vault 凭证等）和各子系统的连接参数
+ * （Anthropic 回退、Bedrock、评估旁路、追踪导出）仍由对应的初始化函数直接读取
+ */
+
+// envInt 整数环境变量：无法解析时使用默认值，小于 minimum 时 validate-config 报错
+type envInt struct {
+	key          string
+	defaultValue int
+	minimum      int
+	target       func(*Settings) *int
+}
+
+// envEnum 枚举环境变量：空值表示默认行为，取值不区分大小写
+type envEnum struct {
+	key     string
+	allowed []string
+	target  func(*Settings) *string
+}
+
+// envBool 布尔环境变量：true / 1 开启，false / 0 关闭，其他值使用默认值
+type envBool struct {
+	key          string
+	defaultValue bool
+	target       func(*Settings) *bool
+}
+
+// envString 字符串环境变量，未设置时为空
+type envString struct {
+	key    string
+	target func(*Settings) *string
+}
+
+var envInts = []envInt{
+	{"MAX_TOOL_DESCRIPTION_LENGTH", 10000, 1, func(s *Settings) *int { return &s.MaxToolDescriptionLength }},
+	{"MAX_INPUT_JSON_DELTA_BYTES", 16384, 0, func(s *Settings) *int { return &s.MaxInputJSONDeltaBytes }},
+	{"UPSTREAM_WRITE_RATE_KB", 4096, 0, func(s *Settings) *int { return &s.UpstreamWriteRateKB }},
+	{"UPSTREAM_TTFB_BUDGET_SECONDS", 0, 0, func(s *Settings) *int { return &s.UpstreamTTFBBudgetSeconds }},
+	{"STREAM_IDLE_TIMEOUT_SECONDS", 300, 0, func(s *Settings) *int { return &s.StreamIdleTimeoutSeconds }},
+	{"TOKEN_REFRESH_MAX_ATTEMPTS", 3, 1, func(s *Settings) *int { return &s.TokenRefreshMaxAttempts }},
+	{"TOKEN_REFRESH_BACKOFF_MS", 500, 0, func(s *Settings) *int { return &s.TokenRefreshBackoffMs }},
+	{"UPSTREAM_RETRY_MAX_ATTEMPTS", 3, 1, func(s *Settings) *int { return &s.UpstreamRetryMaxAttempts }},
+	{"UPSTREAM_RETRY_BACKOFF_MS", 500, 0, func(s *Settings) *int { return &s.UpstreamRetryBackoffMs }},
+	{"RATE_LIMIT_RPM", 0, 0, func(s *Settings) *int { return &s.KeyRequestsPerMinute }},
+	{"RATE_LIMIT_TPM", 0, 0, func(s *Settings) *int { return &s.KeyTokensPerMinute }},
+	{"LONG_CONTEXT_WINDOW_TOKENS", 0, 0, func(s *Settings) *int { return &s.LongContextWindowTokens }},
+	{"MAX_CONCURRENT_REQUESTS", 0, 0, func(s *Settings) *int { return &s.MaxConcurrentRequests }},
+	{"MAX_CONCURRENT_PER_TOKEN", 0, 0, func(s *Settings) *int { return &s.MaxConcurrentPerToken }},
+	{"CONCURRENCY_QUEUE_SIZE", 0, 0, func(s *Settings) *int { return &s.ConcurrencyQueueSize }},
+	{"CONCURRENCY_QUEUE_TIMEOUT_SECONDS", 30, 1, func(s *Settings) *int { return &s.ConcurrencyQueueTimeoutSeconds }},
+	{"UPSTREAM_WARMUP_INTERVAL_SECONDS", 0, 0, func(s *Settings) *int { return &s.UpstreamWarmupIntervalSeconds }},
+	{"DNS_CACHE_TTL_SECONDS", 0, 0, func(s *Settings) *int { return &s.DNSCacheTTLSeconds }},
+	{"HAPPY_EYEBALLS_DELAY_MS", 300, 0, func(s *Settings) *int { return &s.HappyEyeballsDelayMs }},
+	{"UPSTREAM_TOP_K_MAX", 500, 0, func(s *Settings) *int { return &s.UpstreamTopKMax }},
+	{"PROMPT_CACHE_CLEAN_INTERVAL_SECONDS", 300, 1, func(s *Settings) *int { return &s.PromptCacheCleanIntervalSeconds }},
+	{"PROMPT_CACHE_MAX_ENTRIES", 100000, 0, func(s *Settings) *int { return &s.PromptCacheMaxEntries }},
+	{"PROMPT_CACHE_MAX_TOKENS", 0, 0, func(s *Settings) *int { return &s.PromptCacheMaxTokens }},
+	{"CODE_EXECUTION_TIMEOUT_SECONDS", 30, 1, func(s *Settings) *int { return &s.CodeExecutionTimeoutSeconds }},
+	{"REQUEST_LOG_SIZE", 0, 0, func(s *Settings) *int { return &s.RequestLogSize }},
+	{"CONVERSATION_STORE_SIZE", 0, 0, func(s *Settings) *int { return &s.ConversationStoreSize }},
+	{"BAN_INCIDENT_LOG_SIZE", 100, 0, func(s *Settings) *int { return &s.BanIncidentLogSize }},
+	{"ABUSE_CONVERSATION_RPM", 0, 0, func(s *Settings) *int { return &s.AbuseConversationRPM }},
+	{"ABUSE_IDENTICAL_PROMPT_LIMIT", 0, 0, func(s *Settings) *int { return &s.AbuseIdenticalPromptLimit }},
+	{"ABUSE_IDENTICAL_WINDOW_SECONDS", 60, 1, func(s *Settings) *int { return &s.AbuseIdenticalWindowSeconds }},
+	{"ABUSE_DELAY_MS", 2000, 0, func(s *Settings) *int { return &s.AbuseDelayMs }},
+	{"HISTORY_TURN_SOFT_LIMIT", 0, 0, func(s *Settings) *int { return &s.HistoryTurnSoftLimit }},
+	{"HISTORY_TURN_HARD_LIMIT", 0, 0, func(s *Settings) *int { return &s.HistoryTurnHardLimit }},
+	{"TOKEN_PREFLIGHT_AFTER_SECONDS", 0, 0, func(s *Settings) *int { return &s.TokenPreflightAfterSeconds }},
+	{"BATCH_CONCURRENCY", 4, 1, func(s *Settings) *int { return &s.BatchConcurrency }},
+	{"BATCH_MAX_REQUESTS", 10000, 1, func(s *Settings) *int { return &s.BatchMaxRequests }},
+	{"TTFT_SLO_MS", 0, 0, func(s *Settings) *int { return &s.TTFTSLOMs }},
+	{"TTFT_SLO_WINDOW_SECONDS", 300, 1, func(s *Settings) *int { return &s.TTFTSLOWindowSeconds }},
+	{"TTFT_SLO_CONSECUTIVE_CHECKS", 3, 1, func(s *Settings) *int { return &s.TTFTSLOConsecutiveChecks }},
+	{"TTFT_SLO_MIN_SAMPLES", 20, 1, func(s *Settings) *int { return &s.TTFTSLOMinSamples }},
+	{"REQUEST_BODY_MAX_BYTES", 32 * 1024 * 1024, 0, func(s *Settings) *int { return &s.RequestBodyMaxBytes }},
+	{"IMAGE_MAX_BYTES", 20 * 1024 * 1024, 1, func(s *Settings) *int { return &s.ImageMaxBytes }},
+	{"IMAGE_MAX_DIMENSION", 8000, 1, func(s *Settings) *int { return &s.ImageMaxDimension }},
+	{"IMAGE_DOWNSCALE_DIMENSION", 0, 0, func(s *Settings) *int { return &s.ImageDownscaleDimension }},
+}
+
+var envEnums = []envEnum{
+	{"GIN_MODE", []string{"debug", "release", "test"}, func(s *Settings) *string { return &s.GinMode }},
+	{"ROOT_MODE", []string{"redirect", "status", "health", "none"}, func(s *Settings) *string { return &s.RootMode }},
+	{"UPSTREAM_IP_PREFERENCE", []string{"auto", "ipv4", "ipv6", "prefer-ipv4", "prefer-ipv6"}, func(s *Settings) *string { return &s.UpstreamIPPreference }},
+	{"TOKENIZER", []string{"approx"}, func(s *Settings) *string { return &s.Tokenizer }},
+	{"PROMPT_CACHE", []string{"enabled", "disabled"}, func(s *Settings) *string { return &s.PromptCacheMode }},
+	{"PROMPT_CACHE_SCOPE", []string{"key", "tenant"}, func(s *Settings) *string { return &s.PromptCacheScope }},
+	{"TLS_MIN_VERSION", []string{"1.0", "1.1", "1.2", "1.3"}, func(s *Settings) *string { return &s.TLSMinVersion }},
+	{"SSE_FIELD_STYLE", []string{"strict-anthropic", "lenient"}, func(s *Settings) *string { return &s.SSEFieldStyle }},
+	{"TOKEN_PREFLIGHT_MODE", []string{"refresh", "probe"}, func(s *Settings) *string { return &s.TokenPreflightMode }},
+}
+
+var envBools = []envBool{
+	{"UPSTREAM_FORWARD_SAMPLING", true, func(s *Settings) *bool { return &s.UpstreamForwardSampling }},
+	{"TOKEN_SCOPE_CHECK", true, func(s *Settings) *bool { return &s.TokenScopeCheck }},
+	{"DISABLE_RAW_TOKEN_AUTH", false, func(s *Settings) *bool { return &s.RawTokenAuthDisabled }},
+	{"ALLOW_DEBUG_ECHO", false, func(s *Settings) *bool { return &s.AllowDebugEcho }},
+	{"SSE_GZIP", false, func(s *Settings) *bool { return &s.SSEGzip }},
+	{"SSE_COALESCE_DELTAS", false, func(s *Settings) *bool { return &s.SSECoalesceDeltas }},
+	{"ANTHROPIC_PASSTHROUGH", false, func(s *Settings) *bool { return &s.AnthropicPassthrough }},
+	{"COST_HEADER", false, func(s *Settings) *bool { return &s.CostHeader }},
+	{"GENAI_SEMCONV_LOG", false, func(s *Settings) *bool { return &s.GenAISemconvLog }},
+}
+
+var envStrings = []envString{
+	{"BIND_ADDRESS", func(s *Settings) *string { return &s.BindAddress }},
+	{"HTTP_REDIRECT_PORT", func(s *Settings) *string { return &s.HTTPRedirectPort }},
+	{"TLS_CERT_FILE", func(s *Settings) *string { return &s.TLSCertFile }},
+	{"TLS_KEY_FILE", func(s *Settings) *string { return &s.TLSKeyFile }},
+	{"TLS_AUTOCERT_DOMAINS", func(s *Settings) *string { return &s.TLSAutocertDomains }},
+	{"TLS_AUTOCERT_CACHE_DIR", func(s *Settings) *string { return &s.TLSAutocertCacheDir }},
+	{"TLS_AUTOCERT_EMAIL", func(s *Settings) *string { return &s.TLSAutocertEmail }},
+	{"ROOT_REDIRECT_URL", func(s *Settings) *string { return &s.RootRedirectURL }},
+	{"DISABLED_FEATURES", func(s *Settings) *string { return &s.DisabledFeatures }},
+	{"ANTHROPIC_PASSTHROUGH_BASE_URL", func(s *Settings) *string { return &s.AnthropicPassthroughBaseURL }},
+	{"ABUSE_SHAPING_EXEMPT_KEYS", func(s *Settings) *string { return &s.AbuseShapingExemptKeys }},
+	{"CODE_EXECUTION_COMMAND", func(s *Settings) *string { return &s.CodeExecutionCommand }},
+	{"WEB_SEARCH_PROVIDER", func(s *Settings) *string { return &s.WebSearchProvider }},
+	{"WEB_SEARCH_URL", func(s *Settings) *string { return &s.WebSearchURL }},
+	{"WEB_SEARCH_API_KEY", func(s *Settings) *string { return &s.WebSearchAPIKey }},
+	{"BAN_INCIDENT_LOG", func(s *Settings) *string { return &s.BanIncidentLog }},
+	{"USAGE_DB", func(s *Settings) *string { return &s.UsageDB }},
+	{"BATCH_DB", func(s *Settings) *string { return &s.BatchDB }},
+	{"TOKEN_CACHE_DB", func(s *Settings) *string { return &s.TokenCacheDB }},
+	{"TTFT_SLO_MODELS", func(s *Settings) *string { return &s.TTFTSLOModels }},
+	{"TTFT_SLO_WEBHOOK_URL", func(s *Settings) *string { return &s.TTFTSLOWebhookURL }},
+}
+
+// applyEnv 将环境变量写入配置快照，未设置或无法解析的项使用默认值
+func applyEnv(s *Settings) {
+	for _, e := range envInts {
+		*e.target(s) = getEnvIntWithDefault(e.key, e.defaultValue)
+	}
+	for _, e := range envEnums {
+		*e.target(s) = strings.ToLower(strings.TrimSpace(os.Getenv(e.key)))
+	}
+	for _, e := range envBools {
+		value, ok := parseEnvBool(os.Getenv(e.key))
+		if !ok {
+			value = e.defaultValue
+		}
+		*e.target(s) = value
+	}
+	for _, e := range envStrings {
+		*e.target(s) = os.Getenv(e.key)
+	}
+}
+
+// parseEnvBool 解析布尔环境变量，空值或无法识别时返回 false
+func parseEnvBool(value string) (enabled, ok bool) {
+	switch value {
+	case "true", "1":
+		return true, true
+	case "false", "0":
+		return false, true
+	}
+	return false, false
+}
+
+// EnvProblem 环境变量的取值问题，validate-config 以 env.<Key> 报告
+type EnvProblem struct {
+	Key     string
+	Message string
+}
+
+// ValidateEnv 校验登记的整数、枚举和布尔环境变量的格式与取值范围
+func ValidateEnv() []EnvProblem {
+	var problems []EnvProblem
+	for _, e := range envInts {
+		value := os.Getenv(e.key)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			problems = append(problems, EnvProblem{e.key, fmt.Sprintf("不是有效的整数: %q（将被忽略并使用默认值）", value)})
+			continue
+		}
+		if n < e.minimum {
+			problems = append(problems, EnvProblem{e.key, fmt.Sprintf("取值 %d 小于最小值 %d", n, e.minimum)})
+		}
+	}
+
+	for _, e := range envEnums {
+		value := strings.ToLower(strings.TrimSpace(os.Getenv(e.key)))
+		if value == "" {
+			continue
+		}
+		if !slices.Contains(e.allowed, value) {
+			problems = append(problems, EnvProblem{e.key, fmt.Sprintf("无效取值 %q，可选值: %s", value, strings.Join(e.allowed, ", "))})
+		}
+	}
+
+	for _, e := range envBools {
+		if value := os.Getenv(e.key); value != "" {
+			if _, ok := parseEnvBool(value); !ok {
+				problems = append(problems, EnvProblem{e.key, fmt.Sprintf("无效取值 %q，可选值: true, false, 1, 0（将使用默认值 %v）", value, e.defaultValue)})
+			}
+		}
+	}
+	return problems
+}
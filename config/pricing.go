@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"path"
+)
+
+// ModelPricing 模型价格（美元 / 百万 token）
+type ModelPricing struct {
+	Input      float64 `json:"input"`
+	Output     float64 `json:"output"`
+	CacheRead  float64 `json:"cache_read"`
+	CacheWrite float64 `json:"cache_write"`
+}
+
+// pricingEntry 配置文件中的价格项，缓存价格未设置时按输入价推算（读取 0.1 倍、写入 1.25 倍）
+type pricingEntry struct {
+	Input      *float64 `yaml:"input"`
+	Output     *float64 `yaml:"output"`
+	CacheRead  *float64 `yaml:"cache_read"`
+	CacheWrite *float64 `yaml:"cache_write"`
+}
+
+// defaultPricing 内置的模型族价格（官方公开价格），按模型名通配符匹配
+func defaultPricing() map[string]ModelPricing {
+	return map[string]ModelPricing{
+		"*opus*":   derivedPricing(5, 25),
+		"*sonnet*": derivedPricing(3, 15),
+		"*haiku*":  derivedPricing(1, 5),
+	}
+}
+
+// derivedPricing 按输入价推算缓存读写价格
+func derivedPricing(input, output float64) ModelPricing {
+	return ModelPricing{Input: input, Output: output, CacheRead: input * 0.1, CacheWrite: input * 1.25}
+}
+
+// parsePricing 校验配置文件中的价格表并与内置价格合并（同名项覆盖内置价格）
+func parsePricing(entries map[string]pricingEntry) (map[string]ModelPricing, error) {
+	pricing := defaultPricing()
+	for pattern, e := range entries {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("pricing.%s: 通配符无效", pattern)
+		}
+		if e.Input == nil || e.Output == nil {
+			return nil, fmt.Errorf("pricing.%s: input 和 output 不能为空", pattern)
+		}
+		p := derivedPricing(*e.Input, *e.Output)
+		if e.CacheRead != nil {
+			p.CacheRead = *e.CacheRead
+		}
+		if e.CacheWrite != nil {
+			p.CacheWrite = *e.CacheWrite
+		}
+		if p.Input < 0 || p.Output < 0 || p.CacheRead < 0 || p.CacheWrite < 0 {
+			return nil, fmt.Errorf("pricing.%s: 价格不能为负数", pattern)
+		}
+		pricing[pattern] = p
+	}
+	return pricing, nil
+}
+
+/**
+ * PriceFor 返回模型的价格
+ * 精确匹配的项优先，其次是匹配的通配符中最长（最具体）的一项；没有匹配项时 ok 为 false
+ */
+func (s *Settings) PriceFor(model string) (price ModelPricing, ok bool) {
+	if p, exact := s.Pricing[model]; exact {
+		return p, true
+	}
+	best := ""
+	for pattern, p := range s.Pricing {
+		if matched, err := path.Match(pattern, model); err != nil || !matched {
+			continue
+		}
+		if len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best) {
+			best, price, ok = pattern, p, true
+		}
+	}
+	return price, ok
+}
+
+// Cost 按价格计算费用（美元），inputTokens 为未命中缓存的输入 token
+func (p ModelPricing) Cost(inputTokens, outputTokens, cacheReadTokens, cacheWriteTokens int) float64 {
+	return (float64(inputTokens)*p.Input +
+		float64(outputTokens)*p.Output +
+		float64(cacheReadTokens)*p.CacheRead +
+		float64(cacheWriteTokens)*p.CacheWrite) / 1_000_000
+}
@@ -0,0 +1,549 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"kiro/lifecycle"
+
+	"github.com/goccy/go-yaml"
+)
+
+// Settings 可热重载的运行配置快照
+// 默认值来自内置常量和环境变量，配置文件中设置的项覆盖默认值；重载时整体替换快照，读取方无需加锁
+type Settings struct {
+	// ModelMap 模型映射表（映射到 CodeWhisperer 实际支持的模型 ID）
+	// 注意：当模型不在映射表中时，将直接透传原始模型ID
+	ModelMap map[string]string
+
+	// Port 监听端口（仅启动时生效）
+	Port string
+
+	// CodeWhispererURL Kiro API 的 URL (使用根路径，通过 x-amz-target 头路由)
+	CodeWhispererURL string
+	// UpstreamEndpoints 多区域上游端点，按顺序优先使用健康的端点；为空时只使用 CodeWhispererURL
+	UpstreamEndpoints []UpstreamEndpoint
+	// UsageLimitsURL 账号用量查询端点 URL
+	UsageLimitsURL string
+	// MCPURL MCP 端点 URL
+	MCPURL string
+	// RefreshTokenURL Kiro 刷新token的URL (Kiro Desktop 端点，用于原生 Kiro refresh token)
+	RefreshTokenURL string
+	// AmazonQTokenURL AmazonQ OIDC token刷新URL
+	AmazonQTokenURL string
+	// OIDCTokenURLFormat IAM Identity Center 按区域的 OIDC token刷新URL
+	OIDCTokenURLFormat string
+
+	// MaxToolDescriptionLength 工具描述的最大长度（字符数），默认 10000
+	MaxToolDescriptionLength int
+	// MaxInputJSONDeltaBytes 单个 input_json_delta 事件的最大字节数，超过时拆分为多个事件，0 表示不拆分
+	MaxInputJSONDeltaBytes int
+	// UpstreamWriteRateKB 大请求体上传上游时的平滑速率（KB/s），0 表示不限速
+	UpstreamWriteRateKB int
+	// UpstreamTTFBBudgetSeconds 流式请求等待上游首字节的预算（秒）
+	// 超出预算时池化请求切换到池中下一个 token 重试一次，否则返回可重试的 529 错误；0 表示不限制
+	UpstreamTTFBBudgetSeconds int
+	// StreamIdleTimeoutSeconds 流式响应中上游持续无数据的最长时间（秒）
+	// 超时后以 error 事件和完整的结束事件序列结束 SSE 响应；0 表示不限制
+	StreamIdleTimeoutSeconds int
+	// TokenRefreshMaxAttempts token 刷新的最大尝试次数（网络错误、429 和 5xx 时重试），1 表示不重试
+	TokenRefreshMaxAttempts int
+	// TokenRefreshBackoffMs token 刷新重试的初始退避时间（毫秒），每次重试翻倍并附加随机抖动
+	TokenRefreshBackoffMs int
+	// UpstreamRetryMaxAttempts 上游临时故障（连接错误、超时、5xx）时的最大尝试次数，1 表示不重试
+	UpstreamRetryMaxAttempts int
+	// UpstreamRetryBackoffMs 上游重试的初始退避时间（毫秒），每次重试翻倍并附加随机抖动
+	UpstreamRetryBackoffMs int
+	// KeyRequestsPerMinute 每个本地 API Key 每分钟的请求数上限，0 表示不限制
+	KeyRequestsPerMinute int
+	// KeyTokensPerMinute 每个本地 API Key 每分钟的 token 用量（输入 + 输出）上限，0 表示不限制
+	KeyTokensPerMinute int
+	// LongContextWindowTokens 客户端启用 context-1m beta 时的上下文窗口（token）
+	// 0 表示上游不支持长上下文，仍按 ContextWindowTokens 处理
+	LongContextWindowTokens int
+	// MaxConcurrentRequests 同时进行的上游请求总数上限，0 表示不限制
+	MaxConcurrentRequests int
+	// MaxConcurrentPerToken 单个上游 token 同时进行的请求数上限，0 表示不限制
+	MaxConcurrentPerToken int
+	// ConcurrencyQueueSize 并发已满时允许排队等待的请求数，0 表示不排队直接拒绝
+	ConcurrencyQueueSize int
+	// ConcurrencyQueueTimeoutSeconds 排队等待的最长时间（秒），超时后按队列已满处理
+	ConcurrencyQueueTimeoutSeconds int
+
+	// AgenticPrompt 是否在最后一条用户消息以 "-agent" 开头时注入分块写入提示
+	AgenticPrompt bool
+	// ThinkingPrompt 是否在请求启用 thinking 时注入 Thinking 模式提示
+	ThinkingPrompt bool
+
+	// Pricing 模型价格表（键为模型名或通配符），用于用量记录的费用估算
+	Pricing map[string]ModelPricing
+
+	// 以下各项只能通过环境变量设置（见 env.go），标注"仅启动时生效"的项在启动后修改不影响运行中的服务
+
+	// GinMode gin 运行模式：debug、release、test（GIN_MODE，仅启动时生效）
+	GinMode string
+	// BindAddress 监听的地址（IP 字面量或 localhost），为空时同时监听所有 IPv4 和 IPv6 地址（BIND_ADDRESS，仅启动时生效）
+	BindAddress string
+	// HTTPRedirectPort 启用 HTTPS 时额外监听的 HTTP 端口，将请求 301 重定向到 HTTPS
+	// （自动签发证书时同时应答 HTTP-01 验证，HTTP_REDIRECT_PORT，仅启动时生效）
+	HTTPRedirectPort string
+	// TLSCertFile、TLSKeyFile 监听 HTTPS 使用的证书和私钥（PEM）路径，两者都设置时启用 HTTPS（TLS_CERT_FILE、TLS_KEY_FILE，仅启动时生效）
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSAutocertDomains 通过 Let's Encrypt 自动签发证书的域名（逗号分隔），与证书文件二选一（TLS_AUTOCERT_DOMAINS，仅启动时生效）
+	TLSAutocertDomains string
+	// TLSAutocertCacheDir 自动签发证书的缓存目录，默认 autocert-cache（TLS_AUTOCERT_CACHE_DIR，仅启动时生效）
+	TLSAutocertCacheDir string
+	// TLSAutocertEmail 向 Let's Encrypt 注册账户时使用的联系邮箱（TLS_AUTOCERT_EMAIL，仅启动时生效）
+	TLSAutocertEmail string
+	// TLSMinVersion 接受的最低 TLS 版本：1.0、1.1、1.2、1.3，默认 1.2（TLS_MIN_VERSION，仅启动时生效）
+	TLSMinVersion string
+	// RootMode 根路径行为：redirect（默认）、status、health、none（ROOT_MODE，仅启动时生效）
+	RootMode string
+	// RootRedirectURL redirect 模式下根路径重定向的地址（ROOT_REDIRECT_URL，仅启动时生效）
+	RootRedirectURL string
+	// DisabledFeatures 运行时禁用的子系统（mcp、openai，逗号分隔，DISABLED_FEATURES）
+	DisabledFeatures string
+	// RawTokenAuthDisabled 是否拒绝直接使用上游 refresh token 作为 API Key，启用后客户端只能使用租户 API Key 或 KIRO_POOL_API_KEY（DISABLE_RAW_TOKEN_AUTH）
+	RawTokenAuthDisabled bool
+	// AllowDebugEcho 非租户 key 是否允许调试回显（ALLOW_DEBUG_ECHO）
+	AllowDebugEcho bool
+	// TokenScopeCheck 是否在首次刷新后校验 token 权限（启动时对全局 token 池预先执行一次），默认开启（TOKEN_SCOPE_CHECK）
+	TokenScopeCheck bool
+	// TokenPreflightAfterSeconds 缓存的 access token 超过该时间（自上次刷新或预检）未验证时，使用前先预检；0 表示不预检（TOKEN_PREFLIGHT_AFTER_SECONDS）
+	TokenPreflightAfterSeconds int
+	// TokenPreflightMode 预检方式：refresh（直接刷新，默认）或 probe（用量查询验证，401/403 时刷新）（TOKEN_PREFLIGHT_MODE）
+	TokenPreflightMode string
+	// TokenCacheDB token 缓存持久化的 SQLite 文件路径，未配置时仅使用内存缓存（TOKEN_CACHE_DB，仅启动时生效）
+	TokenCacheDB string
+
+	// UpstreamWarmupIntervalSeconds 上游连接预热间隔（秒），0 表示不预热（UPSTREAM_WARMUP_INTERVAL_SECONDS，仅启动时生效）
+	UpstreamWarmupIntervalSeconds int
+	// DNSCacheTTLSeconds 上游域名解析结果的缓存时间（秒），解析失败时沿用过期结果，0 表示不缓存（DNS_CACHE_TTL_SECONDS）
+	DNSCacheTTLSeconds int
+	// UpstreamIPPreference 上游连接的地址族偏好：auto（默认，按解析顺序）、ipv4、ipv6、prefer-ipv4、prefer-ipv6
+	// ipv4/ipv6 只使用对应地址族，prefer-* 优先使用对应地址族并在超过 Happy Eyeballs 延迟后并行尝试另一地址族（UPSTREAM_IP_PREFERENCE）
+	UpstreamIPPreference string
+	// HappyEyeballsDelayMs 首选地址族未连通时开始尝试另一地址族的延迟（毫秒），默认 300（HAPPY_EYEBALLS_DELAY_MS）
+	HappyEyeballsDelayMs int
+	// UpstreamForwardSampling 是否将客户端的 top_p/top_k 通过 inferenceConfig 转发给上游，默认开启，关闭时丢弃（UPSTREAM_FORWARD_SAMPLING）
+	UpstreamForwardSampling bool
+	// UpstreamTopKMax 转发给上游的 top_k 上限，超出时截断到该值，0 表示不转发 top_k（UPSTREAM_TOP_K_MAX）
+	UpstreamTopKMax int
+	// AnthropicPassthrough 是否将 sk-ant- 开头的 API Key 识别为真实 Anthropic Key 并直连转发（ANTHROPIC_PASSTHROUGH）
+	AnthropicPassthrough bool
+	// AnthropicPassthroughBaseURL 直连转发的 API 地址，默认 https://api.anthropic.com（ANTHROPIC_PASSTHROUGH_BASE_URL）
+	AnthropicPassthroughBaseURL string
+
+	// PromptCacheMode Prompt Cache 模拟的开关：enabled（默认）或 disabled，disabled 时 cache_read/cache_creation 均为 0（PROMPT_CACHE，仅启动时生效）
+	PromptCacheMode string
+	// PromptCacheScope Prompt Cache 条目的隔离范围：key（默认，按 API Key 隔离）或 tenant（同一租户的 key 共享，非租户 key 全局共享）（PROMPT_CACHE_SCOPE）
+	PromptCacheScope string
+	// PromptCacheCleanIntervalSeconds Prompt Cache 清理过期条目的间隔（秒），默认 300（PROMPT_CACHE_CLEAN_INTERVAL_SECONDS，仅启动时生效）
+	PromptCacheCleanIntervalSeconds int
+	// PromptCacheMaxEntries Prompt Cache 的最大条目数，超出时淘汰最久未使用的条目，0 表示不限制（PROMPT_CACHE_MAX_ENTRIES，仅启动时生效）
+	PromptCacheMaxEntries int
+	// PromptCacheMaxTokens Prompt Cache 所有条目估算 token 数之和的上限，0 表示不限制（PROMPT_CACHE_MAX_TOKENS，仅启动时生效）
+	PromptCacheMaxTokens int
+
+	// SSEFieldStyle 流式响应可选字段的默认输出风格：strict-anthropic（默认）或 lenient，租户配置和 X-Kiro-SSE-Style 请求头可覆盖（SSE_FIELD_STYLE）
+	SSEFieldStyle string
+	// SSEGzip 客户端声明支持时是否以 gzip 压缩 SSE 响应（SSE_GZIP）
+	SSEGzip bool
+	// SSECoalesceDeltas 是否合并同一批上游数据中相邻的增量事件（SSE_COALESCE_DELTAS）
+	SSECoalesceDeltas bool
+	// CostHeader 非流式响应是否附带 X-Kiro-Cost-USD 响应头（COST_HEADER）
+	CostHeader bool
+	// GenAISemconvLog 是否在每个请求完成时输出 OpenTelemetry GenAI 语义约定格式的 JSON 日志（GENAI_SEMCONV_LOG）
+	GenAISemconvLog bool
+
+	// CodeExecutionCommand 执行 code_execution 工具代码的沙箱命令（按空白拆分参数，不经过 shell），代码通过标准输入传入，
+	// 为空时不模拟 code_execution 工具（CODE_EXECUTION_COMMAND）
+	CodeExecutionCommand string
+	// CodeExecutionTimeoutSeconds 单次沙箱执行的超时时间（秒），默认 30（CODE_EXECUTION_TIMEOUT_SECONDS）
+	CodeExecutionTimeoutSeconds int
+	// WebSearchProvider web_search 工具使用的搜索服务：searxng、brave、bing，为空时通过上游 MCP 端点搜索（WEB_SEARCH_PROVIDER）
+	WebSearchProvider string
+	// WebSearchURL 搜索服务地址：SearxNG 实例地址（必填），或覆盖 Brave / Bing 的默认 API 地址（WEB_SEARCH_URL）
+	WebSearchURL string
+	// WebSearchAPIKey Brave / Bing 搜索 API 的订阅密钥（WEB_SEARCH_API_KEY）
+	WebSearchAPIKey string
+
+	// RequestLogSize 内存中保留最近已完成请求的条数，供管理端点回放和比较，0 表示不记录（REQUEST_LOG_SIZE，仅启动时生效）
+	RequestLogSize int
+	// ConversationStoreSize 内存中保留会话状态的最大会话数，供会话分叉使用，0 表示不保存（CONVERSATION_STORE_SIZE，仅启动时生效）
+	ConversationStoreSize int
+	// BanIncidentLogSize 内存中保留最近 403 封禁事件的条数，默认 100，0 表示不保留（BAN_INCIDENT_LOG_SIZE，仅启动时生效）
+	BanIncidentLogSize int
+	// BanIncidentLog 403 封禁事件的 JSONL 日志文件，默认 data/incidents.log，设为 off 时不写文件（BAN_INCIDENT_LOG）
+	BanIncidentLog string
+	// UsageDB 用量记账的 SQLite 文件，为空时不记录（USAGE_DB，仅启动时生效）
+	UsageDB string
+
+	// AbuseConversationRPM 同一会话每分钟请求数上限，超过后延迟处理，超过两倍时拒绝；0 表示不检查（ABUSE_CONVERSATION_RPM）
+	AbuseConversationRPM int
+	// AbuseIdenticalPromptLimit 窗口内完全相同的请求次数上限，超过后延迟处理，超过两倍时拒绝；0 表示不检查（ABUSE_IDENTICAL_PROMPT_LIMIT）
+	AbuseIdenticalPromptLimit int
+	// AbuseIdenticalWindowSeconds 统计相同请求次数的滑动窗口（秒），默认 60（ABUSE_IDENTICAL_WINDOW_SECONDS）
+	AbuseIdenticalWindowSeconds int
+	// AbuseDelayMs 触发滥用模式整形时每个请求的延迟（毫秒），0 表示只在超过两倍上限时拒绝，默认 2000（ABUSE_DELAY_MS）
+	AbuseDelayMs int
+	// AbuseShapingExemptKeys 豁免滥用模式整形的 API Key（SHA256，逗号分隔，可带 "sha256:" 前缀）（ABUSE_SHAPING_EXEMPT_KEYS）
+	AbuseShapingExemptKeys string
+
+	// HistoryTurnSoftLimit 历史中用户轮次达到该值时在响应头中提示开启新会话，0 表示不提示（HISTORY_TURN_SOFT_LIMIT）
+	HistoryTurnSoftLimit int
+	// HistoryTurnHardLimit 历史中用户轮次超过该值时拒绝请求，0 表示不限制（HISTORY_TURN_HARD_LIMIT）
+	HistoryTurnHardLimit int
+
+	// BatchConcurrency Message Batches 同时处理的请求数（所有批次共享），默认 4（BATCH_CONCURRENCY，仅启动时生效）
+	BatchConcurrency int
+	// BatchMaxRequests 单个批次允许的最大请求数，超出时返回 400，默认 10000（BATCH_MAX_REQUESTS）
+	BatchMaxRequests int
+	// BatchDB 批次状态和结果持久化的 SQLite 文件路径，未配置时只保存在内存中（BATCH_DB，仅启动时生效）
+	BatchDB string
+
+	// TTFTSLOMs 流式请求首 token 延迟（TTFT）p95 的默认阈值（毫秒），0 表示不监控（TTFT_SLO_MS，仅启动时生效）
+	TTFTSLOMs int
+	// TTFTSLOModels 按模型名前缀设置的阈值，如 claude-opus=8000,claude-haiku=1500（TTFT_SLO_MODELS，仅启动时生效）
+	TTFTSLOModels string
+	// TTFTSLOWebhookURL 告警和恢复时 POST JSON 的地址，为空则只记录日志（TTFT_SLO_WEBHOOK_URL，仅启动时生效）
+	TTFTSLOWebhookURL string
+	// TTFTSLOWindowSeconds 计算 TTFT p95 的滑动窗口（秒），默认 300（TTFT_SLO_WINDOW_SECONDS）
+	TTFTSLOWindowSeconds int
+	// TTFTSLOConsecutiveChecks p95 连续超标多少次检查（每分钟一次）后告警，默认 3（TTFT_SLO_CONSECUTIVE_CHECKS）
+	TTFTSLOConsecutiveChecks int
+	// TTFTSLOMinSamples 窗口内样本数少于该值时不评估，避免少量慢请求误报，默认 20（TTFT_SLO_MIN_SAMPLES）
+	TTFTSLOMinSamples int
+
+	// RequestBodyMaxBytes 请求体的最大字节数，超出时返回 413，默认 32MB，0 表示不限制（REQUEST_BODY_MAX_BYTES）
+	RequestBodyMaxBytes int
+	// ImageMaxBytes 单张图片解码后的最大字节数，超出时返回 400，默认 20MB（IMAGE_MAX_BYTES）
+	ImageMaxBytes int
+	// ImageMaxDimension 上游接受的图片最长边（像素），超出且未启用缩放时返回 400，默认 8000（IMAGE_MAX_DIMENSION）
+	ImageMaxDimension int
+	// ImageDownscaleDimension 图片最长边超过该值时等比缩小到该值并重新编码，0 表示不缩放（IMAGE_DOWNSCALE_DIMENSION）
+	ImageDownscaleDimension int
+	// Tokenizer token 计数方式：为空时使用内置分词器，approx 使用近似算法（TOKENIZER，仅启动时生效）
+	Tokenizer string
+}
+
+// UpstreamEndpoint 一个上游区域端点
+type UpstreamEndpoint struct {
+	Name       string   `yaml:"name"`        // 端点名称，用于 token 固定和日志，如 us-east-1
+	URL        string   `yaml:"url"`         // GenerateAssistantResponse 端点 URL
+	TokenTypes []string `yaml:"token_types"` // 允许使用该端点的 token 类型（kiro / amazonq / idc），为空表示不限
+}
+
+// File 配置文件结构（YAML 或 JSON），未设置的项沿用环境变量或内置默认值
+type File struct {
+	ModelMap map[string]string `yaml:"model_map"`
+	Port     string            `yaml:"port"`
+
+	Upstream struct {
+		CodeWhispererURL   string `yaml:"codewhisperer_url"`
+		UsageLimitsURL     string `yaml:"usage_limits_url"`
+		MCPURL             string `yaml:"mcp_url"`
+		RefreshTokenURL    string `yaml:"refresh_token_url"`
+		AmazonQTokenURL    string `yaml:"amazonq_token_url"`
+		OIDCTokenURLFormat string `yaml:"oidc_token_url_format"`
+
+		Endpoints []UpstreamEndpoint `yaml:"endpoints"`
+	} `yaml:"upstream"`
+
+	Limits struct {
+		MaxToolDescriptionLength  *int `yaml:"max_tool_description_length"`
+		MaxInputJSONDeltaBytes    *int `yaml:"max_input_json_delta_bytes"`
+		UpstreamWriteRateKB       *int `yaml:"upstream_write_rate_kb"`
+		UpstreamTTFBBudgetSeconds *int `yaml:"upstream_ttfb_budget_seconds"`
+		StreamIdleTimeoutSeconds  *int `yaml:"stream_idle_timeout_seconds"`
+		TokenRefreshMaxAttempts   *int `yaml:"token_refresh_max_attempts"`
+		TokenRefreshBackoffMs     *int `yaml:"token_refresh_backoff_ms"`
+		UpstreamRetryMaxAttempts  *int `yaml:"upstream_retry_max_attempts"`
+		UpstreamRetryBackoffMs    *int `yaml:"upstream_retry_backoff_ms"`
+		KeyRequestsPerMinute      *int `yaml:"key_requests_per_minute"`
+		KeyTokensPerMinute        *int `yaml:"key_tokens_per_minute"`
+		LongContextWindowTokens   *int `yaml:"long_context_window_tokens"`
+		MaxConcurrentRequests     *int `yaml:"max_concurrent_requests"`
+		MaxConcurrentPerToken     *int `yaml:"max_concurrent_per_token"`
+		ConcurrencyQueueSize      *int `yaml:"concurrency_queue_size"`
+		ConcurrencyQueueTimeout   *int `yaml:"concurrency_queue_timeout_seconds"`
+	} `yaml:"limits"`
+
+	Prompts struct {
+		Agentic  *bool `yaml:"agentic"`
+		Thinking *bool `yaml:"thinking"`
+	} `yaml:"prompts"`
+
+	Pricing map[string]pricingEntry `yaml:"pricing"`
+}
+
+var (
+	current  atomic.Pointer[Settings]
+	reloadMu sync.Mutex
+	modTime  time.Time
+
+	// reloadWatcher 热重载任务
+	reloadWatcher *lifecycle.Task
+)
+
+// defaultSettings 内置默认值，环境变量项按 env.go 中登记的表读取
+func defaultSettings() *Settings {
+	s := &Settings{
+		ModelMap: map[string]string{
+			"claude-opus-4-6":   "claude-opus-4-6",
+			"claude-sonnet-4-6": "claude-sonnet-4-6",
+			"claude-opus-4-5":   "claude-opus-4.5",
+			"claude-sonnet-4-5": "claude-sonnet-4.5",
+			"claude-haiku-4-5":  "claude-haiku-4.5",
+		},
+		Port:               os.Getenv("PORT"),
+		CodeWhispererURL:   "https://q.us-east-1.amazonaws.com",
+		UsageLimitsURL:     "https://q.us-east-1.amazonaws.com/getUsageLimits",
+		MCPURL:             "https://q.us-east-1.amazonaws.com/mcp",
+		RefreshTokenURL:    "https://prod.us-east-1.auth.desktop.kiro.dev/refreshToken",
+		AmazonQTokenURL:    "https://oidc.us-east-1.amazonaws.com/token",
+		OIDCTokenURLFormat: "https://oidc.%s.amazonaws.com/token",
+		AgenticPrompt:      true,
+		ThinkingPrompt:     true,
+		Pricing:            defaultPricing(),
+	}
+	applyEnv(s)
+	return s
+}
+
+// Current 返回当前生效的配置快照（只读，不要修改返回值）
+func Current() *Settings {
+	if s := current.Load(); s != nil {
+		return s
+	}
+	current.CompareAndSwap(nil, defaultSettings())
+	return current.Load()
+}
+
+// Use 替换当前配置快照并返回恢复之前快照的函数，供测试固定配置（不受环境变量和配置文件影响）
+func Use(s *Settings) (restore func()) {
+	prev := Current()
+	current.Store(s)
+	return func() { current.Store(prev) }
+}
+
+// Path 返回配置文件路径：CONFIG_FILE 环境变量，默认 data/config.yaml
+func Path() string {
+	if p := os.Getenv("CONFIG_FILE"); p != "" {
+		return p
+	}
+	return "data/config.yaml"
+}
+
+// Init 启动时加载配置文件，文件不存在时使用环境变量和内置默认值
+func Init() {
+	if err := load(Path()); err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "[Config] 加载配置文件失败，使用默认配置: %v\n", err)
+		}
+		current.Store(defaultSettings())
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[Config] 已加载配置文件 %s\n", Path())
+}
+
+/**
+ * StartReloadWatcher 启动配置热重载
+ * 收到 SIGHUP 时立即重载；另外每 30 秒检查文件修改时间，变化时自动重载
+ * 重载失败（如格式错误）时保留旧配置
+ */
+func StartReloadWatcher() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	reloadWatcher.Stop()
+	reloadWatcher = lifecycle.Go("config-reload", func(ctx context.Context) {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				Reload()
+			case <-ticker.C:
+				checkAndReload()
+			}
+		}
+	})
+}
+
+// StopReloadWatcher 停止配置热重载
+func StopReloadWatcher() {
+	reloadWatcher.Stop()
+}
+
+// Reload 重新读取配置文件，文件被删除时恢复为默认配置
+func Reload() {
+	path := Path()
+	if err := load(path); err != nil {
+		if os.IsNotExist(err) {
+			reloadMu.Lock()
+			if !modTime.IsZero() {
+				modTime = time.Time{}
+				current.Store(defaultSettings())
+				fmt.Fprintf(os.Stderr, "[Config] 配置文件已删除，恢复默认配置\n")
+			}
+			reloadMu.Unlock()
+			return
+		}
+		fmt.Fprintf(os.Stderr, "[Config] 热重载失败，保留旧配置: %v\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[Config] 热重载: %s（模型映射 %d 项）\n", path, len(Current().ModelMap))
+}
+
+// Validate 解析并校验配置文件，返回合并后的配置，不修改运行时状态
+// 文件不存在时返回 os.IsNotExist 错误
+func Validate(path string) (*Settings, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parse(raw)
+}
+
+// --- 内部方法 ---
+
+func parse(raw []byte) (*Settings, error) {
+	var f File
+	// YAML 是 JSON 的超集，同一解析器同时支持两种格式；未知字段视为错误，避免拼写错误被静默忽略
+	if err := yaml.UnmarshalWithOptions(raw, &f, yaml.DisallowUnknownField()); err != nil {
+		return nil, fmt.Errorf("解析配置文件失败: %v", err)
+	}
+
+	s := defaultSettings()
+	if f.ModelMap != nil {
+		for model, target := range f.ModelMap {
+			if target == "" {
+				return nil, fmt.Errorf("model_map.%s: 映射目标不能为空", model)
+			}
+		}
+		s.ModelMap = f.ModelMap
+	}
+	if f.Port != "" {
+		s.Port = f.Port
+	}
+
+	for _, u := range []struct {
+		value  string
+		target *string
+	}{
+		{f.Upstream.CodeWhispererURL, &s.CodeWhispererURL},
+		{f.Upstream.UsageLimitsURL, &s.UsageLimitsURL},
+		{f.Upstream.MCPURL, &s.MCPURL},
+		{f.Upstream.RefreshTokenURL, &s.RefreshTokenURL},
+		{f.Upstream.AmazonQTokenURL, &s.AmazonQTokenURL},
+		{f.Upstream.OIDCTokenURLFormat, &s.OIDCTokenURLFormat},
+	} {
+		if u.value != "" {
+			*u.target = u.value
+		}
+	}
+
+	names := make(map[string]bool, len(f.Upstream.Endpoints))
+	for i, ep := range f.Upstream.Endpoints {
+		if ep.Name == "" || ep.URL == "" {
+			return nil, fmt.Errorf("upstream.endpoints[%d]: name 和 url 不能为空", i)
+		}
+		if names[ep.Name] {
+			return nil, fmt.Errorf("upstream.endpoints[%d]: 端点名称重复: %s", i, ep.Name)
+		}
+		names[ep.Name] = true
+		for _, t := range ep.TokenTypes {
+			switch strings.ToLower(t) {
+			case "kiro", "amazonq", "idc":
+			default:
+				return nil, fmt.Errorf("upstream.endpoints[%d].token_types: 未知的 token 类型 %q（可选 kiro、amazonq、idc）", i, t)
+			}
+		}
+	}
+	s.UpstreamEndpoints = f.Upstream.Endpoints
+
+	for _, l := range []struct {
+		name    string
+		value   *int
+		minimum int
+		target  *int
+	}{
+		{"max_tool_description_length", f.Limits.MaxToolDescriptionLength, 1, &s.MaxToolDescriptionLength},
+		{"max_input_json_delta_bytes", f.Limits.MaxInputJSONDeltaBytes, 0, &s.MaxInputJSONDeltaBytes},
+		{"upstream_write_rate_kb", f.Limits.UpstreamWriteRateKB, 0, &s.UpstreamWriteRateKB},
+		{"upstream_ttfb_budget_seconds", f.Limits.UpstreamTTFBBudgetSeconds, 0, &s.UpstreamTTFBBudgetSeconds},
+		{"stream_idle_timeout_seconds", f.Limits.StreamIdleTimeoutSeconds, 0, &s.StreamIdleTimeoutSeconds},
+		{"token_refresh_max_attempts", f.Limits.TokenRefreshMaxAttempts, 1, &s.TokenRefreshMaxAttempts},
+		{"token_refresh_backoff_ms", f.Limits.TokenRefreshBackoffMs, 0, &s.TokenRefreshBackoffMs},
+		{"upstream_retry_max_attempts", f.Limits.UpstreamRetryMaxAttempts, 1, &s.UpstreamRetryMaxAttempts},
+		{"upstream_retry_backoff_ms", f.Limits.UpstreamRetryBackoffMs, 0, &s.UpstreamRetryBackoffMs},
+		{"key_requests_per_minute", f.Limits.KeyRequestsPerMinute, 0, &s.KeyRequestsPerMinute},
+		{"key_tokens_per_minute", f.Limits.KeyTokensPerMinute, 0, &s.KeyTokensPerMinute},
+		{"long_context_window_tokens", f.Limits.LongContextWindowTokens, 0, &s.LongContextWindowTokens},
+		{"max_concurrent_requests", f.Limits.MaxConcurrentRequests, 0, &s.MaxConcurrentRequests},
+		{"max_concurrent_per_token", f.Limits.MaxConcurrentPerToken, 0, &s.MaxConcurrentPerToken},
+		{"concurrency_queue_size", f.Limits.ConcurrencyQueueSize, 0, &s.ConcurrencyQueueSize},
+		{"concurrency_queue_timeout_seconds", f.Limits.ConcurrencyQueueTimeout, 1, &s.ConcurrencyQueueTimeoutSeconds},
+	} {
+		if l.value == nil {
+			continue
+		}
+		if *l.value < l.minimum {
+			return nil, fmt.Errorf("limits.%s: 取值 %d 小于最小值 %d", l.name, *l.value, l.minimum)
+		}
+		*l.target = *l.value
+	}
+
+	if f.Prompts.Agentic != nil {
+		s.AgenticPrompt = *f.Prompts.Agentic
+	}
+	if f.Prompts.Thinking != nil {
+		s.ThinkingPrompt = *f.Prompts.Thinking
+	}
+
+	pricing, err := parsePricing(f.Pricing)
+	if err != nil {
+		return nil, err
+	}
+	s.Pricing = pricing
+	return s, nil
+}
+
+func load(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	s, err := Validate(path)
+	if err != nil {
+		return err
+	}
+
+	reloadMu.Lock()
+	current.Store(s)
+	modTime = info.ModTime()
+	reloadMu.Unlock()
+	return nil
+}
+
+func checkAndReload() {
+	info, err := os.Stat(Path())
+	reloadMu.Lock()
+	changed := (err == nil && info.ModTime().After(modTime)) || (err != nil && !modTime.IsZero())
+	reloadMu.Unlock()
+	if changed {
+		Reload()
+	}
+}
@@ -22,4 +22,68 @@ const (
 
 	// HTTPClientTLSHandshakeTimeout HTTP客户端TLS握手超时
 	HTTPClientTLSHandshakeTimeout = 15 * time.Second
+
+	// ========== 上游写入配置 ==========
+
+	// UpstreamPacingThreshold 请求体超过该大小时启用令牌桶平滑写入
+	UpstreamPacingThreshold = 2 * 1024 * 1024
+
+	// UpstreamStreamEncodeThreshold 客户端请求体超过该大小时，上游请求体边序列化边发送，不在内存中保留完整副本
+	UpstreamStreamEncodeThreshold = 1 * 1024 * 1024
+
+	// UpstreamWriteStallTimeout 请求体写入停滞超过该时长即中止请求
+	// 避免上游在数分钟后才静默超时
+	UpstreamWriteStallTimeout = 30 * time.Second
+
+	// ========== 上下文窗口配置 ==========
+
+	// ContextWindowTokens 模型上下文窗口大小（token）
+	ContextWindowTokens = 200000
+
+	// ThinkingOutputReserveTokens 收紧思考预算时为最终回答保留的 token 数
+	ThinkingOutputReserveTokens = 4096
+
+	// ThinkingMinBudgetTokens 思考预算下限（与官方 API 的 budget_tokens 最小值一致）
+	ThinkingMinBudgetTokens = 1024
+
+	// ========== 退出配置 ==========
+
+	// ShutdownGracePeriod 优雅退出时等待进行中请求（包括流式响应）结束的最长时间
+	ShutdownGracePeriod = 30 * time.Second
+
+	// BackgroundShutdownTimeout 停止后台任务（刷新、清理、导出、异步落盘）的最长等待时间
+	BackgroundShutdownTimeout = 10 * time.Second
+
+	// ========== 历史构建缓存配置 ==========
+
+	// HistoryCacheMaxEntries 缓存已转换历史前缀的最大会话数
+	HistoryCacheMaxEntries = 256
+
+	// HistoryCacheTTL 会话历史前缀未被使用超过该时长即失效
+	HistoryCacheTTL = 30 * time.Minute
+
+	// ConversationStoreTTL 保存的会话状态未被使用超过该时长即失效
+	ConversationStoreTTL = 2 * time.Hour
+
+	// ========== 上游端点健康检查配置 ==========
+
+	// EndpointFailureThreshold 上游端点连续失败（连接错误、5xx）达到该次数后标记为不健康
+	EndpointFailureThreshold = 3
+
+	// EndpointCooldown 不健康的端点在该时长内不再优先选择，之后重新尝试
+	EndpointCooldown = 30 * time.Second
+
+	// ========== 服务端工具（code_execution / web_search）模拟配置 ==========
+
+	// ServerToolMaxRounds 单个请求内模型调用模拟服务端工具的最大轮数，超出后以 pause_turn 结束
+	ServerToolMaxRounds = 5
+
+	// CodeExecutionMaxOutputBytes 沙箱 stdout / stderr 各自保留的最大字节数
+	CodeExecutionMaxOutputBytes = 64 * 1024
+
+	// CodeExecutionMaxConcurrent 同时运行的沙箱进程数上限
+	CodeExecutionMaxConcurrent = 4
+
+	// WebSearchTimeout 单次搜索请求的超时时间
+	WebSearchTimeout = 15 * time.Second
 )
@@ -68,13 +68,16 @@ func extractTextFromContent(content any) string {
 	return ""
 }
 
-// isAgenticMode 检查是否应启用 Agentic 模式（最后一条用户消息以 "-agent" 开头）
+// isAgenticMode 检查是否应启用 Agentic 模式（最后一条用户消息以 "-agent" 开头，且配置未关闭该提示）
 func isAgenticMode(messages []types.AnthropicRequestMessage) bool {
+	if !config.Current().AgenticPrompt {
+		return false
+	}
 	content := getLastUserMessageContent(messages)
 	return strings.HasPrefix(strings.TrimSpace(content), "-agent")
 }
 
-// buildEnhancedSystemPrompt 构建增强的系统提示（包含 Thinking、Agentic 注入）
+// buildEnhancedSystemPrompt 构建增强的系统提示（包含 Thinking、Agentic、强制工具调用注入）
 func buildEnhancedSystemPrompt(anthropicReq types.AnthropicRequest) string {
 	var systemPrompt strings.Builder
 
@@ -96,27 +99,63 @@ func buildEnhancedSystemPrompt(anthropicReq types.AnthropicRequest) string {
 	}
 
 	// 3. 注入 Thinking 模式提示（默认禁用，除非显式启用）
-	shouldEnableThinking := false
-	budgetTokens := 16000 // 默认值
+	if thinking := thinkingPrompt(anthropicReq); thinking != "" {
+		systemPrompt.WriteString("\n")
+		systemPrompt.WriteString(thinking)
+	}
+
+	// 4. 注入强制工具调用指令（tool_choice 为 any 或 {"type":"tool"}），或 tool_choice 为 none 时禁止调用保留的工具
+	if forced := forcedToolPrompt(anthropicReq); forced != "" {
+		systemPrompt.WriteString("\n")
+		systemPrompt.WriteString(forced)
+	}
+	if none := noToolPrompt(anthropicReq); none != "" {
+		systemPrompt.WriteString("\n")
+		systemPrompt.WriteString(none)
+	}
+
+	return strings.TrimSpace(systemPrompt.String())
+}
 
-	// 检查是否显式启用了 Thinking 模式
-	if anthropicReq.Thinking != nil && anthropicReq.Thinking.Type == "enabled" {
-		shouldEnableThinking = true
+// DefaultThinkingBudget 启用 thinking 但未指定 budget_tokens 时注入的思考长度上限
+const DefaultThinkingBudget = 16000
+
+// thinkingPrompt 构建 Thinking 模式提示，未显式启用或配置关闭该提示时返回空字符串
+func thinkingPrompt(anthropicReq types.AnthropicRequest) string {
+	if !config.Current().ThinkingPrompt || anthropicReq.Thinking == nil || anthropicReq.Thinking.Type != "enabled" {
+		return ""
 	}
 
-	// 如果显式启用并指定了 budget_tokens，使用指定值
-	if anthropicReq.Thinking != nil && anthropicReq.Thinking.BudgetTokens > 0 {
+	budgetTokens := DefaultThinkingBudget
+	if anthropicReq.Thinking.BudgetTokens > 0 {
 		budgetTokens = anthropicReq.Thinking.BudgetTokens
 	}
+	return fmt.Sprintf("<thinking_mode>interleaved</thinking_mode><max_thinking_length>%d</max_thinking_length>", budgetTokens)
+}
 
-	if shouldEnableThinking {
-		systemPrompt.WriteString("\n")
-		systemPrompt.WriteString(fmt.Sprintf("<thinking_mode>interleaved</thinking_mode><max_thinking_length>%d</max_thinking_length>", budgetTokens))
+/**
+ * InjectedPrompt 返回转换时额外注入上游请求的文本（Agentic、Thinking、tool_choice 指令及 <system_mode> 标签）
+ * 不包含客户端自带的系统提示，用于让 input_tokens 反映实际发送给上游的内容
+ */
+func InjectedPrompt(anthropicReq types.AnthropicRequest) string {
+	if buildEnhancedSystemPrompt(anthropicReq) == "" {
+		return ""
 	}
 
-	return strings.TrimSpace(systemPrompt.String())
+	var injected strings.Builder
+	injected.WriteString("<system_mode></system_mode>")
+	if isAgenticMode(anthropicReq.Messages) {
+		injected.WriteString(agenticSystemPrompt)
+	}
+	injected.WriteString(thinkingPrompt(anthropicReq))
+	injected.WriteString(forcedToolPrompt(anthropicReq))
+	injected.WriteString(noToolPrompt(anthropicReq))
+	return injected.String()
 }
 
+// toolTaskPlaceholder 当前消息没有内容但带工具时注入的占位内容
+const toolTaskPlaceholder = "执行工具任务"
+
 // determineChatTriggerType 智能确定聊天触发类型 (SOLID-SRP: 单一责任)
 func determineChatTriggerType(anthropicReq types.AnthropicRequest) string {
 	// 上游 CodeWhisperer 只接受 "MANUAL"，"AUTO" 会返回 Improperly formed request
@@ -147,9 +186,8 @@ func validateCodeWhispererRequest(cwReq *types.CodeWhispererRequest) error {
 
 	// 如果没有内容但有工具，注入占位内容 (YAGNI: 只在需要时处理)
 	if trimmedContent == "" && !hasImages && hasTools {
-		placeholder := "执行工具任务"
-		cwReq.ConversationState.CurrentMessage.UserInputMessage.Content = placeholder
-		trimmedContent = placeholder
+		cwReq.ConversationState.CurrentMessage.UserInputMessage.Content = toolTaskPlaceholder
+		trimmedContent = toolTaskPlaceholder
 	}
 
 	// 验证至少有内容或图片
@@ -306,6 +344,72 @@ func extractToolResultsFromMessage(content any) []types.ToolResult {
 	return toolResults
 }
 
+// SamplingWarningHeader 采样参数被丢弃或截断时附带的响应头
+const SamplingWarningHeader = "X-Kiro-Sampling-Warning"
+
+/**
+ * buildInferenceConfig 将客户端的 top_p/top_k 转换为上游推理配置，均未指定时返回 nil
+ * 默认转发，UPSTREAM_FORWARD_SAMPLING=false 时丢弃
+ * top_p 截断到 (0, 1]，top_k 截断到 [1, UPSTREAM_TOP_K_MAX]，UPSTREAM_TOP_K_MAX 为 0 时不转发 top_k；
+ * top_p、top_k 不大于 0 时丢弃。丢弃或截断时记录日志并在响应头 X-Kiro-Sampling-Warning 中说明
+ */
+func buildInferenceConfig(anthropicReq types.AnthropicRequest, ctx *gin.Context) *types.InferenceConfig {
+	if anthropicReq.TopP == nil && anthropicReq.TopK == nil {
+		return nil
+	}
+	if !config.Current().UpstreamForwardSampling {
+		warnSampling(ctx, []string{"top_p/top_k dropped (UPSTREAM_FORWARD_SAMPLING=false)"})
+		return nil
+	}
+
+	var cfg types.InferenceConfig
+	var notes []string
+	if anthropicReq.TopP != nil {
+		topP := *anthropicReq.TopP
+		switch {
+		case topP <= 0:
+			notes = append(notes, fmt.Sprintf("top_p %v dropped (must be > 0)", topP))
+		case topP > 1:
+			notes = append(notes, fmt.Sprintf("top_p %v clamped to 1", topP))
+			cfg.TopP = 1
+		default:
+			cfg.TopP = topP
+		}
+	}
+	if anthropicReq.TopK != nil {
+		topK := min(*anthropicReq.TopK, config.Current().UpstreamTopKMax)
+		switch {
+		case *anthropicReq.TopK <= 0:
+			notes = append(notes, fmt.Sprintf("top_k %d dropped (must be > 0)", *anthropicReq.TopK))
+		case topK <= 0:
+			notes = append(notes, fmt.Sprintf("top_k %d dropped (UPSTREAM_TOP_K_MAX=0)", *anthropicReq.TopK))
+		default:
+			if topK != *anthropicReq.TopK {
+				notes = append(notes, fmt.Sprintf("top_k %d clamped to %d (UPSTREAM_TOP_K_MAX)", *anthropicReq.TopK, topK))
+			}
+			cfg.TopK = topK
+		}
+	}
+	warnSampling(ctx, notes)
+	if cfg.TopP == 0 && cfg.TopK == 0 {
+		return nil
+	}
+	return &cfg
+}
+
+// warnSampling 记录采样参数的丢弃或截断：调试回显策略、日志和响应头
+func warnSampling(ctx *gin.Context, notes []string) {
+	if len(notes) == 0 {
+		return
+	}
+	detail := strings.Join(notes, "; ")
+	utils.RecordPolicy(ctx, "sampling", "%s", detail)
+	utils.Info("采样参数未按原值转发: %s", detail)
+	if ctx != nil {
+		ctx.Header(SamplingWarningHeader, detail)
+	}
+}
+
 // BuildCodeWhispererRequest 构建 CodeWhisperer 请求
 func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Context) (types.CodeWhispererRequest, error) {
 	cwReq := types.CodeWhispererRequest{}
@@ -315,8 +419,13 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 	cwReq.ConversationState.AgentContinuationId = utils.GenerateUUID()
 	cwReq.ConversationState.AgentTaskType = "vibe"
 
+	// 为满足上游格式要求补齐的文本，用于统计代理开销
+	var padding []string
+
 	// 使用 UUID 作为 conversationId
-	if ctx != nil {
+	// 会话状态错误重试时强制使用全新的 conversationId
+	fresh := ctx != nil && ctx.GetBool(FreshConversationKey)
+	if ctx != nil && !fresh {
 		cwReq.ConversationState.ConversationId = utils.GenerateStableConversationID(ctx)
 	} else {
 		cwReq.ConversationState.ConversationId = utils.GenerateUUID()
@@ -336,7 +445,7 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 
 	textContent, images, err := processMessageContent(lastMessage.Content)
 	if err != nil {
-		return cwReq, fmt.Errorf("处理消息内容失败: %v", err)
+		return cwReq, fmt.Errorf("处理消息内容失败: %w", err)
 	}
 
 	// 构建增强的系统提示（包含 Thinking, Agentic 注入）
@@ -374,7 +483,7 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 	}
 
 	// 获取模型映射，如果不存在则直接透传原始模型ID
-	modelId := config.ModelMap[anthropicReq.Model]
+	modelId := config.Current().ModelMap[anthropicReq.Model]
 	if modelId == "" {
 		modelId = anthropicReq.Model
 	}
@@ -385,6 +494,14 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 		CurrentWorkingDirectory: ".",
 	}
 
+	// tool_choice 为 none 时只向上游发送历史中调用过的工具（并以系统提示禁止调用），其余工具省略
+	if IsToolChoiceNone(anthropicReq.ToolChoice) && len(anthropicReq.Tools) > 0 {
+		kept := toolsForChoiceNone(anthropicReq)
+		utils.RecordPolicy(ctx, "tool_choice", "tool_choice none: %d tools omitted upstream, %d kept for tool history",
+			len(anthropicReq.Tools)-len(kept), len(kept))
+		anthropicReq.Tools = kept
+	}
+
 	// 处理 tools 信息 - 根据req.json实际结构优化工具转换
 	if len(anthropicReq.Tools) > 0 {
 		// utils.Log("开始处理工具配置",
@@ -412,8 +529,9 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 			cwTool.ToolSpecification.Name = tool.Name
 
 			// 限制 description 长度为 10000 字符
-			if len(tool.Description) > config.MaxToolDescriptionLength {
-				cwTool.ToolSpecification.Description = tool.Description[:config.MaxToolDescriptionLength]
+			if maxLen := config.Current().MaxToolDescriptionLength; len(tool.Description) > maxLen {
+				cwTool.ToolSpecification.Description = tool.Description[:maxLen]
+				utils.RecordPolicy(ctx, "truncation", "tool %s description truncated from %d to %d bytes", tool.Name, len(tool.Description), maxLen)
 			} else {
 				cwTool.ToolSpecification.Description = tool.Description
 			}
@@ -445,7 +563,29 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 			historyEndIndex = len(anthropicReq.Messages) // 包含最后一条assistant
 		}
 
-		for i := 0; i < historyEndIndex; i++ {
+		// 命中历史缓存时复用已转换的前缀，只转换新增的消息
+		// 前缀之后紧跟 assistant 消息时需要与前缀末尾合并，放弃缓存整体重建
+		var cacheKey string
+		var fingerprints []uint64
+		var prefix *historyCacheEntry
+		start, boundary := 0, 0
+		historyCache := historyCacheOf(ctx)
+		if historyCache != nil && !fresh {
+			fingerprints = messageFingerprints(anthropicReq.Messages[:historyEndIndex])
+			cacheKey = historyCacheKey(ctx, modelId, fingerprints)
+			prefix = historyCache.lookup(cacheKey, fingerprints)
+			if prefix != nil && len(prefix.fingerprints) < historyEndIndex && anthropicReq.Messages[len(prefix.fingerprints)].Role == "assistant" {
+				prefix = nil
+			}
+			if prefix != nil {
+				start, boundary = len(prefix.fingerprints), len(prefix.fingerprints)
+				for _, item := range prefix.items {
+					history = append(history, item)
+				}
+			}
+		}
+
+		for i := start; i < historyEndIndex; i++ {
 			msg := anthropicReq.Messages[i]
 
 			if msg.Role == "user" {
@@ -454,6 +594,7 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 				continue
 			}
 			if msg.Role == "assistant" {
+				boundary = i + 1
 				// 遇到assistant，只有当有对应的user消息时才处理
 				if len(userMessagesBuffer) > 0 {
 					// 合并所有累积的user消息
@@ -508,7 +649,7 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 
 					// 添加assistant消息（只在有配对的user时添加）
 					assistantMsg := types.HistoryAssistantMessage{}
-					assistantContent, err := utils.GetMessageContent(msg.Content)
+					assistantContent, err := historyAssistantContent(msg.Content)
 					if err == nil {
 						assistantMsg.AssistantResponseMessage.Content = assistantContent
 					} else {
@@ -529,7 +670,7 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 					lastHistoryIdx := len(history) - 1
 					if lastAssistant, ok := history[lastHistoryIdx].(types.HistoryAssistantMessage); ok {
 						// 合并内容
-						additionalContent, err := utils.GetMessageContent(msg.Content)
+						additionalContent, err := historyAssistantContent(msg.Content)
 						if err == nil && additionalContent != "" {
 							if lastAssistant.AssistantResponseMessage.Content != "" {
 								lastAssistant.AssistantResponseMessage.Content += "\n" + additionalContent
@@ -554,6 +695,11 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 			}
 		}
 
+		// 缓存截止到最后一条 assistant 消息的历史前缀（结尾的孤立 user 消息下一轮可能变化，不缓存）
+		if cacheKey != "" && boundary > start {
+			historyCache.cacheHistory(cacheKey, fingerprints[:boundary], history, prefix)
+		}
+
 		// 处理结尾的孤立user消息
 		// 如果最后一条是user（作为currentMessage），buffer中可能还有倒数第二条及之前的孤立user消息
 		// 这些孤立的user消息应该配对一个"OK"的assistant
@@ -601,18 +747,29 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 			autoAssistantMsg.AssistantResponseMessage.Content = "OK"
 			autoAssistantMsg.AssistantResponseMessage.ToolUses = nil
 			history = append(history, autoAssistantMsg)
+			padding = append(padding, "OK")
 		}
 
 		cwReq.ConversationState.History = history
 	}
 
-	// 真正的 Kiro CLI 不发 InferenceConfig，跳过
-	// (保留注释以备将来需要时参考)
+	if fresh {
+		padding = append(padding, rebuildHistory(&cwReq)...)
+	}
+
+	// 真正的 Kiro CLI 不发 InferenceConfig，仅在客户端指定 top_p/top_k 且未关闭 UPSTREAM_FORWARD_SAMPLING 时发送
+	cwReq.InferenceConfig = buildInferenceConfig(anthropicReq, ctx)
 
 	// 最终验证请求完整性 (KISS: 简化验证逻辑)
 	if err := validateCodeWhispererRequest(&cwReq); err != nil {
 		return cwReq, fmt.Errorf("请求验证失败: %v", err)
 	}
+	if cwReq.ConversationState.CurrentMessage.UserInputMessage.Content == toolTaskPlaceholder {
+		padding = append(padding, toolTaskPlaceholder)
+	}
+	if ctx != nil {
+		ctx.Set(PaddingKey, strings.Join(padding, "\n"))
+	}
 
 	return cwReq, nil
 }
@@ -0,0 +1,141 @@
+package converter
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestContext 创建带请求的 gin 上下文，用于读取转换时记录的策略
+func newTestContext() *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	return c
+}
+
+func TestBuildCodeWhispererRequestToolChoice(t *testing.T) {
+	tests := []struct {
+		name        string
+		toolChoice  string
+		wantTools   bool
+		wantForced  string // 注入系统提示的强制调用指令片段，为空表示不注入
+		wantOmitted bool   // 是否记录 tool_choice 策略
+	}{
+		{name: "auto", toolChoice: `{"type":"auto"}`, wantTools: true},
+		{name: "any", toolChoice: `{"type":"any"}`, wantTools: true, wantForced: "one of the provided tools"},
+		{name: "tool", toolChoice: `{"type":"tool","name":"get_weather"}`, wantTools: true, wantForced: `the "get_weather" tool`},
+		{name: "string none", toolChoice: `"none"`, wantOmitted: true},
+		{name: "object none", toolChoice: `{"type":"none"}`, wantOmitted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{
+				"model": "claude-sonnet-4-5",
+				"max_tokens": 1024,
+				"system": "You are a weather assistant.",
+				"tools": [
+					{"name": "get_weather", "description": "Get the weather for a city", "input_schema": {"type": "object", "properties": {"city": {"type": "string"}}, "required": ["city"]}},
+					{"name": "get_time", "description": "Get the local time for a city", "input_schema": {"type": "object", "properties": {"city": {"type": "string"}}}}
+				],
+				"tool_choice": ` + tt.toolChoice + `,
+				"messages": [{"role": "user", "content": "What's the weather in Paris?"}]
+			}`
+			var req types.AnthropicRequest
+			if err := utils.SafeUnmarshal([]byte(body), &req); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := newTestContext()
+			cwReq, err := BuildCodeWhispererRequest(req, ctx)
+			if err != nil {
+				t.Fatalf("BuildCodeWhispererRequest: %v", err)
+			}
+
+			tools := cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools
+			if tt.wantTools && len(tools) != 2 {
+				t.Errorf("upstream tools = %d, want 2", len(tools))
+			}
+			if !tt.wantTools && len(tools) != 0 {
+				t.Errorf("upstream tools = %d, want none", len(tools))
+			}
+
+			data, err := utils.SafeMarshal(cwReq)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 系统提示以 JSON 字符串形式出现在请求中，按同样的编码比较
+			instruction, _ := utils.SafeMarshal("You must respond by calling " + tt.wantForced + ".")
+			hasForced := strings.Contains(string(data), strings.Trim(string(instruction), `"`))
+			if tt.wantForced == "" && strings.Contains(string(data), "You must respond by calling") {
+				t.Error("unexpected forced tool_choice prompt")
+			}
+			if tt.wantForced != "" && !hasForced {
+				t.Errorf("forced tool_choice prompt for %s not injected", tt.wantForced)
+			}
+
+			omitted := false
+			for _, p := range utils.AppliedPolicies(ctx) {
+				if p.Kind == "tool_choice" {
+					omitted = true
+				}
+			}
+			if omitted != tt.wantOmitted {
+				t.Errorf("tool_choice policy recorded = %v, want %v", omitted, tt.wantOmitted)
+			}
+		})
+	}
+}
+
+// TestBuildCodeWhispererRequestToolChoiceNoneWithHistory tool_choice 为 none 时保留历史中调用过的工具定义，并以指令禁止调用
+func TestBuildCodeWhispererRequestToolChoiceNoneWithHistory(t *testing.T) {
+	body := `{
+		"model": "claude-sonnet-4-5",
+		"max_tokens": 1024,
+		"tools": [
+			{"name": "get_weather", "description": "Get the weather for a city", "input_schema": {"type": "object", "properties": {"city": {"type": "string"}}, "required": ["city"]}},
+			{"name": "get_time", "description": "Get the local time for a city", "input_schema": {"type": "object", "properties": {"city": {"type": "string"}}}}
+		],
+		"tool_choice": {"type": "none"},
+		"messages": [
+			{"role": "user", "content": "What's the weather in Paris?"},
+			{"role": "assistant", "content": [{"type": "tool_use", "id": "toolu_01", "name": "get_weather", "input": {"city": "Paris"}}]},
+			{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "toolu_01", "content": "18°C, sunny"}, {"type": "text", "text": "Summarize that without calling tools."}]}
+		]
+	}`
+	var req types.AnthropicRequest
+	if err := utils.SafeUnmarshal([]byte(body), &req); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := newTestContext()
+	cwReq, err := BuildCodeWhispererRequest(req, ctx)
+	if err != nil {
+		t.Fatalf("BuildCodeWhispererRequest: %v", err)
+	}
+
+	tools := cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools
+	if len(tools) != 1 || tools[0].ToolSpecification.Name != "get_weather" {
+		t.Fatalf("upstream tools = %+v, want only get_weather (referenced by history)", tools)
+	}
+
+	data, err := utils.SafeMarshal(cwReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "Do not call any tools.") {
+		t.Error("tool_choice none prompt not injected")
+	}
+	if !strings.Contains(string(data), `"toolUseId":"toolu_01"`) {
+		t.Error("tool_use history dropped")
+	}
+	if !strings.Contains(InjectedPrompt(req), "Do not call any tools.") {
+		t.Error("InjectedPrompt does not include the tool_choice none prompt")
+	}
+}
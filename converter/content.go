@@ -39,11 +39,10 @@ func processMessageContent(content any) (string, []types.CodeWhispererImage, err
 						utils.Log("文本块的Text字段为nil")
 					}
 				case "image":
-					// ... 图片处理保持不变
 					if contentBlock.Source != nil {
 						// 验证图片内容
-						if err := utils.ValidateImageContent(contentBlock.Source); err != nil {
-							return "", nil, fmt.Errorf("图片验证失败: %v", err)
+						if err := validateImage(contentBlock.Source); err != nil {
+							return "", nil, err
 						}
 
 						// 转换为 CodeWhisperer 格式
@@ -88,8 +87,8 @@ func processMessageContent(content any) (string, []types.CodeWhispererImage, err
 			case "image":
 				if block.Source != nil {
 					// 验证图片内容
-					if err := utils.ValidateImageContent(block.Source); err != nil {
-						return "", nil, fmt.Errorf("图片验证失败: %v", err)
+					if err := validateImage(block.Source); err != nil {
+						return "", nil, err
 					}
 
 					// 转换为 CodeWhisperer 格式
@@ -227,3 +226,61 @@ func parseContentBlock(block map[string]any) (types.ContentBlock, error) {
 
 	return contentBlock, nil
 }
+
+// historyAssistantContent 历史助手消息的文本内容，thinking 块以 <thinking> 标签拼接在回复之前（与上游原始输出格式一致）
+// redacted_thinking 的加密内容无法发给上游，直接忽略
+func historyAssistantContent(content any) (string, error) {
+	text, err := utils.GetMessageContent(content)
+	if err != nil {
+		return text, err
+	}
+
+	var thinkingParts []string
+	hasText := false
+	switch v := content.(type) {
+	case []any:
+		for _, item := range v {
+			block, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			switch block["type"] {
+			case "thinking":
+				if thinking, _ := block["thinking"].(string); thinking != "" {
+					thinkingParts = append(thinkingParts, "<thinking>\n"+thinking+"\n</thinking>")
+				}
+			case "text":
+				if s, _ := block["text"].(string); s != "" {
+					hasText = true
+				}
+			case "tool_use", "redacted_thinking":
+			default:
+				hasText = true
+			}
+		}
+	case []types.ContentBlock:
+		for _, block := range v {
+			switch block.Type {
+			case "thinking":
+				if block.Text != nil && *block.Text != "" {
+					thinkingParts = append(thinkingParts, "<thinking>\n"+*block.Text+"\n</thinking>")
+				}
+			case "text":
+				hasText = hasText || (block.Text != nil && *block.Text != "")
+			case "tool_use", "redacted_thinking":
+			default:
+				hasText = true
+			}
+		}
+	}
+
+	if len(thinkingParts) == 0 {
+		return text, nil
+	}
+	thinking := strings.Join(thinkingParts, "\n\n")
+	if !hasText {
+		// 只有 thinking 和工具调用时不使用占位文本
+		return thinking, nil
+	}
+	return thinking + "\n\n" + text, nil
+}
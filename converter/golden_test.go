@@ -0,0 +1,101 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+)
+
+// update 为 true 时用当前输出重写 testdata 中的 .golden.json 文件：go test ./converter -run Golden -update
+var update = flag.Bool("update", false, "rewrite testdata/*.golden.json with the current output")
+
+/**
+ * pinGoldenConfig 固定转换依赖的配置，使 golden 文件不随开发者的环境变量或配置文件变化
+ */
+func pinGoldenConfig(t *testing.T) {
+	t.Helper()
+	settings := *config.Current()
+	settings.ModelMap = map[string]string{
+		"claude-opus-4-6":   "claude-opus-4-6",
+		"claude-sonnet-4-6": "claude-sonnet-4-6",
+		"claude-opus-4-5":   "claude-opus-4.5",
+		"claude-sonnet-4-5": "claude-sonnet-4.5",
+		"claude-haiku-4-5":  "claude-haiku-4.5",
+	}
+	settings.MaxToolDescriptionLength = 10000
+	settings.AgenticPrompt = true
+	settings.ThinkingPrompt = true
+	settings.UpstreamForwardSampling = true
+	settings.UpstreamTopKMax = 500
+	t.Cleanup(config.Use(&settings))
+}
+
+/**
+ * TestBuildCodeWhispererRequestGolden 用典型客户端形状的请求样本校验转换结果
+ * testdata/<client>.request.json 是按各客户端请求形状手工构造的 Anthropic 请求（合成样本，非真实抓包），
+ * <client>.golden.json 为期望的 CodeWhisperer 请求；每次生成的随机 ID 固定为占位值后再比较
+ */
+func TestBuildCodeWhispererRequestGolden(t *testing.T) {
+	pinGoldenConfig(t)
+
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "*.request.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no fixtures in testdata")
+	}
+
+	for _, fixture := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(fixture), ".request.json")
+		t.Run(name, func(t *testing.T) {
+			raw, err := os.ReadFile(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var req types.AnthropicRequest
+			if err := utils.SafeUnmarshal(raw, &req); err != nil {
+				t.Fatalf("parse fixture: %v", err)
+			}
+
+			cwReq, err := BuildCodeWhispererRequest(req, nil)
+			if err != nil {
+				t.Fatalf("BuildCodeWhispererRequest: %v", err)
+			}
+			cwReq.ConversationState.ConversationId = "00000000-0000-0000-0000-000000000000"
+			cwReq.ConversationState.AgentContinuationId = "00000000-0000-0000-0000-000000000000"
+
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(cwReq); err != nil {
+				t.Fatal(err)
+			}
+			got := buf.Bytes()
+
+			golden := filepath.Join("testdata", name+".golden.json")
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("read golden file (run with -update to create it): %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("CodeWhispererRequest differs from %s (run with -update if the change is intended)\ngot:\n%s", golden, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package converter
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/maphash"
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * 历史增量构建缓存
+ * Agent 循环每轮都会重发几乎相同的历史，逐条转换并序列化的开销随轮数线性增长。
+ * 这里按会话缓存已转换并序列化的历史前缀（截止到最后一条 assistant 消息），
+ * 下一轮只需转换新增的消息；前缀中任一消息发生变化（客户端压缩、编辑历史）即视为分叉，整体重建
+ */
+
+// historyCacheEntry 一个会话已转换并序列化的历史前缀
+type historyCacheEntry struct {
+	fingerprints []uint64          // 前缀中每条 Anthropic 消息的指纹
+	items        []json.RawMessage // 前缀转换后的历史条目（已序列化，只读）
+	lastUsed     time.Time
+}
+
+// HistoryCacheKey gin 上下文键：本次请求使用的 *HistoryCache，未设置时不缓存历史
+const HistoryCacheKey = "historyCache"
+
+// conversationIDHeader 客户端提供的会话标识请求头
+const conversationIDHeader = "X-Conversation-ID"
+
+var fingerprintSeed = maphash.MakeSeed()
+
+// HistoryCache 按会话缓存已转换的历史前缀，由服务层持有并经 HistoryCacheKey 放入请求上下文
+type HistoryCache struct {
+	mu      sync.Mutex
+	entries map[string]*historyCacheEntry
+}
+
+// NewHistoryCache 创建历史前缀缓存，容量和过期时间由 HistoryCacheMaxEntries / HistoryCacheTTL 决定
+func NewHistoryCache() *HistoryCache {
+	return &HistoryCache{entries: make(map[string]*historyCacheEntry)}
+}
+
+// historyCacheOf 返回请求使用的历史前缀缓存，未注入时返回 nil
+func historyCacheOf(ctx *gin.Context) *HistoryCache {
+	if ctx == nil {
+		return nil
+	}
+	v, _ := ctx.Get(HistoryCacheKey)
+	hc, _ := v.(*HistoryCache)
+	return hc
+}
+
+/**
+ * historyCacheKey 会话缓存键：本地 API Key、上游模型和会话标识共同确定一个会话
+ * 客户端通过 X-Conversation-ID 提供会话标识时按其区分，否则以首条消息的指纹代替
+ * （首条消息相同的不同会话共用一个条目，前缀指纹不一致时整体重建，结果仍然正确）
+ */
+func historyCacheKey(ctx *gin.Context, modelId string, fingerprints []uint64) string {
+	var h maphash.Hash
+	h.SetSeed(fingerprintSeed)
+	h.WriteString(ctx.GetString("apiKeyHash"))
+	h.WriteByte(0)
+	h.WriteString(modelId)
+	h.WriteByte(0)
+	if id := ctx.GetHeader(conversationIDHeader); id != "" {
+		h.WriteByte('c')
+		h.WriteString(id)
+	} else if len(fingerprints) > 0 {
+		h.WriteByte('f')
+		writeUint64(&h, fingerprints[0])
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// lookup 返回与当前消息前缀一致的缓存条目，未命中或已分叉时返回 nil
+func (hc *HistoryCache) lookup(key string, fingerprints []uint64) *historyCacheEntry {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	entry, ok := hc.entries[key]
+	if !ok {
+		return nil
+	}
+	n := len(entry.fingerprints)
+	if n > len(fingerprints) || !slices.Equal(entry.fingerprints, fingerprints[:n]) || time.Since(entry.lastUsed) > config.HistoryCacheTTL {
+		delete(hc.entries, key)
+		return nil
+	}
+	entry.lastUsed = time.Now()
+	return entry
+}
+
+// store 保存会话的历史前缀，超出容量时淘汰过期和最久未使用的条目
+func (hc *HistoryCache) store(key string, fingerprints []uint64, items []json.RawMessage) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := hc.entries[key]; !ok && len(hc.entries) >= config.HistoryCacheMaxEntries {
+		oldestKey, oldest := "", now
+		for k, e := range hc.entries {
+			if now.Sub(e.lastUsed) > config.HistoryCacheTTL {
+				delete(hc.entries, k)
+			} else if e.lastUsed.Before(oldest) {
+				oldestKey, oldest = k, e.lastUsed
+			}
+		}
+		if len(hc.entries) >= config.HistoryCacheMaxEntries {
+			delete(hc.entries, oldestKey)
+		}
+	}
+	hc.entries[key] = &historyCacheEntry{fingerprints: fingerprints, items: items, lastUsed: now}
+}
+
+/**
+ * cacheHistory 将本轮新转换的历史条目序列化，与命中的前缀一起保存，供下一轮复用
+ * history[cached:] 中的条目原地替换为序列化结果，避免本轮请求再次序列化
+ * 任一条目序列化失败时放弃缓存，保留原始结构交由整体序列化处理
+ */
+func (hc *HistoryCache) cacheHistory(key string, fingerprints []uint64, history []any, prefix *historyCacheEntry) {
+	cached := 0
+	if prefix != nil {
+		cached = len(prefix.items)
+	}
+
+	items := make([]json.RawMessage, len(history))
+	if prefix != nil {
+		copy(items, prefix.items)
+	}
+	for i := cached; i < len(history); i++ {
+		raw, err := utils.SafeMarshal(history[i])
+		if err != nil {
+			return
+		}
+		items[i] = raw
+	}
+	for i := cached; i < len(history); i++ {
+		history[i] = items[i]
+	}
+	hc.store(key, fingerprints, items)
+}
+
+// messageFingerprints 计算每条消息的指纹（角色 + 内容）
+func messageFingerprints(messages []types.AnthropicRequestMessage) []uint64 {
+	fingerprints := make([]uint64, len(messages))
+	var h maphash.Hash
+	for i, msg := range messages {
+		h.SetSeed(fingerprintSeed)
+		h.WriteString(msg.Role)
+		h.WriteByte(0)
+		hashValue(&h, msg.Content)
+		fingerprints[i] = h.Sum64()
+	}
+	return fingerprints
+}
+
+// hashValue 按结构递归哈希 JSON 反序列化得到的值，map 按键排序保证结果稳定
+func hashValue(h *maphash.Hash, v any) {
+	switch val := v.(type) {
+	case nil:
+		h.WriteByte('n')
+	case string:
+		h.WriteByte('s')
+		writeUint64(h, uint64(len(val)))
+		h.WriteString(val)
+	case bool:
+		if val {
+			h.WriteByte('t')
+		} else {
+			h.WriteByte('f')
+		}
+	case float64:
+		h.WriteByte('d')
+		writeUint64(h, math.Float64bits(val))
+	case []any:
+		h.WriteByte('a')
+		writeUint64(h, uint64(len(val)))
+		for _, item := range val {
+			hashValue(h, item)
+		}
+	case map[string]any:
+		h.WriteByte('m')
+		writeUint64(h, uint64(len(val)))
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			hashValue(h, k)
+			hashValue(h, val[k])
+		}
+	default:
+		// 内部构造的类型化内容块等，按 JSON 序列化结果哈希
+		raw, _ := utils.SafeMarshal(val)
+		h.WriteByte('j')
+		writeUint64(h, uint64(len(raw)))
+		h.Write(raw)
+	}
+}
+
+func writeUint64(h *maphash.Hash, v uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	h.Write(buf[:])
+}
@@ -0,0 +1,124 @@
+package converter
+
+import (
+	"fmt"
+	"testing"
+
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+)
+
+// agentLoopRequest 构造 turns 轮 agent 循环的请求：每轮 assistant 调用工具，user 返回工具结果
+func agentLoopRequest(turns int) types.AnthropicRequest {
+	req := types.AnthropicRequest{
+		Model:     "claude-sonnet-4-5",
+		MaxTokens: 8192,
+		System:    []types.AnthropicSystemMessage{{Type: "text", Text: "You are a coding agent."}},
+		Tools: []types.AnthropicTool{{
+			Name:        "Bash",
+			Description: "Executes a bash command.",
+			InputSchema: map[string]any{
+				"type":       "object",
+				"properties": map[string]any{"command": map[string]any{"type": "string"}},
+				"required":   []any{"command"},
+			},
+		}},
+		Messages: []types.AnthropicRequestMessage{{Role: "user", Content: "Fix the failing tests."}},
+	}
+	for i := range turns {
+		id := fmt.Sprintf("toolu_%04d", i)
+		req.Messages = append(req.Messages,
+			types.AnthropicRequestMessage{Role: "assistant", Content: []any{
+				map[string]any{"type": "text", "text": fmt.Sprintf("Step %d: running the tests again.", i)},
+				map[string]any{"type": "tool_use", "id": id, "name": "Bash", "input": map[string]any{"command": "go test ./..."}},
+			}},
+			types.AnthropicRequestMessage{Role: "user", Content: []any{
+				map[string]any{"type": "tool_result", "tool_use_id": id, "content": fmt.Sprintf("--- FAIL: TestCase%d\n    case_test.go:%d: got 1, want 2\nFAIL", i, i+10)},
+			}},
+		)
+	}
+	return req
+}
+
+// BenchmarkBuildHistory200Turns 比较 200 轮历史在增量缓存命中与冷启动时的转换和序列化开销
+func BenchmarkBuildHistory200Turns(b *testing.B) {
+	req := agentLoopRequest(200)
+
+	b.Run("cold", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			// 没有请求上下文（未注入历史缓存）时不使用历史缓存
+			cwReq, err := BuildCodeWhispererRequest(req, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := utils.SafeMarshal(cwReq); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		historyCache := NewHistoryCache()
+		ctx := newTestContext()
+		ctx.Set("apiKeyHash", "benchmark")
+		ctx.Set(HistoryCacheKey, historyCache)
+		if _, err := BuildCodeWhispererRequest(req, ctx); err != nil {
+			b.Fatal(err)
+		}
+		modelId := config.Current().ModelMap[req.Model]
+		if modelId == "" {
+			modelId = req.Model
+		}
+		// 最后一条 user 消息作为 currentMessage，不属于历史
+		fingerprints := messageFingerprints(req.Messages[:len(req.Messages)-1])
+		if historyCache.lookup(historyCacheKey(ctx, modelId, fingerprints), fingerprints) == nil {
+			b.Fatal("history prefix not cached after warm-up")
+		}
+
+		b.ReportAllocs()
+		for b.Loop() {
+			cwReq, err := BuildCodeWhispererRequest(req, ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := utils.SafeMarshal(cwReq); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestHistoryCacheKey(t *testing.T) {
+	first := messageFingerprints([]types.AnthropicRequestMessage{{Role: "user", Content: "Fix the failing tests."}})
+	compacted := messageFingerprints([]types.AnthropicRequestMessage{{Role: "user", Content: "Summary of the session so far."}})
+
+	key := func(conversationID string, fingerprints []uint64) string {
+		ctx := newTestContext()
+		ctx.Set("apiKeyHash", "key-1")
+		if conversationID != "" {
+			ctx.Request.Header.Set(conversationIDHeader, conversationID)
+		}
+		return historyCacheKey(ctx, "claude-sonnet-4.5", fingerprints)
+	}
+
+	tests := []struct {
+		name      string
+		a, b      string
+		fa, fb    []uint64
+		wantEqual bool
+	}{
+		{name: "same conversation after compaction", a: "conv-1", b: "conv-1", fa: first, fb: compacted, wantEqual: true},
+		{name: "different conversations with the same first message", a: "conv-1", b: "conv-2", fa: first, fb: first},
+		{name: "no conversation ID falls back to the first message", fa: first, fb: first, wantEqual: true},
+		{name: "no conversation ID and different first message", fa: first, fb: compacted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := key(tt.a, tt.fa) == key(tt.b, tt.fb); got != tt.wantEqual {
+				t.Errorf("keys equal = %v, want %v", got, tt.wantEqual)
+			}
+		})
+	}
+}
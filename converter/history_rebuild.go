@@ -0,0 +1,129 @@
+package converter
+
+import (
+	"fmt"
+	"strings"
+
+	"kiro/types"
+)
+
+// FreshConversationKey gin 上下文标记：上游报告会话状态错误后重试时设置
+// 设置后使用全新的 ConversationId，并重建历史中工具调用与结果的配对
+const FreshConversationKey = "freshConversation"
+
+// PaddingKey gin 上下文键：转换时为满足上游格式要求补齐的文本（自动配对的 "OK"、占位内容等），用于统计代理开销
+const PaddingKey = "conversionPadding"
+
+// rebuildHistory 修复历史中工具调用与工具结果的配对关系
+// 上游要求每个 toolResult 都对应紧邻的上一条 assistant 消息中的 toolUse，且每个 toolUse 都有结果；
+// 客户端截断或压缩历史后常出现孤立的调用/结果，导致上游以会话状态错误拒绝请求。
+// 孤立的工具结果转为普通文本保留，孤立的工具调用直接移除。返回修复时补齐的文本
+func rebuildHistory(cwReq *types.CodeWhispererRequest) []string {
+	var padding []string
+	history := cwReq.ConversationState.History
+	current := &cwReq.ConversationState.CurrentMessage.UserInputMessage
+
+	for i, item := range history {
+		assistant, ok := item.(types.HistoryAssistantMessage)
+		if !ok || len(assistant.AssistantResponseMessage.ToolUses) == 0 {
+			continue
+		}
+
+		// 下一条 user 消息（或当前消息）中已回复的工具调用
+		answered := make(map[string]bool)
+		if i+1 < len(history) {
+			if next, ok := history[i+1].(types.HistoryUserMessage); ok {
+				for _, r := range next.UserInputMessage.UserInputMessageContext.ToolResults {
+					answered[r.ToolUseId] = true
+				}
+			}
+		} else {
+			for _, r := range current.UserInputMessageContext.ToolResults {
+				answered[r.ToolUseId] = true
+			}
+		}
+
+		var kept []types.ToolUseEntry
+		for _, use := range assistant.AssistantResponseMessage.ToolUses {
+			if answered[use.ToolUseId] {
+				kept = append(kept, use)
+			}
+		}
+		assistant.AssistantResponseMessage.ToolUses = kept
+		history[i] = assistant
+	}
+
+	// 按修复后的工具调用过滤工具结果
+	var prevUses map[string]bool
+	for i, item := range history {
+		switch msg := item.(type) {
+		case types.HistoryAssistantMessage:
+			prevUses = toolUseIDs(msg.AssistantResponseMessage.ToolUses)
+		case types.HistoryUserMessage:
+			ctx := &msg.UserInputMessage.UserInputMessageContext
+			var headers []string
+			ctx.ToolResults, msg.UserInputMessage.Content, headers = splitOrphanToolResults(ctx.ToolResults, prevUses, msg.UserInputMessage.Content)
+			padding = append(padding, headers...)
+			if msg.UserInputMessage.Content == "" && len(ctx.ToolResults) == 0 {
+				msg.UserInputMessage.Content = "OK"
+				padding = append(padding, "OK")
+			}
+			history[i] = msg
+			prevUses = nil
+		}
+	}
+
+	var headers []string
+	current.UserInputMessageContext.ToolResults, current.Content, headers = splitOrphanToolResults(
+		current.UserInputMessageContext.ToolResults, prevUses, current.Content)
+	return append(padding, headers...)
+}
+
+// splitOrphanToolResults 保留有对应调用的工具结果，其余转为文本附加到内容中
+// 同时返回为孤立结果添加的标题行（计入代理补齐开销）
+func splitOrphanToolResults(results []types.ToolResult, uses map[string]bool, content string) ([]types.ToolResult, string, []string) {
+	if len(results) == 0 {
+		return results, content, nil
+	}
+
+	var kept []types.ToolResult
+	var orphanText []string
+	var headers []string
+	for _, r := range results {
+		if uses[r.ToolUseId] {
+			kept = append(kept, r)
+			continue
+		}
+		header := fmt.Sprintf("[tool_result %s]", r.ToolUseId)
+		headers = append(headers, header)
+		orphanText = append(orphanText, header+"\n"+toolResultText(r))
+	}
+
+	if len(orphanText) > 0 {
+		parts := append([]string{}, orphanText...)
+		if content != "" {
+			parts = append(parts, content)
+		}
+		content = strings.Join(parts, "\n\n")
+	}
+	return kept, content, headers
+}
+
+// toolResultText 提取工具结果中的文本内容
+func toolResultText(r types.ToolResult) string {
+	var parts []string
+	for _, item := range r.Content {
+		if text, ok := item["text"].(string); ok && text != "" {
+			parts = append(parts, text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func toolUseIDs(uses []types.ToolUseEntry) map[string]bool {
+	ids := make(map[string]bool, len(uses))
+	for _, use := range uses {
+		ids[use.ToolUseId] = true
+	}
+	return ids
+}
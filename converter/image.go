@@ -0,0 +1,255 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"slices"
+	"strings"
+
+	_ "image/gif" // 注册 GIF 解码器（缩放后重新编码为 PNG）
+
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * 图片处理流水线
+ * 转换前校验图片的来源、格式、大小和尺寸，问题图片直接返回明确的 400，而不是转发给上游后得到难以理解的错误；
+ * 配置 IMAGE_DOWNSCALE_DIMENSION 时把过大的图片等比缩小并重新编码（JPEG 保持 JPEG，其余编码为 PNG）
+ */
+
+// upstreamImageFormats 上游接受的图片 media type
+var upstreamImageFormats = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+// maxDecodePixels 允许解码缩放的最大像素数（8000x8000），防止超大图片耗尽内存
+const maxDecodePixels = 8000 * 8000
+
+// downscaleJPEGQuality 缩放后重新编码 JPEG 的质量
+const downscaleJPEGQuality = 85
+
+// ImageError 请求中的图片无效，调用方应返回 400 invalid_request_error
+type ImageError struct {
+	Path    string // 图片在请求中的位置，如 messages.0.content.1
+	Message string
+}
+
+func (e *ImageError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+/**
+ * PrepareImages 校验请求中的全部图片，并按配置缩放超出尺寸的图片
+ * 在转换前调用一次：缩放结果直接写回请求的内容块，上游重试和请求回放不会重复缩放
+ * 图片无效时返回 *ImageError
+ */
+func PrepareImages(req *types.AnthropicRequest, ctx *gin.Context) error {
+	for i, msg := range req.Messages {
+		blocks, ok := msg.Content.([]any)
+		if !ok {
+			continue
+		}
+		for j, item := range blocks {
+			block, ok := item.(map[string]any)
+			if !ok || block["type"] != "image" {
+				continue
+			}
+
+			path := fmt.Sprintf("messages.%d.content.%d", i, j)
+			source, _ := block["source"].(map[string]any)
+			if source == nil {
+				return &ImageError{Path: path, Message: "图片缺少 source 字段"}
+			}
+			src := &types.ImageSource{}
+			src.Type, _ = source["type"].(string)
+			src.MediaType, _ = source["media_type"].(string)
+			src.Data, _ = source["data"].(string)
+
+			prepared, err := prepareImage(ctx, src)
+			if err != nil {
+				return &ImageError{Path: path, Message: err.Error()}
+			}
+			if prepared != src {
+				source["media_type"] = prepared.MediaType
+				source["data"] = prepared.Data
+			}
+		}
+	}
+	return nil
+}
+
+// prepareImage 校验单张图片，需要缩放时返回新的图片来源，否则原样返回
+func prepareImage(ctx *gin.Context, src *types.ImageSource) (*types.ImageSource, error) {
+	data, err := decodeImageSource(src)
+	if err != nil {
+		return nil, err
+	}
+
+	width, height, err := utils.GetImageDimensions(data)
+	if err != nil {
+		// 尺寸无法解析（数据截断等）时交给上游判断
+		return src, nil
+	}
+	target, err := imageTargetDimension(width, height)
+	if err != nil {
+		return nil, err
+	}
+	if target == 0 {
+		return src, nil
+	}
+
+	resized, mediaType, err := downscaleImage(data, target)
+	if err != nil {
+		if max(width, height) > config.Current().ImageMaxDimension {
+			return nil, fmt.Errorf("图片尺寸 %dx%d 超过上限 %d 像素，且无法缩放: %v", width, height, config.Current().ImageMaxDimension, err)
+		}
+		utils.Log("图片缩放失败，原样转发",
+			utils.LogString("media_type", src.MediaType),
+			utils.LogErr(err))
+		return src, nil
+	}
+
+	utils.RecordPolicy(ctx, "image", "%s %dx%d downscaled to %d px (%d -> %d bytes)", src.MediaType, width, height, target, len(data), len(resized))
+	return &types.ImageSource{
+		Type:      "base64",
+		MediaType: mediaType,
+		Data:      base64.StdEncoding.EncodeToString(resized),
+	}, nil
+}
+
+// decodeImageSource 校验图片来源、格式和大小，返回解码后的图片数据
+func decodeImageSource(src *types.ImageSource) ([]byte, error) {
+	if src == nil || src.Data == "" {
+		return nil, fmt.Errorf("图片数据为空")
+	}
+	if src.Type != "base64" {
+		return nil, fmt.Errorf("不支持的图片来源类型 %q，仅支持 base64", src.Type)
+	}
+	if !slices.Contains(upstreamImageFormats, src.MediaType) {
+		return nil, fmt.Errorf("不支持的图片格式 %q，支持: %s", src.MediaType, strings.Join(upstreamImageFormats, ", "))
+	}
+
+	data, err := base64.StdEncoding.DecodeString(src.Data)
+	if err != nil {
+		return nil, fmt.Errorf("无效的 base64 编码: %v", err)
+	}
+	if len(data) > config.Current().ImageMaxBytes {
+		return nil, fmt.Errorf("图片大小 %d 字节超过上限 %d 字节", len(data), config.Current().ImageMaxBytes)
+	}
+	if detected, err := utils.DetectImageFormat(data); err == nil && detected != src.MediaType {
+		return nil, fmt.Errorf("图片格式不匹配: 声明为 %s，实际为 %s", src.MediaType, detected)
+	}
+	return data, nil
+}
+
+// validateImage 转换时的最终校验（不缩放）：PrepareImages 未处理的图片在这里拒绝
+func validateImage(src *types.ImageSource) error {
+	data, err := decodeImageSource(src)
+	if err != nil {
+		return &ImageError{Message: err.Error()}
+	}
+	if width, height, err := utils.GetImageDimensions(data); err == nil && max(width, height) > config.Current().ImageMaxDimension {
+		return &ImageError{Message: fmt.Sprintf("图片尺寸 %dx%d 超过上限 %d 像素", width, height, config.Current().ImageMaxDimension)}
+	}
+	return nil
+}
+
+// imageTargetDimension 返回图片需要缩放到的最长边，0 表示无需缩放；超出上限且未启用缩放时返回错误
+func imageTargetDimension(width, height int) (int, error) {
+	longest := max(width, height)
+	if target := min(config.Current().ImageDownscaleDimension, config.Current().ImageMaxDimension); target > 0 && longest > target {
+		return target, nil
+	}
+	if longest > config.Current().ImageMaxDimension {
+		return 0, fmt.Errorf("图片尺寸 %dx%d 超过上限 %d 像素（可设置 IMAGE_DOWNSCALE_DIMENSION 自动缩放）", width, height, config.Current().ImageMaxDimension)
+	}
+	return 0, nil
+}
+
+// downscaleImage 把图片等比缩小到最长边为 maxEdge 并重新编码，返回编码后的数据和 media type
+// 标准库没有 WebP 解码器，WebP 图片返回错误
+func downscaleImage(data []byte, maxEdge int) ([]byte, string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("无法解析图片: %v", err)
+	}
+	if cfg.Width*cfg.Height > maxDecodePixels {
+		return nil, "", fmt.Errorf("图片像素数 %d 超过可缩放上限 %d", cfg.Width*cfg.Height, maxDecodePixels)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("解码图片失败: %v", err)
+	}
+
+	width, height := scaledSize(cfg.Width, cfg.Height, maxEdge)
+	resized := resizeImage(img, width, height)
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		if err := jpeg.Encode(&buf, resized, &jpeg.Options{Quality: downscaleJPEGQuality}); err != nil {
+			return nil, "", fmt.Errorf("编码 JPEG 失败: %v", err)
+		}
+		return buf.Bytes(), "image/jpeg", nil
+	}
+	// PNG 保留透明度；GIF 缩放后只保留第一帧，编码为 PNG
+	if err := png.Encode(&buf, resized); err != nil {
+		return nil, "", fmt.Errorf("编码 PNG 失败: %v", err)
+	}
+	return buf.Bytes(), "image/png", nil
+}
+
+// scaledSize 等比缩放后的宽高，最长边为 maxEdge
+func scaledSize(width, height, maxEdge int) (int, int) {
+	if width >= height {
+		return maxEdge, max(1, height*maxEdge/width)
+	}
+	return max(1, width*maxEdge/height), maxEdge
+}
+
+// resizeImage 按区域平均（box filter）缩小图片，大比例缩小时比最近邻更平滑
+func resizeImage(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok || bounds.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	}
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * srcH / height
+		y1 := max((y+1)*srcH/height, y0+1)
+		for x := 0; x < width; x++ {
+			x0 := x * srcW / width
+			x1 := max((x+1)*srcW/width, x0+1)
+
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride+x0*4 : sy*rgba.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			offset := y*dst.Stride + x*4
+			for i := range sum {
+				dst.Pix[offset+i] = uint8(sum[i] / n)
+			}
+		}
+	}
+	return dst
+}
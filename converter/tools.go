@@ -113,13 +113,116 @@ func cleanAndValidateToolParameters(params map[string]any) (map[string]any, erro
 	return tempParams, nil
 }
 
+// IsToolChoiceNone tool_choice 是否禁止模型调用工具
+// 支持字符串 "none" 和对象 {"type": "none"} 两种写法
+func IsToolChoiceNone(toolChoice any) bool {
+	switch choice := toolChoice.(type) {
+	case string:
+		return choice == "none"
+	case map[string]any:
+		choiceType, _ := choice["type"].(string)
+		return choiceType == "none"
+	case *types.ToolChoice:
+		return choice != nil && choice.Type == "none"
+	case types.ToolChoice:
+		return choice.Type == "none"
+	}
+	return false
+}
+
+// ForcedToolChoice 返回 tool_choice 要求必须调用的工具名，"any" 时名称为空（任意工具均可）
+// forced 为 false 表示模型可以不调用工具（auto、none 或未设置）
+func ForcedToolChoice(toolChoice any) (name string, forced bool) {
+	choice, ok := convertAnthropicToolChoiceToAnthropic(toolChoice).(*types.ToolChoice)
+	if !ok || choice == nil {
+		return "", false
+	}
+	switch choice.Type {
+	case "any":
+		return "", true
+	case "tool":
+		return choice.Name, choice.Name != ""
+	}
+	return "", false
+}
+
+// ForcedToolTarget 强制调用的工具描述，用于注入的指令和错误信息，name 为空时表示任意工具
+func ForcedToolTarget(name string) string {
+	if name == "" {
+		return "one of the provided tools"
+	}
+	return fmt.Sprintf("the %q tool", name)
+}
+
+// forcedToolPrompt 上游不支持 tool_choice，要求强制调用工具时以指令注入系统提示，未强制时返回空字符串
+func forcedToolPrompt(anthropicReq types.AnthropicRequest) string {
+	name, forced := ForcedToolChoice(anthropicReq.ToolChoice)
+	if !forced || len(anthropicReq.Tools) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("<tool_choice>You must respond by calling %s. Do not reply with plain text only.</tool_choice>", ForcedToolTarget(name))
+}
+
+// ValidateToolChoice 校验 tool_choice 与 tools 是否一致：强制调用时必须声明了工具，指定的工具名必须存在
+func ValidateToolChoice(anthropicReq types.AnthropicRequest) error {
+	name, forced := ForcedToolChoice(anthropicReq.ToolChoice)
+	if !forced {
+		return nil
+	}
+	if len(anthropicReq.Tools) == 0 {
+		return fmt.Errorf("tool_choice requires calling a tool, but no tools were provided")
+	}
+	if name == "" {
+		return nil
+	}
+	for _, tool := range anthropicReq.Tools {
+		if tool.Name == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("tool_choice.name: tool %q not found in tools", name)
+}
+
+// noToolPrompt tool_choice 为 none 但仍需声明历史中用过的工具时，以指令禁止模型调用工具；其他情况返回空字符串
+func noToolPrompt(anthropicReq types.AnthropicRequest) string {
+	if !IsToolChoiceNone(anthropicReq.ToolChoice) || len(toolsForChoiceNone(anthropicReq)) == 0 {
+		return ""
+	}
+	return "<tool_choice>Do not call any tools. Respond with plain text only.</tool_choice>"
+}
+
+/**
+ * toolsForChoiceNone tool_choice 为 none 时仍需发送给上游的工具定义
+ * 历史消息中的 toolUse 必须有对应的工具定义，上游才会接受请求，因此保留历史中调用过的工具，
+ * 其余工具省略；保留的工具由 noToolPrompt 注入的指令禁止调用
+ */
+func toolsForChoiceNone(anthropicReq types.AnthropicRequest) []types.AnthropicTool {
+	used := make(map[string]bool)
+	for _, msg := range anthropicReq.Messages {
+		if msg.Role != "assistant" {
+			continue
+		}
+		for _, toolUse := range extractToolUsesFromMessage(msg.Content) {
+			used[toolUse.Name] = true
+		}
+	}
+
+	var kept []types.AnthropicTool
+	for _, tool := range anthropicReq.Tools {
+		if used[tool.Name] {
+			kept = append(kept, tool)
+		}
+	}
+	return kept
+}
+
 // convertAnthropicToolChoiceToAnthropic 处理 Anthropic 格式的 tool_choice
 // 支持的格式：
 // - string: "auto", "any", "none"
-// - map[string]any: {"type": "tool", "name": "tool_name"}
+// - map[string]any: {"type": "tool", "name": "tool_name"}、{"type": "none"}
 // - *types.ToolChoice: 结构化类型
 func convertAnthropicToolChoiceToAnthropic(toolChoice any) any {
-	if toolChoice == nil {
+	if toolChoice == nil || IsToolChoiceNone(toolChoice) {
 		return nil
 	}
 
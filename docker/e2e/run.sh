@@ -0,0 +1,116 @@
+#!/bin/sh
+# 端到端测试脚本：对运行中的代理执行一组协议一致性检查，任一检查失败时以非零状态退出
+# 依赖 curl 和 jq；上游行为由 mock-upstream 按消息中的 [mock:*] 指令控制
+
+KIRO_URL="${KIRO_URL:-http://localhost:1188}"
+API_KEY="${API_KEY:-e2e-key}"
+ADMIN_KEY="${ADMIN_KEY:-e2e-admin}"
+MODEL="${MODEL:-claude-sonnet-4-5}"
+
+passed=0
+failed=0
+
+pass() {
+	passed=$((passed + 1))
+	echo "PASS  $1"
+}
+
+fail() {
+	failed=$((failed + 1))
+	echo "FAIL  $1"
+	[ -n "$2" ] && echo "      $2"
+}
+
+# check 名称 jq表达式 JSON：jq 表达式结果为 true 时通过
+check() {
+	if echo "$3" | jq -e "$2" >/dev/null 2>&1; then
+		pass "$1"
+	else
+		fail "$1" "$(echo "$3" | head -c 500)"
+	fi
+}
+
+# message 用户消息 [额外的 JSON 字段]：构建 /v1/messages 请求体
+message() {
+	jq -cn --arg model "$MODEL" --arg content "$1" --argjson extra "${2:-{\}}" \
+		'{model: $model, max_tokens: 256, messages: [{role: "user", content: $content}]} + $extra'
+}
+
+post() {
+	curl -s -H "x-api-key: $API_KEY" -H "content-type: application/json" "$@"
+}
+
+# 等待代理启动
+for i in $(seq 1 60); do
+	curl -sf -o /dev/null -H "x-api-key: $API_KEY" "$KIRO_URL/v1/models" && break
+	sleep 1
+done
+
+resp=$(curl -s -H "x-api-key: $API_KEY" "$KIRO_URL/v1/models")
+check "models: 返回模型列表" '.object == "list" and (.data | length > 0)' "$resp"
+
+resp=$(post "$KIRO_URL/v1/messages" -d "$(message 'hello world')")
+check "messages: 非流式回显" '.type == "message" and .content[0].text == "echo: hello world" and .stop_reason == "end_turn"' "$resp"
+check "messages: usage 字段" '.usage.input_tokens > 0 and .usage.output_tokens > 0' "$resp"
+
+events=$(post -N "$KIRO_URL/v1/messages" -d "$(message 'hello stream' '{"stream":true}')" | sed -n 's/^event: //p' | tr '\n' ' ')
+expected="message_start content_block_start ping content_block_delta content_block_delta content_block_stop message_delta message_stop "
+if [ "$events" = "$expected" ]; then
+	pass "messages: 流式事件序列"
+else
+	fail "messages: 流式事件序列" "$events"
+fi
+
+resp=$(post "$KIRO_URL/v1/messages/count_tokens" -d "$(message 'count me')")
+check "count_tokens: 返回 input_tokens" '.input_tokens > 0' "$resp"
+
+resp=$(curl -s -H "authorization: Bearer $API_KEY" -H "content-type: application/json" "$KIRO_URL/v1/chat/completions" \
+	-d "{\"model\":\"$MODEL\",\"messages\":[{\"role\":\"user\",\"content\":\"hello openai\"}]}")
+check "chat/completions: OpenAI 兼容回显" '.object == "chat.completion" and .choices[0].message.content == "echo: hello openai"' "$resp"
+
+status=$(curl -s -o /dev/null -w '%{http_code}' -H "x-api-key: not-a-key" -H "content-type: application/json" "$KIRO_URL/v1/messages" -d "$(message 'hi')")
+[ "$status" = "401" ] && pass "auth: 未知 API Key 返回 401" || fail "auth: 未知 API Key 返回 401" "status $status"
+
+headers=$(post -D - -o /dev/null "$KIRO_URL/v1/messages" -d "$(message 'headers')" | tr -d '\r')
+if echo "$headers" | grep -qi '^anthropic-ratelimit-requests-limit: 1000$'; then
+	pass "rate limit: anthropic-ratelimit-* 响应头"
+else
+	fail "rate limit: anthropic-ratelimit-* 响应头" "$(echo "$headers" | grep -i ratelimit)"
+fi
+
+resp=$(post "$KIRO_URL/v1/messages" -d "$(message 'partial [mock:drop]')")
+check "salvage: 上游断开返回部分内容" '.stop_reason == "max_tokens" and .warning.type == "upstream_disconnected" and (.content[0].text | startswith("echo: "))' "$resp"
+
+events=$(post -N "$KIRO_URL/v1/messages" -d "$(message 'stall [mock:stall]' '{"stream":true}')" | sed -n 's/^event: //p' | tr '\n' ' ')
+case "$events" in
+*"error content_block_stop message_delta message_stop "*) pass "stream: 空闲超时以 error 事件结束" ;;
+*) fail "stream: 空闲超时以 error 事件结束" "$events" ;;
+esac
+
+batch=$(post "$KIRO_URL/v1/messages/batches" -d "{\"requests\":[{\"custom_id\":\"ok\",\"params\":$(message 'batch item')},{\"custom_id\":\"banned\",\"params\":$(message 'batch [mock:403]')}]}")
+batch_id=$(echo "$batch" | jq -r '.id')
+for _ in $(seq 1 20); do
+	status=$(curl -s -H "x-api-key: $API_KEY" "$KIRO_URL/v1/messages/batches/$batch_id" | jq -r '.processing_status')
+	[ "$status" = "ended" ] && break
+	sleep 1
+done
+resp=$(curl -s -H "x-api-key: $API_KEY" "$KIRO_URL/v1/messages/batches/$batch_id/results" | jq -s '.')
+check "batches: 批次结果" '(.[0].custom_id == "ok") and (.[0].result.message.content[0].text == "echo: batch item") and (.[1].result.type == "errored")' "$resp"
+
+# 用量记录异步批量写入，等待一个刷新周期
+sleep 2
+resp=$(curl -s -H "x-api-key: $ADMIN_KEY" "$KIRO_URL/v1/usage?group_by=model")
+check "usage: 记录请求用量" '(.data | length > 0) and (.data[0].requests > 0)' "$resp"
+
+# 额度耗尽后无法恢复，放在最后
+resp=$(post -D /tmp/quota_headers "$KIRO_URL/v1/messages" -d "$(message 'quota [mock:quota]')")
+check "quota: 额度耗尽返回 rate_limit_error" '.error.type == "rate_limit_error" and .error.quota_reset_at != null' "$resp"
+if tr -d '\r' </tmp/quota_headers | grep -qi '^anthropic-ratelimit-requests-remaining: 0$'; then
+	pass "quota: 剩余请求数响应头为 0"
+else
+	fail "quota: 剩余请求数响应头为 0" "$(grep -i 'ratelimit\|retry-after' /tmp/quota_headers)"
+fi
+
+echo
+echo "passed: $passed, failed: $failed"
+[ "$failed" -eq 0 ]
@@ -0,0 +1,36 @@
+// Package eventstreamtest 编码 AWS event-stream 消息，供测试和模拟上游构造 CodeWhisperer 响应
+package eventstreamtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+)
+
+// Frame 编码一条 :message-type 为 event 的 AWS event-stream 消息，payload 以 JSON 编码为消息体
+func Frame(eventType string, payload any) []byte {
+	body, _ := json.Marshal(payload)
+
+	var headers bytes.Buffer
+	for _, h := range [][2]string{
+		{":message-type", "event"},
+		{":event-type", eventType},
+		{":content-type", "application/json"},
+	} {
+		headers.WriteByte(byte(len(h[0])))
+		headers.WriteString(h[0])
+		headers.WriteByte(7) // string 类型
+		binary.Write(&headers, binary.BigEndian, uint16(len(h[1])))
+		headers.WriteString(h[1])
+	}
+
+	var frame bytes.Buffer
+	binary.Write(&frame, binary.BigEndian, uint32(12+headers.Len()+len(body)+4))
+	binary.Write(&frame, binary.BigEndian, uint32(headers.Len()))
+	binary.Write(&frame, binary.BigEndian, crc32.ChecksumIEEE(frame.Bytes()))
+	frame.Write(headers.Bytes())
+	frame.Write(body)
+	binary.Write(&frame, binary.BigEndian, crc32.ChecksumIEEE(frame.Bytes()))
+	return frame.Bytes()
+}
@@ -0,0 +1,108 @@
+// Package lifecycle 管理后台 goroutine 的生命周期
+// 所有长期运行的后台任务（定时刷新、清理、热重载、导出）和异步落盘都通过 Go 启动，
+// 进程退出时 Shutdown 取消共享的 context 并等待它们结束，避免泄漏或在退出途中继续工作
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ctx, cancel = context.WithCancel(context.Background())
+	wg          sync.WaitGroup
+
+	mu      sync.Mutex
+	running = make(map[string]int)
+)
+
+// Context 返回后台任务共享的 context，Shutdown 时取消
+func Context() context.Context {
+	return ctx
+}
+
+// Task 一个可单独停止的后台任务
+type Task struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Stop 取消任务并等待其结束，可重复调用；nil 任务直接返回
+func (t *Task) Stop() {
+	if t == nil {
+		return
+	}
+	t.cancel()
+	<-t.done
+}
+
+// Go 启动受管理的后台 goroutine，fn 应在 ctx 取消后尽快返回
+// ctx 在 Shutdown 或返回任务的 Stop 时取消；name 用于在退出超时时报告仍未结束的任务
+func Go(name string, fn func(ctx context.Context)) *Task {
+	taskCtx, taskCancel := context.WithCancel(ctx)
+	task := &Task{cancel: taskCancel, done: make(chan struct{})}
+
+	wg.Add(1)
+	mu.Lock()
+	running[name]++
+	mu.Unlock()
+
+	go func() {
+		defer func() {
+			taskCancel()
+			mu.Lock()
+			if running[name]--; running[name] == 0 {
+				delete(running, name)
+			}
+			mu.Unlock()
+			close(task.done)
+			wg.Done()
+		}()
+		fn(taskCtx)
+	}()
+	return task
+}
+
+// Running 返回仍在运行的后台任务数
+func Running() int {
+	mu.Lock()
+	defer mu.Unlock()
+	n := 0
+	for _, count := range running {
+		n += count
+	}
+	return n
+}
+
+// Shutdown 取消所有后台任务并等待其结束，超时时返回仍在运行的任务名
+func Shutdown(timeout time.Duration) error {
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		mu.Lock()
+		names := make([]string, 0, len(running))
+		for name := range running {
+			names = append(names, name)
+		}
+		mu.Unlock()
+		sort.Strings(names)
+		return fmt.Errorf("%v 内仍有后台任务未结束: %v", timeout, names)
+	}
+}
+
+// Stopping 后台任务是否已被要求退出
+func Stopping() bool {
+	return ctx.Err() != nil
+}
@@ -0,0 +1,80 @@
+package lifecycle_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"kiro/cache"
+	"kiro/config"
+	"kiro/internal/eventstreamtest"
+	"kiro/lifecycle"
+	"kiro/parser"
+	"kiro/rules"
+	"kiro/tenant"
+)
+
+/**
+ * TestShutdownStopsBackgroundGoroutines 后台循环和非流式解析在 lifecycle context 取消后全部结束
+ * Running() 归零，goroutine 数量在期限内回到启动前的水平
+ */
+func TestShutdownStopsBackgroundGoroutines(t *testing.T) {
+	// Shutdown 取消的是进程级 context，只能执行一次（如 -count 大于 1 时）
+	if lifecycle.Stopping() {
+		t.Skip("lifecycle context already cancelled in this process")
+	}
+
+	// os/signal 首次 Notify 时启动常驻的分发 goroutine，先预热再记录基线
+	warm := make(chan os.Signal, 1)
+	signal.Notify(warm, syscall.SIGHUP)
+	signal.Stop(warm)
+	baseline := runtime.NumGoroutine()
+
+	config.StartReloadWatcher()
+	rules.StartReloadTicker()
+	tenant.StartReloadTicker()
+	cache.StartPromptCache(time.Minute, cache.Limits{})
+	lifecycle.Go("test-blocked", func(ctx context.Context) {
+		<-ctx.Done()
+	})
+	if n := lifecycle.Running(); n != 5 {
+		t.Fatalf("Running() = %d after starting loops, want 5", n)
+	}
+
+	var stream []byte
+	for range 20 {
+		stream = append(stream, eventstreamtest.Frame("assistantResponseEvent", map[string]any{"content": "chunk "})...)
+	}
+	if _, err := parser.NewCompliantEventStreamParser().ParseResponseContext(lifecycle.Context(), stream); err != nil {
+		t.Fatalf("ParseResponseContext before shutdown: %v", err)
+	}
+
+	if err := lifecycle.Shutdown(5 * time.Second); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if !lifecycle.Stopping() {
+		t.Error("Stopping() = false after Shutdown")
+	}
+	if n := lifecycle.Running(); n != 0 {
+		t.Errorf("Running() = %d after Shutdown, want 0", n)
+	}
+
+	// 非流式解析在当前 goroutine 中运行，context 取消后停止而不是留下后台 goroutine
+	if _, err := parser.NewCompliantEventStreamParser().ParseResponseContext(lifecycle.Context(), stream); !errors.Is(err, context.Canceled) {
+		t.Errorf("ParseResponseContext after shutdown: err = %v, want context.Canceled", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("goroutines = %d, want <= %d\n%s", runtime.NumGoroutine(), baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
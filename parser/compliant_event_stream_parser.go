@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"context"
 	"fmt"
 	"kiro/utils"
 )
@@ -32,6 +33,11 @@ func (cesp *CompliantEventStreamParser) Reset() {
 
 // ParseResponse 解析完整的 CodeWhisperer 响应
 func (cesp *CompliantEventStreamParser) ParseResponse(streamData []byte) (*ParseResult, error) {
+	return cesp.ParseResponseContext(context.Background(), streamData)
+}
+
+// ParseResponseContext 解析完整的 CodeWhisperer 响应，ctx 取消或超时后在消息之间停止并返回 ctx 的错误
+func (cesp *CompliantEventStreamParser) ParseResponseContext(ctx context.Context, streamData []byte) (*ParseResult, error) {
 	// 1. 解析二进制事件流
 	messages, err := cesp.robustParser.ParseStream(streamData)
 	if err != nil {
@@ -43,6 +49,9 @@ func (cesp *CompliantEventStreamParser) ParseResponse(streamData []byte) (*Parse
 	var errors []error
 
 	for i, message := range messages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		events, processErr := cesp.messageProcessor.ProcessMessage(message)
 		if processErr != nil {
 			errMsg := fmt.Errorf("处理消息 %d 失败: %w", i, processErr)
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -13,14 +14,26 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"kiro/lifecycle"
+
 	"golang.org/x/net/proxy"
 )
 
 // dataDir 数据文件根目录
 var dataDir = "data"
 
+var (
+	// bindingsWriteMu 串行化绑定文件的写入
+	bindingsWriteMu sync.Mutex
+	// bindingsWriteSeq 最新提交的绑定快照序号
+	bindingsWriteSeq atomic.Uint64
+	// cleanupTask 定时清理和热重载任务
+	cleanupTask *lifecycle.Task
+)
+
 // ConfigBinding 持久化绑定条目
 type ConfigBinding struct {
 	Key   string `json:"key"`
@@ -134,11 +147,9 @@ func GetClient(key string) (*http.Client, string, error) {
 	if p, ok := manager.keyProxyMap[key]; ok {
 		client := manager.clients[p]
 		manager.mu.RUnlock()
-		go func() {
-			manager.mu.Lock()
-			manager.keyLastSeen[key] = time.Now()
-			manager.mu.Unlock()
-		}()
+		manager.mu.Lock()
+		manager.keyLastSeen[key] = time.Now()
+		manager.mu.Unlock()
 		return client, p, nil
 	}
 	manager.mu.RUnlock()
@@ -206,7 +217,7 @@ func GetClient(key string) (*http.Client, string, error) {
 
 	// 持久化绑定
 	manager.configBindings = append(manager.configBindings, ConfigBinding{Key: key, Proxy: chosen})
-	go writeConfigBindings(manager.configBindings)
+	persistBindings(manager.configBindings)
 
 	fmt.Fprintf(os.Stderr, "[Proxy] 分配 %s → %s\n", key[:8], chosen)
 	return manager.clients[chosen], chosen, nil
@@ -223,7 +234,9 @@ func ReportError(key string, proxyURL string) {
 
 	if _, exists := manager.errorProxies[proxyURL]; !exists {
 		manager.errorProxies[proxyURL] = struct{}{}
-		go appendLine(filepath.Join(dataDir, "error_proxies.txt"), proxyURL)
+		lifecycle.Go("proxy-error-log", func(context.Context) {
+			appendLine(filepath.Join(dataDir, "error_proxies.txt"), proxyURL)
+		})
 		fmt.Fprintf(os.Stderr, "[Proxy] 标记故障: %s\n", proxyURL)
 	}
 
@@ -239,7 +252,7 @@ func ReportError(key string, proxyURL string) {
 		cleaned = append(cleaned, b)
 	}
 	manager.configBindings = cleaned
-	go writeConfigBindings(cleaned)
+	persistBindings(cleaned)
 }
 
 // IsProxyError 判断是否为代理自身的连接错误
@@ -255,18 +268,28 @@ func IsProxyError(err error) bool {
 
 // StartCleanupTicker 启动定时清理和热重载
 func StartCleanupTicker() {
-	go func() {
+	cleanupTask.Stop()
+	cleanupTask = lifecycle.Go("proxy-reload", func(ctx context.Context) {
 		reloadTicker := time.NewTicker(30 * time.Second)
 		cleanupTicker := time.NewTicker(5 * time.Minute)
+		defer reloadTicker.Stop()
+		defer cleanupTicker.Stop()
 		for {
 			select {
+			case <-ctx.Done():
+				return
 			case <-reloadTicker.C:
 				checkAndReload()
 			case <-cleanupTicker.C:
 				cleanupBindings()
 			}
 		}
-	}()
+	})
+}
+
+// StopCleanupTicker 停止定时清理和热重载
+func StopCleanupTicker() {
+	cleanupTask.Stop()
 }
 
 // --- 内部方法 ---
@@ -514,6 +537,20 @@ func normalizeProxy(raw string) string {
 	}
 }
 
+// persistBindings 异步落盘代理绑定；并发提交时只写入最新的快照
+func persistBindings(bindings []ConfigBinding) {
+	snapshot := append([]ConfigBinding(nil), bindings...)
+	seq := bindingsWriteSeq.Add(1)
+	lifecycle.Go("proxy-bindings", func(context.Context) {
+		bindingsWriteMu.Lock()
+		defer bindingsWriteMu.Unlock()
+		if seq != bindingsWriteSeq.Load() {
+			return
+		}
+		writeConfigBindings(snapshot)
+	})
+}
+
 func writeConfigBindings(bindings []ConfigBinding) {
 	if bindings == nil {
 		bindings = []ConfigBinding{}
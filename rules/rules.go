@@ -0,0 +1,315 @@
+package rules
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro/lifecycle"
+)
+
+// dataDir 数据文件根目录（与 tenant、proxy 包保持一致）
+var dataDir = "data"
+
+// Match 规则匹配条件，未设置的条件视为匹配任意值，所有已设置的条件同时满足时规则命中
+type Match struct {
+	Model     string            `json:"model"`      // 模型名，支持通配符（如 claude-opus-*）
+	Tenant    string            `json:"tenant"`     // 租户名，支持通配符
+	Key       string            `json:"key"`        // 本地 API Key，支持 sha256:<hex> 写法避免明文
+	Headers   map[string]string `json:"headers"`    // 请求头，值支持通配符，"*" 表示只要求存在
+	MinTokens int               `json:"min_tokens"` // 估算输入 token 数下限（含）
+	MaxTokens int               `json:"max_tokens"` // 估算输入 token 数上限（含），0 表示不限
+}
+
+// Reject 拒绝请求的响应
+type Reject struct {
+	Status  int    `json:"status"`  // HTTP 状态码，默认 403
+	Message string `json:"message"` // 错误消息
+}
+
+// Action 规则命中后执行的动作，可以组合
+type Action struct {
+	Route        string  `json:"route"`         // 上游 token 池：租户名，或 "global" 表示全局 token 池
+	Priority     *int    `json:"priority"`      // 请求优先级，数值越大越优先
+	InjectPrompt string  `json:"inject_prompt"` // 追加到系统提示词末尾的文本
+	Reject       *Reject `json:"reject"`        // 拒绝请求
+}
+
+// Rule 路由规则
+type Rule struct {
+	Name   string `json:"name"`
+	Match  Match  `json:"match"`
+	Action Action `json:"action"`
+	Final  bool   `json:"final"` // 命中后不再评估后续规则
+
+	keyHash string
+}
+
+// Request 参与规则匹配的请求属性
+type Request struct {
+	Model   string
+	Tenant  string
+	KeyHash string // 本地 API Key 的 sha256 十六进制
+	Headers http.Header
+	// Tokens 按需估算输入 token 数，只有规则使用 token 条件时才会调用
+	Tokens func() int
+}
+
+// Result 规则评估结果
+type Result struct {
+	Applied      []string // 命中的规则名（按评估顺序）
+	Route        string
+	Priority     *int
+	InjectPrompt []string
+	Reject       *Reject
+}
+
+// PoolGlobal 路由到全局 token 池
+const PoolGlobal = "global"
+
+var (
+	mu      sync.RWMutex
+	rules   []*Rule
+	modTime time.Time
+
+	// reloadTask 热重载任务
+	reloadTask *lifecycle.Task
+)
+
+// configPath 规则配置文件路径
+func configPath() string {
+	return filepath.Join(dataDir, "rules.json")
+}
+
+// ConfigPath 返回规则配置文件路径
+func ConfigPath() string {
+	return configPath()
+}
+
+// Init 启动时加载路由规则，文件不存在时不启用
+func Init() {
+	if err := load(configPath()); err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "[Rules] 加载失败: %v\n", err)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[Rules] 已加载 %d 条路由规则\n", Count())
+}
+
+// StartReloadTicker 启动规则热重载（每 30 秒检查文件修改时间）
+func StartReloadTicker() {
+	reloadTask.Stop()
+	reloadTask = lifecycle.Go("rules-reload", func(ctx context.Context) {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				checkAndReload()
+			}
+		}
+	})
+}
+
+// StopReloadTicker 停止规则热重载
+func StopReloadTicker() {
+	reloadTask.Stop()
+}
+
+// Count 返回已加载的规则数量
+func Count() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	return len(rules)
+}
+
+// Evaluate 按顺序评估规则，合并所有命中规则的动作
+// 后命中规则的 route / priority 覆盖先命中的，注入的提示词依次追加；命中 reject 或 final 规则后停止评估
+func Evaluate(req Request) Result {
+	mu.RLock()
+	list := rules
+	mu.RUnlock()
+
+	var result Result
+	tokens := -1
+	for _, rule := range list {
+		if !rule.matches(req, &tokens) {
+			continue
+		}
+		result.Applied = append(result.Applied, rule.Name)
+		if rule.Action.Route != "" {
+			result.Route = rule.Action.Route
+		}
+		if rule.Action.Priority != nil {
+			result.Priority = rule.Action.Priority
+		}
+		if rule.Action.InjectPrompt != "" {
+			result.InjectPrompt = append(result.InjectPrompt, rule.Action.InjectPrompt)
+		}
+		if rule.Action.Reject != nil {
+			result.Reject = rule.Action.Reject
+			break
+		}
+		if rule.Final {
+			break
+		}
+	}
+	return result
+}
+
+// Validate 解析并校验规则文件，不加载到运行时
+// 文件不存在时返回 os.IsNotExist 错误
+func Validate(path string) ([]*Rule, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parse(raw)
+}
+
+// --- 内部方法 ---
+
+// matches 判断请求是否满足规则条件，tokens 缓存已估算的 token 数（-1 表示尚未估算）
+func (r *Rule) matches(req Request, tokens *int) bool {
+	m := r.Match
+	if m.Model != "" && !glob(m.Model, req.Model) {
+		return false
+	}
+	if m.Tenant != "" && !glob(m.Tenant, req.Tenant) {
+		return false
+	}
+	if r.keyHash != "" && r.keyHash != req.KeyHash {
+		return false
+	}
+	for name, pattern := range m.Headers {
+		value := req.Headers.Get(name)
+		if value == "" || !glob(pattern, value) {
+			return false
+		}
+	}
+	if m.MinTokens > 0 || m.MaxTokens > 0 {
+		if *tokens < 0 {
+			*tokens = 0
+			if req.Tokens != nil {
+				*tokens = req.Tokens()
+			}
+		}
+		if *tokens < m.MinTokens || (m.MaxTokens > 0 && *tokens > m.MaxTokens) {
+			return false
+		}
+	}
+	return true
+}
+
+// glob 通配符匹配，模式非法时按字面值比较
+func glob(pattern, value string) bool {
+	if ok, err := path.Match(pattern, value); err == nil {
+		return ok
+	}
+	return pattern == value
+}
+
+func parse(raw []byte) ([]*Rule, error) {
+	var list []*Rule
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("解析规则失败: %v", err)
+	}
+
+	for i, r := range list {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if r.Match.MaxTokens > 0 && r.Match.MinTokens > r.Match.MaxTokens {
+			return nil, fmt.Errorf("规则 %s: min_tokens 大于 max_tokens", r.Name)
+		}
+		for _, pattern := range append([]string{r.Match.Model, r.Match.Tenant}, headerPatterns(r.Match.Headers)...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("规则 %s: 通配符 %q 无效", r.Name, pattern)
+			}
+		}
+		if reject := r.Action.Reject; reject != nil {
+			if reject.Status == 0 {
+				reject.Status = http.StatusForbidden
+			}
+			if reject.Status < 400 || reject.Status > 599 {
+				return nil, fmt.Errorf("规则 %s: reject.status 必须是 4xx 或 5xx", r.Name)
+			}
+		}
+		if key := r.Match.Key; key != "" {
+			if strings.HasPrefix(key, "sha256:") {
+				r.keyHash = strings.ToLower(strings.TrimPrefix(key, "sha256:"))
+			} else {
+				h := sha256.Sum256([]byte(key))
+				r.keyHash = hex.EncodeToString(h[:])
+			}
+		}
+	}
+	return list, nil
+}
+
+func headerPatterns(headers map[string]string) []string {
+	patterns := make([]string, 0, len(headers))
+	for _, p := range headers {
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
+
+func load(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	list, err := Validate(path)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	rules = list
+	modTime = info.ModTime()
+	mu.Unlock()
+	return nil
+}
+
+func checkAndReload() {
+	path := configPath()
+	info, err := os.Stat(path)
+	if err != nil {
+		// 文件被删除时清空规则
+		mu.Lock()
+		if len(rules) > 0 {
+			rules = nil
+			modTime = time.Time{}
+			fmt.Fprintf(os.Stderr, "[Rules] 规则文件已删除，路由规则已清空\n")
+		}
+		mu.Unlock()
+		return
+	}
+
+	mu.RLock()
+	changed := info.ModTime().After(modTime)
+	oldCount := len(rules)
+	mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	if err := load(path); err != nil {
+		fmt.Fprintf(os.Stderr, "[Rules] 热重载失败，保留旧规则: %v\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[Rules] 热重载: 规则 %d→%d\n", oldCount, Count())
+}
@@ -0,0 +1,48 @@
+package secrets
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 密钥引用前缀
+// 配置中的值以这些前缀开头时，会在加载时从对应后端读取真实值
+const (
+	PrefixVault = "vault:" // vault:<KV路径>#<字段>，如 vault:secret/data/kiro#team-a
+	PrefixSSM   = "ssm:"   // ssm:<参数名>，如 ssm:/kiro/team-a/refresh-token
+)
+
+// httpClient 访问密钥后端使用的 HTTP 客户端
+var httpClient = &http.Client{Timeout: 15 * time.Second}
+
+// IsRef 判断配置值是否为密钥引用
+func IsRef(value string) bool {
+	return strings.HasPrefix(value, PrefixVault) || strings.HasPrefix(value, PrefixSSM)
+}
+
+// Resolve 解析密钥引用，非引用值原样返回
+func Resolve(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, PrefixVault):
+		return resolveVault(strings.TrimPrefix(value, PrefixVault))
+	case strings.HasPrefix(value, PrefixSSM):
+		return resolveSSM(strings.TrimPrefix(value, PrefixSSM))
+	default:
+		return value, nil
+	}
+}
+
+// ResolveAll 批量解析密钥引用，任一失败即返回错误
+func ResolveAll(values []string) ([]string, error) {
+	resolved := make([]string, len(values))
+	for i, v := range values {
+		r, err := Resolve(v)
+		if err != nil {
+			return nil, fmt.Errorf("解析密钥引用 %s 失败: %v", v, err)
+		}
+		resolved[i] = r
+	}
+	return resolved, nil
+}
@@ -0,0 +1,76 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"kiro/sigv4"
+)
+
+// resolveSSM 从 AWS SSM Parameter Store 读取参数（自动解密 SecureString）
+// 认证: AWS_ACCESS_KEY_ID、AWS_SECRET_ACCESS_KEY，可选 AWS_SESSION_TOKEN
+// 区域: AWS_REGION（默认 us-east-1）
+func resolveSSM(name string) (string, error) {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return "", fmt.Errorf("未配置 AWS_ACCESS_KEY_ID 或 AWS_SECRET_ACCESS_KEY")
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"Name":           name,
+		"WithDecryption": true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("序列化请求失败: %v", err)
+	}
+
+	host := "ssm." + region + ".amazonaws.com"
+	req, err := http.NewRequest("POST", "https://"+host+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("content-type", "application/x-amz-json-1.1")
+	req.Header.Set("x-amz-target", "AmazonSSM.GetParameter")
+	sigv4.Sign(req, body, region, "ssm", sigv4.Credentials{
+		AccessKeyID:     accessKey,
+		SecretAccessKey: secretKey,
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}, time.Now())
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("读取响应失败: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("状态码 %d, 响应: %s", resp.StatusCode, string(respBody))
+	}
+
+	var result struct {
+		Parameter struct {
+			Value string `json:"Value"`
+		} `json:"Parameter"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return "", fmt.Errorf("解析响应失败: %v", err)
+	}
+	if result.Parameter.Value == "" {
+		return "", fmt.Errorf("参数 %s 为空", name)
+	}
+	return result.Parameter.Value, nil
+}
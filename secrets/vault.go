@@ -0,0 +1,68 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// resolveVault 从 HashiCorp Vault 读取密钥
+// ref 格式: <KV路径>#<字段>，KV v2 路径需包含 data 段（如 secret/data/kiro#token）
+// 认证: VAULT_ADDR、VAULT_TOKEN，可选 VAULT_NAMESPACE
+func resolveVault(ref string) (string, error) {
+	addr := strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+	token := os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return "", fmt.Errorf("未配置 VAULT_ADDR 或 VAULT_TOKEN")
+	}
+
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || field == "" {
+		return "", fmt.Errorf("vault 引用格式应为 <路径>#<字段>")
+	}
+
+	req, err := http.NewRequest("GET", addr+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("读取响应失败: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("状态码 %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("解析响应失败: %v", err)
+	}
+
+	// KV v2 的实际数据位于 data.data，KV v1 直接位于 data
+	data := result.Data
+	if inner, ok := data["data"].(map[string]any); ok {
+		data = inner
+	}
+
+	value, ok := data[field].(string)
+	if !ok || value == "" {
+		return "", fmt.Errorf("字段 %s 不存在或为空", field)
+	}
+	return value, nil
+}
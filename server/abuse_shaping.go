@@ -0,0 +1,190 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro/config"
+	"kiro/tenant"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * 滥用模式整形
+ * 陷入循环的 agent 会在短时间内反复发送同一会话或完全相同的请求，这类流量很容易导致上游封号。
+ * 两类启发式规则（均默认关闭）：
+ *   - ABUSE_CONVERSATION_RPM：同一会话每分钟请求数
+ *   - ABUSE_IDENTICAL_PROMPT_LIMIT：ABUSE_IDENTICAL_WINDOW_SECONDS 内完全相同的请求次数
+ * 超过上限时每个请求延迟 ABUSE_DELAY_MS 再处理，超过两倍上限时直接返回 429，直到窗口内的请求数回落。
+ * 会话以 X-Conversation-ID 请求头区分，未提供时使用系统提示词和首条消息的哈希；计数按 API Key 隔离。
+ * 租户 key 的 abuse_shaping_exempt 或 ABUSE_SHAPING_EXEMPT_KEYS（key 的 SHA256）可豁免
+ */
+
+// abuseWindowPruneThreshold 窗口数量超过该值时清理已过期的窗口
+const abuseWindowPruneThreshold = 4096
+
+// abuseWindow 单个会话或请求内容的请求时间（滑动窗口）
+type abuseWindow struct {
+	hits []time.Time
+}
+
+// abuseCounter 按键统计滑动窗口内的请求数，窗口长度在每次计数时传入以便随配置热更新
+type abuseCounter struct {
+	mu      sync.Mutex
+	entries map[string]*abuseWindow
+}
+
+var (
+	conversationCounter = &abuseCounter{entries: make(map[string]*abuseWindow)}
+	identicalCounter    = &abuseCounter{entries: make(map[string]*abuseWindow)}
+)
+
+// parseAbuseExemptKeys 解析 ABUSE_SHAPING_EXEMPT_KEYS 中豁免的 API Key（SHA256，逗号分隔，可带 "sha256:" 前缀）
+func parseAbuseExemptKeys(value string) map[string]bool {
+	keys := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(item), "sha256:"))
+		if item != "" {
+			keys[item] = true
+		}
+	}
+	return keys
+}
+
+// abuseShapingEnabled 是否启用了任一启发式规则
+func abuseShapingEnabled() bool {
+	return config.Current().AbuseConversationRPM > 0 || config.Current().AbuseIdenticalPromptLimit > 0
+}
+
+/**
+ * shapeAbusiveRequest 检查请求是否符合循环 agent 的特征
+ * 超过上限时阻塞 ABUSE_DELAY_MS（客户端断开则提前返回），超过两倍上限时返回 429 错误
+ */
+func shapeAbusiveRequest(c *gin.Context, req types.AnthropicRequest) *UpstreamError {
+	keyHash := c.GetString("apiKeyHash")
+	settings := config.Current()
+	if !abuseShapingEnabled() || keyHash == "" || parseAbuseExemptKeys(settings.AbuseShapingExemptKeys)[keyHash] || tenant.AbuseShapingExempt(keyHash) {
+		return nil
+	}
+
+	type check struct {
+		counter *abuseCounter
+		window  time.Duration
+		key     string
+		limit   int
+		reason  string
+	}
+	var checks []check
+	if limit := settings.AbuseConversationRPM; limit > 0 {
+		checks = append(checks, check{conversationCounter, time.Minute, keyHash + ":" + conversationFingerprint(c, req), limit, "requests per minute in one conversation"})
+	}
+	if limit := settings.AbuseIdenticalPromptLimit; limit > 0 {
+		if body, err := utils.SafeMarshal(req); err == nil {
+			checks = append(checks, check{identicalCounter, time.Duration(settings.AbuseIdenticalWindowSeconds) * time.Second, keyHash + ":" + sha256Hash(string(body)), limit, fmt.Sprintf("identical requests in %ds", settings.AbuseIdenticalWindowSeconds)})
+		}
+	}
+
+	throttle := ""
+	for _, ck := range checks {
+		count, resetAt := ck.counter.hit(ck.key, ck.window)
+		if count <= ck.limit {
+			continue
+		}
+		detail := fmt.Sprintf("%d %s (limit %d)", count, ck.reason, ck.limit)
+		if count > 2*ck.limit {
+			utils.RecordPolicy(c, "abuse_shaping", "rejected: %s", detail)
+			utils.Log("请求疑似循环调用，已拒绝",
+				addReqFields(c,
+					utils.LogString("reason", detail),
+					utils.LogString("tenant", tenantName(c)),
+				)...)
+			return &UpstreamError{
+				StatusCode: http.StatusTooManyRequests,
+				Type:       errTypeRateLimit,
+				Message:    fmt.Sprintf("Request pattern looks like a runaway loop (%s), please slow down or change the request", detail),
+				ResetAt:    resetAt,
+			}
+		}
+		throttle = detail
+	}
+	if throttle == "" || config.Current().AbuseDelayMs <= 0 {
+		return nil
+	}
+
+	utils.RecordPolicy(c, "abuse_shaping", "delayed %dms: %s", config.Current().AbuseDelayMs, throttle)
+	utils.Log("请求疑似循环调用，延迟处理",
+		addReqFields(c,
+			utils.LogString("reason", throttle),
+			utils.LogInt("delay_ms", config.Current().AbuseDelayMs),
+			utils.LogString("tenant", tenantName(c)),
+		)...)
+	timer := time.NewTimer(time.Duration(config.Current().AbuseDelayMs) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.Request.Context().Done():
+	}
+	return nil
+}
+
+// conversationFingerprint 会话标识：优先使用 X-Conversation-ID，否则取系统提示词和首条消息的哈希
+func conversationFingerprint(c *gin.Context, req types.AnthropicRequest) string {
+	if id := c.GetHeader("X-Conversation-ID"); id != "" {
+		return "id:" + id
+	}
+	var b strings.Builder
+	for _, sys := range req.System {
+		b.WriteString(sys.Text)
+	}
+	b.WriteString("\x00")
+	if len(req.Messages) > 0 {
+		if first, err := utils.SafeMarshal(req.Messages[0]); err == nil {
+			b.Write(first)
+		}
+	}
+	return sha256Hash(b.String())
+}
+
+// hit 记录一次请求，返回窗口内的请求数（含本次）以及计数回落到本次之前的时间
+func (a *abuseCounter) hit(key string, window time.Duration) (int, time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	w, ok := a.entries[key]
+	if !ok {
+		if len(a.entries) >= abuseWindowPruneThreshold {
+			a.pruneLocked(now, window)
+		}
+		w = &abuseWindow{}
+		a.entries[key] = w
+	}
+	w.expire(now, window)
+	w.hits = append(w.hits, now)
+	return len(w.hits), w.hits[0].Add(window)
+}
+
+// expire 移除窗口外的请求时间
+func (w *abuseWindow) expire(now time.Time, window time.Duration) {
+	i := 0
+	for i < len(w.hits) && now.Sub(w.hits[i]) >= window {
+		i++
+	}
+	w.hits = w.hits[i:]
+}
+
+// pruneLocked 清理窗口内已没有请求的键（调用方持有锁）
+func (a *abuseCounter) pruneLocked(now time.Time, window time.Duration) {
+	for key, w := range a.entries {
+		w.expire(now, window)
+		if len(w.hits) == 0 {
+			delete(a.entries, key)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"kiro/tenant"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminAPIKey 管理端点的访问密钥，通过 ADMIN_API_KEY 配置，为空时管理端点不可用
+var adminAPIKey = os.Getenv("ADMIN_API_KEY")
+
+/**
+ * AdminAuthMiddleware 管理端点认证中间件
+ * 未配置 ADMIN_API_KEY 时返回 404，避免暴露管理端点的存在
+ */
+func AdminAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if adminAPIKey == "" {
+			respondError(c, http.StatusNotFound, "%s", "404 未找到")
+			c.Abort()
+			return
+		}
+
+		if !adminKeyValid(c) {
+			respondError(c, http.StatusUnauthorized, "%s", "管理密钥无效")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// adminKeyValid 请求是否携带有效的管理密钥（x-api-key 或 Bearer）
+func adminKeyValid(c *gin.Context) bool {
+	if adminAPIKey == "" {
+		return false
+	}
+	key := c.GetHeader("x-api-key")
+	if key == "" {
+		key = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(key), []byte(adminAPIKey)) == 1
+}
+
+// adminTokenView 管理端点展示的 token 信息（不包含任何凭证明文）
+type adminTokenView struct {
+	ID          string               `json:"id"` // refresh token 的 SHA256 前缀
+	Type        string               `json:"type"`
+	Preview     string               `json:"preview"`
+	Region      string               `json:"region,omitempty"`
+	ProfileArn  string               `json:"profile_arn,omitempty"`
+	Profiles    []TokenProfile       `json:"profiles,omitempty"`
+	LastRefresh time.Time            `json:"last_refresh"`
+	Labels      tenant.AccountLabels `json:"labels"`
+}
+
+// handleAdminTokens GET /admin/tokens 列出已缓存的上游 token 及其账号标注
+func handleAdminTokens(c *gin.Context) {
+	tokens := tokenServiceOf(c)
+	tokens.mu.RLock()
+	views := make([]adminTokenView, 0, len(tokens.entries))
+	for hash, entry := range tokens.entries {
+		views = append(views, adminTokenView{
+			ID:          hash[:16],
+			Type:        entry.TokenType.String(),
+			Preview:     createTokenPreview(entry.RefreshToken),
+			Region:      entry.Region,
+			ProfileArn:  entry.ProfileArn,
+			Profiles:    entry.Profiles,
+			LastRefresh: entry.LastRefresh,
+			Labels:      entry.Labels,
+		})
+	}
+	tokens.mu.RUnlock()
+
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].ID < views[j].ID
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   views,
+	})
+}
+
+// findCachedToken 按 ID（refresh token 的 SHA256 前缀）查找缓存的 token，ID 不唯一时视为未找到
+func findCachedToken(tokens *TokenService, id string) (string, *TokenCache, bool) {
+	if len(id) < 8 {
+		return "", nil, false
+	}
+
+	tokens.mu.RLock()
+	defer tokens.mu.RUnlock()
+
+	var foundHash string
+	var found *TokenCache
+	for hash, entry := range tokens.entries {
+		if strings.HasPrefix(hash, id) {
+			if found != nil {
+				return "", nil, false
+			}
+			foundHash, found = hash, entry
+		}
+	}
+	return foundHash, found, found != nil
+}
+
+// handleAdminInvalidateToken DELETE /admin/tokens/:id 使缓存的 token 失效，下次请求时重新刷新
+func handleAdminInvalidateToken(c *gin.Context) {
+	tokens := tokenServiceOf(c)
+	hash, _, ok := findCachedToken(tokens, c.Param("id"))
+	if !ok {
+		respondError(c, http.StatusNotFound, "%s", "token 不存在")
+		return
+	}
+
+	tokens.remove(hash)
+
+	utils.Info("管理端点使 token 失效: %s", hash[:16])
+	c.JSON(http.StatusOK, gin.H{"id": hash[:16], "invalidated": true})
+}
+
+// handleAdminRefreshToken POST /admin/tokens/:id/refresh 立即刷新 token 的 access token
+func handleAdminRefreshToken(c *gin.Context) {
+	tokens := tokenServiceOf(c)
+	hash, entry, ok := findCachedToken(tokens, c.Param("id"))
+	if !ok {
+		respondError(c, http.StatusNotFound, "%s", "token 不存在")
+		return
+	}
+
+	if err := tokens.refreshCached(requestContext(c), hash, entry); err != nil {
+		utils.Error("管理端点刷新 token 失败: %v", err)
+		respondError(c, http.StatusBadGateway, "刷新失败，token 已从缓存移除: %v", err)
+		return
+	}
+
+	tokens.mu.RLock()
+	lastRefresh := entry.LastRefresh
+	tokens.mu.RUnlock()
+
+	utils.Info("管理端点刷新 token: %s", hash[:16])
+	c.JSON(http.StatusOK, gin.H{"id": hash[:16], "refreshed": true, "last_refresh": lastRefresh})
+}
+
+// handleAdminCacheStats GET /admin/cache Prompt Cache 的条目数、估算 token 数及命中/未命中/淘汰计数
+func handleAdminCacheStats(c *gin.Context) {
+	c.JSON(http.StatusOK, cacheServiceOf(c).Stats())
+}
+
+// handleAdminFlushCache DELETE /admin/cache 清空 Prompt Cache
+func handleAdminFlushCache(c *gin.Context) {
+	flushed := cacheServiceOf(c).Flush()
+
+	utils.Info("管理端点清空 Prompt Cache: %d 条", flushed)
+	c.JSON(http.StatusOK, gin.H{"flushed": flushed})
+}
+
+// handleAdminEndpoints GET /admin/endpoints 配置的上游端点及其健康状态
+func handleAdminEndpoints(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   endpointStatuses(),
+	})
+}
+
+// handleAdminUsage GET /admin/usage 按上游 token 统计的请求数、错误数和 token 用量（进程启动以来）
+func handleAdminUsage(c *gin.Context) {
+	views := tokenUsageSnapshot()
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].ID < views[j].ID
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   views,
+	})
+}
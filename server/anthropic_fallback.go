@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro/config"
+	"kiro/secrets"
+	"kiro/tenant"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// anthropicFallback 上游账号耗尽或被封禁时，回退到真实 Anthropic API Key 的溢出通道
+// 仅对显式开启回退的租户生效，并受模型白名单和每日费用上限约束
+type anthropicFallback struct {
+	apiKey      string
+	baseURL     string
+	models      []string // 全局模型白名单，为空表示不限制
+	dailyBudget float64  // 全局每日费用上限（美元），0 表示不限
+
+	mu          sync.Mutex
+	day         string             // 当前统计日（UTC）
+	spent       float64            // 当日全局花费
+	tenantSpent map[string]float64 // 当日各租户花费
+}
+
+var fallbackProvider *anthropicFallback
+
+// anthropicAPIVersion 回退请求使用的 anthropic-version
+const anthropicAPIVersion = "2023-06-01"
+
+// InitAnthropicFallback 根据环境变量初始化回退通道
+// ANTHROPIC_FALLBACK_API_KEY: 真实 Anthropic API Key（支持 vault:/ssm: 引用），为空则禁用
+// ANTHROPIC_FALLBACK_BASE_URL: API 地址，默认 https://api.anthropic.com
+// ANTHROPIC_FALLBACK_MODELS: 允许回退的模型（逗号分隔），为空表示不限制
+// ANTHROPIC_FALLBACK_DAILY_BUDGET_USD: 全局每日费用上限，0 表示不限
+func InitAnthropicFallback() {
+	apiKey := os.Getenv("ANTHROPIC_FALLBACK_API_KEY")
+	if apiKey == "" {
+		return
+	}
+	resolved, err := secrets.Resolve(apiKey)
+	if err != nil {
+		utils.Error("Anthropic 回退通道初始化失败: %v", err)
+		return
+	}
+
+	baseURL := os.Getenv("ANTHROPIC_FALLBACK_BASE_URL")
+	if baseURL == "" {
+		baseURL = "https://api.anthropic.com"
+	}
+
+	var models []string
+	for _, m := range strings.Split(os.Getenv("ANTHROPIC_FALLBACK_MODELS"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			models = append(models, m)
+		}
+	}
+
+	budget, _ := strconv.ParseFloat(os.Getenv("ANTHROPIC_FALLBACK_DAILY_BUDGET_USD"), 64)
+
+	fallbackProvider = &anthropicFallback{
+		apiKey:      resolved,
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		models:      models,
+		dailyBudget: budget,
+		tenantSpent: make(map[string]float64),
+	}
+	utils.Info("Anthropic 回退通道已启用 (每日上限: $%.2f)", budget)
+}
+
+// eligible 检查当前请求是否允许回退
+func (f *anthropicFallback) eligible(c *gin.Context, model string) bool {
+	profile := GetTenant(c)
+	if profile == nil || !profile.AnthropicFallback.Enabled {
+		return false
+	}
+	if len(f.models) > 0 && !containsString(f.models, model) {
+		return false
+	}
+	if len(profile.AnthropicFallback.Models) > 0 && !containsString(profile.AnthropicFallback.Models, model) {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rollDay()
+	if f.dailyBudget > 0 && f.spent >= f.dailyBudget {
+		utils.Info("Anthropic 回退已达全局每日上限 $%.2f", f.dailyBudget)
+		return false
+	}
+	if limit := profile.AnthropicFallback.DailyBudgetUSD; limit > 0 && f.tenantSpent[profile.Name] >= limit {
+		utils.Info("租户 %s 的 Anthropic 回退已达每日上限 $%.2f", profile.Name, limit)
+		return false
+	}
+	return true
+}
+
+// rollDay 跨天时重置花费统计（调用方持有锁）
+func (f *anthropicFallback) rollDay() {
+	today := time.Now().UTC().Format("2006-01-02")
+	if f.day != today {
+		f.day = today
+		f.spent = 0
+		f.tenantSpent = make(map[string]float64)
+	}
+}
+
+// record 记录一次回退请求的花费
+func (f *anthropicFallback) record(profile *tenant.Profile, model string, usage types.Usage) {
+	cost := estimateFallbackCost(model, usage)
+
+	f.mu.Lock()
+	f.rollDay()
+	f.spent += cost
+	if profile != nil {
+		f.tenantSpent[profile.Name] += cost
+	}
+	spent := f.spent
+	f.mu.Unlock()
+
+	utils.Info("Anthropic 回退完成 | model: %s, input: %d, output: %d, cost: $%.4f, 当日累计: $%.4f",
+		model, usage.InputTokens, usage.OutputTokens, cost, spent)
+}
+
+// estimateFallbackCost 按价格表估算费用，未配置价格的模型按 sonnet 价格估算，避免每日预算失效
+func estimateFallbackCost(model string, usage types.Usage) float64 {
+	settings := config.Current()
+	price, ok := settings.PriceFor(model)
+	if !ok {
+		price, _ = settings.PriceFor("sonnet")
+	}
+	return price.Cost(usage.InputTokens, usage.OutputTokens, usage.CacheReadInputTokens, usage.CacheCreationInputTokens)
+}
+
+// trySpillToAnthropic 上游账号耗尽/封禁时尝试通过回退通道完成请求
+// 返回 true 表示响应已写出，调用方不应再写入错误响应
+// OpenAI 兼容端点的请求不回退（回退通道原样转发 Anthropic 格式响应）
+func trySpillToAnthropic(c *gin.Context, anthropicReq types.AnthropicRequest) bool {
+	if fallbackProvider == nil || c.GetBool(openAICompatKey) || !providerAllowed(anthropicReq.Provider, providerAnthropic) ||
+		!fallbackProvider.eligible(c, anthropicReq.Model) {
+		return false
+	}
+
+	rawBody, err := fallbackRequestBody(c, anthropicReq)
+	if err != nil {
+		return false
+	}
+
+	req, err := http.NewRequestWithContext(c.Request.Context(), "POST", fallbackProvider.baseURL+"/v1/messages", bytes.NewReader(rawBody))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("x-api-key", fallbackProvider.apiKey)
+	req.Header.Set("anthropic-version", anthropicAPIVersion)
+	if beta := c.GetHeader("anthropic-beta"); beta != "" {
+		req.Header.Set("anthropic-beta", beta)
+	}
+
+	resp, err := utils.DoRequest(req)
+	if err != nil {
+		utils.Error("Anthropic 回退请求失败: %v", err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	utils.Info("请求已回退到 Anthropic API (model: %s)", anthropicReq.Model)
+	c.Header("X-Kiro-Fallback", "anthropic")
+
+	var usage types.Usage
+	if anthropicReq.Stream && resp.StatusCode == http.StatusOK {
+		usage = relayAnthropicStream(c, resp.Body)
+	} else {
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			respondError(c, http.StatusBadGateway, "读取回退响应失败: %v", err)
+			return true
+		}
+		var parsed struct {
+			Usage types.Usage `json:"usage"`
+		}
+		_ = utils.SafeUnmarshal(respBody, &parsed)
+		usage = parsed.Usage
+		c.Data(resp.StatusCode, "application/json", respBody)
+	}
+
+	fallbackProvider.record(GetTenant(c), anthropicReq.Model, usage)
+	return true
+}
+
+// fallbackRequestBody 构建发往 Anthropic 的请求体
+// 优先使用客户端原始请求体，并移除 Anthropic API 不接受的 provider 字段
+func fallbackRequestBody(c *gin.Context, anthropicReq types.AnthropicRequest) ([]byte, error) {
+	body, _ := c.Get("rawBody")
+	rawBody, ok := body.([]byte)
+	if !ok {
+		return utils.SafeMarshal(anthropicReq)
+	}
+	if anthropicReq.Provider == nil {
+		return rawBody, nil
+	}
+
+	var rawReq map[string]any
+	if err := utils.SafeUnmarshal(rawBody, &rawReq); err != nil {
+		return nil, err
+	}
+	delete(rawReq, "provider")
+	return utils.SafeMarshal(rawReq)
+}
+
+// relayAnthropicStream 原样转发 Anthropic SSE 流，同时累计 usage
+func relayAnthropicStream(c *gin.Context, body io.Reader) types.Usage {
+	var usage types.Usage
+	if err := initializeSSEResponse(c); err != nil {
+		return usage
+	}
+
+	reader := bufio.NewReader(body)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			if _, werr := io.WriteString(c.Writer, line); werr != nil {
+				return usage
+			}
+			if line == "\n" {
+				c.Writer.Flush()
+			}
+			if data, ok := strings.CutPrefix(strings.TrimSpace(line), "data: "); ok {
+				accumulateStreamUsage(data, &usage)
+			}
+		}
+		if err != nil {
+			c.Writer.Flush()
+			return usage
+		}
+	}
+}
+
+// accumulateStreamUsage 从 message_start / message_delta 事件中提取 usage
+func accumulateStreamUsage(data string, usage *types.Usage) {
+	var event struct {
+		Type    string `json:"type"`
+		Message struct {
+			Usage types.Usage `json:"usage"`
+		} `json:"message"`
+		Usage types.Usage `json:"usage"`
+	}
+	if err := utils.SafeUnmarshal([]byte(data), &event); err != nil {
+		return
+	}
+	switch event.Type {
+	case "message_start":
+		*usage = event.Message.Usage
+	case "message_delta":
+		if event.Usage.OutputTokens > 0 {
+			usage.OutputTokens = event.Usage.OutputTokens
+		}
+	}
+}
+
+// containsString 判断切片中是否包含指定字符串
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
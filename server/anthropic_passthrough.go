@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// anthropicPassthroughKey 上下文键：请求使用客户端自带的真实 Anthropic API Key，原样转发到 Anthropic API
+const anthropicPassthroughKey = "anthropicPassthrough"
+
+// passthroughBaseURL 直连转发的 API 地址，未配置时使用 https://api.anthropic.com
+func passthroughBaseURL() string {
+	if v := config.Current().AnthropicPassthroughBaseURL; v != "" {
+		return strings.TrimSuffix(v, "/")
+	}
+	return "https://api.anthropic.com"
+}
+
+// isAnthropicAPIKey 是否为真实的 Anthropic API Key（包括 Console Key 和 OAuth token）
+func isAnthropicAPIKey(key string) bool {
+	return strings.HasPrefix(key, "sk-ant-")
+}
+
+// anthropicPassthrough 当前请求是否直连 Anthropic API：客户端使用真实 Anthropic Key，或租户配置 backend: anthropic
+func anthropicPassthrough(c *gin.Context) bool {
+	if c.GetBool(anthropicPassthroughKey) {
+		return true
+	}
+	profile := GetTenant(c)
+	return profile != nil && profile.UsesAnthropic()
+}
+
+// tokenlessRequest 当前请求是否不使用 Kiro 上游 token（Bedrock 租户或 Anthropic 直连）
+func tokenlessRequest(c *gin.Context) bool {
+	if c.GetBool(anthropicPassthroughKey) {
+		return true
+	}
+	profile := GetTenant(c)
+	return profile != nil && (profile.UsesBedrock() || profile.UsesAnthropic())
+}
+
+// passthroughResponseHeaders 直连响应中需要回传给客户端的请求头前缀
+var passthroughResponseHeaders = []string{"anthropic-", "request-id", "retry-after", "x-should-retry"}
+
+/**
+ * forwardToAnthropic 将客户端请求体原样转发到 Anthropic API 的 path，并原样返回响应
+ * 客户端自带 Key 时透传其认证头，租户直连时使用租户配置的 anthropic_api_key
+ * 流式响应逐行转发，usage 计入本地用量统计
+ */
+func forwardToAnthropic(c *gin.Context, path string, body []byte) {
+	release, slotErr := acquireConcurrencySlot(c)
+	if slotErr != nil {
+		respondAnthropicError(c, slotErr)
+		return
+	}
+	defer release()
+
+	req, err := http.NewRequestWithContext(c.Request.Context(), "POST", passthroughBaseURL()+path, bytes.NewReader(body))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "创建 Anthropic 请求失败: %v", err)
+		return
+	}
+	req.Header.Set("content-type", "application/json")
+	if profile := GetTenant(c); profile != nil && profile.UsesAnthropic() {
+		req.Header.Set("x-api-key", profile.AnthropicAPIKey)
+	} else if key := c.GetHeader("x-api-key"); key != "" {
+		req.Header.Set("x-api-key", key)
+	} else {
+		req.Header.Set("authorization", c.GetHeader("Authorization"))
+	}
+	version := c.GetHeader("anthropic-version")
+	if version == "" {
+		version = anthropicAPIVersion
+	}
+	req.Header.Set("anthropic-version", version)
+	if beta := c.GetHeader("anthropic-beta"); beta != "" {
+		req.Header.Set("anthropic-beta", beta)
+	}
+
+	resp, err := utils.DoRequest(req)
+	if err != nil {
+		utils.Log("Anthropic 直连请求失败", addReqFields(c, utils.LogErr(err))...)
+		respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadGateway, Message: "Anthropic API request failed: " + err.Error(), Type: errTypeAPI})
+		return
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		lower := strings.ToLower(name)
+		for _, prefix := range passthroughResponseHeaders {
+			if strings.HasPrefix(lower, prefix) {
+				c.Header(name, strings.Join(values, ", "))
+				break
+			}
+		}
+	}
+	c.Header("X-Kiro-Backend", "anthropic")
+	utils.RecordPolicy(c, "backend", "forwarded verbatim to the Anthropic API")
+
+	var usage types.Usage
+	if resp.StatusCode == http.StatusOK && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		usage = relayAnthropicStream(c, resp.Body)
+	} else {
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			respondError(c, http.StatusBadGateway, "读取 Anthropic 响应失败: %v", err)
+			return
+		}
+		if resp.StatusCode == http.StatusOK {
+			var parsed struct {
+				Usage types.Usage `json:"usage"`
+			}
+			_ = utils.SafeUnmarshal(respBody, &parsed)
+			usage = parsed.Usage
+		}
+		c.Data(resp.StatusCode, "application/json", respBody)
+	}
+
+	recordTokenUsage(c, usage.InputTokens, usage.OutputTokens)
+	recordCacheTokens(c, usage.CacheReadInputTokens, usage.CacheCreationInputTokens)
+	utils.Log("Anthropic 直连请求完成",
+		addReqFields(c,
+			utils.LogString("path", path),
+			utils.LogInt("status", resp.StatusCode),
+			utils.LogInt("input_tokens", usage.InputTokens),
+			utils.LogInt("output_tokens", usage.OutputTokens),
+		)...)
+}
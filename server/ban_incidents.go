@@ -0,0 +1,312 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro/config"
+	"kiro/lifecycle"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * 封禁取证记录
+ * 上游返回 403 时保存请求元数据和上游原始错误响应，帮助用户判断是哪类请求模式触发了封禁。
+ * 记录不包含凭证和消息正文，只保存形状信息（消息数、工具名、参数等）；
+ * 保留最近 BAN_INCIDENT_LOG_SIZE 条供 /admin/incidents 查看，同时按行追加到 BAN_INCIDENT_LOG
+ */
+
+// defaultBanIncidentLog BAN_INCIDENT_LOG 未设置时的日志文件
+const defaultBanIncidentLog = "data/incidents.log"
+
+// banIncident 一次 403 事件
+type banIncident struct {
+	ID                string            `json:"id"`
+	Time              time.Time         `json:"time"`
+	RequestID         string            `json:"request_id,omitempty"`
+	TokenID           string            `json:"token_id,omitempty"` // 与 /admin/tokens 的 id 一致
+	Tenant            string            `json:"tenant,omitempty"`
+	KeyHash           string            `json:"key_hash,omitempty"` // 调用方 API Key 的 SHA256 前 16 位
+	ClientIP          string            `json:"client_ip,omitempty"`
+	UserAgent         string            `json:"user_agent,omitempty"`
+	Endpoint          string            `json:"endpoint,omitempty"` // 上游端点名称
+	FailedOver        bool              `json:"failed_over"`        // 是否已切换到其他 token 重试
+	UpstreamStatus    int               `json:"upstream_status"`
+	UpstreamRequestID string            `json:"upstream_request_id,omitempty"`
+	UpstreamHeaders   map[string]string `json:"upstream_headers,omitempty"`
+	UpstreamBody      string            `json:"upstream_body"`
+	Request           banIncidentShape  `json:"request"`
+	TokenStats        *tokenUsageView   `json:"token_stats,omitempty"` // 该 token 自进程启动以来的用量
+}
+
+// banIncidentShape 请求的形状信息（不含消息正文）
+type banIncidentShape struct {
+	Model           string   `json:"model"`
+	Stream          bool     `json:"stream"`
+	MaxTokens       int      `json:"max_tokens"`
+	Messages        int      `json:"messages"`
+	SystemChars     int      `json:"system_chars"`
+	InputTokens     int      `json:"input_tokens"` // 估算值
+	Tools           []string `json:"tools,omitempty"`
+	ThinkingEnabled bool     `json:"thinking_enabled"`
+	ThinkingBudget  int      `json:"thinking_budget,omitempty"`
+	ImageBlocks     int      `json:"image_blocks"`
+}
+
+// banIncidentSummary 列表中展示的摘要
+type banIncidentSummary struct {
+	ID             string    `json:"id"`
+	Time           time.Time `json:"time"`
+	TokenID        string    `json:"token_id,omitempty"`
+	Tenant         string    `json:"tenant,omitempty"`
+	Model          string    `json:"model"`
+	UpstreamStatus int       `json:"upstream_status"`
+	Message        string    `json:"message"` // 上游错误信息（截断）
+}
+
+// banIncidentMessageLimit 摘要中上游错误信息的最大长度
+const banIncidentMessageLimit = 200
+
+// upstreamIncidentHeaders 记录的上游响应头（用于向上游支持提供证据）
+var upstreamIncidentHeaders = []string{"x-amzn-RequestId", "x-amzn-ErrorType", "x-amzn-ErrorMessage", "Date"}
+
+type banIncidentLog struct {
+	mu      sync.Mutex
+	entries []*banIncident
+	size    int
+}
+
+var banIncidents = &banIncidentLog{size: config.Current().BanIncidentLogSize}
+
+// recordBanIncident 记录一次 403 事件（请求未能切换到其他 token）
+func recordBanIncident(c *gin.Context, req types.AnthropicRequest, resp *http.Response, body []byte) {
+	newBanIncident(c, req, resp, body).submit(c)
+}
+
+// newBanIncident 从当前上下文（仍绑定被封禁的 token）采集事件
+func newBanIncident(c *gin.Context, req types.AnthropicRequest, resp *http.Response, body []byte) *banIncident {
+	incident := &banIncident{
+		ID:                "inc_" + utils.GenerateBase62ID(22),
+		Time:              time.Now().UTC(),
+		RequestID:         GetRequestID(c),
+		Tenant:            tenantName(c),
+		UserAgent:         c.GetHeader("User-Agent"),
+		ClientIP:          c.ClientIP(),
+		Endpoint:          c.GetString(upstreamEndpointKey),
+		UpstreamStatus:    resp.StatusCode,
+		UpstreamRequestID: resp.Header.Get("x-amzn-RequestId"),
+		UpstreamBody:      string(body),
+		Request:           incidentShape(req),
+	}
+	if tokenHash := c.GetString("tokenHash"); len(tokenHash) >= 16 {
+		incident.TokenID = tokenHash[:16]
+		incident.TokenStats = tokenUsageViewOf(tokenHash)
+	}
+	if keyHash := c.GetString("apiKeyHash"); len(keyHash) >= 16 {
+		incident.KeyHash = keyHash[:16]
+	}
+	for _, name := range upstreamIncidentHeaders {
+		if v := resp.Header.Get(name); v != "" {
+			if incident.UpstreamHeaders == nil {
+				incident.UpstreamHeaders = make(map[string]string)
+			}
+			incident.UpstreamHeaders[name] = v
+		}
+	}
+
+	return incident
+}
+
+// submit 保存事件并写入日志文件
+func (incident *banIncident) submit(c *gin.Context) {
+	utils.RecordPolicy(c, "ban_incident", "upstream 403 recorded as %s", incident.ID)
+	utils.Log("记录上游封禁事件",
+		addReqFields(c,
+			utils.LogString("incident_id", incident.ID),
+			utils.LogString("token_id", incident.TokenID),
+			utils.LogString("tenant", incident.Tenant),
+		)...)
+
+	banIncidents.add(incident)
+	appendBanIncident(incident)
+}
+
+// incidentShape 提取请求的形状信息
+func incidentShape(req types.AnthropicRequest) banIncidentShape {
+	shape := banIncidentShape{
+		Model:       req.Model,
+		Stream:      req.Stream,
+		MaxTokens:   req.MaxTokens,
+		Messages:    len(req.Messages),
+		InputTokens: estimateInputTokens(utils.NewTokenEstimator(), req),
+	}
+	for _, sys := range req.System {
+		shape.SystemChars += len(sys.Text)
+	}
+	for _, tool := range req.Tools {
+		shape.Tools = append(shape.Tools, tool.Name)
+	}
+	if req.Thinking != nil && req.Thinking.Type == "enabled" {
+		shape.ThinkingEnabled = true
+		shape.ThinkingBudget = req.Thinking.BudgetTokens
+	}
+	for _, msg := range req.Messages {
+		blocks, ok := msg.Content.([]any)
+		if !ok {
+			continue
+		}
+		for _, block := range blocks {
+			if m, ok := block.(map[string]any); ok && m["type"] == "image" {
+				shape.ImageBlocks++
+			}
+		}
+	}
+	return shape
+}
+
+// tokenUsageViewOf 返回 token 的用量计数，没有记录时返回 nil
+func tokenUsageViewOf(tokenHash string) *tokenUsageView {
+	tokenUsageMutex.RLock()
+	_, ok := tokenUsageMap[tokenHash]
+	tokenUsageMutex.RUnlock()
+	if !ok {
+		return nil
+	}
+	u := usageFor(tokenHash)
+	view := &tokenUsageView{
+		ID:           tokenHash[:16],
+		Requests:     u.requests.Load(),
+		Errors:       u.errors.Load(),
+		InputTokens:  u.inputTokens.Load(),
+		OutputTokens: u.outputTokens.Load(),
+	}
+	if ts := u.lastUsed.Load(); ts > 0 {
+		view.LastUsed = time.Unix(0, ts)
+	}
+	return view
+}
+
+// add 保存事件，超出容量时丢弃最早的事件
+func (l *banIncidentLog) add(incident *banIncident) {
+	if l.size <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, incident)
+	if overflow := len(l.entries) - l.size; overflow > 0 {
+		l.entries = append([]*banIncident(nil), l.entries[overflow:]...)
+	}
+}
+
+func (l *banIncidentLog) find(id string) (*banIncident, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, entry := range l.entries {
+		if entry.ID == id {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// banIncidentLogPath 返回事件日志文件路径，为空表示不写文件
+func banIncidentLogPath() string {
+	switch path := config.Current().BanIncidentLog; path {
+	case "":
+		return defaultBanIncidentLog
+	case "off":
+		return ""
+	default:
+		return path
+	}
+}
+
+// appendBanIncident 异步追加一行到事件日志文件
+func appendBanIncident(incident *banIncident) {
+	path := banIncidentLogPath()
+	if path == "" {
+		return
+	}
+	data, err := utils.SafeMarshal(incident)
+	if err != nil {
+		return
+	}
+	lifecycle.Go("ban-incident-log", func(context.Context) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			utils.Error("创建封禁事件日志目录失败: %v", err)
+			return
+		}
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			utils.Error("写入封禁事件日志失败: %v", err)
+			return
+		}
+		defer f.Close()
+		fmt.Fprintln(f, string(data))
+	})
+}
+
+func (i *banIncident) summary() banIncidentSummary {
+	message := i.UpstreamBody
+	var parsed map[string]any
+	if utils.SafeUnmarshal([]byte(i.UpstreamBody), &parsed) == nil {
+		if msg, ok := parsed["message"].(string); ok && msg != "" {
+			message = msg
+		}
+	}
+	message = strings.TrimSpace(message)
+	if len(message) > banIncidentMessageLimit {
+		message = message[:banIncidentMessageLimit] + "..."
+	}
+	return banIncidentSummary{
+		ID:             i.ID,
+		Time:           i.Time,
+		TokenID:        i.TokenID,
+		Tenant:         i.Tenant,
+		Model:          i.Request.Model,
+		UpstreamStatus: i.UpstreamStatus,
+		Message:        message,
+	}
+}
+
+// handleAdminIncidents GET /admin/incidents 列出最近的封禁事件（新的在前），可按 token_id 过滤
+func handleAdminIncidents(c *gin.Context) {
+	tokenID := c.Query("token_id")
+
+	banIncidents.mu.Lock()
+	views := make([]banIncidentSummary, 0, len(banIncidents.entries))
+	for i := len(banIncidents.entries) - 1; i >= 0; i-- {
+		entry := banIncidents.entries[i]
+		if tokenID != "" && entry.TokenID != tokenID {
+			continue
+		}
+		views = append(views, entry.summary())
+	}
+	banIncidents.mu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"object":  "list",
+		"enabled": banIncidents.size > 0,
+		"data":    views,
+	})
+}
+
+// handleAdminIncident GET /admin/incidents/:id 返回单个事件的完整记录（含上游原始响应）
+func handleAdminIncident(c *gin.Context) {
+	incident, ok := banIncidents.find(c.Param("id"))
+	if !ok {
+		respondError(c, http.StatusNotFound, "未找到封禁事件: %s", c.Param("id"))
+		return
+	}
+	c.JSON(http.StatusOK, incident)
+}
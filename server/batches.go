@@ -0,0 +1,759 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro/config"
+	"kiro/lifecycle"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * Message Batches API 模拟
+ * POST /v1/messages/batches 接收一批 /v1/messages 请求后立即返回批次对象，后台以 BATCH_CONCURRENCY（所有批次共享）的并发
+ * 经本服务的 /v1/messages 路由以非流式方式逐个执行：沿用创建请求的请求头，鉴权、租户、路由规则、限流和用量记账与单独请求一致；
+ * 遇到 429 / 529 时按 Retry-After 等待后重试，直到批次过期（创建后 24 小时）
+ * 批次归属创建它的 API Key，其他 Key 查询时返回 404；批次在创建 29 天后删除
+ * BATCH_DB: SQLite 文件路径，配置后批次状态和结果持久化，重启后仍可查询；
+ * 由于不保存凭证，重启时未完成的请求无法继续，记为 errored
+ */
+
+const (
+	batchIDPrefix         = "msgbatch_"
+	batchProcessingWindow = 24 * time.Hour      // 创建后未处理完的请求记为 expired
+	batchRetention        = 29 * 24 * time.Hour // 创建后保留的时长
+	batchCustomIDMaxLen   = 64
+	batchRetryDefaultWait = 5 * time.Second // 429 / 529 未返回 Retry-After 时的等待时间
+	batchRetryMaxWait     = time.Minute
+	batchListDefaultLimit = 20
+	batchListMaxLimit     = 1000
+)
+
+// 批次处理状态
+const (
+	batchInProgress = "in_progress"
+	batchCanceling  = "canceling"
+	batchEnded      = "ended"
+)
+
+// 单个请求的结果类型
+const (
+	batchResultSucceeded = "succeeded"
+	batchResultErrored   = "errored"
+	batchResultCanceled  = "canceled"
+	batchResultExpired   = "expired"
+)
+
+// batchEntry 一个批次及其处理状态，字段由 batchStore.mu 保护
+type batchEntry struct {
+	batch     types.MessageBatch
+	owner     string // 创建者 API Key 的 SHA256
+	customIDs []string
+	results   []*types.MessageBatchResultBody // 与请求顺序一致，nil 表示未完成
+
+	// 以下字段只在处理期间存在，结束后释放
+	requests []types.MessageBatchRequest
+	header   http.Header // 创建请求的请求头，执行每个请求时沿用
+	ctx      context.Context
+	cancel   context.CancelFunc
+	task     *lifecycle.Task
+}
+
+// batchStore 批次存储和调度
+type batchStore struct {
+	mu       sync.Mutex
+	entries  map[string]*batchEntry
+	db       *sql.DB       // 为 nil 时只保存在内存中
+	sem      chan struct{} // 所有批次共享的并发额度
+	dispatch http.Handler  // 执行单个请求的路由，由 New 在路由创建后设置
+}
+
+// persistedBatch 持久化的批次字段
+type persistedBatch struct {
+	Batch     types.MessageBatch `json:"batch"`
+	CustomIDs []string           `json:"custom_ids"`
+}
+
+// newBatchStore 创建批次存储，配置 BATCH_DB 时恢复持久化的批次
+func newBatchStore() *batchStore {
+	s := &batchStore{
+		entries: make(map[string]*batchEntry),
+		sem:     make(chan struct{}, max(config.Current().BatchConcurrency, 1)),
+	}
+
+	dbPath := config.Current().BatchDB
+	if dbPath == "" {
+		return s
+	}
+	if dir := filepath.Dir(dbPath); dir != "" {
+		os.MkdirAll(dir, 0700)
+	}
+	db, err := sql.Open("sqlite", dbPath+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		utils.Error("批次存储初始化失败: %v", err)
+		return s
+	}
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS message_batches (
+			id TEXT PRIMARY KEY,
+			owner TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			created_at INTEGER NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS message_batch_results (
+			batch_id TEXT NOT NULL,
+			idx INTEGER NOT NULL,
+			payload TEXT NOT NULL,
+			PRIMARY KEY (batch_id, idx)
+		)
+	`)
+	if err != nil {
+		utils.Error("创建批次表失败: %v", err)
+		db.Close()
+		return s
+	}
+	s.db = db
+	s.load()
+	utils.Info("批次持久化已启用 (%s)，已恢复 %d 个批次", dbPath, len(s.entries))
+	return s
+}
+
+// load 从数据库恢复批次，未处理完的批次以 errored 结束
+func (s *batchStore) load() {
+	rows, err := s.db.Query(`SELECT owner, payload FROM message_batches`)
+	if err != nil {
+		utils.Error("读取批次失败: %v", err)
+		return
+	}
+	var interrupted []*batchEntry
+	for rows.Next() {
+		var owner, payload string
+		if rows.Scan(&owner, &payload) != nil {
+			continue
+		}
+		var p persistedBatch
+		if err := utils.SafeUnmarshal([]byte(payload), &p); err != nil {
+			utils.Error("解析批次失败: %v", err)
+			continue
+		}
+		entry := &batchEntry{
+			batch:     p.Batch,
+			owner:     owner,
+			customIDs: p.CustomIDs,
+			results:   make([]*types.MessageBatchResultBody, len(p.CustomIDs)),
+		}
+		s.entries[entry.batch.ID] = entry
+		if entry.batch.ProcessingStatus != batchEnded {
+			interrupted = append(interrupted, entry)
+		}
+	}
+	rows.Close()
+
+	rows, err = s.db.Query(`SELECT batch_id, idx, payload FROM message_batch_results`)
+	if err != nil {
+		utils.Error("读取批次结果失败: %v", err)
+		return
+	}
+	for rows.Next() {
+		var batchID, payload string
+		var idx int
+		if rows.Scan(&batchID, &idx, &payload) != nil {
+			continue
+		}
+		entry, ok := s.entries[batchID]
+		if !ok || idx < 0 || idx >= len(entry.results) {
+			continue
+		}
+		var result types.MessageBatchResultBody
+		if utils.SafeUnmarshal([]byte(payload), &result) == nil {
+			entry.results[idx] = &result
+		}
+	}
+	rows.Close()
+
+	for _, entry := range interrupted {
+		utils.Log("批次处理被重启中断", utils.LogString("batch_id", entry.batch.ID))
+		s.end(entry)
+	}
+}
+
+// stop 停止所有批次的处理并关闭数据库，未完成的请求记为 errored
+func (s *batchStore) stop() {
+	s.mu.Lock()
+	tasks := make([]*lifecycle.Task, 0)
+	for _, entry := range s.entries {
+		if entry.task != nil {
+			tasks = append(tasks, entry.task)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, task := range tasks {
+		task.Stop()
+	}
+	if s.db != nil {
+		s.db.Close()
+	}
+}
+
+// batchStoreOf 返回请求所属 Server 的批次存储
+func batchStoreOf(c *gin.Context) *batchStore {
+	return servicesOf(c).batches
+}
+
+// create 创建批次并开始后台处理
+func (s *batchStore) create(c *gin.Context, requests []types.MessageBatchRequest) *batchEntry {
+	now := time.Now().UTC()
+	entry := &batchEntry{
+		batch: types.MessageBatch{
+			ID:               batchIDPrefix + utils.GenerateBase62ID(24),
+			Type:             "message_batch",
+			ProcessingStatus: batchInProgress,
+			RequestCounts:    types.MessageBatchRequestCounts{Processing: len(requests)},
+			CreatedAt:        now,
+			ExpiresAt:        now.Add(batchProcessingWindow),
+		},
+		owner:     c.GetString("apiKeyHash"),
+		customIDs: make([]string, len(requests)),
+		results:   make([]*types.MessageBatchResultBody, len(requests)),
+		requests:  requests,
+		header:    batchRequestHeader(c.Request.Header),
+	}
+	for i, req := range requests {
+		entry.customIDs[i] = req.CustomID
+	}
+	entry.ctx, entry.cancel = context.WithDeadline(context.Background(), entry.batch.ExpiresAt)
+
+	s.prune(now)
+	s.mu.Lock()
+	s.entries[entry.batch.ID] = entry
+	s.persistBatch(entry)
+	entry.task = lifecycle.Go("message-batch", func(taskCtx context.Context) {
+		// 服务退出时中断批次
+		stopAfter := context.AfterFunc(taskCtx, entry.cancel)
+		defer stopAfter()
+		s.run(entry)
+	})
+	s.mu.Unlock()
+
+	utils.Log("创建消息批次",
+		addReqFields(c,
+			utils.LogString("batch_id", entry.batch.ID),
+			utils.LogInt("requests", len(requests)),
+		)...)
+	return entry
+}
+
+// batchRequestHeader 复制创建请求的请求头，移除与请求体和请求 ID 相关的字段
+func batchRequestHeader(header http.Header) http.Header {
+	cloned := header.Clone()
+	for _, key := range []string{"Content-Length", "Content-Encoding", "Accept-Encoding", "X-Request-ID", "Traceparent"} {
+		cloned.Del(key)
+	}
+	cloned.Set("Content-Type", "application/json")
+	return cloned
+}
+
+// run 以共享的并发额度执行批次中的请求，全部完成或批次被取消、过期、中断后结束批次
+func (s *batchStore) run(entry *batchEntry) {
+	var wg sync.WaitGroup
+dispatch:
+	for i := range entry.requests {
+		select {
+		case s.sem <- struct{}{}:
+		case <-entry.ctx.Done():
+			break dispatch
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-s.sem }()
+			s.finish(entry, i, s.execute(entry, i))
+		}(i)
+	}
+	wg.Wait()
+	entry.cancel()
+
+	s.mu.Lock()
+	s.end(entry)
+	s.mu.Unlock()
+}
+
+// execute 执行批次中的单个请求，批次被取消、过期或中断时返回 nil
+func (s *batchStore) execute(entry *batchEntry, i int) *types.MessageBatchResultBody {
+	params := entry.requests[i].Params
+	for {
+		req, err := http.NewRequestWithContext(entry.ctx, http.MethodPost, "/v1/messages", bytes.NewReader(params))
+		if err != nil {
+			return batchErrorResult(http.StatusInternalServerError, errTypeAPI, err.Error())
+		}
+		req.Header = entry.header.Clone()
+		req.Header.Set("X-Request-ID", fmt.Sprintf("%s_%d", entry.batch.ID, i))
+		rec := newBatchResponseWriter()
+		s.dispatch.ServeHTTP(rec, req)
+
+		if entry.ctx.Err() != nil {
+			return nil
+		}
+		if rec.code == http.StatusOK {
+			return &types.MessageBatchResultBody{Type: batchResultSucceeded, Message: rec.body.Bytes()}
+		}
+		if rec.code != http.StatusTooManyRequests && rec.code != statusOverloaded {
+			return batchResponseError(rec)
+		}
+
+		wait := batchRetryDefaultWait
+		if seconds, err := strconv.Atoi(rec.header.Get("Retry-After")); err == nil && seconds > 0 {
+			wait = min(time.Duration(seconds)*time.Second, batchRetryMaxWait)
+		}
+		select {
+		case <-time.After(wait):
+		case <-entry.ctx.Done():
+			return nil
+		}
+	}
+}
+
+/**
+ * batchResponseError 将失败的响应转换为 errored 结果
+ * 标准化错误响应（error.code）和无法解析的响应体按状态码映射为 Anthropic 错误类型
+ */
+func batchResponseError(rec *batchResponseWriter) *types.MessageBatchResultBody {
+	var body struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if utils.SafeUnmarshal(rec.body.Bytes(), &body) != nil || body.Error.Message == "" {
+		body.Error.Type = ""
+		body.Error.Message = strings.TrimSpace(rec.body.String())
+	}
+	if body.Error.Type == "" {
+		body.Error.Type = errorTypeForStatus(rec.code)
+	}
+	return batchErrorResult(rec.code, body.Error.Type, body.Error.Message)
+}
+
+// batchResponseWriter 在内存中缓冲批次单个请求的响应（状态码、响应头和响应体）
+type batchResponseWriter struct {
+	header      http.Header
+	body        bytes.Buffer
+	code        int
+	wroteHeader bool
+}
+
+func newBatchResponseWriter() *batchResponseWriter {
+	return &batchResponseWriter{header: make(http.Header), code: http.StatusOK}
+}
+
+func (w *batchResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *batchResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.code = code
+	w.wroteHeader = true
+}
+
+func (w *batchResponseWriter) Write(data []byte) (int, error) {
+	w.wroteHeader = true
+	return w.body.Write(data)
+}
+
+// Flush 响应已完整缓冲，无需刷新
+func (w *batchResponseWriter) Flush() {}
+
+// batchErrorResult 构造 errored 结果
+func batchErrorResult(status int, errType, message string) *types.MessageBatchResultBody {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	payload, _ := utils.SafeMarshal(gin.H{
+		"type":  "error",
+		"error": gin.H{"type": errType, "message": message},
+	})
+	return &types.MessageBatchResultBody{Type: batchResultErrored, Error: payload}
+}
+
+// finish 记录单个请求的结果，result 为 nil 时留待批次结束时处理
+func (s *batchStore) finish(entry *batchEntry, i int, result *types.MessageBatchResultBody) {
+	if result == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry.results[i] = result
+	countBatchResult(&entry.batch.RequestCounts, result.Type)
+	s.persistResult(entry, i)
+}
+
+// countBatchResult 将一个请求从 processing 计入对应的结果类型
+func countBatchResult(counts *types.MessageBatchRequestCounts, resultType string) {
+	counts.Processing--
+	switch resultType {
+	case batchResultSucceeded:
+		counts.Succeeded++
+	case batchResultErrored:
+		counts.Errored++
+	case batchResultCanceled:
+		counts.Canceled++
+	case batchResultExpired:
+		counts.Expired++
+	}
+}
+
+/**
+ * end 结束批次（调用方持有 s.mu）
+ * 未完成的请求按结束原因记为 canceled（已取消）、expired（超过处理期限）或 errored（服务重启或退出）
+ */
+func (s *batchStore) end(entry *batchEntry) {
+	now := time.Now().UTC()
+	var pending *types.MessageBatchResultBody
+	switch {
+	case entry.batch.CancelInitiatedAt != nil:
+		pending = &types.MessageBatchResultBody{Type: batchResultCanceled}
+	case !now.Before(entry.batch.ExpiresAt):
+		pending = &types.MessageBatchResultBody{Type: batchResultExpired}
+	default:
+		pending = batchErrorResult(http.StatusServiceUnavailable, errTypeAPI, "Batch processing was interrupted by a server restart")
+	}
+
+	counts := types.MessageBatchRequestCounts{Processing: len(entry.results)}
+	for i, result := range entry.results {
+		if result == nil {
+			entry.results[i] = pending
+			s.persistResult(entry, i)
+		}
+		countBatchResult(&counts, entry.results[i].Type)
+	}
+
+	entry.batch.RequestCounts = counts
+	entry.batch.ProcessingStatus = batchEnded
+	entry.batch.EndedAt = &now
+	entry.requests = nil
+	entry.header = nil
+	s.persistBatch(entry)
+
+	utils.Log("消息批次处理结束",
+		utils.LogString("batch_id", entry.batch.ID),
+		utils.LogInt("succeeded", counts.Succeeded),
+		utils.LogInt("errored", counts.Errored),
+		utils.LogInt("canceled", counts.Canceled),
+		utils.LogInt("expired", counts.Expired))
+}
+
+// persistBatch 保存批次状态（调用方持有 s.mu）
+func (s *batchStore) persistBatch(entry *batchEntry) {
+	if s.db == nil {
+		return
+	}
+	payload, err := utils.SafeMarshal(persistedBatch{Batch: entry.batch, CustomIDs: entry.customIDs})
+	if err == nil {
+		_, err = s.db.Exec(`INSERT OR REPLACE INTO message_batches (id, owner, payload, created_at) VALUES (?, ?, ?, ?)`,
+			entry.batch.ID, entry.owner, string(payload), entry.batch.CreatedAt.Unix())
+	}
+	if err != nil {
+		utils.Error("保存批次失败: %v", err)
+	}
+}
+
+// persistResult 保存单个请求的结果（调用方持有 s.mu）
+func (s *batchStore) persistResult(entry *batchEntry, i int) {
+	if s.db == nil {
+		return
+	}
+	payload, err := utils.SafeMarshal(entry.results[i])
+	if err == nil {
+		_, err = s.db.Exec(`INSERT OR REPLACE INTO message_batch_results (batch_id, idx, payload) VALUES (?, ?, ?)`,
+			entry.batch.ID, i, string(payload))
+	}
+	if err != nil {
+		utils.Error("保存批次结果失败: %v", err)
+	}
+}
+
+// prune 删除超过保留期的已结束批次
+func (s *batchStore) prune(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, entry := range s.entries {
+		if entry.batch.ProcessingStatus == batchEnded && now.Sub(entry.batch.CreatedAt) > batchRetention {
+			s.remove(id)
+		}
+	}
+}
+
+// remove 删除批次及其结果（调用方持有 s.mu）
+func (s *batchStore) remove(id string) {
+	delete(s.entries, id)
+	if s.db == nil {
+		return
+	}
+	if _, err := s.db.Exec(`DELETE FROM message_batch_results WHERE batch_id = ?`, id); err != nil {
+		utils.Error("删除批次结果失败: %v", err)
+	}
+	if _, err := s.db.Exec(`DELETE FROM message_batches WHERE id = ?`, id); err != nil {
+		utils.Error("删除批次失败: %v", err)
+	}
+}
+
+// lookup 按 ID 查找当前 API Key 创建的批次（调用方持有 s.mu）
+func (s *batchStore) lookup(c *gin.Context, id string) (*batchEntry, bool) {
+	entry, ok := s.entries[id]
+	if !ok || entry.owner != c.GetString("apiKeyHash") {
+		return nil, false
+	}
+	return entry, true
+}
+
+// view 返回批次对象，已结束的批次附带结果地址（调用方持有 s.mu）
+func (entry *batchEntry) view(c *gin.Context) types.MessageBatch {
+	batch := entry.batch
+	if batch.ProcessingStatus == batchEnded {
+		scheme := "http"
+		if c.Request.TLS != nil || strings.EqualFold(c.GetHeader("X-Forwarded-Proto"), "https") {
+			scheme = "https"
+		}
+		url := fmt.Sprintf("%s://%s/v1/messages/batches/%s/results", scheme, c.Request.Host, batch.ID)
+		batch.ResultsURL = &url
+	}
+	return batch
+}
+
+// validateBatchRequests 校验批次请求，返回面向客户端的错误信息
+func validateBatchRequests(requests []types.MessageBatchRequest) string {
+	if len(requests) == 0 {
+		return "requests: must contain at least one request"
+	}
+	if len(requests) > config.Current().BatchMaxRequests {
+		return fmt.Sprintf("requests: a batch may contain at most %d requests", config.Current().BatchMaxRequests)
+	}
+	seen := make(map[string]bool, len(requests))
+	for i, req := range requests {
+		if req.CustomID == "" || len(req.CustomID) > batchCustomIDMaxLen {
+			return fmt.Sprintf("requests.%d.custom_id: must be between 1 and %d characters", i, batchCustomIDMaxLen)
+		}
+		if seen[req.CustomID] {
+			return fmt.Sprintf("requests.%d.custom_id: duplicate custom_id %q", i, req.CustomID)
+		}
+		seen[req.CustomID] = true
+
+		var params struct {
+			Stream bool `json:"stream"`
+		}
+		if !bytes.HasPrefix(bytes.TrimSpace(req.Params), []byte("{")) || utils.SafeUnmarshal(req.Params, &params) != nil {
+			return fmt.Sprintf("requests.%d.params: must be a Messages API request object", i)
+		}
+		if params.Stream {
+			return fmt.Sprintf("requests.%d.params.stream: streaming is not supported in batches", i)
+		}
+	}
+	return ""
+}
+
+// respondBatchNotFound 批次不存在或不属于当前 API Key
+func respondBatchNotFound(c *gin.Context) {
+	respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusNotFound, Type: errTypeNotFound, Message: "Message batch " + c.Param("id") + " not found"})
+}
+
+// handleCreateBatch POST /v1/messages/batches 创建批次
+func handleCreateBatch(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		if isBodyTooLarge(err) {
+			respondBodyTooLarge(c)
+			return
+		}
+		respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: "Failed to read request body"})
+		return
+	}
+	var req types.MessageBatchCreateRequest
+	if err := utils.SafeUnmarshal(body, &req); err != nil {
+		respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: "Invalid JSON body: " + err.Error()})
+		return
+	}
+	if msg := validateBatchRequests(req.Requests); msg != "" {
+		respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: msg})
+		return
+	}
+
+	s := batchStoreOf(c)
+	entry := s.create(c, req.Requests)
+	s.mu.Lock()
+	batch := entry.view(c)
+	s.mu.Unlock()
+	c.JSON(http.StatusOK, batch)
+}
+
+// handleGetBatch GET /v1/messages/batches/:id 查询批次状态
+func handleGetBatch(c *gin.Context) {
+	s := batchStoreOf(c)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.lookup(c, c.Param("id"))
+	if !ok {
+		respondBatchNotFound(c)
+		return
+	}
+	c.JSON(http.StatusOK, entry.view(c))
+}
+
+/**
+ * handleListBatches GET /v1/messages/batches 列出当前 API Key 的批次（新的在前）
+ * 支持 limit（默认 20，最大 1000）和 before_id / after_id 分页
+ */
+func handleListBatches(c *gin.Context) {
+	limit := batchListDefaultLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > batchListMaxLimit {
+			respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: fmt.Sprintf("limit: must be between 1 and %d", batchListMaxLimit)})
+			return
+		}
+		limit = n
+	}
+
+	s := batchStoreOf(c)
+	s.prune(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	owned := make([]*batchEntry, 0)
+	for _, entry := range s.entries {
+		if entry.owner == c.GetString("apiKeyHash") {
+			owned = append(owned, entry)
+		}
+	}
+	sort.Slice(owned, func(i, j int) bool {
+		if !owned[i].batch.CreatedAt.Equal(owned[j].batch.CreatedAt) {
+			return owned[i].batch.CreatedAt.After(owned[j].batch.CreatedAt)
+		}
+		return owned[i].batch.ID > owned[j].batch.ID
+	})
+
+	start, end := 0, len(owned)
+	if afterID := c.Query("after_id"); afterID != "" {
+		start = len(owned)
+		for i, entry := range owned {
+			if entry.batch.ID == afterID {
+				start = i + 1
+				break
+			}
+		}
+		end = min(start+limit, len(owned))
+	} else if beforeID := c.Query("before_id"); beforeID != "" {
+		end = 0
+		for i, entry := range owned {
+			if entry.batch.ID == beforeID {
+				end = i
+				break
+			}
+		}
+		start = max(end-limit, 0)
+	} else {
+		end = min(limit, len(owned))
+	}
+
+	list := types.MessageBatchList{Data: make([]types.MessageBatch, 0, end-start)}
+	for _, entry := range owned[start:end] {
+		list.Data = append(list.Data, entry.view(c))
+	}
+	if len(list.Data) > 0 {
+		first, last := list.Data[0].ID, list.Data[len(list.Data)-1].ID
+		list.FirstID, list.LastID = &first, &last
+	}
+	if c.Query("before_id") != "" {
+		list.HasMore = start > 0
+	} else {
+		list.HasMore = end < len(owned)
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// handleCancelBatch POST /v1/messages/batches/:id/cancel 取消批次，未开始或进行中的请求记为 canceled
+func handleCancelBatch(c *gin.Context) {
+	s := batchStoreOf(c)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.lookup(c, c.Param("id"))
+	if !ok {
+		respondBatchNotFound(c)
+		return
+	}
+	if entry.batch.ProcessingStatus == batchInProgress {
+		now := time.Now().UTC()
+		entry.batch.ProcessingStatus = batchCanceling
+		entry.batch.CancelInitiatedAt = &now
+		entry.cancel()
+		s.persistBatch(entry)
+		utils.Log("取消消息批次", addReqFields(c, utils.LogString("batch_id", entry.batch.ID))...)
+	}
+	c.JSON(http.StatusOK, entry.view(c))
+}
+
+// handleDeleteBatch DELETE /v1/messages/batches/:id 删除已结束的批次及其结果
+func handleDeleteBatch(c *gin.Context) {
+	s := batchStoreOf(c)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.lookup(c, c.Param("id"))
+	if !ok {
+		respondBatchNotFound(c)
+		return
+	}
+	if entry.batch.ProcessingStatus != batchEnded {
+		respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: "Message batch " + entry.batch.ID + " is still processing; cancel it before deleting"})
+		return
+	}
+	s.remove(entry.batch.ID)
+	c.JSON(http.StatusOK, gin.H{"id": entry.batch.ID, "type": "message_batch_deleted"})
+}
+
+// handleBatchResults GET /v1/messages/batches/:id/results 以 JSONL 返回已结束批次的结果（与请求顺序一致）
+func handleBatchResults(c *gin.Context) {
+	s := batchStoreOf(c)
+	s.mu.Lock()
+	entry, ok := s.lookup(c, c.Param("id"))
+	if !ok {
+		s.mu.Unlock()
+		respondBatchNotFound(c)
+		return
+	}
+	if entry.batch.ProcessingStatus != batchEnded {
+		s.mu.Unlock()
+		respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: "Message batch " + entry.batch.ID + " has not finished processing"})
+		return
+	}
+	var buf bytes.Buffer
+	for i, customID := range entry.customIDs {
+		line, err := utils.SafeMarshal(types.MessageBatchResult{CustomID: customID, Result: *entry.results[i]})
+		if err != nil {
+			continue
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	s.mu.Unlock()
+
+	c.Data(http.StatusOK, "application/x-jsonl", buf.Bytes())
+}
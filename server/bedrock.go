@@ -0,0 +1,359 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"kiro/parser"
+	"kiro/sigv4"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bedrockBackend 通过 Amazon Bedrock InvokeModel API 访问 Claude 模型的上游
+// 按模型（BEDROCK_MODELS）或按租户（backend: bedrock）选用，请求和响应均为 Anthropic Messages 格式，无需转换
+type bedrockBackend struct {
+	region   string
+	creds    sigv4.Credentials
+	models   []string          // 所有请求都发往 Bedrock 的模型
+	modelIDs map[string]string // 客户端模型名 -> Bedrock 模型 ID
+}
+
+var bedrockProvider *bedrockBackend
+
+// bedrockAnthropicVersion Bedrock 要求的 anthropic_version
+const bedrockAnthropicVersion = "bedrock-2023-05-31"
+
+// bedrockDefaultModelIDs 默认的 Bedrock 模型 ID（跨区域推理配置），可通过 BEDROCK_MODEL_MAP 覆盖或补充
+var bedrockDefaultModelIDs = map[string]string{
+	"claude-opus-4-5":   "us.anthropic.claude-opus-4-5-20251101-v1:0",
+	"claude-sonnet-4-5": "us.anthropic.claude-sonnet-4-5-20250929-v1:0",
+	"claude-haiku-4-5":  "us.anthropic.claude-haiku-4-5-20251001-v1:0",
+}
+
+// bedrockUnsupportedFields Bedrock 不接受的请求体字段
+var bedrockUnsupportedFields = []string{"model", "stream", "provider", "metadata", "service_tier"}
+
+// InitBedrock 根据环境变量初始化 Bedrock 上游
+// BEDROCK_REGION: Bedrock 所在区域，为空则禁用
+// AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY / AWS_SESSION_TOKEN: 调用 Bedrock 的 AWS 凭证
+// BEDROCK_MODELS: 所有请求都发往 Bedrock 的模型（逗号分隔）
+// BEDROCK_MODEL_MAP: 模型名到 Bedrock 模型 ID 的映射，格式 name=id，逗号分隔
+func InitBedrock() {
+	backend, err := newBedrockBackend()
+	if err != nil {
+		utils.Error("Bedrock 上游初始化失败: %v", err)
+		return
+	}
+	if backend == nil {
+		return
+	}
+	bedrockProvider = backend
+	utils.Info("Bedrock 上游已启用 (region: %s, 模型: %v)", backend.region, backend.models)
+}
+
+// newBedrockBackend 从环境变量构建 Bedrock 上游，未配置区域时返回 nil
+func newBedrockBackend() (*bedrockBackend, error) {
+	region := os.Getenv("BEDROCK_REGION")
+	if region == "" {
+		return nil, nil
+	}
+	creds := sigv4.Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("未配置 AWS_ACCESS_KEY_ID 或 AWS_SECRET_ACCESS_KEY")
+	}
+
+	var models []string
+	for _, m := range strings.Split(os.Getenv("BEDROCK_MODELS"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			models = append(models, m)
+		}
+	}
+
+	modelIDs := make(map[string]string, len(bedrockDefaultModelIDs))
+	for name, id := range bedrockDefaultModelIDs {
+		modelIDs[name] = id
+	}
+	for _, pair := range strings.Split(os.Getenv("BEDROCK_MODEL_MAP"), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, id, ok := strings.Cut(pair, "=")
+		name, id = strings.TrimSpace(name), strings.TrimSpace(id)
+		if !ok || name == "" || id == "" {
+			return nil, fmt.Errorf("BEDROCK_MODEL_MAP 条目格式错误: %q，应为 name=id", pair)
+		}
+		modelIDs[name] = id
+	}
+
+	return &bedrockBackend{region: region, creds: creds, models: models, modelIDs: modelIDs}, nil
+}
+
+// modelID 返回模型对应的 Bedrock 模型 ID，未映射时原样使用（客户端可直接传 Bedrock 模型 ID 或推理配置 ARN）
+func (b *bedrockBackend) modelID(model string) string {
+	if id, ok := b.modelIDs[model]; ok {
+		return id
+	}
+	return model
+}
+
+// useBedrock 当前请求是否发往 Bedrock：租户指定 backend: bedrock，或模型在 BEDROCK_MODELS 中
+func useBedrock(c *gin.Context, model string) bool {
+	if profile := GetTenant(c); profile != nil && profile.UsesBedrock() {
+		return true
+	}
+	return bedrockProvider != nil && containsString(bedrockProvider.models, model)
+}
+
+/**
+ * handleBedrockRequest 将 Anthropic 请求转发到 Bedrock InvokeModel(WithResponseStream)
+ * 流式响应从 AWS event-stream 中解出原始 Anthropic 事件，按 SSE 原样转发；非流式响应原样返回
+ */
+func handleBedrockRequest(c *gin.Context, anthropicReq types.AnthropicRequest) {
+	if bedrockProvider == nil {
+		respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusServiceUnavailable, Message: "Bedrock backend is not configured on this server", Type: errTypeAPI})
+		return
+	}
+
+	release, slotErr := acquireConcurrencySlot(c)
+	if slotErr != nil {
+		respondAnthropicError(c, slotErr)
+		return
+	}
+	defer release()
+
+	body, err := bedrockRequestBody(c, anthropicReq)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "构建 Bedrock 请求失败: %v", err)
+		return
+	}
+
+	action := "invoke"
+	if anthropicReq.Stream {
+		action = "invoke-with-response-stream"
+	}
+	modelID := bedrockProvider.modelID(anthropicReq.Model)
+	host := "bedrock-runtime." + bedrockProvider.region + ".amazonaws.com"
+	endpoint := "https://" + host + "/model/" + sigv4.EscapePath(modelID) + "/" + action
+
+	req, err := http.NewRequestWithContext(c.Request.Context(), "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "创建 Bedrock 请求失败: %v", err)
+		return
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("accept", "application/json")
+	sigv4.Sign(req, body, bedrockProvider.region, "bedrock", bedrockProvider.creds, time.Now())
+
+	resp, err := utils.DoRequest(req)
+	if err != nil {
+		utils.Log("Bedrock 请求失败", addReqFields(c, utils.LogString("model_id", modelID), utils.LogErr(err))...)
+		respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadGateway, Message: "Bedrock request failed: " + err.Error(), Type: errTypeAPI})
+		return
+	}
+	defer resp.Body.Close()
+
+	c.Header("X-Kiro-Backend", "bedrock")
+	utils.RecordPolicy(c, "backend", "routed to Bedrock model %s in %s", modelID, bedrockProvider.region)
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		respondAnthropicError(c, bedrockError(resp.StatusCode, respBody))
+		return
+	}
+
+	var usage types.Usage
+	if anthropicReq.Stream {
+		usage = relayBedrockStream(c, resp.Body)
+	} else {
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			respondError(c, http.StatusBadGateway, "读取 Bedrock 响应失败: %v", err)
+			return
+		}
+		var parsed struct {
+			Usage types.Usage `json:"usage"`
+		}
+		_ = utils.SafeUnmarshal(respBody, &parsed)
+		usage = parsed.Usage
+		c.Data(http.StatusOK, "application/json", respBody)
+	}
+
+	recordTokenUsage(c, usage.InputTokens, usage.OutputTokens)
+	recordCacheTokens(c, usage.CacheReadInputTokens, usage.CacheCreationInputTokens)
+	utils.Log("Bedrock 请求完成",
+		addReqFields(c,
+			utils.LogString("model_id", modelID),
+			utils.LogInt("input_tokens", usage.InputTokens),
+			utils.LogInt("output_tokens", usage.OutputTokens),
+		)...)
+}
+
+// bedrockRequestBody 构建 Bedrock 请求体
+// 基于客户端原始请求体，移除 Bedrock 不接受的字段，补充 anthropic_version，anthropic-beta 请求头转为 anthropic_beta 字段
+func bedrockRequestBody(c *gin.Context, anthropicReq types.AnthropicRequest) ([]byte, error) {
+	var rawReq map[string]any
+	if body, ok := c.Get("rawBody"); ok {
+		if rawBody, ok := body.([]byte); ok {
+			if err := utils.SafeUnmarshal(rawBody, &rawReq); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if rawReq == nil {
+		marshaled, err := utils.SafeMarshal(anthropicReq)
+		if err != nil {
+			return nil, err
+		}
+		if err := utils.SafeUnmarshal(marshaled, &rawReq); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, field := range bedrockUnsupportedFields {
+		delete(rawReq, field)
+	}
+	rawReq["anthropic_version"] = bedrockAnthropicVersion
+	if beta := c.GetHeader("anthropic-beta"); beta != "" {
+		var betas []string
+		for _, b := range strings.Split(beta, ",") {
+			if b = strings.TrimSpace(b); b != "" {
+				betas = append(betas, b)
+			}
+		}
+		rawReq["anthropic_beta"] = betas
+	}
+	return utils.SafeMarshal(rawReq)
+}
+
+// relayBedrockStream 解析 InvokeModelWithResponseStream 的 event-stream 响应，转发其中的 Anthropic 事件并累计 usage
+func relayBedrockStream(c *gin.Context, body io.Reader) types.Usage {
+	var usage types.Usage
+	if err := initializeSSEResponse(c); err != nil {
+		return usage
+	}
+
+	streamParser := parser.NewRobustEventStreamParser()
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			messages, parseErr := streamParser.ParseStream(buf[:n])
+			for _, msg := range messages {
+				if err := relayBedrockMessage(c, msg, &usage); err != nil {
+					return usage
+				}
+			}
+			if parseErr != nil {
+				utils.Log("Bedrock 事件流解析失败", addReqFields(c, utils.LogErr(parseErr))...)
+				return usage
+			}
+		}
+		if readErr != nil {
+			if !errors.Is(readErr, io.EOF) {
+				utils.Log("读取 Bedrock 事件流失败", addReqFields(c, utils.LogErr(readErr))...)
+			}
+			return usage
+		}
+	}
+}
+
+// relayBedrockMessage 转发一条 Bedrock 事件：chunk 事件的 bytes 字段即 Anthropic 流式事件，异常转为 error 事件
+// 返回错误表示流已结束（写入失败或上游异常）
+func relayBedrockMessage(c *gin.Context, msg *parser.EventStreamMessage, usage *types.Usage) error {
+	if msg.GetMessageType() == "exception" {
+		exceptionType, _ := msg.Headers[":exception-type"].Value.(string)
+		var payload struct {
+			Message string `json:"message"`
+		}
+		_ = utils.SafeUnmarshal(msg.Payload, &payload)
+		utils.Log("Bedrock 流式响应异常",
+			addReqFields(c,
+				utils.LogString("exception", exceptionType),
+				utils.LogString("message", payload.Message),
+			)...)
+		errType := errTypeAPI
+		if exceptionType == "throttlingException" {
+			errType = errTypeOverloaded
+		}
+		event, _ := utils.SafeMarshal(gin.H{"type": "error", "error": gin.H{"type": errType, "message": payload.Message}})
+		writeSSEEvent(c, "error", event)
+		return errors.New(exceptionType)
+	}
+	if msg.GetEventType() != "chunk" {
+		return nil
+	}
+
+	var chunk struct {
+		Bytes string `json:"bytes"`
+	}
+	if err := utils.SafeUnmarshal(msg.Payload, &chunk); err != nil {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(chunk.Bytes)
+	if err != nil {
+		return nil
+	}
+	var event struct {
+		Type string `json:"type"`
+	}
+	if err := utils.SafeUnmarshal(data, &event); err != nil || event.Type == "" {
+		return nil
+	}
+	accumulateStreamUsage(string(data), usage)
+	return writeSSEEvent(c, event.Type, data)
+}
+
+// writeSSEEvent 写出一条 SSE 事件并立即刷新
+func writeSSEEvent(c *gin.Context, eventType string, data []byte) error {
+	if _, err := fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", eventType, data); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
+
+// bedrockError 将 Bedrock 错误响应转换为 Anthropic 错误
+func bedrockError(status int, body []byte) *UpstreamError {
+	var parsed struct {
+		Message string `json:"message"`
+	}
+	_ = utils.SafeUnmarshal(body, &parsed)
+	message := parsed.Message
+	if message == "" {
+		message = strings.TrimSpace(string(body))
+	}
+
+	errType := errTypeAPI
+	switch status {
+	case http.StatusBadRequest:
+		errType = errTypeInvalidRequest
+	case http.StatusUnauthorized, http.StatusForbidden:
+		// Bedrock 凭证或模型访问权限问题属于服务端配置错误，不是客户端认证失败
+		errType = errTypePermission
+		status = http.StatusForbidden
+	case http.StatusNotFound:
+		errType = errTypeNotFound
+	case http.StatusTooManyRequests:
+		errType = errTypeRateLimit
+	case http.StatusServiceUnavailable:
+		errType = errTypeOverloaded
+	}
+	if status >= 500 && status != http.StatusServiceUnavailable {
+		status = http.StatusBadGateway
+	}
+	return &UpstreamError{StatusCode: status, Message: "Bedrock: " + message, Type: errType}
+}
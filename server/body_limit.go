@@ -0,0 +1,54 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"kiro/config"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * RequestBodyLimitMiddleware 限制请求体大小
+ * Content-Length 已超出上限时直接返回 413；未声明长度（分块传输）时包装请求体，
+ * 读取超过上限时由读取方通过 isBodyTooLarge 识别并返回 413，避免把数 MB 的请求体完整读入内存后在转换阶段才失败
+ * REQUEST_BODY_MAX_BYTES 为 0 时不限制
+ */
+func RequestBodyLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := int64(config.Current().RequestBodyMaxBytes)
+		if limit <= 0 || c.Request.Body == nil {
+			c.Next()
+			return
+		}
+
+		if c.Request.ContentLength > limit {
+			utils.Log("请求体超过大小上限",
+				utils.LogInt("content_length", int(c.Request.ContentLength)),
+				utils.LogInt("limit", int(limit)))
+			respondBodyTooLarge(c)
+			c.Abort()
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
+
+// isBodyTooLarge 判断读取请求体的错误是否由超出大小上限引起
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// respondBodyTooLarge 返回 413 request_too_large 错误
+func respondBodyTooLarge(c *gin.Context) {
+	respondAnthropicError(c, &UpstreamError{
+		StatusCode: http.StatusRequestEntityTooLarge,
+		Type:       errTypeRequestTooLarge,
+		Message:    fmt.Sprintf("Request exceeds the maximum allowed size of %d bytes", config.Current().RequestBodyMaxBytes),
+	})
+}
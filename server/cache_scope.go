@@ -0,0 +1,140 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"kiro/cache"
+	"kiro/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * Prompt Cache 的隔离范围和按 API Key 的缓存统计
+ * PROMPT_CACHE_SCOPE=key（默认）时缓存条目按调用方 API Key 隔离，一个 key 写入的缓存不会让另一个 key 的请求命中，
+ * 避免共享部署中 cache_read_input_tokens 被其他客户端的请求抬高；tenant 时同一租户的 key 共享缓存
+ */
+
+// cacheNamespace 返回当前请求的缓存命名空间
+func cacheNamespace(c *gin.Context) string {
+	namespace := ""
+	if profile := GetTenant(c); profile != nil {
+		namespace = profile.Namespace()
+	}
+	if config.Current().PromptCacheScope == "tenant" {
+		return namespace
+	}
+	if keyHash := c.GetString("apiKeyHash"); keyHash != "" {
+		namespace += "/key:" + keyHash
+	}
+	return namespace
+}
+
+// cacheKeyStats 单个 API Key 的缓存计数（进程启动以来）
+type cacheKeyStats struct {
+	tenant         string
+	requests       int64
+	readRequests   int64 // 命中缓存的请求数
+	inputTokens    int64
+	readTokens     int64
+	creationTokens int64
+	lastUsed       time.Time
+}
+
+// cacheKeyStatsView 管理端点展示的 API Key 缓存统计
+type cacheKeyStatsView struct {
+	KeyHash        string    `json:"key_hash"` // API Key 的 SHA256 前 16 位
+	Tenant         string    `json:"tenant,omitempty"`
+	Requests       int64     `json:"requests"`
+	ReadRequests   int64     `json:"read_requests"`
+	HitRate        float64   `json:"hit_rate"`
+	InputTokens    int64     `json:"input_tokens"`
+	ReadTokens     int64     `json:"cache_read_input_tokens"`
+	CreationTokens int64     `json:"cache_creation_input_tokens"`
+	LastUsed       time.Time `json:"last_used"`
+}
+
+var (
+	cacheKeyStatsMap   = make(map[string]*cacheKeyStats)
+	cacheKeyStatsMutex sync.Mutex
+)
+
+// recordCacheKeyStats 将一次缓存处理结果计入调用方 API Key
+func recordCacheKeyStats(c *gin.Context, result *cache.CacheResult) {
+	keyHash := c.GetString("apiKeyHash")
+	if len(keyHash) < 16 {
+		return
+	}
+	id := keyHash[:16]
+
+	cacheKeyStatsMutex.Lock()
+	defer cacheKeyStatsMutex.Unlock()
+	stats, ok := cacheKeyStatsMap[id]
+	if !ok {
+		stats = &cacheKeyStats{}
+		cacheKeyStatsMap[id] = stats
+	}
+	stats.tenant = tenantName(c)
+	stats.requests++
+	if result.CacheReadTokens > 0 {
+		stats.readRequests++
+	}
+	stats.inputTokens += int64(result.TotalTokens)
+	stats.readTokens += int64(result.CacheReadTokens)
+	stats.creationTokens += int64(result.CacheCreationTokens)
+	stats.lastUsed = time.Now()
+}
+
+// cacheKeyStatsSnapshot 返回所有 API Key 的缓存统计（按 key_hash 排序）
+func cacheKeyStatsSnapshot() []cacheKeyStatsView {
+	cacheKeyStatsMutex.Lock()
+	views := make([]cacheKeyStatsView, 0, len(cacheKeyStatsMap))
+	for id, stats := range cacheKeyStatsMap {
+		view := cacheKeyStatsView{
+			KeyHash:        id,
+			Tenant:         stats.tenant,
+			Requests:       stats.requests,
+			ReadRequests:   stats.readRequests,
+			InputTokens:    stats.inputTokens,
+			ReadTokens:     stats.readTokens,
+			CreationTokens: stats.creationTokens,
+			LastUsed:       stats.lastUsed,
+		}
+		if stats.requests > 0 {
+			view.HitRate = float64(stats.readRequests) / float64(stats.requests)
+		}
+		views = append(views, view)
+	}
+	cacheKeyStatsMutex.Unlock()
+
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].KeyHash < views[j].KeyHash
+	})
+	return views
+}
+
+// handleAdminCacheKeys GET /admin/cache/keys 按 API Key 统计的缓存命中和 token 数，可按 tenant 过滤
+func handleAdminCacheKeys(c *gin.Context) {
+	views := cacheKeyStatsSnapshot()
+	if name := c.Query("tenant"); name != "" {
+		filtered := views[:0]
+		for _, view := range views {
+			if view.Tenant == name {
+				filtered = append(filtered, view)
+			}
+		}
+		views = filtered
+	}
+	scope := config.Current().PromptCacheScope
+	if scope == "" {
+		scope = "key"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"scope":  scope,
+		"data":   views,
+	})
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+
+	"kiro/config"
+	"kiro/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// longContextBeta 代理识别的长上下文 beta 名称
+const longContextBeta = "context-1m-2025-08-07"
+
+/**
+ * handleCapabilities 处理 GET /v1/capabilities
+ * 按模型描述本代理实际支持的 Anthropic 特性（考虑租户模型白名单、上游后端、编译选项和运行时开关），
+ * 客户端据此做特性检测，无需逐个试错
+ */
+func handleCapabilities(c *gin.Context) {
+	profile := GetTenant(c)
+	ids := make(map[string]bool)
+	for model := range config.Current().ModelMap {
+		ids[model] = true
+	}
+	if bedrockProvider != nil {
+		for _, model := range bedrockProvider.models {
+			ids[model] = true
+		}
+	}
+
+	models := make([]types.ModelCapability, 0, len(ids))
+	for model := range ids {
+		if profile != nil && !profile.ModelAllowed(model) {
+			continue
+		}
+		models = append(models, modelCapability(c, model))
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].ID < models[j].ID })
+
+	c.JSON(http.StatusOK, types.CapabilitiesResponse{
+		Object:           "capabilities",
+		Batches:          true,
+		CountTokens:      true,
+		OpenAICompatible: openAICompiled && featureEnabled(featureOpenAI),
+		Models:           models,
+	})
+}
+
+// modelCapability 描述当前请求身份下单个模型的能力
+func modelCapability(c *gin.Context, model string) types.ModelCapability {
+	capability := types.ModelCapability{
+		ID:            model,
+		ContextWindow: config.ContextWindowTokens,
+		Features: types.ModelFeatures{
+			Vision:        true,
+			Thinking:      true,
+			ToolUse:       true,
+			ToolStreaming: true,
+			PromptCaching: true,
+		},
+		Emulated:    []string{},
+		ServerTools: []string{},
+	}
+
+	switch {
+	case anthropicPassthrough(c):
+		// 直连和 Bedrock 请求原样转发，特性由上游原生提供
+		capability.Backend = "anthropic"
+		capability.Betas = types.BetaCapability{Passthrough: true, Supported: []string{}}
+		capability.ServerTools = []string{"web_search", codeExecutionToolName}
+	case useBedrock(c, model):
+		capability.Backend = "bedrock"
+		capability.Betas = types.BetaCapability{Passthrough: true, Supported: []string{}}
+	default:
+		capability.Backend = "kiro"
+		capability.Betas = types.BetaCapability{Supported: []string{}}
+		// thinking 通过提示词注入实现，签名由代理生成；缓存只模拟 usage 计费字段
+		capability.Emulated = append(capability.Emulated, "thinking", "prompt_caching")
+		if long := config.Current().LongContextWindowTokens; long > config.ContextWindowTokens {
+			capability.LongContextWindow = long
+			capability.Betas.Supported = append(capability.Betas.Supported, longContextBeta)
+		}
+		if webSearchProviderEnabled() || (mcpCompiled && featureEnabled(featureMCP)) {
+			capability.ServerTools = append(capability.ServerTools, "web_search")
+			capability.Emulated = append(capability.Emulated, "web_search")
+		}
+		if codeExecutionEnabled() {
+			capability.ServerTools = append(capability.ServerTools, codeExecutionToolName)
+			capability.Emulated = append(capability.Emulated, codeExecutionToolName)
+		}
+	}
+	return capability
+}
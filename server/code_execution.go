@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+)
+
+/**
+ * code_execution 服务端工具模拟
+ * 上游不支持 Anthropic 的 code_execution 服务端工具，模型调用时由代理在配置的沙箱命令（Docker / firejail 等）中执行代码，
+ * 执行结果作为 tool_result 继续对话（模拟流程见 server_tools.go）
+ */
+
+// codeExecutionToolName 客户端声明的 code_execution 服务端工具名
+const codeExecutionToolName = "code_execution"
+
+// codeExecutionTool 发往上游的等价客户端工具定义
+var codeExecutionTool = types.AnthropicTool{
+	Name:        codeExecutionToolName,
+	Description: "Execute Python code in a sandboxed environment without network access. Returns stdout, stderr and the exit code. Print every value you need to see.",
+	InputSchema: map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"code": map[string]any{
+				"type":        "string",
+				"description": "The Python code to execute",
+			},
+		},
+		"required": []any{"code"},
+	},
+}
+
+// codeExecutionSlots 限制同时运行的沙箱进程数
+var codeExecutionSlots = make(chan struct{}, config.CodeExecutionMaxConcurrent)
+
+// codeExecutionEnabled 是否配置了沙箱命令
+func codeExecutionEnabled() bool {
+	return strings.TrimSpace(config.Current().CodeExecutionCommand) != ""
+}
+
+// hasCodeExecutionTool 请求是否声明了 code_execution 工具
+func hasCodeExecutionTool(req types.AnthropicRequest) bool {
+	for _, tool := range req.Tools {
+		if tool.Name == codeExecutionToolName {
+			return true
+		}
+	}
+	return false
+}
+
+// codeExecutionResult 一次沙箱执行的结果
+type codeExecutionResult struct {
+	Stdout     string
+	Stderr     string
+	ReturnCode int
+	ErrorCode  string // 非空表示未能完成执行：execution_time_exceeded / unavailable
+}
+
+// content 返回 code_execution_tool_result 块的 content 字段
+func (r codeExecutionResult) content() map[string]any {
+	if r.ErrorCode != "" {
+		return map[string]any{
+			"type":       "code_execution_tool_result_error",
+			"error_code": r.ErrorCode,
+		}
+	}
+	return map[string]any{
+		"type":        "code_execution_result",
+		"stdout":      r.Stdout,
+		"stderr":      r.Stderr,
+		"return_code": r.ReturnCode,
+		"content":     []any{},
+	}
+}
+
+// toolResultText 执行结果转为发往上游的 tool_result 文本
+func (r codeExecutionResult) toolResultText() string {
+	if r.ErrorCode != "" {
+		return "Code execution failed: " + r.ErrorCode
+	}
+	return fmt.Sprintf("return_code: %d\nstdout:\n%s\nstderr:\n%s", r.ReturnCode, r.Stdout, r.Stderr)
+}
+
+// limitedBuffer 只保留前 max 字节的输出缓冲，超出部分丢弃
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.max - b.buf.Len(); remaining < len(p) {
+		b.truncated = true
+		if remaining > 0 {
+			b.buf.Write(p[:remaining])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "\n[output truncated]"
+	}
+	return b.buf.String()
+}
+
+/**
+ * runSandboxedCode 在沙箱命令中执行代码（代码通过标准输入传入）
+ * 超时返回 execution_time_exceeded，命令无法启动或客户端断开返回 unavailable；非零退出码是正常结果
+ */
+func runSandboxedCode(ctx context.Context, code string) codeExecutionResult {
+	args := strings.Fields(config.Current().CodeExecutionCommand)
+	if len(args) == 0 {
+		return codeExecutionResult{ErrorCode: toolErrUnavailable}
+	}
+
+	select {
+	case codeExecutionSlots <- struct{}{}:
+		defer func() { <-codeExecutionSlots }()
+	case <-ctx.Done():
+		return codeExecutionResult{ErrorCode: toolErrUnavailable}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.Current().CodeExecutionTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	stdout := &limitedBuffer{max: config.CodeExecutionMaxOutputBytes}
+	stderr := &limitedBuffer{max: config.CodeExecutionMaxOutputBytes}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(code)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// 沙箱的子进程继承输出管道时，进程被杀后最多再等待 1 秒
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return codeExecutionResult{ErrorCode: toolErrExecutionTimeExceeded}
+	}
+	result := codeExecutionResult{Stdout: stdout.String(), Stderr: stderr.String()}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.ReturnCode = exitErr.ExitCode()
+	} else if err != nil {
+		utils.Error("沙箱命令执行失败: %v", err)
+		return codeExecutionResult{ErrorCode: toolErrUnavailable}
+	}
+	return result
+}
+
+// codeExecutionServerTool 在沙箱中执行代码的 code_execution 模拟工具
+var codeExecutionServerTool = &emulatedServerTool{
+	upstream:   codeExecutionTool,
+	resultType: "code_execution_tool_result",
+	run: func(ctx context.Context, input map[string]any) serverToolResult {
+		code, _ := input["code"].(string)
+		result := runSandboxedCode(ctx, code)
+		return serverToolResult{Content: result.content(), Text: result.toolResultText(), IsError: result.ErrorCode != ""}
+	},
+}
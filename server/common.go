@@ -2,12 +2,19 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"kiro/config"
 	"kiro/converter"
+	"kiro/tenant"
+	"kiro/tracing"
 
 	"kiro/types"
 	"kiro/utils"
@@ -17,8 +24,12 @@ import (
 
 // UpstreamError 上游 API 错误类型
 type UpstreamError struct {
-	StatusCode int
-	Message    string
+	StatusCode     int
+	Message        string
+	Type           string    // Anthropic 错误类型，已翻译的上游错误才设置（如 invalid_request_error）
+	ResetAt        time.Time // 额度耗尽时的重置时间（仅 429）
+	QuotaExhausted bool      // 上游账号额度耗尽，响应附带剩余为 0 的 anthropic-ratelimit-* 响应头
+	Handled        bool      // 响应已由回退通道写出，调用方无需再返回错误
 }
 
 func (e *UpstreamError) Error() string {
@@ -27,12 +38,44 @@ func (e *UpstreamError) Error() string {
 
 // respondErrorWithCode 标准化的错误响应结构
 // 统一返回: {"error": {"message": string, "code": string}}
+// 已记录上游响应头时附带 debug 字段（含上游请求 ID）
 func respondErrorWithCode(c *gin.Context, statusCode int, code string, format string, args ...any) {
+	errBody := gin.H{
+		"message": fmt.Sprintf(format, args...),
+		"code":    code,
+	}
+	if debug := errorDebugInfo(c); debug != nil {
+		errBody["debug"] = debug
+	}
 	c.JSON(statusCode, gin.H{
-		"error": gin.H{
-			"message": fmt.Sprintf(format, args...),
-			"code":    code,
-		},
+		"error": errBody,
+	})
+}
+
+// respondAnthropicError 以 Anthropic 错误格式返回已翻译的上游错误
+// 429 响应附带 Retry-After 头和结构化的重置时间，便于客户端安排恢复
+func respondAnthropicError(c *gin.Context, upstreamErr *UpstreamError) {
+	errBody := gin.H{
+		"type":    upstreamErr.Type,
+		"message": upstreamErr.Message,
+	}
+	if upstreamErr.StatusCode == http.StatusTooManyRequests {
+		retryAfter := retryAfterSeconds(upstreamErr.ResetAt)
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		errBody["retry_after_seconds"] = retryAfter
+		if !upstreamErr.ResetAt.IsZero() {
+			errBody["quota_reset_at"] = upstreamErr.ResetAt.UTC().Format(time.RFC3339)
+		}
+		if upstreamErr.QuotaExhausted {
+			setQuotaRateLimitHeaders(c, upstreamErr.ResetAt)
+		}
+	}
+	if debug := errorDebugInfo(c); debug != nil {
+		errBody["debug"] = debug
+	}
+	c.JSON(upstreamErr.StatusCode, gin.H{
+		"type":  "error",
+		"error": errBody,
 	})
 }
 
@@ -41,23 +84,28 @@ func respondError(c *gin.Context, statusCode int, format string, args ...any) {
 	var code string
 	switch statusCode {
 	case http.StatusBadRequest:
-		code = "bad_request"
+		code = errCodeBadRequest
 	case http.StatusUnauthorized:
-		code = "unauthorized"
+		code = errCodeUnauthorized
 	case http.StatusForbidden:
-		code = "forbidden"
+		code = errCodeForbidden
 	case http.StatusNotFound:
-		code = "not_found"
+		code = errCodeNotFound
 	case http.StatusTooManyRequests:
-		code = "rate_limited"
+		code = errCodeRateLimited
 	default:
-		code = "internal_error"
+		code = errCodeInternal
 	}
 	respondErrorWithCode(c, statusCode, code, format, args...)
 }
 
 // 通用请求处理错误函数
 func handleRequestBuildError(c *gin.Context, err error) {
+	var imageErr *converter.ImageError
+	if errors.As(err, &imageErr) {
+		respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadRequest, Message: imageErr.Error(), Type: errTypeInvalidRequest})
+		return
+	}
 	utils.Error("构建请求失败: %v", err)
 	respondError(c, http.StatusInternalServerError, "构建请求失败: %v", err)
 }
@@ -86,7 +134,62 @@ func filterSupportedTools(tools []types.AnthropicTool) []types.AnthropicTool {
 	return tools
 }
 
+// estimateInputTokens 估算实际发送给上游的输入 token 数
+// 在客户端请求内容之外，计入转换时注入的 <system_mode>、Agentic 和 Thinking 提示
+func estimateInputTokens(estimator *utils.TokenEstimator, anthropicReq types.AnthropicRequest) int {
+	tokens := estimator.EstimateTokens(&types.CountTokensRequest{
+		Model:    anthropicReq.Model,
+		System:   anthropicReq.System,
+		Messages: anthropicReq.Messages,
+		Tools:    filterSupportedTools(anthropicReq.Tools), // 过滤不支持的工具后计算
+	})
+	if injected := converter.InjectedPrompt(anthropicReq); injected != "" {
+		tokens += estimator.EstimateTextTokens(injected)
+	}
+	return tokens
+}
+
+/**
+ * proxyOverheadTokens 估算代理在客户端内容之外额外发送给上游的 token 数
+ * 包括注入的 <system_mode>、Agentic、Thinking 提示，以及历史修复补齐的内容（自动配对的 "OK"、占位内容等）
+ * 用于解释上游额度消耗快于客户端估算的原因，在 usage.proxy_overhead_tokens 中返回
+ */
+func proxyOverheadTokens(c *gin.Context, anthropicReq types.AnthropicRequest) int {
+	estimator := utils.NewTokenEstimator()
+	tokens := estimator.EstimateTextTokens(converter.InjectedPrompt(anthropicReq))
+	tokens += estimator.EstimateTextTokens(c.GetString(converter.PaddingKey))
+	return tokens
+}
+
+// isWebSearchToolName 工具名是否为 web_search（兼容 websearch 写法）
+func isWebSearchToolName(name string) bool {
+	return name == "web_search" || name == "websearch"
+}
+
+// hasWebSearchTool 检查请求中是否包含 web_search 工具
+func hasWebSearchTool(req types.AnthropicRequest) bool {
+	for _, tool := range req.Tools {
+		if isWebSearchToolName(tool.Name) {
+			return true
+		}
+	}
+	return false
+}
+
 func executeCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicRequest, tokenInfo types.TokenInfo, isStream bool) (*http.Response, error) {
+	// 已知额度耗尽的 token 在重置前直接返回 429，避免反复请求上游
+	if state := cachedQuotaExhaustion(c.GetString("tokenHash")); state != nil {
+		upstreamErr := quotaExhaustedError(state)
+		if trySpillToAnthropic(c, anthropicReq) {
+			upstreamErr.Handled = true
+			return nil, upstreamErr
+		}
+		if !isStream {
+			respondAnthropicError(c, upstreamErr)
+		}
+		return nil, upstreamErr
+	}
+
 	req, err := buildCodeWhispererRequest(c, anthropicReq, tokenInfo, isStream)
 	if err != nil {
 		// 检查是否是模型未找到错误，如果是，则响应已经发送，不需要再次处理
@@ -102,16 +205,95 @@ func executeCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReq
 	// 通过代理管理器按 token hash 路由
 	proxyKey, _ := c.Get("tokenHash")
 	proxyKeyStr, _ := proxyKey.(string)
+	req = utils.PaceRequestBody(req)
+	var ttfb *ttfbBudget
+	if isStream && config.Current().UpstreamTTFBBudgetSeconds > 0 {
+		req, ttfb = withTTFBBudget(req)
+	}
+	_, span := tracing.Start(requestContext(c), "upstream GenerateAssistantResponse", tracing.KindClient)
+	span.SetAttr("http.request.method", req.Method)
+	span.SetAttr("server.address", req.URL.Host)
+	span.SetAttr("http.request.body.size", req.ContentLength)
+	span.SetAttr("kiro.upstream_invocation_id", GetUpstreamInvocationID(c))
+	if clientID := c.GetString("client_request_id"); clientID != "" {
+		span.SetAttr("kiro.client_request_id", clientID)
+	}
+	span.SetAttr("kiro.token_failover", c.GetBool(tokenFailoverKey))
+	defer span.End()
+	span.SetAttr("kiro.upstream_endpoint", c.GetString(upstreamEndpointKey))
 	resp, err := utils.DoRequestWithProxy(req, proxyKeyStr)
 	if err != nil {
+		span.SetError(err)
+		recordTokenRequest(c, true)
+		if requestContext(c).Err() == nil {
+			reportEndpointResult(c, false)
+		}
+		// 写入停滞或首字节超时导致的取消，返回明确的原因而非 context canceled
+		cause := context.Cause(req.Context())
+		if ttfb != nil {
+			ttfb.release()
+		}
+		if errors.Is(cause, errUpstreamTTFBExceeded) {
+			return failoverOnTTFB(c, anthropicReq, tokenInfo, isStream)
+		}
+		if errors.Is(cause, utils.ErrUpstreamWriteStalled) {
+			err = cause
+		} else if upstreamRetriesLeft(c) && backoffUpstreamRetry(c, err.Error()) == nil {
+			// 连接重置、超时等网络故障：退避后重发
+			return executeCodeWhispererRequest(c, anthropicReq, tokenInfo, isStream)
+		}
 		if !isStream {
 			handleRequestSendError(c, err)
 		}
 		return nil, err
 	}
+	captureUpstreamHeaders(c, resp)
+	recordTokenRequest(c, resp.StatusCode != http.StatusOK)
+	reportEndpointResult(c, !isRetryableUpstreamStatus(resp.StatusCode))
+	span.SetAttr("http.response.status_code", resp.StatusCode)
+	if upstreamID := resp.Header.Get("x-amzn-RequestId"); upstreamID != "" {
+		span.SetAttr("kiro.upstream_request_id", upstreamID)
+	}
+	if ttfb != nil {
+		if err := ttfb.awaitFirstByte(resp); err != nil {
+			resp.Body.Close()
+			span.SetError(err)
+			return failoverOnTTFB(c, anthropicReq, tokenInfo, isStream)
+		}
+		span.AddEvent("first_byte")
+	}
 
-	upstreamErr := handleCodeWhispererError(c, resp, isStream)
+	// 上游临时故障（5xx）：退避后重发
+	if isRetryableUpstreamStatus(resp.StatusCode) && upstreamRetriesLeft(c) {
+		resp.Body.Close()
+		if err := backoffUpstreamRetry(c, fmt.Sprintf("HTTP %d", resp.StatusCode)); err != nil {
+			return nil, err
+		}
+		return executeCodeWhispererRequest(c, anthropicReq, tokenInfo, isStream)
+	}
+
+	// 会话状态错误客户端无法自行恢复：使用新的 ConversationId 并重建历史后重试一次
+	if resp.StatusCode == http.StatusBadRequest && !c.GetBool(converter.FreshConversationKey) {
+		body, readErr := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if readErr == nil && isConversationStateError(body) {
+			utils.Info("上游会话状态错误，使用新的会话ID重试: %s", string(body))
+			c.Set(converter.FreshConversationKey, true)
+			utils.RecordPolicy(c, "repair", "upstream rejected conversation state; retried with a fresh conversation id and rebuilt tool pairing")
+			return executeCodeWhispererRequest(c, anthropicReq, tokenInfo, isStream)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	// 账号封禁或限流：切换到池中的下一个 token 透明重试一次
+	if (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests) && failoverOnAccountError(c, anthropicReq, resp) {
+		tokenInfo.AccessToken = c.GetString("accessToken")
+		return executeCodeWhispererRequest(c, anthropicReq, tokenInfo, isStream)
+	}
+
+	upstreamErr := handleCodeWhispererError(c, anthropicReq, resp, isStream)
 	if upstreamErr != nil {
+		span.SetError(upstreamErr)
 		resp.Body.Close()
 		return nil, upstreamErr
 	}
@@ -119,12 +301,44 @@ func executeCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReq
 	return resp, nil
 }
 
-// execCWRequest 供测试覆盖的请求执行入口（可在测试中替换）
-var execCWRequest = executeCodeWhispererRequest
+// requestContext 返回请求的 context（携带追踪 span），c 为 nil 时返回 Background
+func requestContext(c *gin.Context) context.Context {
+	if c == nil || c.Request == nil {
+		return context.Background()
+	}
+	return c.Request.Context()
+}
+
+// conversationStatePatterns 上游会话状态类错误的特征（小写匹配）
+var conversationStatePatterns = []string{
+	"conversationid",
+	"conversation id",
+	"conversationstate.history",
+	"conversation history",
+	"tooluseid",
+	"toolresult",
+}
+
+// isConversationStateError 判断 400 响应是否由会话状态（ConversationId/历史）引起
+func isConversationStateError(body []byte) bool {
+	lower := strings.ToLower(string(body))
+	for _, pattern := range conversationStatePatterns {
+		if strings.Contains(lower, pattern) {
+			return true
+		}
+	}
+	return false
+}
 
 // buildCodeWhispererRequest 构建通用的CodeWhisperer请求
 func buildCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicRequest, tokenInfo types.TokenInfo, isStream bool) (*http.Request, error) {
+	_, span := tracing.Start(requestContext(c), "converter.BuildCodeWhispererRequest", tracing.KindInternal)
+	span.SetAttr("gen_ai.request.model", anthropicReq.Model)
+	span.SetAttr("kiro.messages", len(anthropicReq.Messages))
+	span.SetAttr("kiro.tools", len(anthropicReq.Tools))
 	cwReq, err := converter.BuildCodeWhispererRequest(anthropicReq, c)
+	span.SetError(err)
+	span.End()
 	if err != nil {
 		// 检查是否是模型未找到错误
 		if modelNotFoundErr, ok := err.(*types.ModelNotFoundErrorType); ok {
@@ -132,31 +346,44 @@ func buildCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReque
 			c.JSON(http.StatusBadRequest, modelNotFoundErr.ErrorData)
 			return nil, err
 		}
-		return nil, fmt.Errorf("构建CodeWhisperer请求失败: %v", err)
+		return nil, fmt.Errorf("构建CodeWhisperer请求失败: %w", err)
 	}
 
-	// 设置 profileArn（从 token 刷新响应中获取）
+	// 租户身份标识：由租户前缀和原始 conversationId 派生 UUIDv5，保持 GUID 格式且便于上游追溯
+	var profile *tenant.Profile
 	if c != nil {
-		if profileArn, exists := c.Get("profileArn"); exists {
-			if arn, ok := profileArn.(string); ok && arn != "" {
-				cwReq.ProfileArn = arn
-			}
+		profile = GetTenant(c)
+	}
+	if profile != nil && profile.ConversationIDPrefix != "" {
+		original := cwReq.ConversationState.ConversationId
+		cwReq.ConversationState.ConversationId = utils.TenantConversationID(profile.ConversationIDPrefix, original)
+		utils.Debug("租户 conversationId 映射: tenant=%s conversation_id=%s upstream_conversation_id=%s",
+			profile.Name, original, cwReq.ConversationState.ConversationId)
+	}
+
+	// 设置 profileArn（按 token 声明的 profile 选择，否则为 token 显式配置或从 token 刷新响应中获取）
+	if c != nil {
+		if arn := selectTokenProfile(c, anthropicReq.Model); arn != "" {
+			cwReq.ProfileArn = arn
 		}
 	}
 
-	cwReqBody, err := utils.SafeMarshal(cwReq)
+	cwReqBody, err := newUpstreamBody(c, cwReq)
 	if err != nil {
 		return nil, fmt.Errorf("序列化请求失败: %v", err)
 	}
 
-	utils.Info("上游请求: size=%d, tools=%d",
-		len(cwReqBody),
-		len(cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools))
+	utils.Info("上游请求: size=%d, tools=%d, streamed=%t",
+		cwReqBody.size,
+		len(cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools),
+		cwReqBody.streamed())
 
-	req, err := http.NewRequest("POST", config.CodeWhispererURL, bytes.NewReader(cwReqBody))
+	// 绑定客户端请求的 context：客户端断开时立即取消上游请求，不再继续消耗额度
+	req, err := http.NewRequestWithContext(requestContext(c), "POST", selectUpstreamEndpoint(c), nil)
 	if err != nil {
 		return nil, fmt.Errorf("创建请求失败: %v", err)
 	}
+	cwReqBody.attach(req)
 
 	req.Header.Set("Authorization", "Bearer "+tokenInfo.AccessToken)
 	req.Header.Set("content-type", "application/x-amz-json-1.0")
@@ -166,15 +393,22 @@ func buildCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReque
 	req.Header.Set("x-amzn-codewhisperer-optout", "false")
 	req.Header.Set("user-agent", "aws-sdk-rust/"+config.SDKVersion+" ua/2.1 api/codewhispererstreaming/"+config.APIVersion+" os/linux lang/rust/1.92.0 md/appVersion-"+config.KiroCLIVersion+" app/AmazonQ-For-CLI")
 	req.Header.Set("x-amz-user-agent", "aws-sdk-rust/"+config.SDKVersion+" ua/2.1 api/codewhispererstreaming/"+config.APIVersion+" os/linux lang/rust/1.92.0 m/F,C app/AmazonQ-For-CLI")
-	req.Header.Set("amz-sdk-invocation-id", utils.GenerateUUID())
+	req.Header.Set("amz-sdk-invocation-id", GetUpstreamInvocationID(c))
 	req.Header.Set("amz-sdk-request", "attempt=1; max=3")
 
+	// 附加租户自定义请求头（保留头已在 IdentityHeaders 中过滤）
+	if profile != nil {
+		for k, v := range profile.IdentityHeaders() {
+			req.Header.Set(k, v)
+		}
+	}
+
 	return req, nil
 }
 
 // handleCodeWhispererError 处理CodeWhisperer API错误响应
 // 对于流式请求，只返回错误信息；对于非流式请求，发送JSON响应
-func handleCodeWhispererError(c *gin.Context, resp *http.Response, isStream bool) *UpstreamError {
+func handleCodeWhispererError(c *gin.Context, anthropicReq types.AnthropicRequest, resp *http.Response, isStream bool) *UpstreamError {
 	if resp.StatusCode == http.StatusOK {
 		return nil
 	}
@@ -188,7 +422,7 @@ func handleCodeWhispererError(c *gin.Context, resp *http.Response, isStream bool
 		return &UpstreamError{StatusCode: resp.StatusCode, Message: "读取响应失败"}
 	}
 
-	utils.Error("上游错误: status=%d, body=%s", resp.StatusCode, string(body))
+	utils.Error("上游错误: status=%d, upstream_request_id=%s, body=%s", resp.StatusCode, resp.Header.Get("x-amzn-RequestId"), string(body))
 
 	// 尝试解析上游错误信息
 	errorMsg := string(body)
@@ -201,19 +435,50 @@ func handleCodeWhispererError(c *gin.Context, resp *http.Response, isStream bool
 
 	// 特殊处理：403错误表示账号被封禁
 	if resp.StatusCode == http.StatusForbidden {
+		recordBanIncident(c, anthropicReq, resp, body)
+
 		// 清除失效的 token 缓存
 		if refreshToken, exists := c.Get("refreshToken"); exists {
 			if token, ok := refreshToken.(string); ok {
-				InvalidateToken(token)
+				tokenServiceOf(c).Invalidate(token)
 			}
 		}
 
+		if trySpillToAnthropic(c, anthropicReq) {
+			return &UpstreamError{StatusCode: resp.StatusCode, Message: errorMsg, Handled: true}
+		}
 		if !isStream {
-			respondErrorWithCode(c, http.StatusForbidden, "forbidden", "%s", errorMsg)
+			respondErrorWithCode(c, http.StatusForbidden, errCodeForbidden, "%s", errorMsg)
 		}
 		return &UpstreamError{StatusCode: resp.StatusCode, Message: errorMsg}
 	}
 
+	// 限流：探测账号额度，耗尽时返回重置时间
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if state := checkQuotaExhausted(c); state != nil {
+			upstreamErr := quotaExhaustedError(state)
+			if trySpillToAnthropic(c, anthropicReq) {
+				upstreamErr.Handled = true
+				return upstreamErr
+			}
+			if !isStream {
+				respondAnthropicError(c, upstreamErr)
+			}
+			return upstreamErr
+		}
+	}
+
+	// 校验错误：翻译为指向具体工具/消息的 invalid_request_error
+	if resp.StatusCode == http.StatusBadRequest {
+		if detail, ok := translateValidationError(errorMsg, anthropicReq); ok {
+			upstreamErr := &UpstreamError{StatusCode: http.StatusBadRequest, Message: detail, Type: errTypeInvalidRequest}
+			if !isStream {
+				respondAnthropicError(c, upstreamErr)
+			}
+			return upstreamErr
+		}
+	}
+
 	// 使用错误映射器处理错误
 	errorMapper := NewErrorMapper()
 	claudeError := errorMapper.MapCodeWhispererError(resp.StatusCode, body)
@@ -223,7 +488,7 @@ func handleCodeWhispererError(c *gin.Context, resp *http.Response, isStream bool
 		if claudeError.StopReason == "max_tokens" {
 			errorMapper.SendClaudeError(c, claudeError)
 		} else {
-			respondErrorWithCode(c, http.StatusInternalServerError, "cw_error", "%s", errorMsg)
+			respondErrorWithCode(c, http.StatusInternalServerError, errCodeCW, "%s", errorMsg)
 		}
 	}
 
@@ -239,41 +504,9 @@ type StreamEventSender interface {
 // AnthropicStreamSender Anthropic格式的流事件发送器
 type AnthropicStreamSender struct{}
 
+// SendEvent 按统一的 SSE schema 序列化事件（struct 或 map）并写出，字段风格见 sseFieldStyle
 func (s *AnthropicStreamSender) SendEvent(c *gin.Context, data any) error {
-	var eventType string
-	var orderedData any = data
-
-	// 如果是 map，转换为有序 struct
-	if dataMap, ok := data.(map[string]any); ok {
-		if t, exists := dataMap["type"]; exists {
-			eventType, _ = t.(string)
-		}
-		orderedData = convertToOrderedStruct(dataMap)
-	} else {
-		// 从 struct 中提取 type
-		switch v := data.(type) {
-		case *types.MessageStartEvent:
-			eventType = v.Type
-		case *types.ContentBlockStartEvent:
-			eventType = v.Type
-		case *types.ContentBlockDeltaEvent:
-			eventType = v.Type
-		case *types.ContentBlockStopEvent:
-			eventType = v.Type
-		case *types.MessageDeltaEvent:
-			eventType = v.Type
-		case *types.MessageStopEvent:
-			eventType = v.Type
-		case *types.PingEvent:
-			eventType = v.Type
-		case *types.GenericOrderedEvent:
-			eventType = v.Type
-		case *types.ErrorEvent:
-			eventType = v.Type
-		}
-	}
-
-	json, err := utils.SafeMarshal(orderedData)
+	eventType, json, err := types.MarshalSSEEvent(data, sseFieldStyle(c))
 	if err != nil {
 		return err
 	}
@@ -284,274 +517,8 @@ func (s *AnthropicStreamSender) SendEvent(c *gin.Context, data any) error {
 	return nil
 }
 
-// convertToOrderedStruct 将 map 转换为有序 struct（保证 type 在最前）
-func convertToOrderedStruct(m map[string]any) any {
-	eventType, _ := m["type"].(string)
-
-	switch eventType {
-	case "message_start":
-		return convertMessageStart(m)
-	case "content_block_start":
-		return convertContentBlockStart(m)
-	case "content_block_delta":
-		return convertContentBlockDelta(m)
-	case "content_block_stop":
-		return convertContentBlockStop(m)
-	case "message_delta":
-		return convertMessageDelta(m)
-	case "message_stop":
-		return types.NewMessageStopEvent()
-	case "ping":
-		return types.NewPingEvent()
-	case "error":
-		return convertError(m)
-	default:
-		// 未知类型使用 GenericOrderedEvent 确保 type 在前
-		return types.NewGenericOrderedEvent(eventType, m)
-	}
-}
-
-func convertMessageStart(m map[string]any) *types.MessageStartEvent {
-	msg := &types.MessageInfo{
-		Content: []any{}, // 确保 Content 始终是空数组而不是 nil
-	}
-	if message, ok := m["message"].(map[string]any); ok {
-		msg.ID, _ = message["id"].(string)
-		msg.Type, _ = message["type"].(string)
-		msg.Role, _ = message["role"].(string)
-		msg.Model, _ = message["model"].(string)
-		if content, ok := message["content"].([]any); ok && content != nil {
-			// 过滤 content 数组，移除 thinking 块中的 signature 字段
-			cleanedContent := make([]any, 0, len(content))
-			for _, item := range content {
-				if contentBlock, ok := item.(map[string]any); ok {
-					// 如果是 thinking 类型，移除 signature 字段
-					if blockType, _ := contentBlock["type"].(string); blockType == "thinking" {
-						cleanedBlock := make(map[string]any)
-						for k, v := range contentBlock {
-							if k != "signature" {
-								cleanedBlock[k] = v
-							}
-						}
-						cleanedContent = append(cleanedContent, cleanedBlock)
-					} else {
-						// 其他类型直接保留
-						cleanedContent = append(cleanedContent, item)
-					}
-				} else {
-					// 非 map 类型直接保留
-					cleanedContent = append(cleanedContent, item)
-				}
-			}
-			msg.Content = cleanedContent
-		}
-		if usage, ok := message["usage"].(map[string]any); ok {
-			msg.Usage = &types.UsageInfo{
-				ServiceTier:   "standard",
-				InferenceGeo:  "not_available",
-				CacheCreation: &types.CacheCreation{},
-			}
-			// cache 相关字段
-			if v, ok := usage["cache_creation_input_tokens"].(int); ok {
-				msg.Usage.CacheCreationInputTokens = v
-			} else if v, ok := usage["cache_creation_input_tokens"].(float64); ok {
-				msg.Usage.CacheCreationInputTokens = int(v)
-			}
-			if v, ok := usage["cache_read_input_tokens"].(int); ok {
-				msg.Usage.CacheReadInputTokens = v
-			} else if v, ok := usage["cache_read_input_tokens"].(float64); ok {
-				msg.Usage.CacheReadInputTokens = int(v)
-			}
-			// 基础 token 字段
-			if v, ok := usage["input_tokens"].(int); ok {
-				msg.Usage.InputTokens = v
-			} else if v, ok := usage["input_tokens"].(float64); ok {
-				msg.Usage.InputTokens = int(v)
-			}
-			if v, ok := usage["output_tokens"].(int); ok {
-				msg.Usage.OutputTokens = v
-			} else if v, ok := usage["output_tokens"].(float64); ok {
-				msg.Usage.OutputTokens = int(v)
-			}
-		}
-	}
-	return types.NewMessageStartEvent(msg)
-}
-
-
-func convertContentBlockStart(m map[string]any) *types.ContentBlockStartEvent {
-	index := 0
-	if v, ok := m["index"].(int); ok {
-		index = v
-	} else if v, ok := m["index"].(float64); ok {
-		index = int(v)
-	}
-
-	// 默认为空文本块，确保 content_block 不为 null
-	var block any = &types.SSETextContentBlock{
-		Type: "text",
-		Text: "",
-	}
-	if cb, ok := m["content_block"].(map[string]any); ok {
-		blockType, _ := cb["type"].(string)
-		if blockType == "text" {
-			// 文本块：始终包含 text 字段（即使为空）
-			text, _ := cb["text"].(string)
-			block = &types.SSETextContentBlock{
-				Type: "text",
-				Text: text,
-			}
-		} else if blockType == "tool_use" {
-			// 工具使用块：使用专用结构体确保 input 字段始终存在
-			toolBlock := &types.SSEToolUseContentBlock{
-				Type:  "tool_use",
-				Input: map[string]any{}, // 确保 input 不为 null
-			}
-			toolBlock.ID, _ = cb["id"].(string)
-			toolBlock.Name, _ = cb["name"].(string)
-			if input, exists := cb["input"]; exists && input != nil {
-				toolBlock.Input = input
-			}
-			block = toolBlock
-		} else if blockType == "thinking" {
-			// thinking 块：使用专用结构体确保 thinking 字段始终存在
-			thinking, _ := cb["thinking"].(string)
-			block = &types.SSEThinkingContentBlock{
-				Type:     "thinking",
-				Thinking: thinking,
-			}
-		} else if blockType != "" {
-			// 其他已知类型
-			sseBlock := &types.SSEContentBlock{}
-			sseBlock.Type = blockType
-			sseBlock.Text, _ = cb["text"].(string)
-			sseBlock.ID, _ = cb["id"].(string)
-			sseBlock.Name, _ = cb["name"].(string)
-			if input, exists := cb["input"]; exists {
-				sseBlock.Input = input
-			}
-			block = sseBlock
-		}
-	}
-	return types.NewContentBlockStartEvent(index, block)
-}
-
-func convertContentBlockDelta(m map[string]any) *types.ContentBlockDeltaEvent {
-	index := 0
-	if v, ok := m["index"].(int); ok {
-		index = v
-	} else if v, ok := m["index"].(float64); ok {
-		index = int(v)
-	}
-
-	// 解析 delta 类型
-	deltaType := "text_delta"
-	text := ""
-	partialJSON := ""
-	thinking := ""
-	signature := ""
-	if d, ok := m["delta"].(map[string]any); ok {
-		if t, ok := d["type"].(string); ok && t != "" {
-			deltaType = t
-		}
-		text, _ = d["text"].(string)
-		partialJSON, _ = d["partial_json"].(string)
-		thinking, _ = d["thinking"].(string)
-		signature, _ = d["signature"].(string)
-	}
-
-	// 根据 delta 类型返回相应的结构体（确保字段始终存在）
-	var delta any
-	switch deltaType {
-	case "input_json_delta":
-		delta = &types.InputJSONDeltaBlock{
-			Type:        deltaType,
-			PartialJSON: partialJSON,
-		}
-	case "thinking_delta":
-		// thinking_delta：使用专用结构体确保 thinking 字段存在
-		delta = &types.ThinkingDeltaBlock{
-			Type:     deltaType,
-			Thinking: thinking,
-		}
-	case "signature_delta":
-		// signature_delta：使用专用结构体确保 signature 字段存在
-		delta = &types.SignatureDeltaBlock{
-			Type:      deltaType,
-			Signature: signature,
-		}
-	default:
-		// text_delta 或其他类型
-		delta = &types.TextDeltaBlock{
-			Type: deltaType,
-			Text: text,
-		}
-	}
-
-	return types.NewContentBlockDeltaEvent(index, delta)
-}
-
-func convertContentBlockStop(m map[string]any) *types.ContentBlockStopEvent {
-	index := 0
-	if v, ok := m["index"].(int); ok {
-		index = v
-	} else if v, ok := m["index"].(float64); ok {
-		index = int(v)
-	}
-	return types.NewContentBlockStopEvent(index)
-}
-
-func convertMessageDelta(m map[string]any) *types.MessageDeltaEvent {
-	stopReason := ""
-	if delta, ok := m["delta"].(map[string]any); ok {
-		stopReason, _ = delta["stop_reason"].(string)
-	}
-
-	var usage *types.UsageInfo
-	if u, ok := m["usage"].(map[string]any); ok {
-		usage = &types.UsageInfo{
-			ServiceTier:   "standard",
-			InferenceGeo:  "not_available",
-			CacheCreation: &types.CacheCreation{},
-		}
-		// cache 相关字段
-		if v, ok := u["cache_creation_input_tokens"].(int); ok {
-			usage.CacheCreationInputTokens = v
-		} else if v, ok := u["cache_creation_input_tokens"].(float64); ok {
-			usage.CacheCreationInputTokens = int(v)
-		}
-		if v, ok := u["cache_read_input_tokens"].(int); ok {
-			usage.CacheReadInputTokens = v
-		} else if v, ok := u["cache_read_input_tokens"].(float64); ok {
-			usage.CacheReadInputTokens = int(v)
-		}
-		// 基础 token 字段
-		if v, ok := u["input_tokens"].(int); ok {
-			usage.InputTokens = v
-		} else if v, ok := u["input_tokens"].(float64); ok {
-			usage.InputTokens = int(v)
-		}
-		if v, ok := u["output_tokens"].(int); ok {
-			usage.OutputTokens = v
-		} else if v, ok := u["output_tokens"].(float64); ok {
-			usage.OutputTokens = int(v)
-		}
-	}
-	return types.NewMessageDeltaEvent(stopReason, usage)
-}
-
-func convertError(m map[string]any) *types.ErrorEvent {
-	errType := "error"
-	errMsg := ""
-	if e, ok := m["error"].(map[string]any); ok {
-		errType, _ = e["type"].(string)
-		errMsg, _ = e["message"].(string)
-	}
-	return types.NewErrorEvent(errType, errMsg)
-}
-
 func (s *AnthropicStreamSender) SendError(c *gin.Context, message string, _ error) error {
-	return s.SendEvent(c, types.NewErrorEvent("overloaded_error", message))
+	return s.SendEvent(c, types.NewErrorEvent(errTypeOverloaded, message))
 }
 
 // RequestContext 请求处理上下文，封装通用的请求处理逻辑
@@ -579,6 +546,10 @@ func (rc *RequestContext) GetTokenAndBody() (types.TokenInfo, []byte, error) {
 	body, err := rc.GinContext.GetRawData()
 	if err != nil {
 		utils.Error("读取请求体失败: %v", err)
+		if isBodyTooLarge(err) {
+			respondBodyTooLarge(rc.GinContext)
+			return types.TokenInfo{}, nil, err
+		}
 		respondError(rc.GinContext, http.StatusBadRequest, "读取请求体失败: %v", err)
 		return types.TokenInfo{}, nil, err
 	}
@@ -601,6 +572,10 @@ func (rc *RequestContext) GetTokenWithUsageAndBody() (*types.TokenWithUsage, []b
 	body, err := rc.GinContext.GetRawData()
 	if err != nil {
 		utils.Error("读取请求体失败: %v", err)
+		if isBodyTooLarge(err) {
+			respondBodyTooLarge(rc.GinContext)
+			return nil, nil, err
+		}
 		respondError(rc.GinContext, http.StatusBadRequest, "读取请求体失败: %v", err)
 		return nil, nil, err
 	}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"kiro/config"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// errConcurrencyQueueFull 并发已满且等待队列已满
+	errConcurrencyQueueFull = errors.New("并发等待队列已满")
+	// errConcurrencyQueueTimeout 排队超过等待时间仍未获得并发额度
+	errConcurrencyQueueTimeout = errors.New("并发排队超时")
+)
+
+// slotWaiter 排队等待并发额度的请求
+type slotWaiter struct {
+	priority int
+	ready    chan struct{}
+	granted  bool
+}
+
+/**
+ * concurrencyLimiter 带有界等待队列的并发限制器
+ * 额度释放时直接移交给队首的等待者，队列按优先级（路由规则设置，数值越大越优先）排序，同优先级先到先得
+ * 上限在每次获取和释放时读取，配置热重载后立即生效
+ */
+type concurrencyLimiter struct {
+	limit   func() int
+	mu      sync.Mutex
+	active  int
+	waiters []*slotWaiter
+}
+
+var (
+	globalLimiter = &concurrencyLimiter{limit: func() int { return config.Current().MaxConcurrentRequests }}
+
+	tokenLimiters     = make(map[string]*concurrencyLimiter)
+	tokenLimiterMutex sync.Mutex
+)
+
+// limiterForToken 返回上游 token 对应的并发限制器，不存在时创建
+func limiterForToken(tokenHash string) *concurrencyLimiter {
+	tokenLimiterMutex.Lock()
+	defer tokenLimiterMutex.Unlock()
+	l, ok := tokenLimiters[tokenHash]
+	if !ok {
+		l = &concurrencyLimiter{limit: func() int { return config.Current().MaxConcurrentPerToken }}
+		tokenLimiters[tokenHash] = l
+	}
+	return l
+}
+
+// acquire 获取一个并发额度，额度已满时按优先级排队，直到获得额度、排队超时或请求被取消
+func (l *concurrencyLimiter) acquire(ctx context.Context, priority, queueSize int, timeout time.Duration) error {
+	l.mu.Lock()
+	limit := l.limit()
+	if limit <= 0 || (l.active < limit && len(l.waiters) == 0) {
+		l.active++
+		l.mu.Unlock()
+		return nil
+	}
+	if len(l.waiters) >= queueSize {
+		l.mu.Unlock()
+		return errConcurrencyQueueFull
+	}
+
+	w := &slotWaiter{priority: priority, ready: make(chan struct{})}
+	pos := len(l.waiters)
+	for i, other := range l.waiters {
+		if priority > other.priority {
+			pos = i
+			break
+		}
+	}
+	l.waiters = append(l.waiters, nil)
+	copy(l.waiters[pos+1:], l.waiters[pos:])
+	l.waiters[pos] = w
+	l.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-timer.C:
+		err = errConcurrencyQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	if w.granted {
+		// 放弃等待的同时恰好获得了额度，归还给下一个等待者
+		l.mu.Unlock()
+		l.release()
+		return err
+	}
+	for i, other := range l.waiters {
+		if other == w {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			break
+		}
+	}
+	l.mu.Unlock()
+	return err
+}
+
+// release 归还一个并发额度，并按上限唤醒排队的请求
+func (l *concurrencyLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	limit := l.limit()
+	for len(l.waiters) > 0 && (limit <= 0 || l.active < limit) {
+		w := l.waiters[0]
+		l.waiters = l.waiters[1:]
+		w.granted = true
+		close(w.ready)
+		l.active++
+	}
+}
+
+/**
+ * acquireConcurrencySlot 获取全局和当前上游 token 的并发额度，成功时返回释放函数
+ * 全局队列已满返回 503 overloaded_error，token 队列已满返回 429 rate_limit_error，均附带 Retry-After
+ * 额度在整个请求（包括流式响应）结束后释放
+ */
+func acquireConcurrencySlot(c *gin.Context) (func(), *UpstreamError) {
+	settings := config.Current()
+	if settings.MaxConcurrentRequests <= 0 && settings.MaxConcurrentPerToken <= 0 {
+		return func() {}, nil
+	}
+
+	ctx := c.Request.Context()
+	priority := c.GetInt(requestPriorityKey)
+	queueSize := settings.ConcurrencyQueueSize
+	timeout := time.Duration(settings.ConcurrencyQueueTimeoutSeconds) * time.Second
+	start := time.Now()
+
+	if err := globalLimiter.acquire(ctx, priority, queueSize, timeout); err != nil {
+		return nil, concurrencyError(c, err, "global", settings.MaxConcurrentRequests)
+	}
+
+	tokenHash := c.GetString("tokenHash")
+	var tokenLimiter *concurrencyLimiter
+	if tokenHash != "" {
+		tokenLimiter = limiterForToken(tokenHash)
+		if err := tokenLimiter.acquire(ctx, priority, queueSize, timeout); err != nil {
+			globalLimiter.release()
+			return nil, concurrencyError(c, err, "token", settings.MaxConcurrentPerToken)
+		}
+	}
+
+	if waited := time.Since(start); waited >= time.Millisecond {
+		utils.RecordPolicy(c, "concurrency_queue", "waited %s for a concurrency slot", waited.Round(time.Millisecond))
+	}
+	return func() {
+		if tokenLimiter != nil {
+			tokenLimiter.release()
+		}
+		globalLimiter.release()
+	}, nil
+}
+
+// concurrencyError 将排队失败转换为返回给客户端的错误
+func concurrencyError(c *gin.Context, err error, scope string, limit int) *UpstreamError {
+	utils.Log("并发额度不足，拒绝请求",
+		addReqFields(c,
+			utils.LogString("scope", scope),
+			utils.LogInt("limit", limit),
+			utils.LogErr(err),
+		)...)
+
+	if scope == "token" {
+		return &UpstreamError{
+			StatusCode: http.StatusTooManyRequests,
+			Type:       errTypeRateLimit,
+			Message:    fmt.Sprintf("Too many concurrent requests for this upstream account (limit %d), please retry later", limit),
+			ResetAt:    time.Now().Add(time.Second),
+		}
+	}
+	c.Header("Retry-After", "1")
+	c.Header("x-should-retry", "true")
+	return &UpstreamError{
+		StatusCode: http.StatusServiceUnavailable,
+		Type:       errTypeOverloaded,
+		Message:    fmt.Sprintf("Too many concurrent requests (limit %d), please retry later", limit),
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * sendContentBlock 以官方流式事件序列输出一个已完整生成的内容块
+ * 用于服务端工具模拟（web_search、code_execution）等先生成完整响应再输出的场景：
+ * tool_use / server_tool_use 的 input 通过 input_json_delta 给出，thinking 依次给出 thinking_delta 和 signature_delta，
+ * 文本的引用通过 citations_delta 在正文之前给出，其它块（工具结果）在 content_block_start 中一次性给出
+ */
+func sendContentBlock(c *gin.Context, sender StreamEventSender, index int, block map[string]any) {
+	switch block["type"] {
+	case "tool_use", "server_tool_use":
+		sender.SendEvent(c, map[string]any{
+			"type":  "content_block_start",
+			"index": index,
+			"content_block": map[string]any{
+				"id":    block["id"],
+				"type":  block["type"],
+				"name":  block["name"],
+				"input": map[string]any{},
+			},
+		})
+		inputJSON, _ := json.Marshal(block["input"])
+		sender.SendEvent(c, map[string]any{
+			"type":  "content_block_delta",
+			"index": index,
+			"delta": map[string]any{
+				"type":         "input_json_delta",
+				"partial_json": string(inputJSON),
+			},
+		})
+	case "thinking":
+		sender.SendEvent(c, map[string]any{
+			"type":          "content_block_start",
+			"index":         index,
+			"content_block": map[string]any{"type": "thinking", "thinking": ""},
+		})
+		sender.SendEvent(c, map[string]any{
+			"type":  "content_block_delta",
+			"index": index,
+			"delta": map[string]any{
+				"type":     "thinking_delta",
+				"thinking": block["thinking"],
+			},
+		})
+		if signature, _ := block["signature"].(string); signature != "" {
+			sender.SendEvent(c, map[string]any{
+				"type":  "content_block_delta",
+				"index": index,
+				"delta": map[string]any{
+					"type":      "signature_delta",
+					"signature": signature,
+				},
+			})
+		}
+	case "text":
+		sender.SendEvent(c, map[string]any{
+			"type":          "content_block_start",
+			"index":         index,
+			"content_block": map[string]any{"type": "text", "text": ""},
+		})
+		citations, _ := block["citations"].([]any)
+		for _, citation := range citations {
+			sender.SendEvent(c, map[string]any{
+				"type":  "content_block_delta",
+				"index": index,
+				"delta": map[string]any{
+					"type":     "citations_delta",
+					"citation": citation,
+				},
+			})
+		}
+		sender.SendEvent(c, map[string]any{
+			"type":  "content_block_delta",
+			"index": index,
+			"delta": map[string]any{
+				"type": "text_delta",
+				"text": block["text"],
+			},
+		})
+	default:
+		sender.SendEvent(c, map[string]any{
+			"type":          "content_block_start",
+			"index":         index,
+			"content_block": block,
+		})
+	}
+
+	sender.SendEvent(c, map[string]any{
+		"type":  "content_block_stop",
+		"index": index,
+	})
+}
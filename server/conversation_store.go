@@ -0,0 +1,284 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * 会话状态保存与分叉
+ * CONVERSATION_STORE_SIZE > 0 时，带 X-Conversation-ID 的 /v1/messages 请求完成后保存该会话的完整历史
+ * （请求消息 + 本次 assistant 回复），按调用方 API Key 隔离。同一会话 ID 的请求带 X-Kiro-Conversation-Append: 1 时
+ * 只需发送新增的消息，代理把保存的历史拼接在请求消息之前；不带该请求头的请求照常视为完整历史。
+ * POST /v1/conversations/{id}/fork 将保存的状态复制到新的会话 ID（可截断到较早的 assistant 回复），
+ * 客户端据此从同一个 agent 会话分出多个分支，而无需再经代理重发完整历史。
+ * 状态只保存在内存中，超过 ConversationStoreTTL 未使用或超出容量时按最久未使用淘汰；
+ * 存储属于各个 Server，经 services 放入请求上下文
+ */
+
+// conversationIDHeader 客户端指定会话 ID 的请求头（同时决定上游 conversationId）
+const conversationIDHeader = "X-Conversation-ID"
+
+// conversationAppendHeader 值为 1 时请求只携带新增消息，需要拼接保存的历史
+const conversationAppendHeader = "X-Kiro-Conversation-Append"
+
+// storedConversation 一个会话保存的状态
+type storedConversation struct {
+	owner      string // 调用方 API Key 的 SHA256
+	id         string
+	model      string
+	messages   []types.AnthropicRequestMessage
+	forkedFrom string
+	createdAt  time.Time
+	lastUsed   time.Time
+}
+
+// conversationStore 按 API Key + 会话 ID 保存的会话状态
+type conversationStore struct {
+	mu      sync.Mutex
+	entries map[string]*storedConversation
+	size    int
+}
+
+// newConversationStore 创建会话状态存储，size 为 0 时不保存
+func newConversationStore(size int) *conversationStore {
+	return &conversationStore{
+		entries: make(map[string]*storedConversation),
+		size:    size,
+	}
+}
+
+// conversationStoreOf 返回请求所属 Server 的会话状态存储
+func conversationStoreOf(c *gin.Context) *conversationStore {
+	return servicesOf(c).conversations
+}
+
+// enabled 是否保存会话状态
+func (s *conversationStore) enabled() bool {
+	return s != nil && s.size > 0
+}
+
+// tracks 当前请求的会话状态是否需要保存
+func (s *conversationStore) tracks(c *gin.Context) bool {
+	return s.enabled() && c.GetHeader(conversationIDHeader) != ""
+}
+
+func conversationKey(owner, id string) string {
+	return owner + "/" + id
+}
+
+// get 返回未过期的会话，过期的直接删除（调用方持有 s.mu）
+func (s *conversationStore) get(owner, id string) (*storedConversation, bool) {
+	key := conversationKey(owner, id)
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(entry.lastUsed) > config.ConversationStoreTTL {
+		delete(s.entries, key)
+		return nil, false
+	}
+	return entry, true
+}
+
+// put 保存会话，超出容量时先清理过期条目，仍超出时淘汰最久未使用的会话（调用方持有 s.mu）
+func (s *conversationStore) put(entry *storedConversation) {
+	key := conversationKey(entry.owner, entry.id)
+	if _, exists := s.entries[key]; !exists && len(s.entries) >= s.size {
+		now := time.Now()
+		var oldestKey string
+		var oldest time.Time
+		for k, e := range s.entries {
+			if now.Sub(e.lastUsed) > config.ConversationStoreTTL {
+				delete(s.entries, k)
+				continue
+			}
+			if oldestKey == "" || e.lastUsed.Before(oldest) {
+				oldestKey, oldest = k, e.lastUsed
+			}
+		}
+		if len(s.entries) >= s.size {
+			delete(s.entries, oldestKey)
+		}
+	}
+	s.entries[key] = entry
+}
+
+// expandStoredConversation 请求带 X-Kiro-Conversation-Append: 1 时，在请求消息前拼接保存的会话历史
+// 会话不存在（未保存或已过期）时返回 404；新增消息须接着保存历史的最后一条消息（角色交替）
+func expandStoredConversation(c *gin.Context, req *types.AnthropicRequest) *UpstreamError {
+	if c.GetHeader(conversationAppendHeader) != "1" {
+		return nil
+	}
+	store := conversationStoreOf(c)
+	id := c.GetHeader(conversationIDHeader)
+	if !store.enabled() || id == "" {
+		return &UpstreamError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest,
+			Message: conversationAppendHeader + " requires " + conversationIDHeader + " and a server with CONVERSATION_STORE_SIZE set"}
+	}
+
+	store.mu.Lock()
+	entry, ok := store.get(c.GetString("apiKeyHash"), id)
+	var stored []types.AnthropicRequestMessage
+	if ok {
+		entry.lastUsed = time.Now()
+		stored = slices.Clone(entry.messages)
+	}
+	store.mu.Unlock()
+
+	if !ok {
+		return &UpstreamError{StatusCode: http.StatusNotFound, Type: errTypeNotFound, Message: "Conversation " + id + " not found"}
+	}
+	if len(req.Messages) == 0 {
+		return &UpstreamError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: "messages must contain the new turns of conversation " + id}
+	}
+	if len(stored) > 0 && req.Messages[0].Role == stored[len(stored)-1].Role {
+		return &UpstreamError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest,
+			Message: fmt.Sprintf("messages must continue conversation %s, whose last message has role %q", id, stored[len(stored)-1].Role)}
+	}
+	req.Messages = append(stored, req.Messages...)
+	utils.RecordPolicy(c, "conversation_store", "prepended %d stored messages of conversation %s", len(stored), id)
+	return nil
+}
+
+// recordConversation 保存已完成请求的完整历史（请求消息 + 本次回复）
+func recordConversation(c *gin.Context, rec evalRecord) {
+	store := conversationStoreOf(c)
+	if !store.tracks(c) {
+		return
+	}
+	messages := slices.Clone(rec.Request.Messages)
+	if len(rec.Content) > 0 {
+		messages = append(messages, types.AnthropicRequestMessage{Role: "assistant", Content: rec.Content})
+	}
+
+	entry := &storedConversation{
+		owner:     c.GetString("apiKeyHash"),
+		id:        c.GetHeader(conversationIDHeader),
+		model:     rec.Request.Model,
+		messages:  messages,
+		createdAt: rec.EndTime,
+		lastUsed:  rec.EndTime,
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if prev, ok := store.get(entry.owner, entry.id); ok {
+		entry.forkedFrom = prev.forkedFrom
+		entry.createdAt = prev.createdAt
+	}
+	store.put(entry)
+}
+
+// forkConversationRequest 分叉参数，均可省略
+type forkConversationRequest struct {
+	ID           string `json:"id,omitempty"`            // 新会话 ID，默认生成 UUID
+	MessageCount *int   `json:"message_count,omitempty"` // 只保留前 N 条消息，须以 assistant 消息结尾
+}
+
+// conversationView 会话端点返回的会话摘要
+type conversationView struct {
+	ID           string    `json:"id"`
+	Type         string    `json:"type"`
+	Model        string    `json:"model"`
+	MessageCount int       `json:"message_count"`
+	ForkedFrom   string    `json:"forked_from,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (entry *storedConversation) view() conversationView {
+	return conversationView{
+		ID:           entry.id,
+		Type:         "conversation",
+		Model:        entry.model,
+		MessageCount: len(entry.messages),
+		ForkedFrom:   entry.forkedFrom,
+		CreatedAt:    entry.createdAt,
+	}
+}
+
+// handleForkConversation POST /v1/conversations/:id/fork 将保存的会话状态复制到新的会话 ID
+func handleForkConversation(c *gin.Context) {
+	store := conversationStoreOf(c)
+	if !store.enabled() {
+		respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: "Conversation state is not stored on this server (set CONVERSATION_STORE_SIZE to enable forking)"})
+		return
+	}
+
+	var req forkConversationRequest
+	body, err := c.GetRawData()
+	if err != nil {
+		if isBodyTooLarge(err) {
+			respondBodyTooLarge(c)
+			return
+		}
+		respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: "Failed to read request body"})
+		return
+	}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		if err := utils.SafeUnmarshal(body, &req); err != nil {
+			respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: "Invalid JSON body: " + err.Error()})
+			return
+		}
+	}
+	if req.ID == "" {
+		req.ID = utils.GenerateUUID()
+	}
+
+	owner := c.GetString("apiKeyHash")
+	sourceID := c.Param("id")
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	source, ok := store.get(owner, sourceID)
+	if !ok {
+		respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusNotFound, Type: errTypeNotFound, Message: "Conversation " + sourceID + " not found"})
+		return
+	}
+	if _, exists := store.get(owner, req.ID); exists {
+		respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: "Conversation " + req.ID + " already exists"})
+		return
+	}
+
+	messages := source.messages
+	if req.MessageCount != nil {
+		n := *req.MessageCount
+		if n < 1 || n > len(messages) || messages[n-1].Role != "assistant" {
+			respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest,
+				Message: fmt.Sprintf("message_count must select 1..%d messages ending with an assistant message", len(messages))})
+			return
+		}
+		messages = messages[:n]
+	}
+
+	now := time.Now()
+	fork := &storedConversation{
+		owner:      owner,
+		id:         req.ID,
+		model:      source.model,
+		messages:   slices.Clone(messages),
+		forkedFrom: source.id,
+		createdAt:  now,
+		lastUsed:   now,
+	}
+	source.lastUsed = now
+	store.put(fork)
+
+	utils.Log("分叉会话",
+		addReqFields(c,
+			utils.LogString("conversation_id", source.id),
+			utils.LogString("fork_id", fork.id),
+			utils.LogInt("messages", len(fork.messages)),
+		)...)
+	c.JSON(http.StatusOK, fork.view())
+}
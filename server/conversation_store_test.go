@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"kiro/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestConversationForkAndAppend 保存会话、分叉后在分支上只发送新增消息
+func TestConversationForkAndAppend(t *testing.T) {
+	svc := &services{conversations: newConversationStore(8)}
+	newContext := func(apiKeyHash, body string, headers map[string]string) (*gin.Context, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		for k, v := range headers {
+			c.Request.Header.Set(k, v)
+		}
+		c.Set(servicesKey, svc)
+		c.Set("apiKeyHash", apiKeyHash)
+		return c, w
+	}
+	user := func(text string) types.AnthropicRequestMessage {
+		return types.AnthropicRequestMessage{Role: "user", Content: text}
+	}
+
+	c, _ := newContext("key-1", "", map[string]string{conversationIDHeader: "main"})
+	recordConversation(c, evalRecord{
+		Request: types.AnthropicRequest{Model: "claude-sonnet-4-5", Messages: []types.AnthropicRequestMessage{user("hi")}},
+		Content: []any{map[string]any{"type": "text", "text": "hello"}},
+		EndTime: time.Now(),
+	})
+
+	c, w := newContext("key-1", `{"id":"branch"}`, nil)
+	c.Params = gin.Params{{Key: "id", Value: "main"}}
+	handleForkConversation(c)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"forked_from":"main"`) {
+		t.Fatalf("fork: %d %s", w.Code, w.Body.String())
+	}
+
+	tests := []struct {
+		name       string
+		apiKeyHash string // 发起请求的 API Key，会话由 key-1 保存
+		headers    map[string]string
+		messages   []types.AnthropicRequestMessage
+		wantStatus int // 0 表示不返回错误
+		wantLen    int
+	}{
+		{"full history without opt-in", "key-1", map[string]string{conversationIDHeader: "branch"}, []types.AnthropicRequestMessage{user("hi (compacted)")}, 0, 1},
+		{"append to fork", "key-1", map[string]string{conversationIDHeader: "branch", conversationAppendHeader: "1"}, []types.AnthropicRequestMessage{user("try again")}, 0, 3},
+		{"role does not continue", "key-1", map[string]string{conversationIDHeader: "branch", conversationAppendHeader: "1"}, []types.AnthropicRequestMessage{{Role: "assistant", Content: "x"}}, http.StatusBadRequest, 1},
+		{"unknown conversation", "key-1", map[string]string{conversationIDHeader: "missing", conversationAppendHeader: "1"}, []types.AnthropicRequestMessage{user("hi")}, http.StatusNotFound, 1},
+		{"other api key", "key-2", map[string]string{conversationIDHeader: "branch", conversationAppendHeader: "1"}, []types.AnthropicRequestMessage{user("hi")}, http.StatusNotFound, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newContext(tt.apiKeyHash, "", tt.headers)
+			req := types.AnthropicRequest{Messages: tt.messages}
+			status := 0
+			if err := expandStoredConversation(c, &req); err != nil {
+				status = err.StatusCode
+			}
+			if status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", status, tt.wantStatus)
+			}
+			if len(req.Messages) != tt.wantLen {
+				t.Errorf("messages = %d, want %d", len(req.Messages), tt.wantLen)
+			}
+		})
+	}
+}
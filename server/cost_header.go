@@ -0,0 +1,33 @@
+package server
+
+import (
+	"strconv"
+
+	"kiro/cache"
+	"kiro/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// costHeader 按价格表估算的本次请求费用（美元）
+const costHeader = "X-Kiro-Cost-USD"
+
+/**
+ * setCostHeader 在写出非流式响应前设置费用响应头
+ * inputTokens 为未命中缓存的输入 token；流式响应在用量确定前已发出响应头，不附带该头，费用见 /v1/usage
+ */
+func setCostHeader(c *gin.Context, model string, inputTokens, outputTokens int, cacheResult *cache.CacheResult) {
+	if !config.Current().CostHeader {
+		return
+	}
+	price, ok := config.Current().PriceFor(model)
+	if !ok {
+		return
+	}
+	var cacheRead, cacheWrite int
+	if cacheResult != nil {
+		cacheRead, cacheWrite = cacheResult.CacheReadTokens, cacheResult.CacheCreationTokens
+	}
+	cost := price.Cost(inputTokens, outputTokens, cacheRead, cacheWrite)
+	c.Header(costHeader, strconv.FormatFloat(cost, 'f', 6, 64))
+}
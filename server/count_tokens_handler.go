@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
 
@@ -10,26 +11,57 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// maxCountTokensBatch 批量计数单次请求允许的最大条目数
+const maxCountTokensBatch = 256
+
 // handleCountTokens 本地实现token计数接口
 // 设计原则：
 // - KISS: 简单高效的估算算法，避免引入复杂的tokenizer库
 // - 向后兼容: 支持所有Claude模型和消息格式
 // - 性能优先: 本地计算，响应时间<5ms
+// 扩展：请求体为数组或包含 requests 数组时按批量计数处理，见 handleCountTokensBatch
 func handleCountTokens(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		if isBodyTooLarge(err) {
+			respondBodyTooLarge(c)
+			return
+		}
+		respondCountTokensError(c, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	// Anthropic 直连时由官方 API 精确计数
+	if anthropicPassthrough(c) {
+		forwardToAnthropic(c, "/v1/messages/count_tokens", body)
+		return
+	}
+
+	if items, isBatch, err := parseCountTokensBatch(body); isBatch {
+		if err != nil {
+			utils.Log("批量token计数请求解析失败",
+				addReqFields(c,
+					utils.LogErr(err),
+				)...)
+			respondCountTokensError(c, err.Error())
+			return
+		}
+		handleCountTokensBatch(c, items)
+		return
+	}
+
 	var req types.CountTokensRequest
 
 	// 解析请求体
-	if err := c.ShouldBindJSON(&req); err != nil {
+	if err := utils.SafeUnmarshal(body, &req); err != nil || req.Model == "" || req.Messages == nil {
+		if err == nil {
+			err = fmt.Errorf("model and messages are required")
+		}
 		utils.Log("token计数请求解析失败",
 			addReqFields(c,
 				utils.LogErr(err),
 			)...)
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": gin.H{
-				"type":    "invalid_request_error",
-				"message": fmt.Sprintf("Invalid request body: %v", err),
-			},
-		})
+		respondCountTokensError(c, fmt.Sprintf("Invalid request body: %v", err))
 		return
 	}
 
@@ -39,12 +71,7 @@ func handleCountTokens(c *gin.Context) {
 			addReqFields(c,
 				utils.LogString("model", req.Model),
 			)...)
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": gin.H{
-				"type":    "invalid_request_error",
-				"message": fmt.Sprintf("Invalid model: %s", req.Model),
-			},
-		})
+		respondCountTokensError(c, fmt.Sprintf("Invalid model: %s", req.Model))
 		return
 	}
 
@@ -52,10 +79,89 @@ func handleCountTokens(c *gin.Context) {
 	estimator := utils.NewTokenEstimator()
 
 	// 计算token数量
-	tokenCount := estimator.EstimateTokens(&req)
+	tokenCount := estimateCountTokens(estimator, &req)
 
 	// 返回符合官方API格式的响应
 	c.JSON(http.StatusOK, types.CountTokensResponse{
 		InputTokens: tokenCount,
 	})
 }
+
+/**
+ * parseCountTokensBatch 识别批量计数请求
+ * 支持两种写法：顶层数组 [{...}, {...}]，或对象 {"requests": [{...}, {...}]}
+ * 返回值 isBatch 为 false 时按单个请求处理
+ */
+func parseCountTokensBatch(body []byte) ([]types.CountTokensRequest, bool, error) {
+	trimmed := bytes.TrimSpace(body)
+	var items []types.CountTokensRequest
+
+	switch {
+	case len(trimmed) > 0 && trimmed[0] == '[':
+		if err := utils.SafeUnmarshal(trimmed, &items); err != nil {
+			return nil, true, fmt.Errorf("Invalid request body: %v", err)
+		}
+	default:
+		var wrapper types.CountTokensBatchRequest
+		if err := utils.SafeUnmarshal(trimmed, &wrapper); err != nil || wrapper.Requests == nil {
+			return nil, false, nil
+		}
+		items = wrapper.Requests
+	}
+
+	if len(items) == 0 {
+		return nil, true, fmt.Errorf("requests must contain at least one item")
+	}
+	if len(items) > maxCountTokensBatch {
+		return nil, true, fmt.Errorf("requests contains %d items, at most %d are allowed", len(items), maxCountTokensBatch)
+	}
+	return items, true, nil
+}
+
+/**
+ * handleCountTokensBatch 批量计数：逐条返回结果和总数
+ * 单条无效（如模型不支持）时该条返回 error，不影响其他条目，总数只累计成功的条目
+ */
+func handleCountTokensBatch(c *gin.Context, items []types.CountTokensRequest) {
+	estimator := utils.NewTokenEstimator()
+	resp := types.CountTokensBatchResponse{
+		Results: make([]types.CountTokensBatchResult, len(items)),
+	}
+
+	for i := range items {
+		item := &items[i]
+		switch {
+		case item.Model == "" || item.Messages == nil:
+			resp.Results[i].Error = &types.CountTokensBatchError{Type: errTypeInvalidRequest, Message: "model and messages are required"}
+		case !utils.IsValidClaudeModel(item.Model):
+			resp.Results[i].Error = &types.CountTokensBatchError{Type: errTypeInvalidRequest, Message: fmt.Sprintf("Invalid model: %s", item.Model)}
+		default:
+			tokens := estimateCountTokens(estimator, item)
+			resp.Results[i].InputTokens = &tokens
+			resp.TotalInputTokens += tokens
+		}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// estimateCountTokens 按实际发送给上游的内容计数，与 /v1/messages 返回的 input_tokens 保持一致
+func estimateCountTokens(estimator *utils.TokenEstimator, req *types.CountTokensRequest) int {
+	return estimateInputTokens(estimator, types.AnthropicRequest{
+		Model:    req.Model,
+		Messages: req.Messages,
+		System:   req.System,
+		Tools:    req.Tools,
+		Thinking: req.Thinking,
+	})
+}
+
+// respondCountTokensError 返回计数接口的参数错误
+func respondCountTokensError(c *gin.Context, message string) {
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error": gin.H{
+			"type":    errTypeInvalidRequest,
+			"message": message,
+		},
+	})
+}
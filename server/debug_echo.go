@@ -0,0 +1,59 @@
+package server
+
+import (
+	"kiro/config"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// debugEchoHeader 请求回显生效策略的请求头
+const debugEchoHeader = "X-Kiro-Debug"
+
+/**
+ * debugEchoEnabled 请求是否要求并被允许回显生效的策略
+ * 租户 key 需在租户配置中设置 allow_debug，非租户 key 需设置 ALLOW_DEBUG_ECHO
+ */
+func debugEchoEnabled(c *gin.Context) bool {
+	if c.GetHeader(debugEchoHeader) != "1" {
+		return false
+	}
+	if profile := GetTenant(c); profile != nil {
+		return profile.AllowDebug
+	}
+	return config.Current().AllowDebugEcho
+}
+
+// debugEcho 构建调试回显对象：生效的路由规则、修复、截断、缓存决策及上游请求标识
+func debugEcho(c *gin.Context) gin.H {
+	policies := utils.AppliedPolicies(c)
+	if policies == nil {
+		policies = []utils.PolicyDecision{}
+	}
+	echo := gin.H{
+		"request_id": GetRequestID(c),
+		"policies":   policies,
+	}
+	for k, v := range upstreamDebugInfo(c) {
+		echo[k] = v
+	}
+	return echo
+}
+
+// writeDebugComment 在流式响应末尾以 SSE 注释行输出调试回显，客户端解析器会忽略注释
+func writeDebugComment(c *gin.Context) {
+	data, err := utils.SafeMarshal(debugEcho(c))
+	if err != nil {
+		return
+	}
+	c.Writer.WriteString(": debug " + string(data) + "\n\n")
+	c.Writer.Flush()
+}
+
+// errorDebugInfo 错误响应中的 debug 字段：允许调试回显时包含完整的策略记录，否则仅包含上游请求标识
+func errorDebugInfo(c *gin.Context) gin.H {
+	if debugEchoEnabled(c) {
+		return debugEcho(c)
+	}
+	return upstreamDebugInfo(c)
+}
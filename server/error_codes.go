@@ -0,0 +1,132 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Anthropic 格式错误响应的 error.type（与官方 API 一致）
+const (
+	errTypeInvalidRequest  = "invalid_request_error"
+	errTypeAuthentication  = "authentication_error"
+	errTypePermission      = "permission_error"
+	errTypeNotFound        = "not_found_error"
+	errTypeRequestTooLarge = "request_too_large"
+	errTypeRateLimit       = "rate_limit_error"
+	errTypeAPI             = "api_error"
+	errTypeOverloaded      = "overloaded_error"
+	errTypeParsing         = "parsing_error"
+)
+
+// 代理标准化错误响应（respondErrorWithCode）的 error.code
+const (
+	errCodeBadRequest   = "bad_request"
+	errCodeUnauthorized = "unauthorized"
+	errCodeForbidden    = "forbidden"
+	errCodeNotFound     = "not_found"
+	errCodeRateLimited  = "rate_limited"
+	errCodeInternal     = "internal_error"
+	errCodeCW           = "cw_error"
+	errCodeUpstream     = "upstream_error"
+)
+
+// 服务端工具（web_search / code_execution）结果中的 error_code
+const (
+	toolErrUnavailable           = "unavailable"
+	toolErrExecutionTimeExceeded = "execution_time_exceeded"
+	toolErrInvalidInput          = "invalid_input"
+	toolErrMaxUsesExceeded       = "max_uses_exceeded"
+)
+
+// 错误码所在的字段
+const (
+	errorKindType       = "type"        // Anthropic 格式响应的 error.type
+	errorKindCode       = "code"        // 标准化错误响应的 error.code
+	errorKindToolResult = "tool_result" // 服务端工具结果块的 error_code（响应本身为 200）
+)
+
+// errorCodeInfo 错误码目录条目
+type errorCodeInfo struct {
+	Code        string `json:"code"`
+	Kind        string `json:"kind"`
+	Status      int    `json:"status,omitempty"` // 典型 HTTP 状态码，工具结果错误为 0
+	Meaning     string `json:"meaning"`
+	Remediation string `json:"remediation"`
+}
+
+// errorCatalog 代理可能返回的全部错误码，GET /errors 原样输出
+// 新增错误码时同步在此登记
+var errorCatalog = []errorCodeInfo{
+	{errTypeInvalidRequest, errorKindType, http.StatusBadRequest,
+		"请求格式或参数无效，包括输入超出上下文窗口（prompt is too long）、工具未启用、模型不在白名单、图片格式或尺寸不符等",
+		"按 message 修正请求；上下文超限时压缩历史或启用 context-1m beta；图片过大时压缩或设置 IMAGE_DOWNSCALE_DIMENSION"},
+	{errTypeAuthentication, errorKindType, http.StatusUnauthorized,
+		"缺少 API Key、格式无法识别，或 refresh token 刷新失败",
+		"检查 x-api-key / Authorization 头和 token 格式；token 失效时重新登录获取"},
+	{errTypePermission, errorKindType, http.StatusForbidden,
+		"API Key 无权访问所请求的模型或功能，或上游账号被拒绝",
+		"使用租户白名单内的模型，或联系管理员调整租户配置"},
+	{errTypeNotFound, errorKindType, http.StatusNotFound,
+		"请求的模型或资源不存在",
+		"通过 GET /v1/models 确认可用的模型名"},
+	{errTypeRequestTooLarge, errorKindType, http.StatusRequestEntityTooLarge,
+		"请求体超过大小上限（REQUEST_BODY_MAX_BYTES）",
+		"减少图片或历史消息后重试"},
+	{errTypeRateLimit, errorKindType, http.StatusTooManyRequests,
+		"触发 API Key 限流、并发上限或上游额度耗尽；响应带 Retry-After 和 retry_after_seconds，额度耗尽时带 quota_reset_at",
+		"等待 retry_after_seconds 后重试，或降低请求频率"},
+	{errTypeAPI, errorKindType, http.StatusInternalServerError,
+		"代理或上游内部错误（含 Bedrock、Anthropic 直连的网络错误）",
+		"稍后重试；持续出现时附带 request-id 反馈"},
+	{errTypeOverloaded, errorKindType, statusOverloaded,
+		"上游过载、首字节超时或并发排队超时，可安全重试",
+		"指数退避后重试"},
+	{errTypeParsing, errorKindType, http.StatusInternalServerError,
+		"无法解析上游的非流式响应",
+		"重试；持续出现时检查日志中的上游响应"},
+	{errCodeBadRequest, errorKindCode, http.StatusBadRequest,
+		"请求体无法读取或解析",
+		"确认请求体为合法 JSON 且符合 Messages API 格式"},
+	{errCodeUnauthorized, errorKindCode, http.StatusUnauthorized,
+		"未通过认证",
+		"检查 API Key"},
+	{errCodeForbidden, errorKindCode, http.StatusForbidden,
+		"上游拒绝访问（403），通常是 token 失效或账号被封禁",
+		"重新获取 refresh token；账号被封禁时更换账号"},
+	{errCodeNotFound, errorKindCode, http.StatusNotFound,
+		"路径不存在（ROOT_MODE=none 的根路径等）",
+		"检查请求路径"},
+	{errCodeRateLimited, errorKindCode, http.StatusTooManyRequests,
+		"请求过于频繁",
+		"降低请求频率后重试"},
+	{errCodeInternal, errorKindCode, http.StatusInternalServerError,
+		"代理内部错误，如构建上游请求失败",
+		"重试；持续出现时附带 request-id 反馈"},
+	{errCodeCW, errorKindCode, http.StatusInternalServerError,
+		"上游 CodeWhisperer 返回了无法映射的错误",
+		"查看 message 中的上游错误；持续出现时检查 token 和账号状态"},
+	{errCodeUpstream, errorKindCode, http.StatusBadGateway,
+		"上游请求失败且没有对应的 Anthropic 错误类型",
+		"重试；携带 X-Kiro-Debug: 1 请求头查看生效的策略"},
+	{toolErrUnavailable, errorKindToolResult, 0,
+		"web_search 搜索失败（MCP 端点或搜索服务出错），或 code_execution 沙箱命令无法启动",
+		"检查 MCP 端点、WEB_SEARCH_PROVIDER 或 CODE_EXECUTION_COMMAND 配置；模型会基于错误继续回答"},
+	{toolErrExecutionTimeExceeded, errorKindToolResult, 0,
+		"code_execution 超过 CODE_EXECUTION_TIMEOUT_SECONDS",
+		"缩短代码运行时间或调大超时"},
+	{toolErrInvalidInput, errorKindToolResult, 0,
+		"模型调用 web_search 时没有给出查询词",
+		"无需处理；模型会基于错误重新搜索或直接回答"},
+	{toolErrMaxUsesExceeded, errorKindToolResult, 0,
+		"服务端工具调用次数超过工具定义中的 max_uses",
+		"调大 max_uses，或接受模型基于已有结果回答"},
+}
+
+// handleErrorCatalog 处理 GET /errors，列出代理可能返回的错误码、含义和处理建议
+func handleErrorCatalog(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   errorCatalog,
+	})
+}
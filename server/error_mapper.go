@@ -150,12 +150,16 @@ func (em *ErrorMapper) sendMaxTokensResponse(c *gin.Context, claudeError *Claude
 
 // sendStandardError 发送标准错误响应 (SRP原则)
 func (em *ErrorMapper) sendStandardError(c *gin.Context, claudeError *ClaudeErrorResponse) {
+	errBody := map[string]any{
+		"type":    errTypeOverloaded,
+		"message": claudeError.Message,
+	}
+	if debug := errorDebugInfo(c); debug != nil {
+		errBody["debug"] = debug
+	}
 	errorResp := map[string]any{
-		"type": "error",
-		"error": map[string]any{
-			"type":    "overloaded_error",
-			"message": claudeError.Message,
-		},
+		"type":  "error",
+		"error": errBody,
 	}
 
 	sender := &AnthropicStreamSender{}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"kiro/lifecycle"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// evalTee 评估旁路：异步将（采样的）请求/响应对转发到外部评估端点
+// 负载采用 Langfuse ingestion API 格式（generation-create），
+// OpenLLMetry 等兼容该格式的后端也可直接接收
+type evalTee struct {
+	url        string
+	auth       string
+	sampleRate float64
+	queue      chan []byte
+	task       *lifecycle.Task
+}
+
+// evalTeeQueueSize 待发送队列长度，队列满时直接丢弃，避免影响客户端延迟
+const evalTeeQueueSize = 256
+
+var evalSink *evalTee
+
+// InitEvalTee 根据环境变量初始化评估旁路
+// EVAL_SINK_URL: 评估端点（如 https://cloud.langfuse.com/api/public/ingestion），为空则禁用
+// EVAL_SINK_AUTH: Authorization 请求头的值（如 Basic base64(pk:sk)）
+// EVAL_SINK_SAMPLE_RATE: 采样率 0~1，默认 1
+func InitEvalTee() {
+	url := os.Getenv("EVAL_SINK_URL")
+	if url == "" {
+		return
+	}
+
+	sampleRate := 1.0
+	if v := os.Getenv("EVAL_SINK_SAMPLE_RATE"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 && f <= 1 {
+			sampleRate = f
+		}
+	}
+
+	evalSink = &evalTee{
+		url:        url,
+		auth:       os.Getenv("EVAL_SINK_AUTH"),
+		sampleRate: sampleRate,
+		queue:      make(chan []byte, evalTeeQueueSize),
+	}
+	evalSink.task = lifecycle.Go("eval-tee", evalSink.run)
+
+	utils.Info("评估旁路已启用 (采样率: %.2f)", sampleRate)
+}
+
+// StopEvalTee 停止评估旁路，已排队的记录发送完后返回
+func StopEvalTee() {
+	if evalSink != nil {
+		evalSink.task.Stop()
+	}
+}
+
+// shouldSampleEval 决定当前请求是否采样到评估旁路
+func shouldSampleEval() bool {
+	if evalSink == nil || evalSink.sampleRate <= 0 {
+		return false
+	}
+	return evalSink.sampleRate >= 1 || rand.Float64() < evalSink.sampleRate
+}
+
+// evalRecord 一次请求/响应对
+type evalRecord struct {
+	Request      types.AnthropicRequest
+	Content      []any
+	StopReason   string
+	InputTokens  int
+	OutputTokens int
+	StartTime    time.Time
+	EndTime      time.Time
+	Stream       bool
+	Attributes   map[string]any // GenAI 语义约定属性，合并到 metadata
+}
+
+// submitEval 异步提交评估记录，不阻塞调用方
+func submitEval(c *gin.Context, rec evalRecord) {
+	if evalSink == nil {
+		return
+	}
+
+	traceID := GetRequestID(c)
+	if traceID == "" {
+		traceID = utils.GenerateUUID()
+	}
+
+	generationID := GetMessageID(c)
+	if generationID == "" {
+		generationID = utils.GenerateUUID()
+	}
+
+	input := map[string]any{"messages": rec.Request.Messages}
+	if len(rec.Request.System) > 0 {
+		input["system"] = rec.Request.System
+	}
+	if len(rec.Request.Tools) > 0 {
+		input["tools"] = rec.Request.Tools
+	}
+
+	metadata := map[string]any{
+		"stream":      rec.Stream,
+		"stop_reason": rec.StopReason,
+	}
+	for k, v := range rec.Attributes {
+		metadata[k] = v
+	}
+	if profile := GetTenant(c); profile != nil {
+		metadata["tenant"] = profile.Name
+	}
+
+	body := map[string]any{
+		"batch": []any{
+			map[string]any{
+				"id":        utils.GenerateUUID(),
+				"type":      "generation-create",
+				"timestamp": rec.EndTime.UTC().Format(time.RFC3339Nano),
+				"body": map[string]any{
+					"id":        generationID,
+					"traceId":   traceID,
+					"name":      "kiro.messages",
+					"model":     rec.Request.Model,
+					"input":     input,
+					"output":    map[string]any{"role": "assistant", "content": rec.Content},
+					"startTime": rec.StartTime.UTC().Format(time.RFC3339Nano),
+					"endTime":   rec.EndTime.UTC().Format(time.RFC3339Nano),
+					"usage": map[string]any{
+						"input":  rec.InputTokens,
+						"output": rec.OutputTokens,
+						"unit":   "TOKENS",
+					},
+					"metadata": metadata,
+				},
+			},
+		},
+	}
+
+	data, err := utils.SafeMarshal(body)
+	if err != nil {
+		return
+	}
+
+	select {
+	case evalSink.queue <- data:
+	default:
+		utils.Debug("评估旁路队列已满，丢弃记录")
+	}
+}
+
+// run 后台发送协程，逐条发送队列中的记录；退出时发送已排队的记录后结束
+func (t *evalTee) run(ctx context.Context) {
+	for {
+		select {
+		case data := <-t.queue:
+			t.send(data)
+		case <-ctx.Done():
+			for {
+				select {
+				case data := <-t.queue:
+					t.send(data)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (t *evalTee) send(data []byte) {
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.auth != "" {
+		req.Header.Set("Authorization", t.auth)
+	}
+
+	resp, err := utils.DoRequest(req)
+	if err != nil {
+		utils.Debug("评估旁路发送失败: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		utils.Debug("评估旁路返回状态码 %d", resp.StatusCode)
+	}
+}
+
+// recordingSender 记录已发送给客户端的流式内容，用于重建完整响应
+type recordingSender struct {
+	StreamEventSender
+	blocks     map[int]map[string]any
+	order      []int
+	partials   map[int]*strings.Builder
+	stopReason string
+}
+
+func newRecordingSender(inner StreamEventSender) *recordingSender {
+	return &recordingSender{
+		StreamEventSender: inner,
+		blocks:            make(map[int]map[string]any),
+		partials:          make(map[int]*strings.Builder),
+	}
+}
+
+// SendEvent 记录事件后交给内部发送器
+func (s *recordingSender) SendEvent(c *gin.Context, data any) error {
+	if m, ok := data.(map[string]any); ok {
+		s.record(m)
+	}
+	return s.StreamEventSender.SendEvent(c, data)
+}
+
+func (s *recordingSender) record(m map[string]any) {
+	eventType, _ := m["type"].(string)
+	index := extractIndex(m)
+
+	switch eventType {
+	case "content_block_start":
+		cb, _ := m["content_block"].(map[string]any)
+		block := map[string]any{}
+		for k, v := range cb {
+			block[k] = v
+		}
+		if _, exists := s.blocks[index]; !exists {
+			s.order = append(s.order, index)
+		}
+		s.blocks[index] = block
+	case "content_block_delta":
+		block, ok := s.blocks[index]
+		if !ok {
+			return
+		}
+		delta, _ := m["delta"].(map[string]any)
+		switch deltaType, _ := delta["type"].(string); deltaType {
+		case "text_delta":
+			text, _ := delta["text"].(string)
+			prev, _ := block["text"].(string)
+			block["text"] = prev + text
+		case "thinking_delta":
+			thinking, _ := delta["thinking"].(string)
+			prev, _ := block["thinking"].(string)
+			block["thinking"] = prev + thinking
+		case "signature_delta":
+			block["signature"], _ = delta["signature"].(string)
+		case "input_json_delta":
+			partial, _ := delta["partial_json"].(string)
+			if s.partials[index] == nil {
+				s.partials[index] = &strings.Builder{}
+			}
+			s.partials[index].WriteString(partial)
+		}
+	case "message_delta":
+		if delta, ok := m["delta"].(map[string]any); ok {
+			if reason, ok := delta["stop_reason"].(string); ok {
+				s.stopReason = reason
+			}
+		}
+	}
+}
+
+// Content 返回重建后的 content 数组
+func (s *recordingSender) Content() []any {
+	content := make([]any, 0, len(s.order))
+	for _, index := range s.order {
+		block := s.blocks[index]
+		if partial, ok := s.partials[index]; ok && partial.Len() > 0 {
+			var input any
+			if err := utils.SafeUnmarshal([]byte(partial.String()), &input); err == nil {
+				block["input"] = input
+			}
+		}
+		content = append(content, block)
+	}
+	return content
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"kiro/config"
+	"kiro/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * 流式事件拦截链
+ * 位于流处理器（SSEStateManager 校验之后）和发送器之间，对下发给客户端的事件做横切处理
+ * （增量合并、脱敏、模型名改写、用量注入等），各功能以拦截器的形式组合，而不是各自修改流处理器。
+ * 拦截器按 eventInterceptorFactories 的顺序执行，越靠后越接近客户端；
+ * 需要暂存事件的拦截器实现 eventBatchFlusher，在每批上游数据处理完后及下发其他事件前交出暂存的事件
+ */
+
+// EventEmitter 将事件交给链中的下一环
+type EventEmitter func(event map[string]any) error
+
+// EventInterceptor 事件拦截器：可修改、丢弃、拆分或暂存事件，调用 next 继续下发
+type EventInterceptor interface {
+	Intercept(c *gin.Context, event map[string]any, next EventEmitter) error
+}
+
+// eventBatchFlusher 暂存事件的拦截器实现此接口，每批上游数据处理完后调用
+type eventBatchFlusher interface {
+	FlushBatch(c *gin.Context, next EventEmitter) error
+}
+
+// eventInterceptorFactory 按请求创建拦截器，不适用于该请求时返回 nil
+type eventInterceptorFactory func(c *gin.Context, req types.AnthropicRequest) EventInterceptor
+
+// eventInterceptorFactories 拦截链的组成，新增的横切功能在此登记
+var eventInterceptorFactories = []eventInterceptorFactory{
+	newTTFTObserver,
+	newDeltaCoalescer,
+}
+
+// eventPipeline 经拦截链下发事件的发送器
+// 只有 map 形式的事件经过拦截链；SendError 等发送器自行构造的事件直接下发
+type eventPipeline struct {
+	StreamEventSender
+	interceptors []EventInterceptor
+}
+
+// newEventPipeline 为请求组装拦截链，没有适用的拦截器时直接返回原发送器
+func newEventPipeline(c *gin.Context, req types.AnthropicRequest, sender StreamEventSender) StreamEventSender {
+	var interceptors []EventInterceptor
+	for _, factory := range eventInterceptorFactories {
+		if interceptor := factory(c, req); interceptor != nil {
+			interceptors = append(interceptors, interceptor)
+		}
+	}
+	if len(interceptors) == 0 {
+		return sender
+	}
+	return &eventPipeline{StreamEventSender: sender, interceptors: interceptors}
+}
+
+// SendEvent 事件依次经过各拦截器后交给发送器
+func (p *eventPipeline) SendEvent(c *gin.Context, data any) error {
+	event, ok := data.(map[string]any)
+	if !ok {
+		return p.StreamEventSender.SendEvent(c, data)
+	}
+	return p.emitFrom(c, 0, event)
+}
+
+// FlushBatch 按顺序交出各拦截器暂存的事件，前面拦截器交出的事件仍经过后面的拦截器
+func (p *eventPipeline) FlushBatch(c *gin.Context) error {
+	for i, interceptor := range p.interceptors {
+		flusher, ok := interceptor.(eventBatchFlusher)
+		if !ok {
+			continue
+		}
+		if err := flusher.FlushBatch(c, p.nextAfter(c, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *eventPipeline) emitFrom(c *gin.Context, i int, event map[string]any) error {
+	if i == len(p.interceptors) {
+		return p.StreamEventSender.SendEvent(c, event)
+	}
+	return p.interceptors[i].Intercept(c, event, p.nextAfter(c, i))
+}
+
+func (p *eventPipeline) nextAfter(c *gin.Context, i int) EventEmitter {
+	return func(event map[string]any) error {
+		return p.emitFrom(c, i+1, event)
+	}
+}
+
+// flushEventBatch 一批上游数据处理完后交出拦截链暂存的事件并刷新响应
+func flushEventBatch(c *gin.Context, sender StreamEventSender) {
+	if p, ok := sender.(*eventPipeline); ok {
+		_ = p.FlushBatch(c)
+	}
+	c.Writer.Flush()
+}
+
+// coalescedDeltaFields 可合并的增量类型及其内容字段
+var coalescedDeltaFields = map[string]string{
+	"text_delta":       "text",
+	"thinking_delta":   "thinking",
+	"input_json_delta": "partial_json",
+}
+
+/**
+ * deltaCoalescer 将同一内容块相邻的同类增量合并为一个 content_block_delta
+ * 只合并同一批上游数据中的事件（批次结束即交出），不增加首字延迟；
+ * 上游把文本切得很碎时可显著减少事件数和客户端的渲染次数
+ */
+type deltaCoalescer struct {
+	pending map[string]any // 暂存的 content_block_delta，nil 表示没有
+	field   string         // 暂存增量的内容字段
+}
+
+func newDeltaCoalescer(c *gin.Context, req types.AnthropicRequest) EventInterceptor {
+	if !config.Current().SSECoalesceDeltas {
+		return nil
+	}
+	return &deltaCoalescer{}
+}
+
+// Intercept 可合并的增量先暂存，遇到其他事件时先交出暂存的增量
+func (d *deltaCoalescer) Intercept(c *gin.Context, event map[string]any, next EventEmitter) error {
+	field, mergeable := d.deltaField(event)
+	if mergeable && d.pending != nil && d.field == field && extractIndex(d.pending) == extractIndex(event) {
+		delta := d.pending["delta"].(map[string]any)
+		text, _ := delta[field].(string)
+		more, _ := event["delta"].(map[string]any)[field].(string)
+		delta[field] = text + more
+		return nil
+	}
+
+	if err := d.FlushBatch(c, next); err != nil {
+		return err
+	}
+	if mergeable {
+		d.pending = copyDeltaEvent(event)
+		d.field = field
+		return nil
+	}
+	return next(event)
+}
+
+// FlushBatch 交出暂存的增量
+func (d *deltaCoalescer) FlushBatch(c *gin.Context, next EventEmitter) error {
+	if d.pending == nil {
+		return nil
+	}
+	pending := d.pending
+	d.pending = nil
+	return next(pending)
+}
+
+// deltaField 返回可合并增量的内容字段
+func (d *deltaCoalescer) deltaField(event map[string]any) (string, bool) {
+	if eventType, _ := event["type"].(string); eventType != "content_block_delta" {
+		return "", false
+	}
+	delta, ok := event["delta"].(map[string]any)
+	if !ok {
+		return "", false
+	}
+	deltaType, _ := delta["type"].(string)
+	field, ok := coalescedDeltaFields[deltaType]
+	if !ok {
+		return "", false
+	}
+	if _, isString := delta[field].(string); !isString {
+		return "", false
+	}
+	return field, true
+}
+
+// copyDeltaEvent 复制增量事件，合并时不修改调用方持有的 map
+func copyDeltaEvent(event map[string]any) map[string]any {
+	out := make(map[string]any, len(event))
+	for k, v := range event {
+		out[k] = v
+	}
+	delta := event["delta"].(map[string]any)
+	deltaCopy := make(map[string]any, len(delta))
+	for k, v := range delta {
+		deltaCopy[k] = v
+	}
+	out["delta"] = deltaCopy
+	return out
+}
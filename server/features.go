@@ -0,0 +1,29 @@
+package server
+
+import (
+	"strings"
+
+	"kiro/config"
+)
+
+// 可选子系统名称，用于 DISABLED_FEATURES 运行时开关
+const (
+	featureMCP    = "mcp"
+	featureOpenAI = "openai"
+)
+
+func parseDisabledFeatures(value string) map[string]bool {
+	disabled := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			disabled[name] = true
+		}
+	}
+	return disabled
+}
+
+// featureEnabled 子系统是否在运行时启用
+// 编译期已通过 build tag 移除的子系统由各自的 stub 处理，不经过此判断
+func featureEnabled(name string) bool {
+	return !parseDisabledFeatures(config.Current().DisabledFeatures)[name]
+}
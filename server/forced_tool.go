@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"kiro/converter"
+	"kiro/parser"
+	"kiro/types"
+)
+
+/**
+ * 强制工具调用校验
+ * 上游不支持 tool_choice，客户端要求必须调用工具（"any" 或 {"type":"tool"}）时转换器会在系统提示中注入调用指令，
+ * 但模型仍可能直接回复文本，而下游 Agent 通常假定强制调用一定发生。非流式响应缺少要求的 tool_use 时
+ * 在客户端系统提示末尾再追加一次指令重试，仍未调用则返回错误；流式响应已开始下发无法重试，以 error 事件结束
+ */
+
+// forcedToolSatisfied 已调用的工具是否满足强制要求，name 为空时任意工具均可
+func forcedToolSatisfied(name string, called []string) bool {
+	for _, tool := range called {
+		if name == "" || tool == name {
+			return true
+		}
+	}
+	return false
+}
+
+// toolNames 返回解析出的工具调用名称
+func toolNames(tools []*parser.ToolExecution) []string {
+	names := make([]string, 0, len(tools))
+	for _, tool := range tools {
+		names = append(names, tool.Name)
+	}
+	return names
+}
+
+// withForcedToolInstruction 在系统提示末尾追加必须调用工具的指令，不修改原请求的系统提示
+func withForcedToolInstruction(req types.AnthropicRequest, name string) types.AnthropicRequest {
+	system := make(types.SystemMessages, len(req.System), len(req.System)+1)
+	copy(system, req.System)
+	req.System = append(system, types.AnthropicSystemMessage{
+		Type: "text",
+		Text: fmt.Sprintf("You MUST respond by calling %s. Do not reply with plain text only.", converter.ForcedToolTarget(name)),
+	})
+	return req
+}
+
+// forcedToolError 上游未按 tool_choice 调用工具时返回给客户端的错误
+func forcedToolError(name string) *UpstreamError {
+	return &UpstreamError{
+		StatusCode: http.StatusBadGateway,
+		Type:       errTypeAPI,
+		Message:    fmt.Sprintf("tool_choice requires calling %s, but the upstream model replied without it", converter.ForcedToolTarget(name)),
+	}
+}
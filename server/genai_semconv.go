@@ -0,0 +1,86 @@
+package server
+
+import (
+	"time"
+
+	"kiro/cache"
+	"kiro/config"
+	"kiro/tenant"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// genAICompletion 一次请求完成时的统计信息
+type genAICompletion struct {
+	Request      types.AnthropicRequest
+	ResponseID   string
+	FinishReason string
+	InputTokens  int
+	OutputTokens int
+	CacheResult  *cache.CacheResult
+	StartTime    time.Time
+	Stream       bool
+}
+
+// genAIAttributes 按 OpenTelemetry GenAI 语义约定构建属性集合
+// 参考: https://opentelemetry.io/docs/specs/semconv/gen-ai/gen-ai-spans/
+func genAIAttributes(c *gin.Context, comp genAICompletion) map[string]any {
+	attrs := map[string]any{
+		"gen_ai.operation.name":          "chat",
+		"gen_ai.provider.name":           "anthropic",
+		"gen_ai.system":                  "anthropic",
+		"gen_ai.request.model":           comp.Request.Model,
+		"gen_ai.response.model":          comp.Request.Model,
+		"gen_ai.usage.input_tokens":      comp.InputTokens,
+		"gen_ai.usage.output_tokens":     comp.OutputTokens,
+		"gen_ai.response.finish_reasons": []string{comp.FinishReason},
+		"kiro.stream":                    comp.Stream,
+		"kiro.duration_ms":               time.Since(comp.StartTime).Milliseconds(),
+	}
+	if comp.ResponseID != "" {
+		attrs["gen_ai.response.id"] = comp.ResponseID
+	}
+	if comp.Request.MaxTokens > 0 {
+		attrs["gen_ai.request.max_tokens"] = comp.Request.MaxTokens
+	}
+	if comp.Request.Temperature != nil {
+		attrs["gen_ai.request.temperature"] = *comp.Request.Temperature
+	}
+	if comp.Request.TopP != nil {
+		attrs["gen_ai.request.top_p"] = *comp.Request.TopP
+	}
+	if comp.Request.TopK != nil {
+		attrs["gen_ai.request.top_k"] = *comp.Request.TopK
+	}
+	if comp.CacheResult != nil {
+		attrs["gen_ai.usage.cache_read.input_tokens"] = comp.CacheResult.CacheReadTokens
+		attrs["gen_ai.usage.cache_creation.input_tokens"] = comp.CacheResult.CacheCreationTokens
+	}
+	if rid := GetRequestID(c); rid != "" {
+		attrs["kiro.request_id"] = rid
+	}
+	if profile := GetTenant(c); profile != nil {
+		attrs["kiro.tenant"] = profile.Name
+	}
+	if labels := GetAccountLabels(c); !labels.IsZero() {
+		attrs["kiro.account.owner"] = labels.Owner
+		attrs["kiro.account.tier"] = labels.Tier
+		attrs["kiro.account.region"] = labels.Region
+	}
+	return attrs
+}
+
+// logGenAICompletion 输出 GenAI 语义约定格式的完成日志
+func logGenAICompletion(c *gin.Context, comp genAICompletion) {
+	if !config.Current().GenAISemconvLog || logPolicy(c) == tenant.LogPolicyOff {
+		return
+	}
+
+	data, err := utils.SafeMarshal(genAIAttributes(c, comp))
+	if err != nil {
+		return
+	}
+	utils.Info("[GenAI] %s", data)
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -10,8 +11,11 @@ import (
 
 	"kiro/cache"
 	"kiro/config"
+	"kiro/converter"
 
 	"kiro/parser"
+	"kiro/tenant"
+	"kiro/tracing"
 	"kiro/types"
 	"kiro/utils"
 
@@ -57,25 +61,34 @@ func handleStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest, to
 
 // handleGenericStreamRequest 通用流式请求处理
 func handleGenericStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest, token types.TokenInfo, sender StreamEventSender, eventCreator func(string, int, string, *cache.CacheResult) []map[string]any) {
+	startTime := time.Now()
+	c.Set(streamStartKey, startTime)
+
 	// 计算输入tokens（基于实际发送给上游的数据）
-	estimator := utils.NewTokenEstimator()
-	countReq := &types.CountTokensRequest{
-		Model:    anthropicReq.Model,
-		System:   anthropicReq.System,
-		Messages: anthropicReq.Messages,
-		Tools:    filterSupportedTools(anthropicReq.Tools), // 过滤不支持的工具后计算
+	inputTokens := estimateInputTokens(utils.NewTokenEstimator(), anthropicReq)
+	if upstreamErr := checkContextWindow(c, inputTokens); upstreamErr != nil {
+		respondAnthropicError(c, upstreamErr)
+		return
+	}
+	clampThinkingBudget(c, &anthropicReq, inputTokens)
+
+	// 获取并发额度（已满时排队），整个响应结束后释放
+	releaseSlot, slotErr := acquireConcurrencySlot(c)
+	if slotErr != nil {
+		respondAnthropicError(c, slotErr)
+		return
 	}
-	inputTokens := estimator.EstimateTokens(countReq)
+	defer releaseSlot()
 
 	// 执行缓存处理
-	cacheResult := cache.ProcessRequest(anthropicReq, inputTokens)
+	cacheResult := processCache(c, anthropicReq, inputTokens)
 
 	// 生成消息ID并注入上下文
 	messageID := fmt.Sprintf(config.MessageIDFormat, utils.GenerateBase62ID(22))
 	c.Set("message_id", messageID)
 
 	// 先执行上游请求，确保成功后再建立 SSE 连接
-	resp, err := execCWRequest(c, anthropicReq, token, true)
+	resp, err := upstreamClientOf(c).Execute(c, anthropicReq, token, true)
 	if err != nil {
 		var modelNotFoundErrorType *types.ModelNotFoundErrorType
 		if errors.As(err, &modelNotFoundErrorType) {
@@ -83,8 +96,12 @@ func handleGenericStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequ
 		}
 		// 上游请求失败，返回 HTTP 错误（不建立 SSE 连接）
 		var upstreamErr *UpstreamError
-		if errors.As(err, &upstreamErr) {
-			respondErrorWithCode(c, upstreamErr.StatusCode, "upstream_error", "%s", upstreamErr.Message)
+		if errors.As(err, &upstreamErr) && upstreamErr.Handled {
+			return
+		} else if upstreamErr != nil && upstreamErr.Type != "" {
+			respondAnthropicError(c, upstreamErr)
+		} else if upstreamErr != nil {
+			respondErrorWithCode(c, upstreamErr.StatusCode, errCodeUpstream, "%s", upstreamErr.Message)
 		} else {
 			respondError(c, http.StatusBadGateway, "%s", err.Error())
 		}
@@ -99,6 +116,17 @@ func handleGenericStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequ
 		return
 	}
 
+	// 采样到评估旁路时，记录下发内容用于重建完整响应
+	// 同时用于请求记录（回放）和会话状态保存
+	sampled := shouldSampleEval()
+	var recorder *recordingSender
+	if sampled || requestLogEnabled() || conversationStoreOf(c).tracks(c) {
+		recorder = newRecordingSender(sender)
+		sender = recorder
+	}
+	// 事件拦截链位于记录器之外，记录的是客户端实际收到的内容
+	sender = newEventPipeline(c, anthropicReq, sender)
+
 	// 创建流处理上下文
 	ctx := NewStreamProcessorContext(c, anthropicReq, token, sender, messageID, inputTokens, cacheResult)
 	defer ctx.Cleanup()
@@ -110,19 +138,82 @@ func handleGenericStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequ
 
 	// 处理事件流
 	processor := NewEventStreamProcessor(ctx)
-	if err := processor.ProcessEventStream(resp.Body); err != nil {
+	// 命中停止序列时提前结束读取上游，按正常完成处理
+	if err := processor.ProcessEventStream(resp.Body); err != nil && !errors.Is(err, errStopSequenceMatched) {
+		if errors.Is(err, errClientDisconnected) {
+			// 上游已生成的部分仍计入用量
+			recordTokenUsage(c, inputTokens, ctx.totalOutputTokens)
+			recordCacheResult(c, cacheResult)
+			return
+		}
+		if errors.Is(err, errStreamIdle) {
+			ctx.sendIdleTimeoutEvents()
+			recordTokenUsage(c, inputTokens, ctx.totalOutputTokens)
+			recordCacheResult(c, cacheResult)
+			return
+		}
 		utils.Log("事件流处理失败", utils.LogErr(err))
 		return
 	}
 
+	// tool_choice 要求强制调用工具但上游直接回复文本：内容已下发无法重试，以 error 事件结束，
+	// 避免客户端把纯文本回复当作已完成的工具调用
+	if toolName, forced := converter.ForcedToolChoice(anthropicReq.ToolChoice); forced && !forcedToolSatisfied(toolName, ctx.calledToolNames) && ctx.stopSequences.Matched() == "" {
+		upstreamErr := forcedToolError(toolName)
+		utils.RecordPolicy(c, "forced_tool", "tool_choice requires %s; upstream replied without it", converter.ForcedToolTarget(toolName))
+		utils.Log("上游未按 tool_choice 调用工具", addReqFields(c, utils.LogString("tool", toolName))...)
+		_ = ctx.sender.SendEvent(c, map[string]any{
+			"type":  "error",
+			"error": map[string]any{"type": upstreamErr.Type, "message": upstreamErr.Message},
+		})
+		recordTokenUsage(c, inputTokens, ctx.totalOutputTokens)
+		return
+	}
+
 	// 发送结束事件
 	if err := ctx.sendFinalEvents(); err != nil {
 		utils.Log("发送结束事件失败", utils.LogErr(err))
 		return
 	}
+	if debugEchoEnabled(c) {
+		writeDebugComment(c)
+	}
 
 	// 日志输出缓存统计
-	logCacheResult(cacheResult, inputTokens, ctx.totalOutputTokens, true)
+	logCacheResult(c, cacheResult, inputTokens, ctx.totalOutputTokens, true)
+	recordCacheResult(c, cacheResult)
+
+	completion := genAICompletion{
+		Request:      anthropicReq,
+		ResponseID:   messageID,
+		FinishReason: ctx.finalStopReason,
+		InputTokens:  inputTokens,
+		OutputTokens: ctx.totalOutputTokens,
+		CacheResult:  cacheResult,
+		StartTime:    startTime,
+		Stream:       true,
+	}
+	logGenAICompletion(c, completion)
+	recordTokenUsage(c, completion.InputTokens, completion.OutputTokens)
+
+	if recorder != nil {
+		rec := evalRecord{
+			Request:      anthropicReq,
+			Content:      recorder.Content(),
+			StopReason:   recorder.stopReason,
+			InputTokens:  inputTokens,
+			OutputTokens: ctx.totalOutputTokens,
+			StartTime:    startTime,
+			EndTime:      time.Now(),
+			Stream:       true,
+			Attributes:   genAIAttributes(c, completion),
+		}
+		if sampled {
+			submitEval(c, rec)
+		}
+		recordRequest(c, rec)
+		recordConversation(c, rec)
+	}
 }
 
 // createAnthropicStreamEvents 创建Anthropic流式初始事件
@@ -180,7 +271,8 @@ func createAnthropicStreamEvents(messageId string, inputTokens int, model string
 }
 
 // createAnthropicFinalEvents 创建Anthropic流式结束事件
-func createAnthropicFinalEvents(outputTokens, inputTokens int, stopReason string, cacheResult *cache.CacheResult) []map[string]any {
+// stopSequence 为命中的停止序列，未命中时为空（下发 null）
+func createAnthropicFinalEvents(outputTokens, inputTokens, overheadTokens int, stopReason, stopSequence string, cacheResult *cache.CacheResult) []map[string]any {
 	// 计算实际 input_tokens（扣除 cache_read 和 cache_creation）
 	actualInputTokens := inputTokens
 	if cacheResult != nil {
@@ -203,13 +295,14 @@ func createAnthropicFinalEvents(outputTokens, inputTokens int, stopReason string
 			"type": "message_delta",
 			"delta": map[string]any{
 				"stop_reason":   stopReason,
-				"stop_sequence": nil,
+				"stop_sequence": stopSequenceValue(stopSequence),
 			},
 			"usage": map[string]any{
-				"input_tokens":  actualInputTokens,
-				"output_tokens": outputTokens,
-				"service_tier":  "standard",
-				"inference_geo": "not_available",
+				"input_tokens":          actualInputTokens,
+				"output_tokens":         outputTokens,
+				"service_tier":          "standard",
+				"inference_geo":         "not_available",
+				"proxy_overhead_tokens": overheadTokens,
 			},
 		},
 		{
@@ -222,88 +315,45 @@ func createAnthropicFinalEvents(outputTokens, inputTokens int, stopReason string
 
 // handleNonStreamRequest 处理非流式请求
 func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest, token types.TokenInfo) {
+	startTime := time.Now()
+
 	// 计算输入tokens（基于实际发送给上游的数据）
 	estimator := utils.NewTokenEstimator()
-	countReq := &types.CountTokensRequest{
-		Model:    anthropicReq.Model,
-		System:   anthropicReq.System,
-		Messages: anthropicReq.Messages,
-		Tools:    filterSupportedTools(anthropicReq.Tools), // 过滤不支持的工具后计算
-	}
-	inputTokens := estimator.EstimateTokens(countReq)
-
-	// 执行缓存处理
-	cacheResult := cache.ProcessRequest(anthropicReq, inputTokens)
-
-	resp, err := executeCodeWhispererRequest(c, anthropicReq, token, false)
-	if err != nil {
+	inputTokens := estimateInputTokens(estimator, anthropicReq)
+	if upstreamErr := checkContextWindow(c, inputTokens); upstreamErr != nil {
+		respondAnthropicError(c, upstreamErr)
 		return
 	}
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(resp.Body)
+	clampThinkingBudget(c, &anthropicReq, inputTokens)
 
-	// 读取响应体
-	body, err := utils.ReadHTTPResponse(resp.Body)
-	if err != nil {
-		handleResponseReadError(c, err)
+	// 获取并发额度（已满时排队），整个响应结束后释放
+	releaseSlot, slotErr := acquireConcurrencySlot(c)
+	if slotErr != nil {
+		respondAnthropicError(c, slotErr)
 		return
 	}
+	defer releaseSlot()
 
-	// 使用新的符合AWS规范的解析器，但在非流式模式下增加超时保护
-	compliantParser := parser.NewCompliantEventStreamParser()
-	compliantParser.SetMaxErrors(config.ParserMaxErrors) // 限制最大错误次数以防死循环
-
-	// 为非流式解析添加超时保护
-	result, err := func() (*parser.ParseResult, error) {
-		done := make(chan struct{})
-		var result *parser.ParseResult
-		var err error
-
-		go func() {
-			defer func() {
-				if r := recover(); r != nil {
-					err = fmt.Errorf("解析器panic: %v", r)
-				}
-				close(done)
-			}()
-			result, err = compliantParser.ParseResponse(body)
-		}()
-
-		select {
-		case <-done:
-			return result, err
-		case <-time.After(600 * time.Second): // 600秒超时
-			utils.Log("非流式解析超时")
-			return nil, fmt.Errorf("解析超时")
-		}
-	}()
+	// 执行缓存处理
+	cacheResult := processCache(c, anthropicReq, inputTokens)
 
-	if err != nil {
-		utils.Log("非流式解析失败",
-			utils.LogErr(err),
-			utils.LogString("model", anthropicReq.Model),
-			utils.LogInt("response_size", len(body)))
+	result, allTools, ok := fetchNonStreamResponse(c, anthropicReq, token)
+	if !ok {
+		return
+	}
 
-		// 提供更详细的错误信息和建议
-		errorResp := gin.H{
-			"error":   "响应解析失败",
-			"type":    "parsing_error",
-			"message": "无法解析AWS CodeWhisperer响应格式",
+	// tool_choice 要求强制调用工具但上游直接回复文本时，追加明确指令重试一次
+	if toolName, forced := converter.ForcedToolChoice(anthropicReq.ToolChoice); forced && !forcedToolSatisfied(toolName, toolNames(allTools)) {
+		utils.RecordPolicy(c, "forced_tool", "tool_choice requires %s; upstream replied without it, retrying with explicit instruction", converter.ForcedToolTarget(toolName))
+		result, allTools, ok = fetchNonStreamResponse(c, withForcedToolInstruction(anthropicReq, toolName), token)
+		if !ok {
+			return
 		}
-
-		// 根据错误类型提供不同的HTTP状态码
-		statusCode := http.StatusInternalServerError
-		if strings.Contains(err.Error(), "解析超时") {
-			statusCode = http.StatusRequestTimeout
-			errorResp["message"] = "请求处理超时，请稍后重试"
-		} else if strings.Contains(err.Error(), "格式错误") {
-			statusCode = http.StatusBadRequest
-			errorResp["message"] = "请求格式不正确"
+		if !forcedToolSatisfied(toolName, toolNames(allTools)) {
+			utils.Log("上游未按 tool_choice 调用工具", addReqFields(c, utils.LogString("tool", toolName))...)
+			respondAnthropicError(c, forcedToolError(toolName))
+			return
 		}
-
-		c.JSON(statusCode, errorResp)
-		return
 	}
 
 	// 转换为Anthropic格式
@@ -313,20 +363,6 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 	// 检查是否启用了 thinking 模式
 	thinkingEnabled := anthropicReq.Thinking != nil && anthropicReq.Thinking.Type == "enabled"
 
-	// 先获取工具管理器的所有工具，确保sawToolUse的判断基于实际工具
-	toolManager := compliantParser.GetToolManager()
-	allTools := make([]*parser.ToolExecution, 0)
-
-	// 获取活跃工具
-	for _, tool := range toolManager.GetActiveTools() {
-		allTools = append(allTools, tool)
-	}
-
-	// 获取已完成工具
-	for _, tool := range toolManager.GetCompletedTools() {
-		allTools = append(allTools, tool)
-	}
-
 	// 基于实际工具数量判断是否包含工具调用
 	sawToolUse := len(allTools) > 0
 
@@ -338,6 +374,8 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 	// 	)...)
 
 	// 添加文本内容（如果启用 thinking 模式，需要提取 thinking 块）
+	// 文本命中停止序列时截断在停止序列之前
+	var stopSequence string
 	if textAgg != "" {
 		if thinkingEnabled {
 			// 提取 thinking 内容
@@ -350,12 +388,13 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 					contexts = append(contexts, &types.SSEThinkingContentBlock{
 						Type:      "thinking",
 						Thinking:  mergedThinking,
-						Signature: GenerateFakeSignature(len(mergedThinking)),
+						Signature: SignThinking(mergedThinking),
 					})
 				}
 			}
 
 			// 添加清理后的文本（如果有）
+			cleanText, stopSequence = applyStopSequences(cleanText, anthropicReq.StopSequences)
 			if cleanText != "" {
 				contexts = append(contexts, map[string]any{
 					"type": "text",
@@ -364,13 +403,23 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 			}
 		} else {
 			// 非 thinking 模式，直接添加文本
-			contexts = append(contexts, map[string]any{
-				"type": "text",
-				"text": textAgg,
-			})
+			var text string
+			text, stopSequence = applyStopSequences(textAgg, anthropicReq.StopSequences)
+			if text != "" {
+				contexts = append(contexts, map[string]any{
+					"type": "text",
+					"text": text,
+				})
+			}
 		}
 	}
 
+	// 命中停止序列后模型不会再调用工具
+	if stopSequence != "" {
+		allTools = nil
+		sawToolUse = false
+	}
+
 	// 添加工具调用
 	// 工具已经在前面从toolManager获取到allTools中
 	// utils.Log("从工具生命周期管理器获取工具调用",
@@ -459,6 +508,11 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 
 	stopReasonManager.UpdateToolCallStatus(sawToolUse, sawToolUse)
 	stopReason := stopReasonManager.DetermineStopReason()
+	if stopSequence != "" {
+		stopReason = "stop_sequence"
+	} else if c.GetBool(partialResponseKey) {
+		stopReason = partialStopReason
+	}
 
 	// utils.Log("非流式响应stop_reason决策",
 	// 	utils.LogString("stop_reason", stopReason),
@@ -483,6 +537,7 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 		"output_tokens":                 outputTokens,
 		"service_tier":                  "standard",
 		"inference_geo":                 "not_available",
+		"proxy_overhead_tokens":         proxyOverheadTokens(c, anthropicReq),
 		"cache_creation": map[string]int{
 			"ephemeral_5m_input_tokens": 0,
 			"ephemeral_1h_input_tokens": 0,
@@ -497,32 +552,177 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 		}
 	}
 
+	responseID := fmt.Sprintf(config.MessageIDFormat, utils.GenerateBase62ID(22))
 	anthropicResp := map[string]any{
-		"id":            fmt.Sprintf(config.MessageIDFormat, utils.GenerateBase62ID(22)),
+		"id":            responseID,
 		"content":       contexts,
 		"model":         anthropicReq.Model,
 		"role":          "assistant",
 		"stop_reason":   stopReason,
-		"stop_sequence": nil,
+		"stop_sequence": stopSequenceValue(stopSequence),
 		"type":          "message",
 		"usage":         usageMap,
 	}
+	if c.GetBool(partialResponseKey) {
+		anthropicResp["warning"] = partialResponseWarning()
+	}
+	if debugEchoEnabled(c) {
+		anthropicResp["debug"] = debugEcho(c)
+	}
 
 	// utils.Log("非流式响应最终数据",
 	// 	utils.LogString("stop_reason", stopReason),
 	// 	utils.LogInt("content_blocks", len(contexts)))
 
-	utils.Log("下发非流式响应",
-		addReqFields(c,
-			utils.LogString("direction", "downstream_send"),
-			utils.LogAny("contexts", contexts),
-			utils.LogBool("saw_tool_use", sawToolUse),
-			utils.LogInt("content_count", len(contexts)),
-		)...)
+	if logPolicy(c) == tenant.LogPolicyFull {
+		utils.Log("下发非流式响应",
+			addReqFields(c,
+				utils.LogString("direction", "downstream_send"),
+				utils.LogAny("contexts", contexts),
+				utils.LogBool("saw_tool_use", sawToolUse),
+				utils.LogInt("content_count", len(contexts)),
+			)...)
+	}
+	setCostHeader(c, anthropicReq.Model, actualInputTokens, outputTokens, cacheResult)
 	c.JSON(http.StatusOK, anthropicResp)
 
 	// 日志输出缓存统计
-	logCacheResult(cacheResult, inputTokens, outputTokens, false)
+	logCacheResult(c, cacheResult, inputTokens, outputTokens, false)
+	recordCacheResult(c, cacheResult)
+
+	completion := genAICompletion{
+		Request:      anthropicReq,
+		ResponseID:   responseID,
+		FinishReason: stopReason,
+		InputTokens:  inputTokens,
+		OutputTokens: outputTokens,
+		CacheResult:  cacheResult,
+		StartTime:    startTime,
+	}
+	logGenAICompletion(c, completion)
+	recordTokenUsage(c, completion.InputTokens, completion.OutputTokens)
+
+	rec := evalRecord{
+		Request:      anthropicReq,
+		Content:      contexts,
+		StopReason:   stopReason,
+		InputTokens:  inputTokens,
+		OutputTokens: outputTokens,
+		StartTime:    startTime,
+		EndTime:      time.Now(),
+		Attributes:   genAIAttributes(c, completion),
+	}
+	if shouldSampleEval() {
+		submitEval(c, rec)
+	}
+	recordRequest(c, rec)
+	recordConversation(c, rec)
+}
+
+/**
+ * fetchNonStreamResponse 执行上游请求并完整解析响应，返回文本结果和工具调用
+ * 出错时已向客户端写出错误响应，ok 为 false
+ */
+func fetchNonStreamResponse(c *gin.Context, anthropicReq types.AnthropicRequest, token types.TokenInfo) (result *parser.ParseResult, allTools []*parser.ToolExecution, ok bool) {
+	resp, err := upstreamClientOf(c).Execute(c, anthropicReq, token, false)
+	if err != nil {
+		return nil, nil, false
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	// 读取响应体，上游中途断开时保留已收到的部分尝试解析
+	body, readErr := utils.ReadHTTPResponse(resp.Body)
+	if readErr != nil {
+		if requestContext(c).Err() != nil {
+			utils.Log("客户端已断开，已取消上游请求", addReqFields(c)...)
+			return nil, nil, false
+		}
+		if len(body) == 0 {
+			handleResponseReadError(c, readErr)
+			return nil, nil, false
+		}
+	}
+
+	// 使用新的符合AWS规范的解析器，但在非流式模式下增加超时保护
+	compliantParser := parser.NewCompliantEventStreamParser()
+	compliantParser.SetMaxErrors(config.ParserMaxErrors) // 限制最大错误次数以防死循环
+
+	// 为非流式解析添加超时保护
+	_, parseSpan := tracing.Start(requestContext(c), "parser.ParseResponse", tracing.KindInternal)
+	parseSpan.SetAttr("kiro.response_size", len(body))
+	// 在当前 goroutine 中解析，超时或客户端断开后解析器在消息之间停止，不会残留后台 goroutine
+	parseCtx, cancelParse := context.WithTimeout(requestContext(c), 600*time.Second)
+	result, err = func() (result *parser.ParseResult, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("解析器panic: %v", r)
+			}
+		}()
+		return compliantParser.ParseResponseContext(parseCtx, body)
+	}()
+	cancelParse()
+	if errors.Is(err, context.DeadlineExceeded) {
+		utils.Log("非流式解析超时")
+		err = fmt.Errorf("解析超时")
+	}
+	parseSpan.SetError(err)
+	parseSpan.End()
+
+	if err != nil {
+		utils.Log("非流式解析失败",
+			utils.LogErr(err),
+			utils.LogString("model", anthropicReq.Model),
+			utils.LogInt("response_size", len(body)))
+
+		// 提供更详细的错误信息和建议
+		errorResp := gin.H{
+			"error":   "响应解析失败",
+			"type":    errTypeParsing,
+			"message": "无法解析AWS CodeWhisperer响应格式",
+		}
+
+		// 根据错误类型提供不同的HTTP状态码
+		statusCode := http.StatusInternalServerError
+		if strings.Contains(err.Error(), "解析超时") {
+			statusCode = http.StatusRequestTimeout
+			errorResp["message"] = "请求处理超时，请稍后重试"
+		} else if strings.Contains(err.Error(), "格式错误") {
+			statusCode = http.StatusBadRequest
+			errorResp["message"] = "请求格式不正确"
+		}
+
+		c.JSON(statusCode, errorResp)
+		return nil, nil, false
+	}
+
+	// 先获取工具管理器的所有工具，确保sawToolUse的判断基于实际工具
+	toolManager := compliantParser.GetToolManager()
+	allTools = make([]*parser.ToolExecution, 0)
+
+	// 上游中途断开：只返回已完成的工具调用，没有可用内容时按读取失败处理
+	if readErr != nil {
+		for _, tool := range toolManager.GetCompletedTools() {
+			allTools = append(allTools, tool)
+		}
+		if !salvagePartialResponse(c, result, allTools, readErr) {
+			handleResponseReadError(c, readErr)
+			return nil, nil, false
+		}
+		return result, allTools, true
+	}
+
+	// 获取活跃工具
+	for _, tool := range toolManager.GetActiveTools() {
+		allTools = append(allTools, tool)
+	}
+
+	// 获取已完成工具
+	for _, tool := range toolManager.GetCompletedTools() {
+		allTools = append(allTools, tool)
+	}
+	return result, allTools, true
 }
 
 // createTokenPreview 创建token预览显示格式 (***+后10位)
@@ -598,8 +798,30 @@ func maskEmail(email string) string {
 	return maskedUsername + "@" + maskedDomain
 }
 
+// processCache 执行缓存处理，缓存条目按 cacheNamespace 隔离，并计入调用方 API Key 的缓存统计
+func processCache(c *gin.Context, anthropicReq types.AnthropicRequest, inputTokens int) *cache.CacheResult {
+	result := cacheServiceOf(c).ProcessRequest(anthropicReq, inputTokens, cacheNamespace(c))
+	if result != nil {
+		utils.RecordPolicy(c, "cache", "prompt cache read=%d creation=%d of %d input tokens", result.CacheReadTokens, result.CacheCreationTokens, result.TotalTokens)
+		recordCacheKeyStats(c, result)
+	}
+	return result
+}
+
+// logPolicy 返回当前请求适用的日志策略
+func logPolicy(c *gin.Context) string {
+	if profile := GetTenant(c); profile != nil {
+		return profile.Logging()
+	}
+	return tenant.LogPolicyFull
+}
+
 // logCacheResult 输出缓存统计日志
-func logCacheResult(cacheResult *cache.CacheResult, inputTokens, outputTokens int, isStream bool) {
+func logCacheResult(c *gin.Context, cacheResult *cache.CacheResult, inputTokens, outputTokens int, isStream bool) {
+	if logPolicy(c) == tenant.LogPolicyOff {
+		return
+	}
+
 	mode := "非流式"
 	if isStream {
 		mode = "流式"
@@ -612,6 +834,11 @@ func logCacheResult(cacheResult *cache.CacheResult, inputTokens, outputTokens in
 		cacheRead = cacheResult.CacheReadTokens
 	}
 
-	utils.Info("请求完成 [%s] | input: %d, output: %d, cache_creation: %d, cache_read: %d",
-		mode, inputTokens, outputTokens, cacheCreation, cacheRead)
+	account := ""
+	if labels := GetAccountLabels(c); labels.Owner != "" {
+		account = " | account: " + labels.Owner
+	}
+
+	utils.Info("请求完成 [%s] | input: %d, output: %d, cache_creation: %d, cache_read: %d%s",
+		mode, inputTokens, outputTokens, cacheCreation, cacheRead, account)
 }
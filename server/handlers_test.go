@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"kiro/config"
+	"kiro/internal/eventstreamtest"
+	"kiro/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeUpstream 上游替身：返回固定的事件流或错误，并记录收到的 access token
+type fakeUpstream struct {
+	stream []byte
+	err    error
+	calls  int
+	tokens []string
+}
+
+func (f *fakeUpstream) Execute(c *gin.Context, _ types.AnthropicRequest, tokenInfo types.TokenInfo, _ bool) (*http.Response, error) {
+	f.calls++
+	f.tokens = append(f.tokens, tokenInfo.AccessToken)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/vnd.amazon.eventstream"}},
+		Body:       io.NopCloser(bytes.NewReader(f.stream)),
+	}, nil
+}
+
+// useSettings 在当前配置快照的副本上应用 modify 并替换为测试配置，测试结束后恢复
+func useSettings(t *testing.T, modify func(*config.Settings)) {
+	t.Helper()
+	settings := *config.Current()
+	modify(&settings)
+	t.Cleanup(config.Use(&settings))
+}
+
+// newTestRouter 使用注入的服务构建路由，不初始化进程级子系统
+// token 服务启用全局 token 池（API Key: test-pool-key），池中的 token 已缓存 access token
+func newTestRouter(t *testing.T, upstream UpstreamClient) http.Handler {
+	t.Helper()
+	tokens := NewTokenService()
+	tokens.SetPool("test-pool-key", []string{"refresh-1", "refresh-2"})
+	for refresh, access := range map[string]string{"refresh-1": "access-1", "refresh-2": "access-2"} {
+		tokens.entries[sha256Hash(refresh)] = &TokenCache{
+			AccessToken:  access,
+			RefreshToken: refresh,
+			LastRefresh:  time.Now(),
+		}
+	}
+
+	return newRouter(serverOptions{
+		ginMode: gin.TestMode,
+		services: services{
+			tokens:   tokens,
+			cache:    noPromptCache{},
+			upstream: upstream,
+		},
+	})
+}
+
+func TestMessagesHandler(t *testing.T) {
+	reply := append(
+		eventstreamtest.Frame("assistantResponseEvent", map[string]any{"content": "Hello"}),
+		eventstreamtest.Frame("assistantResponseEvent", map[string]any{"content": " there"})...,
+	)
+
+	tests := []struct {
+		name        string
+		apiKey      string
+		body        string
+		upstreamErr error
+		wantStatus  int
+		wantCalls   int
+		wantBody    []string
+	}{
+		{
+			name:       "non-stream",
+			apiKey:     "test-pool-key",
+			body:       `{"model":"claude-sonnet-4-5","max_tokens":64,"messages":[{"role":"user","content":"hi"}]}`,
+			wantStatus: http.StatusOK,
+			wantCalls:  1,
+			wantBody:   []string{`"type":"message"`, `Hello there`},
+		},
+		{
+			name:       "stream",
+			apiKey:     "test-pool-key",
+			body:       `{"model":"claude-sonnet-4-5","max_tokens":64,"stream":true,"messages":[{"role":"user","content":"hi"}]}`,
+			wantStatus: http.StatusOK,
+			wantCalls:  1,
+			wantBody:   []string{"event: message_start", `"text":"Hello`, "event: message_stop"},
+		},
+		{
+			name:        "upstream error",
+			apiKey:      "test-pool-key",
+			body:        `{"model":"claude-sonnet-4-5","max_tokens":64,"stream":true,"messages":[{"role":"user","content":"hi"}]}`,
+			upstreamErr: &UpstreamError{StatusCode: http.StatusTooManyRequests, Type: errTypeRateLimit, Message: "slow down"},
+			wantStatus:  http.StatusTooManyRequests,
+			wantCalls:   1,
+			wantBody:    []string{`"type":"rate_limit_error"`, "slow down"},
+		},
+		{
+			name:       "empty messages",
+			apiKey:     "test-pool-key",
+			body:       `{"model":"claude-sonnet-4-5","max_tokens":64,"messages":[]}`,
+			wantStatus: http.StatusBadRequest,
+			wantCalls:  0,
+		},
+		{
+			name:       "missing api key",
+			body:       `{"model":"claude-sonnet-4-5","max_tokens":64,"messages":[{"role":"user","content":"hi"}]}`,
+			wantStatus: http.StatusUnauthorized,
+			wantCalls:  0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &fakeUpstream{stream: reply, err: tt.upstreamErr}
+			router := newTestRouter(t, upstream)
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.apiKey != "" {
+				req.Header.Set("x-api-key", tt.apiKey)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d\n%s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if upstream.calls != tt.wantCalls {
+				t.Errorf("upstream calls = %d, want %d", upstream.calls, tt.wantCalls)
+			}
+			for _, token := range upstream.tokens {
+				if token != "access-1" && token != "access-2" {
+					t.Errorf("upstream access token = %q, want one from the injected token pool", token)
+				}
+			}
+			for _, want := range tt.wantBody {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("body does not contain %q\n%s", want, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+// TestTokenPoolPerService 每个 TokenService 持有独立的全局 token 池和轮询游标
+func TestTokenPoolPerService(t *testing.T) {
+	a, b := NewTokenService(), NewTokenService()
+	a.SetPool("key-a", []string{"a1", "a2"})
+
+	if b.isPoolAPIKey("key-a") {
+		t.Error("pool configured on one service leaked into another")
+	}
+	if _, ok := b.NextPoolToken(""); ok {
+		t.Error("NextPoolToken on a service without a pool returned a token")
+	}
+	var got []string
+	for range 3 {
+		token, _ := a.NextPoolToken("")
+		got = append(got, token)
+	}
+	if want := []string{"a1", "a2", "a1"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("round robin = %v, want %v", got, want)
+	}
+	if token, _ := a.NextPoolToken("a2"); token != "a1" {
+		t.Errorf("NextPoolToken(exclude a2) = %q, want a1", token)
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * 历史轮次限制
+ * 过深的历史会降低上游的回答质量并显著增加延迟。按历史中 role=user 的消息数（含工具结果）计算轮次：
+ * 达到 HISTORY_TURN_SOFT_LIMIT 时在响应头 X-Kiro-History-Warning 中提示开启新会话，
+ * 超过 HISTORY_TURN_HARD_LIMIT 时返回 400，并提示客户端压缩历史或开启新会话
+ */
+
+// historyWarningHeader 达到软限制时附带的响应头
+const historyWarningHeader = "X-Kiro-History-Warning"
+
+// historyTurns 返回历史中的用户轮次
+func historyTurns(req types.AnthropicRequest) int {
+	turns := 0
+	for _, msg := range req.Messages {
+		if msg.Role == "user" {
+			turns++
+		}
+	}
+	return turns
+}
+
+// checkHistoryTurns 超过硬限制时返回错误，达到软限制时设置提示响应头
+func checkHistoryTurns(c *gin.Context, req types.AnthropicRequest) *UpstreamError {
+	soft, hard := config.Current().HistoryTurnSoftLimit, config.Current().HistoryTurnHardLimit
+	if soft <= 0 && hard <= 0 {
+		return nil
+	}
+	turns := historyTurns(req)
+
+	if hard > 0 && turns > hard {
+		utils.RecordPolicy(c, "history_turns", "rejected: %d turns exceed hard limit %d", turns, hard)
+		utils.Log("历史轮次超过硬限制，拒绝请求",
+			addReqFields(c,
+				utils.LogInt("turns", turns),
+				utils.LogInt("limit", hard),
+			)...)
+		return &UpstreamError{
+			StatusCode: http.StatusBadRequest,
+			Type:       errTypeInvalidRequest,
+			Message:    fmt.Sprintf("Conversation history has %d turns, exceeding the limit of %d. Please compact the history or start a new conversation", turns, hard),
+		}
+	}
+	if soft > 0 && turns >= soft {
+		utils.RecordPolicy(c, "history_turns", "warned: %d turns reached soft limit %d", turns, soft)
+		c.Header(historyWarningHeader, fmt.Sprintf("conversation has %d turns (soft limit %d); consider starting a new conversation", turns, soft))
+	}
+	return nil
+}
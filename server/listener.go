@@ -0,0 +1,48 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"kiro/config"
+)
+
+/**
+ * 监听地址
+ * BIND_ADDRESS 为空时与之前一致，同时监听所有 IPv4 和 IPv6 地址；
+ * 0.0.0.0 只监听 IPv4，:: 只监听 IPv6（Go 对通配地址默认启用双栈，这里按地址族显式区分），
+ * 其他地址（如 127.0.0.1、::1）只监听该地址，用于限制为本机访问或纯 IPv6 环境
+ */
+
+// bindHost 解析 BIND_ADDRESS，允许带方括号的 IPv6 地址（如 [::1]）
+func bindHost(address string) (string, error) {
+	host := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(address), "["), "]")
+	if host == "" || host == "localhost" {
+		return host, nil
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("BIND_ADDRESS 必须是 IP 地址或 localhost: %q", address)
+	}
+	return host, nil
+}
+
+// listenNetwork 监听地址对应的网络类型，通配地址按地址族限定，避免 0.0.0.0 也监听 IPv6
+func listenNetwork(host string) string {
+	switch host {
+	case "0.0.0.0":
+		return "tcp4"
+	case "::":
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// listen 按 BIND_ADDRESS 在指定端口上监听
+func listen(port string) (net.Listener, error) {
+	host, err := bindHost(config.Current().BindAddress)
+	if err != nil {
+		return nil, err
+	}
+	return net.Listen(listenNetwork(host), net.JoinHostPort(host, port))
+}
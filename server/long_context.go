@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"kiro/config"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// longContextBetaPrefix 长上下文 beta 标识前缀（如 context-1m-2025-08-07）
+const longContextBetaPrefix = "context-1m"
+
+// wantsLongContext 客户端是否通过 anthropic-beta 请求头启用了 1M 上下文
+func wantsLongContext(c *gin.Context) bool {
+	for _, beta := range strings.Split(c.GetHeader("anthropic-beta"), ",") {
+		if strings.HasPrefix(strings.TrimSpace(beta), longContextBetaPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * contextWindow 返回当前请求可用的上下文窗口
+ * 启用 context-1m beta 且配置了 LONG_CONTEXT_WINDOW_TOKENS 时使用长上下文窗口，否则为标准窗口
+ */
+func contextWindow(c *gin.Context) int {
+	if long := config.Current().LongContextWindowTokens; long > config.ContextWindowTokens && wantsLongContext(c) {
+		return long
+	}
+	return config.ContextWindowTokens
+}
+
+/**
+ * checkContextWindow 输入超过上下文窗口时提前拒绝，返回与官方 API 一致的 prompt is too long 错误
+ * 避免把数 MB 的历史序列化后上传，再等待上游超时或返回难以理解的错误；
+ * 客户端（如 Claude Code）识别该错误后会自动压缩历史
+ */
+func checkContextWindow(c *gin.Context, inputTokens int) *UpstreamError {
+	window := contextWindow(c)
+	if wantsLongContext(c) {
+		utils.RecordPolicy(c, "long_context", "context-1m beta requested; effective window is %d tokens", window)
+	}
+	if inputTokens <= window {
+		return nil
+	}
+
+	utils.Log("输入超出上下文窗口，提前拒绝",
+		addReqFields(c,
+			utils.LogInt("input_tokens", inputTokens),
+			utils.LogInt("context_window", window),
+			utils.LogBool("long_context", wantsLongContext(c)),
+		)...)
+	return &UpstreamError{
+		StatusCode: http.StatusBadRequest,
+		Type:       errTypeInvalidRequest,
+		Message:    fmt.Sprintf("prompt is too long: %d tokens > %d maximum", inputTokens, window),
+	}
+}
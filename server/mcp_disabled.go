@@ -0,0 +1,15 @@
+//go:build nomcp
+
+package server
+
+import (
+	"kiro/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mcpCompiled 使用 -tags nomcp 构建时 MCP web_search 集成不可用
+const mcpCompiled = false
+
+// handleMCPWebSearch 占位实现，mcpCompiled 为 false 时不会被调用
+func handleMCPWebSearch(c *gin.Context, anthropicReq types.AnthropicRequest, token types.TokenInfo) {}
@@ -1,11 +1,15 @@
+//go:build !nomcp
+
 package server
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,6 +20,9 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// mcpCompiled MCP web_search 集成已编译（使用 -tags nomcp 构建时移除）
+const mcpCompiled = true
+
 // MCP JSON-RPC 请求/响应结构
 type mcpRequest struct {
 	ID      string    `json:"id"`
@@ -61,31 +68,6 @@ type webSearchResults struct {
 	Query        string            `json:"query,omitempty"`
 }
 
-type webSearchResult struct {
-	Title       string `json:"title"`
-	URL         string `json:"url"`
-	Snippet     string `json:"snippet,omitempty"`
-	Domain      string `json:"domain,omitempty"`
-	PublishedAt int64  `json:"published_date,omitempty"`
-}
-
-// hasWebSearchTool 检查请求中是否包含 web_search 工具
-func hasWebSearchTool(req types.AnthropicRequest) bool {
-	for _, tool := range req.Tools {
-		if tool.Name == "web_search" || tool.Name == "websearch" {
-			return true
-		}
-	}
-	return false
-}
-
-// getWebSearchMaxUses 获取 web_search 工具的 max_uses 限制
-func getWebSearchMaxUses(req types.AnthropicRequest) int {
-	// Anthropic web_search tool 没有标准的 max_uses 字段
-	// 默认返回 5
-	return 5
-}
-
 // extractSearchQuery 从请求中提取搜索查询
 func extractSearchQuery(req types.AnthropicRequest) string {
 	if len(req.Messages) == 0 {
@@ -126,7 +108,14 @@ func extractTextFromUserMessage(content any) string {
 	return ""
 }
 
-// handleMCPWebSearch 处理包含 web_search 的请求（支持流式 SSE 和非流式 JSON）
+// webSearchCitedTextMax 引用中 cited_text 的最大字符数（与官方一致）
+const webSearchCitedTextMax = 150
+
+/**
+ * handleMCPWebSearch 处理包含 web_search 的请求（支持流式 SSE 和非流式 JSON）
+ * 响应使用官方的 server_tool_use / web_search_tool_result 内容块，摘要文本附带 web_search_result_location 引用，
+ * 客户端（如 Claude Code）可以原生展示搜索来源；搜索失败时返回 web_search_tool_result_error 而不是整个请求失败
+ */
 func handleMCPWebSearch(c *gin.Context, anthropicReq types.AnthropicRequest, token types.TokenInfo) {
 	estimator := utils.NewTokenEstimator()
 	countReq := &types.CountTokensRequest{
@@ -143,170 +132,57 @@ func handleMCPWebSearch(c *gin.Context, anthropicReq types.AnthropicRequest, tok
 		return
 	}
 
-	maxUses := getWebSearchMaxUses(anthropicReq)
-
-	// 构建 MCP 请求
-	mcpReqID := fmt.Sprintf("web_search_%s_%d", utils.GenerateUUID()[:22], time.Now().UnixMilli())
-	mcpReq := mcpRequest{
-		ID:      mcpReqID,
-		JSONRPC: "2.0",
-		Method:  "tools/call",
-		Params: mcpParams{
-			Name:      "web_search",
-			Arguments: mcpArguments{Query: query},
-		},
-	}
-
-	jsonBytes, err := json.Marshal(mcpReq)
-	if err != nil {
-		respondError(c, http.StatusInternalServerError, "序列化 MCP 请求失败: %v", err)
-		return
-	}
-
-	// 发送 MCP 请求
-	httpReq, err := http.NewRequest("POST", config.MCPURL, bytes.NewReader(jsonBytes))
-	if err != nil {
-		respondError(c, http.StatusInternalServerError, "创建 MCP 请求失败: %v", err)
-		return
-	}
-
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Authorization", "Bearer "+token.AccessToken)
-	httpReq.Header.Set("user-agent", "aws-sdk-rust/"+config.SDKVersion+" ua/2.1 api/codewhispererstreaming/"+config.APIVersion+" os/linux lang/rust/1.92.0 md/appVersion-"+config.KiroCLIVersion+" app/AmazonQ-For-CLI")
-	httpReq.Header.Set("x-amz-user-agent", "aws-sdk-rust/"+config.SDKVersion+" ua/2.1 api/codewhispererstreaming/"+config.APIVersion+" os/linux lang/rust/1.92.0 m/F,C app/AmazonQ-For-CLI")
-
-	proxyKey, _ := c.Get("tokenHash")
-	proxyKeyStr, _ := proxyKey.(string)
-	resp, err := utils.DoRequestWithProxy(httpReq, proxyKeyStr)
-	if err != nil {
-		utils.Error("MCP 请求失败: %v", err)
-		respondError(c, http.StatusBadGateway, "MCP 服务不可用")
-		return
-	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-
-	var mcpResp mcpResponse
-	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &mcpResp) != nil || mcpResp.Error != nil {
-		errMsg := "MCP 请求失败"
-		if mcpResp.Error != nil {
-			errMsg = mcpResp.Error.Message
+	var results []webSearchResult
+	searchResults, searchErr := callMCPWebSearch(c, query, token)
+	if searchErr != nil {
+		utils.Log("MCP web_search 失败", addReqFields(c, utils.LogString("query", query), utils.LogErr(searchErr))...)
+	} else if searchResults != nil {
+		results = searchResults.Results
+		if len(results) > webSearchMaxResults {
+			results = results[:webSearchMaxResults]
 		}
-		utils.Error("MCP 响应错误: status=%d, body=%s", resp.StatusCode, string(body))
-		respondError(c, http.StatusBadGateway, "%s", errMsg)
-		return
 	}
 
-	// 解析搜索结果
-	var searchResults *webSearchResults
-	if mcpResp.Result != nil && len(mcpResp.Result.Content) > 0 {
-		for _, content := range mcpResp.Result.Content {
-			if content.Type == "text" {
-				var results webSearchResults
-				if json.Unmarshal([]byte(content.Text), &results) == nil {
-					searchResults = &results
-					break
-				}
-			}
-		}
-	}
-
-	// 构建通用数据
 	toolUseID := "srvtoolu_" + strings.ReplaceAll(utils.GenerateUUID(), "-", "")[:32]
 	msgID := fmt.Sprintf(config.MessageIDFormat, utils.GenerateBase62ID(22))
+	blocks := webSearchContentBlocks(toolUseID, query, results, searchErr)
 
-	// 构建搜索结果内容
-	searchContent := []any{}
-	if searchResults != nil {
-		limit := len(searchResults.Results)
-		if maxUses > 0 && maxUses < limit {
-			limit = maxUses
-		}
-		for i := 0; i < limit; i++ {
-			result := searchResults.Results[i]
-			searchContent = append(searchContent, map[string]any{
-				"type":              "web_search_result",
-				"title":             result.Title,
-				"url":               result.URL,
-				"encrypted_content": result.Snippet,
-				"page_age":          nil,
-			})
+	outputTokens := 0
+	for _, block := range blocks {
+		if text, ok := block["text"].(string); ok {
+			outputTokens += estimator.EstimateTextTokens(text)
 		}
 	}
-
-	// 生成文本摘要
-	summary := fmt.Sprintf("以下是关于 \"%s\" 的搜索结果：\n\n", query)
-	if searchResults != nil && len(searchResults.Results) > 0 {
-		limit := len(searchResults.Results)
-		if maxUses > 0 && maxUses < limit {
-			limit = maxUses
-		}
-		for i := 0; i < limit; i++ {
-			result := searchResults.Results[i]
-			summary += fmt.Sprintf("%d. **%s**\n", i+1, result.Title)
-			if result.Snippet != "" {
-				snippet := result.Snippet
-				if len(snippet) > 200 {
-					snippet = snippet[:200] + "..."
-				}
-				summary += fmt.Sprintf("   %s\n", snippet)
-			}
-			summary += fmt.Sprintf("   来源: %s\n\n", result.URL)
-		}
-	} else {
-		summary += "未找到相关结果。\n"
-	}
-
-	outputTokens := estimator.EstimateTextTokens(summary)
+	serverToolUse := map[string]any{"web_search_requests": 1}
 
 	// 非流式响应：返回完整 JSON
 	if !anthropicReq.Stream {
-		contentBlocks := []any{
-			map[string]any{
-				"type":  "server_tool_use",
-				"id":    toolUseID,
-				"name":  "web_search",
-				"input": map[string]string{"query": query},
-			},
-			map[string]any{
-				"type":        "web_search_tool_result",
-				"tool_use_id": toolUseID,
-				"content":     searchContent,
-			},
-			map[string]any{
-				"type": "text",
-				"text": summary,
-			},
-		}
-
 		c.JSON(http.StatusOK, map[string]any{
 			"id":            msgID,
 			"type":          "message",
 			"role":          "assistant",
 			"model":         anthropicReq.Model,
-			"content":       contentBlocks,
+			"content":       blocks,
 			"stop_reason":   "end_turn",
 			"stop_sequence": nil,
 			"usage": map[string]any{
-				"input_tokens":  inputTokens,
-				"output_tokens": outputTokens,
-				"service_tier":  "standard",
+				"input_tokens":    inputTokens,
+				"output_tokens":   outputTokens,
+				"server_tool_use": serverToolUse,
+				"service_tier":    "standard",
 			},
 		})
 
-		utils.Info("MCP web_search 完成 (非流式): query=%s, results=%d", query, len(searchContent))
+		utils.Info("MCP web_search 完成 (非流式): query=%s, results=%d", query, len(results))
 		return
 	}
 
 	// 流式响应：SSE 输出
-	c.Header("Content-Type", "text/event-stream")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
-
+	if err := initializeSSEResponse(c); err != nil {
+		return
+	}
 	sender := &AnthropicStreamSender{}
 
-	// 1. message_start
 	sender.SendEvent(c, map[string]any{
 		"type": "message_start",
 		"message": map[string]any{
@@ -325,91 +201,134 @@ func handleMCPWebSearch(c *gin.Context, anthropicReq types.AnthropicRequest, tok
 		},
 	})
 
-	// 2. content_block_start: server_tool_use (web_search)
-	sender.SendEvent(c, map[string]any{
-		"type":  "content_block_start",
-		"index": 0,
-		"content_block": map[string]any{
-			"id":    toolUseID,
-			"type":  "server_tool_use",
-			"name":  "web_search",
-			"input": map[string]any{},
-		},
-	})
+	for index, block := range blocks {
+		sendContentBlock(c, sender, index, block)
+	}
 
-	// 3. content_block_delta: input_json
-	inputJSON, _ := json.Marshal(map[string]string{"query": query})
 	sender.SendEvent(c, map[string]any{
-		"type":  "content_block_delta",
-		"index": 0,
+		"type": "message_delta",
 		"delta": map[string]any{
-			"type":         "input_json_delta",
-			"partial_json": string(inputJSON),
+			"stop_reason":   "end_turn",
+			"stop_sequence": nil,
+		},
+		"usage": map[string]any{
+			"output_tokens":   outputTokens,
+			"server_tool_use": serverToolUse,
+			"service_tier":    "standard",
 		},
 	})
 
-	// 4. content_block_stop
 	sender.SendEvent(c, map[string]any{
-		"type":  "content_block_stop",
-		"index": 0,
+		"type": "message_stop",
 	})
 
-	// 5. content_block_start: web_search_tool_result
-	sender.SendEvent(c, map[string]any{
-		"type":  "content_block_start",
-		"index": 1,
-		"content_block": map[string]any{
-			"type":        "web_search_tool_result",
-			"tool_use_id": toolUseID,
-			"content":     searchContent,
+	utils.Info("MCP web_search 完成 (流式): query=%s, results=%d", query, len(results))
+}
+
+// callMCPWebSearch 通过 MCP 端点执行一次搜索
+func callMCPWebSearch(c *gin.Context, query string, token types.TokenInfo) (*webSearchResults, error) {
+	mcpReqID := fmt.Sprintf("web_search_%s_%d", utils.GenerateUUID()[:22], time.Now().UnixMilli())
+	mcpReq := mcpRequest{
+		ID:      mcpReqID,
+		JSONRPC: "2.0",
+		Method:  "tools/call",
+		Params: mcpParams{
+			Name:      "web_search",
+			Arguments: mcpArguments{Query: query},
 		},
-	})
+	}
 
-	sender.SendEvent(c, map[string]any{
-		"type":  "content_block_stop",
-		"index": 1,
-	})
+	jsonBytes, err := json.Marshal(mcpReq)
+	if err != nil {
+		return nil, fmt.Errorf("序列化 MCP 请求失败: %v", err)
+	}
 
-	// 6. 文本摘要
-	sender.SendEvent(c, map[string]any{
-		"type":  "content_block_start",
-		"index": 2,
-		"content_block": map[string]any{
-			"type": "text",
-			"text": "",
-		},
-	})
+	httpReq, err := http.NewRequestWithContext(c.Request.Context(), "POST", config.Current().MCPURL, bytes.NewReader(jsonBytes))
+	if err != nil {
+		return nil, fmt.Errorf("创建 MCP 请求失败: %v", err)
+	}
 
-	sender.SendEvent(c, map[string]any{
-		"type":  "content_block_delta",
-		"index": 2,
-		"delta": map[string]any{
-			"type": "text_delta",
-			"text": summary,
-		},
-	})
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	httpReq.Header.Set("user-agent", "aws-sdk-rust/"+config.SDKVersion+" ua/2.1 api/codewhispererstreaming/"+config.APIVersion+" os/linux lang/rust/1.92.0 md/appVersion-"+config.KiroCLIVersion+" app/AmazonQ-For-CLI")
+	httpReq.Header.Set("x-amz-user-agent", "aws-sdk-rust/"+config.SDKVersion+" ua/2.1 api/codewhispererstreaming/"+config.APIVersion+" os/linux lang/rust/1.92.0 m/F,C app/AmazonQ-For-CLI")
 
-	sender.SendEvent(c, map[string]any{
-		"type":  "content_block_stop",
-		"index": 2,
-	})
+	resp, err := utils.DoRequestWithProxy(httpReq, c.GetString("tokenHash"))
+	if err != nil {
+		return nil, fmt.Errorf("MCP 请求失败: %v", err)
+	}
+	defer resp.Body.Close()
 
-	// 7. message_delta + message_stop
-	sender.SendEvent(c, map[string]any{
-		"type": "message_delta",
-		"delta": map[string]any{
-			"stop_reason":   "end_turn",
-			"stop_sequence": nil,
+	body, _ := io.ReadAll(resp.Body)
+
+	var mcpResp mcpResponse
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &mcpResp) != nil || mcpResp.Error != nil {
+		if mcpResp.Error != nil {
+			return nil, fmt.Errorf("MCP 响应错误: %s", mcpResp.Error.Message)
+		}
+		return nil, fmt.Errorf("MCP 响应错误: status=%d, body=%s", resp.StatusCode, string(body))
+	}
+
+	// 解析搜索结果
+	if mcpResp.Result != nil {
+		for _, content := range mcpResp.Result.Content {
+			if content.Type == "text" {
+				var results webSearchResults
+				if json.Unmarshal([]byte(content.Text), &results) == nil {
+					return &results, nil
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+/**
+ * webSearchContentBlocks 构建搜索响应的内容块：server_tool_use、web_search_tool_result 和带引用的摘要文本
+ * 搜索结果的 encrypted_content 与引用的 encrypted_index 只在本代理内部使用，客户端原样回传即可
+ */
+func webSearchContentBlocks(toolUseID, query string, results []webSearchResult, searchErr error) []map[string]any {
+	resultContent := webSearchResultContent(results, searchErr)
+
+	blocks := []map[string]any{
+		{
+			"type":  "server_tool_use",
+			"id":    toolUseID,
+			"name":  webSearchToolName,
+			"input": map[string]any{"query": query},
 		},
-		"usage": map[string]any{
-			"output_tokens": outputTokens,
-			"service_tier":  "standard",
+		{
+			"type":        "web_search_tool_result",
+			"tool_use_id": toolUseID,
+			"content":     resultContent,
 		},
-	})
+	}
 
-	sender.SendEvent(c, map[string]any{
-		"type": "message_stop",
-	})
+	switch {
+	case searchErr != nil:
+		blocks = append(blocks, map[string]any{"type": "text", "text": "搜索服务暂时不可用，未能获取关于 \"" + query + "\" 的结果。"})
+		return blocks
+	case len(results) == 0:
+		blocks = append(blocks, map[string]any{"type": "text", "text": "未找到关于 \"" + query + "\" 的相关结果。"})
+		return blocks
+	}
 
-	utils.Info("MCP web_search 完成 (流式): query=%s, results=%d", query, len(searchContent))
+	blocks = append(blocks, map[string]any{"type": "text", "text": fmt.Sprintf("以下是关于 \"%s\" 的搜索结果：\n\n", query)})
+	for i, result := range results {
+		text := fmt.Sprintf("%d. **%s**\n", i+1, result.Title)
+		block := map[string]any{"type": "text"}
+		if result.Snippet != "" {
+			text += "   " + truncateRunes(result.Snippet, 200) + "\n"
+			block["citations"] = []any{map[string]any{
+				"type":            "web_search_result_location",
+				"url":             result.URL,
+				"title":           result.Title,
+				"encrypted_index": base64.StdEncoding.EncodeToString([]byte(strconv.Itoa(i))),
+				"cited_text":      truncateRunes(result.Snippet, webSearchCitedTextMax),
+			}}
+		}
+		block["text"] = text + fmt.Sprintf("   来源: %s\n\n", result.URL)
+		blocks = append(blocks, block)
+	}
+	return blocks
 }
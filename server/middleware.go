@@ -1,14 +1,22 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"regexp"
 	"strings"
 
+	"kiro/config"
+	"kiro/tenant"
+	"kiro/tracing"
 	"kiro/utils"
 
 	"github.com/gin-gonic/gin"
 )
 
+// 启用后客户端只能使用租户 API Key 或 KIRO_POOL_API_KEY，上游凭证无需分发给最终用户
+
 /**
  * AuthMiddleware 认证中间件，支持 x-api-key 和 Authorization Bearer 两种格式
  */
@@ -28,7 +36,7 @@ func AuthMiddleware() gin.HandlerFunc {
 		if token == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"error": gin.H{
-					"type":    "authentication_error",
+					"type":    errTypeAuthentication,
 					"message": "Missing authentication. Provide Authorization header or x-api-key",
 				},
 			})
@@ -36,13 +44,109 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		// 本地 API Key 命中租户配置时，从租户 token 池中选取上游 token
+		apiKey := token
+		var labels tenant.AccountLabels
+		profile, lookupErr := tenant.Lookup(apiKey)
+		if lookupErr != nil {
+			message := "API key has expired, please rotate to a new key"
+			if errors.Is(lookupErr, tenant.ErrKeyRevoked) {
+				message = "API key has been revoked"
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": gin.H{
+					"type":    errTypeAuthentication,
+					"message": message,
+				},
+			})
+			c.Abort()
+			return
+		}
+		if profile != nil {
+			if !tenant.Allow(profile) {
+				c.JSON(http.StatusTooManyRequests, gin.H{
+					"error": gin.H{
+						"type":    errTypeRateLimit,
+						"message": "Tenant rate limit exceeded, please retry later",
+					},
+				})
+				c.Abort()
+				return
+			}
+			c.Set("tenant", profile)
+
+			// Bedrock / Anthropic 直连租户使用服务端配置的凭证，无需选取上游 token
+			if profile.UsesBedrock() || profile.UsesAnthropic() {
+				c.Set("apiKeyHash", sha256Hash(apiKey))
+				c.Next()
+				return
+			}
+
+			upstreamToken, err := tenant.NextToken(profile)
+			if err != nil {
+				utils.Error("租户 token 选取失败: %v", err)
+				c.JSON(http.StatusUnauthorized, gin.H{
+					"error": gin.H{
+						"type":    errTypeAuthentication,
+						"message": "Identity verification fails, please check its validity",
+					},
+				})
+				c.Abort()
+				return
+			}
+			token = upstreamToken.Token
+			labels = upstreamToken.AccountLabels
+		} else if tokenServiceOf(c).isPoolAPIKey(apiKey) {
+			// 全局 token 池：按请求轮询上游 token
+			pooled, _ := tokenServiceOf(c).NextPoolToken("")
+			c.Set("tokenPool", true)
+			token = pooled
+		} else if config.Current().AnthropicPassthrough && isAnthropicAPIKey(apiKey) {
+			// 真实 Anthropic API Key：请求原样转发到 Anthropic API，无需上游 token
+			c.Set(anthropicPassthroughKey, true)
+			c.Set("apiKeyHash", sha256Hash(apiKey))
+			c.Next()
+			return
+		} else if config.Current().RawTokenAuthDisabled {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": gin.H{
+					"type":    errTypeAuthentication,
+					"message": "Invalid API key",
+				},
+			})
+			c.Abort()
+			return
+		}
+
+		c.Set("apiKeyHash", sha256Hash(apiKey))
+
 		// 获取或刷新 access token
-		cached, err := GetOrRefreshToken(token)
-		if err != nil {
+		if err := bindUpstreamToken(c, token, labels); err != nil {
 			utils.Error("Token 认证失败: %v", err)
+			if errors.Is(err, ErrMalformedToken) {
+				c.JSON(http.StatusUnauthorized, gin.H{
+					"error": gin.H{
+						"type":    errTypeAuthentication,
+						"message": "Malformed token: " + err.Error(),
+					},
+				})
+				c.Abort()
+				return
+			}
+			var scopeErr *tokenScopeError
+			if errors.As(err, &scopeErr) {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error": gin.H{
+						"type":    errTypePermission,
+						"message": fmt.Sprintf("Upstream %s token was refreshed but lacks CodeWhisperer permissions (status %d), see server logs for configuration guidance", scopeErr.TokenType, scopeErr.StatusCode),
+					},
+				})
+				c.Abort()
+				return
+			}
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"error": gin.H{
-					"type":    "authentication_error",
+					"type":    errTypeAuthentication,
 					"message": "Identity verification fails, please check its validity",
 				},
 			})
@@ -50,27 +154,146 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		// 将 access token、原始 refresh token、profileArn 和 token hash 存入上下文
-		c.Set("accessToken", cached.AccessToken)
-		c.Set("profileArn", cached.ProfileArn)
-		c.Set("refreshToken", token)
-		c.Set("tokenHash", sha256Hash(token))
 		c.Next()
 	}
 }
 
+/**
+ * bindUpstreamToken 获取或刷新上游 token，并将凭证信息写入上下文
+ */
+func bindUpstreamToken(c *gin.Context, token string, labels tenant.AccountLabels) error {
+	tokens := tokenServiceOf(c)
+	cached, err := tokens.GetOrRefresh(requestContext(c), token)
+	if err != nil {
+		return err
+	}
+
+	// 账号标注随 token 缓存保存，供管理端点展示和用量记录归属
+	if !labels.IsZero() {
+		tokens.SetLabels(token, labels)
+		c.Set("accountLabels", labels)
+	}
+
+	// 将 access token、原始 refresh token、profileArn、声明的 profile 和 token hash 存入上下文
+	c.Set("accessToken", cached.AccessToken)
+	c.Set("profileArn", cached.ProfileArn)
+	c.Set(tokenProfilesKey, cached.Profiles)
+	c.Set("refreshToken", token)
+	c.Set("tokenHash", sha256Hash(token))
+	return nil
+}
+
+/**
+ * GetTenant 从上下文读取租户配置，未绑定租户时返回 nil
+ */
+func GetTenant(c *gin.Context) *tenant.Profile {
+	if v, ok := c.Get("tenant"); ok {
+		if p, ok2 := v.(*tenant.Profile); ok2 {
+			return p
+		}
+	}
+	return nil
+}
+
+/**
+ * tokenPoolProfile 返回当前请求使用的租户 token 池
+ * 路由规则指定的 token 池优先，其次是请求所属租户；路由到全局 token 池时返回 nil
+ */
+func tokenPoolProfile(c *gin.Context) *tenant.Profile {
+	if v, ok := c.Get(routePoolKey); ok {
+		p, _ := v.(*tenant.Profile)
+		return p
+	}
+	return GetTenant(c)
+}
+
+/**
+ * GetAccountLabels 从上下文读取当前上游账号的标注，未配置时返回零值
+ */
+func GetAccountLabels(c *gin.Context) tenant.AccountLabels {
+	if v, ok := c.Get("accountLabels"); ok {
+		if l, ok2 := v.(tenant.AccountLabels); ok2 {
+			return l
+		}
+	}
+	return tenant.AccountLabels{}
+}
+
+// maxClientRequestIDLength 客户端 X-Request-ID 的最大长度
+const maxClientRequestIDLength = 128
+
+// validClientRequestID 客户端 X-Request-ID 须为 1-128 个可打印 ASCII 字符（不含空格），否则忽略
+func validClientRequestID(id string) bool {
+	if id == "" || len(id) > maxClientRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
 /**
  * RequestIDMiddleware 为每个请求注入 request_id 并通过响应头返回
+ * request_id 总是由代理生成；客户端传入合法的 X-Request-ID 时另存为 client_request_id 并原样回显，
+ * 不合法（超长或含不可打印字符）的值直接忽略
  */
 func RequestIDMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		rid := c.GetHeader("X-Request-ID")
-		if rid == "" {
-			rid = "req_" + utils.GenerateUUID()
-		}
+		rid := "req_" + utils.GenerateUUID()
 		c.Set("request_id", rid)
-		c.Writer.Header().Set("X-Request-ID", rid)
+
+		echo := rid
+		if clientID := c.GetHeader("X-Request-ID"); validClientRequestID(clientID) {
+			c.Set("client_request_id", clientID)
+			echo = clientID
+		} else if clientID != "" {
+			utils.Debug("忽略不合法的 X-Request-ID（长度 %d）", len(clientID))
+		}
+		c.Writer.Header().Set("X-Request-ID", echo)
+		c.Next()
+	}
+}
+
+/**
+ * TracingMiddleware 为每个请求创建服务端 span（需配置 OTLP 导出端点）
+ * 支持通过 W3C traceparent 请求头加入调用方的 trace，并通过 X-Trace-Id 响应头返回 trace ID
+ */
+func TracingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !tracing.Enabled() {
+			c.Next()
+			return
+		}
+
+		ctx := tracing.Extract(c.Request.Context(), c.GetHeader("traceparent"))
+		ctx, span := tracing.Start(ctx, c.Request.Method+" "+c.Request.URL.Path, tracing.KindServer)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		c.Writer.Header().Set("X-Trace-Id", span.TraceID())
+
+		span.SetAttr("http.request.method", c.Request.Method)
+		span.SetAttr("url.path", c.Request.URL.Path)
+		span.SetAttr("kiro.request_id", GetRequestID(c))
+		if clientID := c.GetString("client_request_id"); clientID != "" {
+			span.SetAttr("kiro.client_request_id", clientID)
+		}
+
 		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttr("http.response.status_code", status)
+		if name := tenantName(c); name != "" {
+			span.SetAttr("kiro.tenant", name)
+		}
+		if upstreamID := GetUpstreamHeaders(c)["x-amzn-RequestId"]; upstreamID != "" {
+			span.SetAttr("kiro.upstream_request_id", upstreamID)
+		}
+		if status >= 500 {
+			span.SetError(fmt.Errorf("HTTP %d", status))
+		}
 	}
 }
 
@@ -86,6 +309,30 @@ func GetRequestID(c *gin.Context) string {
 	return ""
 }
 
+// uuidPattern 标准 UUID 格式
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+/**
+ * GetUpstreamInvocationID 返回本次请求发往上游的 amz-sdk-invocation-id
+ * 复用代理生成的 request_id 中的 UUID，每个请求都不同，客户端的 X-Request-ID 不会发往上游
+ * 同一请求的重试共用一个 ID，使代理日志与 AWS 侧记录可以相互关联
+ */
+func GetUpstreamInvocationID(c *gin.Context) string {
+	if c == nil {
+		return utils.GenerateUUID()
+	}
+	if id := c.GetString("upstreamInvocationID"); id != "" {
+		return id
+	}
+
+	id := strings.TrimPrefix(GetRequestID(c), "req_")
+	if !uuidPattern.MatchString(id) {
+		id = utils.GenerateUUID()
+	}
+	c.Set("upstreamInvocationID", id)
+	return id
+}
+
 /**
  * GetMessageID 从上下文读取 message_id
  */
@@ -111,6 +358,15 @@ func addReqFields(c *gin.Context, fields ...utils.LogField) []utils.LogField {
 	if mid != "" {
 		out = append(out, utils.LogString("message_id", mid))
 	}
+	if clientID := c.GetString("client_request_id"); clientID != "" {
+		out = append(out, utils.LogString("client_request_id", clientID))
+	}
+	if invocationID := c.GetString("upstreamInvocationID"); invocationID != "" {
+		out = append(out, utils.LogString("upstream_invocation_id", invocationID))
+	}
+	if upstreamID := GetUpstreamHeaders(c)["x-amzn-RequestId"]; upstreamID != "" {
+		out = append(out, utils.LogString("upstream_request_id", upstreamID))
+	}
 	out = append(out, fields...)
 	return out
 }
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		wantClient string // 期望记录的 client_request_id，为空表示忽略
+	}{
+		{name: "no header"},
+		{name: "client uuid", header: "0b9c4a51-6a3e-4c36-9f55-3c2e8c1d2f10", wantClient: "0b9c4a51-6a3e-4c36-9f55-3c2e8c1d2f10"},
+		{name: "client opaque id", header: "trace-42/step:7", wantClient: "trace-42/step:7"},
+		{name: "too long", header: strings.Repeat("a", maxClientRequestIDLength+1)},
+		{name: "control characters", header: "abc\x01def"},
+		{name: "spaces", header: "abc def"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.Use(RequestIDMiddleware())
+			var requestID, clientID string
+			var invocationIDs []string
+			r.GET("/", func(c *gin.Context) {
+				requestID = GetRequestID(c)
+				clientID = c.GetString("client_request_id")
+				invocationIDs = append(invocationIDs, GetUpstreamInvocationID(c))
+			})
+
+			// 同一客户端 ID 的两个请求必须发往上游不同的 invocation ID
+			var echoed []string
+			for range 2 {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				if tt.header != "" {
+					req.Header.Set("X-Request-ID", tt.header)
+				}
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+				echoed = append(echoed, w.Header().Get("X-Request-ID"))
+			}
+
+			if !strings.HasPrefix(requestID, "req_") {
+				t.Errorf("request_id = %q, want a proxy-generated req_ ID", requestID)
+			}
+			if clientID != tt.wantClient {
+				t.Errorf("client_request_id = %q, want %q", clientID, tt.wantClient)
+			}
+			if tt.wantClient != "" && echoed[1] != tt.wantClient {
+				t.Errorf("X-Request-ID echo = %q, want the client ID", echoed[1])
+			}
+			if tt.wantClient == "" && echoed[1] != requestID {
+				t.Errorf("X-Request-ID echo = %q, want request_id %q", echoed[1], requestID)
+			}
+			if invocationIDs[0] == invocationIDs[1] {
+				t.Errorf("invocation ID %q reused across requests", invocationIDs[0])
+			}
+			for _, id := range invocationIDs {
+				if !uuidPattern.MatchString(id) {
+					t.Errorf("invocation ID %q is not a UUID", id)
+				}
+			}
+		})
+	}
+}
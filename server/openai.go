@@ -0,0 +1,615 @@
+//go:build !noopenai
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"kiro/config"
+	"kiro/converter"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAICompatKey 标记当前请求来自 OpenAI 兼容端点
+const openAICompatKey = "openaiCompat"
+
+// openAICompiled OpenAI 兼容端点已编译（使用 -tags noopenai 构建时移除）
+const openAICompiled = true
+
+// registerOpenAIRoutes 注册 OpenAI 兼容端点（DISABLED_FEATURES 包含 openai 时跳过）
+func registerOpenAIRoutes(r *gin.Engine) {
+	if !featureEnabled(featureOpenAI) {
+		return
+	}
+	r.POST("/v1/chat/completions", UsageRecordMiddleware(), RateLimitMiddleware(), handleChatCompletions)
+}
+
+// openAIDefaultMaxTokens 客户端未指定 max_tokens 时的默认值
+const openAIDefaultMaxTokens = 8192
+
+/**
+ * handleChatCompletions 处理 OpenAI 兼容的 /v1/chat/completions 请求
+ * 请求转换为 Anthropic 格式后复用现有处理流程，流式响应由 OpenAIStreamSender 转换为 chat.completion.chunk
+ */
+func handleChatCompletions(c *gin.Context) {
+	var openAIReq types.OpenAIChatRequest
+	if err := c.ShouldBindJSON(&openAIReq); err != nil {
+		if isBodyTooLarge(err) {
+			respondOpenAIError(c, http.StatusRequestEntityTooLarge, errTypeRequestTooLarge, fmt.Sprintf("Request exceeds the maximum allowed size of %d bytes", config.Current().RequestBodyMaxBytes))
+			return
+		}
+		respondOpenAIError(c, http.StatusBadRequest, errTypeInvalidRequest, fmt.Sprintf("解析请求体失败: %v", err))
+		return
+	}
+
+	anthropicReq, err := convertOpenAIRequest(openAIReq)
+	if err != nil {
+		respondOpenAIError(c, http.StatusBadRequest, errTypeInvalidRequest, err.Error())
+		return
+	}
+	noteUsageRequest(c, anthropicReq.Model, anthropicReq.Stream)
+
+	if profile := GetTenant(c); profile != nil && !profile.ModelAllowed(anthropicReq.Model) {
+		respondOpenAIError(c, http.StatusForbidden, errTypePermission, "Model "+anthropicReq.Model+" is not allowed for this API key")
+		return
+	}
+	if ruleErr := applyRoutingRules(c, &anthropicReq); ruleErr != nil {
+		respondOpenAIError(c, ruleErr.StatusCode, ruleErr.Type, ruleErr.Message)
+		return
+	}
+	if turnErr := checkHistoryTurns(c, anthropicReq); turnErr != nil {
+		respondOpenAIError(c, turnErr.StatusCode, turnErr.Type, turnErr.Message)
+		return
+	}
+	if abuseErr := shapeAbusiveRequest(c, anthropicReq); abuseErr != nil {
+		respondOpenAIError(c, abuseErr.StatusCode, abuseErr.Type, abuseErr.Message)
+		return
+	}
+	if err := converter.PrepareImages(&anthropicReq, c); err != nil {
+		respondOpenAIError(c, http.StatusBadRequest, errTypeInvalidRequest, err.Error())
+		return
+	}
+	if hasWebSearchTool(anthropicReq) {
+		respondOpenAIError(c, http.StatusBadRequest, errTypeInvalidRequest, "web_search 工具仅支持 /v1/messages 端点")
+		return
+	}
+	if useBedrock(c, anthropicReq.Model) {
+		respondOpenAIError(c, http.StatusBadRequest, errTypeInvalidRequest, "Bedrock 上游仅支持 /v1/messages 端点")
+		return
+	}
+	if anthropicPassthrough(c) {
+		respondOpenAIError(c, http.StatusBadRequest, errTypeInvalidRequest, "Anthropic 直连仅支持 /v1/messages 端点")
+		return
+	}
+
+	c.Set(openAICompatKey, true)
+	tokenInfo := types.TokenInfo{AccessToken: c.GetString("accessToken")}
+
+	if anthropicReq.Stream {
+		sender := &OpenAIStreamSender{
+			model:        openAIReq.Model,
+			created:      time.Now().Unix(),
+			includeUsage: openAIReq.StreamOptions != nil && openAIReq.StreamOptions.IncludeUsage,
+			toolIndex:    make(map[int]int),
+		}
+		handleGenericStreamRequest(c, anthropicReq, tokenInfo, sender, createAnthropicStreamEvents)
+		return
+	}
+
+	// 非流式：截获 Anthropic 格式的响应后转换为 chat.completion
+	capture := &capturingWriter{ResponseWriter: c.Writer, status: http.StatusOK}
+	c.Writer = capture
+	handleNonStreamRequest(c, anthropicReq, tokenInfo)
+	c.Writer = capture.ResponseWriter
+
+	if capture.status != http.StatusOK {
+		message, errType := extractErrorMessage(capture.body.Bytes())
+		respondOpenAIError(c, capture.status, errType, message)
+		return
+	}
+	var anthropicResp anthropicMessageResponse
+	if err := utils.SafeUnmarshal(capture.body.Bytes(), &anthropicResp); err != nil {
+		respondOpenAIError(c, http.StatusBadGateway, errTypeAPI, fmt.Sprintf("解析响应失败: %v", err))
+		return
+	}
+	c.JSON(http.StatusOK, convertAnthropicResponse(anthropicResp, openAIReq.Model))
+}
+
+// convertOpenAIRequest 将 OpenAI Chat Completions 请求转换为 Anthropic 请求
+func convertOpenAIRequest(req types.OpenAIChatRequest) (types.AnthropicRequest, error) {
+	anthropicReq := types.AnthropicRequest{
+		Model:       req.Model,
+		MaxTokens:   req.MaxCompletionTokens,
+		Stream:      req.Stream,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+	}
+	if anthropicReq.MaxTokens == 0 {
+		anthropicReq.MaxTokens = req.MaxTokens
+	}
+	if anthropicReq.MaxTokens == 0 {
+		anthropicReq.MaxTokens = openAIDefaultMaxTokens
+	}
+	switch stop := req.Stop.(type) {
+	case string:
+		anthropicReq.StopSequences = []string{stop}
+	case []any:
+		for _, item := range stop {
+			if seq, ok := item.(string); ok {
+				anthropicReq.StopSequences = append(anthropicReq.StopSequences, seq)
+			}
+		}
+	}
+
+	for i, msg := range req.Messages {
+		switch msg.Role {
+		case "system", "developer":
+			text, err := openAIContentText(msg.Content)
+			if err != nil {
+				return anthropicReq, fmt.Errorf("messages[%d]: %v", i, err)
+			}
+			anthropicReq.System = append(anthropicReq.System, types.AnthropicSystemMessage{Type: "text", Text: text})
+		case "user":
+			blocks, err := openAIContentBlocks(msg.Content)
+			if err != nil {
+				return anthropicReq, fmt.Errorf("messages[%d]: %v", i, err)
+			}
+			anthropicReq.Messages = appendMessageBlocks(anthropicReq.Messages, "user", blocks)
+		case "assistant":
+			blocks, err := openAIContentBlocks(msg.Content)
+			if err != nil {
+				return anthropicReq, fmt.Errorf("messages[%d]: %v", i, err)
+			}
+			for _, call := range msg.ToolCalls {
+				var input any = map[string]any{}
+				if strings.TrimSpace(call.Function.Arguments) != "" {
+					if err := utils.SafeUnmarshal([]byte(call.Function.Arguments), &input); err != nil {
+						return anthropicReq, fmt.Errorf("messages[%d].tool_calls: arguments 不是合法JSON: %v", i, err)
+					}
+				}
+				blocks = append(blocks, map[string]any{
+					"type":  "tool_use",
+					"id":    call.ID,
+					"name":  call.Function.Name,
+					"input": input,
+				})
+			}
+			anthropicReq.Messages = appendMessageBlocks(anthropicReq.Messages, "assistant", blocks)
+		case "tool":
+			text, err := openAIContentText(msg.Content)
+			if err != nil {
+				return anthropicReq, fmt.Errorf("messages[%d]: %v", i, err)
+			}
+			anthropicReq.Messages = appendMessageBlocks(anthropicReq.Messages, "user", []any{map[string]any{
+				"type":        "tool_result",
+				"tool_use_id": msg.ToolCallID,
+				"content":     text,
+			}})
+		default:
+			return anthropicReq, fmt.Errorf("messages[%d]: 不支持的角色 %q", i, msg.Role)
+		}
+	}
+	if len(anthropicReq.Messages) == 0 {
+		return anthropicReq, fmt.Errorf("messages 数组不能为空")
+	}
+
+	for _, tool := range req.Tools {
+		schema := tool.Function.Parameters
+		if schema == nil {
+			schema = map[string]any{"type": "object", "properties": map[string]any{}}
+		}
+		anthropicReq.Tools = append(anthropicReq.Tools, types.AnthropicTool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: schema,
+		})
+	}
+	switch choice := req.ToolChoice.(type) {
+	case string:
+		switch choice {
+		case "required":
+			anthropicReq.ToolChoice = &types.ToolChoice{Type: "any"}
+		case "none":
+			// 由转换层决定保留哪些工具（历史中调用过的工具仍需声明）
+			anthropicReq.ToolChoice = &types.ToolChoice{Type: "none"}
+		}
+	case map[string]any:
+		if fn, ok := choice["function"].(map[string]any); ok {
+			if name, _ := fn["name"].(string); name != "" {
+				anthropicReq.ToolChoice = &types.ToolChoice{Type: "tool", Name: name}
+			}
+		}
+	}
+	return anthropicReq, nil
+}
+
+// appendMessageBlocks 追加消息内容块，与上一条消息角色相同时合并（Anthropic 要求角色交替）
+func appendMessageBlocks(messages []types.AnthropicRequestMessage, role string, blocks []any) []types.AnthropicRequestMessage {
+	if len(blocks) == 0 {
+		return messages
+	}
+	if n := len(messages); n > 0 && messages[n-1].Role == role {
+		if existing, ok := messages[n-1].Content.([]any); ok {
+			messages[n-1].Content = append(existing, blocks...)
+			return messages
+		}
+	}
+	return append(messages, types.AnthropicRequestMessage{Role: role, Content: blocks})
+}
+
+// openAIContentBlocks 将 OpenAI 消息内容转换为 Anthropic 内容块
+// 图片仅支持 data URL（base64），上游无法直接拉取远程图片
+func openAIContentBlocks(content any) ([]any, error) {
+	switch v := content.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if v == "" {
+			return nil, nil
+		}
+		return []any{map[string]any{"type": "text", "text": v}}, nil
+	case []any:
+		blocks := make([]any, 0, len(v))
+		for _, item := range v {
+			part, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			switch part["type"] {
+			case "text":
+				if text, _ := part["text"].(string); text != "" {
+					blocks = append(blocks, map[string]any{"type": "text", "text": text})
+				}
+			case "image_url":
+				imageURL, _ := part["image_url"].(map[string]any)
+				url, _ := imageURL["url"].(string)
+				mediaType, data, ok := parseDataURL(url)
+				if !ok {
+					return nil, fmt.Errorf("image_url 仅支持 base64 data URL")
+				}
+				blocks = append(blocks, map[string]any{
+					"type": "image",
+					"source": map[string]any{
+						"type":       "base64",
+						"media_type": mediaType,
+						"data":       data,
+					},
+				})
+			default:
+				return nil, fmt.Errorf("不支持的内容类型 %v", part["type"])
+			}
+		}
+		return blocks, nil
+	default:
+		return nil, fmt.Errorf("content 格式无效")
+	}
+}
+
+// openAIContentText 提取纯文本内容（system / tool 消息）
+func openAIContentText(content any) (string, error) {
+	blocks, err := openAIContentBlocks(content)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for _, block := range blocks {
+		if text, ok := block.(map[string]any)["text"].(string); ok {
+			sb.WriteString(text)
+		}
+	}
+	return sb.String(), nil
+}
+
+// parseDataURL 解析 data:<media_type>;base64,<data> 格式
+func parseDataURL(url string) (mediaType, data string, ok bool) {
+	rest, found := strings.CutPrefix(url, "data:")
+	if !found {
+		return "", "", false
+	}
+	meta, data, found := strings.Cut(rest, ",")
+	if !found {
+		return "", "", false
+	}
+	mediaType, found = strings.CutSuffix(meta, ";base64")
+	return mediaType, data, found
+}
+
+// openAIFinishReason 将 Anthropic stop_reason 映射为 OpenAI finish_reason
+func openAIFinishReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens", "model_context_window_exceeded":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	default:
+		return "stop"
+	}
+}
+
+// openAICompletionID 由消息ID生成 chat.completion 的ID
+func openAICompletionID(messageID string) string {
+	return "chatcmpl-" + strings.TrimPrefix(messageID, "msg_")
+}
+
+// OpenAIStreamSender 将 Anthropic 流式事件转换为 chat.completion.chunk
+type OpenAIStreamSender struct {
+	id           string
+	model        string
+	created      int64
+	includeUsage bool
+	toolIndex    map[int]int // content block index -> tool_calls index
+	usage        types.OpenAIUsage
+}
+
+func (s *OpenAIStreamSender) SendEvent(c *gin.Context, data any) error {
+	event, ok := data.(map[string]any)
+	if !ok {
+		raw, err := utils.SafeMarshal(data)
+		if err != nil {
+			return err
+		}
+		if err := utils.SafeUnmarshal(raw, &event); err != nil {
+			return err
+		}
+	}
+
+	switch event["type"] {
+	case "message_start":
+		message, _ := event["message"].(map[string]any)
+		s.id = openAICompletionID(getStringField(message, "id"))
+		if usage, ok := message["usage"].(map[string]any); ok {
+			s.usage.PromptTokens = intField(usage, "input_tokens") +
+				intField(usage, "cache_read_input_tokens") +
+				intField(usage, "cache_creation_input_tokens")
+		}
+		empty := ""
+		return s.writeChunk(c, types.OpenAIChunkDelta{Role: "assistant", Content: &empty}, nil)
+
+	case "content_block_start":
+		block, _ := event["content_block"].(map[string]any)
+		if getStringField(block, "type") != "tool_use" {
+			return nil
+		}
+		idx := len(s.toolIndex)
+		s.toolIndex[extractIndex(event)] = idx
+		return s.writeChunk(c, types.OpenAIChunkDelta{ToolCalls: []types.OpenAIToolCall{{
+			Index:    &idx,
+			ID:       getStringField(block, "id"),
+			Type:     "function",
+			Function: types.OpenAIFunctionCall{Name: getStringField(block, "name")},
+		}}}, nil)
+
+	case "content_block_delta":
+		delta, _ := event["delta"].(map[string]any)
+		switch getStringField(delta, "type") {
+		case "text_delta":
+			text := getStringField(delta, "text")
+			return s.writeChunk(c, types.OpenAIChunkDelta{Content: &text}, nil)
+		case "thinking_delta":
+			thinking := getStringField(delta, "thinking")
+			return s.writeChunk(c, types.OpenAIChunkDelta{ReasoningContent: &thinking}, nil)
+		case "input_json_delta":
+			idx, ok := s.toolIndex[extractIndex(event)]
+			if !ok {
+				return nil
+			}
+			return s.writeChunk(c, types.OpenAIChunkDelta{ToolCalls: []types.OpenAIToolCall{{
+				Index:    &idx,
+				Function: types.OpenAIFunctionCall{Arguments: getStringField(delta, "partial_json")},
+			}}}, nil)
+		}
+		return nil
+
+	case "message_delta":
+		delta, _ := event["delta"].(map[string]any)
+		if usage, ok := event["usage"].(map[string]any); ok {
+			s.usage.CompletionTokens = intField(usage, "output_tokens")
+		}
+		finishReason := openAIFinishReason(getStringField(delta, "stop_reason"))
+		return s.writeChunk(c, types.OpenAIChunkDelta{}, &finishReason)
+
+	case "message_stop":
+		if s.includeUsage {
+			s.usage.TotalTokens = s.usage.PromptTokens + s.usage.CompletionTokens
+			usage := s.usage
+			if err := s.writeData(c, types.OpenAIChatChunk{
+				ID:      s.id,
+				Object:  "chat.completion.chunk",
+				Created: s.created,
+				Model:   s.model,
+				Choices: []types.OpenAIChunkChoice{},
+				Usage:   &usage,
+			}); err != nil {
+				return err
+			}
+		}
+		return s.writeRaw(c, "[DONE]")
+
+	case "error":
+		errBody, _ := event["error"].(map[string]any)
+		if err := s.writeData(c, gin.H{"error": gin.H{
+			"message": getStringField(errBody, "message"),
+			"type":    getStringField(errBody, "type"),
+		}}); err != nil {
+			return err
+		}
+		return s.writeRaw(c, "[DONE]")
+	}
+	return nil
+}
+
+func (s *OpenAIStreamSender) SendError(c *gin.Context, message string, _ error) error {
+	return s.SendEvent(c, types.NewErrorEvent(errTypeOverloaded, message))
+}
+
+// writeChunk 发送单个 chat.completion.chunk
+func (s *OpenAIStreamSender) writeChunk(c *gin.Context, delta types.OpenAIChunkDelta, finishReason *string) error {
+	return s.writeData(c, types.OpenAIChatChunk{
+		ID:      s.id,
+		Object:  "chat.completion.chunk",
+		Created: s.created,
+		Model:   s.model,
+		Choices: []types.OpenAIChunkChoice{{Delta: delta, FinishReason: finishReason}},
+	})
+}
+
+func (s *OpenAIStreamSender) writeData(c *gin.Context, v any) error {
+	data, err := types.MarshalOrderedJSON(v)
+	if err != nil {
+		return err
+	}
+	return s.writeRaw(c, string(data))
+}
+
+func (s *OpenAIStreamSender) writeRaw(c *gin.Context, data string) error {
+	if _, err := fmt.Fprintf(c.Writer, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
+
+// intField 从映射中提取整数字段（兼容 int 和 JSON 解析出的 float64）
+func intField(m map[string]any, key string) int {
+	switch v := m[key].(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	}
+	return 0
+}
+
+// anthropicMessageResponse 非流式 Anthropic 响应中转换所需的字段
+type anthropicMessageResponse struct {
+	ID         string           `json:"id"`
+	Content    []map[string]any `json:"content"`
+	StopReason string           `json:"stop_reason"`
+	Usage      types.Usage      `json:"usage"`
+}
+
+// convertAnthropicResponse 将非流式 Anthropic 响应转换为 chat.completion
+func convertAnthropicResponse(resp anthropicMessageResponse, model string) types.OpenAIChatResponse {
+	var text, reasoning strings.Builder
+	var toolCalls []types.OpenAIToolCall
+	for _, block := range resp.Content {
+		switch getStringField(block, "type") {
+		case "text":
+			text.WriteString(getStringField(block, "text"))
+		case "thinking":
+			reasoning.WriteString(getStringField(block, "thinking"))
+		case "tool_use":
+			args, _ := utils.SafeMarshal(block["input"])
+			toolCalls = append(toolCalls, types.OpenAIToolCall{
+				ID:       getStringField(block, "id"),
+				Type:     "function",
+				Function: types.OpenAIFunctionCall{Name: getStringField(block, "name"), Arguments: string(args)},
+			})
+		}
+	}
+
+	message := types.OpenAIResponseMessage{
+		Role:             "assistant",
+		ReasoningContent: reasoning.String(),
+		ToolCalls:        toolCalls,
+	}
+	if text.Len() > 0 || len(toolCalls) == 0 {
+		content := text.String()
+		message.Content = &content
+	}
+
+	promptTokens := resp.Usage.InputTokens + resp.Usage.CacheReadInputTokens + resp.Usage.CacheCreationInputTokens
+	return types.OpenAIChatResponse{
+		ID:      openAICompletionID(resp.ID),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []types.OpenAIChoice{{
+			Message:      message,
+			FinishReason: openAIFinishReason(resp.StopReason),
+		}},
+		Usage: types.OpenAIUsage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: resp.Usage.OutputTokens,
+			TotalTokens:      promptTokens + resp.Usage.OutputTokens,
+		},
+	}
+}
+
+// respondOpenAIError 以 OpenAI 错误格式返回
+func respondOpenAIError(c *gin.Context, statusCode int, errType, message string) {
+	c.JSON(statusCode, gin.H{
+		"error": gin.H{
+			"message": message,
+			"type":    errType,
+			"code":    nil,
+		},
+	})
+}
+
+// extractErrorMessage 从 Anthropic 格式或通用格式的错误响应中提取错误信息和类型
+func extractErrorMessage(body []byte) (message, errType string) {
+	var parsed struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Code    string `json:"code"`
+		} `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := utils.SafeUnmarshal(body, &parsed); err != nil {
+		return string(body), errTypeAPI
+	}
+	message = parsed.Error.Message
+	if message == "" {
+		message = parsed.Message
+	}
+	errType = parsed.Error.Type
+	if errType == "" {
+		errType = parsed.Error.Code
+	}
+	if errType == "" {
+		errType = errTypeAPI
+	}
+	return message, errType
+}
+
+// capturingWriter 截获响应而不写出，用于在非流式响应返回前转换格式
+type capturingWriter struct {
+	gin.ResponseWriter
+	body   bytes.Buffer
+	status int
+}
+
+func (w *capturingWriter) WriteHeader(code int) {
+	w.status = code
+}
+
+func (w *capturingWriter) WriteHeaderNow() {}
+
+func (w *capturingWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *capturingWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+func (w *capturingWriter) Status() int {
+	return w.status
+}
+
+func (w *capturingWriter) Size() int {
+	return w.body.Len()
+}
+
+func (w *capturingWriter) Written() bool {
+	return w.body.Len() > 0
+}
@@ -0,0 +1,14 @@
+//go:build noopenai
+
+package server
+
+import "github.com/gin-gonic/gin"
+
+// openAICompatKey 使用 -tags noopenai 构建时不会被设置
+const openAICompatKey = "openaiCompat"
+
+// openAICompiled 使用 -tags noopenai 构建时 OpenAI 兼容端点不可用
+const openAICompiled = false
+
+// registerOpenAIRoutes 使用 -tags noopenai 构建时不注册 OpenAI 兼容端点
+func registerOpenAIRoutes(r *gin.Engine) {}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"kiro/parser"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * 非流式响应的部分结果保留
+ * 上游连接在非流式请求中途断开时，已收到的事件流仍可解析出部分文本和完整的工具调用。
+ * 此时返回这些内容（stop_reason 为 max_tokens，附带 warning 字段），而不是丢弃已生成内容并返回 500；
+ * 未完成的工具调用参数不完整，不会返回
+ */
+
+// partialResponseKey 上下文键：非流式响应因上游断开而不完整
+const partialResponseKey = "partialResponse"
+
+// partialStopReason 不完整响应使用的 stop_reason，客户端会按输出被截断处理（如继续生成）
+const partialStopReason = "max_tokens"
+
+// salvagePartialResponse 判断断开前收到的文本和已完成工具调用是否可以返回，可以时在上下文中记录不完整标记
+func salvagePartialResponse(c *gin.Context, result *parser.ParseResult, completedTools []*parser.ToolExecution, readErr error) bool {
+	if result == nil || (result.GetCompletionText() == "" && len(completedTools) == 0) {
+		return false
+	}
+	c.Set(partialResponseKey, true)
+	utils.RecordPolicy(c, "partial_response", "upstream disconnected mid-response (%v); returning partial content", readErr)
+	utils.Log("上游连接中途断开，返回已解析的部分内容",
+		addReqFields(c,
+			utils.LogErr(readErr),
+			utils.LogInt("completed_tools", len(completedTools)),
+		)...)
+	return true
+}
+
+// partialResponseWarning 不完整响应附带的 warning 字段
+func partialResponseWarning() map[string]any {
+	return map[string]any{
+		"type":    "upstream_disconnected",
+		"message": "The upstream connection dropped before the response completed; content is partial and incomplete tool calls were omitted",
+	}
+}
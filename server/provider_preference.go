@@ -0,0 +1,115 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"kiro/tenant"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// providerAnthropic 回退通道的提供方名称
+const providerAnthropic = "anthropic"
+
+// providerTokenTypes 提供方名称到上游 token 类型的映射
+var providerTokenTypes = map[string]types.TokenType{
+	"kiro":    types.TokenTypeKiro,
+	"amazonq": types.TokenTypeAmazonQ,
+	"q":       types.TokenTypeAmazonQ,
+	"idc":     types.TokenTypeIdC,
+}
+
+// validateProviderPreferences 校验提供方名称
+func validateProviderPreferences(pref *types.ProviderPreferences) error {
+	for _, name := range pref.Order {
+		name = strings.ToLower(name)
+		if _, ok := providerTokenTypes[name]; !ok && name != providerAnthropic {
+			return fmt.Errorf("provider.order: unknown provider %q (expected kiro, amazonq, idc or anthropic)", name)
+		}
+	}
+	return nil
+}
+
+// providerListed 提供方是否出现在 order 中
+func providerListed(pref *types.ProviderPreferences, name string) bool {
+	for _, p := range pref.Order {
+		if strings.EqualFold(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// providerAllowed 请求偏好是否允许使用指定提供方
+func providerAllowed(pref *types.ProviderPreferences, name string) bool {
+	if pref == nil || len(pref.Order) == 0 {
+		return pref.FallbacksAllowed()
+	}
+	return providerListed(pref, name) || pref.FallbacksAllowed()
+}
+
+// prefersAnthropicFirst 请求是否要求优先使用 Anthropic 回退通道
+func prefersAnthropicFirst(pref *types.ProviderPreferences) bool {
+	return pref != nil && len(pref.Order) > 0 && strings.EqualFold(pref.Order[0], providerAnthropic)
+}
+
+// tokenTypeOf 解析 token 类型，格式错误时返回 false
+func tokenTypeOf(token string) (types.TokenType, bool) {
+	parsed, err := ParseToken(token)
+	if err != nil {
+		return 0, false
+	}
+	return parsed.Type, true
+}
+
+/**
+ * applyProviderPreferences 按请求的提供方偏好重新选择上游 token
+ * 租户请求按 order 依次在 token 池中查找对应类型的 token；
+ * 非租户请求只能使用自身 token，类型不在 order 中且不允许回退时返回错误
+ */
+func applyProviderPreferences(c *gin.Context, pref *types.ProviderPreferences) error {
+	if pref == nil || len(pref.Order) == 0 {
+		return nil
+	}
+
+	// 当前 token 无法解析时类型未知，不按偏好切换，保留当前 token
+	currentType, ok := tokenTypeOf(c.GetString("refreshToken"))
+	if !ok {
+		utils.Debug("当前 token 类型无法识别，忽略提供方偏好")
+		return nil
+	}
+	if profile := tokenPoolProfile(c); profile != nil {
+		for _, name := range pref.Order {
+			tokenType, ok := providerTokenTypes[strings.ToLower(name)]
+			if !ok {
+				continue
+			}
+			if tokenType == currentType {
+				return nil
+			}
+			entry, found := tenant.NextTokenMatching(profile, func(e tenant.TokenEntry) bool {
+				t, ok := tokenTypeOf(e.Token)
+				return ok && t == tokenType
+			})
+			if !found {
+				continue
+			}
+			utils.Debug("按提供方偏好切换上游 token: %s", tokenType)
+			utils.RecordPolicy(c, "provider_preference", "switched upstream token to provider %s", name)
+			return bindUpstreamToken(c, entry.Token, entry.AccountLabels)
+		}
+	}
+
+	for name, tokenType := range providerTokenTypes {
+		if tokenType == currentType && providerListed(pref, name) {
+			return nil
+		}
+	}
+	if pref.FallbacksAllowed() || providerListed(pref, providerAnthropic) {
+		return nil
+	}
+	return fmt.Errorf("no configured provider matches provider.order %v and allow_fallbacks is false", pref.Order)
+}
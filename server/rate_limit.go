@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"kiro/config"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// keyWindow 单个本地 API Key 的固定窗口计数（1 分钟）
+type keyWindow struct {
+	start    time.Time
+	requests int
+	tokens   int
+}
+
+var (
+	keyWindows     = make(map[string]*keyWindow)
+	keyWindowMutex sync.Mutex
+)
+
+// keyWindowPruneThreshold 窗口数量超过该值时清理已过期的窗口
+const keyWindowPruneThreshold = 1024
+
+/**
+ * keyRateLimits 返回当前请求的 API Key 限额（每分钟请求数、每分钟 token 数）
+ * 租户配置的 key_requests_per_minute / key_tokens_per_minute 优先，否则使用全局配置
+ */
+func keyRateLimits(c *gin.Context) (rpm, tpm int) {
+	settings := config.Current()
+	rpm, tpm = settings.KeyRequestsPerMinute, settings.KeyTokensPerMinute
+	if profile := GetTenant(c); profile != nil {
+		if profile.RateLimit.KeyRequestsPerMinute > 0 {
+			rpm = profile.RateLimit.KeyRequestsPerMinute
+		}
+		if profile.RateLimit.KeyTokensPerMinute > 0 {
+			tpm = profile.RateLimit.KeyTokensPerMinute
+		}
+	}
+	return rpm, tpm
+}
+
+/**
+ * RateLimitMiddleware 按本地 API Key 限制每分钟请求数和 token 用量
+ * token 用量在请求完成后累计（输入 + 输出），本窗口用量已达上限时拒绝新请求直到窗口重置
+ * 超限时返回 Anthropic 格式的 rate_limit_error 和 Retry-After，所有响应都附带 anthropic-ratelimit-* 响应头
+ */
+func RateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rpm, tpm := keyRateLimits(c)
+		keyHash := c.GetString("apiKeyHash")
+		if (rpm <= 0 && tpm <= 0) || keyHash == "" {
+			c.Next()
+			return
+		}
+
+		reason, state := admitKeyRequest(keyHash, rpm, tpm)
+		setKeyRateLimitHeaders(c, rpm, tpm, state)
+		if reason != "" {
+			utils.Log("API Key 触发限流",
+				addReqFields(c,
+					utils.LogString("reason", reason),
+					utils.LogString("tenant", tenantName(c)),
+				)...)
+			respondAnthropicError(c, &UpstreamError{
+				StatusCode: http.StatusTooManyRequests,
+				Type:       errTypeRateLimit,
+				Message:    fmt.Sprintf("This API key has exceeded its rate limit of %s, please retry later", reason),
+				ResetAt:    state.resetAt,
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// admitKeyRequest 检查并占用一次请求额度，超限时返回原因；同时返回占用后的窗口状态
+func admitKeyRequest(keyHash string, rpm, tpm int) (string, keyWindowState) {
+	keyWindowMutex.Lock()
+	defer keyWindowMutex.Unlock()
+
+	now := time.Now()
+	w, ok := keyWindows[keyHash]
+	if !ok || now.Sub(w.start) >= time.Minute {
+		if !ok && len(keyWindows) >= keyWindowPruneThreshold {
+			pruneKeyWindows(now)
+		}
+		w = &keyWindow{start: now}
+		keyWindows[keyHash] = w
+	}
+
+	state := keyWindowState{requests: w.requests, tokens: w.tokens, resetAt: w.start.Add(time.Minute)}
+	if rpm > 0 && w.requests >= rpm {
+		return fmt.Sprintf("%d requests per minute", rpm), state
+	}
+	if tpm > 0 && w.tokens >= tpm {
+		return fmt.Sprintf("%d tokens per minute", tpm), state
+	}
+	w.requests++
+	state.requests = w.requests
+	return "", state
+}
+
+// recordKeyTokens 将请求完成时的 token 用量计入 API Key 当前窗口
+func recordKeyTokens(c *gin.Context, tokens int) {
+	keyHash := c.GetString("apiKeyHash")
+	if keyHash == "" {
+		return
+	}
+
+	keyWindowMutex.Lock()
+	defer keyWindowMutex.Unlock()
+	if w, ok := keyWindows[keyHash]; ok && time.Since(w.start) < time.Minute {
+		w.tokens += tokens
+	}
+}
+
+// pruneKeyWindows 清理已过期的窗口（调用方持有锁）
+func pruneKeyWindows(now time.Time) {
+	for hash, w := range keyWindows {
+		if now.Sub(w.start) >= time.Minute {
+			delete(keyWindows, hash)
+		}
+	}
+}
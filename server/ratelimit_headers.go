@@ -0,0 +1,58 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * Anthropic 风格的限流响应头
+ * Claude Code 等客户端读取 anthropic-ratelimit-* 响应头决定退避，这里按代理自己的状态计算：
+ * - API Key 限流（RATE_LIMIT_RPM / RATE_LIMIT_TPM）：当前 1 分钟窗口的上限、剩余和重置时间，只输出已配置的维度
+ * - 上游账号额度耗尽：requests / tokens 剩余均为 0，重置时间为额度重置时间
+ */
+
+const (
+	headerRequestsLimit     = "anthropic-ratelimit-requests-limit"
+	headerRequestsRemaining = "anthropic-ratelimit-requests-remaining"
+	headerRequestsReset     = "anthropic-ratelimit-requests-reset"
+	headerTokensLimit       = "anthropic-ratelimit-tokens-limit"
+	headerTokensRemaining   = "anthropic-ratelimit-tokens-remaining"
+	headerTokensReset       = "anthropic-ratelimit-tokens-reset"
+)
+
+// keyWindowState API Key 当前窗口的用量快照
+type keyWindowState struct {
+	requests int
+	tokens   int
+	resetAt  time.Time
+}
+
+// setKeyRateLimitHeaders 按 API Key 窗口状态设置限流响应头
+func setKeyRateLimitHeaders(c *gin.Context, rpm, tpm int, state keyWindowState) {
+	reset := state.resetAt.UTC().Format(time.RFC3339)
+	if rpm > 0 {
+		c.Header(headerRequestsLimit, strconv.Itoa(rpm))
+		c.Header(headerRequestsRemaining, strconv.Itoa(max(rpm-state.requests, 0)))
+		c.Header(headerRequestsReset, reset)
+	}
+	if tpm > 0 {
+		c.Header(headerTokensLimit, strconv.Itoa(tpm))
+		c.Header(headerTokensRemaining, strconv.Itoa(max(tpm-state.tokens, 0)))
+		c.Header(headerTokensReset, reset)
+	}
+}
+
+// setQuotaRateLimitHeaders 上游账号额度耗尽时设置限流响应头，重置时间未知时按 Retry-After 的默认值推算
+func setQuotaRateLimitHeaders(c *gin.Context, resetAt time.Time) {
+	if resetAt.IsZero() {
+		resetAt = time.Now().Add(quotaExhaustedRetryFallback)
+	}
+	reset := resetAt.UTC().Format(time.RFC3339)
+	c.Header(headerRequestsRemaining, "0")
+	c.Header(headerRequestsReset, reset)
+	c.Header(headerTokensRemaining, "0")
+	c.Header(headerTokensReset, reset)
+}
@@ -0,0 +1,332 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * 请求记录与回放
+ * 保留最近 REQUEST_LOG_SIZE 条已完成请求（转换后的请求和下发内容），管理端点可以重新执行其中一条
+ * （可换 token 或模型）并与原响应比较，用于排查上游行为变化导致的“昨天还好好的”问题
+ * 记录只保存在内存中，不包含任何凭证，上游 token 以 /admin/tokens 的 ID 引用
+ */
+
+// recordedRequest 一条已完成请求的记录
+type recordedRequest struct {
+	ID           string
+	Time         time.Time
+	Tenant       string
+	TokenHash    string // 上游 refresh token 的 SHA256，回放时查找缓存的 token
+	Request      types.AnthropicRequest
+	Content      []any
+	StopReason   string
+	InputTokens  int
+	OutputTokens int
+	Stream       bool
+}
+
+// requestLog 最近请求的环形记录
+type requestLog struct {
+	mu      sync.Mutex
+	entries []*recordedRequest
+	size    int
+}
+
+var recentRequests = &requestLog{size: config.Current().RequestLogSize}
+
+// requestLogEnabled 是否记录请求供回放
+func requestLogEnabled() bool {
+	return recentRequests.size > 0
+}
+
+// recordRequest 记录一次已完成的请求，超出容量时丢弃最早的记录
+func recordRequest(c *gin.Context, rec evalRecord) {
+	if !requestLogEnabled() {
+		return
+	}
+	entry := &recordedRequest{
+		ID:           GetRequestID(c),
+		Time:         rec.EndTime,
+		TokenHash:    c.GetString("tokenHash"),
+		Request:      rec.Request,
+		Content:      rec.Content,
+		StopReason:   rec.StopReason,
+		InputTokens:  rec.InputTokens,
+		OutputTokens: rec.OutputTokens,
+		Stream:       rec.Stream,
+	}
+	if entry.ID == "" {
+		entry.ID = utils.GenerateUUID()
+	}
+	if profile := GetTenant(c); profile != nil {
+		entry.Tenant = profile.Name
+	}
+
+	recentRequests.mu.Lock()
+	defer recentRequests.mu.Unlock()
+	recentRequests.entries = append(recentRequests.entries, entry)
+	if overflow := len(recentRequests.entries) - recentRequests.size; overflow > 0 {
+		recentRequests.entries = append([]*recordedRequest(nil), recentRequests.entries[overflow:]...)
+	}
+}
+
+// findRecordedRequest 按请求 ID 查找记录
+func findRecordedRequest(id string) (*recordedRequest, bool) {
+	recentRequests.mu.Lock()
+	defer recentRequests.mu.Unlock()
+	for _, entry := range recentRequests.entries {
+		if entry.ID == id {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// recordedRequestView 管理端点展示的请求摘要
+type recordedRequestView struct {
+	ID           string    `json:"id"`
+	Time         time.Time `json:"time"`
+	Model        string    `json:"model"`
+	Tenant       string    `json:"tenant,omitempty"`
+	TokenID      string    `json:"token_id,omitempty"` // 与 /admin/tokens 的 id 一致
+	Stream       bool      `json:"stream"`
+	StopReason   string    `json:"stop_reason"`
+	InputTokens  int       `json:"input_tokens"`
+	OutputTokens int       `json:"output_tokens"`
+}
+
+func (r *recordedRequest) view() recordedRequestView {
+	view := recordedRequestView{
+		ID:           r.ID,
+		Time:         r.Time,
+		Model:        r.Request.Model,
+		Tenant:       r.Tenant,
+		Stream:       r.Stream,
+		StopReason:   r.StopReason,
+		InputTokens:  r.InputTokens,
+		OutputTokens: r.OutputTokens,
+	}
+	if len(r.TokenHash) >= 16 {
+		view.TokenID = r.TokenHash[:16]
+	}
+	return view
+}
+
+// handleAdminRequests GET /admin/requests 列出最近记录的请求（新的在前）
+func handleAdminRequests(c *gin.Context) {
+	recentRequests.mu.Lock()
+	views := make([]recordedRequestView, 0, len(recentRequests.entries))
+	for i := len(recentRequests.entries) - 1; i >= 0; i-- {
+		views = append(views, recentRequests.entries[i].view())
+	}
+	recentRequests.mu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"object":  "list",
+		"enabled": requestLogEnabled(),
+		"data":    views,
+	})
+}
+
+// replayOptions 回放参数，均可省略
+type replayOptions struct {
+	Model   string `json:"model"`    // 换用的模型
+	TokenID string `json:"token_id"` // 换用的上游 token（/admin/tokens 的 id），默认使用原请求的 token
+}
+
+/**
+ * handleAdminReplayRequest POST /admin/requests/:id/replay 以非流式方式重新执行记录的请求，并与原响应比较
+ * 上游返回错误时直接返回该错误
+ */
+func handleAdminReplayRequest(c *gin.Context) {
+	entry, ok := findRecordedRequest(c.Param("id"))
+	if !ok {
+		respondError(c, http.StatusNotFound, "%s", "请求记录不存在")
+		return
+	}
+
+	var opts replayOptions
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&opts); err != nil {
+			respondError(c, http.StatusBadRequest, "解析回放参数失败: %v", err)
+			return
+		}
+	}
+
+	tokenID := opts.TokenID
+	if tokenID == "" {
+		tokenID = entry.TokenHash
+	}
+	_, cached, found := findCachedToken(tokenServiceOf(c), tokenID)
+	if !found {
+		respondError(c, http.StatusNotFound, "%s", "token 不存在，请通过 token_id 指定 /admin/tokens 中的 token")
+		return
+	}
+	if err := bindUpstreamToken(c, cached.RefreshToken, cached.Labels); err != nil {
+		respondError(c, http.StatusBadGateway, "获取 token 失败: %v", err)
+		return
+	}
+	token := types.TokenInfo{
+		AccessToken:  c.GetString("accessToken"),
+		RefreshToken: cached.RefreshToken,
+		ProfileArn:   c.GetString("profileArn"),
+	}
+
+	req := entry.Request
+	req.Stream = false
+	if opts.Model != "" {
+		req.Model = opts.Model
+	}
+
+	utils.Info("管理端点回放请求: %s (model=%s)", entry.ID, req.Model)
+	start := time.Now()
+	result, allTools, ok := fetchNonStreamResponse(c, req, token)
+	if !ok {
+		return
+	}
+
+	content := make([]any, 0, len(allTools)+2)
+	for _, block := range responseTextBlocks(result.GetCompletionText(), req.Thinking != nil && req.Thinking.Type == "enabled") {
+		content = append(content, block)
+	}
+	stopReason := "end_turn"
+	for _, tool := range allTools {
+		input := tool.Arguments
+		if input == nil {
+			input = map[string]any{}
+		}
+		content = append(content, map[string]any{"type": "tool_use", "id": tool.ID, "name": tool.Name, "input": input})
+		stopReason = "tool_use"
+	}
+
+	original := entry.view()
+	c.JSON(http.StatusOK, gin.H{
+		"id": entry.ID,
+		"original": gin.H{
+			"model":       original.Model,
+			"token_id":    original.TokenID,
+			"stop_reason": entry.StopReason,
+			"content":     entry.Content,
+		},
+		"replay": gin.H{
+			"model":       req.Model,
+			"token_id":    c.GetString("tokenHash")[:16],
+			"stop_reason": stopReason,
+			"content":     content,
+			"duration_ms": time.Since(start).Milliseconds(),
+		},
+		"diff": diffResponses(entry.StopReason, entry.Content, stopReason, content),
+	})
+}
+
+// replayDiff 原响应与回放响应的差异
+type replayDiff struct {
+	Identical  bool       `json:"identical"`
+	StopReason []string   `json:"stop_reason,omitempty"` // [原响应, 回放]，相同时省略
+	ToolCalls  [][]string `json:"tool_calls,omitempty"`  // 调用的工具名 [原响应, 回放]，相同时省略
+	Text       []string   `json:"text,omitempty"`        // 正文按行比较："  " 相同、"- " 仅原响应、"+ " 仅回放；相同时省略
+}
+
+// diffResponses 比较两次响应的 stop_reason、工具调用和正文
+func diffResponses(oldStop string, oldContent []any, newStop string, newContent []any) replayDiff {
+	var diff replayDiff
+	if oldStop != newStop {
+		diff.StopReason = []string{oldStop, newStop}
+	}
+	oldText, oldTools := contentSummary(oldContent)
+	newText, newTools := contentSummary(newContent)
+	if strings.Join(oldTools, ",") != strings.Join(newTools, ",") {
+		diff.ToolCalls = [][]string{oldTools, newTools}
+	}
+	if oldText != newText {
+		diff.Text = diffLines(strings.Split(oldText, "\n"), strings.Split(newText, "\n"))
+	}
+	diff.Identical = diff.StopReason == nil && diff.ToolCalls == nil && diff.Text == nil
+	return diff
+}
+
+// contentSummary 提取内容块中的正文和工具调用名称（忽略 thinking）
+func contentSummary(content []any) (string, []string) {
+	var blocks []map[string]any
+	if data, err := utils.SafeMarshal(content); err == nil {
+		_ = utils.SafeUnmarshal(data, &blocks)
+	}
+	var texts []string
+	tools := []string{}
+	for _, block := range blocks {
+		switch block["type"] {
+		case "text":
+			text, _ := block["text"].(string)
+			texts = append(texts, text)
+		case "tool_use", "server_tool_use":
+			name, _ := block["name"].(string)
+			tools = append(tools, name)
+		}
+	}
+	return strings.Join(texts, "\n"), tools
+}
+
+// diffLinesMax 逐行比较的行数上限，超出时整体视为替换
+const diffLinesMax = 2000
+
+// diffLines 基于最长公共子序列的逐行比较
+func diffLines(a, b []string) []string {
+	if len(a) > diffLinesMax || len(b) > diffLinesMax {
+		out := make([]string, 0, len(a)+len(b))
+		for _, line := range a {
+			out = append(out, "- "+line)
+		}
+		for _, line := range b {
+			out = append(out, "+ "+line)
+		}
+		return out
+	}
+
+	// lcs[i][j] 为 a[i:] 与 b[j:] 的最长公共子序列长度
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, "  "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "- "+a[i])
+			i++
+		default:
+			out = append(out, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+ "+b[j])
+	}
+	return out
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"kiro/config"
+	"kiro/tenant"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultRootRedirectURL 根路径默认的重定向地址
+const defaultRootRedirectURL = "https://www.bilibili.com/video/BV1cp4y1Q7yn"
+
+// serverStartTime 服务启动时间，用于健康摘要中的运行时长
+var serverStartTime = time.Now()
+
+/**
+ * rootHandler 根据 ROOT_MODE 构建根路径处理器
+ * redirect（默认）: 重定向到 ROOT_REDIRECT_URL
+ * status: 返回最简状态页
+ * health: 返回健康摘要（tokenizer 降级时 status 为 degraded），携带有效 ADMIN_API_KEY 时附带 token 缓存、租户等详情
+ * none: 返回 404
+ */
+func rootHandler() gin.HandlerFunc {
+	mode := config.Current().RootMode
+	switch mode {
+	case "status":
+		return func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		}
+	case "health":
+		return handleRootHealth
+	case "none":
+		return func(c *gin.Context) {
+			respondError(c, http.StatusNotFound, "%s", "404 未找到")
+		}
+	case "", "redirect":
+		target := config.Current().RootRedirectURL
+		if target == "" {
+			target = defaultRootRedirectURL
+		}
+		return func(c *gin.Context) {
+			c.Redirect(http.StatusMovedPermanently, target)
+		}
+	default:
+		utils.Error("无效的 ROOT_MODE=%s，根路径返回 404", mode)
+		return func(c *gin.Context) {
+			respondError(c, http.StatusNotFound, "%s", "404 未找到")
+		}
+	}
+}
+
+// handleRootHealth 健康摘要，详情仅对管理密钥可见
+func handleRootHealth(c *gin.Context) {
+	summary := gin.H{
+		"status":         "ok",
+		"uptime_seconds": int(time.Since(serverStartTime).Seconds()),
+	}
+	tokenizer := utils.GetTokenizerHealth()
+	if tokenizer.Degraded {
+		// 降级不影响服务可用性，仅作为告警提示
+		summary["status"] = "degraded"
+		summary["warnings"] = []string{"tokenizer degraded to approximate counting"}
+	}
+	if adminKeyValid(c) {
+		summary["tokenizer"] = tokenizer
+		summary["version"] = config.KiroCLIVersion
+		summary["cached_tokens"] = tokenServiceOf(c).Count()
+		summary["prompt_cache"] = cacheServiceOf(c).Stats()
+		summary["tenants"] = tenant.Count()
+		summary["anthropic_fallback"] = fallbackProvider != nil
+	}
+	c.JSON(http.StatusOK, summary)
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"kiro/rules"
+	"kiro/tenant"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 路由规则写入上下文的键
+const (
+	routePoolKey       = "routePool"    // 规则指定的租户 token 池（*tenant.Profile，全局池为 nil）
+	requestPriorityKey = "priority"     // 请求优先级
+	appliedRulesKey    = "appliedRules" // 命中的规则名
+)
+
+/**
+ * applyRoutingRules 评估 data/rules.json 中的路由规则并执行命中的动作
+ * 规则要求拒绝时返回对应的错误；路由目标不可用时返回 503
+ */
+func applyRoutingRules(c *gin.Context, req *types.AnthropicRequest) *UpstreamError {
+	if rules.Count() == 0 {
+		return nil
+	}
+
+	result := rules.Evaluate(rules.Request{
+		Model:   req.Model,
+		Tenant:  tenantName(c),
+		KeyHash: c.GetString("apiKeyHash"),
+		Headers: c.Request.Header,
+		Tokens: func() int {
+			return estimateInputTokens(utils.NewTokenEstimator(), *req)
+		},
+	})
+	if len(result.Applied) == 0 {
+		return nil
+	}
+
+	c.Set(appliedRulesKey, result.Applied)
+	for _, name := range result.Applied {
+		utils.RecordPolicy(c, "routing_rule", "%s", name)
+	}
+	utils.Log("命中路由规则",
+		addReqFields(c,
+			utils.LogString("rules", strings.Join(result.Applied, ",")),
+			utils.LogString("tenant", tenantName(c)),
+		)...)
+
+	if result.Reject != nil {
+		message := result.Reject.Message
+		if message == "" {
+			message = "Request rejected by routing policy"
+		}
+		return &UpstreamError{StatusCode: result.Reject.Status, Message: message, Type: errorTypeForStatus(result.Reject.Status)}
+	}
+
+	if result.Priority != nil {
+		c.Set(requestPriorityKey, *result.Priority)
+		utils.RecordPolicy(c, "priority", "request priority set to %d", *result.Priority)
+	}
+
+	for _, prompt := range result.InjectPrompt {
+		req.System = append(req.System, types.AnthropicSystemMessage{Type: "text", Text: prompt})
+		utils.RecordPolicy(c, "prompt_injection", "appended %d chars to the system prompt", len(prompt))
+	}
+
+	if result.Route != "" {
+		if err := routeToPool(c, result.Route); err != nil {
+			utils.Error("路由规则切换 token 池失败: %v", err)
+			return &UpstreamError{StatusCode: http.StatusServiceUnavailable, Message: "Routing target is unavailable", Type: errTypeAPI}
+		}
+		utils.RecordPolicy(c, "route", "routed to token pool %s", result.Route)
+	}
+	return nil
+}
+
+/**
+ * routeToPool 将请求切换到指定 token 池：租户名或 global（全局 token 池）
+ * 后续的失败切换（403/429、首字节超时）也在该池内进行
+ */
+func routeToPool(c *gin.Context, pool string) error {
+	if pool == rules.PoolGlobal {
+		next, found := tokenServiceOf(c).NextPoolToken("")
+		if !found {
+			return fmt.Errorf("全局 token 池未启用")
+		}
+		if err := bindUpstreamToken(c, next, tenant.AccountLabels{}); err != nil {
+			return err
+		}
+		c.Set(routePoolKey, (*tenant.Profile)(nil))
+		c.Set("tokenPool", true)
+		return nil
+	}
+
+	profile := tenant.Find(pool)
+	if profile == nil {
+		return fmt.Errorf("token 池不存在: %s", pool)
+	}
+	entry, err := tenant.NextToken(profile)
+	if err != nil {
+		return err
+	}
+	if err := bindUpstreamToken(c, entry.Token, entry.AccountLabels); err != nil {
+		return err
+	}
+	c.Set(routePoolKey, profile)
+	return nil
+}
+
+// errorTypeForStatus 按 HTTP 状态码返回 Anthropic 错误类型
+func errorTypeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return errTypeInvalidRequest
+	case http.StatusUnauthorized:
+		return errTypeAuthentication
+	case http.StatusForbidden:
+		return errTypePermission
+	case http.StatusNotFound:
+		return errTypeNotFound
+	case http.StatusRequestEntityTooLarge:
+		return errTypeRequestTooLarge
+	case http.StatusTooManyRequests:
+		return errTypeRateLimit
+	case statusOverloaded:
+		return errTypeOverloaded
+	default:
+		return errTypeAPI
+	}
+}
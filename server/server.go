@@ -1,14 +1,20 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
 	"kiro/cache"
 	"kiro/config"
+	"kiro/converter"
+	"kiro/lifecycle"
 	"kiro/proxy"
+	"kiro/rules"
+	"kiro/tenant"
+	"kiro/tracing"
 
 	"kiro/types"
 	"kiro/utils"
@@ -17,40 +23,220 @@ import (
 )
 
 /**
- * StartServer 启动HTTP代理服务器
+ * Server 可嵌入的代理服务
+ * New 初始化各子系统并构建路由：Handler 可以挂到其他 Go 服务或 httptest 上使用，
+ * ListenAndServe 按 BIND_ADDRESS 和 HTTPS 配置监听，ctx 取消时优雅退出
+ * token 缓存、Prompt Cache 和上游请求入口属于各个 Server（可通过 Option 注入），
+ * 签名存储、租户配置、后台任务等其余子系统是进程级的，生产环境一个进程只应创建一个 Server
  */
-func StartServer(port string) {
-	// 初始化 Prompt Cache（每5分钟清理过期条目）
-	cache.InitGlobalCache(5 * time.Minute)
+type Server struct {
+	opts    serverOptions
+	handler http.Handler
+}
+
+// serverOptions New 的可选项
+type serverOptions struct {
+	port      string
+	ginMode   string
+	accessLog bool
+	services  services
+}
+
+// Option 配置 Server 的可选项
+type Option func(*serverOptions)
+
+// defaultPort 未配置端口时的监听端口
+const defaultPort = "1188"
+
+// WithPort 设置监听端口，默认使用配置中的 port，为空时为 1188
+func WithPort(port string) Option {
+	return func(o *serverOptions) {
+		o.port = port
+	}
+}
+
+// WithGinMode 设置 gin 运行模式（debug / release / test），默认读取 GIN_MODE，为空时为 release
+func WithGinMode(mode string) Option {
+	return func(o *serverOptions) {
+		o.ginMode = mode
+	}
+}
+
+// WithAccessLog 设置是否输出 gin 访问日志，默认输出
+func WithAccessLog(enabled bool) Option {
+	return func(o *serverOptions) {
+		o.accessLog = enabled
+	}
+}
+
+/**
+ * New 初始化子系统并创建代理服务
+ * 配置文件需在调用前通过 config.Init 加载
+ */
+func New(opts ...Option) *Server {
+	o := serverOptions{
+		port:      config.Current().Port,
+		ginMode:   config.Current().GinMode,
+		accessLog: true,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.port == "" {
+		o.port = defaultPort
+	}
+	if o.ginMode == "" {
+		o.ginMode = gin.ReleaseMode
+	}
+
+	initSubsystems(&o)
+	router := newRouter(o)
+	o.services.batches.dispatch = router
+	return &Server{opts: o, handler: router}
+}
+
+// Handler 返回代理的 HTTP 处理器
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+/**
+ * StartTokenRefresher 启动定时 token 刷新器（每 45 分钟刷新所有缓存的 token）
+ * 在 Close 时停止
+ */
+func (s *Server) StartTokenRefresher() {
+	s.opts.services.tokens.StartRefresher()
+}
+
+// Port 返回监听端口
+func (s *Server) Port() string {
+	return s.opts.port
+}
+
+// initSubsystems 初始化缓存、租户、token 池、持久化存储等子系统并启动后台任务，未注入的服务使用默认实现
+func initSubsystems(o *serverOptions) {
+	svc := &o.services
+	if svc.tokens == nil {
+		svc.tokens = NewTokenService()
+	}
+	if svc.upstream == nil {
+		svc.upstream = codeWhispererClient{}
+	}
+
+	// 初始化 Prompt Cache（PROMPT_CACHE=disabled 时不启用，请求按无缓存统计）
+	if svc.cache == nil {
+		if strings.EqualFold(config.Current().PromptCacheMode, "disabled") {
+			utils.Log("Prompt Cache 已禁用", utils.LogString("env", "PROMPT_CACHE=disabled"))
+			svc.cache = noPromptCache{}
+		} else {
+			svc.cache = cache.StartPromptCache(time.Duration(config.Current().PromptCacheCleanIntervalSeconds)*time.Second, cache.Limits{
+				MaxEntries: config.Current().PromptCacheMaxEntries,
+				MaxTokens:  config.Current().PromptCacheMaxTokens,
+			})
+		}
+	}
 
 	// 初始化代理管理器
-	skipTLS := os.Getenv("GIN_MODE") == "debug"
+	skipTLS := o.ginMode == gin.DebugMode
 	proxy.Init(skipTLS)
 	proxy.StartCleanupTicker()
 
+	// 配置文件热重载（SIGHUP 或文件修改后生效）
+	config.StartReloadWatcher()
+
+	// 初始化租户配置
+	tenant.Init()
+	tenant.StartReloadTicker()
+
+	// 初始化 OTLP 追踪导出（可选）
+	tracing.Init()
+
+	// 加载路由规则（可选）
+	rules.Init()
+	rules.StartReloadTicker()
+
+	// 加载全局 token 池（可选）
+	InitTokenPool(svc.tokens)
+
+	// 预加载 tokenizer，失败时降级为近似计数并在健康摘要中提示
+	if err := utils.InitTokenizer(); err != nil {
+		utils.Error("%v，token 计数已降级为近似算法", err)
+	}
+
+	// 恢复持久化的 token 缓存（可选）
+	InitTokenStore(svc.tokens)
+
 	// 初始化签名持久化存储
 	InitSignatureStore()
 	StartSignatureCleanup()
 
-	// 设置 gin 模式
-	ginMode := os.Getenv("GIN_MODE")
-	if ginMode == "" {
-		ginMode = gin.ReleaseMode
-	}
-	gin.SetMode(ginMode)
+	// 初始化用量记账（可选）
+	InitUsageStore()
+
+	// 初始化评估旁路（可选）
+	InitEvalTee()
+
+	// 初始化 TTFT SLO 监控（可选）
+	InitTTFTSLO()
+
+	// 初始化 Message Batches（BATCH_DB 配置时持久化）
+	svc.batches = newBatchStore()
+
+	// 会话状态存储（CONVERSATION_STORE_SIZE 配置时启用，供会话分叉使用）
+	svc.conversations = newConversationStore(config.Current().ConversationStoreSize)
+
+	// Agent 循环的历史增量转换缓存
+	svc.history = converter.NewHistoryCache()
 
+	// 初始化 Anthropic 回退通道（可选）
+	InitAnthropicFallback()
+	InitBedrock()
+
+	// 预热上游连接（可选）
+	utils.StartConnectionWarmer()
+}
+
+// newRouter 注册中间件和路由
+func newRouter(o serverOptions) *gin.Engine {
+	gin.SetMode(o.ginMode)
 	r := gin.New()
 
 	// 添加中间件
-	r.Use(gin.Logger())
+	if o.accessLog {
+		r.Use(gin.Logger())
+	}
 	r.Use(gin.Recovery())
+	r.Use(servicesMiddleware(&o.services))
 	r.Use(RequestIDMiddleware())
+	r.Use(TracingMiddleware())
 	r.Use(corsMiddleware())
-
-	// 根路径重定向（无需认证）
-	r.GET("/", func(c *gin.Context) {
-		c.Redirect(http.StatusMovedPermanently, "https://www.bilibili.com/video/BV1cp4y1Q7yn")
-	})
+	r.Use(sseGzipMiddleware())
+	r.Use(RequestBodyLimitMiddleware())
+
+	// 根路径（无需认证，行为由 ROOT_MODE 配置）
+	r.GET("/", rootHandler())
+
+	// 错误码目录（无需认证）
+	r.GET("/errors", handleErrorCatalog)
+
+	// 管理端点（使用独立的 ADMIN_API_KEY 认证）
+	admin := r.Group("/admin", AdminAuthMiddleware())
+	admin.GET("/tokens", handleAdminTokens)
+	admin.DELETE("/tokens/:id", handleAdminInvalidateToken)
+	admin.POST("/tokens/:id/refresh", handleAdminRefreshToken)
+	admin.GET("/cache", handleAdminCacheStats)
+	admin.GET("/cache/keys", handleAdminCacheKeys)
+	admin.DELETE("/cache", handleAdminFlushCache)
+	admin.GET("/usage", handleAdminUsage)
+	admin.GET("/ttft", handleAdminTTFT)
+	admin.GET("/incidents", handleAdminIncidents)
+	admin.GET("/incidents/:id", handleAdminIncident)
+	admin.GET("/endpoints", handleAdminEndpoints)
+	admin.GET("/requests", handleAdminRequests)
+	admin.POST("/requests/:id/replay", handleAdminReplayRequest)
+
+	// 用量查询（使用 ADMIN_API_KEY 认证，供运营方计费或监控）
+	r.GET("/v1/usage", AdminAuthMiddleware(), handleUsageQuery)
 
 	r.Use(AuthMiddleware()) // 应用到所有 API 端点
 
@@ -58,7 +244,11 @@ func StartServer(port string) {
 	r.GET("/v1/models", func(c *gin.Context) {
 		// 构建模型列表
 		models := []types.Model{}
-		for anthropicModel := range config.ModelMap {
+		profile := GetTenant(c)
+		for anthropicModel := range config.Current().ModelMap {
+			if profile != nil && !profile.ModelAllowed(anthropicModel) {
+				continue
+			}
 			model := types.Model{
 				ID:          anthropicModel,
 				Object:      "model",
@@ -66,7 +256,7 @@ func StartServer(port string) {
 				OwnedBy:     "anthropic",
 				DisplayName: anthropicModel,
 				Type:        "text",
-				MaxTokens:   200000,
+				MaxTokens:   config.ContextWindowTokens,
 			}
 			models = append(models, model)
 		}
@@ -79,26 +269,34 @@ func StartServer(port string) {
 		c.JSON(http.StatusOK, response)
 	})
 
+	// GET /v1/capabilities 端点：按模型描述支持的特性，供客户端做特性检测
+	r.GET("/v1/capabilities", handleCapabilities)
+
 	// POST /v1/messages 端点
-	r.POST("/v1/messages", func(c *gin.Context) {
+	r.POST("/v1/messages", UsageRecordMiddleware(), RateLimitMiddleware(), func(c *gin.Context) {
 		// 从上下文获取 access token
-		accessToken, exists := c.Get("accessToken")
-		if !exists {
+		// Bedrock 租户和 Anthropic 直连不绑定上游 token
+		if _, exists := c.Get("accessToken"); !exists && !tokenlessRequest(c) {
 			respondError(c, http.StatusUnauthorized, "%s", "未找到访问令牌")
 			return
 		}
 
 		tokenInfo := types.TokenInfo{
-			AccessToken: accessToken.(string),
+			AccessToken: c.GetString("accessToken"),
 		}
 
 		// 读取请求体
 		body, err := c.GetRawData()
 		if err != nil {
 			utils.Error("读取请求体失败: %v", err)
+			if isBodyTooLarge(err) {
+				respondBodyTooLarge(c)
+				return
+			}
 			respondError(c, http.StatusBadRequest, "读取请求体失败: %v", err)
 			return
 		}
+		c.Set("rawBody", body)
 
 		// 先解析为通用map以便处理工具格式
 		var rawReq map[string]any
@@ -148,6 +346,43 @@ func StartServer(port string) {
 			respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
 			return
 		}
+		noteUsageRequest(c, anthropicReq.Model, anthropicReq.Stream)
+
+		// 校验租户模型白名单
+		if profile := GetTenant(c); profile != nil && !profile.ModelAllowed(anthropicReq.Model) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"type": "error",
+				"error": gin.H{
+					"type":    errTypePermission,
+					"message": "Model " + anthropicReq.Model + " is not allowed for this API key",
+				},
+			})
+			return
+		}
+
+		// Anthropic 直连：原样转发客户端请求体（仅移除代理扩展的 provider 字段）
+		if anthropicPassthrough(c) {
+			passthroughBody, err := fallbackRequestBody(c, anthropicReq)
+			if err != nil {
+				respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
+				return
+			}
+			forwardToAnthropic(c, "/v1/messages", passthroughBody)
+			return
+		}
+
+		// 会话只发送新增消息时拼接保存的历史（X-Conversation-ID + X-Kiro-Conversation-Append）
+		if convErr := expandStoredConversation(c, &anthropicReq); convErr != nil {
+			respondAnthropicError(c, convErr)
+			return
+		}
+
+		// 执行路由规则（拒绝、切换 token 池、注入提示词、设置优先级）
+		if ruleErr := applyRoutingRules(c, &anthropicReq); ruleErr != nil {
+			respondAnthropicError(c, ruleErr)
+			return
+		}
+		tokenInfo.AccessToken = c.GetString("accessToken")
 
 		// 验证请求的有效性
 		if len(anthropicReq.Messages) == 0 {
@@ -171,25 +406,95 @@ func StartServer(port string) {
 			return
 		}
 
+		// 校验 tool_choice 指定的工具存在
+		if err := converter.ValidateToolChoice(anthropicReq); err != nil {
+			respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: err.Error()})
+			return
+		}
+
+		// 校验 X-Kiro-Profile 指定的 profile 存在
+		if err := validateProfileHeader(c); err != nil {
+			respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: err.Error()})
+			return
+		}
+
 		// 校验历史消息中 thinking 块的签名
 		if err := validateThinkingSignatures(anthropicReq); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{
 				"type": "error",
 				"error": gin.H{
-					"type":    "invalid_request_error",
+					"type":    errTypeInvalidRequest,
 					"message": err.Error(),
 				},
 			})
 			return
 		}
 
-		// 检测 web_search 工具，路由到 MCP 处理
-		if hasWebSearchTool(anthropicReq) {
+		// 历史轮次过多时提示或拒绝
+		if turnErr := checkHistoryTurns(c, anthropicReq); turnErr != nil {
+			respondAnthropicError(c, turnErr)
+			return
+		}
+
+		// 循环调用的 agent 在上游封号前先延迟或拒绝
+		if abuseErr := shapeAbusiveRequest(c, anthropicReq); abuseErr != nil {
+			respondAnthropicError(c, abuseErr)
+			return
+		}
+
+		// 校验图片并按配置缩放，无效图片直接返回 400
+		if err := converter.PrepareImages(&anthropicReq, c); err != nil {
+			respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadRequest, Message: err.Error(), Type: errTypeInvalidRequest})
+			return
+		}
+
+		// 按租户或模型选择 Bedrock 上游
+		if useBedrock(c, anthropicReq.Model) {
+			handleBedrockRequest(c, anthropicReq)
+			return
+		}
+
+		// 按请求的提供方偏好选择上游
+		if anthropicReq.Provider != nil {
+			if err := validateProviderPreferences(anthropicReq.Provider); err != nil {
+				respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadRequest, Message: err.Error(), Type: errTypeInvalidRequest})
+				return
+			}
+			if prefersAnthropicFirst(anthropicReq.Provider) && trySpillToAnthropic(c, anthropicReq) {
+				return
+			}
+			if err := applyProviderPreferences(c, anthropicReq.Provider); err != nil {
+				respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusServiceUnavailable, Message: err.Error(), Type: errTypeAPI})
+				return
+			}
+			tokenInfo.AccessToken = c.GetString("accessToken")
+		}
+
+		// 恢复历史消息中由本服务签名的 thinking 内容（redacted_thinking、被清空的 thinking 块）
+		anthropicReq.Messages = restoreThinkingBlocks(c, anthropicReq.Messages)
+
+		// 检测 web_search 工具：未配置搜索服务时路由到 MCP 处理
+		if hasWebSearchTool(anthropicReq) && !webSearchProviderEnabled() {
+			if !mcpCompiled || !featureEnabled(featureMCP) {
+				respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadRequest, Message: "web_search tool is not enabled on this server", Type: errTypeInvalidRequest})
+				return
+			}
 			utils.Info("检测到 web_search 工具，路由到 MCP 端点")
 			handleMCPWebSearch(c, anthropicReq, tokenInfo)
 			return
 		}
 
+		// 检测 code_execution / web_search 工具，由代理模拟执行（沙箱运行代码、搜索服务）
+		if hasCodeExecutionTool(anthropicReq) || hasWebSearchTool(anthropicReq) {
+			if hasCodeExecutionTool(anthropicReq) && !codeExecutionEnabled() {
+				respondAnthropicError(c, &UpstreamError{StatusCode: http.StatusBadRequest, Message: "code_execution tool is not enabled on this server", Type: errTypeInvalidRequest})
+				return
+			}
+			utils.Info("检测到服务端工具，由代理模拟执行")
+			handleServerToolRequest(c, anthropicReq, tokenInfo)
+			return
+		}
+
 		if anthropicReq.Stream {
 			handleStreamRequest(c, anthropicReq, tokenInfo)
 			return
@@ -201,20 +506,129 @@ func StartServer(port string) {
 	// Token计数端点
 	r.POST("/v1/messages/count_tokens", handleCountTokens)
 
+	// 会话分叉端点（复制保存的会话状态到新的会话 ID）
+	r.POST("/v1/conversations/:id/fork", handleForkConversation)
+
+	// Message Batches 端点（后台逐个经 /v1/messages 执行）
+	r.POST("/v1/messages/batches", handleCreateBatch)
+	r.GET("/v1/messages/batches", handleListBatches)
+	r.GET("/v1/messages/batches/:id", handleGetBatch)
+	r.GET("/v1/messages/batches/:id/results", handleBatchResults)
+	r.POST("/v1/messages/batches/:id/cancel", handleCancelBatch)
+	r.DELETE("/v1/messages/batches/:id", handleDeleteBatch)
+
+	// OpenAI 兼容端点（可选）
+	registerOpenAIRoutes(r)
+
 	r.NoRoute(func(c *gin.Context) {
 		respondError(c, http.StatusNotFound, "%s", "404 未找到")
 	})
 
+	return r
+}
+
+/**
+ * ListenAndServe 监听端口并提供服务，阻塞直到 ctx 取消或服务出错
+ * ctx 取消时停止接收新请求，等待进行中的请求结束（最长 SHUTDOWN_GRACE_PERIOD）；
+ * 返回前停止所有后台任务，监听失败或 HTTPS 配置错误时返回错误
+ */
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	defer s.Close()
+
 	// 创建自定义HTTP服务器以支持长时间请求
 	server := &http.Server{
-		Addr:    ":" + port,
-		Handler: r,
+		Handler: s.handler,
+	}
+	ln, err := listen(s.opts.port)
+	if err != nil {
+		return fmt.Errorf("启动服务器失败: %v, port: %s", err, s.opts.port)
+	}
+	utils.Info("监听地址: %s", ln.Addr())
+	tlsListener, err := configureTLS(server)
+	if err != nil {
+		ln.Close()
+		return fmt.Errorf("HTTPS 配置错误: %v", err)
+	}
+	var redirect *http.Server
+	if tlsListener != nil {
+		redirect = tlsListener.redirectServer(s.opts.port)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if tlsListener != nil {
+			serveErr <- tlsListener.serve(server, ln)
+			return
+		}
+		serveErr <- server.Serve(ln)
+	}()
+	if redirect != nil {
+		go func() {
+			redirectLn, err := listen(config.Current().HTTPRedirectPort)
+			if err == nil {
+				err = redirect.Serve(redirectLn)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				serveErr <- fmt.Errorf("HTTP 重定向端口 %s: %w", config.Current().HTTPRedirectPort, err)
+			}
+		}()
 	}
 
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		utils.Error("启动服务器失败: %v, port: %s", err, port)
-		os.Exit(1)
+	select {
+	case err := <-serveErr:
+		if err != nil && err != http.ErrServerClosed {
+			if redirect != nil {
+				redirect.Close()
+			}
+			server.Close()
+			return fmt.Errorf("启动服务器失败: %v, port: %s", err, s.opts.port)
+		}
+	case <-ctx.Done():
+		utils.Info("收到退出信号，等待进行中的请求结束")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownGracePeriod)
+		defer cancel()
+		if redirect != nil {
+			redirect.Shutdown(shutdownCtx)
+		}
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			utils.Error("等待进行中的请求超时，强制退出: %v", err)
+		}
 	}
+	return nil
+}
+
+/**
+ * Close 停止所有后台任务
+ * ListenAndServe 返回前会自动调用；只通过 Handler 嵌入时由调用方在退出时调用
+ */
+func (s *Server) Close() error {
+	stopBackgroundTasks(&s.opts.services)
+	if err := lifecycle.Shutdown(config.BackgroundShutdownTimeout); err != nil {
+		utils.Error("停止后台任务失败: %v", err)
+		return err
+	}
+	utils.Info("服务已退出")
+	return nil
+}
+
+/**
+ * stopBackgroundTasks 逐个停止后台任务
+ * 先停止 token 刷新，避免退出途中发起刷新；再停止定时清理和热重载；最后停止导出类任务，让退出过程中的记录也能送达
+ */
+func stopBackgroundTasks(svc *services) {
+	svc.tokens.StopRefresher()
+	utils.StopConnectionWarmer()
+	StopSignatureCleanup()
+	rules.StopReloadTicker()
+	tenant.StopReloadTicker()
+	config.StopReloadWatcher()
+	proxy.StopCleanupTicker()
+	svc.cache.StopCleaner()
+	svc.batches.stop()
+	StopUsageStore()
+	StopEvalTee()
+	StopTTFTSLO()
+	tracing.Stop()
 }
 
 /**
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * 服务端工具模拟（code_execution、web_search）
+ * 上游不支持 Anthropic 的服务端工具，这里将其替换为等价的客户端工具发往上游，
+ * 模型调用时由代理执行（沙箱运行代码 / 请求搜索服务），把结果作为 tool_result 追加到对话后继续请求上游，
+ * 直到模型不再调用模拟的工具；返回给客户端的是官方格式的 server_tool_use 和对应的 *_tool_result 内容块
+ */
+
+// emulatedServerTool 由代理模拟执行的服务端工具
+type emulatedServerTool struct {
+	upstream   types.AnthropicTool // 发往上游的等价客户端工具定义
+	resultType string              // 返回给客户端的结果块类型，错误内容的类型为 resultType + "_error"
+	maxUses    int                 // 单个请求的调用次数上限，0 表示不限
+	run        func(ctx context.Context, input map[string]any) serverToolResult
+}
+
+// serverToolResult 一次模拟工具调用的结果
+type serverToolResult struct {
+	Content any    // 结果块的 content 字段
+	Text    string // 发往上游的 tool_result 文本
+	IsError bool
+}
+
+// errorResult 未执行时的错误结果（如超出 max_uses）
+func (t *emulatedServerTool) errorResult(code string) serverToolResult {
+	return serverToolResult{
+		Content: map[string]any{"type": t.resultType + "_error", "error_code": code},
+		Text:    fmt.Sprintf("%s failed: %s", t.upstream.Name, code),
+		IsError: true,
+	}
+}
+
+// emulatedServerToolsFor 请求中声明且已启用的模拟工具，按发往上游的工具名索引
+func emulatedServerToolsFor(req types.AnthropicRequest) map[string]*emulatedServerTool {
+	tools := make(map[string]*emulatedServerTool)
+	for _, tool := range req.Tools {
+		switch {
+		case tool.Name == codeExecutionToolName && codeExecutionEnabled():
+			tools[codeExecutionToolName] = codeExecutionServerTool
+		case isWebSearchToolName(tool.Name) && webSearchProviderEnabled():
+			tools[webSearchToolName] = webSearchServerTool(tool)
+		}
+	}
+	return tools
+}
+
+// withEmulatedServerTools 将请求中的服务端工具替换为等价的客户端工具定义
+func withEmulatedServerTools(req types.AnthropicRequest) types.AnthropicRequest {
+	tools := make([]types.AnthropicTool, 0, len(req.Tools))
+	for _, tool := range req.Tools {
+		switch {
+		case tool.Name == codeExecutionToolName && codeExecutionEnabled():
+			tool = codeExecutionServerTool.upstream
+		case isWebSearchToolName(tool.Name) && webSearchProviderEnabled():
+			tool = webSearchTool
+		}
+		tools = append(tools, tool)
+	}
+	req.Tools = tools
+	req.Messages = append([]types.AnthropicRequestMessage(nil), req.Messages...)
+	return req
+}
+
+// serverToolUseID 由上游工具调用 ID 派生 server_tool_use 块的 ID
+func serverToolUseID(toolID string) string {
+	return "srvtoolu_" + strings.TrimPrefix(toolID, "tooluse_")
+}
+
+// responseTextBlocks 将上游完整文本转换为内容块，启用 thinking 时拆出 thinking 块
+func responseTextBlocks(text string, thinkingEnabled bool) []map[string]any {
+	if text == "" {
+		return nil
+	}
+	if !thinkingEnabled {
+		return []map[string]any{{"type": "text", "text": text}}
+	}
+
+	var blocks []map[string]any
+	thinkingBlocks, cleanText := ExtractThinkingFromFinalText(text)
+	if merged := strings.Join(thinkingBlocks, "\n\n"); merged != "" {
+		blocks = append(blocks, map[string]any{
+			"type":      "thinking",
+			"thinking":  merged,
+			"signature": SignThinking(merged),
+		})
+	}
+	if cleanText != "" {
+		blocks = append(blocks, map[string]any{"type": "text", "text": cleanText})
+	}
+	return blocks
+}
+
+/**
+ * handleServerToolRequest 处理声明了模拟服务端工具的请求（流式与非流式）
+ * 每轮以非流式方式请求上游；模型调用模拟工具时由代理执行并继续下一轮，
+ * 同时调用了客户端工具时执行完本轮模拟工具后以 tool_use 结束，超过轮数上限时以 pause_turn 结束
+ * 流式请求在全部轮次完成后按官方事件序列一次性输出
+ */
+func handleServerToolRequest(c *gin.Context, anthropicReq types.AnthropicRequest, token types.TokenInfo) {
+	estimator := utils.NewTokenEstimator()
+	emulated := emulatedServerToolsFor(anthropicReq)
+	req := withEmulatedServerTools(anthropicReq)
+	inputTokens := estimateInputTokens(estimator, req)
+	if upstreamErr := checkContextWindow(c, inputTokens); upstreamErr != nil {
+		respondAnthropicError(c, upstreamErr)
+		return
+	}
+
+	releaseSlot, slotErr := acquireConcurrencySlot(c)
+	if slotErr != nil {
+		respondAnthropicError(c, slotErr)
+		return
+	}
+	defer releaseSlot()
+
+	thinkingEnabled := req.Thinking != nil && req.Thinking.Type == "enabled"
+	var content []map[string]any
+	stopReason := "end_turn"
+	uses := make(map[string]int)
+	outputTokens := 0
+
+	for round := 0; ; round++ {
+		result, allTools, ok := fetchNonStreamResponse(c, req, token)
+		if !ok {
+			return
+		}
+
+		textBlocks := responseTextBlocks(result.GetCompletionText(), thinkingEnabled)
+		content = append(content, textBlocks...)
+
+		var assistantBlocks, toolResults []any
+		for _, block := range textBlocks {
+			if block["type"] == "text" {
+				assistantBlocks = append(assistantBlocks, block)
+				outputTokens += estimator.EstimateTextTokens(block["text"].(string))
+			}
+		}
+
+		clientToolCalled := false
+		for _, tool := range allTools {
+			input := tool.Arguments
+			if input == nil {
+				input = map[string]any{}
+			}
+			outputTokens += estimator.EstimateToolUseTokens(tool.Name, input)
+			serverTool, ok := emulated[tool.Name]
+			if !ok {
+				clientToolCalled = true
+				content = append(content, map[string]any{"type": "tool_use", "id": tool.ID, "name": tool.Name, "input": input})
+				continue
+			}
+
+			var toolResult serverToolResult
+			if serverTool.maxUses > 0 && uses[tool.Name] >= serverTool.maxUses {
+				toolResult = serverTool.errorResult(toolErrMaxUsesExceeded)
+			} else {
+				uses[tool.Name]++
+				toolResult = serverTool.run(requestContext(c), input)
+			}
+			srvID := serverToolUseID(tool.ID)
+			content = append(content,
+				map[string]any{"type": "server_tool_use", "id": srvID, "name": tool.Name, "input": input},
+				map[string]any{"type": serverTool.resultType, "tool_use_id": srvID, "content": toolResult.Content},
+			)
+			assistantBlocks = append(assistantBlocks, map[string]any{"type": "tool_use", "id": tool.ID, "name": tool.Name, "input": input})
+			toolResults = append(toolResults, map[string]any{
+				"type":        "tool_result",
+				"tool_use_id": tool.ID,
+				"content":     toolResult.Text,
+				"is_error":    toolResult.IsError,
+			})
+		}
+
+		if clientToolCalled {
+			stopReason = "tool_use"
+			break
+		}
+		if len(toolResults) == 0 || requestContext(c).Err() != nil {
+			break
+		}
+		if round+1 >= config.ServerToolMaxRounds {
+			stopReason = "pause_turn"
+			break
+		}
+		req.Messages = append(req.Messages,
+			types.AnthropicRequestMessage{Role: "assistant", Content: assistantBlocks},
+			types.AnthropicRequestMessage{Role: "user", Content: toolResults},
+		)
+	}
+
+	for name, n := range uses {
+		utils.RecordPolicy(c, name, "ran %d emulated %s calls", n, name)
+	}
+	recordTokenUsage(c, inputTokens, outputTokens)
+	msgID := fmt.Sprintf(config.MessageIDFormat, utils.GenerateBase62ID(22))
+
+	usage := map[string]any{
+		"input_tokens":  inputTokens,
+		"output_tokens": outputTokens,
+	}
+	if n := uses[webSearchToolName]; n > 0 {
+		usage["server_tool_use"] = map[string]any{"web_search_requests": n}
+	}
+
+	if !anthropicReq.Stream {
+		usage["service_tier"] = "standard"
+		c.JSON(http.StatusOK, map[string]any{
+			"id":            msgID,
+			"type":          "message",
+			"role":          "assistant",
+			"model":         anthropicReq.Model,
+			"content":       content,
+			"stop_reason":   stopReason,
+			"stop_sequence": nil,
+			"usage":         usage,
+		})
+		return
+	}
+
+	if err := initializeSSEResponse(c); err != nil {
+		return
+	}
+	sender := &AnthropicStreamSender{}
+	sender.SendEvent(c, map[string]any{
+		"type": "message_start",
+		"message": map[string]any{
+			"id":            msgID,
+			"type":          "message",
+			"role":          "assistant",
+			"model":         anthropicReq.Model,
+			"content":       []any{},
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage": map[string]any{
+				"input_tokens":  inputTokens,
+				"output_tokens": 0,
+			},
+		},
+	})
+	for index, block := range content {
+		sendContentBlock(c, sender, index, block)
+	}
+	delete(usage, "input_tokens")
+	sender.SendEvent(c, map[string]any{
+		"type": "message_delta",
+		"delta": map[string]any{
+			"stop_reason":   stopReason,
+			"stop_sequence": nil,
+		},
+		"usage": usage,
+	})
+	sender.SendEvent(c, map[string]any{
+		"type": "message_stop",
+	})
+}
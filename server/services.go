@@ -0,0 +1,123 @@
+package server
+
+import (
+	"net/http"
+
+	"kiro/cache"
+	"kiro/converter"
+	"kiro/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * 可注入的服务
+ * token 缓存（含全局 token 池）、Prompt Cache、上游请求入口、批次和会话状态存储、历史转换缓存由 Server 持有，
+ * 经 servicesMiddleware 放入请求上下文，处理器通过 tokenServiceOf / cacheServiceOf / upstreamClientOf 等获取。
+ * 测试可以通过 WithTokenService / WithCacheService / WithUpstreamClient 注入独立实例或替身。
+ * 其余状态（限流器、用量库、端点健康、TTFT 监控、签名存储等）仍是进程级单例，由 New 经 initSubsystems 初始化，
+ * 同一进程中的多个 Server 共享这些状态
+ */
+
+// servicesKey 上下文键：当前 Server 的服务集合
+const servicesKey = "services"
+
+// CacheService Prompt Cache 接口，*cache.PromptCache 实现了该接口
+type CacheService interface {
+	// ProcessRequest 计算请求的缓存命中和写入，namespace 隔离不同租户的缓存条目
+	ProcessRequest(req types.AnthropicRequest, inputTokens int, namespace string) *cache.CacheResult
+	// Flush 清空所有缓存条目，返回清除的条目数
+	Flush() int
+	// Stats 返回缓存规模和命中/未命中/淘汰计数
+	Stats() cache.Stats
+	// StopCleaner 停止后台清理任务
+	StopCleaner()
+}
+
+// noPromptCache PROMPT_CACHE=disabled 时使用，请求按无缓存统计
+type noPromptCache struct{}
+
+func (noPromptCache) ProcessRequest(_ types.AnthropicRequest, inputTokens int, _ string) *cache.CacheResult {
+	return &cache.CacheResult{TotalTokens: inputTokens}
+}
+
+func (noPromptCache) Flush() int { return 0 }
+
+func (noPromptCache) Stats() cache.Stats { return cache.Stats{} }
+
+func (noPromptCache) StopCleaner() {}
+
+// UpstreamClient 上游请求入口，返回成功的响应；出错时已按需向客户端写出错误响应
+type UpstreamClient interface {
+	Execute(c *gin.Context, anthropicReq types.AnthropicRequest, tokenInfo types.TokenInfo, isStream bool) (*http.Response, error)
+}
+
+// codeWhispererClient 默认的上游入口，请求 CodeWhisperer（含端点选择、重试和 token 切换）
+type codeWhispererClient struct{}
+
+func (codeWhispererClient) Execute(c *gin.Context, anthropicReq types.AnthropicRequest, tokenInfo types.TokenInfo, isStream bool) (*http.Response, error) {
+	return executeCodeWhispererRequest(c, anthropicReq, tokenInfo, isStream)
+}
+
+// services Server 持有的服务集合
+type services struct {
+	tokens   *TokenService
+	cache    CacheService
+	upstream UpstreamClient
+	batches  *batchStore
+
+	conversations *conversationStore
+	history       *converter.HistoryCache // 已转换的历史前缀，为 nil 时不缓存
+}
+
+// WithTokenService 使用指定的 token 缓存，默认创建新的实例
+func WithTokenService(tokens *TokenService) Option {
+	return func(o *serverOptions) {
+		o.services.tokens = tokens
+	}
+}
+
+// WithCacheService 使用指定的 Prompt Cache，默认按 PROMPT_CACHE 配置创建
+func WithCacheService(cacheService CacheService) Option {
+	return func(o *serverOptions) {
+		o.services.cache = cacheService
+	}
+}
+
+// WithUpstreamClient 使用指定的上游请求入口，默认请求 CodeWhisperer
+func WithUpstreamClient(upstream UpstreamClient) Option {
+	return func(o *serverOptions) {
+		o.services.upstream = upstream
+	}
+}
+
+// servicesMiddleware 将服务集合放入请求上下文
+func servicesMiddleware(svc *services) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(servicesKey, svc)
+		if svc.history != nil {
+			c.Set(converter.HistoryCacheKey, svc.history)
+		}
+		c.Next()
+	}
+}
+
+// servicesOf 返回请求所属 Server 的服务集合
+func servicesOf(c *gin.Context) *services {
+	return c.MustGet(servicesKey).(*services)
+}
+
+// tokenServiceOf 返回请求所属 Server 的 token 缓存
+func tokenServiceOf(c *gin.Context) *TokenService {
+	return servicesOf(c).tokens
+}
+
+// cacheServiceOf 返回请求所属 Server 的 Prompt Cache
+func cacheServiceOf(c *gin.Context) CacheService {
+	return servicesOf(c).cache
+}
+
+// upstreamClientOf 返回请求所属 Server 的上游请求入口
+func upstreamClientOf(c *gin.Context) UpstreamClient {
+	return servicesOf(c).upstream
+}
@@ -1,15 +1,18 @@
 package server
 
 import (
+	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
+	"kiro/lifecycle"
 	"kiro/types"
 	"kiro/utils"
 
@@ -24,6 +27,15 @@ type signatureStore struct {
 
 var sigStore *signatureStore
 
+// addColumnIfMissing 为旧版本创建的表补充列，列已存在（duplicate column）时忽略，其他错误返回
+func addColumnIfMissing(db *sql.DB, table, columnDef string) error {
+	_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, columnDef))
+	if err != nil && strings.Contains(err.Error(), "duplicate column name") {
+		return nil
+	}
+	return err
+}
+
 // InitSignatureStore 初始化签名存储（SQLite）
 func InitSignatureStore() {
 	// 数据目录
@@ -47,12 +59,19 @@ func InitSignatureStore() {
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS signatures (
 			hash TEXT PRIMARY KEY,
-			created_at INTEGER NOT NULL
+			created_at INTEGER NOT NULL,
+			thinking TEXT
 		)
 	`)
 	if err != nil {
 		utils.Error("创建签名表失败: %v", err)
 	}
+	// 旧版本创建的表没有 thinking 列；迁移失败时签名查询会出错，不启用签名存储
+	if err := addColumnIfMissing(db, "signatures", "thinking TEXT"); err != nil {
+		utils.Error("签名表迁移失败，签名存储未启用: %v", err)
+		db.Close()
+		return
+	}
 
 	// 索引加速过期清理
 	db.Exec(`CREATE INDEX IF NOT EXISTS idx_sig_created ON signatures(created_at)`)
@@ -82,6 +101,40 @@ func RegisterSignature(sig string) {
 	)
 }
 
+// registerThinking 注册签名并保存对应的 thinking 内容，客户端回传历史时用于恢复被清空或编辑过的 thinking 块
+func registerThinking(sig, thinking string) {
+	if sig == "" || sigStore == nil {
+		return
+	}
+	hash := hashSignature(sig)
+	now := time.Now().Unix()
+
+	sigStore.mu.Lock()
+	defer sigStore.mu.Unlock()
+
+	sigStore.db.Exec(
+		`INSERT OR REPLACE INTO signatures (hash, created_at, thinking) VALUES (?, ?, ?)`,
+		hash, now, thinking,
+	)
+}
+
+// lookupThinking 返回签名对应的 thinking 内容，签名不是本服务生成或未保存内容时 ok 为 false
+func lookupThinking(sig string) (thinking string, ok bool) {
+	if sig == "" || sigStore == nil {
+		return "", false
+	}
+	hash := hashSignature(sig)
+
+	sigStore.mu.RLock()
+	defer sigStore.mu.RUnlock()
+
+	var stored sql.NullString
+	if err := sigStore.db.QueryRow(`SELECT thinking FROM signatures WHERE hash = ?`, hash).Scan(&stored); err != nil {
+		return "", false
+	}
+	return stored.String, stored.Valid
+}
+
 // IsValidSignature 检查签名是否由本服务生成
 func IsValidSignature(sig string) bool {
 	if sig == "" || sigStore == nil {
@@ -136,17 +189,31 @@ func validateThinkingSignatures(req types.AnthropicRequest) error {
 	return nil
 }
 
+// signatureCleanup 签名清理任务
+var signatureCleanup *lifecycle.Task
+
 // StartSignatureCleanup 定时清理过期签名（保留 7 天）
 func StartSignatureCleanup() {
-	go func() {
+	signatureCleanup.Stop()
+	signatureCleanup = lifecycle.Go("signature-cleanup", func(ctx context.Context) {
 		ticker := time.NewTicker(1 * time.Hour)
 		defer ticker.Stop()
-		for range ticker.C {
-			if sigStore != nil {
-				sigStore.cleanup()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if sigStore != nil {
+					sigStore.cleanup()
+				}
 			}
 		}
-	}()
+	})
+}
+
+// StopSignatureCleanup 停止签名清理任务
+func StopSignatureCleanup() {
+	signatureCleanup.Stop()
 }
 
 func (s *signatureStore) cleanup() {
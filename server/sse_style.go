@@ -0,0 +1,43 @@
+package server
+
+import (
+	"kiro/config"
+	"kiro/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * SSE 字段风格
+ * 部分客户端要求 stop_sequence 等可空字段始终存在（即使为 null），另一些遇到未知字段即报错，
+ * 按 X-Kiro-SSE-Style 请求头 > 租户 sse_style > SSE_FIELD_STYLE 的优先级选择 strict-anthropic 或 lenient，
+ * 未知的取值被忽略
+ */
+
+// sseStyleHeader 按请求覆盖字段风格的请求头
+const sseStyleHeader = "X-Kiro-SSE-Style"
+
+// sseStyleKey 上下文键：本次请求解析后的字段风格
+const sseStyleKey = "sseFieldStyle"
+
+// sseFieldStyle 返回本次请求的字段风格，首次调用时解析并缓存到上下文
+func sseFieldStyle(c *gin.Context) types.SSEFieldStyle {
+	if v, ok := c.Get(sseStyleKey); ok {
+		return v.(types.SSEFieldStyle)
+	}
+
+	style := types.SSEFieldStyleStrict
+	if parsed, ok := types.ParseSSEFieldStyle(config.Current().SSEFieldStyle); ok {
+		style = parsed
+	}
+	if profile := GetTenant(c); profile != nil {
+		if parsed, ok := types.ParseSSEFieldStyle(profile.SSEStyle); ok {
+			style = parsed
+		}
+	}
+	if parsed, ok := types.ParseSSEFieldStyle(c.GetHeader(sseStyleHeader)); ok {
+		style = parsed
+	}
+	c.Set(sseStyleKey, style)
+	return style
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"compress/gzip"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"kiro/config"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errSSEHeadersWritten 响应头已经发送，无法再切换为 SSE 响应
+var errSSEHeadersWritten = errors.New("响应头已发送，无法建立SSE连接")
+
+// canFlush 判断底层 ResponseWriter 是否支持 Flush
+// gin 的 ResponseWriter 总是声明 http.Flusher，但底层不支持时调用会 panic，需要沿 Unwrap 链检查
+func canFlush(w http.ResponseWriter) bool {
+	for {
+		switch u := w.(type) {
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = u.Unwrap()
+		case http.Flusher:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// unflushableWriter 底层不支持 Flush 时的回退写入器
+// Flush 只提交响应头，每个事件仍以独立的 Write 写入底层，由底层自行决定何时发送
+type unflushableWriter struct {
+	gin.ResponseWriter
+}
+
+func (w unflushableWriter) Flush() {
+	w.WriteHeaderNow()
+}
+
+// prepareSSEWriter 检查并适配 SSE 写入器
+// 底层不支持 Flush（嵌入场景、部分测试 Writer）时替换为回退写入器，而不是直接失败
+func prepareSSEWriter(c *gin.Context) error {
+	if c.Writer.Written() {
+		return errSSEHeadersWritten
+	}
+	if _, ok := c.Writer.(unflushableWriter); ok {
+		return nil
+	}
+	if !canFlush(c.Writer) {
+		utils.Debug("ResponseWriter 不支持 Flush，SSE 使用分块写入回退模式")
+		c.Writer = unflushableWriter{c.Writer}
+	}
+	return nil
+}
+
+// sseGzipKey 上下文中保存当前请求 gzip 写入器的键，请求结束时由中间件关闭
+const sseGzipKey = "sseGzipWriter"
+
+/**
+ * gzipSSEWriter SSE 响应的 gzip 压缩写入器
+ * 每次 Flush 先同步刷新压缩流再刷新底层连接，每个事件仍然实时送达；
+ * 压缩字典在事件之间共享，重复的 JSON 字段名和工具参数片段压缩效果明显
+ */
+type gzipSSEWriter struct {
+	gin.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w *gzipSSEWriter) Write(data []byte) (int, error) {
+	return w.gz.Write(data)
+}
+
+func (w *gzipSSEWriter) WriteString(s string) (int, error) {
+	return w.gz.Write([]byte(s))
+}
+
+func (w *gzipSSEWriter) Flush() {
+	if err := w.gz.Flush(); err != nil {
+		utils.Debug("刷新 SSE gzip 压缩流失败: %v", err)
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Close 写入 gzip 尾部并刷新
+func (w *gzipSSEWriter) Close() {
+	if err := w.gz.Close(); err != nil {
+		utils.Debug("关闭 SSE gzip 压缩流失败: %v", err)
+	}
+	w.ResponseWriter.Flush()
+}
+
+// acceptsGzip 客户端的 Accept-Encoding 是否接受 gzip（q=0 表示拒绝）
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+		if !ok {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err == nil && weight > 0
+	}
+	return false
+}
+
+// enableSSEGzip 启用且客户端支持时把 SSE 写入器切换为 gzip 压缩（需在响应头发送前调用）
+func enableSSEGzip(c *gin.Context) {
+	if !config.Current().SSEGzip || !acceptsGzip(c.GetHeader("Accept-Encoding")) {
+		return
+	}
+	if _, ok := c.Get(sseGzipKey); ok {
+		return
+	}
+	c.Header("Content-Encoding", "gzip")
+	c.Header("Vary", "Accept-Encoding")
+	w := &gzipSSEWriter{ResponseWriter: c.Writer, gz: gzip.NewWriter(c.Writer)}
+	c.Writer = w
+	c.Set(sseGzipKey, w)
+}
+
+// sseGzipMiddleware 请求处理完成后关闭 SSE gzip 压缩流，客户端据此确认响应完整
+func sseGzipMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if value, ok := c.Get(sseGzipKey); ok {
+			value.(*gzipSSEWriter).Close()
+		}
+	}
+}
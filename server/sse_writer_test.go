@@ -0,0 +1,253 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"kiro/internal/eventstreamtest"
+	"kiro/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sseTestReply 上游分三段返回 "Hello, world"
+func sseTestReply() []byte {
+	var stream []byte
+	for _, chunk := range []string{"Hello", ", ", "world"} {
+		stream = append(stream, eventstreamtest.Frame("assistantResponseEvent", map[string]any{"content": chunk})...)
+	}
+	return stream
+}
+
+// newStreamRequest 构造流式 /v1/messages 请求，使用 newTestRouter 注入的 token 池认证
+func newStreamRequest() *http.Request {
+	body := `{"model":"claude-sonnet-4-5","max_tokens":256,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", "test-pool-key")
+	return req
+}
+
+// sseEventTypes 按顺序提取 SSE 响应中的事件类型
+func sseEventTypes(body string) []string {
+	var events []string
+	for _, line := range strings.Split(body, "\n") {
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			events = append(events, strings.TrimSpace(name))
+		}
+	}
+	return events
+}
+
+// assertFullSSESequence 校验事件流从 message_start 开始、以 message_stop 结束，且文本完整
+func assertFullSSESequence(t *testing.T, body string) {
+	t.Helper()
+	events := sseEventTypes(body)
+	if len(events) == 0 || events[0] != "message_start" || events[len(events)-1] != "message_stop" {
+		t.Fatalf("event sequence = %v, want message_start ... message_stop\n%s", events, body)
+	}
+	for _, want := range []string{"content_block_start", "content_block_delta", "content_block_stop", "message_delta"} {
+		found := false
+		for _, e := range events {
+			if e == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("event %s missing from %v", want, events)
+		}
+	}
+	var text strings.Builder
+	for _, line := range strings.Split(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var event struct {
+			Delta struct {
+				Text string `json:"text"`
+			} `json:"delta"`
+		}
+		if json.Unmarshal([]byte(data), &event) == nil {
+			text.WriteString(event.Delta.Text)
+		}
+	}
+	if text.String() != "Hello, world" {
+		t.Errorf("streamed text = %q, want %q", text.String(), "Hello, world")
+	}
+}
+
+// plainResponseWriter 不实现 http.Flusher 的 ResponseWriter（嵌入场景或部分中间件的包装）
+type plainResponseWriter struct {
+	header http.Header
+	body   bytes.Buffer
+	code   int
+}
+
+func (w *plainResponseWriter) Header() http.Header { return w.header }
+
+func (w *plainResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *plainResponseWriter) Write(data []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+func TestPrepareSSEWriter(t *testing.T) {
+	t.Run("unflushable writer falls back", func(t *testing.T) {
+		c, _ := gin.CreateTestContext(&plainResponseWriter{header: make(http.Header)})
+		if canFlush(c.Writer) {
+			t.Fatal("canFlush = true for writer without http.Flusher")
+		}
+		if err := prepareSSEWriter(c); err != nil {
+			t.Fatalf("prepareSSEWriter: %v", err)
+		}
+		if _, ok := c.Writer.(unflushableWriter); !ok {
+			t.Fatalf("writer = %T, want unflushableWriter", c.Writer)
+		}
+		c.Writer.Flush() // 不应 panic
+	})
+
+	t.Run("headers already written", func(t *testing.T) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Writer.WriteHeaderNow()
+		if err := prepareSSEWriter(c); !errors.Is(err, errSSEHeadersWritten) {
+			t.Fatalf("err = %v, want errSSEHeadersWritten", err)
+		}
+	})
+}
+
+func TestInitializeSSEResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		protoMinor int
+		wantConn   string
+	}{
+		{name: "HTTP/1.1 keeps the connection", protoMinor: 1, wantConn: "keep-alive"},
+		{name: "HTTP/1.0 closes the connection", protoMinor: 0, wantConn: "close"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &plainResponseWriter{header: make(http.Header)}
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+			c.Request.ProtoMinor = tt.protoMinor
+
+			if err := initializeSSEResponse(c); err != nil {
+				t.Fatalf("initializeSSEResponse: %v", err)
+			}
+			sender := &AnthropicStreamSender{}
+			if err := sender.SendEvent(c, &types.MessageStopEvent{Type: "message_stop"}); err != nil {
+				t.Fatalf("SendEvent: %v", err)
+			}
+
+			if w.code != http.StatusOK {
+				t.Errorf("status = %d, want 200", w.code)
+			}
+			if got := w.header.Get("Connection"); got != tt.wantConn {
+				t.Errorf("Connection = %q, want %q", got, tt.wantConn)
+			}
+			if !strings.Contains(w.body.String(), "event: message_stop") {
+				t.Errorf("body = %q, want the message_stop event written without Flush", w.body.String())
+			}
+		})
+	}
+}
+
+func TestStreamWithoutFlusher(t *testing.T) {
+
+	t.Run("full sequence", func(t *testing.T) {
+		w := &plainResponseWriter{header: make(http.Header)}
+		newTestRouter(t, &fakeUpstream{stream: sseTestReply()}).ServeHTTP(w, newStreamRequest())
+		if w.code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", w.code, w.body.String())
+		}
+		if ct := w.header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		assertFullSSESequence(t, w.body.String())
+	})
+
+	// 上游在建立 SSE 之前失败时返回 HTTP 错误，而不是打开一个只有错误的事件流
+	t.Run("upstream rate limit", func(t *testing.T) {
+		upstream := &fakeUpstream{err: &UpstreamError{StatusCode: http.StatusTooManyRequests, Message: "Too many requests"}}
+		w := &plainResponseWriter{header: make(http.Header)}
+		newTestRouter(t, upstream).ServeHTTP(w, newStreamRequest())
+		if w.code != http.StatusTooManyRequests {
+			t.Fatalf("status = %d, want 429, body = %s", w.code, w.body.String())
+		}
+		if ct := w.header.Get("Content-Type"); strings.HasPrefix(ct, "text/event-stream") {
+			t.Errorf("Content-Type = %q, want JSON error before SSE is established", ct)
+		}
+		var body struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(w.body.Bytes(), &body); err != nil {
+			t.Fatalf("decode error body: %v\n%s", err, w.body.String())
+		}
+		if body.Error.Code != errCodeUpstream || body.Error.Message != "Too many requests" {
+			t.Errorf("error = %+v, want code %s with the upstream message", body.Error, errCodeUpstream)
+		}
+	})
+}
+
+func TestStreamHTTP10Client(t *testing.T) {
+	ts := httptest.NewServer(newTestRouter(t, &fakeUpstream{stream: sseTestReply()}))
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	body := `{"model":"claude-sonnet-4-5","max_tokens":256,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	io.WriteString(conn, "POST /v1/messages HTTP/1.0\r\n"+
+		"Host: "+ts.Listener.Addr().String()+"\r\n"+
+		"Content-Type: application/json\r\n"+
+		"x-api-key: test-pool-key\r\n"+
+		"Content-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+
+	// HTTP/1.0 没有分块传输，响应体以连接关闭结束：读到 EOF 说明服务端按预期关闭了连接
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", resp.StatusCode, data)
+	}
+	if resp.ProtoMajor != 1 || resp.ProtoMinor != 0 {
+		t.Errorf("proto = %s, want HTTP/1.0", resp.Proto)
+	}
+	if len(resp.TransferEncoding) != 0 {
+		t.Errorf("Transfer-Encoding = %v, want none for HTTP/1.0", resp.TransferEncoding)
+	}
+	if !resp.Close {
+		t.Error("response does not close the connection")
+	}
+	assertFullSSESequence(t, string(data))
+}
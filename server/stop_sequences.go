@@ -0,0 +1,143 @@
+package server
+
+import (
+	"errors"
+	"strings"
+
+	"kiro/utils"
+)
+
+// errStopSequenceMatched 流式文本命中停止序列，停止读取上游并正常结束响应
+var errStopSequenceMatched = errors.New("命中停止序列")
+
+/**
+ * stopSequenceMatcher 流式文本的停止序列匹配器
+ * 上游不支持 stop_sequences，由代理在下发文本时检测：末尾可能构成停止序列前缀的文本暂缓下发，
+ * 确认不是停止序列后再输出；命中时截断在停止序列之前，之后的文本全部丢弃
+ * nil 表示请求未设置停止序列，所有方法均可安全调用
+ */
+type stopSequenceMatcher struct {
+	sequences []string
+	pending   string // 暂缓下发的文本（可能是停止序列的前缀）
+	index     int    // 暂缓文本所属的内容块索引
+	matched   string // 命中的停止序列
+}
+
+// newStopSequenceMatcher 创建匹配器，没有有效停止序列时返回 nil
+func newStopSequenceMatcher(sequences []string) *stopSequenceMatcher {
+	var valid []string
+	for _, seq := range sequences {
+		if seq != "" {
+			valid = append(valid, seq)
+		}
+	}
+	if len(valid) == 0 {
+		return nil
+	}
+	return &stopSequenceMatcher{sequences: valid}
+}
+
+// Feed 输入内容块 index 的新文本，返回可以立即下发的部分；命中停止序列时 stopped 为 true
+func (m *stopSequenceMatcher) Feed(index int, text string) (emit string, stopped bool) {
+	if m == nil {
+		return text, false
+	}
+	if m.matched != "" {
+		return "", true
+	}
+
+	buf := m.pending + text
+	m.index = index
+	if cut, seq, ok := findStopSequence(buf, m.sequences); ok {
+		m.pending = ""
+		m.matched = seq
+		return buf[:cut], true
+	}
+
+	// 保留能构成某个停止序列前缀的最长尾部
+	hold := 0
+	for _, seq := range m.sequences {
+		for n := min(len(seq)-1, len(buf)); n > hold; n-- {
+			if strings.HasSuffix(buf, seq[:n]) {
+				hold = n
+				break
+			}
+		}
+	}
+	m.pending = buf[len(buf)-hold:]
+	return buf[:len(buf)-hold], false
+}
+
+// Flush 取出暂缓的文本及其所属内容块索引（文本块结束时调用）
+func (m *stopSequenceMatcher) Flush() (string, int) {
+	if m == nil || m.pending == "" {
+		return "", -1
+	}
+	text := m.pending
+	m.pending = ""
+	return text, m.index
+}
+
+// Matched 返回命中的停止序列，未命中时为空
+func (m *stopSequenceMatcher) Matched() string {
+	if m == nil {
+		return ""
+	}
+	return m.matched
+}
+
+// findStopSequence 返回文本中最早出现的停止序列及其位置
+func findStopSequence(text string, sequences []string) (int, string, bool) {
+	cut, matched := -1, ""
+	for _, seq := range sequences {
+		if seq == "" {
+			continue
+		}
+		if i := strings.Index(text, seq); i >= 0 && (cut < 0 || i < cut) {
+			cut, matched = i, seq
+		}
+	}
+	return cut, matched, cut >= 0
+}
+
+// stopSequenceValue 响应中的 stop_sequence 字段：未命中时为 null
+func stopSequenceValue(seq string) any {
+	if seq == "" {
+		return nil
+	}
+	return seq
+}
+
+// applyStopSequences 对非流式响应的文本应用停止序列，返回截断后的文本和命中的停止序列
+func applyStopSequences(text string, sequences []string) (string, string) {
+	if cut, seq, ok := findStopSequence(text, sequences); ok {
+		return text[:cut], seq
+	}
+	return text, ""
+}
+
+// sendStopSequenceText 下发经过停止序列过滤的文本增量并累计 token
+func (ctx *StreamProcessorContext) sendStopSequenceText(index int, text string) {
+	if text == "" {
+		return
+	}
+	event := map[string]any{
+		"type":  "content_block_delta",
+		"index": index,
+		"delta": map[string]any{
+			"type": "text_delta",
+			"text": text,
+		},
+	}
+	if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, event); err != nil {
+		utils.Log("发送文本 delta 失败", utils.LogErr(err))
+	}
+	ctx.totalOutputTokens += ctx.tokenEstimator.EstimateTextTokens(text)
+}
+
+// flushStopSequenceText 文本块结束前下发暂缓的文本
+func (ctx *StreamProcessorContext) flushStopSequenceText() {
+	if text, index := ctx.stopSequences.Flush(); text != "" {
+		ctx.sendStopSequenceText(index, text)
+	}
+}
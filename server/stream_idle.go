@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"kiro/config"
+	"kiro/utils"
+)
+
+/**
+ * 流式响应空闲超时
+ * 上游在流式响应中途停滞时，客户端会在已建立的 SSE 连接上无限等待。
+ * ProcessEventStream 为每个流启动空闲计时器，持续 STREAM_IDLE_TIMEOUT_SECONDS 未收到上游数据时关闭上游响应体，
+ * 随后向客户端发送 error 事件，并补齐 content_block_stop / message_delta / message_stop 后结束响应
+ */
+
+// errStreamIdle 上游流式响应空闲超时
+var errStreamIdle = errors.New("上游流式响应空闲超时")
+
+// idleWatchdog 上游读取空闲计时器，nil 表示未启用
+type idleWatchdog struct {
+	timeout time.Duration
+	timer   *time.Timer
+	fired   atomic.Bool
+}
+
+// startIdleWatchdog 启动空闲计时器，超时后关闭 reader；timeout 非正数或 reader 不可关闭时返回 nil
+func startIdleWatchdog(reader io.Reader, timeout time.Duration) *idleWatchdog {
+	closer, ok := reader.(io.Closer)
+	if timeout <= 0 || !ok {
+		return nil
+	}
+	w := &idleWatchdog{timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		w.fired.Store(true)
+		closer.Close()
+	})
+	return w
+}
+
+// touch 收到上游数据后重新计时
+func (w *idleWatchdog) touch() {
+	if w != nil && !w.fired.Load() {
+		w.timer.Reset(w.timeout)
+	}
+}
+
+// stop 停止计时器
+func (w *idleWatchdog) stop() {
+	if w != nil {
+		w.timer.Stop()
+	}
+}
+
+// timedOut 是否因空闲超时关闭了上游响应体
+func (w *idleWatchdog) timedOut() bool {
+	return w != nil && w.fired.Load()
+}
+
+/**
+ * sendIdleTimeoutEvents 空闲超时后结束 SSE 响应
+ * 先发送 error 事件告知客户端响应不完整，再补齐未关闭的内容块和结束事件，使严格校验事件序列的客户端也能正常收尾
+ */
+func (ctx *StreamProcessorContext) sendIdleTimeoutEvents() {
+	timeout := time.Duration(config.Current().StreamIdleTimeoutSeconds) * time.Second
+	utils.RecordPolicy(ctx.c, "stream_idle", "no upstream data for %s; stream terminated", timeout)
+	_ = ctx.sender.SendEvent(ctx.c, map[string]any{
+		"type": "error",
+		"error": map[string]any{
+			"type":    errTypeAPI,
+			"message": fmt.Sprintf("Upstream stream stalled: no data received for %d seconds, the response is incomplete", int(timeout.Seconds())),
+		},
+	})
+	if err := ctx.sendFinalEvents(); err != nil {
+		utils.Log("发送结束事件失败", utils.LogErr(err))
+	}
+	ctx.c.Writer.Flush()
+}
@@ -1,12 +1,15 @@
 package server
 
 import (
-	"fmt"
+	"errors"
 	"io"
 	"strings"
+	"time"
 
 	"kiro/cache"
+	"kiro/config"
 	"kiro/parser"
+	"kiro/tracing"
 	"kiro/types"
 	"kiro/utils"
 
@@ -42,9 +45,13 @@ type StreamProcessorContext struct {
 	nativeThinkingContent   int  // 原生 thinking 内容累计长度（用于生成伪签名）
 	textBlockIndex       int  // 文本块的索引（thinking 模式下用于发送普通文本）
 	textBlockStarted     bool // 文本块是否已开始
+	thinkingEmitted      bool         // 是否已下发过 thinking 块（thinking 模式下首个块必须是 thinking）
+	upstreamTextBlocks   map[int]bool // 上游文本块索引（thinking 模式下由提取器拆分后下发）
+	blockIndexMap        map[int]int  // 上游块索引 → 下发块索引（thinking 模式下重新分配）
 
 	// 统计信息
-	totalOutputTokens    int // 累计发送给客户端的输出 token 数
+	totalOutputTokens    int    // 累计发送给客户端的输出 token 数
+	finalStopReason      string // 最终下发的 stop_reason
 	totalReadBytes       int
 	totalProcessedEvents int
 	lastParseErr         error
@@ -52,9 +59,16 @@ type StreamProcessorContext struct {
 	// 工具调用跟踪
 	toolUseIdByBlockIndex map[int]string
 	completedToolUseIds   map[string]bool // 已完成的工具ID集合（用于stop_reason判断）
+	calledToolNames       []string        // 已下发的工具调用名称（用于校验 tool_choice）
 
 	// JSON字节累加器（修复分段整除精度损失）
 	jsonBytesByBlockIndex map[int]int // 每个工具块累积的JSON字节数
+
+	// 工具参数拼接缓冲（块结束时校验完整 JSON）
+	jsonBufByBlockIndex map[int]*strings.Builder
+
+	// 停止序列匹配器（请求未设置 stop_sequences 时为 nil）
+	stopSequences *stopSequenceMatcher
 }
 
 // NewStreamProcessorContext 创建流处理上下文
@@ -88,9 +102,13 @@ func NewStreamProcessorContext(
 		thinkingBlockIndex:    -1,
 		textBlockIndex:        -1,
 		textBlockStarted:      false,
+		upstreamTextBlocks:    make(map[int]bool),
+		blockIndexMap:         make(map[int]int),
 		toolUseIdByBlockIndex: make(map[int]string),
 		completedToolUseIds:   make(map[string]bool),
 		jsonBytesByBlockIndex: make(map[int]int), // *** 初始化JSON字节累加器 ***
+		jsonBufByBlockIndex:   make(map[int]*strings.Builder),
+		stopSequences:         newStopSequenceMatcher(req.StopSequences),
 	}
 }
 
@@ -116,6 +134,9 @@ func (ctx *StreamProcessorContext) Cleanup() {
 		ctx.toolUseIdByBlockIndex = nil
 	}
 
+	// 清理工具参数拼接缓冲
+	ctx.jsonBufByBlockIndex = nil
+
 	// 清理已完成工具集合
 	if ctx.completedToolUseIds != nil {
 		for k := range ctx.completedToolUseIds {
@@ -133,16 +154,23 @@ func (ctx *StreamProcessorContext) Cleanup() {
 
 // initializeSSEResponse 初始化SSE响应头
 func initializeSSEResponse(c *gin.Context) error {
+	// 确认响应头尚未发送，底层Writer不支持Flush时切换到回退写入
+	if err := prepareSSEWriter(c); err != nil {
+		return err
+	}
+
 	// 设置SSE响应头，禁用反向代理缓冲
 	c.Header("Content-Type", "text/event-stream; charset=utf-8")
 	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
 	c.Header("X-Accel-Buffering", "no")
-
-	// 确认底层Writer支持Flush
-	if _, ok := c.Writer.(io.Writer); !ok {
-		return fmt.Errorf("writer不支持SSE刷新")
+	// HTTP/1.0 不支持分块传输，响应以关闭连接结束
+	if c.Request.ProtoAtLeast(1, 1) {
+		c.Header("Connection", "keep-alive")
+	} else {
+		c.Header("Connection", "close")
 	}
+	// 客户端支持时压缩事件流（逐事件刷新）
+	enableSSEGzip(c)
 
 	c.Writer.Flush()
 	return nil
@@ -193,6 +221,7 @@ func (ctx *StreamProcessorContext) processToolUseStart(dataMap map[string]any) {
 
 	// 记录索引到tool_use_id的映射
 	ctx.toolUseIdByBlockIndex[idx] = id
+	ctx.calledToolNames = append(ctx.calledToolNames, getStringField(cb, "name"))
 
 	utils.Log("转发tool_use开始",
 		utils.LogString("tool_use_id", id),
@@ -207,6 +236,8 @@ func (ctx *StreamProcessorContext) processToolUseStop(dataMap map[string]any) {
 		return
 	}
 
+	ctx.verifyToolInputJSON(idx)
+
 	// *** 修复：在块结束时计算累加的JSON字节数的token ***
 	// 使用进一法（向上取整）确保不低估token消耗
 	if jsonBytes, exists := ctx.jsonBytesByBlockIndex[idx]; exists && jsonBytes > 0 {
@@ -238,6 +269,14 @@ func (ctx *StreamProcessorContext) processToolUseStop(dataMap map[string]any) {
 
 // sendFinalEvents 发送结束事件
 func (ctx *StreamProcessorContext) sendFinalEvents() error {
+	// 结束 thinking 流中仍未关闭的 thinking/文本块
+	if ctx.thinkingEnabled {
+		ctx.closeThinkingModeBlocks()
+	}
+
+	// 下发停止序列匹配器暂缓的文本（上游未发送 content_block_stop 时）
+	ctx.flushStopSequenceText()
+
 	// 关闭所有未关闭的content_block
 	activeBlocks := ctx.sseStateManager.GetActiveBlocks()
 	for index, block := range activeBlocks {
@@ -291,6 +330,11 @@ func (ctx *StreamProcessorContext) sendFinalEvents() error {
 
 	// 确定stop_reason
 	stopReason := ctx.stopReasonManager.DetermineStopReason()
+	stopSequence := ctx.stopSequences.Matched()
+	if stopSequence != "" {
+		stopReason = "stop_sequence"
+	}
+	ctx.finalStopReason = stopReason
 
 	utils.Log("创建结束事件",
 		utils.LogString("stop_reason", stopReason),
@@ -298,7 +342,7 @@ func (ctx *StreamProcessorContext) sendFinalEvents() error {
 		utils.LogInt("output_tokens", outputTokens))
 
 	// 创建并发送结束事件
-	finalEvents := createAnthropicFinalEvents(outputTokens, ctx.inputTokens, stopReason, ctx.cacheResult)
+	finalEvents := createAnthropicFinalEvents(outputTokens, ctx.inputTokens, proxyOverheadTokens(ctx.c, ctx.req), stopReason, stopSequence, ctx.cacheResult)
 	for _, event := range finalEvents {
 		if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, event); err != nil {
 			utils.Log("结束事件发送违规", utils.LogErr(err))
@@ -329,6 +373,9 @@ func getStringField(m map[string]any, key string) string {
 	return ""
 }
 
+// errClientDisconnected 流式响应过程中客户端断开连接
+var errClientDisconnected = errors.New("客户端已断开连接")
+
 // EventStreamProcessor 事件流处理器
 // 遵循单一职责原则：专注于处理事件流
 type EventStreamProcessor struct {
@@ -346,16 +393,30 @@ func NewEventStreamProcessor(ctx *StreamProcessorContext) *EventStreamProcessor
 func (esp *EventStreamProcessor) ProcessEventStream(reader io.Reader) error {
 	buf := make([]byte, 1024)
 
+	_, span := tracing.Start(requestContext(esp.ctx.c), "parser.EventStream", tracing.KindInternal)
+	defer func() {
+		span.SetAttr("kiro.stream.read_bytes", esp.ctx.totalReadBytes)
+		span.SetAttr("kiro.stream.events", esp.ctx.totalProcessedEvents)
+		span.End()
+	}()
+
+	// 上游持续无数据时关闭响应体，使阻塞的 Read 返回
+	idleTimeout := time.Duration(config.Current().StreamIdleTimeoutSeconds) * time.Second
+	idle := startIdleWatchdog(reader, idleTimeout)
+	defer idle.stop()
+
 	for {
 		n, err := reader.Read(buf)
 		esp.ctx.totalReadBytes += n
 
 		if n > 0 {
+			idle.touch()
 			// 解析事件流
 			events, parseErr := esp.ctx.compliantParser.ParseStream(buf[:n])
 			esp.ctx.lastParseErr = parseErr
 
 			if parseErr != nil {
+				span.AddEvent("parse_error", "error", parseErr.Error())
 				utils.Log("符合规范的解析器处理失败",
 					addReqFields(esp.ctx.c,
 						utils.LogErr(parseErr),
@@ -364,18 +425,26 @@ func (esp *EventStreamProcessor) ProcessEventStream(reader io.Reader) error {
 					)...)
 			}
 
+			if esp.ctx.totalProcessedEvents == 0 && len(events) > 0 {
+				span.AddEvent("first_event")
+			}
 			esp.ctx.totalProcessedEvents += len(events)
 
 			// 处理每个事件
 			for _, event := range events {
 				if err := esp.processEvent(event); err != nil {
+					if errors.Is(err, errStopSequenceMatched) {
+						span.AddEvent("stop_sequence")
+					} else {
+						span.SetError(err)
+					}
 					return err
 				}
 			}
 
-			// 批量 Flush：处理完一批事件后统一刷新，避免每个事件都 Flush
+			// 批量 Flush：处理完一批事件后交出拦截链暂存的事件并统一刷新，避免每个事件都 Flush
 			if len(events) > 0 {
-				esp.ctx.c.Writer.Flush()
+				flushEventBatch(esp.ctx.c, esp.ctx.sender)
 			}
 		}
 
@@ -385,7 +454,26 @@ func (esp *EventStreamProcessor) ProcessEventStream(reader io.Reader) error {
 					addReqFields(esp.ctx.c,
 						utils.LogInt("total_read_bytes", esp.ctx.totalReadBytes),
 					)...)
+			} else if idle.timedOut() {
+				span.AddEvent("idle_timeout")
+				utils.Log("上游流式响应空闲超时",
+					addReqFields(esp.ctx.c,
+						utils.LogString("timeout", idleTimeout.String()),
+						utils.LogInt("total_read_bytes", esp.ctx.totalReadBytes),
+						utils.LogInt("output_tokens", esp.ctx.totalOutputTokens),
+					)...)
+				return errStreamIdle
+			} else if requestContext(esp.ctx.c).Err() != nil {
+				// 客户端断开时请求 context 被取消，上游连接随之关闭
+				span.AddEvent("client_disconnected")
+				utils.Log("客户端已断开，已取消上游请求",
+					addReqFields(esp.ctx.c,
+						utils.LogInt("total_read_bytes", esp.ctx.totalReadBytes),
+						utils.LogInt("output_tokens", esp.ctx.totalOutputTokens),
+					)...)
+				return errClientDisconnected
 			} else {
+				span.SetError(err)
 				utils.Log("读取响应流时发生错误",
 					addReqFields(esp.ctx.c,
 						utils.LogErr(err),
@@ -411,110 +499,33 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 
 	eventType, _ := dataMap["type"].(string)
 
+	// 启用 thinking 时由 thinking 流编排内容块（拆分 <thinking> 标签、重新分配块索引）
+	if esp.ctx.thinkingEnabled {
+		if handled, err := esp.ctx.handleThinkingModeEvent(eventType, dataMap); handled || err != nil {
+			return err
+		}
+	}
+
 	// 处理不同类型的事件
 	switch eventType {
 	case "content_block_start":
 		esp.ctx.processToolUseStart(dataMap)
-		// 如果启用 thinking 模式
-		if esp.ctx.thinkingEnabled {
-			if cb, ok := dataMap["content_block"].(map[string]any); ok {
-				cbType, _ := cb["type"].(string)
-
-				if cbType == "thinking" {
-					// 添加空 thinking 字段以符合 Anthropic API 格式
-					cb["thinking"] = ""
-					// 标记原生 thinking 块开始
-					esp.ctx.nativeThinkingActive = true
-					esp.ctx.nativeSignatureReceived = false
-					esp.ctx.nativeThinkingContent = 0
-				}
-
-				// 如果是 text 块但还没出现过 thinking → 补一个最小 thinking 块
-				if cbType == "text" && !esp.ctx.thinkingBlockStarted && !esp.ctx.nativeThinkingActive && esp.ctx.nativeThinkingContent == 0 {
-					minThinking := "I'll answer this directly."
-					fakeSig := GenerateFakeSignature(len(minThinking))
-
-					// 发送 thinking block: start → delta → signature → stop
-					idx := esp.ctx.sseStateManager.AllocateBlockIndex()
-					esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, map[string]any{
-						"type": "content_block_start", "index": idx,
-						"content_block": map[string]any{"type": "thinking", "thinking": ""},
-					})
-					esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, map[string]any{
-						"type": "content_block_delta", "index": idx,
-						"delta": map[string]any{"type": "thinking_delta", "thinking": minThinking},
-					})
-					esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, map[string]any{
-						"type": "content_block_delta", "index": idx,
-						"delta": map[string]any{"type": "signature_delta", "signature": fakeSig},
-					})
-					esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, map[string]any{
-						"type": "content_block_stop", "index": idx,
-					})
-					// 标记已补过，防止重复
-					esp.ctx.nativeThinkingContent = len(minThinking)
-				}
-			}
-		}
 
 	case "content_block_delta":
-		// 如果启用 thinking 模式，转换 thinking_delta 格式
-		if esp.ctx.thinkingEnabled {
-			if delta, ok := dataMap["delta"].(map[string]any); ok {
-				deltaType, _ := delta["type"].(string)
-
-				if deltaType == "thinking_delta" {
-					// 将 text 字段改为 thinking 字段
-					if text, exists := delta["text"]; exists {
-						delta["thinking"] = text
-						delete(delta, "text")
-					}
-					// 累计 thinking 内容长度
-					if thinking, ok := delta["thinking"].(string); ok {
-						esp.ctx.nativeThinkingContent += len(thinking)
-					}
-				}
-
-				if deltaType == "signature_delta" {
-					esp.ctx.nativeSignatureReceived = true
-					// 注册真实签名到签名表
-					if sig, ok := delta["signature"].(string); ok {
-						RegisterSignature(sig)
-					}
-				}
-			}
-			// 检查是否需要处理 thinking 提取（从 text_delta 中提取 <thinking> 标签）
-			if handled, err := esp.handleThinkingDelta(dataMap); err != nil {
-				return err
-			} else if handled {
-				return nil // thinking 已处理，不需要继续（Flush 已移至批量处理）
+		// 设置了停止序列时，文本增量经过匹配器过滤后下发
+		if delta, ok := dataMap["delta"].(map[string]any); ok && delta["type"] == "text_delta" && esp.ctx.stopSequences != nil {
+			text, _ := delta["text"].(string)
+			emit, stopped := esp.ctx.stopSequences.Feed(extractIndex(dataMap), text)
+			esp.ctx.sendStopSequenceText(extractIndex(dataMap), emit)
+			if stopped {
+				return errStopSequenceMatched
 			}
+			return nil
 		}
 
 	case "content_block_stop":
+		esp.ctx.flushStopSequenceText()
 		esp.ctx.processToolUseStop(dataMap)
-		// 如果启用了 thinking 模式
-		if esp.ctx.thinkingEnabled {
-			// 原生 thinking 块结束且没有收到 signature_delta → 补一个伪造的
-			if esp.ctx.nativeThinkingActive && !esp.ctx.nativeSignatureReceived {
-				fakeSig := GenerateFakeSignature(esp.ctx.nativeThinkingContent)
-				sigEvent := map[string]any{
-					"type":  "content_block_delta",
-					"index": dataMap["index"],
-					"delta": map[string]any{
-						"type":      "signature_delta",
-						"signature": fakeSig,
-					},
-				}
-				esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, sigEvent)
-			}
-			esp.ctx.nativeThinkingActive = false
-
-			// 刷新 XML thinking 提取器
-			if err := esp.flushThinkingExtractor(); err != nil {
-				utils.Log("刷新 thinking 提取器失败", utils.LogErr(err))
-			}
-		}
 
 	case "message_delta":
 
@@ -525,8 +536,8 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 		}
 	}
 
-	// 使用状态管理器发送事件（直传）
-	if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, dataMap); err != nil {
+	// 使用状态管理器发送事件（直传，超大工具参数自动拆分）
+	if err := esp.sendEvent(dataMap); err != nil {
 		utils.Log("SSE事件发送违规", utils.LogErr(err))
 		// 非严格模式下，违规事件被跳过但不中断流
 	}
@@ -589,239 +600,6 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 	return nil
 }
 
-// handleThinkingDelta 处理 thinking 模式下的 text_delta 事件
-// 返回 (handled, error) - handled 为 true 表示事件已被处理，不需要原样转发
-func (esp *EventStreamProcessor) handleThinkingDelta(dataMap map[string]any) (bool, error) {
-	delta, ok := dataMap["delta"].(map[string]any)
-	if !ok {
-		return false, nil
-	}
-
-	deltaType, _ := delta["type"].(string)
-	if deltaType != "text_delta" {
-		return false, nil
-	}
-
-	text, ok := delta["text"].(string)
-	if !ok || text == "" {
-		return false, nil
-	}
-
-	// 使用流式 thinking 提取器处理文本
-	result := esp.ctx.thinkingExtractor.ProcessTextStreaming(text)
-
-	// 处理 thinking 块开始
-	if result.ThinkingStarted {
-		// 分配新的 thinking 块索引
-		esp.ctx.thinkingBlockIndex = esp.ctx.sseStateManager.AllocateBlockIndex()
-		esp.ctx.thinkingBlockStarted = true
-
-		// 发送 content_block_start 事件
-		startEvent := map[string]any{
-			"type":  "content_block_start",
-			"index": esp.ctx.thinkingBlockIndex,
-			"content_block": map[string]any{
-				"type":     "thinking",
-				"thinking": "",
-			},
-		}
-
-		if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, startEvent); err != nil {
-			utils.Log("发送 thinking block start 失败", utils.LogErr(err))
-			return true, err
-		}
-	}
-
-	// 处理 thinking 增量内容（立即转发）
-	if result.ThinkingDelta != "" && esp.ctx.thinkingBlockStarted {
-		deltaEvent := map[string]any{
-			"type":  "content_block_delta",
-			"index": esp.ctx.thinkingBlockIndex,
-			"delta": map[string]any{
-				"type":     "thinking_delta",
-				"thinking": result.ThinkingDelta,
-			},
-		}
-
-		if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, deltaEvent); err != nil {
-			utils.Log("发送 thinking delta 失败", utils.LogErr(err))
-			return true, err
-		}
-
-		// 累计 token
-		esp.ctx.totalOutputTokens += esp.ctx.tokenEstimator.EstimateTextTokens(result.ThinkingDelta)
-	}
-
-	// 处理 thinking 块结束
-	if result.ThinkingEnded && esp.ctx.thinkingBlockStarted {
-		// 发送 signature_delta 事件
-		signatureDeltaEvent := map[string]any{
-			"type":  "content_block_delta",
-			"index": esp.ctx.thinkingBlockIndex,
-			"delta": map[string]any{
-				"type":      "signature_delta",
-				"signature": result.Signature,
-			},
-		}
-
-		if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, signatureDeltaEvent); err != nil {
-			utils.Log("发送 signature delta 失败", utils.LogErr(err))
-			return true, err
-		}
-
-		// 发送 content_block_stop 事件
-		stopEvent := map[string]any{
-			"type":  "content_block_stop",
-			"index": esp.ctx.thinkingBlockIndex,
-		}
-
-		if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, stopEvent); err != nil {
-			utils.Log("发送 thinking block stop 失败", utils.LogErr(err))
-			return true, err
-		}
-
-		esp.ctx.thinkingBlockStarted = false
-	}
-
-	// 处理普通文本内容
-	if result.TextDelta != "" {
-		// 如果文本块未开启，先开启一个新的文本块
-		if !esp.ctx.textBlockStarted {
-			esp.ctx.textBlockIndex = esp.ctx.sseStateManager.AllocateBlockIndex()
-			esp.ctx.textBlockStarted = true
-
-			// 发送 content_block_start 事件
-			startEvent := map[string]any{
-				"type":  "content_block_start",
-				"index": esp.ctx.textBlockIndex,
-				"content_block": map[string]any{
-					"type": "text",
-					"text": "",
-				},
-			}
-
-			if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, startEvent); err != nil {
-				utils.Log("发送 text block start 失败", utils.LogErr(err))
-				return true, err
-			}
-		}
-
-		// 发送文本 delta 事件
-		textDeltaEvent := map[string]any{
-			"type":  "content_block_delta",
-			"index": esp.ctx.textBlockIndex,
-			"delta": map[string]any{
-				"type": "text_delta",
-				"text": result.TextDelta,
-			},
-		}
-
-		if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, textDeltaEvent); err != nil {
-			utils.Log("发送文本 delta 失败", utils.LogErr(err))
-		}
-
-		// 累计 token
-		esp.ctx.totalOutputTokens += esp.ctx.tokenEstimator.EstimateTextTokens(result.TextDelta)
-	}
-
-	// 如果有任何内容被处理，则认为事件已处理
-	return result.ThinkingStarted || result.ThinkingDelta != "" || result.ThinkingEnded || result.TextDelta != "" || result.HasPending, nil
-}
-
-// flushThinkingExtractor 刷新 thinking 提取器中的剩余内容
-func (esp *EventStreamProcessor) flushThinkingExtractor() error {
-	if esp.ctx.thinkingExtractor == nil {
-		return nil
-	}
-
-	result := esp.ctx.thinkingExtractor.FlushStreaming()
-
-	// 如果还有 thinking 块未结束，发送 signature_delta 和 stop 事件
-	if result.ThinkingEnded && esp.ctx.thinkingBlockStarted {
-		// 发送 signature_delta 事件
-		if result.Signature != "" {
-			signatureDeltaEvent := map[string]any{
-				"type":  "content_block_delta",
-				"index": esp.ctx.thinkingBlockIndex,
-				"delta": map[string]any{
-					"type":      "signature_delta",
-					"signature": result.Signature,
-				},
-			}
-
-			if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, signatureDeltaEvent); err != nil {
-				utils.Log("flush 时发送 signature delta 失败", utils.LogErr(err))
-			}
-		}
-
-		// 发送 content_block_stop 事件
-		stopEvent := map[string]any{
-			"type":  "content_block_stop",
-			"index": esp.ctx.thinkingBlockIndex,
-		}
-
-		if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, stopEvent); err != nil {
-			utils.Log("flush 时发送 thinking block stop 失败", utils.LogErr(err))
-		}
-
-		esp.ctx.thinkingBlockStarted = false
-	}
-
-	// 处理剩余的普通文本（如果有的话）
-	if result.TextDelta != "" {
-		// 如果文本块未开启，先开启一个新的文本块
-		if !esp.ctx.textBlockStarted {
-			esp.ctx.textBlockIndex = esp.ctx.sseStateManager.AllocateBlockIndex()
-			esp.ctx.textBlockStarted = true
-
-			// 发送 content_block_start 事件
-			startEvent := map[string]any{
-				"type":  "content_block_start",
-				"index": esp.ctx.textBlockIndex,
-				"content_block": map[string]any{
-					"type": "text",
-					"text": "",
-				},
-			}
-
-			if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, startEvent); err != nil {
-				utils.Log("flush 时发送 text block start 失败", utils.LogErr(err))
-			}
-		}
-
-		textDeltaEvent := map[string]any{
-			"type":  "content_block_delta",
-			"index": esp.ctx.textBlockIndex,
-			"delta": map[string]any{
-				"type": "text_delta",
-				"text": result.TextDelta,
-			},
-		}
-
-		if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, textDeltaEvent); err != nil {
-			utils.Log("发送剩余文本 delta 失败", utils.LogErr(err))
-		}
-
-		esp.ctx.totalOutputTokens += esp.ctx.tokenEstimator.EstimateTextTokens(result.TextDelta)
-	}
-
-	// 关闭文本块（如果已开启）
-	if esp.ctx.textBlockStarted {
-		stopEvent := map[string]any{
-			"type":  "content_block_stop",
-			"index": esp.ctx.textBlockIndex,
-		}
-
-		if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, stopEvent); err != nil {
-			utils.Log("关闭文本块失败", utils.LogErr(err))
-		}
-
-		esp.ctx.textBlockStarted = false
-	}
-
-	return nil
-}
-
 // handleExceptionEvent 处理上游异常事件，检查是否需要映射为max_tokens
 // 返回true表示已处理并转换，不需要转发原始exception事件
 func (esp *EventStreamProcessor) handleExceptionEvent(dataMap map[string]any) bool {
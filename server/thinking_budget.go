@@ -0,0 +1,49 @@
+package server
+
+import (
+	"kiro/config"
+	"kiro/converter"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * clampThinkingBudget 思考预算超过历史之后剩余的上下文时自动收紧
+ * 剩余空间 = 上下文窗口 - 输入 token - 为最终回答保留的 token，收紧后不低于官方最小预算
+ * 否则注入的 max_thinking_length 无法达到，上游会在思考中途截断并降低回答质量
+ */
+func clampThinkingBudget(c *gin.Context, req *types.AnthropicRequest, inputTokens int) {
+	if req.Thinking == nil || req.Thinking.Type != "enabled" {
+		return
+	}
+
+	budget := req.Thinking.BudgetTokens
+	if budget <= 0 {
+		budget = converter.DefaultThinkingBudget
+	}
+
+	window := contextWindow(c)
+	available := window - inputTokens - config.ThinkingOutputReserveTokens
+	if available < config.ThinkingMinBudgetTokens {
+		available = config.ThinkingMinBudgetTokens
+	}
+	if budget <= available {
+		return
+	}
+
+	// 复制配置，避免修改调用方共享的请求结构
+	thinking := *req.Thinking
+	thinking.BudgetTokens = available
+	req.Thinking = &thinking
+
+	utils.RecordPolicy(c, "thinking_budget", "budget_tokens clamped from %d to %d (%d input tokens, %d context window)",
+		budget, available, inputTokens, window)
+	utils.Log("思考预算超出剩余上下文，已自动收紧",
+		addReqFields(c,
+			utils.LogInt("requested", budget),
+			utils.LogInt("clamped", available),
+			utils.LogInt("input_tokens", inputTokens),
+		)...)
+}
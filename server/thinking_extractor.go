@@ -8,29 +8,27 @@ import (
 )
 
 // ThinkingExtractor 从文本流中提取 <thinking> 标签内容
-// 支持增量流式输出：收到一条转发一条
+// 流式状态机：按到达顺序输出文本与 thinking 片段，标签跨越多个增量时暂存可能的部分标签
 type ThinkingExtractor struct {
 	buffer          strings.Builder // 文本缓冲区（用于处理部分标签）
 	inThinkingBlock bool            // 是否在 thinking 块内
-	thinkingContent strings.Builder // 累积的 thinking 内容（用于生成签名）
+	thinkingContent strings.Builder // 当前 thinking 块的内容（用于生成签名）
 }
 
-// StreamingExtractResult 流式提取结果
-type StreamingExtractResult struct {
-	// 事件类型
-	ThinkingStarted bool   // 是否刚进入 thinking 块
-	ThinkingEnded   bool   // 是否刚结束 thinking 块
-	ThinkingDelta   string // thinking 增量内容（立即转发）
-	TextDelta       string // 普通文本增量（立即转发）
-	Signature       string // thinking 块结束时的签名
-	HasPending      bool   // 是否有未完成的内容（部分标签）
-}
+// thinkingSegmentKind 提取片段类型
+type thinkingSegmentKind int
+
+const (
+	segmentText          thinkingSegmentKind = iota // 普通文本
+	segmentThinkingStart                            // 进入 thinking 块
+	segmentThinkingDelta                            // thinking 增量内容
+	segmentThinkingEnd                              // thinking 块结束，Text 为签名
+)
 
-// ExtractedContent 提取结果（兼容旧接口）
-type ExtractedContent struct {
-	ThinkingBlocks []string // 完整的 thinking 内容列表
-	TextContent    string   // 非 thinking 的文本内容
-	HasPending     bool     // 是否有未完成的 thinking 块
+// thinkingSegment 按顺序排列的提取片段
+type thinkingSegment struct {
+	Kind thinkingSegmentKind
+	Text string
 }
 
 // NewThinkingExtractor 创建新的 thinking 提取器
@@ -45,10 +43,10 @@ func (te *ThinkingExtractor) Reset() {
 	te.inThinkingBlock = false
 }
 
-// ProcessTextStreaming 流式处理文本增量
-// 返回可以立即转发的内容
-func (te *ThinkingExtractor) ProcessTextStreaming(text string) StreamingExtractResult {
-	result := StreamingExtractResult{}
+// ProcessTextStreaming 流式处理文本增量，返回可以立即转发的片段（保持原文顺序）
+// 结尾可能是部分标签的内容暂存到下一个增量
+func (te *ThinkingExtractor) ProcessTextStreaming(text string) []thinkingSegment {
+	var segments []thinkingSegment
 
 	// 将新文本添加到缓冲区
 	te.buffer.WriteString(text)
@@ -60,109 +58,50 @@ func (te *ThinkingExtractor) ProcessTextStreaming(text string) StreamingExtractR
 			// 在 thinking 块内，查找结束标签
 			endIdx := strings.Index(content, "</thinking>")
 			if endIdx >= 0 {
-				// 找到结束标签，发送剩余内容并结束
-				if endIdx > 0 {
-					delta := content[:endIdx]
-					result.ThinkingDelta += delta
-					te.thinkingContent.WriteString(delta)
-				}
-				// 生成签名并结束 thinking 块
-				result.ThinkingEnded = true
-				result.Signature = te.generateSignature()
-				te.thinkingContent.Reset()
-				te.inThinkingBlock = false
+				segments = te.appendThinking(segments, content[:endIdx])
+				segments = append(segments, te.endThinking())
 				content = content[endIdx+len("</thinking>"):]
-			} else {
-				// 检查是否有部分结束标签
-				partialEnd := findPartialEndTag(content)
-				if partialEnd > 0 {
-					// 有部分结束标签，发送前面的内容，保留部分标签
-					if len(content) > partialEnd {
-						delta := content[:len(content)-partialEnd]
-						result.ThinkingDelta += delta
-						te.thinkingContent.WriteString(delta)
-					}
-					te.buffer.WriteString(content[len(content)-partialEnd:])
-					result.HasPending = true
-				} else {
-					// 没有结束标签，全部作为 thinking delta 发送
-					result.ThinkingDelta += content
-					te.thinkingContent.WriteString(content)
-				}
-				content = ""
+				continue
 			}
+			// 保留可能的部分结束标签，其余作为 thinking 增量
+			partialEnd := findPartialEndTag(content)
+			segments = te.appendThinking(segments, content[:len(content)-partialEnd])
+			te.buffer.WriteString(content[len(content)-partialEnd:])
+			content = ""
 		} else {
 			// 不在 thinking 块内，查找开始标签
 			startIdx := strings.Index(content, "<thinking>")
 			if startIdx >= 0 {
-				// 找到开始标签
-				if startIdx > 0 {
-					result.TextDelta += content[:startIdx]
-				}
-				result.ThinkingStarted = true
+				segments = appendText(segments, content[:startIdx])
+				segments = append(segments, thinkingSegment{Kind: segmentThinkingStart})
 				te.inThinkingBlock = true
 				content = content[startIdx+len("<thinking>"):]
-			} else {
-				// 检查是否有部分开始标签
-				partialStart := findPartialStartTag(content)
-				if partialStart > 0 {
-					// 有部分开始标签，发送前面的内容，保留部分标签
-					if len(content) > partialStart {
-						result.TextDelta += content[:len(content)-partialStart]
-					}
-					te.buffer.WriteString(content[len(content)-partialStart:])
-					result.HasPending = true
-				} else {
-					// 没有开始标签，全部作为普通文本发送
-					result.TextDelta += content
-				}
-				content = ""
+				continue
 			}
+			// 保留可能的部分开始标签，其余作为普通文本
+			partialStart := findPartialStartTag(content)
+			segments = appendText(segments, content[:len(content)-partialStart])
+			te.buffer.WriteString(content[len(content)-partialStart:])
+			content = ""
 		}
 	}
 
-	return result
-}
-
-// Flush 强制刷新所有缓冲内容
-func (te *ThinkingExtractor) Flush() ExtractedContent {
-	result := ExtractedContent{}
-
-	// 如果有未完成的 thinking 块，将其作为 thinking 内容
-	if te.inThinkingBlock && te.thinkingContent.Len() > 0 {
-		result.ThinkingBlocks = append(result.ThinkingBlocks, strings.TrimSpace(te.thinkingContent.String()))
-		te.thinkingContent.Reset()
-	}
-
-	// 缓冲区中的内容作为普通文本
-	if te.buffer.Len() > 0 {
-		result.TextContent = te.buffer.String()
-		te.buffer.Reset()
-	}
-
-	te.inThinkingBlock = false
-	return result
+	return segments
 }
 
-// FlushStreaming 流式刷新
-func (te *ThinkingExtractor) FlushStreaming() StreamingExtractResult {
-	result := StreamingExtractResult{}
+// FlushStreaming 流结束时刷新：结束未闭合的 thinking 块，暂存的部分标签按所在位置输出
+func (te *ThinkingExtractor) FlushStreaming() []thinkingSegment {
+	var segments []thinkingSegment
+	pending := te.buffer.String()
+	te.buffer.Reset()
 
-	// 如果在 thinking 块内，结束它
 	if te.inThinkingBlock {
-		result.ThinkingEnded = true
-		result.Signature = te.generateSignature()
-		te.inThinkingBlock = false
-	}
-
-	// 缓冲区中的内容作为普通文本
-	if te.buffer.Len() > 0 {
-		result.TextDelta = te.buffer.String()
-		te.buffer.Reset()
+		segments = te.appendThinking(segments, pending)
+		segments = append(segments, te.endThinking())
+	} else {
+		segments = appendText(segments, pending)
 	}
-
-	te.thinkingContent.Reset()
-	return result
+	return segments
 }
 
 // IsInThinkingBlock 检查是否在 thinking 块内
@@ -170,28 +109,29 @@ func (te *ThinkingExtractor) IsInThinkingBlock() bool {
 	return te.inThinkingBlock
 }
 
-// generateSignature 生成 thinking 签名并注册到签名表
-func (te *ThinkingExtractor) generateSignature() string {
-	sig := generateProtobufLikeSignature(te.thinkingContent.Len())
-	RegisterSignature(sig)
-	return sig
+// appendThinking 追加 thinking 增量片段
+func (te *ThinkingExtractor) appendThinking(segments []thinkingSegment, text string) []thinkingSegment {
+	if text == "" {
+		return segments
+	}
+	te.thinkingContent.WriteString(text)
+	return append(segments, thinkingSegment{Kind: segmentThinkingDelta, Text: text})
 }
 
-// ProcessText 处理文本增量（兼容旧接口）
-func (te *ThinkingExtractor) ProcessText(text string) ExtractedContent {
-	result := ExtractedContent{}
-	streamResult := te.ProcessTextStreaming(text)
+// endThinking 结束 thinking 块并生成签名
+func (te *ThinkingExtractor) endThinking() thinkingSegment {
+	sig := SignThinking(te.thinkingContent.String())
+	te.thinkingContent.Reset()
+	te.inThinkingBlock = false
+	return thinkingSegment{Kind: segmentThinkingEnd, Text: sig}
+}
 
-	// 如果 thinking 块完成了，添加到结果
-	if streamResult.ThinkingEnded {
-		// 这里需要累积内容，但新的流式接口不再累积完整块
-		// 旧接口不再推荐使用
+// appendText 追加普通文本片段
+func appendText(segments []thinkingSegment, text string) []thinkingSegment {
+	if text == "" {
+		return segments
 	}
-
-	result.TextContent = streamResult.TextDelta
-	result.HasPending = streamResult.HasPending || te.inThinkingBlock
-
-	return result
+	return append(segments, thinkingSegment{Kind: segmentText, Text: text})
 }
 
 // findPartialStartTag 查找部分开始标签
@@ -245,6 +185,13 @@ func GenerateFakeSignature(contentLen int) string {
 	return sig
 }
 
+// SignThinking 为 thinking 内容生成签名，注册到签名表并保存内容（客户端回传历史时可恢复）
+func SignThinking(thinking string) string {
+	sig := generateProtobufLikeSignature(len(thinking))
+	registerThinking(sig, thinking)
+	return sig
+}
+
 // generateProtobufLikeSignature 生成模拟官方 protobuf 格式的签名
 // 官方签名特征：以 "Ev"/"Eu" 开头，含 "CkYI" 子串，Base64 编码，末尾 "=="
 func generateProtobufLikeSignature(contentLen int) string {
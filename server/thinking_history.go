@@ -0,0 +1,83 @@
+package server
+
+import (
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * 历史 thinking 块回放
+ * 本服务签发的签名在签名表中保存了对应的 thinking 内容。客户端回传历史 assistant 消息时：
+ * - thinking 块内容被清空（部分客户端只保留 signature）时按签名恢复原内容
+ * - redacted_thinking 块的 data 为本服务签名时恢复为 thinking 块；其他来源（如官方 API）的加密内容无法解读，不发往上游
+ * 恢复后的 thinking 块在历史转换时以 <thinking> 标签拼接在助手回复之前
+ */
+
+// restoreThinkingBlocks 返回恢复了 thinking 内容的消息列表，不修改原请求的内容块
+func restoreThinkingBlocks(c *gin.Context, messages []types.AnthropicRequestMessage) []types.AnthropicRequestMessage {
+	var restored []types.AnthropicRequestMessage
+	for i, msg := range messages {
+		blocks, ok := msg.Content.([]any)
+		if msg.Role != "assistant" || !ok {
+			continue
+		}
+
+		var rebuilt []any
+		changed := false
+		for _, item := range blocks {
+			block, ok := item.(map[string]any)
+			if !ok {
+				rebuilt = append(rebuilt, item)
+				continue
+			}
+			switch block["type"] {
+			case "thinking":
+				text, _ := block["thinking"].(string)
+				signature, _ := block["signature"].(string)
+				if text == "" {
+					if stored, found := lookupThinking(signature); found && stored != "" {
+						block = cloneBlock(block)
+						block["thinking"] = stored
+						changed = true
+						utils.RecordPolicy(c, "thinking_history", "messages.%d: restored thinking content from signature", i)
+					}
+				}
+			case "redacted_thinking":
+				data, _ := block["data"].(string)
+				changed = true
+				if stored, found := lookupThinking(data); found {
+					block = map[string]any{"type": "thinking", "thinking": stored, "signature": data}
+					utils.RecordPolicy(c, "thinking_history", "messages.%d: redacted_thinking restored from signature", i)
+				} else {
+					utils.RecordPolicy(c, "thinking_history", "messages.%d: redacted_thinking from another issuer omitted upstream", i)
+					continue
+				}
+			}
+			rebuilt = append(rebuilt, block)
+		}
+		if !changed {
+			continue
+		}
+
+		if restored == nil {
+			restored = append([]types.AnthropicRequestMessage(nil), messages...)
+		}
+		msg.Content = rebuilt
+		restored[i] = msg
+	}
+	if restored == nil {
+		return messages
+	}
+	return restored
+}
+
+// cloneBlock 浅拷贝内容块
+func cloneBlock(block map[string]any) map[string]any {
+	clone := make(map[string]any, len(block))
+	for k, v := range block {
+		clone[k] = v
+	}
+	return clone
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"strings"
+
+	"kiro/utils"
+)
+
+/**
+ * thinking 模式下的流式内容块编排
+ * 上游以普通文本返回思考过程（<thinking>...</thinking>），这里用 ThinkingExtractor 实时拆分：
+ * 标签内的内容以 content_block_start(type=thinking) + thinking_delta + signature_delta 下发，其余文本进入文本块，
+ * 原始标签不会泄漏给客户端。上游文本块不直接转发，其他块（tool_use、原生 thinking）重新分配下发索引，
+ * 保证同一时刻只有一个块处于打开状态、索引按下发顺序递增；首个块不是 thinking 时补一个最小 thinking 块
+ */
+
+// placeholderThinking 上游未返回思考内容时补充的最小 thinking 块内容
+const placeholderThinking = "I'll answer this directly."
+
+/**
+ * handleThinkingModeEvent 处理 thinking 模式下的内容块事件
+ * 返回 true 表示事件已处理，不需要继续转发；否则事件的 index 已改写为下发索引
+ */
+func (ctx *StreamProcessorContext) handleThinkingModeEvent(eventType string, dataMap map[string]any) (bool, error) {
+	switch eventType {
+	case "content_block_start", "content_block_delta", "content_block_stop":
+	default:
+		return false, nil
+	}
+	upstreamIndex := extractIndex(dataMap)
+	if upstreamIndex < 0 {
+		return false, nil
+	}
+
+	switch eventType {
+	case "content_block_start":
+		cb, _ := dataMap["content_block"].(map[string]any)
+		cbType, _ := cb["type"].(string)
+		if cbType == "text" {
+			// 文本块在提取出实际文本后才开启
+			ctx.upstreamTextBlocks[upstreamIndex] = true
+			return true, nil
+		}
+
+		// 其他块开始前结束当前的 thinking/文本块
+		if err := ctx.closeThinkingModeBlocks(); err != nil {
+			return true, err
+		}
+		if cbType == "thinking" {
+			// 原生 thinking 块：补齐空 thinking 字段，结束时未收到签名则补一个
+			cb["thinking"] = ""
+			ctx.nativeThinkingActive = true
+			ctx.nativeSignatureReceived = false
+			ctx.nativeThinkingContent = 0
+			ctx.thinkingEmitted = true
+		} else {
+			ctx.ensureThinkingBlock()
+		}
+		ctx.blockIndexMap[upstreamIndex] = ctx.sseStateManager.AllocateBlockIndex()
+
+	case "content_block_delta":
+		delta, _ := dataMap["delta"].(map[string]any)
+		deltaType, _ := delta["type"].(string)
+		if deltaType == "text_delta" {
+			if _, mapped := ctx.blockIndexMap[upstreamIndex]; !mapped {
+				ctx.upstreamTextBlocks[upstreamIndex] = true
+			}
+		}
+		if ctx.upstreamTextBlocks[upstreamIndex] {
+			text, _ := delta["text"].(string)
+			return true, ctx.emitThinkingSegments(ctx.thinkingExtractor.ProcessTextStreaming(text))
+		}
+
+		switch deltaType {
+		case "thinking_delta":
+			// 将 text 字段改为 thinking 字段
+			if text, exists := delta["text"]; exists {
+				delta["thinking"] = text
+				delete(delta, "text")
+			}
+			if thinking, ok := delta["thinking"].(string); ok {
+				ctx.nativeThinkingContent += len(thinking)
+			}
+		case "signature_delta":
+			ctx.nativeSignatureReceived = true
+			// 注册真实签名到签名表
+			if sig, ok := delta["signature"].(string); ok {
+				RegisterSignature(sig)
+			}
+		}
+
+	case "content_block_stop":
+		if ctx.upstreamTextBlocks[upstreamIndex] {
+			delete(ctx.upstreamTextBlocks, upstreamIndex)
+			return true, ctx.closeThinkingModeBlocks()
+		}
+	}
+
+	// 改写为下发索引（未见过 start 的块分配新索引）
+	index, ok := ctx.blockIndexMap[upstreamIndex]
+	if !ok {
+		index = ctx.sseStateManager.AllocateBlockIndex()
+		ctx.blockIndexMap[upstreamIndex] = index
+	}
+	dataMap["index"] = index
+
+	// 原生 thinking 块结束且没有收到 signature_delta → 补一个伪造的
+	if eventType == "content_block_stop" && ctx.nativeThinkingActive {
+		if !ctx.nativeSignatureReceived {
+			ctx.sendThinkingEvent(map[string]any{
+				"type":  "content_block_delta",
+				"index": index,
+				"delta": map[string]any{"type": "signature_delta", "signature": GenerateFakeSignature(ctx.nativeThinkingContent)},
+			})
+		}
+		ctx.nativeThinkingActive = false
+	}
+	return false, nil
+}
+
+// emitThinkingSegments 按顺序下发提取出的片段，命中停止序列时返回 errStopSequenceMatched
+func (ctx *StreamProcessorContext) emitThinkingSegments(segments []thinkingSegment) error {
+	for _, seg := range segments {
+		if ctx.stopSequences.Matched() != "" {
+			return errStopSequenceMatched
+		}
+
+		switch seg.Kind {
+		case segmentThinkingStart:
+			if err := ctx.closeTextBlock(); err != nil {
+				return err
+			}
+			ctx.thinkingBlockIndex = ctx.sseStateManager.AllocateBlockIndex()
+			ctx.thinkingBlockStarted = true
+			ctx.thinkingEmitted = true
+			ctx.sendThinkingEvent(map[string]any{
+				"type":          "content_block_start",
+				"index":         ctx.thinkingBlockIndex,
+				"content_block": map[string]any{"type": "thinking", "thinking": ""},
+			})
+
+		case segmentThinkingDelta:
+			if !ctx.thinkingBlockStarted {
+				continue
+			}
+			ctx.sendThinkingEvent(map[string]any{
+				"type":  "content_block_delta",
+				"index": ctx.thinkingBlockIndex,
+				"delta": map[string]any{"type": "thinking_delta", "thinking": seg.Text},
+			})
+			ctx.totalOutputTokens += ctx.tokenEstimator.EstimateTextTokens(seg.Text)
+
+		case segmentThinkingEnd:
+			if !ctx.thinkingBlockStarted {
+				continue
+			}
+			ctx.sendThinkingEvent(map[string]any{
+				"type":  "content_block_delta",
+				"index": ctx.thinkingBlockIndex,
+				"delta": map[string]any{"type": "signature_delta", "signature": seg.Text},
+			})
+			ctx.sendThinkingEvent(map[string]any{
+				"type":  "content_block_stop",
+				"index": ctx.thinkingBlockIndex,
+			})
+			ctx.thinkingBlockStarted = false
+
+		case segmentText:
+			if err := ctx.sendThinkingModeText(seg.Text); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sendThinkingModeText 下发普通文本，文本块未开启时先开启（首个块不是 thinking 时先补最小 thinking 块）
+func (ctx *StreamProcessorContext) sendThinkingModeText(text string) error {
+	if !ctx.textBlockStarted {
+		// 新文本块不以空白开头（</thinking> 后通常跟着换行）
+		text = strings.TrimLeft(text, " \t\r\n")
+		if text == "" {
+			return nil
+		}
+		ctx.ensureThinkingBlock()
+		ctx.textBlockIndex = ctx.sseStateManager.AllocateBlockIndex()
+		ctx.textBlockStarted = true
+		ctx.sendThinkingEvent(map[string]any{
+			"type":          "content_block_start",
+			"index":         ctx.textBlockIndex,
+			"content_block": map[string]any{"type": "text", "text": ""},
+		})
+	}
+
+	// 经过停止序列过滤后下发（并累计 token）
+	emit, stopped := ctx.stopSequences.Feed(ctx.textBlockIndex, text)
+	ctx.sendStopSequenceText(ctx.textBlockIndex, emit)
+	if stopped {
+		return errStopSequenceMatched
+	}
+	return nil
+}
+
+// ensureThinkingBlock 尚未下发 thinking 块时补一个最小 thinking 块（start → delta → signature → stop）
+func (ctx *StreamProcessorContext) ensureThinkingBlock() {
+	if ctx.thinkingEmitted {
+		return
+	}
+	ctx.thinkingEmitted = true
+
+	index := ctx.sseStateManager.AllocateBlockIndex()
+	ctx.sendThinkingEvent(map[string]any{
+		"type":          "content_block_start",
+		"index":         index,
+		"content_block": map[string]any{"type": "thinking", "thinking": ""},
+	})
+	ctx.sendThinkingEvent(map[string]any{
+		"type":  "content_block_delta",
+		"index": index,
+		"delta": map[string]any{"type": "thinking_delta", "thinking": placeholderThinking},
+	})
+	ctx.sendThinkingEvent(map[string]any{
+		"type":  "content_block_delta",
+		"index": index,
+		"delta": map[string]any{"type": "signature_delta", "signature": SignThinking(placeholderThinking)},
+	})
+	ctx.sendThinkingEvent(map[string]any{
+		"type":  "content_block_stop",
+		"index": index,
+	})
+}
+
+// closeTextBlock 关闭已开启的文本块，先下发停止序列匹配器暂缓的文本
+func (ctx *StreamProcessorContext) closeTextBlock() error {
+	if !ctx.textBlockStarted {
+		return nil
+	}
+	ctx.flushStopSequenceText()
+	ctx.sendThinkingEvent(map[string]any{
+		"type":  "content_block_stop",
+		"index": ctx.textBlockIndex,
+	})
+	ctx.textBlockStarted = false
+	return nil
+}
+
+/**
+ * closeThinkingModeBlocks 上游文本块结束或其他块开始时调用
+ * 刷新提取器中暂存的内容（未闭合的 thinking 块以签名结束），并关闭仍打开的文本块
+ */
+func (ctx *StreamProcessorContext) closeThinkingModeBlocks() error {
+	if ctx.thinkingExtractor != nil && ctx.stopSequences.Matched() == "" {
+		if err := ctx.emitThinkingSegments(ctx.thinkingExtractor.FlushStreaming()); err != nil {
+			return err
+		}
+	}
+	if ctx.thinkingBlockStarted {
+		ctx.sendThinkingEvent(map[string]any{
+			"type":  "content_block_stop",
+			"index": ctx.thinkingBlockIndex,
+		})
+		ctx.thinkingBlockStarted = false
+	}
+	return ctx.closeTextBlock()
+}
+
+// sendThinkingEvent 通过状态管理器下发 thinking 流生成的事件
+func (ctx *StreamProcessorContext) sendThinkingEvent(event map[string]any) {
+	if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, event); err != nil {
+		utils.Log("发送 thinking 流事件失败", utils.LogErr(err), utils.LogAny("event_type", event["type"]))
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"kiro/config"
+	"kiro/utils"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsVersions TLS_MIN_VERSION 可选值
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// defaultAutocertCacheDir 未配置 TLS_AUTOCERT_CACHE_DIR 时的证书缓存目录
+const defaultAutocertCacheDir = "autocert-cache"
+
+// tlsListener 启用 HTTPS 时的监听配置
+type tlsListener struct {
+	certFile, keyFile string
+	manager           *autocert.Manager // 自动签发证书时非空
+}
+
+/**
+ * configureTLS 按环境变量为服务器启用 HTTPS
+ * 证书文件和 Let's Encrypt 自动签发二选一；都未配置时返回 nil，服务器以明文 HTTP 监听
+ */
+func configureTLS(server *http.Server) (*tlsListener, error) {
+	if err := checkTLSSettings(); err != nil {
+		return nil, err
+	}
+	domains := splitDomains(config.Current().TLSAutocertDomains)
+	if config.Current().TLSCertFile == "" && len(domains) == 0 {
+		return nil, nil
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if config.Current().TLSMinVersion != "" {
+		v, ok := tlsVersions[config.Current().TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("无效的 TLS_MIN_VERSION: %q", config.Current().TLSMinVersion)
+		}
+		minVersion = v
+	}
+
+	listener := &tlsListener{certFile: config.Current().TLSCertFile, keyFile: config.Current().TLSKeyFile}
+	server.TLSConfig = &tls.Config{MinVersion: minVersion}
+	if len(domains) > 0 {
+		cacheDir := config.Current().TLSAutocertCacheDir
+		if cacheDir == "" {
+			cacheDir = defaultAutocertCacheDir
+		}
+		listener.manager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      config.Current().TLSAutocertEmail,
+		}
+		server.TLSConfig.GetCertificate = listener.manager.GetCertificate
+		// 支持 TLS-ALPN-01 验证，未开放 80 端口时也能签发证书
+		server.TLSConfig.NextProtos = append(server.TLSConfig.NextProtos, "h2", "http/1.1", "acme-tls/1")
+	}
+
+	utils.Log("已启用 HTTPS",
+		utils.LogString("min_version", tls.VersionName(minVersion)),
+		utils.LogBool("autocert", listener.manager != nil),
+		utils.LogString("domains", strings.Join(domains, ",")),
+		utils.LogString("redirect_port", config.Current().HTTPRedirectPort))
+	return listener, nil
+}
+
+// checkTLSSettings 检查 HTTPS 相关环境变量的组合是否合法
+func checkTLSSettings() error {
+	hasFiles := config.Current().TLSCertFile != "" || config.Current().TLSKeyFile != ""
+	if hasFiles && config.Current().TLSAutocertDomains != "" {
+		return fmt.Errorf("TLS_CERT_FILE/TLS_KEY_FILE 与 TLS_AUTOCERT_DOMAINS 不能同时配置")
+	}
+	if hasFiles && (config.Current().TLSCertFile == "" || config.Current().TLSKeyFile == "") {
+		return fmt.Errorf("TLS_CERT_FILE 和 TLS_KEY_FILE 必须同时配置")
+	}
+	if config.Current().HTTPRedirectPort != "" && !hasFiles && config.Current().TLSAutocertDomains == "" {
+		return fmt.Errorf("HTTP_REDIRECT_PORT 仅在启用 HTTPS 时生效")
+	}
+	return nil
+}
+
+// serve 在已监听的端口上提供 HTTPS 服务，阻塞直到服务器关闭
+func (l *tlsListener) serve(server *http.Server, ln net.Listener) error {
+	return server.ServeTLS(ln, l.certFile, l.keyFile)
+}
+
+/**
+ * redirectServer 返回 HTTP→HTTPS 重定向服务器，未配置 HTTP_REDIRECT_PORT 时返回 nil
+ * 自动签发证书时由 autocert 先应答 HTTP-01 验证请求，其余请求 301 重定向到 HTTPS 端口
+ */
+func (l *tlsListener) redirectServer(httpsPort string) *http.Server {
+	if config.Current().HTTPRedirectPort == "" {
+		return nil
+	}
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+	if l.manager != nil {
+		handler = l.manager.HTTPHandler(handler)
+	}
+	return &http.Server{Handler: handler}
+}
+
+// splitDomains 解析逗号分隔的域名列表
+func splitDomains(value string) []string {
+	var domains []string
+	for _, domain := range strings.Split(value, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
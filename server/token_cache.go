@@ -2,16 +2,23 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"kiro/config"
+	"kiro/lifecycle"
+	"kiro/tenant"
 	"kiro/types"
 	"kiro/utils"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sync/singleflight"
@@ -24,21 +31,48 @@ type TokenCache struct {
 	AccessToken  string
 	RefreshToken string
 	ProfileArn   string
-	LastRefresh  time.Time
-	TokenType    types.TokenType
-	// AmazonQ 专用字段
+	// ProfileArn 来自 token 配置时为 true，刷新响应不覆盖
+	ProfileArnConfigured bool
+	// Profiles token 声明的多个 profile（来自 token 配置）
+	Profiles    []TokenProfile
+	LastRefresh time.Time
+	ExpiresAt   time.Time // 刷新响应给出的过期时间，未给出时为零值
+	VerifiedAt  time.Time // 最近一次预检通过的时间（不持久化）
+	TokenType   types.TokenType
+	// AmazonQ / IdC 专用字段
 	ClientID     string
 	ClientSecret string
+	Region       string
+	// 账号标注（来自租户 token 池配置）
+	Labels tenant.AccountLabels
 }
 
-var (
-	// tokenMap Token 缓存映射（key: token hash）
-	tokenMap = make(map[string]*TokenCache)
-	// tokenMutex Token 缓存互斥锁
-	tokenMutex sync.RWMutex
+/**
+ * TokenService 上游 token 缓存
+ * 负责按需刷新、失效、定时刷新和持久化，由 Server 持有并通过请求上下文提供给处理器，
+ * 测试可以为每个 Server 创建独立的实例
+ */
+type TokenService struct {
+	// entries Token 缓存映射（key: token hash）
+	entries map[string]*TokenCache
+	// mu Token 缓存互斥锁
+	mu sync.RWMutex
 	// refreshGroup 用于防止并发刷新同一个 token
 	refreshGroup singleflight.Group
-)
+	// store 持久化存储，未启用时为 nil
+	store *tokenStore
+	// refresher 定时刷新任务
+	refresher *lifecycle.Task
+	// pool 全局上游 token 池，未启用时为 nil
+	pool atomic.Pointer[tokenPool]
+	// poolCursor 全局 token 池的轮询游标
+	poolCursor atomic.Uint64
+}
+
+// NewTokenService 创建空的 token 缓存
+func NewTokenService() *TokenService {
+	return &TokenService{entries: make(map[string]*TokenCache)}
+}
 
 /**
  * sha256Hash 计算输入文本的 SHA256 哈希值
@@ -49,22 +83,10 @@ func sha256Hash(text string) string {
 }
 
 /**
- * ParseToken 解析 token 格式，判断是 Kiro 还是 AmazonQ
- * AmazonQ 格式: clientId:clientSecret:refreshToken
- * Kiro 格式: refreshToken (单段)
- */
-func ParseToken(token string) (tokenType types.TokenType, clientID, clientSecret, refreshToken string) {
-	parts := strings.SplitN(token, ":", 3)
-	if len(parts) == 3 && parts[0] != "" && parts[2] != "" {
-		return types.TokenTypeAmazonQ, parts[0], parts[1], parts[2]
-	}
-	return types.TokenTypeKiro, "", "", token
-}
-
-/**
- * RefreshAmazonQToken 刷新 AmazonQ token
+ * RefreshAmazonQToken 刷新 AmazonQ / IdC token
+ * region 为空时使用 AmazonQ 默认端点（us-east-1）
  */
-func RefreshAmazonQToken(clientID, clientSecret, refreshToken string) (string, error) {
+func RefreshAmazonQToken(ctx context.Context, clientID, clientSecret, refreshToken, region string) (*types.RefreshResponse, error) {
 	refreshReq := types.AmazonQRefreshRequest{
 		GrantType:    "refresh_token",
 		ClientID:     clientID,
@@ -74,12 +96,18 @@ func RefreshAmazonQToken(clientID, clientSecret, refreshToken string) (string, e
 
 	reqBody, err := utils.FastMarshal(refreshReq)
 	if err != nil {
-		return "", fmt.Errorf("序列化请求失败: %v", err)
+		return nil, fmt.Errorf("序列化请求失败: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", config.AmazonQTokenURL, bytes.NewBuffer(reqBody))
+	settings := config.Current()
+	tokenURL := settings.AmazonQTokenURL
+	if region != "" {
+		tokenURL = fmt.Sprintf(settings.OIDCTokenURLFormat, region)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", tokenURL, bytes.NewBuffer(reqBody))
 	if err != nil {
-		return "", fmt.Errorf("创建请求失败: %v", err)
+		return nil, fmt.Errorf("创建请求失败: %v", err)
 	}
 
 	for k, v := range config.AmazonQOIDCHeaders {
@@ -91,32 +119,32 @@ func RefreshAmazonQToken(clientID, clientSecret, refreshToken string) (string, e
 	tokenHash := sha256Hash(refreshToken)
 	resp, err := utils.DoRequestWithProxy(req, tokenHash)
 	if err != nil {
-		return "", fmt.Errorf("请求失败: %v", err)
+		return nil, fmt.Errorf("请求失败: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("刷新失败: 状态码 %d, 响应: %s", resp.StatusCode, string(body))
+		return nil, &refreshStatusError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	var refreshResp types.RefreshResponse
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("读取响应失败: %v", err)
+		return nil, fmt.Errorf("读取响应失败: %v", err)
 	}
 
 	if err := utils.SafeUnmarshal(body, &refreshResp); err != nil {
-		return "", fmt.Errorf("解析响应失败: %v", err)
+		return nil, fmt.Errorf("解析响应失败: %v", err)
 	}
 
-	return refreshResp.AccessToken, nil
+	return &refreshResp, nil
 }
 
 /**
  * RefreshKiroToken 刷新 Kiro token
  */
-func RefreshKiroToken(refreshToken string) (*types.RefreshResponse, error) {
+func RefreshKiroToken(ctx context.Context, refreshToken string) (*types.RefreshResponse, error) {
 	refreshReq := types.RefreshRequest{
 		RefreshToken: refreshToken,
 	}
@@ -126,7 +154,7 @@ func RefreshKiroToken(refreshToken string) (*types.RefreshResponse, error) {
 		return nil, fmt.Errorf("序列化请求失败: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", config.RefreshTokenURL, bytes.NewBuffer(reqBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", config.Current().RefreshTokenURL, bytes.NewBuffer(reqBody))
 	if err != nil {
 		return nil, fmt.Errorf("创建请求失败: %v", err)
 	}
@@ -145,7 +173,7 @@ func RefreshKiroToken(refreshToken string) (*types.RefreshResponse, error) {
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("刷新失败: 状态码 %d, 响应: %s", resp.StatusCode, string(body))
+		return nil, &refreshStatusError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	var refreshResp types.RefreshResponse
@@ -161,106 +189,233 @@ func RefreshKiroToken(refreshToken string) (*types.RefreshResponse, error) {
 	return &refreshResp, nil
 }
 
+// refreshStatusError 刷新端点返回的非 200 响应
+type refreshStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *refreshStatusError) Error() string {
+	return fmt.Sprintf("刷新失败: 状态码 %d, 响应: %s", e.StatusCode, e.Body)
+}
+
+// refreshedToken 一次刷新的结果
+type refreshedToken struct {
+	AccessToken  string
+	ProfileArn   string    // 仅 Kiro 刷新响应返回
+	RefreshToken string    // 刷新端点轮换后的 refresh token，未轮换时为空
+	ExpiresAt    time.Time // 刷新响应给出的过期时间，未给出时为零值
+}
+
 /**
- * GetOrRefreshToken 获取或刷新 token，自动识别 Kiro 或 AmazonQ 格式
- * 使用 singleflight 确保同一个 token 的并发请求只刷新一次
+ * refreshParsedToken 按 token 类型调用对应的刷新端点
+ * 200 响应中缺少 accessToken 视为无效响应（与无法解析的响应一样可重试）
  */
-func GetOrRefreshToken(token string) (*TokenCache, error) {
+func refreshParsedToken(ctx context.Context, tokenType types.TokenType, clientID, clientSecret, refreshToken, region string) (refreshedToken, error) {
+	var resp *types.RefreshResponse
+	var err error
+	switch tokenType {
+	case types.TokenTypeAmazonQ, types.TokenTypeIdC:
+		resp, err = RefreshAmazonQToken(ctx, clientID, clientSecret, refreshToken, region)
+	default:
+		resp, err = RefreshKiroToken(ctx, refreshToken)
+	}
+	if err != nil {
+		return refreshedToken{}, err
+	}
+	if resp.AccessToken == "" {
+		return refreshedToken{}, fmt.Errorf("刷新响应缺少 accessToken")
+	}
+
+	result := refreshedToken{AccessToken: resp.AccessToken, ProfileArn: resp.ProfileArn}
+	if resp.RefreshToken != "" && resp.RefreshToken != refreshToken {
+		result.RefreshToken = resp.RefreshToken
+	}
+	if resp.ExpiresIn > 0 {
+		result.ExpiresAt = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+	return result, nil
+}
+
+// isRetryableRefreshError 网络错误、429 和 5xx 可重试；其他 4xx（如 refresh token 已失效）重试无意义
+func isRetryableRefreshError(err error) bool {
+	var statusErr *refreshStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+	return true
+}
+
+/**
+ * refreshWithRetry 执行刷新，遇到可重试错误时按指数退避（附加随机抖动）重试
+ * 最多尝试 TOKEN_REFRESH_MAX_ATTEMPTS 次；退避期间 ctx 结束时不再重试
+ */
+func refreshWithRetry(ctx context.Context, refresh func(ctx context.Context) error) error {
+	settings := config.Current()
+	base := time.Duration(settings.TokenRefreshBackoffMs) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := refresh(ctx)
+		if err == nil {
+			return nil
+		}
+		if attempt >= settings.TokenRefreshMaxAttempts || !isRetryableRefreshError(err) || ctx.Err() != nil {
+			return err
+		}
+
+		wait := retryBackoff(base, attempt)
+		utils.Error("AT 刷新失败（第 %d 次），%v 后重试: %v", attempt, wait, err)
+		if waitErr := sleepContext(ctx, wait); waitErr != nil {
+			return fmt.Errorf("AT 刷新重试已取消: %w（上次错误: %v）", waitErr, err)
+		}
+	}
+}
+
+// awaitFlight 等待 singleflight 结果；ctx 先结束时调用方不再等待，刷新继续进行并供其他等待者使用
+func awaitFlight(ctx context.Context, ch <-chan singleflight.Result) (*TokenCache, error) {
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*TokenCache), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+/**
+ * GetOrRefresh 获取或刷新 token，自动识别 Kiro、AmazonQ 或 IdC 格式
+ * 使用 singleflight 确保同一个 token 的并发请求只刷新一次；刷新在进程生命周期内进行，
+ * ctx 结束时调用方停止等待并返回 ctx 的错误
+ */
+func (s *TokenService) GetOrRefresh(ctx context.Context, token string) (*TokenCache, error) {
 	tokenHash := sha256Hash(token)
 
 	// 检查缓存
-	tokenMutex.RLock()
-	cached, exists := tokenMap[tokenHash]
-	tokenMutex.RUnlock()
+	s.mu.RLock()
+	cached, exists := s.entries[tokenHash]
+	s.mu.RUnlock()
 
 	if exists {
-		return cached, nil
+		if !s.needsPreflight(cached) {
+			return cached, nil
+		}
+		return s.preflight(ctx, tokenHash, cached)
 	}
 
 	// 使用 singleflight 确保同一个 token 只刷新一次
-	result, err, _ := refreshGroup.Do(tokenHash, func() (interface{}, error) {
+	ch := s.refreshGroup.DoChan(tokenHash, func() (interface{}, error) {
 		// 双重检查：可能在等待期间已被其他 goroutine 刷新
-		tokenMutex.RLock()
-		cached, exists := tokenMap[tokenHash]
-		tokenMutex.RUnlock()
+		s.mu.RLock()
+		cached, exists := s.entries[tokenHash]
+		s.mu.RUnlock()
 		if exists {
 			return cached, nil
 		}
 
 		// 解析 token 类型
-		tokenType, clientID, clientSecret, refreshToken := ParseToken(token)
-
-		var accessToken string
-		var profileArn string
-		var refreshErr error
-
-		switch tokenType {
-		case types.TokenTypeAmazonQ:
-			accessToken, refreshErr = RefreshAmazonQToken(clientID, clientSecret, refreshToken)
-		default:
-			var resp *types.RefreshResponse
-			resp, refreshErr = RefreshKiroToken(refreshToken)
-			if resp != nil {
-				accessToken = resp.AccessToken
-				profileArn = resp.ProfileArn
-			}
+		parsed, parseErr := ParseToken(token)
+		if parseErr != nil {
+			utils.Error("Token 格式错误: %v", parseErr)
+			return nil, parseErr
 		}
 
-		// 获取类型名称用于日志
-		typeName := "Kiro"
-		if tokenType == types.TokenTypeAmazonQ {
-			typeName = "AmazonQ"
-		}
+		var refreshed refreshedToken
+		refreshErr := refreshWithRetry(lifecycle.Context(), func(ctx context.Context) error {
+			var err error
+			refreshed, err = refreshParsedToken(ctx, parsed.Type, parsed.ClientID, parsed.ClientSecret, parsed.RefreshToken, parsed.Region)
+			return err
+		})
 
 		if refreshErr != nil {
-			utils.Error("AT 刷新失败 [%s]: %v", typeName, refreshErr)
+			utils.Error("AT 刷新失败 [%s]: %v", parsed.Type, refreshErr)
 			return nil, refreshErr
 		}
 
-		utils.Info("AT 刷新成功 [%s]", typeName)
+		utils.Info("AT 刷新成功 [%s]", parsed.Type)
+
+		// 显式配置的 profileArn 优先（部分企业 IdC 环境刷新响应不返回或返回的不是目标 profile）
+		profileArn := refreshed.ProfileArn
+		if parsed.ProfileArn != "" {
+			profileArn = parsed.ProfileArn
+		}
+		// 刷新端点轮换了 refresh token 时，后续刷新使用新值（缓存键仍为客户端提供的 token）
+		refreshToken := parsed.RefreshToken
+		if refreshed.RefreshToken != "" {
+			refreshToken = refreshed.RefreshToken
+			utils.Info("refresh token 已轮换 [%s]", parsed.Type)
+		}
 
-		// 缓存
 		entry := &TokenCache{
-			AccessToken:  accessToken,
-			RefreshToken: refreshToken,
-			ProfileArn:   profileArn,
-			LastRefresh:  time.Now(),
-			TokenType:    tokenType,
-			ClientID:     clientID,
-			ClientSecret: clientSecret,
+			AccessToken:          refreshed.AccessToken,
+			RefreshToken:         refreshToken,
+			ProfileArn:           profileArn,
+			ProfileArnConfigured: parsed.ProfileArn != "",
+			Profiles:             parsed.Profiles,
+			LastRefresh:          time.Now(),
+			ExpiresAt:            refreshed.ExpiresAt,
+			TokenType:            parsed.Type,
+			ClientID:             parsed.ClientID,
+			ClientSecret:         parsed.ClientSecret,
+			Region:               parsed.Region,
+		}
+		// 首次刷新后校验权限，不具备权限的 token 不缓存
+		if err := checkTokenScope(entry, tokenHash); err != nil {
+			utils.Error("AT 权限校验失败 [%s]: %v", parsed.Type, err)
+			return nil, err
 		}
-		tokenMutex.Lock()
-		tokenMap[tokenHash] = entry
-		tokenMutex.Unlock()
+
+		// 缓存
+		s.mu.Lock()
+		s.entries[tokenHash] = entry
+		s.mu.Unlock()
+		s.persist(tokenHash, entry)
 
 		return entry, nil
 	})
+	return awaitFlight(ctx, ch)
+}
 
-	if err != nil {
-		return nil, err
-	}
+/**
+ * Invalidate 使指定的 token 缓存失效
+ * 当上游返回 403 表示 token 已过期时调用
+ */
+func (s *TokenService) Invalidate(token string) {
+	s.remove(sha256Hash(token))
+}
 
-	return result.(*TokenCache), nil
+// remove 按 hash 移除缓存条目及其持久化记录
+func (s *TokenService) remove(hash string) {
+	s.mu.Lock()
+	delete(s.entries, hash)
+	s.mu.Unlock()
+	s.forget(hash)
 }
 
 /**
- * InvalidateToken 使指定的 token 缓存失效
- * 当上游返回 403 表示 token 已过期时调用
+ * SetLabels 为已缓存的 token 设置账号标注
  */
-func InvalidateToken(token string) {
+func (s *TokenService) SetLabels(token string, labels tenant.AccountLabels) {
 	tokenHash := sha256Hash(token)
-	tokenMutex.Lock()
-	delete(tokenMap, tokenHash)
-	tokenMutex.Unlock()
+	s.mu.Lock()
+	if entry, ok := s.entries[tokenHash]; ok {
+		entry.Labels = labels
+	}
+	s.mu.Unlock()
+}
+
+// Count 返回已缓存的 token 数
+func (s *TokenService) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.entries)
 }
 
 /**
- * RefreshAllTokens 全局刷新器，遍历并刷新所有缓存的 token
+ * RefreshAll 遍历并刷新所有缓存的 token
  */
-func RefreshAllTokens() {
-	tokenMutex.RLock()
-	count := len(tokenMap)
-	tokenMutex.RUnlock()
+func (s *TokenService) RefreshAll(ctx context.Context) {
+	count := s.Count()
 
 	if count == 0 {
 		return
@@ -268,48 +423,22 @@ func RefreshAllTokens() {
 
 	refreshCount := 0
 
-	tokenMutex.RLock()
+	s.mu.RLock()
 	tokens := make(map[string]*TokenCache)
-	for k, v := range tokenMap {
+	for k, v := range s.entries {
 		tokens[k] = v
 	}
-	tokenMutex.RUnlock()
+	s.mu.RUnlock()
 
 	for hash, cache := range tokens {
-		var newToken string
-		var newProfileArn string
-		var err error
-
-		switch cache.TokenType {
-		case types.TokenTypeAmazonQ:
-			newToken, err = RefreshAmazonQToken(cache.ClientID, cache.ClientSecret, cache.RefreshToken)
-		default:
-			var resp *types.RefreshResponse
-			resp, err = RefreshKiroToken(cache.RefreshToken)
-			if resp != nil {
-				newToken = resp.AccessToken
-				newProfileArn = resp.ProfileArn
-			}
+		if ctx.Err() != nil {
+			utils.Info("Token 刷新已中止: %d/%d", refreshCount, count)
+			return
 		}
-
-		if err != nil {
+		if err := s.refreshCached(ctx, hash, cache); err != nil {
 			utils.Error("刷新 token 失败: %v", err)
-			tokenMutex.Lock()
-			delete(tokenMap, hash)
-			tokenMutex.Unlock()
 			continue
 		}
-
-		tokenMutex.Lock()
-		if tokenMap[hash] != nil {
-			tokenMap[hash].AccessToken = newToken
-			tokenMap[hash].LastRefresh = time.Now()
-			if newProfileArn != "" {
-				tokenMap[hash].ProfileArn = newProfileArn
-			}
-		}
-		tokenMutex.Unlock()
-
 		refreshCount++
 	}
 
@@ -317,18 +446,192 @@ func RefreshAllTokens() {
 }
 
 /**
- * StartTokenRefresher 启动定时 token 刷新器
+ * refreshCached 使用缓存条目中的凭证立即刷新 access token
+ * 刷新失败（重试后）时移除该缓存条目，下次请求重新刷新；ctx 结束时停止重试并保留条目
+ */
+func (s *TokenService) refreshCached(ctx context.Context, hash string, cache *TokenCache) error {
+	s.mu.RLock()
+	refreshToken := cache.RefreshToken
+	s.mu.RUnlock()
+
+	var refreshed refreshedToken
+	err := refreshWithRetry(ctx, func(ctx context.Context) error {
+		var refreshErr error
+		refreshed, refreshErr = refreshParsedToken(ctx, cache.TokenType, cache.ClientID, cache.ClientSecret, refreshToken, cache.Region)
+		return refreshErr
+	})
+
+	if err != nil {
+		if ctx.Err() == nil {
+			s.remove(hash)
+		}
+		return err
+	}
+
+	s.mu.Lock()
+	entry := s.entries[hash]
+	if entry != nil {
+		entry.AccessToken = refreshed.AccessToken
+		entry.LastRefresh = time.Now()
+		entry.ExpiresAt = refreshed.ExpiresAt
+		if refreshed.RefreshToken != "" {
+			entry.RefreshToken = refreshed.RefreshToken
+		}
+		if refreshed.ProfileArn != "" && !entry.ProfileArnConfigured {
+			entry.ProfileArn = refreshed.ProfileArn
+		}
+	}
+	s.mu.Unlock()
+	if entry != nil {
+		s.persist(hash, entry)
+	}
+	return nil
+}
+
+/**
+ * StartRefresher 启动定时 token 刷新器
  * 在后台 goroutine 中每 45 分钟自动刷新所有缓存的 token
  */
-func StartTokenRefresher() {
-	go func() {
+func (s *TokenService) StartRefresher() {
+	s.refresher.Stop()
+	s.refresher = lifecycle.Go("token-refresher", func(ctx context.Context) {
 		ticker := time.NewTicker(45 * time.Minute)
 		defer ticker.Stop()
 
-		for range ticker.C {
-			RefreshAllTokens()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.RefreshAll(ctx)
+			}
 		}
-	}()
+	})
 
 	utils.Info("Token 自动刷新器已启动 (间隔: 45分钟)")
 }
+
+// StopRefresher 停止定时刷新器，正在进行的一轮刷新在当前 token 完成后结束
+func (s *TokenService) StopRefresher() {
+	s.refresher.Stop()
+}
+
+// tokenPool 全局上游 token 池（KIRO_TOKENS / KIRO_TOKENS_FILE）及其访问密钥
+type tokenPool struct {
+	tokens []string
+	// apiKey 使用全局 token 池的本地 API Key
+	apiKey string
+}
+
+/**
+ * InitTokenPool 从环境变量加载全局 token 池
+ * KIRO_TOKENS: 逗号或换行分隔的 refresh token 列表（支持 kiro:/q:/idc: 前缀）
+ * KIRO_TOKENS_FILE: token 文件路径，每行一个，# 开头为注释
+ * KIRO_POOL_API_KEY: 客户端访问 token 池使用的本地 API Key，未配置时 token 池不启用
+ */
+func InitTokenPool(tokenService *TokenService) {
+	tokens, err := readPoolTokens()
+	if err != nil {
+		utils.Error("读取 token 文件失败: %v", err)
+	}
+	if len(tokens) == 0 {
+		return
+	}
+
+	valid := tokens[:0]
+	for i, t := range tokens {
+		if _, err := ParseToken(t); err != nil {
+			utils.Error("token 池第 %d 个 token 格式错误，已跳过: %v", i+1, err)
+			continue
+		}
+		valid = append(valid, t)
+	}
+
+	apiKey := os.Getenv("KIRO_POOL_API_KEY")
+	if apiKey == "" {
+		utils.Error("已配置 %d 个池化 token，但未设置 KIRO_POOL_API_KEY，token 池未启用", len(valid))
+		return
+	}
+	tokenService.SetPool(apiKey, valid)
+	utils.Info("全局 token 池已加载 %d 个 token", len(valid))
+	checkPoolTokenScopes(tokenService)
+}
+
+// SetPool 设置全局 token 池：使用 apiKey 的请求按轮询从 tokens 中选取上游 token，tokens 为空时停用
+func (s *TokenService) SetPool(apiKey string, tokens []string) {
+	if len(tokens) == 0 {
+		s.pool.Store(nil)
+		return
+	}
+	s.pool.Store(&tokenPool{tokens: append([]string(nil), tokens...), apiKey: apiKey})
+}
+
+// poolTokens 返回全局 token 池中的 token，未启用时为 nil
+func (s *TokenService) poolTokens() []string {
+	if pool := s.pool.Load(); pool != nil {
+		return pool.tokens
+	}
+	return nil
+}
+
+// readPoolTokens 读取 KIRO_TOKENS 和 KIRO_TOKENS_FILE 中配置的 token（未校验格式）
+func readPoolTokens() ([]string, error) {
+	var tokens []string
+	for _, t := range strings.FieldsFunc(os.Getenv("KIRO_TOKENS"), func(r rune) bool { return r == ',' || r == '\n' }) {
+		if t = strings.TrimSpace(t); t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	path := os.Getenv("KIRO_TOKENS_FILE")
+	if path == "" {
+		return tokens, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return tokens, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			tokens = append(tokens, line)
+		}
+	}
+	return tokens, nil
+}
+
+/**
+ * isPoolAPIKey 判断本地 API Key 是否为全局 token 池的访问密钥
+ */
+func (s *TokenService) isPoolAPIKey(key string) bool {
+	pool := s.pool.Load()
+	return pool != nil && subtle.ConstantTimeCompare([]byte(key), []byte(pool.apiKey)) == 1
+}
+
+/**
+ * NextPoolToken 按轮询顺序从全局 token 池选取 token
+ * 跳过已知额度耗尽的 token；全部耗尽时仍按轮询返回，由上游错误处理返回重置时间
+ * exclude 非空时跳过该 token（用于失败后切换）
+ */
+func (s *TokenService) NextPoolToken(exclude string) (string, bool) {
+	tokens := s.poolTokens()
+	n := len(tokens)
+	if n == 0 {
+		return "", false
+	}
+
+	start := int(s.poolCursor.Add(1) - 1)
+	fallback := ""
+	for i := 0; i < n; i++ {
+		token := tokens[(start+i)%n]
+		if token == exclude {
+			continue
+		}
+		if cachedQuotaExhaustion(sha256Hash(token)) != nil {
+			if fallback == "" {
+				fallback = token
+			}
+			continue
+		}
+		return token, true
+	}
+	return fallback, fallback != ""
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"kiro/tenant"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tokenFailoverKey 标记本次请求已切换过上游 token，每个请求最多切换一次
+const tokenFailoverKey = "tokenFailover"
+
+// hasAlternateToken 当前请求所在的 token 池中是否还有其他 token
+func hasAlternateToken(c *gin.Context) bool {
+	if profile := tokenPoolProfile(c); profile != nil {
+		return len(profile.Tokens) > 1
+	}
+	return c.GetBool("tokenPool") && len(tokenServiceOf(c).poolTokens()) > 1
+}
+
+/**
+ * failoverToNextToken 将请求切换到池中的下一个 token
+ * 每个请求只切换一次，返回 false 表示已切换过或没有可用的 token
+ */
+func failoverToNextToken(c *gin.Context) bool {
+	if c.GetBool(tokenFailoverKey) || !hasAlternateToken(c) {
+		return false
+	}
+	if !switchToNextPooledToken(c) {
+		return false
+	}
+	c.Set(tokenFailoverKey, true)
+	return true
+}
+
+/**
+ * failoverOnAccountError 上游返回 403（封禁）或 429（限流）时切换到下一个 token
+ * 切换前使失效 token 的缓存失效、记录额度状态，使后续轮询跳过该 token；
+ * 无法切换时恢复响应体，交由常规错误处理
+ */
+func failoverOnAccountError(c *gin.Context, anthropicReq types.AnthropicRequest, resp *http.Response) bool {
+	if c.GetBool(tokenFailoverKey) || !hasAlternateToken(c) {
+		return false
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	failedToken := c.GetString("refreshToken")
+	var incident *banIncident
+	if resp.StatusCode == http.StatusForbidden {
+		// 切换前采集，此时上下文中仍是被封禁的 token；无法切换时由 handleCodeWhispererError 记录
+		incident = newBanIncident(c, anthropicReq, resp, body)
+		tokenServiceOf(c).Invalidate(failedToken)
+	} else {
+		checkQuotaExhausted(c)
+	}
+
+	if !failoverToNextToken(c) {
+		return false
+	}
+	if incident != nil {
+		incident.FailedOver = true
+		incident.submit(c)
+	}
+	utils.RecordPolicy(c, "token_failover", "upstream returned %d; switched to the next pooled token", resp.StatusCode)
+	utils.Log("上游账号不可用，切换 token 重试",
+		addReqFields(c,
+			utils.LogInt("status", resp.StatusCode),
+			utils.LogString("tenant", tenantName(c)),
+			utils.LogString("upstream_body", string(body)),
+		)...)
+	return true
+}
+
+// switchToNextPooledToken 将当前请求切换到租户或全局 token 池中的另一个 token
+func switchToNextPooledToken(c *gin.Context) bool {
+	current := c.GetString("refreshToken")
+	profile := tokenPoolProfile(c)
+	if profile == nil {
+		if !c.GetBool("tokenPool") {
+			return false
+		}
+		next, found := tokenServiceOf(c).NextPoolToken(current)
+		if !found {
+			return false
+		}
+		if err := bindUpstreamToken(c, next, tenant.AccountLabels{}); err != nil {
+			utils.Error("切换上游 token 失败: %v", err)
+			return false
+		}
+		return true
+	}
+	entry, found := tenant.NextTokenMatching(profile, func(e tenant.TokenEntry) bool {
+		return e.Token != current
+	})
+	if !found {
+		return false
+	}
+	if err := bindUpstreamToken(c, entry.Token, entry.AccountLabels); err != nil {
+		utils.Error("切换上游 token 失败: %v", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"kiro/types"
+	"kiro/utils"
+)
+
+// ErrMalformedToken token 格式无法识别
+var ErrMalformedToken = errors.New("malformed token")
+
+// awsRegionPattern AWS 区域格式（如 us-east-1、eu-central-1）
+var awsRegionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d$`)
+
+// profileArnPattern CodeWhisperer profile ARN 格式（如 arn:aws:codewhisperer:us-east-1:123456789012:profile/ABCDEF）
+var profileArnPattern = regexp.MustCompile(`^arn:aws[a-z-]*:codewhisperer:[a-z0-9-]+:\d{12}:profile/[A-Za-z0-9]+$`)
+
+// 显式类型前缀
+const (
+	tokenPrefixKiro = "kiro:"
+	tokenPrefixQ    = "q:"
+	tokenPrefixIdC  = "idc:"
+)
+
+// tokenTypeAuto JSON token 未指定前缀时按字段自动识别类型
+const tokenTypeAuto types.TokenType = -1
+
+// ParsedToken 解析后的上游凭证
+type ParsedToken struct {
+	Type         types.TokenType
+	RefreshToken string
+	ClientID     string         // AmazonQ / IdC
+	ClientSecret string         // AmazonQ / IdC
+	Region       string         // IdC OIDC 区域，为空时使用 us-east-1
+	ProfileArn   string         // 显式配置的 profile ARN，优先于刷新响应返回的值
+	Profiles     []TokenProfile // 可选的多个 profile，按请求头或模型选择
+}
+
+// tokenBlob JSON 格式的 token（兼容 Kiro 本地缓存 kiro-auth-token.json 与客户端注册信息合并后的结构）
+type tokenBlob struct {
+	Type         string         `json:"type"`
+	AuthMethod   string         `json:"authMethod"` // social / IdC
+	RefreshToken string         `json:"refreshToken"`
+	ClientID     string         `json:"clientId"`
+	ClientSecret string         `json:"clientSecret"`
+	Region       string         `json:"region"`
+	ProfileArn   string         `json:"profileArn"`
+	Profiles     []TokenProfile `json:"profiles"`
+}
+
+/**
+ * ParseToken 解析 token 格式，识别 Kiro、AmazonQ 或 IdC
+ * 支持的格式:
+ *   kiro:refreshToken                               显式 Kiro（refreshToken 可包含冒号）
+ *   q:clientId:clientSecret:refreshToken            显式 AmazonQ
+ *   idc:region:clientId:clientSecret:refreshToken   IAM Identity Center
+ *   {"refreshToken": "...", "clientId": ...}        JSON（可带 kiro:/q:/idc: 前缀，可用 profileArn / profiles 指定 profile）
+ *   clientId:clientSecret:refreshToken              无前缀时按 AmazonQ 处理（clientSecret 可为空）
+ *   refreshToken                                    无前缀单段按 Kiro 处理
+ */
+func ParseToken(token string) (*ParsedToken, error) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return nil, fmt.Errorf("%w: token 为空", ErrMalformedToken)
+	}
+
+	switch {
+	case strings.HasPrefix(token, tokenPrefixKiro):
+		rest := strings.TrimPrefix(token, tokenPrefixKiro)
+		if strings.HasPrefix(rest, "{") {
+			return parseTokenBlob(rest, types.TokenTypeKiro)
+		}
+		return validateParsedToken(&ParsedToken{Type: types.TokenTypeKiro, RefreshToken: rest})
+	case strings.HasPrefix(token, tokenPrefixQ):
+		rest := strings.TrimPrefix(token, tokenPrefixQ)
+		if strings.HasPrefix(rest, "{") {
+			return parseTokenBlob(rest, types.TokenTypeAmazonQ)
+		}
+		parts := strings.SplitN(rest, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("%w: q: 前缀需要 clientId:clientSecret:refreshToken 三段", ErrMalformedToken)
+		}
+		return validateParsedToken(&ParsedToken{
+			Type:         types.TokenTypeAmazonQ,
+			ClientID:     parts[0],
+			ClientSecret: parts[1],
+			RefreshToken: parts[2],
+		})
+	case strings.HasPrefix(token, tokenPrefixIdC):
+		rest := strings.TrimPrefix(token, tokenPrefixIdC)
+		if strings.HasPrefix(rest, "{") {
+			return parseTokenBlob(rest, types.TokenTypeIdC)
+		}
+		parts := strings.SplitN(rest, ":", 4)
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("%w: idc: 前缀需要 region:clientId:clientSecret:refreshToken 四段", ErrMalformedToken)
+		}
+		return validateParsedToken(&ParsedToken{
+			Type:         types.TokenTypeIdC,
+			Region:       parts[0],
+			ClientID:     parts[1],
+			ClientSecret: parts[2],
+			RefreshToken: parts[3],
+		})
+	case strings.HasPrefix(token, "{"):
+		return parseTokenBlob(token, tokenTypeAuto)
+	}
+
+	// 无前缀：保持旧格式兼容（旧格式允许 clientSecret 为空，如 clientId::refreshToken）
+	parts := strings.SplitN(token, ":", 3)
+	if len(parts) == 3 {
+		return validateTokenFields(&ParsedToken{
+			Type:         types.TokenTypeAmazonQ,
+			ClientID:     parts[0],
+			ClientSecret: parts[1],
+			RefreshToken: parts[2],
+		}, false)
+	}
+	return validateParsedToken(&ParsedToken{Type: types.TokenTypeKiro, RefreshToken: token})
+}
+
+// parseTokenBlob 解析 JSON 格式的 token，hint 为前缀指定的类型
+func parseTokenBlob(raw string, hint types.TokenType) (*ParsedToken, error) {
+	var blob tokenBlob
+	if err := utils.SafeUnmarshal([]byte(raw), &blob); err != nil {
+		return nil, fmt.Errorf("%w: JSON 解析失败: %v", ErrMalformedToken, err)
+	}
+
+	tokenType := hint
+	if tokenType == tokenTypeAuto {
+		switch strings.ToLower(blob.Type) {
+		case "kiro", "social":
+			tokenType = types.TokenTypeKiro
+		case "q", "amazonq":
+			tokenType = types.TokenTypeAmazonQ
+		case "idc":
+			tokenType = types.TokenTypeIdC
+		case "":
+			switch {
+			case strings.EqualFold(blob.AuthMethod, "idc"):
+				tokenType = types.TokenTypeIdC
+			case blob.ClientID != "" || blob.ClientSecret != "":
+				tokenType = types.TokenTypeAmazonQ
+			default:
+				tokenType = types.TokenTypeKiro
+			}
+		default:
+			return nil, fmt.Errorf("%w: 未知的 token 类型 %q", ErrMalformedToken, blob.Type)
+		}
+	}
+
+	parsed := &ParsedToken{
+		Type:         tokenType,
+		RefreshToken: blob.RefreshToken,
+		ProfileArn:   blob.ProfileArn,
+		Profiles:     blob.Profiles,
+	}
+	if tokenType != types.TokenTypeKiro {
+		parsed.ClientID = blob.ClientID
+		parsed.ClientSecret = blob.ClientSecret
+	}
+	if tokenType == types.TokenTypeIdC {
+		parsed.Region = blob.Region
+	}
+	return validateParsedToken(parsed)
+}
+
+// validateParsedToken 校验各类型的必填字段
+func validateParsedToken(t *ParsedToken) (*ParsedToken, error) {
+	return validateTokenFields(t, true)
+}
+
+// validateTokenFields 校验必填字段，requireSecret 为 false 时 AmazonQ / IdC 仅要求 clientId 非空
+func validateTokenFields(t *ParsedToken, requireSecret bool) (*ParsedToken, error) {
+	if t.RefreshToken == "" {
+		return nil, fmt.Errorf("%w: %s token 缺少 refreshToken", ErrMalformedToken, t.Type)
+	}
+	if strings.ContainsAny(t.RefreshToken, " \t\r\n") {
+		return nil, fmt.Errorf("%w: refreshToken 包含空白字符", ErrMalformedToken)
+	}
+
+	switch t.Type {
+	case types.TokenTypeAmazonQ, types.TokenTypeIdC:
+		if t.ClientID == "" || (requireSecret && t.ClientSecret == "") {
+			return nil, fmt.Errorf("%w: %s token 需要非空的 clientId 和 clientSecret（refreshToken 本身包含冒号时请使用 kiro: 前缀）", ErrMalformedToken, t.Type)
+		}
+	}
+
+	if t.Type == types.TokenTypeIdC && t.Region != "" && !awsRegionPattern.MatchString(t.Region) {
+		return nil, fmt.Errorf("%w: 无效的 IdC 区域 %q", ErrMalformedToken, t.Region)
+	}
+	if t.ProfileArn != "" && !profileArnPattern.MatchString(t.ProfileArn) {
+		return nil, fmt.Errorf("%w: 无效的 profileArn %q", ErrMalformedToken, t.ProfileArn)
+	}
+	if err := validateTokenProfiles(t.Profiles); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedToken, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"kiro/config"
+	"kiro/lifecycle"
+	"kiro/utils"
+)
+
+/**
+ * 过期 access token 预检
+ * 长时间空闲（或重启后从持久化恢复）的 access token 可能已在上游失效，直接使用会让首个请求
+ * 先收到 403 再刷新重试。设置 TOKEN_PREFLIGHT_AFTER_SECONDS 后，缓存的 access token
+ * 自上次刷新或预检起超过该时间时，在使用前先处理：
+ *   - refresh（默认）：直接刷新
+ *   - probe：用一次用量查询验证，401/403 时刷新，其他错误按有效处理
+ * 同一个 token 的并发请求只预检一次
+ */
+
+// needsPreflight 缓存的 access token 是否需要在使用前预检
+func (s *TokenService) needsPreflight(entry *TokenCache) bool {
+	if config.Current().TokenPreflightAfterSeconds <= 0 {
+		return false
+	}
+	s.mu.RLock()
+	verified := entry.LastRefresh
+	if entry.VerifiedAt.After(verified) {
+		verified = entry.VerifiedAt
+	}
+	s.mu.RUnlock()
+	return time.Since(verified) >= time.Duration(config.Current().TokenPreflightAfterSeconds)*time.Second
+}
+
+// preflight 预检缓存的 access token，返回可用的缓存条目；刷新失败时条目已被移除，ctx 结束时停止等待
+func (s *TokenService) preflight(ctx context.Context, tokenHash string, entry *TokenCache) (*TokenCache, error) {
+	ch := s.refreshGroup.DoChan("preflight:"+tokenHash, func() (interface{}, error) {
+		// 双重检查：可能在等待期间已被其他 goroutine 预检
+		if !s.needsPreflight(entry) {
+			return entry, nil
+		}
+
+		if config.Current().TokenPreflightMode == "probe" {
+			_, probeErr := probeUsageLimits(entry.AccessToken, entry.ProfileArn, tokenHash)
+			var statusErr *usageStatusError
+			if probeErr == nil || !errors.As(probeErr, &statusErr) ||
+				(statusErr.StatusCode != http.StatusUnauthorized && statusErr.StatusCode != http.StatusForbidden) {
+				if probeErr != nil {
+					utils.Error("access token 预检失败，继续使用缓存: %v", probeErr)
+				}
+				s.mu.Lock()
+				entry.VerifiedAt = time.Now()
+				s.mu.Unlock()
+				return entry, nil
+			}
+			utils.Info("access token 预检返回 %d，刷新 [%s]", statusErr.StatusCode, entry.TokenType)
+		}
+
+		if err := s.refreshCached(lifecycle.Context(), tokenHash, entry); err != nil {
+			utils.Error("access token 预检刷新失败 [%s]: %v", entry.TokenType, err)
+			return nil, err
+		}
+		utils.Info("access token 预检刷新成功 [%s]", entry.TokenType)
+		return entry, nil
+	})
+	return awaitFlight(ctx, ch)
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * token 多 profile 支持
+ * 企业管理员可能按 profile 分配额度，一个 token 可在 JSON 格式中声明多个 CodeWhisperer profile（profiles 字段），
+ * 每次构建上游请求时按以下顺序选择：
+ *   1. 请求头 X-Kiro-Profile 指定的 profile（名称或 ARN）
+ *   2. models 通配符匹配请求模型的第一个 profile
+ *   3. token 的默认 profileArn（显式配置或刷新响应返回），未设置时使用第一个 profile
+ * 选中的 profile 配置了 endpoint 时固定使用该上游端点
+ */
+
+// tokenProfileHeader 客户端指定 profile 的请求头
+const tokenProfileHeader = "X-Kiro-Profile"
+
+// tokenProfilesKey 上下文键：当前上游 token 声明的 profile 列表
+const tokenProfilesKey = "tokenProfiles"
+
+// profileEndpointKey 上下文键：选中的 profile 固定的上游端点名称
+const profileEndpointKey = "profileEndpoint"
+
+// TokenProfile token 声明的一个 CodeWhisperer profile
+type TokenProfile struct {
+	Name     string   `json:"name"`               // profile 名称，用于 X-Kiro-Profile 请求头和日志
+	Arn      string   `json:"arn"`                // profile ARN
+	Endpoint string   `json:"endpoint,omitempty"` // 固定使用的上游端点名称（对应配置文件 upstream.endpoints），为空时按健康状态选择
+	Models   []string `json:"models,omitempty"`   // 使用该 profile 的模型（支持通配符），为空时只能通过请求头或默认规则选中
+}
+
+// validateTokenProfiles 校验 profile 的 ARN、名称唯一性和模型通配符
+func validateTokenProfiles(profiles []TokenProfile) error {
+	names := make(map[string]bool, len(profiles))
+	for i, p := range profiles {
+		if !profileArnPattern.MatchString(p.Arn) {
+			return fmt.Errorf("profiles[%d]: 无效的 arn %q", i, p.Arn)
+		}
+		if p.Name != "" {
+			if names[p.Name] {
+				return fmt.Errorf("profiles[%d]: 名称 %q 重复", i, p.Name)
+			}
+			names[p.Name] = true
+		}
+		for _, pattern := range p.Models {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("profiles[%d]: 模型通配符 %q 无效", i, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// currentTokenProfiles 返回当前上游 token 声明的 profile 列表
+func currentTokenProfiles(c *gin.Context) []TokenProfile {
+	v, _ := c.Get(tokenProfilesKey)
+	profiles, _ := v.([]TokenProfile)
+	return profiles
+}
+
+// findTokenProfile 按名称或 ARN 查找 profile
+func findTokenProfile(profiles []TokenProfile, ref string) *TokenProfile {
+	for i := range profiles {
+		if profiles[i].Arn == ref || (profiles[i].Name != "" && profiles[i].Name == ref) {
+			return &profiles[i]
+		}
+	}
+	return nil
+}
+
+/**
+ * validateProfileHeader 校验 X-Kiro-Profile 请求头指定的 profile 在当前 token 中存在
+ * 未携带请求头时不做校验
+ */
+func validateProfileHeader(c *gin.Context) error {
+	ref := strings.TrimSpace(c.GetHeader(tokenProfileHeader))
+	if ref == "" {
+		return nil
+	}
+	if findTokenProfile(currentTokenProfiles(c), ref) == nil {
+		return fmt.Errorf("%s %q does not match any profile declared for the upstream token", tokenProfileHeader, ref)
+	}
+	return nil
+}
+
+/**
+ * selectTokenProfile 为本次上游请求选择 profile，返回使用的 profileArn
+ * 同时记录选中 profile 固定的上游端点，未声明 profile 时返回 token 的默认 profileArn
+ */
+func selectTokenProfile(c *gin.Context, model string) string {
+	defaultArn := c.GetString("profileArn")
+	c.Set(profileEndpointKey, "")
+
+	profiles := currentTokenProfiles(c)
+	if len(profiles) == 0 {
+		return defaultArn
+	}
+
+	var chosen *TokenProfile
+	reason := "default"
+	if ref := strings.TrimSpace(c.GetHeader(tokenProfileHeader)); ref != "" {
+		if chosen = findTokenProfile(profiles, ref); chosen != nil {
+			reason = "header"
+		} else {
+			// 请求头已在入口校验，这里只可能是切换到了未声明该 profile 的 token
+			utils.RecordPolicy(c, "token_profile", "profile %q not declared by current token; using default", ref)
+		}
+	}
+	if chosen == nil {
+		for i := range profiles {
+			if profileMatchesModel(profiles[i], model) {
+				chosen, reason = &profiles[i], "model"
+				break
+			}
+		}
+	}
+	if chosen == nil {
+		if defaultArn != "" {
+			if chosen = findTokenProfile(profiles, defaultArn); chosen == nil {
+				return defaultArn
+			}
+		} else {
+			chosen = &profiles[0]
+		}
+	}
+
+	c.Set(profileEndpointKey, chosen.Endpoint)
+	utils.RecordPolicy(c, "token_profile", "profile %s selected by %s", profileLabel(chosen), reason)
+	return chosen.Arn
+}
+
+// profileMatchesModel 判断 profile 的模型通配符是否匹配请求模型
+func profileMatchesModel(p TokenProfile, model string) bool {
+	for _, pattern := range p.Models {
+		if ok, err := path.Match(pattern, model); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// profileLabel 日志中使用的 profile 标识，未命名时使用 ARN
+func profileLabel(p *TokenProfile) string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return p.Arn
+}
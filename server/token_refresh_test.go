@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"kiro/config"
+	"kiro/types"
+)
+
+func TestRefreshParsedToken(t *testing.T) {
+	// wantStatus 非 0 表示期望 *refreshStatusError（刷新端点返回非 200）；wantErr 且 wantStatus 为 0 表示响应无法使用
+	tests := []struct {
+		name          string
+		status        int
+		body          string
+		wantAccess    string
+		wantRotated   string
+		wantErr       bool
+		wantStatus    int
+		wantRetryable bool
+	}{
+		{
+			name:       "success",
+			status:     http.StatusOK,
+			body:       `{"accessToken":"access-1","expiresIn":3600,"refreshToken":"refresh-old","profileArn":"arn:aws:codewhisperer:us-east-1:123456789012:profile/ABC"}`,
+			wantAccess: "access-1",
+		},
+		{
+			name:        "rotation",
+			status:      http.StatusOK,
+			body:        `{"accessToken":"access-2","expiresIn":3600,"refreshToken":"refresh-new"}`,
+			wantAccess:  "access-2",
+			wantRotated: "refresh-new",
+		},
+		{
+			name:       "invalid_grant",
+			status:     http.StatusBadRequest,
+			body:       `{"error":"invalid_grant","error_description":"Invalid refresh token provided"}`,
+			wantErr:    true,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:          "rate limited",
+			status:        http.StatusTooManyRequests,
+			body:          `{"message":"Too many requests"}`,
+			wantErr:       true,
+			wantStatus:    http.StatusTooManyRequests,
+			wantRetryable: true,
+		},
+		{
+			name:          "malformed JSON",
+			status:        http.StatusOK,
+			body:          `{"accessToken":`,
+			wantErr:       true,
+			wantRetryable: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotRefresh string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				gotRefresh = string(body)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+			useSettings(t, func(s *config.Settings) { s.RefreshTokenURL = srv.URL })
+
+			got, err := refreshParsedToken(context.Background(), types.TokenTypeKiro, "", "", "refresh-old", "")
+			if !strings.Contains(gotRefresh, `"refresh-old"`) {
+				t.Errorf("refresh request body = %s, want refreshToken refresh-old", gotRefresh)
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var statusErr *refreshStatusError
+			if gotStatus := errors.As(err, &statusErr); gotStatus != (tt.wantStatus != 0) {
+				t.Fatalf("error = %v, want *refreshStatusError: %v", err, tt.wantStatus != 0)
+			}
+			if statusErr != nil && statusErr.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", statusErr.StatusCode, tt.wantStatus)
+			}
+			if err != nil && isRetryableRefreshError(err) != tt.wantRetryable {
+				t.Errorf("retryable = %v, want %v", isRetryableRefreshError(err), tt.wantRetryable)
+			}
+
+			if got.AccessToken != tt.wantAccess {
+				t.Errorf("AccessToken = %q, want %q", got.AccessToken, tt.wantAccess)
+			}
+			if got.RefreshToken != tt.wantRotated {
+				t.Errorf("RefreshToken = %q, want %q", got.RefreshToken, tt.wantRotated)
+			}
+			if !tt.wantErr && got.ExpiresAt.IsZero() {
+				t.Error("ExpiresAt not set from expiresIn")
+			}
+		})
+	}
+}
+
+func TestRefreshWithRetryStopsOnCancel(t *testing.T) {
+	useSettings(t, func(s *config.Settings) {
+		s.TokenRefreshMaxAttempts = 5
+		s.TokenRefreshBackoffMs = int(time.Minute.Milliseconds())
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	done := make(chan error, 1)
+	go func() {
+		done <- refreshWithRetry(ctx, func(context.Context) error {
+			attempts++
+			return &refreshStatusError{StatusCode: http.StatusServiceUnavailable}
+		})
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("error = %v, want context.Canceled", err)
+		}
+		if attempts != 1 {
+			t.Errorf("attempts = %d, want 1", attempts)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("refreshWithRetry kept backing off after the context was cancelled")
+	}
+}
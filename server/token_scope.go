@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"kiro/config"
+	"kiro/lifecycle"
+	"kiro/types"
+	"kiro/utils"
+)
+
+/**
+ * Token 权限校验
+ * AmazonQ / IdC 客户端注册时若未申请 CodeWhisperer 的 scope，刷新仍然成功，
+ * 但之后每个请求都会得到含义不明的 403。首次刷新后用一次轻量的用量查询验证 access token 的权限，
+ * 不具备权限时立即报错并给出配置建议；启动时对全局 token 池中的 token 预先执行一次
+ */
+
+// codeWhispererScopes AmazonQ / IdC 客户端注册时需要申请的 scope
+const codeWhispererScopes = "codewhisperer:completions codewhisperer:analysis codewhisperer:conversations"
+
+// tokenScopeError access token 刷新成功但不具备调用 CodeWhisperer 的权限
+type tokenScopeError struct {
+	TokenType  types.TokenType
+	StatusCode int
+	Body       string
+}
+
+func (e *tokenScopeError) Error() string {
+	return fmt.Sprintf("%s token 不具备 CodeWhisperer 权限（状态码 %d）: %s", e.TokenType, e.StatusCode, e.Guidance())
+}
+
+// Guidance 按 token 类型给出的配置建议
+func (e *tokenScopeError) Guidance() string {
+	switch e.TokenType {
+	case types.TokenTypeAmazonQ:
+		return "请确认注册 OIDC 客户端时申请了 scope: " + codeWhispererScopes + "，并使用 Amazon Q Developer 订阅的账号登录"
+	case types.TokenTypeIdC:
+		return "请确认 IAM Identity Center 用户已分配 Amazon Q Developer Pro 订阅，客户端注册时申请了 scope: " + codeWhispererScopes + "，且 token 中的区域与身份中心所在区域一致"
+	}
+	return "请确认该账号已在 Kiro 中完成登录并可正常使用"
+}
+
+/**
+ * checkTokenScope 用一次用量查询验证 access token 具备 CodeWhisperer 权限
+ * 仅 401/403 视为权限不足；网络错误等其他失败只记录日志，不影响 token 使用
+ */
+func checkTokenScope(entry *TokenCache, tokenHash string) error {
+	if !config.Current().TokenScopeCheck {
+		return nil
+	}
+	_, err := probeUsageLimits(entry.AccessToken, entry.ProfileArn, tokenHash)
+	if err == nil {
+		return nil
+	}
+	var statusErr *usageStatusError
+	if errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden) {
+		return &tokenScopeError{TokenType: entry.TokenType, StatusCode: statusErr.StatusCode, Body: statusErr.Body}
+	}
+	utils.Error("token 权限校验失败，跳过: %v", err)
+	return nil
+}
+
+/**
+ * checkPoolTokenScopes 启动时在后台刷新全局 token 池中的 token 并校验权限
+ * 配置错误的 token 在启动日志中报告，而不是等到请求时才出现 403
+ */
+func checkPoolTokenScopes(tokenService *TokenService) {
+	tokens := tokenService.poolTokens()
+	if !config.Current().TokenScopeCheck || len(tokens) == 0 {
+		return
+	}
+	lifecycle.Go("token-scope-check", func(ctx context.Context) {
+		failed := 0
+		for i, token := range tokens {
+			if ctx.Err() != nil {
+				return
+			}
+			if _, err := tokenService.GetOrRefresh(ctx, token); err != nil {
+				failed++
+				utils.Error("token 池第 %d 个 token 不可用: %v", i+1, err)
+			}
+		}
+		utils.Info("token 池校验完成: %d/%d 可用", len(tokens)-failed, len(tokens))
+	})
+}
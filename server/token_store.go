@@ -0,0 +1,308 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+)
+
+// defaultAccessTokenTTL 刷新响应未返回有效期时假定的 access token 有效期
+const defaultAccessTokenTTL = time.Hour
+
+// tokenRestoreMargin 剩余有效期不足该值的 token 不再从持久化存储恢复
+const tokenRestoreMargin = 5 * time.Minute
+
+// tokenStoreSaltSize 派生加密密钥使用的随机盐长度
+const tokenStoreSaltSize = 16
+
+// tokenStoreKeyInfo HKDF 派生 token 缓存加密密钥的 info 参数
+const tokenStoreKeyInfo = "kiro token cache v1"
+
+// tokenStore token 缓存的持久化存储（SQLite），使 access token 在进程重启后仍然可用
+type tokenStore struct {
+	db   *sql.DB
+	aead cipher.AEAD // 为 nil 时明文存储
+	mu   sync.Mutex
+}
+
+// persistedToken 持久化的 token 字段（账号标注来自租户配置，不做持久化）
+type persistedToken struct {
+	AccessToken          string          `json:"access_token"`
+	RefreshToken         string          `json:"refresh_token"`
+	ProfileArn           string          `json:"profile_arn,omitempty"`
+	ProfileArnConfigured bool            `json:"profile_arn_configured,omitempty"`
+	Profiles             []TokenProfile  `json:"profiles,omitempty"`
+	LastRefresh          time.Time       `json:"last_refresh"`
+	ExpiresAt            time.Time       `json:"expires_at"`
+	TokenType            types.TokenType `json:"token_type"`
+	ClientID             string          `json:"client_id,omitempty"`
+	ClientSecret         string          `json:"client_secret,omitempty"`
+	Region               string          `json:"region,omitempty"`
+}
+
+/**
+ * InitTokenStore 初始化 token 缓存持久化（可选）
+ * TOKEN_CACHE_DB: SQLite 文件路径，未配置时仅使用内存缓存
+ * TOKEN_CACHE_KEY: 加密密钥，配置后以 HKDF-SHA256（随机盐保存在数据库中）派生 AES-256-GCM 密钥加密存储
+ * 初始化后将仍在有效期内的 token 恢复到内存缓存，避免重启后集中刷新；
+ * 目录、文件权限或加密无法正确设置时不启用持久化，仅使用内存缓存
+ */
+func InitTokenStore(tokenService *TokenService) {
+	dbPath := config.Current().TokenCacheDB
+	if dbPath == "" {
+		return
+	}
+
+	if dir := filepath.Dir(dbPath); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			utils.Error("创建 token 缓存目录失败，仅使用内存缓存: %v", err)
+			return
+		}
+	}
+
+	db, err := sql.Open("sqlite", dbPath+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		utils.Error("token 缓存存储初始化失败: %v", err)
+		return
+	}
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS tokens (
+			hash TEXT PRIMARY KEY,
+			payload BLOB NOT NULL,
+			updated_at INTEGER NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS token_store_meta (
+			name TEXT PRIMARY KEY,
+			value BLOB NOT NULL
+		)
+	`)
+	if err != nil {
+		utils.Error("创建 token 缓存表失败: %v", err)
+		db.Close()
+		return
+	}
+	// 文件中包含 refresh token，仅允许当前用户读写
+	if err := os.Chmod(dbPath, 0600); err != nil {
+		utils.Error("设置 token 缓存文件权限失败，仅使用内存缓存: %v", err)
+		db.Close()
+		return
+	}
+
+	store := &tokenStore{db: db}
+	if key := os.Getenv("TOKEN_CACHE_KEY"); key != "" {
+		aead, err := store.initCipher(key)
+		if err != nil {
+			utils.Error("初始化 token 缓存加密失败，仅使用内存缓存: %v", err)
+			db.Close()
+			return
+		}
+		store.aead = aead
+	} else {
+		utils.Info("警告: 未设置 TOKEN_CACHE_KEY，token 缓存将以明文存储")
+	}
+	tokenService.store = store
+
+	restored := store.restore(tokenService)
+	utils.Info("token 缓存持久化已启用 (%s)，恢复 %d 个 token", dbPath, restored)
+}
+
+// initCipher 用 HKDF-SHA256 从 TOKEN_CACHE_KEY 和数据库中保存的盐派生 AES-256-GCM 密钥，首次使用时生成盐
+func (s *tokenStore) initCipher(secret string) (cipher.AEAD, error) {
+	var salt []byte
+	err := s.db.QueryRow(`SELECT value FROM token_store_meta WHERE name = 'salt'`).Scan(&salt)
+	if errors.Is(err, sql.ErrNoRows) {
+		salt = make([]byte, tokenStoreSaltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, fmt.Errorf("生成盐失败: %w", err)
+		}
+		// 旧版本以 sha256(TOKEN_CACHE_KEY) 加密的记录无法用新密钥解密，启动时会被丢弃并重新刷新
+		if _, err := s.db.Exec(`INSERT INTO token_store_meta (name, value) VALUES ('salt', ?)`, salt); err != nil {
+			return nil, fmt.Errorf("保存盐失败: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("读取盐失败: %w", err)
+	}
+	if len(salt) != tokenStoreSaltSize {
+		return nil, fmt.Errorf("盐长度无效: %d", len(salt))
+	}
+
+	key, err := hkdf.Key(sha256.New, []byte(secret), salt, tokenStoreKeyInfo, 32)
+	if err != nil {
+		return nil, fmt.Errorf("派生密钥失败: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/**
+ * restore 将持久化存储中仍然有效的 token 载入内存缓存
+ * 已过期、无法解密（如更换了密钥）或无法解析的记录会被删除
+ */
+func (s *tokenStore) restore(tokenService *TokenService) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.db.Query(`SELECT hash, payload FROM tokens`)
+	if err != nil {
+		utils.Error("读取 token 缓存失败: %v", err)
+		return 0
+	}
+
+	var stale []string
+	restored := make(map[string]*TokenCache)
+	deadline := time.Now().Add(tokenRestoreMargin)
+	for rows.Next() {
+		var hash string
+		var payload []byte
+		if err := rows.Scan(&hash, &payload); err != nil {
+			continue
+		}
+		entry, err := s.decode(payload)
+		if err != nil || tokenExpiry(entry).Before(deadline) {
+			stale = append(stale, hash)
+			continue
+		}
+		restored[hash] = entry
+	}
+	rows.Close()
+
+	for _, hash := range stale {
+		s.db.Exec(`DELETE FROM tokens WHERE hash = ?`, hash)
+	}
+
+	tokenService.mu.Lock()
+	for hash, entry := range restored {
+		if _, exists := tokenService.entries[hash]; !exists {
+			tokenService.entries[hash] = entry
+		}
+	}
+	tokenService.mu.Unlock()
+	return len(restored)
+}
+
+// encode 序列化并（按需）加密 token 记录，密文格式为 nonce || ciphertext
+func (s *tokenStore) encode(entry *TokenCache) ([]byte, error) {
+	data, err := utils.SafeMarshal(persistedToken{
+		AccessToken:          entry.AccessToken,
+		RefreshToken:         entry.RefreshToken,
+		ProfileArn:           entry.ProfileArn,
+		ProfileArnConfigured: entry.ProfileArnConfigured,
+		Profiles:             entry.Profiles,
+		LastRefresh:          entry.LastRefresh,
+		ExpiresAt:            entry.ExpiresAt,
+		TokenType:            entry.TokenType,
+		ClientID:             entry.ClientID,
+		ClientSecret:         entry.ClientSecret,
+		Region:               entry.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.aead == nil {
+		return data, nil
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// decode 解密并反序列化 token 记录
+func (s *tokenStore) decode(payload []byte) (*TokenCache, error) {
+	if s.aead != nil {
+		size := s.aead.NonceSize()
+		if len(payload) < size {
+			return nil, fmt.Errorf("token 记录长度无效")
+		}
+		plain, err := s.aead.Open(nil, payload[:size], payload[size:], nil)
+		if err != nil {
+			return nil, fmt.Errorf("token 记录解密失败: %v", err)
+		}
+		payload = plain
+	}
+
+	var p persistedToken
+	if err := utils.SafeUnmarshal(payload, &p); err != nil {
+		return nil, fmt.Errorf("token 记录解析失败: %v", err)
+	}
+	return &TokenCache{
+		AccessToken:          p.AccessToken,
+		RefreshToken:         p.RefreshToken,
+		ProfileArn:           p.ProfileArn,
+		ProfileArnConfigured: p.ProfileArnConfigured,
+		Profiles:             p.Profiles,
+		LastRefresh:          p.LastRefresh,
+		ExpiresAt:            p.ExpiresAt,
+		TokenType:            p.TokenType,
+		ClientID:             p.ClientID,
+		ClientSecret:         p.ClientSecret,
+		Region:               p.Region,
+	}, nil
+}
+
+/**
+ * persist 将 token 缓存写入持久化存储，未启用持久化时为空操作
+ */
+func (s *TokenService) persist(hash string, entry *TokenCache) {
+	if s.store == nil {
+		return
+	}
+
+	s.mu.RLock()
+	payload, err := s.store.encode(entry)
+	s.mu.RUnlock()
+	if err != nil {
+		utils.Error("token 缓存序列化失败: %v", err)
+		return
+	}
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	if _, err := s.store.db.Exec(
+		`INSERT OR REPLACE INTO tokens (hash, payload, updated_at) VALUES (?, ?, ?)`,
+		hash, payload, time.Now().Unix(),
+	); err != nil {
+		utils.Error("token 缓存写入失败: %v", err)
+	}
+}
+
+/**
+ * forget 从持久化存储删除 token 缓存
+ */
+func (s *TokenService) forget(hash string) {
+	if s.store == nil {
+		return
+	}
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	s.store.db.Exec(`DELETE FROM tokens WHERE hash = ?`, hash)
+}
+
+// tokenExpiry 返回 access token 的过期时间，刷新响应未给出有效期时按默认有效期估算
+func tokenExpiry(entry *TokenCache) time.Time {
+	if !entry.ExpiresAt.IsZero() {
+		return entry.ExpiresAt
+	}
+	return entry.LastRefresh.Add(defaultAccessTokenTTL)
+}
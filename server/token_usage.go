@@ -0,0 +1,104 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tokenUsage 单个上游 token 的累计用量（进程内，重启后清零）
+type tokenUsage struct {
+	requests     atomic.Int64
+	errors       atomic.Int64
+	inputTokens  atomic.Int64
+	outputTokens atomic.Int64
+	lastUsed     atomic.Int64 // UnixNano
+}
+
+// tokenUsageView 管理端点展示的用量计数
+type tokenUsageView struct {
+	ID           string    `json:"id"` // refresh token 的 SHA256 前缀，与 /admin/tokens 一致
+	Requests     int64     `json:"requests"`
+	Errors       int64     `json:"errors"`
+	InputTokens  int64     `json:"input_tokens"`
+	OutputTokens int64     `json:"output_tokens"`
+	LastUsed     time.Time `json:"last_used"`
+}
+
+var (
+	tokenUsageMap   = make(map[string]*tokenUsage)
+	tokenUsageMutex sync.RWMutex
+)
+
+// usageFor 返回 token hash 对应的计数器，不存在时创建
+func usageFor(tokenHash string) *tokenUsage {
+	tokenUsageMutex.RLock()
+	u, ok := tokenUsageMap[tokenHash]
+	tokenUsageMutex.RUnlock()
+	if ok {
+		return u
+	}
+
+	tokenUsageMutex.Lock()
+	defer tokenUsageMutex.Unlock()
+	if u, ok = tokenUsageMap[tokenHash]; !ok {
+		u = &tokenUsage{}
+		tokenUsageMap[tokenHash] = u
+	}
+	return u
+}
+
+// recordTokenRequest 记录一次发往上游的请求，failed 表示上游返回错误或请求未能发出
+func recordTokenRequest(c *gin.Context, failed bool) {
+	tokenHash := c.GetString("tokenHash")
+	if tokenHash == "" {
+		return
+	}
+	u := usageFor(tokenHash)
+	u.requests.Add(1)
+	if failed {
+		u.errors.Add(1)
+	}
+	u.lastUsed.Store(time.Now().UnixNano())
+}
+
+// recordTokenUsage 记录请求完成时的 token 用量（同时计入 API Key 的限流窗口和用量记录）
+func recordTokenUsage(c *gin.Context, inputTokens, outputTokens int) {
+	recordKeyTokens(c, inputTokens+outputTokens)
+	if usage := requestUsageOf(c); usage != nil {
+		usage.InputTokens = inputTokens
+		usage.OutputTokens = outputTokens
+	}
+
+	tokenHash := c.GetString("tokenHash")
+	if tokenHash == "" {
+		return
+	}
+	u := usageFor(tokenHash)
+	u.inputTokens.Add(int64(inputTokens))
+	u.outputTokens.Add(int64(outputTokens))
+}
+
+// tokenUsageSnapshot 返回所有 token 的用量计数
+func tokenUsageSnapshot() []tokenUsageView {
+	tokenUsageMutex.RLock()
+	defer tokenUsageMutex.RUnlock()
+
+	views := make([]tokenUsageView, 0, len(tokenUsageMap))
+	for hash, u := range tokenUsageMap {
+		view := tokenUsageView{
+			ID:           hash[:16],
+			Requests:     u.requests.Load(),
+			Errors:       u.errors.Load(),
+			InputTokens:  u.inputTokens.Load(),
+			OutputTokens: u.outputTokens.Load(),
+		}
+		if ts := u.lastUsed.Load(); ts > 0 {
+			view.LastUsed = time.Unix(0, ts)
+		}
+		views = append(views, view)
+	}
+	return views
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode/utf8"
+
+	"kiro/config"
+	"kiro/utils"
+)
+
+// splitPartialJSON 按字节上限切分 partial_json，切分点避开 UTF-8 多字节字符中间
+func splitPartialJSON(s string, maxBytes int) []string {
+	if maxBytes <= 0 || len(s) <= maxBytes {
+		return []string{s}
+	}
+
+	chunks := make([]string, 0, len(s)/maxBytes+1)
+	for len(s) > maxBytes {
+		cut := maxBytes
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			// 单个字符超过上限（maxBytes < 4），整字符输出
+			_, size := utf8.DecodeRuneInString(s)
+			cut = size
+		}
+		chunks = append(chunks, s[:cut])
+		s = s[cut:]
+	}
+	if s != "" {
+		chunks = append(chunks, s)
+	}
+	return chunks
+}
+
+// sendEvent 发送事件，超过上限的 input_json_delta 自动拆分为多个增量事件
+// 避免完整文件写入等超大工具参数超出客户端 SSE 单行缓冲
+func (esp *EventStreamProcessor) sendEvent(dataMap map[string]any) error {
+	delta, ok := dataMap["delta"].(map[string]any)
+	if !ok || dataMap["type"] != "content_block_delta" || delta["type"] != "input_json_delta" {
+		return esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, dataMap)
+	}
+
+	partialJSON, _ := delta["partial_json"].(string)
+	index := extractIndex(dataMap)
+	if buf, exists := esp.ctx.jsonBufByBlockIndex[index]; exists {
+		buf.WriteString(partialJSON)
+	} else {
+		buf := &strings.Builder{}
+		buf.WriteString(partialJSON)
+		esp.ctx.jsonBufByBlockIndex[index] = buf
+	}
+
+	chunks := splitPartialJSON(partialJSON, config.Current().MaxInputJSONDeltaBytes)
+	if len(chunks) == 1 {
+		return esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, dataMap)
+	}
+
+	utils.Debug("拆分超大 input_json_delta: index=%d, bytes=%d, chunks=%d", index, len(partialJSON), len(chunks))
+	for _, chunk := range chunks {
+		event := map[string]any{
+			"type":  "content_block_delta",
+			"index": dataMap["index"],
+			"delta": map[string]any{
+				"type":         "input_json_delta",
+				"partial_json": chunk,
+			},
+		}
+		if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyToolInputJSON 工具块结束时校验拼接后的参数是否为合法 JSON
+func (ctx *StreamProcessorContext) verifyToolInputJSON(index int) {
+	buf, exists := ctx.jsonBufByBlockIndex[index]
+	if !exists {
+		return
+	}
+	delete(ctx.jsonBufByBlockIndex, index)
+
+	if buf.Len() == 0 || json.Valid([]byte(buf.String())) {
+		return
+	}
+	utils.Log("工具参数拼接后不是合法JSON",
+		addReqFields(ctx.c,
+			utils.LogInt("block_index", index),
+			utils.LogString("tool_use_id", ctx.toolUseIdByBlockIndex[index]),
+			utils.LogInt("json_bytes", buf.Len()),
+		)...)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errUpstreamTTFBExceeded 上游在首字节预算内没有返回任何数据
+var errUpstreamTTFBExceeded = errors.New("上游首字节超时")
+
+// statusOverloaded Anthropic 过载状态码，官方 SDK 会自动重试
+const statusOverloaded = 529
+
+// ttfbBudget 上游首字节计时器，超时后取消请求（包括尚未返回的响应头和响应体读取）
+type ttfbBudget struct {
+	budget time.Duration
+	timer  *time.Timer
+	cancel context.CancelCauseFunc
+}
+
+// withTTFBBudget 为上游请求施加首字节预算
+func withTTFBBudget(req *http.Request) (*http.Request, *ttfbBudget) {
+	budget := time.Duration(config.Current().UpstreamTTFBBudgetSeconds) * time.Second
+	ctx, cancel := context.WithCancelCause(req.Context())
+	b := &ttfbBudget{
+		budget: budget,
+		timer:  time.AfterFunc(budget, func() { cancel(errUpstreamTTFBExceeded) }),
+		cancel: cancel,
+	}
+	return req.WithContext(ctx), b
+}
+
+// release 停止计时并释放预算的子 context：请求失败时立即调用，成功时在响应体关闭后调用
+func (b *ttfbBudget) release() {
+	b.timer.Stop()
+	b.cancel(nil)
+}
+
+// awaitFirstByte 等待响应体首字节到达后停止计时
+// 非 200 响应直接停止计时，交由常规错误处理读取响应体
+func (b *ttfbBudget) awaitFirstByte(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		b.timer.Stop()
+		resp.Body = utils.ReleaseOnClose(resp.Body, b.release)
+		return nil
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	_, _ = reader.Peek(1)
+	if !b.timer.Stop() {
+		return errUpstreamTTFBExceeded
+	}
+	// 已预读的数据需要保留给后续的事件流解析
+	resp.Body = utils.ReleaseOnClose(struct {
+		io.Reader
+		io.Closer
+	}{reader, resp.Body}, b.release)
+	return nil
+}
+
+/**
+ * failoverOnTTFB 首字节超时后的处理
+ * 使用 token 池（租户或全局）的请求切换到另一个 token 重试一次；无可用 token 时返回带重试提示的 529 错误，
+ * 让客户端尽快重试，而不是在一个静默的连接上等待数分钟
+ */
+func failoverOnTTFB(c *gin.Context, anthropicReq types.AnthropicRequest, tokenInfo types.TokenInfo, isStream bool) (*http.Response, error) {
+	budgetSeconds := config.Current().UpstreamTTFBBudgetSeconds
+	utils.Log("上游首字节超时",
+		addReqFields(c,
+			utils.LogInt("budget_seconds", budgetSeconds),
+			utils.LogString("tenant", tenantName(c)),
+		)...)
+
+	if failoverToNextToken(c) {
+		utils.RecordPolicy(c, "token_failover", "no first byte within %ds; switched to the next pooled token", budgetSeconds)
+		tokenInfo.AccessToken = c.GetString("accessToken")
+		utils.Info("首字节超时，切换上游 token 重试")
+		return executeCodeWhispererRequest(c, anthropicReq, tokenInfo, isStream)
+	}
+
+	c.Header("Retry-After", "1")
+	c.Header("x-should-retry", "true")
+	return nil, &UpstreamError{
+		StatusCode: statusOverloaded,
+		Message:    fmt.Sprintf("Upstream sent no data within %ds, please retry the request", budgetSeconds),
+		Type:       errTypeOverloaded,
+	}
+}
+
+// tenantName 返回当前请求的租户名称，未绑定租户时为空
+func tenantName(c *gin.Context) string {
+	if profile := GetTenant(c); profile != nil {
+		return profile.Name
+	}
+	return ""
+}
@@ -0,0 +1,372 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro/config"
+	"kiro/lifecycle"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * 首 token 延迟（TTFT）SLO 监控
+ * 流式请求从收到请求到下发第一个 content_block_delta 的耗时按「模型 + 上游 token」分组记录，
+ * 每分钟计算滑动窗口内的 p95，连续 TTFT_SLO_CONSECUTIVE_CHECKS 次超过阈值时记录告警日志并调用 webhook，
+ * 恢复后再通知一次。同一模型的多个 token 同时告警通常意味着上游区域劣化，单个 token 告警则多为该账号的问题
+ */
+
+// ttftSLOCheckInterval 评估 p95 的间隔
+const ttftSLOCheckInterval = time.Minute
+
+// ttftMaxSamples 每组最多保留的样本数，超出时丢弃最早的样本
+const ttftMaxSamples = 2000
+
+// streamStartKey 流式请求开始处理的时间（time.Time），用于计算 TTFT
+const streamStartKey = "streamStart"
+
+// ttftThreshold 按模型名前缀设置的阈值
+type ttftThreshold struct {
+	prefix string
+	ms     int
+}
+
+type ttftSample struct {
+	at time.Time
+	ms int64
+}
+
+// ttftSeries 一组（模型 + token）的样本和告警状态
+type ttftSeries struct {
+	model    string
+	token    string // 上游 token 的 SHA256 前 16 位
+	samples  []ttftSample
+	p95      int64
+	breaches int  // 连续超标的检查次数
+	alerting bool // 已发出告警、尚未恢复
+}
+
+// ttftSeriesView 管理端点展示的分组状态
+type ttftSeriesView struct {
+	Model               string `json:"model"`
+	Token               string `json:"token"`
+	Samples             int    `json:"samples"`
+	P95Ms               int64  `json:"p95_ms"`
+	ThresholdMs         int    `json:"threshold_ms"`
+	ConsecutiveBreaches int    `json:"consecutive_breaches"`
+	Alerting            bool   `json:"alerting"`
+}
+
+// ttftAlert webhook 负载
+type ttftAlert struct {
+	Type                string `json:"type"` // ttft_slo_breach / ttft_slo_recovered
+	Model               string `json:"model"`
+	Token               string `json:"token"`
+	P95Ms               int64  `json:"p95_ms"`
+	ThresholdMs         int    `json:"threshold_ms"`
+	Samples             int    `json:"samples"`
+	WindowSeconds       int    `json:"window_seconds"`
+	ConsecutiveBreaches int    `json:"consecutive_breaches"`
+	Timestamp           string `json:"timestamp"`
+}
+
+type ttftSLO struct {
+	mu         sync.Mutex
+	series     map[string]*ttftSeries
+	defaultMs  int
+	thresholds []ttftThreshold // 按前缀长度降序，优先匹配最具体的前缀
+	webhook    string
+	task       *lifecycle.Task
+}
+
+var ttftMonitor *ttftSLO
+
+// InitTTFTSLO 根据环境变量初始化 TTFT SLO 监控
+// TTFT_SLO_MS: 默认 p95 阈值（毫秒）
+// TTFT_SLO_MODELS: 按模型名前缀设置的阈值，如 claude-opus=8000,claude-haiku=1500
+// TTFT_SLO_WEBHOOK_URL: 告警和恢复时 POST JSON 的地址，为空则只记录日志
+func InitTTFTSLO() {
+	thresholds, err := parseTTFTThresholds(config.Current().TTFTSLOModels)
+	if err != nil {
+		utils.Error("TTFT_SLO_MODELS 无效，已忽略: %v", err)
+		thresholds = nil
+	}
+	if config.Current().TTFTSLOMs <= 0 && len(thresholds) == 0 {
+		return
+	}
+
+	ttftMonitor = &ttftSLO{
+		series:     make(map[string]*ttftSeries),
+		defaultMs:  config.Current().TTFTSLOMs,
+		thresholds: thresholds,
+		webhook:    config.Current().TTFTSLOWebhookURL,
+	}
+	ttftMonitor.task = lifecycle.Go("ttft-slo", ttftMonitor.run)
+
+	utils.Info("TTFT SLO 监控已启用 (默认阈值: %dms, 窗口: %ds)", config.Current().TTFTSLOMs, config.Current().TTFTSLOWindowSeconds)
+}
+
+// StopTTFTSLO 停止 TTFT SLO 监控
+func StopTTFTSLO() {
+	if ttftMonitor != nil {
+		ttftMonitor.task.Stop()
+	}
+}
+
+// parseTTFTThresholds 解析 prefix=ms 形式的逗号分隔列表
+func parseTTFTThresholds(spec string) ([]ttftThreshold, error) {
+	var thresholds []ttftThreshold
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, value, ok := strings.Cut(item, "=")
+		ms, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || strings.TrimSpace(prefix) == "" || err != nil || ms <= 0 {
+			return nil, fmt.Errorf("应为 模型前缀=毫秒: %q", item)
+		}
+		thresholds = append(thresholds, ttftThreshold{prefix: strings.TrimSpace(prefix), ms: ms})
+	}
+	sort.SliceStable(thresholds, func(i, j int) bool {
+		return len(thresholds[i].prefix) > len(thresholds[j].prefix)
+	})
+	return thresholds, nil
+}
+
+// thresholdFor 返回模型的阈值，0 表示不监控该模型
+func (m *ttftSLO) thresholdFor(model string) int {
+	for _, t := range m.thresholds {
+		if strings.HasPrefix(model, t.prefix) {
+			return t.ms
+		}
+	}
+	return m.defaultMs
+}
+
+// observe 记录一个 TTFT 样本
+func (m *ttftSLO) observe(model, token string, ttft time.Duration) {
+	if m.thresholdFor(model) <= 0 {
+		return
+	}
+	key := model + "\x00" + token
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[key]
+	if !ok {
+		s = &ttftSeries{model: model, token: token}
+		m.series[key] = s
+	}
+	s.samples = append(s.samples, ttftSample{at: time.Now(), ms: ttft.Milliseconds()})
+	if len(s.samples) > ttftMaxSamples {
+		s.samples = s.samples[len(s.samples)-ttftMaxSamples:]
+	}
+}
+
+func (m *ttftSLO) run(ctx context.Context) {
+	ticker := time.NewTicker(ttftSLOCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, alert := range m.evaluate(time.Now()) {
+				m.notify(alert)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/**
+ * evaluate 丢弃窗口外的样本并重新计算各组 p95，返回需要发送的告警和恢复通知
+ * 样本不足时不改变告警状态；窗口内没有样本且未在告警的分组被移除
+ */
+func (m *ttftSLO) evaluate(now time.Time) []ttftAlert {
+	window := time.Duration(config.Current().TTFTSLOWindowSeconds) * time.Second
+	cutoff := now.Add(-window)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var alerts []ttftAlert
+	for key, s := range m.series {
+		kept := s.samples[:0]
+		for _, sample := range s.samples {
+			if sample.at.After(cutoff) {
+				kept = append(kept, sample)
+			}
+		}
+		s.samples = kept
+		if len(s.samples) == 0 && !s.alerting {
+			delete(m.series, key)
+			continue
+		}
+		if len(s.samples) < config.Current().TTFTSLOMinSamples {
+			continue
+		}
+
+		s.p95 = ttftP95(s.samples)
+		threshold := m.thresholdFor(s.model)
+		alert := ttftAlert{
+			Model:         s.model,
+			Token:         s.token,
+			P95Ms:         s.p95,
+			ThresholdMs:   threshold,
+			Samples:       len(s.samples),
+			WindowSeconds: config.Current().TTFTSLOWindowSeconds,
+			Timestamp:     now.UTC().Format(time.RFC3339),
+		}
+		if s.p95 > int64(threshold) {
+			s.breaches++
+			if !s.alerting && s.breaches >= config.Current().TTFTSLOConsecutiveChecks {
+				s.alerting = true
+				alert.Type = "ttft_slo_breach"
+				alert.ConsecutiveBreaches = s.breaches
+				alerts = append(alerts, alert)
+			}
+		} else {
+			s.breaches = 0
+			if s.alerting {
+				s.alerting = false
+				alert.Type = "ttft_slo_recovered"
+				alerts = append(alerts, alert)
+			}
+		}
+	}
+	return alerts
+}
+
+// ttftP95 计算样本的 p95（最近秩法）
+func ttftP95(samples []ttftSample) int64 {
+	values := make([]int64, len(samples))
+	for i, sample := range samples {
+		values[i] = sample.ms
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	rank := int(math.Ceil(0.95*float64(len(values)))) - 1
+	return values[max(rank, 0)]
+}
+
+// notify 记录告警日志并调用 webhook
+func (m *ttftSLO) notify(alert ttftAlert) {
+	fields := []utils.LogField{
+		utils.LogString("model", alert.Model),
+		utils.LogString("token", alert.Token),
+		utils.LogInt("p95_ms", int(alert.P95Ms)),
+		utils.LogInt("threshold_ms", alert.ThresholdMs),
+		utils.LogInt("samples", alert.Samples),
+	}
+	if alert.Type == "ttft_slo_breach" {
+		utils.Log("TTFT p95 持续超过 SLO 阈值", fields...)
+	} else {
+		utils.Log("TTFT p95 已恢复到 SLO 阈值以内", fields...)
+	}
+
+	if m.webhook == "" {
+		return
+	}
+	data, err := utils.SafeMarshal(alert)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest("POST", m.webhook, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := utils.DoRequest(req)
+	if err != nil {
+		utils.Error("TTFT SLO webhook 发送失败: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		utils.Error("TTFT SLO webhook 返回状态码 %d", resp.StatusCode)
+	}
+}
+
+// snapshot 返回各分组的当前状态，按模型和 token 排序
+func (m *ttftSLO) snapshot() []ttftSeriesView {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	views := make([]ttftSeriesView, 0, len(m.series))
+	for _, s := range m.series {
+		views = append(views, ttftSeriesView{
+			Model:               s.model,
+			Token:               s.token,
+			Samples:             len(s.samples),
+			P95Ms:               s.p95,
+			ThresholdMs:         m.thresholdFor(s.model),
+			ConsecutiveBreaches: s.breaches,
+			Alerting:            s.alerting,
+		})
+	}
+	sort.Slice(views, func(i, j int) bool {
+		if views[i].Model != views[j].Model {
+			return views[i].Model < views[j].Model
+		}
+		return views[i].Token < views[j].Token
+	})
+	return views
+}
+
+// handleAdminTTFT GET /admin/ttft 各模型和 token 的 TTFT p95 及告警状态（p95 每分钟更新）
+func handleAdminTTFT(c *gin.Context) {
+	views := []ttftSeriesView{}
+	if ttftMonitor != nil {
+		views = ttftMonitor.snapshot()
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object":  "list",
+		"enabled": ttftMonitor != nil,
+		"data":    views,
+	})
+}
+
+// ttftObserver 在第一个 content_block_delta 下发时记录 TTFT
+type ttftObserver struct {
+	model string
+	start time.Time
+	done  bool
+}
+
+func newTTFTObserver(c *gin.Context, req types.AnthropicRequest) EventInterceptor {
+	if ttftMonitor == nil {
+		return nil
+	}
+	start, ok := c.Get(streamStartKey)
+	if !ok {
+		return nil
+	}
+	startTime, _ := start.(time.Time)
+	return &ttftObserver{model: req.Model, start: startTime}
+}
+
+// Intercept 只观察事件，不做修改
+func (o *ttftObserver) Intercept(c *gin.Context, event map[string]any, next EventEmitter) error {
+	if !o.done {
+		if eventType, _ := event["type"].(string); eventType == "content_block_delta" {
+			o.done = true
+			token := c.GetString("tokenHash")
+			if len(token) > 16 {
+				token = token[:16]
+			}
+			ttftMonitor.observe(o.model, token, time.Since(o.start))
+		}
+	}
+	return next(event)
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+
+	"kiro/config"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * 上游请求体
+ * 数 MB 的 CodeWhispererRequest 先完整序列化为字节再发送时，内存中同时存在请求结构和序列化副本。
+ * 客户端请求体超过 UpstreamStreamEncodeThreshold 时改为流式编码：先编码一遍只统计长度
+ * （保留 Content-Length，平滑写入等按长度生效的逻辑不受影响），发送时再经 io.Pipe 边编码边写入，
+ * 峰值内存约减半；重试时 GetBody 重新编码
+ */
+
+// upstreamBody 上游请求体，data 为 nil 时表示流式编码
+type upstreamBody struct {
+	data  []byte
+	value any
+	size  int64
+}
+
+// newUpstreamBody 序列化上游请求，大请求只统计长度，发送时再流式编码
+func newUpstreamBody(c *gin.Context, v any) (*upstreamBody, error) {
+	if !streamEncodeUpstream(c) {
+		data, err := utils.SafeMarshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return &upstreamBody{data: data, size: int64(len(data))}, nil
+	}
+
+	var counter countingWriter
+	if err := json.NewEncoder(&counter).Encode(v); err != nil {
+		return nil, err
+	}
+	return &upstreamBody{value: v, size: counter.n}, nil
+}
+
+// streamEncodeUpstream 客户端请求体较大（或长度未知）时流式编码上游请求体
+func streamEncodeUpstream(c *gin.Context) bool {
+	if c == nil || c.Request == nil {
+		return false
+	}
+	return c.Request.ContentLength < 0 || c.Request.ContentLength >= config.UpstreamStreamEncodeThreshold
+}
+
+func (b *upstreamBody) streamed() bool {
+	return b.data == nil
+}
+
+// open 返回请求体的读取器，流式编码时每次调用都重新编码
+func (b *upstreamBody) open() io.ReadCloser {
+	if !b.streamed() {
+		return io.NopCloser(bytes.NewReader(b.data))
+	}
+	return &encodingReader{value: b.value}
+}
+
+// attach 设置请求的请求体、长度和重试时使用的 GetBody
+func (b *upstreamBody) attach(req *http.Request) {
+	req.Body = b.open()
+	req.ContentLength = b.size
+	req.GetBody = func() (io.ReadCloser, error) {
+		return b.open(), nil
+	}
+}
+
+// encodingReader 首次读取时才启动编码协程，未读取即关闭时不会遗留协程
+type encodingReader struct {
+	value any
+	once  sync.Once
+	pr    *io.PipeReader
+}
+
+func (r *encodingReader) start() {
+	pr, pw := io.Pipe()
+	r.pr = pr
+	go func() {
+		// 传输层关闭请求体（发送完成或请求取消）后写入失败，编码随之结束
+		pw.CloseWithError(json.NewEncoder(pw).Encode(r.value))
+	}()
+}
+
+func (r *encodingReader) Read(p []byte) (int, error) {
+	r.once.Do(r.start)
+	return r.pr.Read(p)
+}
+
+func (r *encodingReader) Close() error {
+	r.once.Do(func() {})
+	if r.pr == nil {
+		return nil
+	}
+	return r.pr.Close()
+}
+
+// countingWriter 只统计写入字节数
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
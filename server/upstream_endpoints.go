@@ -0,0 +1,180 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"kiro/config"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// upstreamEndpointKey 上下文键：本次上游请求使用的端点名称
+const upstreamEndpointKey = "upstreamEndpoint"
+
+// triedEndpointsKey 上下文键：本次请求已尝试过的端点（重试时优先切换到其他端点）
+const triedEndpointsKey = "triedEndpoints"
+
+// endpointHealth 上游端点的被动健康状态
+type endpointHealth struct {
+	failures  int       // 连续失败次数
+	downUntil time.Time // 不健康状态的截止时间
+}
+
+var (
+	endpointStates     = make(map[string]*endpointHealth)
+	endpointStateMutex sync.Mutex
+)
+
+/**
+ * selectUpstreamEndpoint 选择本次上游请求的端点 URL
+ * 未配置 upstream.endpoints 时使用 CodeWhispererURL；
+ * 否则先按 token 固定的端点和端点允许的 token 类型过滤，再按配置顺序选择健康且本次请求未尝试过的端点，
+ * 全部不健康时选择最早恢复的端点
+ */
+func selectUpstreamEndpoint(c *gin.Context) string {
+	settings := config.Current()
+	if len(settings.UpstreamEndpoints) == 0 {
+		return settings.CodeWhispererURL
+	}
+
+	candidates := endpointCandidates(c, settings.UpstreamEndpoints)
+	if len(candidates) == 0 {
+		// 固定的端点不存在或没有端点接受该类型的 token：退回全部端点，避免请求无处可发
+		candidates = settings.UpstreamEndpoints
+	}
+
+	tried, _ := c.Get(triedEndpointsKey)
+	triedSet, _ := tried.(map[string]bool)
+	now := time.Now()
+
+	endpointStateMutex.Lock()
+	var chosen *config.UpstreamEndpoint
+	best, bestDown := 3, time.Time{}
+	for i := range candidates {
+		// 0: 健康且未尝试；1: 健康但本次已尝试；2: 不健康（按恢复时间先后）
+		rank, down := 0, time.Time{}
+		if state := endpointStates[candidates[i].Name]; state != nil && now.Before(state.downUntil) {
+			rank, down = 2, state.downUntil
+		} else if triedSet[candidates[i].Name] {
+			rank = 1
+		}
+		if rank < best || (rank == 2 && down.Before(bestDown)) {
+			chosen, best, bestDown = &candidates[i], rank, down
+		}
+	}
+	endpointStateMutex.Unlock()
+
+	if triedSet == nil {
+		triedSet = make(map[string]bool)
+		c.Set(triedEndpointsKey, triedSet)
+	}
+	triedSet[chosen.Name] = true
+	c.Set(upstreamEndpointKey, chosen.Name)
+	if best == 2 {
+		utils.RecordPolicy(c, "upstream_endpoint", "all endpoints unhealthy; routed to %s", chosen.Name)
+	}
+	return chosen.URL
+}
+
+// endpointCandidates 按 token 固定的端点和端点允许的 token 类型过滤
+func endpointCandidates(c *gin.Context, endpoints []config.UpstreamEndpoint) []config.UpstreamEndpoint {
+	if pinned := pinnedEndpoint(c); pinned != "" {
+		for _, ep := range endpoints {
+			if ep.Name == pinned {
+				return []config.UpstreamEndpoint{ep}
+			}
+		}
+		return nil
+	}
+
+	tokenType, ok := tokenTypeOf(c.GetString("refreshToken"))
+	var candidates []config.UpstreamEndpoint
+	for _, ep := range endpoints {
+		if len(ep.TokenTypes) == 0 || !ok {
+			candidates = append(candidates, ep)
+			continue
+		}
+		for _, name := range ep.TokenTypes {
+			if providerTokenTypes[strings.ToLower(name)] == tokenType {
+				candidates = append(candidates, ep)
+				break
+			}
+		}
+	}
+	return candidates
+}
+
+// pinnedEndpoint 返回当前上游 token 在租户配置中固定的端点名称，未固定时使用选中 profile 的端点
+func pinnedEndpoint(c *gin.Context) string {
+	if profile := tokenPoolProfile(c); profile != nil {
+		token := c.GetString("refreshToken")
+		for _, entry := range profile.Tokens {
+			if entry.Token == token && entry.Endpoint != "" {
+				return entry.Endpoint
+			}
+		}
+	}
+	return c.GetString(profileEndpointKey)
+}
+
+// reportEndpointResult 记录上游端点的请求结果，连续失败达到阈值时标记为不健康
+func reportEndpointResult(c *gin.Context, ok bool) {
+	name := c.GetString(upstreamEndpointKey)
+	if name == "" {
+		return
+	}
+
+	endpointStateMutex.Lock()
+	defer endpointStateMutex.Unlock()
+	state := endpointStates[name]
+	if state == nil {
+		state = &endpointHealth{}
+		endpointStates[name] = state
+	}
+	if ok {
+		state.failures = 0
+		state.downUntil = time.Time{}
+		return
+	}
+	state.failures++
+	if state.failures >= config.EndpointFailureThreshold {
+		if time.Now().After(state.downUntil) {
+			utils.Error("上游端点 %s 连续失败 %d 次，%v 内暂停使用", name, state.failures, config.EndpointCooldown)
+		}
+		state.downUntil = time.Now().Add(config.EndpointCooldown)
+	}
+}
+
+// EndpointStatus 上游端点的健康状态（管理端点展示）
+type EndpointStatus struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"consecutive_failures"`
+	DownUntil time.Time `json:"down_until,omitempty"`
+}
+
+// endpointStatuses 返回配置的上游端点及其健康状态
+func endpointStatuses() []EndpointStatus {
+	endpoints := config.Current().UpstreamEndpoints
+	statuses := make([]EndpointStatus, 0, len(endpoints))
+	now := time.Now()
+
+	endpointStateMutex.Lock()
+	defer endpointStateMutex.Unlock()
+	for _, ep := range endpoints {
+		status := EndpointStatus{Name: ep.Name, URL: ep.URL, Healthy: true}
+		if state := endpointStates[ep.Name]; state != nil {
+			status.Failures = state.failures
+			if now.Before(state.downUntil) {
+				status.Healthy = false
+				status.DownUntil = state.downUntil
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net/http"
+
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// upstreamDiagnosticHeaders 需要记录的上游响应头，便于向 AWS 反馈问题时关联请求
+var upstreamDiagnosticHeaders = []string{
+	"x-amzn-RequestId",
+	"x-amzn-ErrorType",
+	"x-amzn-Trace-Id",
+	"x-amz-apigw-id",
+	"x-amz-cf-id",
+}
+
+/**
+ * captureUpstreamHeaders 记录上游响应中的诊断头
+ * 结果存入上下文供日志和错误响应使用，上游请求 ID 同时通过 X-Upstream-Request-Id 返回给客户端
+ */
+func captureUpstreamHeaders(c *gin.Context, resp *http.Response) {
+	headers := make(map[string]string)
+	for _, name := range upstreamDiagnosticHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			headers[name] = value
+		}
+	}
+	if len(headers) == 0 {
+		return
+	}
+
+	c.Set("upstreamHeaders", headers)
+	if requestID := headers["x-amzn-RequestId"]; requestID != "" {
+		c.Header("X-Upstream-Request-Id", requestID)
+	}
+	utils.Debug("上游响应头: status=%d, headers=%v", resp.StatusCode, headers)
+}
+
+/**
+ * GetUpstreamHeaders 从上下文读取已记录的上游诊断头
+ */
+func GetUpstreamHeaders(c *gin.Context) map[string]string {
+	if v, ok := c.Get("upstreamHeaders"); ok {
+		if h, ok2 := v.(map[string]string); ok2 {
+			return h
+		}
+	}
+	return nil
+}
+
+// upstreamDebugInfo 错误响应中的 debug 字段，尚未请求上游时返回 nil
+func upstreamDebugInfo(c *gin.Context) gin.H {
+	invocationID := c.GetString("upstreamInvocationID")
+	headers := GetUpstreamHeaders(c)
+	if headers == nil && invocationID == "" {
+		return nil
+	}
+	debug := gin.H{}
+	if invocationID != "" {
+		debug["upstream_invocation_id"] = invocationID
+	}
+	if headers != nil {
+		debug["upstream_request_id"] = headers["x-amzn-RequestId"]
+		debug["upstream_headers"] = headers
+	}
+	return debug
+}
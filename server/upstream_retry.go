@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"kiro/config"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// upstreamAttemptKey 上下文键：当前请求已重试上游的次数（不含首次）
+const upstreamAttemptKey = "upstreamAttempt"
+
+// isRetryableUpstreamStatus 上游临时故障的状态码，请求可以原样重发
+func isRetryableUpstreamStatus(status int) bool {
+	switch status {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// upstreamRetriesLeft 是否还可以重试上游（客户端已断开时不再重试）
+func upstreamRetriesLeft(c *gin.Context) bool {
+	return c.GetInt(upstreamAttemptKey)+1 < config.Current().UpstreamRetryMaxAttempts &&
+		requestContext(c).Err() == nil
+}
+
+// retryBackoff 第 attempt 次（从 1 开始）失败后的退避时间：base 逐次翻倍，附加不超过退避时间的随机抖动
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	backoff := base << (attempt - 1)
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff + time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// sleepContext 等待 d，ctx 先结束时立即返回 ctx 的错误
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/**
+ * backoffUpstreamRetry 按指数退避（附加随机抖动）等待下一次上游重试
+ * 上游请求尚未开始向客户端输出，重发不会产生重复内容；等待期间客户端断开时返回 context 错误
+ */
+func backoffUpstreamRetry(c *gin.Context, reason string) error {
+	attempt := c.GetInt(upstreamAttemptKey) + 1
+	wait := retryBackoff(time.Duration(config.Current().UpstreamRetryBackoffMs)*time.Millisecond, attempt)
+
+	utils.Log("上游临时故障，退避后重试",
+		addReqFields(c,
+			utils.LogInt("attempt", attempt),
+			utils.LogString("reason", reason),
+			utils.LogString("backoff", wait.String()),
+		)...)
+	utils.RecordPolicy(c, "upstream_retry", "attempt %d failed (%s); retried after %s", attempt, reason, wait.Round(time.Millisecond))
+
+	if err := sleepContext(requestContext(c), wait); err != nil {
+		return err
+	}
+	c.Set(upstreamAttemptKey, attempt)
+	return nil
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// quotaState token 额度探测结果
+type quotaState struct {
+	exhausted bool
+	resetAt   time.Time // 额度重置时间，零值表示未知
+	checkedAt time.Time
+}
+
+var (
+	// quotaStates 额度探测结果缓存（key: token hash）
+	quotaStates = make(map[string]*quotaState)
+	quotaMutex  sync.RWMutex
+)
+
+// quotaExhaustedRetryFallback 额度耗尽但上游未返回重置时间时建议的重试间隔
+const quotaExhaustedRetryFallback = 1 * time.Hour
+
+// usageStatusError 用量端点返回的非 200 响应
+type usageStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *usageStatusError) Error() string {
+	return fmt.Sprintf("状态码 %d, 响应: %s", e.StatusCode, e.Body)
+}
+
+/**
+ * probeUsageLimits 查询账号当前用量
+ */
+func probeUsageLimits(accessToken, profileArn, proxyKey string) (*types.UsageLimits, error) {
+	query := url.Values{}
+	query.Set("origin", "AI_EDITOR")
+	query.Set("resourceType", "AGENTIC_REQUEST")
+	if profileArn != "" {
+		query.Set("profileArn", profileArn)
+	}
+
+	req, err := http.NewRequest("GET", config.Current().UsageLimitsURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("accept", "application/json")
+	req.Header.Set("user-agent", "aws-sdk-rust/"+config.SDKVersion+" ua/2.1 api/codewhispererruntime/"+config.APIVersion+" os/linux lang/rust/1.92.0 md/appVersion-"+config.KiroCLIVersion+" app/AmazonQ-For-CLI")
+	req.Header.Set("amz-sdk-invocation-id", utils.GenerateUUID())
+
+	resp, err := utils.DoRequestWithProxy(req, proxyKey)
+	if err != nil {
+		return nil, fmt.Errorf("请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("读取响应失败: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &usageStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var limits types.UsageLimits
+	if err := utils.SafeUnmarshal(body, &limits); err != nil {
+		return nil, fmt.Errorf("解析响应失败: %v", err)
+	}
+	return &limits, nil
+}
+
+/**
+ * cachedQuotaExhaustion 返回缓存中仍在有效期内的额度耗尽状态
+ * 已过重置时间或探测结果过期时返回 nil
+ */
+func cachedQuotaExhaustion(tokenHash string) *quotaState {
+	quotaMutex.RLock()
+	state, ok := quotaStates[tokenHash]
+	quotaMutex.RUnlock()
+	if !ok || !state.exhausted {
+		return nil
+	}
+
+	now := time.Now()
+	if !state.resetAt.IsZero() && now.After(state.resetAt) {
+		return nil
+	}
+	if state.resetAt.IsZero() && now.Sub(state.checkedAt) > config.TokenCacheTTL {
+		return nil
+	}
+	return state
+}
+
+/**
+ * checkQuotaExhausted 上游限流时探测当前 token 的额度
+ * 额度耗尽时返回包含重置时间的状态，否则返回 nil（探测结果按 TokenCacheTTL 缓存）
+ */
+func checkQuotaExhausted(c *gin.Context) *quotaState {
+	tokenHash := c.GetString("tokenHash")
+	if tokenHash == "" {
+		return nil
+	}
+
+	quotaMutex.RLock()
+	state, ok := quotaStates[tokenHash]
+	quotaMutex.RUnlock()
+	if ok && time.Since(state.checkedAt) < config.TokenCacheTTL {
+		return cachedQuotaExhaustion(tokenHash)
+	}
+
+	limits, err := probeUsageLimits(c.GetString("accessToken"), c.GetString("profileArn"), tokenHash)
+	if err != nil {
+		utils.Error("用量探测失败: %v", err)
+		return nil
+	}
+
+	usage := &types.TokenWithUsage{UsageLimits: limits}
+	state = &quotaState{
+		exhausted: usage.GetAvailableCount() <= 0,
+		resetAt:   limits.ResetTime(),
+		checkedAt: time.Now(),
+	}
+	quotaMutex.Lock()
+	quotaStates[tokenHash] = state
+	quotaMutex.Unlock()
+
+	if !state.exhausted {
+		return nil
+	}
+	utils.Info("账号额度已耗尽，重置时间: %s", state.resetAt.UTC().Format(time.RFC3339))
+	return state
+}
+
+/**
+ * quotaExhaustedError 构建额度耗尽的 429 错误
+ */
+func quotaExhaustedError(state *quotaState) *UpstreamError {
+	message := "Upstream account quota exhausted"
+	if !state.resetAt.IsZero() {
+		message += ", resets at " + state.resetAt.UTC().Format(time.RFC3339)
+	}
+	return &UpstreamError{
+		StatusCode:     http.StatusTooManyRequests,
+		Message:        message,
+		Type:           errTypeRateLimit,
+		ResetAt:        state.resetAt,
+		QuotaExhausted: true,
+	}
+}
+
+/**
+ * retryAfterSeconds 计算距离重置时间的秒数（向上取整，至少 1 秒）
+ */
+func retryAfterSeconds(resetAt time.Time) int {
+	if resetAt.IsZero() {
+		return int(quotaExhaustedRetryFallback.Seconds())
+	}
+	seconds := int(time.Until(resetAt).Seconds()) + 1
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
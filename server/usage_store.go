@@ -0,0 +1,454 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"kiro/cache"
+	"kiro/config"
+	"kiro/lifecycle"
+	"kiro/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * 用量记账（可选）
+ * USAGE_DB: SQLite 文件路径，配置后 /v1/messages 和 /v1/chat/completions 的每个请求结束时写入一条记录
+ * （API Key、租户、模型、输入/输出/缓存 token、估算费用、耗时、状态码），GET /v1/usage 按时间范围和维度聚合，供计费或监控
+ * 记录经队列异步批量写入，不阻塞请求；队列满时丢弃并计数
+ */
+
+// usageQueueSize 待写入队列长度
+const usageQueueSize = 1024
+
+// usageBatchSize 单个事务最多写入的记录数
+const usageBatchSize = 100
+
+// usageFlushInterval 队列未满一批时的最长写入间隔
+const usageFlushInterval = time.Second
+
+// requestUsageKey 上下文键：本次请求的用量累计
+const requestUsageKey = "requestUsage"
+
+// usageRecord 一条请求用量记录
+type usageRecord struct {
+	Time                time.Time
+	RequestID           string
+	APIKey              string // API Key 的 SHA256 前缀，不保存明文
+	Tenant              string
+	Model               string
+	Stream              bool
+	Status              int
+	LatencyMs           int64
+	InputTokens         int // 未命中缓存的输入 token，与官方 usage.input_tokens 一致
+	OutputTokens        int
+	CacheReadTokens     int
+	CacheCreationTokens int
+	CostUSD             float64 // 按请求时的价格表估算，未配置价格的模型为 0
+}
+
+// requestUsage 请求处理过程中累计的用量，结束时写入记录
+type requestUsage struct {
+	Model               string
+	Stream              bool
+	InputTokens         int
+	OutputTokens        int
+	CacheReadTokens     int
+	CacheCreationTokens int
+	inputIncludesCache  bool // InputTokens 包含缓存部分（Kiro 路径按总输入计数）
+}
+
+// usageStore 用量记录存储
+type usageStore struct {
+	db      *sql.DB
+	queue   chan usageRecord
+	dropped atomic.Int64
+	task    *lifecycle.Task
+}
+
+var usageDB *usageStore
+
+// InitUsageStore 根据 USAGE_DB 初始化用量记账，未配置时不记录
+func InitUsageStore() {
+	dbPath := config.Current().UsageDB
+	if dbPath == "" {
+		return
+	}
+
+	if dir := filepath.Dir(dbPath); dir != "" {
+		os.MkdirAll(dir, 0755)
+	}
+
+	db, err := sql.Open("sqlite", dbPath+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		utils.Error("用量存储初始化失败: %v", err)
+		return
+	}
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS usage_records (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			created_at INTEGER NOT NULL,
+			request_id TEXT,
+			api_key TEXT,
+			tenant TEXT,
+			model TEXT,
+			stream INTEGER NOT NULL DEFAULT 0,
+			status INTEGER NOT NULL,
+			latency_ms INTEGER NOT NULL,
+			input_tokens INTEGER NOT NULL DEFAULT 0,
+			output_tokens INTEGER NOT NULL DEFAULT 0,
+			cache_read_tokens INTEGER NOT NULL DEFAULT 0,
+			cache_creation_tokens INTEGER NOT NULL DEFAULT 0,
+			cost_usd REAL NOT NULL DEFAULT 0
+		)
+	`)
+	if err != nil {
+		utils.Error("创建用量表失败: %v", err)
+		db.Close()
+		return
+	}
+	// 旧版本创建的表没有 cost_usd 列；迁移失败时写入会出错，不启用用量记录
+	if err := addColumnIfMissing(db, "usage_records", "cost_usd REAL NOT NULL DEFAULT 0"); err != nil {
+		utils.Error("用量表迁移失败，用量记录未启用: %v", err)
+		db.Close()
+		return
+	}
+	db.Exec(`CREATE INDEX IF NOT EXISTS idx_usage_created ON usage_records(created_at)`)
+	db.Exec(`CREATE INDEX IF NOT EXISTS idx_usage_key_created ON usage_records(api_key, created_at)`)
+
+	usageDB = &usageStore{db: db, queue: make(chan usageRecord, usageQueueSize)}
+	usageDB.task = lifecycle.Go("usage-writer", usageDB.run)
+	utils.Info("用量记账已启用 (%s)", dbPath)
+}
+
+// StopUsageStore 停止用量写入，已排队的记录写入后返回
+func StopUsageStore() {
+	if usageDB != nil {
+		usageDB.task.Stop()
+	}
+}
+
+/**
+ * UsageRecordMiddleware 记录请求用量
+ * 在限流之前执行，被限流拒绝的请求同样记录（状态码 429，token 为 0）
+ */
+func UsageRecordMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if usageDB == nil {
+			c.Next()
+			return
+		}
+
+		usage := &requestUsage{}
+		c.Set(requestUsageKey, usage)
+		start := time.Now()
+		c.Next()
+
+		rec := usageRecord{
+			Time:                start,
+			RequestID:           GetRequestID(c),
+			Model:               usage.Model,
+			Stream:              usage.Stream,
+			Status:              c.Writer.Status(),
+			LatencyMs:           time.Since(start).Milliseconds(),
+			InputTokens:         usage.InputTokens,
+			OutputTokens:        usage.OutputTokens,
+			CacheReadTokens:     usage.CacheReadTokens,
+			CacheCreationTokens: usage.CacheCreationTokens,
+		}
+		if usage.inputIncludesCache {
+			rec.InputTokens = max(rec.InputTokens-rec.CacheReadTokens-rec.CacheCreationTokens, 0)
+		}
+		if price, ok := config.Current().PriceFor(rec.Model); ok {
+			rec.CostUSD = price.Cost(rec.InputTokens, rec.OutputTokens, rec.CacheReadTokens, rec.CacheCreationTokens)
+		}
+		if keyHash := c.GetString("apiKeyHash"); len(keyHash) >= 16 {
+			rec.APIKey = keyHash[:16]
+		}
+		if profile := GetTenant(c); profile != nil {
+			rec.Tenant = profile.Name
+		}
+		usageDB.submit(rec)
+	}
+}
+
+// requestUsageOf 返回本次请求的用量累计，未启用用量记账时返回 nil
+func requestUsageOf(c *gin.Context) *requestUsage {
+	v, ok := c.Get(requestUsageKey)
+	if !ok {
+		return nil
+	}
+	usage, _ := v.(*requestUsage)
+	return usage
+}
+
+// noteUsageRequest 记录请求的模型（客户端请求的模型名）和是否流式
+func noteUsageRequest(c *gin.Context, model string, stream bool) {
+	if usage := requestUsageOf(c); usage != nil {
+		usage.Model = model
+		usage.Stream = stream
+	}
+}
+
+// recordCacheTokens 记录请求的缓存命中与写入 token（输入 token 不包含缓存部分，如官方 API 返回的 usage）
+func recordCacheTokens(c *gin.Context, readTokens, creationTokens int) {
+	if usage := requestUsageOf(c); usage != nil {
+		usage.CacheReadTokens = readTokens
+		usage.CacheCreationTokens = creationTokens
+	}
+}
+
+// recordCacheResult 记录 Kiro 路径的缓存统计，此时输入 token 按总输入计数，写入记录时扣除缓存部分
+func recordCacheResult(c *gin.Context, cacheResult *cache.CacheResult) {
+	if cacheResult == nil {
+		return
+	}
+	recordCacheTokens(c, cacheResult.CacheReadTokens, cacheResult.CacheCreationTokens)
+	if usage := requestUsageOf(c); usage != nil {
+		usage.inputIncludesCache = true
+	}
+}
+
+// submit 异步提交记录，队列满时丢弃
+func (s *usageStore) submit(rec usageRecord) {
+	select {
+	case s.queue <- rec:
+	default:
+		if s.dropped.Add(1)%100 == 1 {
+			utils.Error("用量记录队列已满，已丢弃 %d 条记录", s.dropped.Load())
+		}
+	}
+}
+
+// run 后台写入协程，按批写入；退出时写入已排队的记录后结束
+func (s *usageStore) run(ctx context.Context) {
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]usageRecord, 0, usageBatchSize)
+	for {
+		select {
+		case rec := <-s.queue:
+			batch = append(batch, rec)
+			if len(batch) >= usageBatchSize {
+				s.write(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				s.write(batch)
+				batch = batch[:0]
+			}
+		case <-ctx.Done():
+			for {
+				select {
+				case rec := <-s.queue:
+					batch = append(batch, rec)
+				default:
+					if len(batch) > 0 {
+						s.write(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// write 在一个事务中写入一批记录
+func (s *usageStore) write(batch []usageRecord) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		utils.Error("写入用量记录失败: %v", err)
+		return
+	}
+	stmt, err := tx.Prepare(`
+		INSERT INTO usage_records (created_at, request_id, api_key, tenant, model, stream, status, latency_ms,
+			input_tokens, output_tokens, cache_read_tokens, cache_creation_tokens, cost_usd)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		utils.Error("写入用量记录失败: %v", err)
+		return
+	}
+	defer stmt.Close()
+
+	for _, rec := range batch {
+		if _, err := stmt.Exec(rec.Time.UnixMilli(), rec.RequestID, rec.APIKey, rec.Tenant, rec.Model, rec.Stream, rec.Status, rec.LatencyMs,
+			rec.InputTokens, rec.OutputTokens, rec.CacheReadTokens, rec.CacheCreationTokens, rec.CostUSD); err != nil {
+			tx.Rollback()
+			utils.Error("写入用量记录失败: %v", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		utils.Error("写入用量记录失败: %v", err)
+	}
+}
+
+// usageGroupColumns group_by 可选维度对应的列表达式
+var usageGroupColumns = map[string]string{
+	"key":    "api_key",
+	"tenant": "tenant",
+	"model":  "model",
+	"day":    "strftime('%Y-%m-%d', created_at / 1000, 'unixepoch')",
+}
+
+// usageGroupFields group_by 维度在响应中的字段名
+var usageGroupFields = map[string]string{
+	"key":    "api_key",
+	"tenant": "tenant",
+	"model":  "model",
+	"day":    "day",
+}
+
+/**
+ * handleUsageQuery GET /v1/usage 按时间范围聚合用量（使用 ADMIN_API_KEY 认证）
+ * 参数：
+ *   start / end  RFC3339 时间或 YYYY-MM-DD 日期（UTC，end 为日期时包含当天），默认当天 0 点到现在
+ *   group_by     逗号分隔的维度：key、tenant、model、day，默认 key
+ *   api_key      只统计指定 API Key（SHA256 前缀，与记录中的 api_key 一致）
+ *   tenant       只统计指定租户
+ */
+func handleUsageQuery(c *gin.Context) {
+	if usageDB == nil {
+		respondError(c, http.StatusNotFound, "%s", "用量记账未启用（未设置 USAGE_DB）")
+		return
+	}
+
+	now := time.Now().UTC()
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	end := now
+	var err error
+	if v := c.Query("start"); v != "" {
+		if start, err = parseUsageTime(v, false); err != nil {
+			respondError(c, http.StatusBadRequest, "无效的 start: %v", err)
+			return
+		}
+	}
+	if v := c.Query("end"); v != "" {
+		if end, err = parseUsageTime(v, true); err != nil {
+			respondError(c, http.StatusBadRequest, "无效的 end: %v", err)
+			return
+		}
+	}
+	if !end.After(start) {
+		respondError(c, http.StatusBadRequest, "%s", "end 必须晚于 start")
+		return
+	}
+
+	groupBy := []string{"key"}
+	if v := c.Query("group_by"); v != "" {
+		groupBy = nil
+		for _, dim := range strings.Split(v, ",") {
+			dim = strings.TrimSpace(dim)
+			if _, ok := usageGroupColumns[dim]; !ok {
+				respondError(c, http.StatusBadRequest, "无效的 group_by 维度 %q（可选 key、tenant、model、day）", dim)
+				return
+			}
+			groupBy = append(groupBy, dim)
+		}
+	}
+
+	data, err := usageDB.aggregate(start, end, groupBy, c.Query("api_key"), c.Query("tenant"))
+	if err != nil {
+		utils.Error("查询用量失败: %v", err)
+		respondError(c, http.StatusInternalServerError, "查询用量失败: %v", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"object":   "list",
+		"start":    start.Format(time.RFC3339),
+		"end":      end.Format(time.RFC3339),
+		"group_by": groupBy,
+		"data":     data,
+		"dropped":  usageDB.dropped.Load(),
+	})
+}
+
+// parseUsageTime 解析 RFC3339 时间或 YYYY-MM-DD 日期，endOfDay 为 true 时日期取次日 0 点（包含当天）
+func parseUsageTime(v string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("需要 RFC3339 时间或 YYYY-MM-DD 日期")
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// aggregate 按维度聚合 [start, end) 内的记录
+func (s *usageStore) aggregate(start, end time.Time, groupBy []string, apiKey, tenantName string) ([]map[string]any, error) {
+	columns := make([]string, len(groupBy))
+	for i, dim := range groupBy {
+		columns[i] = usageGroupColumns[dim]
+	}
+	dims := strings.Join(columns, ", ")
+
+	query := `SELECT ` + dims + `, COUNT(*), SUM(CASE WHEN status >= 400 THEN 1 ELSE 0 END),
+		SUM(input_tokens), SUM(output_tokens), SUM(cache_read_tokens), SUM(cache_creation_tokens), SUM(cost_usd), AVG(latency_ms)
+		FROM usage_records WHERE created_at >= ? AND created_at < ?`
+	args := []any{start.UnixMilli(), end.UnixMilli()}
+	if apiKey != "" {
+		query += ` AND api_key = ?`
+		args = append(args, apiKey)
+	}
+	if tenantName != "" {
+		query += ` AND tenant = ?`
+		args = append(args, tenantName)
+	}
+	query += ` GROUP BY ` + dims + ` ORDER BY ` + dims
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	data := []map[string]any{}
+	for rows.Next() {
+		keys := make([]sql.NullString, len(groupBy))
+		var requests, errors, input, output, cacheRead, cacheCreation int64
+		var cost, avgLatency float64
+		dest := make([]any, 0, len(groupBy)+8)
+		for i := range keys {
+			dest = append(dest, &keys[i])
+		}
+		dest = append(dest, &requests, &errors, &input, &output, &cacheRead, &cacheCreation, &cost, &avgLatency)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		row := map[string]any{
+			"requests":              requests,
+			"errors":                errors,
+			"input_tokens":          input,
+			"output_tokens":         output,
+			"cache_read_tokens":     cacheRead,
+			"cache_creation_tokens": cacheCreation,
+			"cost_usd":              cost,
+			"avg_latency_ms":        int64(avgLatency),
+		}
+		for i, dim := range groupBy {
+			row[usageGroupFields[dim]] = keys[i].String
+		}
+		data = append(data, row)
+	}
+	return data, rows.Err()
+}
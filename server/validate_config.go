@@ -0,0 +1,347 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"kiro/config"
+	"kiro/rules"
+	"kiro/secrets"
+	"kiro/tenant"
+	"kiro/types"
+)
+
+// 校验结果级别
+const (
+	ValidationError   = "error"
+	ValidationWarning = "warning"
+)
+
+// ValidationResult 单项校验问题
+type ValidationResult struct {
+	Check   string `json:"check"`   // 校验项，如 env.ROOT_MODE、tenant.team-a.tokens[0]
+	Level   string `json:"level"`   // error / warning
+	Message string `json:"message"` // 问题描述
+}
+
+// ValidationReport 配置校验报告（validate-config 命令以 JSON 输出）
+type ValidationReport struct {
+	Valid    bool               `json:"valid"`
+	Errors   int                `json:"errors"`
+	Warnings int                `json:"warnings"`
+	Results  []ValidationResult `json:"results"`
+}
+
+func (r *ValidationReport) add(level, check, format string, args ...any) {
+	r.Results = append(r.Results, ValidationResult{Check: check, Level: level, Message: fmt.Sprintf(format, args...)})
+	if level == ValidationError {
+		r.Errors++
+	} else {
+		r.Warnings++
+	}
+}
+
+/**
+ * ValidateConfig 校验环境变量、token 格式、模型映射和租户配置
+ * 只做离线检查：不刷新 token，不解析密钥引用，也不修改运行时状态
+ */
+func ValidateConfig() ValidationReport {
+	report := ValidationReport{Results: []ValidationResult{}}
+
+	settings := validateConfigFile(&report)
+	validateEnv(&report, settings)
+	validateModelMap(&report, settings)
+	validatePoolTokens(&report)
+	validateTenants(&report, settings)
+	validateRules(&report)
+
+	// 按校验项排序，保证输出稳定便于 CI 比对
+	sort.SliceStable(report.Results, func(i, j int) bool {
+		return report.Results[i].Check < report.Results[j].Check
+	})
+	report.Valid = report.Errors == 0
+	return report
+}
+
+// validateEnv 校验环境变量的格式与取值范围，整数、枚举和布尔项的规则与 config 包读取时共用一张表
+func validateEnv(r *ValidationReport, settings *config.Settings) {
+	for _, p := range config.ValidateEnv() {
+		r.add(ValidationError, "env."+p.Key, "%s", p.Message)
+	}
+
+	for _, key := range []string{"PORT", "HTTP_REDIRECT_PORT"} {
+		if port := os.Getenv(key); port != "" {
+			if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+				r.add(ValidationError, "env."+key, "无效端口: %q", port)
+			}
+		}
+	}
+
+	if _, err := bindHost(settings.BindAddress); err != nil {
+		r.add(ValidationError, "env.BIND_ADDRESS", "%v", err)
+	}
+
+	if err := checkTLSSettings(); err != nil {
+		r.add(ValidationError, "env.TLS", "%v", err)
+	}
+	for key, path := range map[string]string{"TLS_CERT_FILE": settings.TLSCertFile, "TLS_KEY_FILE": settings.TLSKeyFile} {
+		if path != "" {
+			if _, err := os.Stat(path); err != nil {
+				r.add(ValidationError, "env."+key, "无法读取文件: %v", err)
+			}
+		}
+	}
+
+	if v := os.Getenv("SECRET_REFRESH_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			r.add(ValidationError, "env.SECRET_REFRESH_INTERVAL", "无效时长: %q（示例: 5m、1h30m）", v)
+		}
+	}
+
+	if v := os.Getenv("EVAL_SINK_SAMPLE_RATE"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err != nil || f < 0 || f > 1 {
+			r.add(ValidationError, "env.EVAL_SINK_SAMPLE_RATE", "采样率必须在 0 到 1 之间: %q", v)
+		}
+	}
+
+	if _, err := parseTTFTThresholds(settings.TTFTSLOModels); err != nil {
+		r.add(ValidationError, "env.TTFT_SLO_MODELS", "%v", err)
+	}
+
+	if soft, hard := settings.HistoryTurnSoftLimit, settings.HistoryTurnHardLimit; soft > 0 && hard > 0 && soft >= hard {
+		r.add(ValidationWarning, "env.HISTORY_TURN_SOFT_LIMIT", "软限制 %d 不小于硬限制 %d，客户端在被拒绝前不会收到提示", soft, hard)
+	}
+
+	if v := os.Getenv("ANTHROPIC_FALLBACK_DAILY_BUDGET_USD"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err != nil || f < 0 {
+			r.add(ValidationError, "env.ANTHROPIC_FALLBACK_DAILY_BUDGET_USD", "无效金额: %q", v)
+		}
+	}
+
+	for key, v := range map[string]string{
+		"ROOT_REDIRECT_URL":              settings.RootRedirectURL,
+		"ANTHROPIC_FALLBACK_BASE_URL":    os.Getenv("ANTHROPIC_FALLBACK_BASE_URL"),
+		"ANTHROPIC_PASSTHROUGH_BASE_URL": settings.AnthropicPassthroughBaseURL,
+		"EVAL_SINK_URL":                  os.Getenv("EVAL_SINK_URL"),
+		"TTFT_SLO_WEBHOOK_URL":           settings.TTFTSLOWebhookURL,
+	} {
+		if v != "" {
+			if u, err := url.Parse(v); err != nil || u.Scheme == "" || u.Host == "" {
+				r.add(ValidationError, "env."+key, "无效 URL: %q", v)
+			}
+		}
+	}
+
+	for name := range parseDisabledFeatures(settings.DisabledFeatures) {
+		if name != featureMCP && name != featureOpenAI {
+			r.add(ValidationWarning, "env.DISABLED_FEATURES", "未知的子系统 %q，可选值: %s, %s", name, featureMCP, featureOpenAI)
+		}
+	}
+
+	if _, err := newBedrockBackend(); err != nil {
+		r.add(ValidationError, "env.BEDROCK", "%v", err)
+	} else if os.Getenv("BEDROCK_REGION") == "" && os.Getenv("BEDROCK_MODELS") != "" {
+		r.add(ValidationWarning, "env.BEDROCK_MODELS", "已设置 BEDROCK_MODELS，但未设置 BEDROCK_REGION，Bedrock 上游不会启用")
+	}
+
+	if args := strings.Fields(settings.CodeExecutionCommand); len(args) > 0 {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			r.add(ValidationWarning, "env.CODE_EXECUTION_COMMAND", "沙箱命令 %q 不可用: %v", args[0], err)
+		}
+	}
+
+	if settings.WebSearchProvider != "" {
+		if _, err := newWebSearchProvider(); err != nil {
+			r.add(ValidationError, "env.WEB_SEARCH_PROVIDER", "%v", err)
+		}
+	}
+
+	if settings.ImageDownscaleDimension > settings.ImageMaxDimension {
+		r.add(ValidationWarning, "env.IMAGE_DOWNSCALE_DIMENSION", "缩放尺寸 %d 大于 IMAGE_MAX_DIMENSION，将按 %d 缩放", settings.ImageDownscaleDimension, settings.ImageMaxDimension)
+	}
+
+	if settings.TokenCacheDB != "" && os.Getenv("TOKEN_CACHE_KEY") == "" {
+		r.add(ValidationWarning, "env.TOKEN_CACHE_KEY", "已启用 token 缓存持久化但未设置加密密钥，refresh token 将以明文存储")
+	}
+}
+
+// validateConfigFile 校验配置文件（不存在时跳过），返回合并后的配置；文件无效时返回默认配置
+func validateConfigFile(r *ValidationReport) *config.Settings {
+	settings, err := config.Validate(config.Path())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			r.add(ValidationError, "config_file", "%v", err)
+		} else if os.Getenv("CONFIG_FILE") != "" {
+			r.add(ValidationError, "env.CONFIG_FILE", "配置文件不存在: %s", config.Path())
+		}
+		return config.Current()
+	}
+
+	for key, value := range map[string]string{
+		"codewhisperer_url":     settings.CodeWhispererURL,
+		"usage_limits_url":      settings.UsageLimitsURL,
+		"mcp_url":               settings.MCPURL,
+		"refresh_token_url":     settings.RefreshTokenURL,
+		"amazonq_token_url":     settings.AmazonQTokenURL,
+		"oidc_token_url_format": fmt.Sprintf(settings.OIDCTokenURLFormat, "us-east-1"),
+	} {
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+			r.add(ValidationError, "config_file.upstream."+key, "无效 URL: %q", value)
+		}
+	}
+	for i, ep := range settings.UpstreamEndpoints {
+		if u, err := url.Parse(ep.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			r.add(ValidationError, fmt.Sprintf("config_file.upstream.endpoints[%d]", i), "无效 URL: %q", ep.URL)
+		}
+	}
+	if settings.Port != "" {
+		if n, err := strconv.Atoi(settings.Port); err != nil || n < 1 || n > 65535 {
+			r.add(ValidationError, "config_file.port", "无效端口: %q", settings.Port)
+		}
+	}
+	return settings
+}
+
+// validateModelMap 校验模型映射目标
+func validateModelMap(r *ValidationReport, settings *config.Settings) {
+	for model, target := range settings.ModelMap {
+		if strings.TrimSpace(target) == "" || strings.ContainsAny(target, " \t") {
+			r.add(ValidationError, "model_map."+model, "映射目标无效: %q", target)
+		}
+	}
+}
+
+// validatePoolTokens 校验全局 token 池
+func validatePoolTokens(r *ValidationReport) {
+	tokens, err := readPoolTokens()
+	if err != nil {
+		r.add(ValidationError, "env.KIRO_TOKENS_FILE", "读取 token 文件失败: %v", err)
+	}
+	for i, token := range tokens {
+		if _, err := ParseToken(token); err != nil {
+			r.add(ValidationError, fmt.Sprintf("pool.tokens[%d]", i), "token 格式错误: %v", err)
+		}
+	}
+
+	hasKey := os.Getenv("KIRO_POOL_API_KEY") != ""
+	if len(tokens) > 0 && !hasKey {
+		r.add(ValidationWarning, "env.KIRO_POOL_API_KEY", "已配置 %d 个池化 token，但未设置 KIRO_POOL_API_KEY，token 池不会启用", len(tokens))
+	}
+	if len(tokens) == 0 && hasKey {
+		r.add(ValidationWarning, "env.KIRO_POOL_API_KEY", "已设置 KIRO_POOL_API_KEY，但未配置 KIRO_TOKENS 或 KIRO_TOKENS_FILE")
+	}
+}
+
+// validateTenants 校验租户配置文件（不存在时跳过）
+func validateTenants(r *ValidationReport, settings *config.Settings) {
+	path := tenant.ConfigPath()
+	profiles, err := tenant.Validate(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			r.add(ValidationError, "tenants", "%v", err)
+		}
+		return
+	}
+
+	now := time.Now()
+	hasFallbackKey := os.Getenv("ANTHROPIC_FALLBACK_API_KEY") != ""
+	for i, p := range profiles {
+		if p.Name == "" {
+			r.add(ValidationWarning, fmt.Sprintf("tenants[%d]", i), "租户缺少 name，将被忽略")
+			continue
+		}
+		check := "tenant." + p.Name
+
+		if len(p.APIKeys) == 0 && len(p.Keys) == 0 {
+			r.add(ValidationWarning, check+".keys", "未配置任何本地 API Key，该租户无法被访问")
+		}
+		for j, key := range p.Keys {
+			if key.Expired(now) {
+				r.add(ValidationWarning, fmt.Sprintf("%s.keys[%d]", check, j), "API Key 已于 %s 过期", key.ExpiresAt.Format(time.RFC3339))
+			}
+		}
+
+		if p.UsesBedrock() {
+			if os.Getenv("BEDROCK_REGION") == "" {
+				r.add(ValidationError, check+".backend", "使用 Bedrock 上游，但未设置 BEDROCK_REGION")
+			}
+		} else if !p.UsesAnthropic() && len(p.Tokens) == 0 {
+			r.add(ValidationError, check+".tokens", "上游 token 池为空")
+		}
+		for j, entry := range p.Tokens {
+			// 密钥引用在运行时解析，离线校验时跳过
+			if secrets.IsRef(entry.Token) {
+				continue
+			}
+			if _, err := ParseToken(entry.Token); err != nil {
+				r.add(ValidationError, fmt.Sprintf("%s.tokens[%d]", check, j), "token 格式错误: %v", err)
+			}
+		}
+
+		if p.RateLimit.RequestsPerMinute < 0 || p.RateLimit.KeyRequestsPerMinute < 0 || p.RateLimit.KeyTokensPerMinute < 0 {
+			r.add(ValidationError, check+".rate_limit", "限流配置不能为负数")
+		}
+
+		for _, model := range p.Models {
+			if _, ok := settings.ModelMap[model]; !ok {
+				r.add(ValidationWarning, check+".models", "模型 %q 不在模型映射表中，将原样透传给上游", model)
+			}
+		}
+
+		switch p.LogPolicy {
+		case "", tenant.LogPolicyFull, tenant.LogPolicySummary, tenant.LogPolicyOff:
+		default:
+			r.add(ValidationWarning, check+".log_policy", "未知的日志策略 %q，将按 full 处理", p.LogPolicy)
+		}
+
+		if _, ok := types.ParseSSEFieldStyle(p.SSEStyle); p.SSEStyle != "" && !ok {
+			r.add(ValidationWarning, check+".sse_style", "未知的字段风格 %q，将使用 SSE_FIELD_STYLE", p.SSEStyle)
+		}
+
+		if p.AnthropicFallback.DailyBudgetUSD < 0 {
+			r.add(ValidationError, check+".anthropic_fallback", "daily_budget_usd 不能为负数")
+		}
+		if p.AnthropicFallback.Enabled && !hasFallbackKey {
+			r.add(ValidationWarning, check+".anthropic_fallback", "已启用回退，但未设置 ANTHROPIC_FALLBACK_API_KEY")
+		}
+	}
+}
+
+// validateRules 校验路由规则文件（不存在时跳过），并检查路由目标是否存在
+func validateRules(r *ValidationReport) {
+	list, err := rules.Validate(rules.ConfigPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			r.add(ValidationError, "rules", "%v", err)
+		}
+		return
+	}
+
+	tenants := make(map[string]bool)
+	if profiles, err := tenant.Validate(tenant.ConfigPath()); err == nil {
+		for _, p := range profiles {
+			tenants[p.Name] = true
+		}
+	}
+	for _, rule := range list {
+		route := rule.Action.Route
+		if route == "" {
+			continue
+		}
+		if route == rules.PoolGlobal {
+			if os.Getenv("KIRO_POOL_API_KEY") == "" {
+				r.add(ValidationWarning, "rules."+rule.Name, "路由到全局 token 池，但全局 token 池未启用")
+			}
+			continue
+		}
+		if !tenants[route] {
+			r.add(ValidationError, "rules."+rule.Name, "路由目标租户 %q 不存在", route)
+		}
+	}
+}
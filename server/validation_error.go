@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"kiro/types"
+)
+
+// validationViolationPattern 匹配上游 ValidationException 中的单条违规描述
+// 例: Value at 'conversationState.history.3.member.userInputMessage.content' failed to satisfy constraint: Member must have length less than or equal to 600000
+var validationViolationPattern = regexp.MustCompile(`Value (?:'[^']*' )?at '([^']+)' failed to satisfy constraint: ([^;]+)`)
+
+// validationIndexPattern 匹配字段路径中的数组下标段（如 tools.3 / history.12）
+var validationIndexPattern = regexp.MustCompile(`(tools|history|toolResults|toolUses|images)\.(\d+)`)
+
+// validationViolation 上游字段校验失败项
+type validationViolation struct {
+	Path       string
+	Constraint string
+}
+
+// parseValidationViolations 从上游错误消息中提取所有字段违规
+func parseValidationViolations(message string) []validationViolation {
+	matches := validationViolationPattern.FindAllStringSubmatch(message, -1)
+	violations := make([]validationViolation, 0, len(matches))
+	for _, m := range matches {
+		violations = append(violations, validationViolation{
+			Path:       m[1],
+			Constraint: strings.TrimSpace(m[2]),
+		})
+	}
+	return violations
+}
+
+// translateValidationError 将上游校验错误翻译为指向具体工具/消息的可操作描述
+// 无法识别时返回 false，由调用方按原有逻辑处理
+func translateValidationError(message string, req types.AnthropicRequest) (string, bool) {
+	violations := parseValidationViolations(message)
+	if len(violations) == 0 {
+		return "", false
+	}
+
+	details := make([]string, 0, len(violations))
+	for _, v := range violations {
+		details = append(details, fmt.Sprintf("%s: %s", describeValidationPath(v.Path, req), v.Constraint))
+	}
+	return "Request rejected by upstream validation: " + strings.Join(details, "; "), true
+}
+
+// describeValidationPath 将上游字段路径映射为 Anthropic 请求中的位置
+func describeValidationPath(path string, req types.AnthropicRequest) string {
+	field := path[strings.LastIndex(path, ".")+1:]
+
+	var parts []string
+	for _, m := range validationIndexPattern.FindAllStringSubmatch(path, -1) {
+		index, _ := strconv.Atoi(m[2])
+		switch m[1] {
+		case "tools":
+			if name := upstreamToolName(req, index); name != "" {
+				parts = append(parts, fmt.Sprintf("tools[%d] (%q)", index, name))
+			} else {
+				parts = append(parts, fmt.Sprintf("tools[%d]", index))
+			}
+		case "history":
+			// 历史按 user/assistant 成对构建，下标与 messages 近似一一对应
+			parts = append(parts, fmt.Sprintf("messages[%d] (approximate)", index))
+		default:
+			parts = append(parts, fmt.Sprintf("%s[%d]", m[1], index))
+		}
+	}
+
+	if len(parts) == 0 {
+		if strings.Contains(path, "currentMessage") {
+			parts = append(parts, fmt.Sprintf("messages[%d]", len(req.Messages)-1))
+		} else {
+			return path
+		}
+	} else if strings.Contains(path, "currentMessage") && !strings.HasPrefix(parts[0], "tools") {
+		parts = append([]string{fmt.Sprintf("messages[%d]", len(req.Messages)-1)}, parts...)
+	}
+
+	return strings.Join(parts, ".") + " " + field
+}
+
+// upstreamToolName 返回上游工具列表第 index 项对应的工具名（与转换时一致，跳过无名工具）
+func upstreamToolName(req types.AnthropicRequest, index int) string {
+	i := 0
+	for _, tool := range req.Tools {
+		if tool.Name == "" {
+			continue
+		}
+		if i == index {
+			return tool.Name
+		}
+		i++
+	}
+	return ""
+}
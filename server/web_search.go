@@ -0,0 +1,334 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"kiro/config"
+	"kiro/types"
+	"kiro/utils"
+)
+
+/**
+ * web_search 服务端工具的搜索服务
+ * 配置 WEB_SEARCH_PROVIDER 后，web_search 与 code_execution 一样由代理模拟：替换为等价的客户端工具发往上游，
+ * 模型调用时由代理请求搜索服务，把结果作为 tool_result 继续对话，模型基于搜索结果给出回答
+ * 未配置时 web_search 仍通过上游 MCP 端点搜索（mcp_handler.go），直接返回搜索结果
+ */
+
+// webSearchToolName web_search 服务端工具名
+const webSearchToolName = "web_search"
+
+// webSearchMaxResults 搜索结果最多保留的条数
+const webSearchMaxResults = 5
+
+// webSearchTool 发往上游的等价客户端工具定义
+var webSearchTool = types.AnthropicTool{
+	Name:        webSearchToolName,
+	Description: "Search the web for up-to-date information. Returns titles, URLs and snippets of the top results. Use it for recent events or facts you are unsure about.",
+	InputSchema: map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"query": map[string]any{
+				"type":        "string",
+				"description": "The search query",
+			},
+		},
+		"required": []any{"query"},
+	},
+}
+
+// webSearchResult 一条搜索结果
+type webSearchResult struct {
+	Title       string `json:"title"`
+	URL         string `json:"url"`
+	Snippet     string `json:"snippet,omitempty"`
+	Domain      string `json:"domain,omitempty"`
+	PublishedAt int64  `json:"published_date,omitempty"` // 毫秒时间戳
+}
+
+// webSearchProvider 搜索服务
+type webSearchProvider interface {
+	Search(ctx context.Context, query string, count int) ([]webSearchResult, error)
+}
+
+// 支持的搜索服务
+const (
+	webSearchProviderSearxNG = "searxng"
+	webSearchProviderBrave   = "brave"
+	webSearchProviderBing    = "bing"
+)
+
+// newWebSearchProvider 根据配置创建搜索服务，未配置时返回 nil
+func newWebSearchProvider() (webSearchProvider, error) {
+	switch strings.ToLower(strings.TrimSpace(config.Current().WebSearchProvider)) {
+	case "":
+		return nil, nil
+	case webSearchProviderSearxNG:
+		if config.Current().WebSearchURL == "" {
+			return nil, fmt.Errorf("WEB_SEARCH_PROVIDER=searxng 需要设置 WEB_SEARCH_URL")
+		}
+		return &searxngProvider{endpoint: strings.TrimRight(config.Current().WebSearchURL, "/") + "/search"}, nil
+	case webSearchProviderBrave:
+		if config.Current().WebSearchAPIKey == "" {
+			return nil, fmt.Errorf("WEB_SEARCH_PROVIDER=brave 需要设置 WEB_SEARCH_API_KEY")
+		}
+		return &braveProvider{endpoint: withDefault(config.Current().WebSearchURL, "https://api.search.brave.com/res/v1/web/search"), apiKey: config.Current().WebSearchAPIKey}, nil
+	case webSearchProviderBing:
+		if config.Current().WebSearchAPIKey == "" {
+			return nil, fmt.Errorf("WEB_SEARCH_PROVIDER=bing 需要设置 WEB_SEARCH_API_KEY")
+		}
+		return &bingProvider{endpoint: withDefault(config.Current().WebSearchURL, "https://api.bing.microsoft.com/v7.0/search"), apiKey: config.Current().WebSearchAPIKey}, nil
+	default:
+		return nil, fmt.Errorf("未知的 WEB_SEARCH_PROVIDER: %q，可选值: searxng, brave, bing", config.Current().WebSearchProvider)
+	}
+}
+
+// withDefault 值为空时使用默认值
+func withDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// webSearch 当前配置的搜索服务，配置无效时启动时记录错误并视为未配置
+var webSearch = func() webSearchProvider {
+	provider, err := newWebSearchProvider()
+	if err != nil {
+		utils.Error("web_search 搜索服务配置无效: %v", err)
+	}
+	return provider
+}()
+
+// webSearchProviderEnabled 是否配置了搜索服务
+func webSearchProviderEnabled() bool {
+	return webSearch != nil
+}
+
+// fetchSearchJSON 请求搜索 API 并解析 JSON 响应
+func fetchSearchJSON(ctx context.Context, endpoint string, params url.Values, headers map[string]string, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, config.WebSearchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("创建搜索请求失败: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := utils.SharedHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("搜索请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4*1024*1024))
+	if err != nil {
+		return fmt.Errorf("读取搜索响应失败: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("搜索服务返回 %d: %s", resp.StatusCode, truncateRunes(string(body), 200))
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("解析搜索响应失败: %v", err)
+	}
+	return nil
+}
+
+// parsePublishedAt 解析搜索服务返回的发布时间，无法解析时返回 0
+func parsePublishedAt(value string) int64 {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UnixMilli()
+		}
+	}
+	return 0
+}
+
+// searxngProvider SearxNG 实例（需要在实例设置中启用 json 输出格式）
+type searxngProvider struct {
+	endpoint string
+}
+
+func (p *searxngProvider) Search(ctx context.Context, query string, count int) ([]webSearchResult, error) {
+	var resp struct {
+		Results []struct {
+			Title         string `json:"title"`
+			URL           string `json:"url"`
+			Content       string `json:"content"`
+			PublishedDate string `json:"publishedDate"`
+		} `json:"results"`
+	}
+	params := url.Values{"q": {query}, "format": {"json"}}
+	if err := fetchSearchJSON(ctx, p.endpoint, params, nil, &resp); err != nil {
+		return nil, err
+	}
+	results := make([]webSearchResult, 0, min(count, len(resp.Results)))
+	for _, r := range resp.Results {
+		if len(results) >= count {
+			break
+		}
+		results = append(results, webSearchResult{Title: r.Title, URL: r.URL, Snippet: r.Content, PublishedAt: parsePublishedAt(r.PublishedDate)})
+	}
+	return results, nil
+}
+
+// braveProvider Brave Search API
+type braveProvider struct {
+	endpoint string
+	apiKey   string
+}
+
+func (p *braveProvider) Search(ctx context.Context, query string, count int) ([]webSearchResult, error) {
+	var resp struct {
+		Web struct {
+			Results []struct {
+				Title       string `json:"title"`
+				URL         string `json:"url"`
+				Description string `json:"description"`
+				PageAge     string `json:"page_age"`
+			} `json:"results"`
+		} `json:"web"`
+	}
+	params := url.Values{"q": {query}, "count": {strconv.Itoa(count)}}
+	if err := fetchSearchJSON(ctx, p.endpoint, params, map[string]string{"X-Subscription-Token": p.apiKey}, &resp); err != nil {
+		return nil, err
+	}
+	results := make([]webSearchResult, 0, len(resp.Web.Results))
+	for _, r := range resp.Web.Results {
+		results = append(results, webSearchResult{Title: r.Title, URL: r.URL, Snippet: r.Description, PublishedAt: parsePublishedAt(r.PageAge)})
+	}
+	return results, nil
+}
+
+// bingProvider Bing Web Search API
+type bingProvider struct {
+	endpoint string
+	apiKey   string
+}
+
+func (p *bingProvider) Search(ctx context.Context, query string, count int) ([]webSearchResult, error) {
+	var resp struct {
+		WebPages struct {
+			Value []struct {
+				Name            string `json:"name"`
+				URL             string `json:"url"`
+				Snippet         string `json:"snippet"`
+				DatePublished   string `json:"datePublished"`
+				DateLastCrawled string `json:"dateLastCrawled"`
+			} `json:"value"`
+		} `json:"webPages"`
+	}
+	params := url.Values{"q": {query}, "count": {strconv.Itoa(count)}, "responseFilter": {"Webpages"}}
+	if err := fetchSearchJSON(ctx, p.endpoint, params, map[string]string{"Ocp-Apim-Subscription-Key": p.apiKey}, &resp); err != nil {
+		return nil, err
+	}
+	results := make([]webSearchResult, 0, len(resp.WebPages.Value))
+	for _, r := range resp.WebPages.Value {
+		results = append(results, webSearchResult{Title: r.Name, URL: r.URL, Snippet: r.Snippet, PublishedAt: parsePublishedAt(withDefault(r.DatePublished, r.DateLastCrawled))})
+	}
+	return results, nil
+}
+
+// domainMatches 结果的主机名是否属于域名列表（含子域名）
+func domainMatches(rawURL string, domains []string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "*."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterSearchResults 按 allowed_domains / blocked_domains 过滤结果
+func filterSearchResults(results []webSearchResult, allowed, blocked []string) []webSearchResult {
+	if len(allowed) == 0 && len(blocked) == 0 {
+		return results
+	}
+	filtered := results[:0:0]
+	for _, result := range results {
+		if len(allowed) > 0 && !domainMatches(result.URL, allowed) {
+			continue
+		}
+		if domainMatches(result.URL, blocked) {
+			continue
+		}
+		filtered = append(filtered, result)
+	}
+	return filtered
+}
+
+// webSearchResultContent 构建 web_search_tool_result 块的 content 字段
+// encrypted_content 为摘要的 base64，客户端原样回传后由 utils.WebSearchResultText 还原
+func webSearchResultContent(results []webSearchResult, searchErr error) any {
+	if searchErr != nil {
+		return map[string]any{
+			"type":       "web_search_tool_result_error",
+			"error_code": toolErrUnavailable,
+		}
+	}
+	items := make([]any, 0, len(results))
+	for _, result := range results {
+		var pageAge any
+		if result.PublishedAt > 0 {
+			pageAge = time.UnixMilli(result.PublishedAt).UTC().Format("January 2, 2006")
+		}
+		items = append(items, map[string]any{
+			"type":              "web_search_result",
+			"title":             result.Title,
+			"url":               result.URL,
+			"encrypted_content": base64.StdEncoding.EncodeToString([]byte(result.Snippet)),
+			"page_age":          pageAge,
+		})
+	}
+	return items
+}
+
+// webSearchServerTool 由搜索服务执行的 web_search 模拟工具，declared 为客户端声明的工具（携带 max_uses 和域名过滤）
+func webSearchServerTool(declared types.AnthropicTool) *emulatedServerTool {
+	return &emulatedServerTool{
+		upstream:   webSearchTool,
+		resultType: "web_search_tool_result",
+		maxUses:    declared.MaxUses,
+		run: func(ctx context.Context, input map[string]any) serverToolResult {
+			query, _ := input["query"].(string)
+			if strings.TrimSpace(query) == "" {
+				return serverToolResult{Content: map[string]any{"type": "web_search_tool_result_error", "error_code": toolErrInvalidInput}, Text: "Web search failed: " + toolErrInvalidInput, IsError: true}
+			}
+			results, err := webSearch.Search(ctx, query, webSearchMaxResults)
+			if err != nil {
+				utils.Error("web_search 搜索失败: query=%s, err=%v", query, err)
+			}
+			results = filterSearchResults(results, declared.AllowedDomains, declared.BlockedDomains)
+			content := webSearchResultContent(results, err)
+			return serverToolResult{Content: content, Text: utils.WebSearchResultText(content), IsError: err != nil}
+		},
+	}
+}
+
+// truncateRunes 按字符截断字符串，超出时追加省略号
+func truncateRunes(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max]) + "..."
+}
@@ -0,0 +1,762 @@
+package tenant
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro/lifecycle"
+	"kiro/secrets"
+)
+
+// dataDir 数据文件根目录（与 proxy 包保持一致）
+var dataDir = "data"
+
+// 日志策略
+const (
+	LogPolicyFull    = "full"    // 完整日志（默认）
+	LogPolicySummary = "summary" // 仅输出请求完成统计
+	LogPolicyOff     = "off"     // 不输出该租户的请求日志
+)
+
+// 租户上游后端（为空时使用 Kiro token 池）
+const (
+	BackendBedrock   = "bedrock"   // 请求全部发往 Amazon Bedrock
+	BackendAnthropic = "anthropic" // 请求原样转发到 Anthropic API
+)
+
+// RateLimit 租户级限流配置
+type RateLimit struct {
+	RequestsPerMinute int `json:"requests_per_minute"` // 租户所有 key 合计的每分钟请求数
+	// 单个 API Key 的限制，覆盖全局 RATE_LIMIT_RPM / RATE_LIMIT_TPM，0 表示沿用全局配置
+	KeyRequestsPerMinute int `json:"key_requests_per_minute"`
+	KeyTokensPerMinute   int `json:"key_tokens_per_minute"`
+}
+
+// APIKey 带有效期的本地 API Key
+type APIKey struct {
+	Key       string    `json:"key"`
+	KeyHash   string    `json:"key_hash,omitempty"` // key 的 SHA256（十六进制，可带 "sha256:" 前缀），设置后配置中无需保存明文 key
+	Label     string    `json:"label,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"` // RFC3339，零值表示永不过期
+	// AbuseShapingExempt 为 true 时该 key 不受滥用模式整形限制（如确实需要高频重放的批处理任务）
+	AbuseShapingExempt bool `json:"abuse_shaping_exempt,omitempty"`
+}
+
+// hashedKeyPrefix api_keys 或 keys[].key 以该前缀开头时表示已哈希的 key
+const hashedKeyPrefix = "sha256:"
+
+// hash 返回 key 的 SHA256，兼容明文、key_hash 和 "sha256:" 前缀三种写法
+func (k APIKey) hash() (string, error) {
+	hash := strings.TrimPrefix(k.KeyHash, hashedKeyPrefix)
+	if hash == "" && strings.HasPrefix(k.Key, hashedKeyPrefix) {
+		hash = strings.TrimPrefix(k.Key, hashedKeyPrefix)
+	}
+	if hash == "" {
+		return hashKey(k.Key), nil
+	}
+	hash = strings.ToLower(hash)
+	if raw, err := hex.DecodeString(hash); err != nil || len(raw) != sha256.Size {
+		return "", fmt.Errorf("无效的 key 哈希 %q，应为 64 位十六进制 SHA256", hash)
+	}
+	return hash, nil
+}
+
+// Expired 检查 key 是否已过期
+func (k APIKey) Expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && now.After(k.ExpiresAt)
+}
+
+// AccountLabels 上游账号的标注信息，用于多账号场景下的用量归属
+type AccountLabels struct {
+	Owner  string `json:"owner,omitempty"`  // 账号所有者邮箱
+	Tier   string `json:"tier,omitempty"`   // 订阅等级（如 free / pro）
+	Region string `json:"region,omitempty"` // 账号所在区域
+	Notes  string `json:"notes,omitempty"`  // 备注
+}
+
+// IsZero 是否未设置任何标注
+func (l AccountLabels) IsZero() bool {
+	return l == AccountLabels{}
+}
+
+// TokenEntry 上游 token 池条目
+// 配置中既可以是纯字符串，也可以是带标注的对象 {"token": "...", "owner": "...", ...}
+type TokenEntry struct {
+	Token    string `json:"token"`
+	Endpoint string `json:"endpoint,omitempty"` // 固定使用的上游端点名称（对应配置文件 upstream.endpoints），为空时按健康状态选择
+	AccountLabels
+}
+
+// UnmarshalJSON 兼容纯字符串与对象两种写法
+func (e *TokenEntry) UnmarshalJSON(data []byte) error {
+	var token string
+	if err := json.Unmarshal(data, &token); err == nil {
+		*e = TokenEntry{Token: token}
+		return nil
+	}
+
+	type plain TokenEntry
+	var entry plain
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return fmt.Errorf("token 条目必须是字符串或对象: %v", err)
+	}
+	*e = TokenEntry(entry)
+	return nil
+}
+
+// FallbackPolicy 上游账号耗尽或被封禁时回退到真实 Anthropic API 的策略
+type FallbackPolicy struct {
+	Enabled        bool     `json:"enabled"`
+	Models         []string `json:"models"`           // 允许回退的模型，为空表示不限制
+	DailyBudgetUSD float64  `json:"daily_budget_usd"` // 租户每日回退费用上限，0 表示不限
+}
+
+// Profile 租户配置
+type Profile struct {
+	Name           string       `json:"name"`
+	APIKeys        []string     `json:"api_keys"`        // 绑定到该租户的本地 API Key（永不过期）
+	Keys           []APIKey     `json:"keys"`            // 带有效期的本地 API Key，用于轮换
+	Tokens         []TokenEntry `json:"tokens"`          // 上游 token 池（Kiro / AmazonQ / IdC 格式，可附带账号标注）
+	RateLimit      RateLimit    `json:"rate_limit"`      // 限流配置，0 表示不限流
+	Models         []string     `json:"models"`          // 模型白名单，为空表示不限制
+	CacheNamespace string       `json:"cache_namespace"` // Prompt Cache 命名空间，为空时使用租户名
+	LogPolicy      string       `json:"log_policy"`      // full / summary / off
+
+	// 上游身份标识（用于上游滥用报告追溯到租户，无需为每个租户单独分配 token）
+	ConversationIDPrefix string            `json:"conversation_id_prefix"` // 上游 conversationId 前缀
+	UpstreamHeaders      map[string]string `json:"upstream_headers"`       // 附加到上游请求的自定义请求头
+
+	// 溢出回退（需同时配置 ANTHROPIC_FALLBACK_API_KEY）
+	AnthropicFallback FallbackPolicy `json:"anthropic_fallback"`
+
+	// 上游后端：空（默认 Kiro token 池）、bedrock（需同时配置 BEDROCK_REGION）或 anthropic（使用 anthropic_api_key 直连），
+	// 后两者无需配置 tokens
+	Backend         string `json:"backend"`
+	AnthropicAPIKey string `json:"anthropic_api_key"` // backend 为 anthropic 时使用的真实 Anthropic API Key（支持 vault:/ssm: 引用）
+
+	// 允许通过 X-Kiro-Debug: 1 请求头在响应中回显生效的策略
+	AllowDebug bool `json:"allow_debug"`
+
+	// 流式响应可选字段的输出风格（strict-anthropic / lenient），为空时使用 SSE_FIELD_STYLE
+	SSEStyle string `json:"sse_style"`
+}
+
+// UsesBedrock 租户是否通过 Amazon Bedrock 访问模型
+func (p *Profile) UsesBedrock() bool {
+	return p.Backend == BackendBedrock
+}
+
+// UsesAnthropic 租户请求是否原样转发到 Anthropic API
+func (p *Profile) UsesAnthropic() bool {
+	return p.Backend == BackendAnthropic
+}
+
+// ModelAllowed 检查模型是否在租户白名单中
+func (p *Profile) ModelAllowed(model string) bool {
+	if len(p.Models) == 0 {
+		return true
+	}
+	for _, m := range p.Models {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// Namespace 返回租户的缓存命名空间
+func (p *Profile) Namespace() string {
+	if p.CacheNamespace != "" {
+		return p.CacheNamespace
+	}
+	return p.Name
+}
+
+// Logging 返回租户的日志策略
+func (p *Profile) Logging() string {
+	switch p.LogPolicy {
+	case LogPolicySummary, LogPolicyOff:
+		return p.LogPolicy
+	default:
+		return LogPolicyFull
+	}
+}
+
+// reservedHeaders 不允许租户覆盖的上游请求头（小写）
+var reservedHeaders = map[string]struct{}{
+	"authorization":         {},
+	"content-type":          {},
+	"content-length":        {},
+	"host":                  {},
+	"x-amz-target":          {},
+	"amz-sdk-invocation-id": {},
+	"amz-sdk-request":       {},
+}
+
+// IdentityHeaders 返回可安全附加到上游请求的租户自定义请求头
+func (p *Profile) IdentityHeaders() map[string]string {
+	headers := make(map[string]string, len(p.UpstreamHeaders))
+	for k, v := range p.UpstreamHeaders {
+		if _, reserved := reservedHeaders[strings.ToLower(k)]; reserved {
+			continue
+		}
+		headers[k] = v
+	}
+	return headers
+}
+
+// allKeys 合并 api_keys 与 keys 两种配置
+func (p *Profile) allKeys() []APIKey {
+	keys := make([]APIKey, 0, len(p.APIKeys)+len(p.Keys))
+	for _, k := range p.APIKeys {
+		keys = append(keys, APIKey{Key: k})
+	}
+	return append(keys, p.Keys...)
+}
+
+// window 固定窗口限流计数
+type window struct {
+	start time.Time
+	count int
+}
+
+// keyBinding API Key 与租户的绑定
+type keyBinding struct {
+	profile *Profile
+	key     APIKey
+}
+
+// Manager 租户配置管理器
+type Manager struct {
+	mu       sync.RWMutex
+	profiles map[string]*Profile    // key: 租户名
+	byAPIKey map[string]*keyBinding // key: 本地 API Key 的 SHA256
+	revoked  map[string]struct{}    // 吊销列表（key 的 sha256）
+	cursors  map[string]int         // 租户 token 池轮询游标
+	windows  map[string]*window     // 租户限流窗口
+	audited  map[string]time.Time   // 审计事件节流（key: 事件+key hash）
+	modTime  time.Time
+	// 配置中是否包含密钥引用（vault:/ssm:），包含时定期重新拉取以跟随轮换
+	hasSecretRefs bool
+	// 吊销列表文件修改时间，用于热重载检测
+	revokedModTime time.Time
+}
+
+// 全局单例
+var manager = &Manager{
+	profiles: make(map[string]*Profile),
+	byAPIKey: make(map[string]*keyBinding),
+	revoked:  make(map[string]struct{}),
+	cursors:  make(map[string]int),
+	windows:  make(map[string]*window),
+	audited:  make(map[string]time.Time),
+}
+
+// maxActiveKeys 每个租户同时有效的 API Key 上限（轮换期间新旧两把 key 并存）
+const maxActiveKeys = 2
+
+// expiryWarningWindow 即将过期 key 的审计提醒窗口
+const expiryWarningWindow = 7 * 24 * time.Hour
+
+// auditThrottle 同一 key 同类审计事件的最小记录间隔
+const auditThrottle = 1 * time.Hour
+
+var (
+	// ErrKeyExpired API Key 已过期
+	ErrKeyExpired = errors.New("api key expired")
+	// ErrKeyRevoked API Key 已被吊销
+	ErrKeyRevoked = errors.New("api key revoked")
+)
+
+// configPath 租户配置文件路径
+func configPath() string {
+	return filepath.Join(dataDir, "tenants.json")
+}
+
+// revokedPath 吊销列表文件路径
+func revokedPath() string {
+	return filepath.Join(dataDir, "revoked_keys.txt")
+}
+
+// Init 启动时加载租户配置
+func Init() {
+	loadRevoked(revokedPath())
+
+	path := configPath()
+	if err := load(path); err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "[Tenant] 加载失败: %v\n", err)
+		}
+		return
+	}
+
+	manager.mu.RLock()
+	count := len(manager.profiles)
+	manager.mu.RUnlock()
+	fmt.Fprintf(os.Stderr, "[Tenant] 已加载 %d 个租户\n", count)
+}
+
+// reloadTask 热重载任务
+var reloadTask *lifecycle.Task
+
+// StartReloadTicker 启动配置热重载
+// 配置包含密钥引用时，按 SECRET_REFRESH_INTERVAL（默认 5m）重新从密钥后端拉取
+func StartReloadTicker() {
+	secretInterval := 5 * time.Minute
+	if v := os.Getenv("SECRET_REFRESH_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			secretInterval = d
+		}
+	}
+
+	reloadTask.Stop()
+	reloadTask = lifecycle.Go("tenant-reload", func(ctx context.Context) {
+		reloadTicker := time.NewTicker(30 * time.Second)
+		secretTicker := time.NewTicker(secretInterval)
+		defer reloadTicker.Stop()
+		defer secretTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-reloadTicker.C:
+				checkAndReload()
+			case <-secretTicker.C:
+				refreshSecrets()
+			}
+		}
+	})
+}
+
+// StopReloadTicker 停止配置热重载
+func StopReloadTicker() {
+	reloadTask.Stop()
+}
+
+// Count 返回已加载的租户数量
+func Count() int {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+	return len(manager.profiles)
+}
+
+// Find 按名称查找租户，不存在时返回 nil
+func Find(name string) *Profile {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+	return manager.profiles[name]
+}
+
+// Lookup 根据本地 API Key 查找租户
+// 未绑定租户时返回 (nil, nil)；key 已吊销或过期时返回对应错误
+func Lookup(apiKey string) (*Profile, error) {
+	keyHash := hashKey(apiKey)
+
+	manager.mu.RLock()
+	_, revoked := manager.revoked[keyHash]
+	binding, ok := manager.byAPIKey[keyHash]
+	manager.mu.RUnlock()
+
+	if revoked {
+		name := ""
+		if ok {
+			name = binding.profile.Name
+		}
+		audit("revoked_key_used", name, keyHash, time.Time{})
+		return nil, ErrKeyRevoked
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if binding.key.Expired(now) {
+		audit("expired_key_used", binding.profile.Name, keyHash, binding.key.ExpiresAt)
+		return nil, ErrKeyExpired
+	}
+	if !binding.key.ExpiresAt.IsZero() && binding.key.ExpiresAt.Sub(now) < expiryWarningWindow {
+		audit("expiring_key_used", binding.profile.Name, keyHash, binding.key.ExpiresAt)
+	}
+
+	return binding.profile, nil
+}
+
+// AbuseShapingExempt 返回 API Key（SHA256）是否在租户配置中豁免滥用模式整形
+func AbuseShapingExempt(keyHash string) bool {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+	binding, ok := manager.byAPIKey[keyHash]
+	return ok && binding.key.AbuseShapingExempt
+}
+
+// NextToken 从租户 token 池中轮询选取一个上游 token
+func NextToken(p *Profile) (TokenEntry, error) {
+	if len(p.Tokens) == 0 {
+		return TokenEntry{}, fmt.Errorf("租户 %s 未配置上游 token", p.Name)
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	idx := manager.cursors[p.Name] % len(p.Tokens)
+	manager.cursors[p.Name] = idx + 1
+	return p.Tokens[idx], nil
+}
+
+// NextTokenMatching 从租户 token 池中轮询选取满足条件的上游 token
+func NextTokenMatching(p *Profile, match func(TokenEntry) bool) (TokenEntry, bool) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	start := manager.cursors[p.Name]
+	for i := 0; i < len(p.Tokens); i++ {
+		idx := (start + i) % len(p.Tokens)
+		if match(p.Tokens[idx]) {
+			manager.cursors[p.Name] = idx + 1
+			return p.Tokens[idx], true
+		}
+	}
+	return TokenEntry{}, false
+}
+
+// Allow 检查租户是否超出每分钟请求数限制
+func Allow(p *Profile) bool {
+	limit := p.RateLimit.RequestsPerMinute
+	if limit <= 0 {
+		return true
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	now := time.Now()
+	w, ok := manager.windows[p.Name]
+	if !ok || now.Sub(w.start) >= time.Minute {
+		manager.windows[p.Name] = &window{start: now, count: 1}
+		return true
+	}
+	if w.count >= limit {
+		return false
+	}
+	w.count++
+	return true
+}
+
+// --- 内部方法 ---
+
+func load(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var list []*Profile
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return fmt.Errorf("解析 %s 失败: %v", path, err)
+	}
+
+	hasSecretRefs := false
+	for _, p := range list {
+		refs, err := resolveSecrets(p)
+		if err != nil {
+			return fmt.Errorf("租户 %s: %v", p.Name, err)
+		}
+		hasSecretRefs = hasSecretRefs || refs
+	}
+
+	profiles, byAPIKey, err := index(list, time.Now())
+	if err != nil {
+		return err
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	manager.profiles = profiles
+	manager.byAPIKey = byAPIKey
+	manager.modTime = info.ModTime()
+	manager.hasSecretRefs = hasSecretRefs
+	return nil
+}
+
+// index 建立租户名和 API Key 索引，校验租户名、API Key 唯一性和同时有效的 key 数量
+func index(list []*Profile, now time.Time) (map[string]*Profile, map[string]*keyBinding, error) {
+	profiles := make(map[string]*Profile, len(list))
+	byAPIKey := make(map[string]*keyBinding)
+	for _, p := range list {
+		if p.Name == "" {
+			continue
+		}
+		if _, dup := profiles[p.Name]; dup {
+			return nil, nil, fmt.Errorf("租户名重复: %s", p.Name)
+		}
+		profiles[p.Name] = p
+		switch p.Backend {
+		case "", BackendBedrock:
+		case BackendAnthropic:
+			if p.AnthropicAPIKey == "" {
+				return nil, nil, fmt.Errorf("租户 %s 使用 anthropic 后端，但未配置 anthropic_api_key", p.Name)
+			}
+		default:
+			return nil, nil, fmt.Errorf("租户 %s 的 backend 无效: %s（可选值: %s, %s）", p.Name, p.Backend, BackendBedrock, BackendAnthropic)
+		}
+
+		active := 0
+		for _, key := range p.allKeys() {
+			if key.Key == "" && key.KeyHash == "" {
+				continue
+			}
+			keyHash, err := key.hash()
+			if err != nil {
+				return nil, nil, fmt.Errorf("租户 %s: %v", p.Name, err)
+			}
+			if owner, dup := byAPIKey[keyHash]; dup {
+				return nil, nil, fmt.Errorf("API Key 同时绑定到租户 %s 和 %s", owner.profile.Name, p.Name)
+			}
+			byAPIKey[keyHash] = &keyBinding{profile: p, key: key}
+			if !key.Expired(now) {
+				active++
+			}
+		}
+		if active > maxActiveKeys {
+			return nil, nil, fmt.Errorf("租户 %s 同时有效的 API Key 有 %d 个，最多允许 %d 个", p.Name, active, maxActiveKeys)
+		}
+	}
+	return profiles, byAPIKey, nil
+}
+
+// ConfigPath 返回租户配置文件路径
+func ConfigPath() string {
+	return configPath()
+}
+
+// Validate 解析并校验租户配置文件，不加载到运行时，也不解析密钥引用
+// 文件不存在时返回 os.IsNotExist 错误
+func Validate(path string) ([]*Profile, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*Profile
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %v", path, err)
+	}
+	if _, _, err := index(list, time.Now()); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// resolveSecrets 将租户配置中的密钥引用替换为真实值
+// 返回配置中是否包含密钥引用
+func resolveSecrets(p *Profile) (bool, error) {
+	hasRefs := false
+	for _, t := range p.Tokens {
+		hasRefs = hasRefs || secrets.IsRef(t.Token)
+	}
+	for _, v := range p.APIKeys {
+		hasRefs = hasRefs || secrets.IsRef(v)
+	}
+	for _, k := range p.Keys {
+		hasRefs = hasRefs || secrets.IsRef(k.Key)
+	}
+	hasRefs = hasRefs || secrets.IsRef(p.AnthropicAPIKey)
+	if !hasRefs {
+		return false, nil
+	}
+
+	for i := range p.Tokens {
+		token, err := secrets.Resolve(p.Tokens[i].Token)
+		if err != nil {
+			return true, fmt.Errorf("解析密钥引用 %s 失败: %v", p.Tokens[i].Token, err)
+		}
+		p.Tokens[i].Token = token
+	}
+	apiKeys, err := secrets.ResolveAll(p.APIKeys)
+	if err != nil {
+		return true, err
+	}
+	for i := range p.Keys {
+		key, err := secrets.Resolve(p.Keys[i].Key)
+		if err != nil {
+			return true, fmt.Errorf("解析密钥引用 %s 失败: %v", p.Keys[i].Key, err)
+		}
+		p.Keys[i].Key = key
+	}
+	p.APIKeys = apiKeys
+	if p.AnthropicAPIKey != "" {
+		key, err := secrets.Resolve(p.AnthropicAPIKey)
+		if err != nil {
+			return true, fmt.Errorf("解析密钥引用 %s 失败: %v", p.AnthropicAPIKey, err)
+		}
+		p.AnthropicAPIKey = key
+	}
+	return true, nil
+}
+
+// refreshSecrets 重新从密钥后端拉取配置中引用的密钥
+func refreshSecrets() {
+	manager.mu.RLock()
+	hasRefs := manager.hasSecretRefs
+	manager.mu.RUnlock()
+	if !hasRefs {
+		return
+	}
+
+	if err := load(configPath()); err != nil {
+		fmt.Fprintf(os.Stderr, "[Tenant] 密钥刷新失败，保留旧配置: %v\n", err)
+	}
+}
+
+// loadRevoked 加载吊销列表
+// 每行一个 key，或以 "sha256:" 前缀给出 key 的 SHA256（避免在文件中保存明文）
+func loadRevoked(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	lines, err := readLines(path)
+	if err != nil {
+		return
+	}
+
+	revoked := make(map[string]struct{}, len(lines))
+	for _, line := range lines {
+		if strings.HasPrefix(line, "sha256:") {
+			revoked[strings.ToLower(strings.TrimPrefix(line, "sha256:"))] = struct{}{}
+			continue
+		}
+		revoked[hashKey(line)] = struct{}{}
+	}
+
+	manager.mu.Lock()
+	oldCount := len(manager.revoked)
+	manager.revoked = revoked
+	manager.revokedModTime = info.ModTime()
+	manager.mu.Unlock()
+
+	if oldCount != len(revoked) {
+		fmt.Fprintf(os.Stderr, "[Tenant] 吊销列表: %d→%d\n", oldCount, len(revoked))
+	}
+}
+
+func checkAndReload() {
+	if info, err := os.Stat(revokedPath()); err == nil {
+		manager.mu.RLock()
+		changed := info.ModTime().After(manager.revokedModTime)
+		manager.mu.RUnlock()
+		if changed {
+			loadRevoked(revokedPath())
+		}
+	}
+
+	path := configPath()
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	manager.mu.RLock()
+	changed := info.ModTime().After(manager.modTime)
+	oldCount := len(manager.profiles)
+	manager.mu.RUnlock()
+
+	if !changed {
+		return
+	}
+
+	if err := load(path); err != nil {
+		fmt.Fprintf(os.Stderr, "[Tenant] 热重载失败，保留旧配置: %v\n", err)
+		return
+	}
+
+	manager.mu.RLock()
+	newCount := len(manager.profiles)
+	manager.mu.RUnlock()
+	fmt.Fprintf(os.Stderr, "[Tenant] 热重载: 租户 %d→%d\n", oldCount, newCount)
+}
+
+// audit 记录 API Key 审计事件（同一 key 同类事件每小时最多记录一次）
+func audit(event, tenantName, keyHash string, expiresAt time.Time) {
+	throttleKey := event + "|" + keyHash
+	now := time.Now()
+
+	manager.mu.Lock()
+	if last, ok := manager.audited[throttleKey]; ok && now.Sub(last) < auditThrottle {
+		manager.mu.Unlock()
+		return
+	}
+	manager.audited[throttleKey] = now
+	manager.mu.Unlock()
+
+	entry := map[string]any{
+		"time":     now.UTC().Format(time.RFC3339),
+		"event":    event,
+		"tenant":   tenantName,
+		"key_hash": keyHash[:16],
+	}
+	if !expiresAt.IsZero() {
+		entry["expires_at"] = expiresAt.UTC().Format(time.RFC3339)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[Audit] %s\n", data)
+	lifecycle.Go("tenant-audit-log", func(context.Context) {
+		appendLine(filepath.Join(dataDir, "audit.log"), string(data))
+	})
+}
+
+// hashKey 计算 API Key 的 SHA256
+func hashKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// --- 文件 I/O ---
+
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+func appendLine(path string, line string) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
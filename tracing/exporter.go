@@ -0,0 +1,232 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"kiro/lifecycle"
+)
+
+const (
+	// exportBatchSize 单次导出的最大 span 数
+	exportBatchSize = 512
+	// exportInterval 定时导出间隔
+	exportInterval = 5 * time.Second
+	// exportQueueSize 待导出队列容量，队列满时丢弃新 span，避免追踪后端故障拖慢请求
+	exportQueueSize = 4096
+)
+
+// exporter OTLP/HTTP（JSON 编码）span 导出器
+type exporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+	queue    chan *Span
+	task     *lifecycle.Task
+}
+
+var exp *exporter
+
+/**
+ * Init 按标准 OTel 环境变量初始化 OTLP 导出，未配置端点时追踪保持关闭
+ * OTEL_EXPORTER_OTLP_TRACES_ENDPOINT: 完整的 traces 端点 URL
+ * OTEL_EXPORTER_OTLP_ENDPOINT: 基础 URL，自动追加 /v1/traces
+ * OTEL_EXPORTER_OTLP_HEADERS: 附加请求头，格式 k1=v1,k2=v2
+ * OTEL_SERVICE_NAME: 服务名，默认 kiro
+ */
+func Init() {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return
+	}
+
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if k, v, ok := strings.Cut(pair, "="); ok && strings.TrimSpace(k) != "" {
+			headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+
+	exp = &exporter{
+		endpoint: endpoint,
+		headers:  headers,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *Span, exportQueueSize),
+	}
+	exp.task = lifecycle.Go("otlp-exporter", exp.run)
+	fmt.Fprintf(os.Stderr, "[Tracing] OTLP 追踪已启用: %s\n", endpoint)
+}
+
+// Stop 停止导出，已排队的 span 导出后返回
+func Stop() {
+	if exp != nil {
+		exp.task.Stop()
+	}
+}
+
+func (e *exporter) enqueue(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+	}
+}
+
+func (e *exporter) run(ctx context.Context) {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, exportBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.export(batch); err != nil {
+			fmt.Fprintf(os.Stderr, "[Tracing] 导出 %d 个 span 失败: %v\n", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= exportBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			// 退出前导出已排队的 span
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *exporter) export(batch []*Span) error {
+	spans := make([]map[string]any, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, s.otlp())
+	}
+	payload := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes([]attribute{{key: "service.name", value: serviceName()}}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "kiro"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("状态码 %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// otlp 按 OTLP JSON 编码转换 span（trace/span ID 使用十六进制，64 位整数使用字符串）
+func (s *Span) otlp() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	span := map[string]any{
+		"traceId":           s.traceID,
+		"spanId":            s.spanID,
+		"name":              s.name,
+		"kind":              int(s.kind),
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attrs),
+	}
+	if s.parentID != "" {
+		span["parentSpanId"] = s.parentID
+	}
+	if len(s.events) > 0 {
+		events := make([]map[string]any, 0, len(s.events))
+		for _, ev := range s.events {
+			events = append(events, map[string]any{
+				"name":         ev.name,
+				"timeUnixNano": strconv.FormatInt(ev.time.UnixNano(), 10),
+				"attributes":   otlpAttributes(ev.attrs),
+			})
+		}
+		span["events"] = events
+	}
+	if s.statusCode != statusUnset {
+		status := map[string]any{"code": s.statusCode}
+		if s.statusMsg != "" {
+			status["message"] = s.statusMsg
+		}
+		span["status"] = status
+	}
+	return span
+}
+
+func otlpAttributes(attrs []attribute) []map[string]any {
+	out := make([]map[string]any, 0, len(attrs))
+	for _, a := range attrs {
+		out = append(out, map[string]any{"key": a.key, "value": otlpValue(a.value)})
+	}
+	return out
+}
+
+func otlpValue(v any) map[string]any {
+	switch val := v.(type) {
+	case string:
+		return map[string]any{"stringValue": val}
+	case bool:
+		return map[string]any{"boolValue": val}
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(val)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(val, 10)}
+	case float64:
+		return map[string]any{"doubleValue": val}
+	case []string:
+		values := make([]map[string]any, 0, len(val))
+		for _, s := range val {
+			values = append(values, map[string]any{"stringValue": s})
+		}
+		return map[string]any{"arrayValue": map[string]any{"values": values}}
+	default:
+		return map[string]any{"stringValue": fmt.Sprint(val)}
+	}
+}
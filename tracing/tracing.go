@@ -0,0 +1,225 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanKind OTLP span 类型
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// OTLP 状态码
+const (
+	statusUnset = 0
+	statusOK    = 1
+	statusError = 2
+)
+
+type attribute struct {
+	key   string
+	value any
+}
+
+type spanEvent struct {
+	name  string
+	time  time.Time
+	attrs []attribute
+}
+
+// Span 一次操作的追踪区间，nil Span 的所有方法均为空操作（追踪未启用时）
+type Span struct {
+	mu         sync.Mutex
+	traceID    string
+	spanID     string
+	parentID   string
+	name       string
+	kind       SpanKind
+	start      time.Time
+	end        time.Time
+	attrs      []attribute
+	events     []spanEvent
+	statusCode int
+	statusMsg  string
+	ended      bool
+}
+
+// spanContext 跨进程传播的追踪上下文（W3C traceparent）
+type spanContext struct {
+	traceID string
+	spanID  string
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// Enabled 是否已配置 OTLP 导出端点
+func Enabled() bool {
+	return exp != nil
+}
+
+/**
+ * Start 创建子 span 并写入返回的 context
+ * 父 span 取自 ctx；没有本地父 span 时使用 Extract 注入的远端上下文，否则开启新的 trace
+ */
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if exp == nil {
+		return ctx, nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	s := &Span{name: name, kind: kind, start: time.Now(), spanID: randomHex(8)}
+	if parent := FromContext(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(spanContext); ok {
+		s.traceID = remote.traceID
+		s.parentID = remote.spanID
+	} else {
+		s.traceID = randomHex(16)
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// FromContext 返回 ctx 中的当前 span，不存在时返回 nil
+func FromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+/**
+ * Extract 解析 W3C traceparent 请求头，使后续创建的 span 加入调用方的 trace
+ * 格式: 00-<32 位 trace-id>-<16 位 parent-id>-<flags>，格式错误时忽略
+ */
+func Extract(ctx context.Context, traceparent string) context.Context {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+	if !isHex(parts[1]) || !isHex(parts[2]) || strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, spanContext{traceID: strings.ToLower(parts[1]), spanID: strings.ToLower(parts[2])})
+}
+
+// TraceID 返回 span 所属 trace 的 ID
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return s.traceID
+}
+
+// TraceParent 返回 W3C traceparent 格式的上下文，用于响应头或下游传播
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.traceID, s.spanID)
+}
+
+// SetAttr 设置 span 属性，支持 string、bool、int、int64、float64 和 []string
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.attrs {
+		if s.attrs[i].key == key {
+			s.attrs[i].value = value
+			return
+		}
+	}
+	s.attrs = append(s.attrs, attribute{key: key, value: value})
+}
+
+// AddEvent 记录 span 内的时间点事件，kv 为交替的键和值
+func (s *Span) AddEvent(name string, kv ...any) {
+	if s == nil {
+		return
+	}
+	ev := spanEvent{name: name, time: time.Now()}
+	for i := 0; i+1 < len(kv); i += 2 {
+		if key, ok := kv[i].(string); ok {
+			ev.attrs = append(ev.attrs, attribute{key: key, value: kv[i+1]})
+		}
+	}
+	s.mu.Lock()
+	s.events = append(s.events, ev)
+	s.mu.Unlock()
+}
+
+// SetError 将 span 标记为失败
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.statusCode = statusError
+	s.statusMsg = err.Error()
+	s.mu.Unlock()
+}
+
+// SetOK 将 span 标记为成功
+func (s *Span) SetOK() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.statusCode == statusUnset {
+		s.statusCode = statusOK
+	}
+	s.mu.Unlock()
+}
+
+// End 结束 span 并提交导出，重复调用时忽略
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	exp.enqueue(s)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// serviceName 资源属性 service.name
+func serviceName() string {
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		return name
+	}
+	return "kiro"
+}
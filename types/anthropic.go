@@ -8,26 +8,46 @@ type AnthropicTool struct {
 	Description  string        `json:"description"`
 	InputSchema  map[string]any `json:"input_schema"`
 	CacheControl *CacheControl  `json:"cache_control,omitempty"`
+
+	// 服务端工具 web_search 的参数
+	MaxUses        int      `json:"max_uses,omitempty"`        // 单个请求的调用次数上限
+	AllowedDomains []string `json:"allowed_domains,omitempty"` // 只保留这些域名的结果
+	BlockedDomains []string `json:"blocked_domains,omitempty"` // 排除这些域名的结果
 }
 
 // ToolChoice 表示工具选择策略
 type ToolChoice struct {
-	Type string `json:"type"`           // "auto", "any", "tool"
+	Type string `json:"type"`           // "auto", "any", "tool", "none"
 	Name string `json:"name,omitempty"` // 当type为"tool"时指定的工具名称
 }
 
 // AnthropicRequest 表示 Anthropic API 的请求结构
 type AnthropicRequest struct {
-	Model       string                    `json:"model"`
-	MaxTokens   int                       `json:"max_tokens"`
-	Messages    []AnthropicRequestMessage `json:"messages"`
-	System      SystemMessages            `json:"system,omitempty"`
-	Tools       []AnthropicTool           `json:"tools,omitempty"`
-	ToolChoice  any                       `json:"tool_choice,omitempty"` // 可以是string或ToolChoice对象
-	Stream      bool                      `json:"stream"`
-	Temperature *float64                  `json:"temperature,omitempty"`
-	Metadata    map[string]any            `json:"metadata,omitempty"`
-	Thinking    *ThinkingConfig           `json:"thinking,omitempty"` // Thinking 模式配置
+	Model         string                    `json:"model"`
+	MaxTokens     int                       `json:"max_tokens"`
+	Messages      []AnthropicRequestMessage `json:"messages"`
+	System        SystemMessages            `json:"system,omitempty"`
+	Tools         []AnthropicTool           `json:"tools,omitempty"`
+	ToolChoice    any                       `json:"tool_choice,omitempty"` // 可以是string或ToolChoice对象
+	Stream        bool                      `json:"stream"`
+	Temperature   *float64                  `json:"temperature,omitempty"`
+	TopP          *float64                  `json:"top_p,omitempty"`
+	TopK          *int                      `json:"top_k,omitempty"`
+	StopSequences []string                  `json:"stop_sequences,omitempty"` // 自定义停止序列，由代理在下发文本时检测
+	Metadata      map[string]any            `json:"metadata,omitempty"`
+	Thinking      *ThinkingConfig           `json:"thinking,omitempty"` // Thinking 模式配置
+	Provider      *ProviderPreferences      `json:"provider,omitempty"` // 提供方路由偏好（OpenRouter 风格）
+}
+
+// ProviderPreferences 表示单次请求的提供方路由偏好
+type ProviderPreferences struct {
+	Order          []string `json:"order,omitempty"`           // 按优先级排列的提供方：kiro / amazonq / idc / anthropic
+	AllowFallbacks *bool    `json:"allow_fallbacks,omitempty"` // 是否允许使用 order 之外的提供方，默认 true
+}
+
+// FallbacksAllowed 是否允许使用 order 之外的提供方
+func (p *ProviderPreferences) FallbacksAllowed() bool {
+	return p == nil || p.AllowFallbacks == nil || *p.AllowFallbacks
 }
 
 // ThinkingConfig 表示 Thinking 模式配置
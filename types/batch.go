@@ -0,0 +1,61 @@
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// MessageBatchCreateRequest 表示 POST /v1/messages/batches 请求
+type MessageBatchCreateRequest struct {
+	Requests []MessageBatchRequest `json:"requests"`
+}
+
+// MessageBatchRequest 表示批次中的单个请求，params 与 /v1/messages 请求体相同（不支持流式）
+type MessageBatchRequest struct {
+	CustomID string          `json:"custom_id"`
+	Params   json.RawMessage `json:"params"`
+}
+
+// MessageBatchRequestCounts 表示批次中各状态的请求数
+type MessageBatchRequestCounts struct {
+	Processing int `json:"processing"`
+	Succeeded  int `json:"succeeded"`
+	Errored    int `json:"errored"`
+	Canceled   int `json:"canceled"`
+	Expired    int `json:"expired"`
+}
+
+// MessageBatch 表示批次对象
+type MessageBatch struct {
+	ID                string                    `json:"id"`
+	Type              string                    `json:"type"`              // 固定为 message_batch
+	ProcessingStatus  string                    `json:"processing_status"` // in_progress / canceling / ended
+	RequestCounts     MessageBatchRequestCounts `json:"request_counts"`
+	CreatedAt         time.Time                 `json:"created_at"`
+	ExpiresAt         time.Time                 `json:"expires_at"`
+	EndedAt           *time.Time                `json:"ended_at"`
+	CancelInitiatedAt *time.Time                `json:"cancel_initiated_at"`
+	ArchivedAt        *time.Time                `json:"archived_at"`
+	ResultsURL        *string                   `json:"results_url"`
+}
+
+// MessageBatchList 表示 GET /v1/messages/batches 响应
+type MessageBatchList struct {
+	Data    []MessageBatch `json:"data"`
+	HasMore bool           `json:"has_more"`
+	FirstID *string        `json:"first_id"`
+	LastID  *string        `json:"last_id"`
+}
+
+// MessageBatchResult 表示结果文件（JSONL）中的一行
+type MessageBatchResult struct {
+	CustomID string                 `json:"custom_id"`
+	Result   MessageBatchResultBody `json:"result"`
+}
+
+// MessageBatchResultBody 表示单个请求的结果：succeeded 时携带 message，errored 时携带 error
+type MessageBatchResultBody struct {
+	Type    string          `json:"type"` // succeeded / errored / canceled / expired
+	Message json.RawMessage `json:"message,omitempty"`
+	Error   json.RawMessage `json:"error,omitempty"`
+}
@@ -0,0 +1,37 @@
+package types
+
+// CapabilitiesResponse 表示 /v1/capabilities 响应：本代理实际支持的 Anthropic 特性
+type CapabilitiesResponse struct {
+	Object           string            `json:"object"`
+	Batches          bool              `json:"batches"`           // 是否支持 Message Batches API
+	CountTokens      bool              `json:"count_tokens"`      // 是否支持 /v1/messages/count_tokens
+	OpenAICompatible bool              `json:"openai_compatible"` // 是否提供 /v1/chat/completions
+	Models           []ModelCapability `json:"models"`
+}
+
+// ModelCapability 表示单个模型的能力描述
+type ModelCapability struct {
+	ID                string         `json:"id"`
+	Backend           string         `json:"backend"` // kiro / bedrock / anthropic
+	ContextWindow     int            `json:"context_window"`
+	LongContextWindow int            `json:"long_context_window,omitempty"` // 启用 context-1m beta 时的窗口，0 表示不支持
+	Features          ModelFeatures  `json:"features"`
+	Emulated          []string       `json:"emulated"` // 由代理模拟而非上游原生支持的特性
+	Betas             BetaCapability `json:"betas"`
+	ServerTools       []string       `json:"server_tools"`
+}
+
+// ModelFeatures 模型支持的特性开关
+type ModelFeatures struct {
+	Vision        bool `json:"vision"`
+	Thinking      bool `json:"thinking"`
+	ToolUse       bool `json:"tool_use"`
+	ToolStreaming bool `json:"tool_streaming"` // 工具参数通过 input_json_delta 流式返回
+	PromptCaching bool `json:"prompt_caching"`
+}
+
+// BetaCapability 描述 anthropic-beta 请求头的处理方式
+type BetaCapability struct {
+	Passthrough bool     `json:"passthrough"` // true 表示任意 beta 原样转发给上游
+	Supported   []string `json:"supported"`   // 代理识别并生效的 beta（Passthrough 为 true 时忽略）
+}
@@ -42,6 +42,8 @@ type CodeWhispererRequest struct {
 type InferenceConfig struct {
 	MaxTokens   int     `json:"maxTokens,omitempty"`
 	Temperature float64 `json:"temperature,omitempty"`
+	TopP        float64 `json:"topP,omitempty"`
+	TopK        int     `json:"topK,omitempty"`
 }
 
 // CodeWhispererImage 表示 CodeWhisperer API 的图片结构
@@ -7,9 +7,33 @@ type CountTokensRequest struct {
 	Messages []AnthropicRequestMessage `json:"messages" binding:"required"`
 	System   SystemMessages            `json:"system,omitempty"`
 	Tools    []AnthropicTool           `json:"tools,omitempty"`
+	Thinking *ThinkingConfig           `json:"thinking,omitempty"` // 启用时计入注入的 Thinking 提示
 }
 
 // CountTokensResponse 符合Anthropic官方API规范的token计数响应结构
 type CountTokensResponse struct {
 	InputTokens int `json:"input_tokens"`
 }
+
+// CountTokensBatchRequest 批量 token 计数请求（扩展），一次计算多个候选提示词
+type CountTokensBatchRequest struct {
+	Requests []CountTokensRequest `json:"requests"`
+}
+
+// CountTokensBatchError 批量计数中单条请求的错误
+type CountTokensBatchError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// CountTokensBatchResult 批量计数中单条请求的结果，成功时返回 input_tokens，失败时返回 error
+type CountTokensBatchResult struct {
+	InputTokens *int                   `json:"input_tokens,omitempty"`
+	Error       *CountTokensBatchError `json:"error,omitempty"`
+}
+
+// CountTokensBatchResponse 批量 token 计数响应
+type CountTokensBatchResponse struct {
+	Results          []CountTokensBatchResult `json:"results"`
+	TotalInputTokens int                      `json:"total_input_tokens"`
+}
@@ -0,0 +1,115 @@
+package types
+
+// OpenAIChatRequest 表示 OpenAI Chat Completions 请求结构
+type OpenAIChatRequest struct {
+	Model               string               `json:"model"`
+	Messages            []OpenAIMessage      `json:"messages"`
+	MaxTokens           int                  `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int                  `json:"max_completion_tokens,omitempty"`
+	Temperature         *float64             `json:"temperature,omitempty"`
+	TopP                *float64             `json:"top_p,omitempty"`
+	Stream              bool                 `json:"stream"`
+	StreamOptions       *OpenAIStreamOptions `json:"stream_options,omitempty"`
+	Tools               []OpenAITool         `json:"tools,omitempty"`
+	ToolChoice          any                  `json:"tool_choice,omitempty"` // "none" / "auto" / "required" 或指定函数的对象
+	Stop                any                  `json:"stop,omitempty"`        // 停止序列：字符串或字符串数组
+	User                string               `json:"user,omitempty"`
+}
+
+// OpenAIStreamOptions 流式选项
+type OpenAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// OpenAIMessage 表示 OpenAI 消息结构
+type OpenAIMessage struct {
+	Role       string           `json:"role"`
+	Content    any              `json:"content"` // 可以是 string、[]OpenAIContentPart 或 null
+	Name       string           `json:"name,omitempty"`
+	ToolCalls  []OpenAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+// OpenAITool 表示 OpenAI 工具定义
+type OpenAITool struct {
+	Type     string             `json:"type"` // "function"
+	Function OpenAIFunctionSpec `json:"function"`
+}
+
+// OpenAIFunctionSpec 表示函数定义
+type OpenAIFunctionSpec struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Parameters  map[string]any `json:"parameters,omitempty"`
+}
+
+// OpenAIToolCall 表示助手消息中的工具调用
+type OpenAIToolCall struct {
+	Index    *int               `json:"index,omitempty"` // 仅流式增量中使用
+	ID       string             `json:"id,omitempty"`
+	Type     string             `json:"type,omitempty"`
+	Function OpenAIFunctionCall `json:"function"`
+}
+
+// OpenAIFunctionCall 表示函数调用的名称和参数（参数为 JSON 字符串）
+type OpenAIFunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+// OpenAIUsage 表示 OpenAI 用量统计
+type OpenAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// OpenAIChunkDelta 表示流式增量内容
+type OpenAIChunkDelta struct {
+	Role             string           `json:"role,omitempty"`
+	Content          *string          `json:"content,omitempty"`
+	ReasoningContent *string          `json:"reasoning_content,omitempty"` // 思维链内容（非标准字段，兼容 DeepSeek 风格客户端）
+	ToolCalls        []OpenAIToolCall `json:"tool_calls,omitempty"`
+}
+
+// OpenAIChunkChoice 表示流式响应中的单个选项
+type OpenAIChunkChoice struct {
+	Index        int              `json:"index"`
+	Delta        OpenAIChunkDelta `json:"delta"`
+	FinishReason *string          `json:"finish_reason"`
+}
+
+// OpenAIChatChunk 表示 chat.completion.chunk 流式事件
+type OpenAIChatChunk struct {
+	ID      string              `json:"id"`
+	Object  string              `json:"object"`
+	Created int64               `json:"created"`
+	Model   string              `json:"model"`
+	Choices []OpenAIChunkChoice `json:"choices"`
+	Usage   *OpenAIUsage        `json:"usage,omitempty"`
+}
+
+// OpenAIResponseMessage 表示非流式响应中的助手消息
+type OpenAIResponseMessage struct {
+	Role             string           `json:"role"`
+	Content          *string          `json:"content"`
+	ReasoningContent string           `json:"reasoning_content,omitempty"`
+	ToolCalls        []OpenAIToolCall `json:"tool_calls,omitempty"`
+}
+
+// OpenAIChoice 表示非流式响应中的单个选项
+type OpenAIChoice struct {
+	Index        int                   `json:"index"`
+	Message      OpenAIResponseMessage `json:"message"`
+	FinishReason string                `json:"finish_reason"`
+}
+
+// OpenAIChatResponse 表示 chat.completion 非流式响应
+type OpenAIChatResponse struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []OpenAIChoice `json:"choices"`
+	Usage   OpenAIUsage    `json:"usage"`
+}
@@ -0,0 +1,255 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+/**
+ * 有序 JSON 序列化
+ * 先按标准 encoding/json 序列化（struct 标签、omitempty、自定义 MarshalJSON 照常生效），
+ * 再解码为保留字段顺序的树，按 OrderedSchema 补齐必需字段、调整顺序后输出。
+ * 没有对应 schema 的对象统一将 type 字段移到最前，其余字段保持原顺序（map 为按键名排序）。
+ * SSE 事件、OpenAI chunk 等所有流式输出都经此序列化，新增事件类型只需在 schema 表中登记
+ */
+
+// OrderedSchema 描述对象的字段顺序、默认值和子对象
+type OrderedSchema struct {
+	Fields   []OrderedField            // 按输出顺序排列的字段
+	Closed   bool                      // 丢弃 Fields 以外的字段，否则按原顺序追加在后
+	Children map[string]*OrderedSchema // 字段名 -> 子对象 schema（数组字段作用于每个元素）
+	Variants map[string]*OrderedSchema // 按对象的 type 字段选择 schema，未登记的类型按通用规则处理
+	// DefaultType type 字段缺失时补充的类型（与 Variants 配合使用）
+	DefaultType string
+}
+
+// OrderedField 描述单个字段
+type OrderedField struct {
+	Name string
+	// Default 字段缺失时补充的 JSON 值（如 `""`、`0`、`null`、`[]`），为空表示缺失时不输出
+	Default string
+	// OmitEmpty 值为空字符串时省略
+	OmitEmpty bool
+	// LenientOmitNull lenient 风格下值为 null 时省略
+	LenientOmitNull bool
+	// LenientOmit lenient 风格下始终省略（官方 API 后加的扩展字段）
+	LenientOmit bool
+}
+
+// orderedObject 保留字段顺序的 JSON 对象
+type orderedObject struct {
+	keys   []string
+	values map[string]any
+}
+
+func newOrderedObject() *orderedObject {
+	return &orderedObject{values: make(map[string]any)}
+}
+
+func (o *orderedObject) get(key string) (any, bool) {
+	v, ok := o.values[key]
+	return v, ok
+}
+
+// set 设置字段，新字段追加在末尾
+func (o *orderedObject) set(key string, value any) {
+	if _, exists := o.values[key]; !exists {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+// MarshalOrderedJSON 序列化 v，所有对象的 type 字段在最前
+func MarshalOrderedJSON(v any) ([]byte, error) {
+	return marshalWithSchema(v, nil, false)
+}
+
+// marshalWithSchema 序列化 v 并按 schema 补齐和排序，lenient 为 true 时省略 lenient 风格不输出的字段
+func marshalWithSchema(v any, schema *OrderedSchema, lenient bool) ([]byte, error) {
+	tree, err := toOrderedTree(v)
+	if err != nil {
+		return nil, err
+	}
+	return marshalTree(schema.apply(tree, lenient))
+}
+
+// marshalTree 输出保留字段顺序的树
+func marshalTree(tree any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeOrdered(&buf, tree); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// toOrderedTree 将任意值转换为保留字段顺序的树
+func toOrderedTree(v any) (any, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return parseOrdered(raw)
+}
+
+// parseOrdered 解析 JSON 文本为保留字段顺序的树：对象为 *orderedObject，数组为 []any，数字为 json.Number
+func parseOrdered(raw []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	return decodeOrdered(dec)
+}
+
+func decodeOrdered(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return tok, nil
+	}
+	switch delim {
+	case '{':
+		obj := newOrderedObject()
+		for dec.More() {
+			keyTok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, _ := keyTok.(string)
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj.set(key, value)
+		}
+		_, err = dec.Token()
+		return obj, err
+	default:
+		arr := []any{}
+		for dec.More() {
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		_, err = dec.Token()
+		return arr, err
+	}
+}
+
+// writeOrdered 按树中的顺序输出 JSON
+func writeOrdered(buf *bytes.Buffer, v any) error {
+	switch t := v.(type) {
+	case *orderedObject:
+		buf.WriteByte('{')
+		for i, key := range t.keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			keyJSON, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			buf.Write(keyJSON)
+			buf.WriteByte(':')
+			if err := writeOrdered(buf, t.values[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []any:
+		buf.WriteByte('[')
+		for i, item := range t {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeOrdered(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		data, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	}
+	return nil
+}
+
+// apply 按 schema 处理节点；schema 为 nil 时只将 type 字段移到最前
+func (s *OrderedSchema) apply(v any, lenient bool) any {
+	if arr, ok := v.([]any); ok {
+		for i, item := range arr {
+			arr[i] = s.apply(item, lenient)
+		}
+		return arr
+	}
+	obj, ok := v.(*orderedObject)
+	if !ok {
+		return v
+	}
+
+	schema := s.resolve(obj)
+	if schema == nil {
+		return typeFirst(obj, lenient)
+	}
+
+	out := newOrderedObject()
+	declared := make(map[string]bool, len(schema.Fields))
+	for _, field := range schema.Fields {
+		declared[field.Name] = true
+		value, exists := obj.get(field.Name)
+		if !exists {
+			if field.Default == "" {
+				continue
+			}
+			value, _ = parseOrdered([]byte(field.Default))
+		}
+		if field.OmitEmpty && value == "" {
+			continue
+		}
+		if lenient && (field.LenientOmit || (field.LenientOmitNull && value == nil)) {
+			continue
+		}
+		out.set(field.Name, schema.Children[field.Name].apply(value, lenient))
+	}
+	if !schema.Closed {
+		for _, key := range obj.keys {
+			if !declared[key] {
+				out.set(key, schema.Children[key].apply(obj.values[key], lenient))
+			}
+		}
+	}
+	return out
+}
+
+// resolve 返回对象适用的 schema：按 type 选择变体，缺失 type 时使用 DefaultType
+func (s *OrderedSchema) resolve(obj *orderedObject) *OrderedSchema {
+	if s == nil || s.Variants == nil {
+		return s
+	}
+	t, ok := obj.get("type")
+	if !ok && s.DefaultType != "" {
+		t = s.DefaultType
+		obj.set("type", t)
+	}
+	name, _ := t.(string)
+	return s.Variants[name]
+}
+
+// typeFirst 将对象及其所有子对象的 type 字段移到最前，其余字段保持原顺序
+func typeFirst(obj *orderedObject, lenient bool) *orderedObject {
+	out := newOrderedObject()
+	if t, ok := obj.get("type"); ok {
+		out.set("type", t)
+	}
+	for _, key := range obj.keys {
+		if key != "type" {
+			out.set(key, (*OrderedSchema)(nil).apply(obj.values[key], lenient))
+		}
+	}
+	return out
+}
@@ -1,9 +1,6 @@
 package types
 
-import (
-	"bytes"
-	"encoding/json"
-)
+import "strings"
 
 // ==================== SSE 事件结构（保证 type 字段在最前） ====================
 
@@ -34,6 +31,12 @@ type UsageInfo struct {
 	OutputTokens             int              `json:"output_tokens"`
 	ServiceTier              string           `json:"service_tier,omitempty"`
 	InferenceGeo             string           `json:"inference_geo,omitempty"`
+	ServerToolUse            *ServerToolUsage `json:"server_tool_use,omitempty"`
+}
+
+// ServerToolUsage 服务端工具（web_search 等）的调用次数
+type ServerToolUsage struct {
+	WebSearchRequests int `json:"web_search_requests"`
 }
 
 // CacheCreation 缓存创建详情
@@ -74,6 +77,14 @@ type SSETextContentBlock struct {
 	Text string `json:"text"`
 }
 
+// SSEServerToolResultBlock 服务端工具结果块（web_search_tool_result / code_execution_tool_result），
+// 结果在 content_block_start 中一次性给出
+type SSEServerToolResultBlock struct {
+	Type      string `json:"type"`
+	ToolUseID string `json:"tool_use_id"`
+	Content   any    `json:"content"`
+}
+
 // SSEThinkingContentBlock thinking 内容块（需要包含空 thinking 字段）
 type SSEThinkingContentBlock struct {
 	Type      string `json:"type"`
@@ -93,6 +104,12 @@ type SignatureDeltaBlock struct {
 	Signature string `json:"signature"`
 }
 
+// CitationsDeltaBlock citations 增量块，为当前文本块追加一条引用
+type CitationsDeltaBlock struct {
+	Type     string `json:"type"`
+	Citation any    `json:"citation"`
+}
+
 // ContentBlockDeltaEvent content_block_delta 事件
 // 字段顺序: type, index, delta (与官方 Claude API 一致)
 type ContentBlockDeltaEvent struct {
@@ -150,54 +167,6 @@ type PingEvent struct {
 	Type string `json:"type"`
 }
 
-// GenericOrderedEvent 通用有序事件（确保 type 在最前面）
-type GenericOrderedEvent struct {
-	Type string         `json:"type"`
-	Data map[string]any `json:"-"`
-}
-
-// MarshalJSON 自定义 JSON 序列化，确保 type 在最前面
-func (e *GenericOrderedEvent) MarshalJSON() ([]byte, error) {
-	var buf bytes.Buffer
-	buf.WriteString(`{"type":`)
-
-	typeJSON, err := json.Marshal(e.Type)
-	if err != nil {
-		return nil, err
-	}
-	buf.Write(typeJSON)
-
-	// 添加其他字段
-	for k, v := range e.Data {
-		if k == "type" {
-			continue
-		}
-		buf.WriteString(",")
-		keyJSON, err := json.Marshal(k)
-		if err != nil {
-			return nil, err
-		}
-		buf.Write(keyJSON)
-		buf.WriteString(":")
-		valJSON, err := json.Marshal(v)
-		if err != nil {
-			return nil, err
-		}
-		buf.Write(valJSON)
-	}
-
-	buf.WriteString("}")
-	return buf.Bytes(), nil
-}
-
-// NewGenericOrderedEvent 创建通用有序事件
-func NewGenericOrderedEvent(eventType string, data map[string]any) *GenericOrderedEvent {
-	return &GenericOrderedEvent{
-		Type: eventType,
-		Data: data,
-	}
-}
-
 // ErrorEvent error 事件
 type ErrorEvent struct {
 	Type  string     `json:"type"`
@@ -334,3 +303,26 @@ func NewErrorEvent(errType, message string) *ErrorEvent {
 		},
 	}
 }
+
+// ==================== 字段风格 ====================
+
+// SSEFieldStyle SSE 事件可选字段的输出风格，兼容对字段要求不同的客户端
+type SSEFieldStyle string
+
+const (
+	// SSEFieldStyleStrict 与官方 API 一致：stop_reason / stop_sequence 为空时输出 null，usage 包含 cache_creation、service_tier 等字段
+	SSEFieldStyleStrict SSEFieldStyle = "strict-anthropic"
+	// SSEFieldStyleLenient 省略值为 null 的可选字段和 usage 的扩展字段，适合遇到未知字段即报错的客户端
+	SSEFieldStyleLenient SSEFieldStyle = "lenient"
+)
+
+// ParseSSEFieldStyle 解析字段风格名称（不区分大小写），未知名称返回 false
+func ParseSSEFieldStyle(name string) (SSEFieldStyle, bool) {
+	switch SSEFieldStyle(strings.ToLower(strings.TrimSpace(name))) {
+	case SSEFieldStyleStrict:
+		return SSEFieldStyleStrict, true
+	case SSEFieldStyleLenient:
+		return SSEFieldStyleLenient, true
+	}
+	return "", false
+}
@@ -0,0 +1,135 @@
+package types
+
+import "fmt"
+
+/**
+ * Anthropic SSE 事件的字段顺序和必需字段（与官方 Claude API 一致）
+ * 事件按 type 选择 schema：type 在最前，content_block / delta 按各自的 type 补齐必需字段
+ * （文本块的 text、工具块的 input 等即使为空也必须存在），usage 只输出官方字段并补齐默认值
+ */
+
+// usageSchema usage 对象：只保留官方字段，缺失时补齐；cache_creation、service_tier、inference_geo 在 lenient 风格下省略
+var usageSchema = &OrderedSchema{
+	Closed: true,
+	Fields: []OrderedField{
+		{Name: "input_tokens", Default: "0"},
+		{Name: "cache_creation_input_tokens", Default: "0"},
+		{Name: "cache_read_input_tokens", Default: "0"},
+		{Name: "cache_creation", Default: `{"ephemeral_5m_input_tokens":0,"ephemeral_1h_input_tokens":0}`, LenientOmit: true},
+		{Name: "output_tokens", Default: "0"},
+		{Name: "service_tier", Default: `"standard"`, LenientOmit: true},
+		{Name: "inference_geo", Default: `"not_available"`, LenientOmit: true},
+		{Name: "server_tool_use"},
+	},
+	Children: map[string]*OrderedSchema{
+		"cache_creation": {Fields: []OrderedField{
+			{Name: "ephemeral_5m_input_tokens", Default: "0"},
+			{Name: "ephemeral_1h_input_tokens", Default: "0"},
+		}},
+	},
+}
+
+// toolUseBlockSchema tool_use / server_tool_use 内容块，input 始终存在
+var toolUseBlockSchema = &OrderedSchema{Fields: []OrderedField{
+	{Name: "type"},
+	{Name: "id", Default: `""`},
+	{Name: "name", Default: `""`},
+	{Name: "input", Default: "{}"},
+}}
+
+// serverToolResultBlockSchema 服务端工具结果块，结果在 content_block_start 中一次性给出
+var serverToolResultBlockSchema = &OrderedSchema{Fields: []OrderedField{
+	{Name: "type"},
+	{Name: "tool_use_id", Default: `""`},
+	{Name: "content", Default: "null"},
+}}
+
+// contentBlockSchema content_block_start 的内容块，按块类型补齐必需字段
+var contentBlockSchema = &OrderedSchema{Variants: map[string]*OrderedSchema{
+	"text":                       {Fields: []OrderedField{{Name: "type"}, {Name: "text", Default: `""`}}},
+	"thinking":                   {Fields: []OrderedField{{Name: "type"}, {Name: "thinking", Default: `""`}, {Name: "signature", OmitEmpty: true}}},
+	"tool_use":                   toolUseBlockSchema,
+	"server_tool_use":            toolUseBlockSchema,
+	"web_search_tool_result":     serverToolResultBlockSchema,
+	"code_execution_tool_result": serverToolResultBlockSchema,
+}}
+
+// deltaSchema content_block_delta 的增量块，缺失 type 时按 text_delta 处理
+var deltaSchema = &OrderedSchema{
+	DefaultType: "text_delta",
+	Variants: map[string]*OrderedSchema{
+		"text_delta":       {Fields: []OrderedField{{Name: "type"}, {Name: "text", Default: `""`}}},
+		"input_json_delta": {Fields: []OrderedField{{Name: "type"}, {Name: "partial_json", Default: `""`}}},
+		"thinking_delta":   {Fields: []OrderedField{{Name: "type"}, {Name: "thinking", Default: `""`}}},
+		"signature_delta":  {Fields: []OrderedField{{Name: "type"}, {Name: "signature", Default: `""`}}},
+		"citations_delta":  {Fields: []OrderedField{{Name: "type"}, {Name: "citation", Default: "null"}}},
+	},
+}
+
+// sseEventSchema 所有 SSE 事件，未登记的事件类型只保证 type 在最前
+var sseEventSchema = &OrderedSchema{Variants: map[string]*OrderedSchema{
+	"message_start": {
+		Fields: []OrderedField{{Name: "type"}, {Name: "message", Default: "{}"}},
+		Children: map[string]*OrderedSchema{
+			"message": {
+				Fields: []OrderedField{
+					{Name: "id", Default: `""`},
+					{Name: "type", Default: `"message"`},
+					{Name: "role", Default: `"assistant"`},
+					{Name: "content", Default: "[]"},
+					{Name: "model", Default: `""`},
+					{Name: "stop_reason", Default: "null", LenientOmitNull: true},
+					{Name: "stop_sequence", Default: "null", LenientOmitNull: true},
+					{Name: "usage", Default: "null", LenientOmitNull: true},
+				},
+				Children: map[string]*OrderedSchema{"usage": usageSchema},
+			},
+		},
+	},
+	"content_block_start": {
+		Fields:   []OrderedField{{Name: "type"}, {Name: "index", Default: "0"}, {Name: "content_block", Default: `{"type":"text","text":""}`}},
+		Children: map[string]*OrderedSchema{"content_block": contentBlockSchema},
+	},
+	"content_block_delta": {
+		Fields:   []OrderedField{{Name: "type"}, {Name: "index", Default: "0"}, {Name: "delta", Default: "{}"}},
+		Children: map[string]*OrderedSchema{"delta": deltaSchema},
+	},
+	"content_block_stop": {
+		Fields: []OrderedField{{Name: "type"}, {Name: "index", Default: "0"}},
+	},
+	"message_delta": {
+		Fields: []OrderedField{{Name: "type"}, {Name: "delta", Default: "{}"}, {Name: "usage"}},
+		Children: map[string]*OrderedSchema{
+			"delta": {Fields: []OrderedField{
+				{Name: "stop_reason", Default: `""`},
+				{Name: "stop_sequence", Default: "null", LenientOmitNull: true},
+			}},
+			"usage": usageSchema,
+		},
+	},
+	"error": {
+		Fields: []OrderedField{{Name: "type"}, {Name: "error", Default: "{}"}},
+		Children: map[string]*OrderedSchema{
+			"error": {Fields: []OrderedField{{Name: "type", Default: `"error"`}, {Name: "message", Default: `""`}}},
+		},
+	},
+}}
+
+// MarshalSSEEvent 按字段风格序列化 SSE 事件（struct 或 map 均可），返回事件类型和 JSON
+func MarshalSSEEvent(event any, style SSEFieldStyle) (string, []byte, error) {
+	tree, err := toOrderedTree(event)
+	if err != nil {
+		return "", nil, err
+	}
+	obj, ok := tree.(*orderedObject)
+	if !ok {
+		return "", nil, fmt.Errorf("SSE 事件必须是 JSON 对象: %T", event)
+	}
+	eventType, _ := obj.values["type"].(string)
+
+	data, err := marshalTree(sseEventSchema.apply(obj, style == SSEFieldStyleLenient))
+	if err != nil {
+		return "", nil, err
+	}
+	return eventType, data, nil
+}
@@ -60,4 +60,17 @@ type TokenType int
 const (
 	TokenTypeKiro    TokenType = iota // Kiro 单段式 refreshToken
 	TokenTypeAmazonQ                  // AmazonQ 三段式 clientId:clientSecret:refreshToken
+	TokenTypeIdC                      // IAM Identity Center（按区域走 OIDC 刷新）
 )
+
+// String 返回认证类型名称（用于日志）
+func (t TokenType) String() string {
+	switch t {
+	case TokenTypeAmazonQ:
+		return "AmazonQ"
+	case TokenTypeIdC:
+		return "IdC"
+	default:
+		return "Kiro"
+	}
+}
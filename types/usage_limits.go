@@ -18,6 +18,23 @@ type UsageLimits struct {
 	UsageBreakdown       any              `json:"usageBreakdown"`
 }
 
+// ResetTime 返回额度重置时间，上游未返回时为零值
+func (u *UsageLimits) ResetTime() time.Time {
+	reset := u.NextDateReset
+	if reset <= 0 {
+		for _, breakdown := range u.UsageBreakdownList {
+			if breakdown.NextDateReset > 0 {
+				reset = breakdown.NextDateReset
+				break
+			}
+		}
+	}
+	if reset <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(reset), 0)
+}
+
 // UsageBreakdown 使用详细信息
 type UsageBreakdown struct {
 	NextDateReset                float64        `json:"nextDateReset"`
@@ -0,0 +1,46 @@
+package utils
+
+import "unicode"
+
+// approxTokenizer 纯 Go 近似 token 计数，完整 tokenizer 不可用时使用
+type approxTokenizer struct{}
+
+func (approxTokenizer) Count(text string) (int, error) {
+	return approximateTokenCount(text), nil
+}
+
+// approximateTokenCount 按字符类别近似估算 token 数量
+// 按 Claude tokenizer 的典型比例校准：ASCII 单词约 4 字符 1 token，
+// 中日韩字符约 1 字符 1 token，其他文字约 2 字符 1 token，标点和换行各计 1 token
+func approximateTokenCount(text string) int {
+	tokens := 0
+	wordUnits := 0 // 当前单词累计的字符权重（每 4 个单位计 1 token）
+	flush := func() {
+		if wordUnits > 0 {
+			tokens += (wordUnits + 3) / 4
+			wordUnits = 0
+		}
+	}
+
+	for _, r := range text {
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			wordUnits++
+		case r == '\n':
+			flush()
+			tokens++
+		case unicode.IsSpace(r):
+			flush()
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			flush()
+			tokens++
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			wordUnits += 2
+		default:
+			flush()
+			tokens++
+		}
+	}
+	flush()
+	return tokens
+}
@@ -24,11 +24,11 @@ func init() {
 
 	SharedHTTPClient = &http.Client{
 		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
+			DialContext: newDialContext(&net.Dialer{
 				Timeout:   15 * time.Second,
 				KeepAlive: config.HTTPClientKeepAlive,
 				DualStack: true,
-			}).DialContext,
+			}),
 			TLSHandshakeTimeout: config.HTTPClientTLSHandshakeTimeout,
 			TLSClientConfig: &tls.Config{
 				InsecureSkipVerify: skipTLS,
@@ -52,6 +52,7 @@ func shouldSkipTLSVerify() bool {
 
 // DoRequest 执行HTTP请求（使用默认直连客户端）
 func DoRequest(req *http.Request) (*http.Response, error) {
+	markUpstreamActivity()
 	return SharedHTTPClient.Do(req)
 }
 
@@ -59,6 +60,12 @@ func DoRequest(req *http.Request) (*http.Response, error) {
 // key 通常是 token hash，用于绑定代理
 // 如果代理未启用或获取失败，回退到直连
 func DoRequestWithProxy(req *http.Request, key string) (*http.Response, error) {
+	resp, err := doRequestWithProxy(req, key)
+	return releasePacedRequest(req, resp, err)
+}
+
+func doRequestWithProxy(req *http.Request, key string) (*http.Response, error) {
+	markUpstreamActivity()
 	if !proxy.Enabled() || key == "" {
 		return SharedHTTPClient.Do(req)
 	}
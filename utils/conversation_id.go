@@ -2,6 +2,7 @@ package utils
 
 import (
 	"crypto/md5"
+	"crypto/sha1"
 	"fmt"
 	"sync"
 	"time"
@@ -102,7 +103,7 @@ func GenerateStableAgentContinuationID(ctx *gin.Context) string {
 	clientSignature := buildAgentClientSignature(ctx)
 
 	// 生成确定性GUID
-	return generateDeterministicGUID(clientSignature, "agent")
+	return formatUUID(uuidV5(uuidNamespaceURL, "kiro:"+clientSignature))
 }
 
 // buildAgentClientSignature 构建代理客户端特征签名 (SOLID-SRP: 单一职责)
@@ -117,23 +118,32 @@ func buildAgentClientSignature(ctx *gin.Context) string {
 	return fmt.Sprintf("agent|%s|%s|%s", clientIP, userAgent, timeWindow)
 }
 
-// generateDeterministicGUID 基于输入字符串生成确定性GUID (SOLID-SRP: 单一职责)
-// 遵循UUID v5规范，使用MD5哈希生成标准GUID格式
-func generateDeterministicGUID(input, namespace string) string {
-	// 在输入中加入命名空间以避免冲突
-	namespacedInput := fmt.Sprintf("%s|%s", namespace, input)
-
-	// 生成MD5哈希
-	hash := md5.Sum([]byte(namespacedInput))
+// uuidNamespaceURL RFC 4122 预定义的 URL 命名空间
+var uuidNamespaceURL = [16]byte{0x6b, 0xa7, 0xb8, 0x11, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+
+// uuidV5 按 RFC 4122 基于命名空间和名称生成确定性的 UUID v5（SHA-1），所有确定性 GUID 均由此生成
+func uuidV5(namespace [16]byte, name string) [16]byte {
+	h := sha1.New()
+	h.Write(namespace[:])
+	h.Write([]byte(name))
+	var u [16]byte
+	copy(u[:], h.Sum(nil))
+	u[6] = (u[6] & 0x0f) | 0x50 // Version 5
+	u[8] = (u[8] & 0x3f) | 0x80 // Variant bits
+	return u
+}
 
-	// 按照UUID格式重新排列字节
-	// 设置版本位 (Version 5 - 基于命名空间的UUID)
-	hash[6] = (hash[6] & 0x0f) | 0x50 // Version 5
-	hash[8] = (hash[8] & 0x3f) | 0x80 // Variant bits
+// formatUUID 格式化为标准GUID格式: xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx
+func formatUUID(u [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
 
-	// 格式化为标准GUID格式: xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx
-	return fmt.Sprintf("%x-%x-%x-%x-%x",
-		hash[0:4], hash[4:6], hash[6:8], hash[8:10], hash[10:16])
+// TenantConversationID 基于租户前缀和原始会话ID派生上游 conversationId
+// 前缀先派生出租户命名空间，再与原始会话ID生成 UUID v5：结果仍是标准 GUID，
+// 同一租户的同一会话映射稳定，已知原始会话ID时可重新计算以追溯到租户
+func TenantConversationID(prefix, conversationID string) string {
+	namespace := uuidV5(uuidNamespaceURL, "kiro:conversation-id-prefix:"+prefix)
+	return formatUUID(uuidV5(namespace, conversationID))
 }
 
 // ExtractClientInfo 提取客户端信息用于调试和日志
@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro/config"
+)
+
+// dnsEntry 域名解析缓存条目
+type dnsEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// dnsCache 上游域名解析缓存
+type dnsCache struct {
+	ttl     time.Duration
+	mu      sync.RWMutex
+	entries map[string]*dnsEntry
+}
+
+// lookup 解析域名，缓存命中时直接返回；解析失败时沿用过期的缓存结果
+func (d *dnsCache) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	d.mu.RLock()
+	entry, ok := d.entries[host]
+	d.mu.RUnlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		if ok {
+			Debug("DNS 解析失败，沿用过期结果 %s: %v", host, err)
+			return entry.ips, nil
+		}
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	if d.ttl > 0 {
+		d.mu.Lock()
+		d.entries[host] = &dnsEntry{ips: ips, expires: time.Now().Add(d.ttl)}
+		d.mu.Unlock()
+	}
+	return ips, nil
+}
+
+// upstreamDialer 带 DNS 缓存和地址族偏好的拨号器
+type upstreamDialer struct {
+	dialer     *net.Dialer
+	cache      *dnsCache
+	preference string
+}
+
+// newDialContext 构建上游连接的 DialContext
+// 未启用 DNS 缓存且无地址族偏好时直接使用标准拨号器（自带 Happy Eyeballs）
+func newDialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer.FallbackDelay = time.Duration(config.Current().HappyEyeballsDelayMs) * time.Millisecond
+
+	preference := strings.ToLower(strings.TrimSpace(config.Current().UpstreamIPPreference))
+	switch preference {
+	case "", "auto":
+		preference = ""
+	case "ipv4", "ipv6", "prefer-ipv4", "prefer-ipv6":
+	default:
+		os.Stderr.WriteString("[WARNING] 无效的 UPSTREAM_IP_PREFERENCE=" + config.Current().UpstreamIPPreference + "，使用 auto\n")
+		preference = ""
+	}
+
+	if config.Current().DNSCacheTTLSeconds <= 0 && preference == "" {
+		return dialer.DialContext
+	}
+
+	d := &upstreamDialer{
+		dialer: dialer,
+		cache: &dnsCache{
+			ttl:     time.Duration(config.Current().DNSCacheTTLSeconds) * time.Second,
+			entries: make(map[string]*dnsEntry),
+		},
+		preference: preference,
+	}
+	return d.DialContext
+}
+
+// DialContext 解析域名后按地址族偏好拨号
+func (d *upstreamDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+
+	ips, err := d.cache.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	primaries, fallbacks := d.partition(ips)
+	if len(primaries) == 0 {
+		return nil, fmt.Errorf("%s 没有符合 %s 偏好的地址", host, d.preference)
+	}
+	return d.dialParallel(ctx, network, joinAddrs(primaries, port), joinAddrs(fallbacks, port))
+}
+
+// partition 按偏好将地址分为首选和备选两组
+// auto 模式以第一个解析结果的地址族为首选（与标准库一致）
+func (d *upstreamDialer) partition(ips []net.IP) (primaries, fallbacks []net.IP) {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	switch d.preference {
+	case "ipv4":
+		return v4, nil
+	case "ipv6":
+		return v6, nil
+	case "prefer-ipv4":
+		if len(v4) == 0 {
+			return v6, nil
+		}
+		return v4, v6
+	case "prefer-ipv6":
+		if len(v6) == 0 {
+			return v4, nil
+		}
+		return v6, v4
+	}
+	if len(ips) > 0 && ips[0].To4() == nil {
+		return v6, v4
+	}
+	return v4, v6
+}
+
+// dialParallel Happy Eyeballs：首选地址依次尝试，超过 FallbackDelay 或首选全部失败时并行尝试备选地址
+func (d *upstreamDialer) dialParallel(ctx context.Context, network string, primaries, fallbacks []string) (net.Conn, error) {
+	if len(fallbacks) == 0 {
+		return d.dialSerial(ctx, network, primaries)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult, 2)
+	start := func(addrs []string) {
+		go func() {
+			conn, err := d.dialSerial(ctx, network, addrs)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	start(primaries)
+	fallbackTimer := time.NewTimer(d.dialer.FallbackDelay)
+	defer fallbackTimer.Stop()
+
+	pending, fallbackStarted := 1, false
+	var firstErr error
+	for {
+		select {
+		case <-fallbackTimer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallbacks)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// 另一组稍后连通的连接直接关闭
+				if pending > 0 {
+					go func(n int) {
+						for i := 0; i < n; i++ {
+							if late := <-results; late.conn != nil {
+								late.conn.Close()
+							}
+						}
+					}(pending)
+				}
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallbacks)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// dialSerial 依次尝试地址，返回第一个成功的连接
+func (d *upstreamDialer) dialSerial(ctx context.Context, network string, addrs []string) (net.Conn, error) {
+	var firstErr error
+	for _, addr := range addrs {
+		conn, err := d.dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// joinAddrs 将 IP 列表与端口拼接为拨号地址
+func joinAddrs(ips []net.IP, port string) []string {
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return addrs
+}
@@ -1,9 +1,11 @@
 package utils
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"strings"
+	"unicode/utf8"
 
 	"kiro/types"
 )
@@ -134,6 +136,10 @@ func GetMessageContent(content any) (string, error) {
 							if cb.Text != nil {
 								texts = append(texts, *cb.Text)
 							}
+						case "web_search_tool_result":
+							texts = append(texts, WebSearchResultText(cb.Content))
+						case "code_execution_tool_result":
+							texts = append(texts, CodeExecutionResultText(cb.Content))
 						case "image":
 							hasImage = true
 							if cb.Source != nil {
@@ -178,6 +184,10 @@ func GetMessageContent(content any) (string, error) {
 				if cb.Text != nil {
 					texts = append(texts, *cb.Text)
 				}
+			case "web_search_tool_result":
+				texts = append(texts, WebSearchResultText(cb.Content))
+			case "code_execution_tool_result":
+				texts = append(texts, CodeExecutionResultText(cb.Content))
 			case "image":
 				hasImage = true
 				if cb.Source != nil {
@@ -198,3 +208,51 @@ func GetMessageContent(content any) (string, error) {
 		return "", fmt.Errorf("unsupported content type: %T", v)
 	}
 }
+
+/**
+ * WebSearchResultText 将客户端回传的 web_search_tool_result 内容转为文本，保留搜索来源供后续轮次参考
+ * 本代理生成的 encrypted_content 是摘要的 base64，能解码为有效 UTF-8 时一并附上
+ */
+func WebSearchResultText(content any) string {
+	items, ok := content.([]any)
+	if !ok {
+		if m, ok := content.(map[string]any); ok {
+			code, _ := m["error_code"].(string)
+			return "Web search failed: " + code
+		}
+		return "Web search returned no results"
+	}
+
+	var b strings.Builder
+	b.WriteString("Web search results:")
+	for i, item := range items {
+		result, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		title, _ := result["title"].(string)
+		url, _ := result["url"].(string)
+		fmt.Fprintf(&b, "\n%d. %s (%s)", i+1, title, url)
+		if encoded, ok := result["encrypted_content"].(string); ok {
+			if snippet, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(snippet) > 0 && utf8.Valid(snippet) {
+				b.WriteString("\n   " + string(snippet))
+			}
+		}
+	}
+	return b.String()
+}
+
+// CodeExecutionResultText 将客户端回传的 code_execution_tool_result 内容转为文本
+func CodeExecutionResultText(content any) string {
+	m, ok := content.(map[string]any)
+	if !ok {
+		return "Code execution returned no result"
+	}
+	if code, ok := m["error_code"].(string); ok {
+		return "Code execution failed: " + code
+	}
+	stdout, _ := m["stdout"].(string)
+	stderr, _ := m["stderr"].(string)
+	returnCode, _ := m["return_code"].(float64)
+	return fmt.Sprintf("Code execution result (return_code: %d):\nstdout:\n%s\nstderr:\n%s", int(returnCode), stdout, stderr)
+}
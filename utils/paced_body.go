@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kiro/config"
+)
+
+// ErrUpstreamWriteStalled 上游请求体写入停滞
+var ErrUpstreamWriteStalled = errors.New("上游请求体写入停滞，连接可能已阻塞")
+
+// PaceRequestBody 为大请求体启用令牌桶平滑写入与停滞监控
+// 请求体小于 UpstreamPacingThreshold 时原样返回
+// 写入停滞超过 UpstreamWriteStallTimeout 时取消请求，错误可用 errors.Is(err, ErrUpstreamWriteStalled) 判断
+// 平滑写入创建的子 context 在响应体关闭或请求失败时释放（见 releasePacedRequest）
+func PaceRequestBody(req *http.Request) *http.Request {
+	if req.Body == nil || req.ContentLength < config.UpstreamPacingThreshold {
+		return req
+	}
+
+	ctx, cancel := context.WithCancelCause(req.Context())
+	body := &pacedReader{
+		inner:  req.Body,
+		cancel: cancel,
+		rate:   float64(config.Current().UpstreamWriteRateKB) * 1024,
+		last:   time.Now(),
+	}
+	body.tokens = body.rate
+	body.stall = time.AfterFunc(config.UpstreamWriteStallTimeout, func() {
+		Error("上游请求体写入停滞超过 %v，已写入 %d/%d 字节，中止请求",
+			config.UpstreamWriteStallTimeout, body.written.Load(), req.ContentLength)
+		cancel(ErrUpstreamWriteStalled)
+	})
+
+	Debug("上游请求体 %d 字节，启用平滑写入 (%d KB/s)", req.ContentLength, config.Current().UpstreamWriteRateKB)
+
+	paced := req.WithContext(ctx)
+	paced.Body = body
+	return paced
+}
+
+// pacedReader 令牌桶限速读取器
+// http.Transport 在连接可写时才会继续 Read，两次 Read 间隔过长即视为写入停滞
+type pacedReader struct {
+	inner   io.ReadCloser
+	rate    float64 // 字节/秒，<=0 表示不限速
+	tokens  float64
+	last    time.Time
+	written atomic.Int64
+	stall   *time.Timer
+	cancel  context.CancelCauseFunc
+	once    sync.Once
+}
+
+func (r *pacedReader) Read(p []byte) (int, error) {
+	r.stall.Stop()
+
+	if r.rate > 0 {
+		// 单次读取不超过桶容量（1 秒的配额）
+		if len(p) > int(r.rate) {
+			p = p[:int(r.rate)]
+		}
+		r.wait(len(p))
+	}
+
+	n, err := r.inner.Read(p)
+	r.written.Add(int64(n))
+	if err != nil {
+		r.finish()
+		return n, err
+	}
+
+	r.stall.Reset(config.UpstreamWriteStallTimeout)
+	return n, nil
+}
+
+// wait 等待令牌桶中有足够的配额
+func (r *pacedReader) wait(n int) {
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+
+	if r.tokens < float64(n) {
+		time.Sleep(time.Duration((float64(n) - r.tokens) / r.rate * float64(time.Second)))
+		r.tokens = 0
+		r.last = time.Now()
+		return
+	}
+	r.tokens -= float64(n)
+}
+
+// finish 请求体写完或关闭后停止停滞监控
+func (r *pacedReader) finish() {
+	r.once.Do(func() { r.stall.Stop() })
+}
+
+// Close 停止停滞监控
+// 传输层写完请求体即关闭请求体，此时响应仍在读取，因此不在这里取消子 context
+func (r *pacedReader) Close() error {
+	r.finish()
+	return r.inner.Close()
+}
+
+// release 停止停滞监控并释放子 context
+func (r *pacedReader) release() {
+	r.finish()
+	r.cancel(nil)
+}
+
+// releasePacedRequest 请求失败时立即释放平滑写入的子 context，成功时在响应体关闭后释放
+func releasePacedRequest(req *http.Request, resp *http.Response, err error) (*http.Response, error) {
+	body, ok := req.Body.(*pacedReader)
+	if !ok {
+		return resp, err
+	}
+	if err != nil || resp == nil {
+		body.release()
+		return resp, err
+	}
+	resp.Body = ReleaseOnClose(resp.Body, body.release)
+	return resp, nil
+}
+
+// ReleaseOnClose 包装响应体，关闭后调用 release 释放为该请求派生的子 context
+func ReleaseOnClose(body io.ReadCloser, release func()) io.ReadCloser {
+	return &releasingBody{ReadCloser: body, release: release}
+}
+
+// releasingBody 关闭时释放请求子 context 的响应体
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+// appliedPoliciesKey gin 上下文中记录已生效策略的键
+const appliedPoliciesKey = "appliedPolicies"
+
+// PolicyDecision 请求处理过程中生效的一项策略（路由规则、修复、截断、缓存决策等）
+type PolicyDecision struct {
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+// RecordPolicy 记录本次请求生效的策略，供调试回显（X-Kiro-Debug）使用；ctx 为 nil 时忽略
+func RecordPolicy(ctx *gin.Context, kind, format string, args ...any) {
+	if ctx == nil {
+		return
+	}
+	decisions := AppliedPolicies(ctx)
+	ctx.Set(appliedPoliciesKey, append(decisions, PolicyDecision{Kind: kind, Detail: fmt.Sprintf(format, args...)}))
+}
+
+// AppliedPolicies 返回本次请求已记录的策略
+func AppliedPolicies(ctx *gin.Context) []PolicyDecision {
+	if ctx == nil {
+		return nil
+	}
+	if v, ok := ctx.Get(appliedPoliciesKey); ok {
+		if decisions, ok2 := v.([]PolicyDecision); ok2 {
+			return decisions
+		}
+	}
+	return nil
+}
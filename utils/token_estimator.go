@@ -1,80 +1,88 @@
 package utils
 
 import (
-	"embed"
 	"fmt"
-	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 
+	"kiro/config"
 	"kiro/types"
-
-	"github.com/sugarme/tokenizer"
-	"github.com/sugarme/tokenizer/pretrained"
 )
 
-//go:embed claude_tokenizer.json
-var embeddedTokenizer embed.FS
+// textTokenizer 文本分词计数接口
+type textTokenizer interface {
+	Count(text string) (int, error)
+}
 
 var (
-	claudeTokenizer *tokenizer.Tokenizer
-	initOnce        sync.Once
-	initErr         error
+	activeTokenizer textTokenizer
+	selectOnce      sync.Once
+	// tokenizerLoadErr 完整 tokenizer 的加载错误，非空表示已降级为近似计数
+	tokenizerLoadErr error
+	// tokenizerRuntimeErrors 运行期分词失败（已降级为近似计数）的次数
+	tokenizerRuntimeErrors atomic.Int64
 )
 
-// getClaudeTokenizer 获取 Claude tokenizer（单例）
-func getClaudeTokenizer() (*tokenizer.Tokenizer, error) {
-	initOnce.Do(func() {
-		// 从嵌入的文件系统读取 tokenizer.json
-		data, err := embeddedTokenizer.ReadFile("claude_tokenizer.json")
-		if err != nil {
-			initErr = fmt.Errorf("failed to read embedded tokenizer: %w", err)
+// selectTokenizer 选择 token 计数实现（单例）
+// TOKENIZER=approx 时强制使用近似计数；完整 tokenizer 加载失败（如部分 ARM64/musl 环境）时自动降级
+func selectTokenizer() textTokenizer {
+	selectOnce.Do(func() {
+		if config.Current().Tokenizer == "approx" {
+			activeTokenizer = approxTokenizer{}
 			return
 		}
-
-		// 创建临时文件（pretrained.FromFile 需要文件路径）
-		// 使用当前目录，避免 /tmp 在某些容器中不存在的问题
-		tmpFile, err := os.CreateTemp(".", ".claude_tokenizer_*.json")
+		tk, err := loadFullTokenizer()
 		if err != nil {
-			initErr = fmt.Errorf("failed to create temp file: %w", err)
+			tokenizerLoadErr = fmt.Errorf("Claude tokenizer 加载失败: %w", err)
+			activeTokenizer = approxTokenizer{}
 			return
 		}
-		tmpPath := tmpFile.Name()
+		activeTokenizer = tk
+	})
+	return activeTokenizer
+}
 
-		// 写入数据并关闭文件
-		if _, err := tmpFile.Write(data); err != nil {
-			tmpFile.Close()
-			os.Remove(tmpPath)
-			initErr = fmt.Errorf("failed to write temp file: %w", err)
-			return
-		}
-		if err := tmpFile.Close(); err != nil {
-			os.Remove(tmpPath)
-			initErr = fmt.Errorf("failed to close temp file: %w", err)
-			return
-		}
+// InitTokenizer 预加载 token 计数实现，返回完整 tokenizer 的加载错误
+// 加载失败时不会中断服务，后续计数自动使用近似算法
+func InitTokenizer() error {
+	selectTokenizer()
+	return tokenizerLoadErr
+}
 
-		// 加载 tokenizer
-		claudeTokenizer, initErr = pretrained.FromFile(tmpPath)
+// TokenizerHealth token 计数实现的健康状态
+type TokenizerHealth struct {
+	Mode          string `json:"mode"` // full / approx
+	Degraded      bool   `json:"degraded"`
+	Error         string `json:"error,omitempty"`
+	RuntimeErrors int64  `json:"runtime_errors"`
+}
 
-		// 清理临时文件
-		os.Remove(tmpPath)
-	})
-	return claudeTokenizer, initErr
+// GetTokenizerHealth 返回 token 计数实现的健康状态
+// 完整 tokenizer 加载失败或运行期出现分词错误时标记为降级；TOKENIZER=approx 主动选择近似计数不视为降级
+func GetTokenizerHealth() TokenizerHealth {
+	h := TokenizerHealth{Mode: "full", RuntimeErrors: tokenizerRuntimeErrors.Load()}
+	if _, ok := selectTokenizer().(approxTokenizer); ok {
+		h.Mode = "approx"
+	}
+	if tokenizerLoadErr != nil {
+		h.Degraded = true
+		h.Error = tokenizerLoadErr.Error()
+	}
+	if h.RuntimeErrors > 0 {
+		h.Degraded = true
+	}
+	return h
 }
 
 // TokenEstimator Claude token 计算器
 type TokenEstimator struct {
-	tokenizer *tokenizer.Tokenizer
+	tokenizer textTokenizer
 }
 
 // NewTokenEstimator 创建 token 估算器实例
 func NewTokenEstimator() *TokenEstimator {
-	tk, err := getClaudeTokenizer()
-	if err != nil {
-		panic("failed to initialize Claude tokenizer: " + err.Error())
-	}
-	return &TokenEstimator{tokenizer: tk}
+	return &TokenEstimator{tokenizer: selectTokenizer()}
 }
 
 // EstimateTokens 计算消息的 token 数量
@@ -164,14 +172,17 @@ func (e *TokenEstimator) EstimateToolUseTokens(toolName string, toolInput map[st
 	return totalTokens
 }
 
-// countTokens 使用 Claude tokenizer 计算 token 数量
+// countTokens 使用当前 tokenizer 计算 token 数量
 func (e *TokenEstimator) countTokens(text string) int {
-	en, err := e.tokenizer.EncodeSingle(text, true)
+	n, err := e.tokenizer.Count(text)
 	if err != nil {
-		// 降级到字符估算
-		return len([]rune(text))
+		// 降级到近似计数
+		if tokenizerRuntimeErrors.Add(1) == 1 {
+			Error("分词失败，已降级为近似计数: %v", err)
+		}
+		return approximateTokenCount(text)
 	}
-	return len(en.Ids)
+	return n
 }
 
 // estimateContentBlock 计算单个内容块的 token 数量
@@ -0,0 +1,73 @@
+//go:build !notokenizer
+
+package utils
+
+import (
+	"embed"
+	"fmt"
+	"os"
+
+	"github.com/sugarme/tokenizer"
+	"github.com/sugarme/tokenizer/pretrained"
+)
+
+//go:embed claude_tokenizer.json
+var embeddedTokenizer embed.FS
+
+// claudeTokenizer 基于嵌入词表的完整 Claude tokenizer
+type claudeTokenizer struct {
+	tk *tokenizer.Tokenizer
+}
+
+// Count 计算文本 token 数，分词库内部 panic 转为错误返回
+func (t claudeTokenizer) Count(text string) (n int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("tokenizer panic: %v", r)
+		}
+	}()
+	en, err := t.tk.EncodeSingle(text, true)
+	if err != nil {
+		return 0, err
+	}
+	return len(en.Ids), nil
+}
+
+// loadFullTokenizer 从嵌入文件加载完整 tokenizer
+func loadFullTokenizer() (tt textTokenizer, err error) {
+	// 从嵌入的文件系统读取 tokenizer.json
+	data, err := embeddedTokenizer.ReadFile("claude_tokenizer.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embedded tokenizer: %w", err)
+	}
+
+	// 创建临时文件（pretrained.FromFile 需要文件路径）
+	// 使用当前目录，避免 /tmp 在某些容器中不存在的问题
+	tmpFile, err := os.CreateTemp(".", ".claude_tokenizer_*.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	// 写入数据并关闭文件
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return nil, fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close temp file: %w", err)
+	}
+
+	// 加载 tokenizer（分词库在词表异常时可能 panic）
+	defer func() {
+		if r := recover(); r != nil {
+			tt, err = nil, fmt.Errorf("tokenizer panic: %v", r)
+		}
+	}()
+	tk, err := pretrained.FromFile(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	return claudeTokenizer{tk: tk}, nil
+}
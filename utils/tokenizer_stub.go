@@ -0,0 +1,8 @@
+//go:build notokenizer
+
+package utils
+
+// loadFullTokenizer 使用 -tags notokenizer 构建时不包含完整 tokenizer，始终使用近似计数
+func loadFullTokenizer() (textTokenizer, error) {
+	return approxTokenizer{}, nil
+}
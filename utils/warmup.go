@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"kiro/config"
+	"kiro/lifecycle"
+)
+
+// lastUpstreamActivity 最近一次上游请求的时间（UnixNano），用于判断连接是否空闲
+var lastUpstreamActivity atomic.Int64
+
+// warmerTask 连接预热任务
+var warmerTask *lifecycle.Task
+
+// markUpstreamActivity 记录上游请求活动
+func markUpstreamActivity() {
+	lastUpstreamActivity.Store(time.Now().UnixNano())
+}
+
+// warmupOrigins 需要预热的上游地址
+// 固定包含 CodeWhisperer（及配置的多区域端点）与 Kiro 刷新端点，OIDC 端点按 UPSTREAM_WARMUP_REGIONS 逐区域添加（默认 us-east-1）
+func warmupOrigins() []string {
+	endpoints := []string{config.Current().CodeWhispererURL, config.Current().RefreshTokenURL}
+	for _, ep := range config.Current().UpstreamEndpoints {
+		endpoints = append(endpoints, ep.URL)
+	}
+
+	regions := os.Getenv("UPSTREAM_WARMUP_REGIONS")
+	if regions == "" {
+		regions = "us-east-1"
+	}
+	for _, region := range strings.Split(regions, ",") {
+		if region = strings.TrimSpace(region); region != "" {
+			endpoints = append(endpoints, fmt.Sprintf(config.Current().OIDCTokenURLFormat, region))
+		}
+	}
+
+	seen := make(map[string]bool)
+	var origins []string
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil || seen[u.Host] {
+			continue
+		}
+		seen[u.Host] = true
+		origins = append(origins, u.Scheme+"://"+u.Host+"/")
+	}
+	return origins
+}
+
+// warmConnections 向各上游地址发送 HEAD 请求，建立的 TLS 连接留在共享客户端的空闲连接池中
+func warmConnections(origins []string) {
+	for _, origin := range origins {
+		req, err := http.NewRequest(http.MethodHead, origin, nil)
+		if err != nil {
+			continue
+		}
+		start := time.Now()
+		resp, err := SharedHTTPClient.Do(req)
+		if err != nil {
+			Debug("上游连接预热失败 %s: %v", origin, err)
+			continue
+		}
+		// 读完响应体连接才会回到空闲池
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		Debug("上游连接预热完成 %s (%v)", origin, time.Since(start))
+	}
+}
+
+// StartConnectionWarmer 启动上游连接预热
+// 启动时立即预热一次，之后每个间隔检查一次，上游空闲超过间隔时重新预热
+// 仅预热直连客户端，经代理的连接不受影响
+func StartConnectionWarmer() {
+	if config.Current().UpstreamWarmupIntervalSeconds <= 0 {
+		return
+	}
+	interval := time.Duration(config.Current().UpstreamWarmupIntervalSeconds) * time.Second
+	origins := warmupOrigins()
+	Info("上游连接预热已启用 (间隔: %v, 地址: %d 个)", interval, len(origins))
+
+	warmerTask.Stop()
+	warmerTask = lifecycle.Go("connection-warmer", func(ctx context.Context) {
+		warmConnections(origins)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if time.Since(time.Unix(0, lastUpstreamActivity.Load())) >= interval {
+					warmConnections(origins)
+				}
+			}
+		}
+	})
+}
+
+// StopConnectionWarmer 停止上游连接预热
+func StopConnectionWarmer() {
+	warmerTask.Stop()
+}